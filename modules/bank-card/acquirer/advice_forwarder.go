@@ -0,0 +1,89 @@
+package acquirer
+
+import (
+	"sync"
+	"time"
+
+	"golang.org/x/exp/slog"
+)
+
+// adviceForwarder sends the queued advices when one is queued, when the
+// client signs on (again) and every interval until the issuer acknowledges
+// them.
+type adviceForwarder struct {
+	acquirer *Service
+	interval time.Duration
+	logger   *slog.Logger
+
+	// parked is how many advices were parked after the last run
+	parked int
+
+	stop chan struct{}
+	wg   sync.WaitGroup
+}
+
+func newAdviceForwarder(logger *slog.Logger, acquirer *Service, interval time.Duration) *adviceForwarder {
+	return &adviceForwarder{
+		acquirer: acquirer,
+		interval: interval,
+		logger:   logger.With(slog.String("type", "advice-forwarder")),
+		stop:     make(chan struct{}),
+	}
+}
+
+// Start runs the forwarder in a background goroutine until Stop is called.
+func (f *adviceForwarder) Start() {
+	f.wg.Add(1)
+	go func() {
+		defer f.wg.Done()
+
+		f.logger.Info("advice forwarder started", slog.Duration("interval", f.interval))
+
+		ticker := time.NewTicker(f.interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-f.stop:
+				f.logger.Info("advice forwarder stopped")
+				return
+			case <-f.acquirer.adviceQueued:
+				f.forward()
+			case <-ticker.C:
+				f.forward()
+			}
+		}
+	}()
+}
+
+// Trigger makes the forwarder run as soon as possible, e.g. after a reconnect.
+func (f *adviceForwarder) Trigger() {
+	select {
+	case f.acquirer.adviceQueued <- struct{}{}:
+	default:
+	}
+}
+
+// Stop signals the forwarder to exit and waits for the current run to finish.
+func (f *adviceForwarder) Stop() {
+	close(f.stop)
+	f.wg.Wait()
+}
+
+func (f *adviceForwarder) forward() {
+	n, err := f.acquirer.ForwardAdvices()
+	if err != nil {
+		f.logger.Warn("forwarding advices", "err", err)
+	}
+
+	if n > 0 {
+		f.logger.Info("advices forwarded", slog.Int("forwarded", n))
+	}
+
+	// parked advices need someone to look at them
+	parked := len(f.acquirer.ParkedAdvices())
+	if parked > f.parked {
+		f.logger.Warn("advices parked for manual handling", slog.Int("parked", parked))
+	}
+	f.parked = parked
+}
@@ -0,0 +1,134 @@
+package acquirer
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/alovak/cardflow-playground/acquirer/models"
+)
+
+// AdviceQueue holds the advices that were not acknowledged by the issuer yet,
+// in the order they have to be forwarded, and the parked ones the issuer
+// rejected. When it has a path, every change is written to that file so
+// queued advices survive a restart.
+type AdviceQueue struct {
+	mu sync.Mutex
+
+	path    string
+	advices []*models.Advice
+}
+
+// NewAdviceQueue loads the queue from path. An empty path keeps the queue in
+// memory only.
+func NewAdviceQueue(path string) (*AdviceQueue, error) {
+	q := &AdviceQueue{path: path}
+
+	if path == "" {
+		return q, nil
+	}
+
+	if err := loadQueueFile(path, &q.advices); err != nil {
+		return nil, fmt.Errorf("loading advice queue: %w", err)
+	}
+
+	return q, nil
+}
+
+// Add appends the advice to the end of the queue.
+func (q *AdviceQueue) Add(advice *models.Advice) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.advices = append(q.advices, advice)
+
+	return q.save()
+}
+
+// Pending returns copies of the queued advices that are not parked, oldest
+// first.
+func (q *AdviceQueue) Pending() []models.Advice {
+	return q.list(false)
+}
+
+// Parked returns copies of the parked advices, oldest first.
+func (q *AdviceQueue) Parked() []models.Advice {
+	return q.list(true)
+}
+
+func (q *AdviceQueue) list(parked bool) []models.Advice {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	list := make([]models.Advice, 0, len(q.advices))
+	for _, a := range q.advices {
+		if a.ParkedAt.IsZero() != parked {
+			list = append(list, *a)
+		}
+	}
+
+	return list
+}
+
+// Update stores the attempt counters and the rejections of a queued advice.
+func (q *AdviceQueue) Update(advice models.Advice) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	for _, a := range q.advices {
+		if a.ID == advice.ID {
+			a.Attempts = advice.Attempts
+			a.LastAttemptAt = advice.LastAttemptAt
+			a.Rejections = advice.Rejections
+			a.ResponseCode = advice.ResponseCode
+			return q.save()
+		}
+	}
+
+	return ErrNotFound
+}
+
+// Park takes the advice out of forwarding, keeping it in the file for
+// manual handling with its rejections.
+func (q *AdviceQueue) Park(advice models.Advice) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	for _, a := range q.advices {
+		if a.ID == advice.ID {
+			a.Rejections = advice.Rejections
+			a.ResponseCode = advice.ResponseCode
+			a.ParkedAt = time.Now()
+			return q.save()
+		}
+	}
+
+	return ErrNotFound
+}
+
+// Remove drops the advice once the issuer acknowledged it.
+func (q *AdviceQueue) Remove(adviceID string) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	for i, a := range q.advices {
+		if a.ID == adviceID {
+			q.advices = append(q.advices[:i], q.advices[i+1:]...)
+			return q.save()
+		}
+	}
+
+	return ErrNotFound
+}
+
+func (q *AdviceQueue) save() error {
+	if q.path == "" {
+		return nil
+	}
+
+	if err := saveQueueFile(q.path, q.advices); err != nil {
+		return fmt.Errorf("saving advice queue: %w", err)
+	}
+
+	return nil
+}
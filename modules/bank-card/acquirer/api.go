@@ -3,6 +3,7 @@ package acquirer
 import (
 	"encoding/json"
 	"errors"
+	"io"
 	"net/http"
 
 	"github.com/alovak/cardflow-playground/acquirer/models"
@@ -10,9 +11,14 @@ import (
 	"golang.org/x/exp/slog"
 )
 
+const maxIdempotencyKeyLength = 255
+
 type API struct {
 	acquirer *Service
 	logger   *slog.Logger
+
+	// clearingDir is where clearing files are written when batches are closed
+	clearingDir string
 }
 
 func NewAPI(logger *slog.Logger, acquirer *Service) *API {
@@ -26,10 +32,27 @@ func (a *API) AppendRoutes(r chi.Router) {
 	r.Route("/merchants", func(r chi.Router) {
 		r.Post("/", a.createMerchant)
 		r.Route("/{merchantID}", func(r chi.Router) {
+			r.Post("/terminals", a.createTerminal)
+			r.Get("/terminals", a.listTerminals)
 			r.Post("/payments", a.createPayment)
+			r.Post("/payments/offline", a.createOfflinePayment)
 			r.Get("/payments/{paymentID}", a.getPayment)
+			r.Post("/payments/{paymentID}/reversal-advice", a.adviseReversal)
+			r.Post("/payments/{paymentID}/capture", a.capturePayment)
+			r.Post("/payments/{paymentID}/void", a.voidPayment)
+			r.Post("/payments/{paymentID}/refunds", a.createRefund)
+			r.Get("/payments/{paymentID}/chargebacks", a.listChargebacks)
+			r.Post("/chargebacks/{chargebackID}/representment", a.submitRepresentment)
+			r.Get("/batches", a.listBatches)
 		})
 	})
+	r.Post("/batches/close", a.closeBatches)
+	r.Get("/reversals/parked", a.listParkedReversals)
+	r.Get("/advices/parked", a.listParkedAdvices)
+	// chargebacks and the issuers' responses to representments arrive from
+	// the card network
+	r.Post("/chargebacks", a.receiveChargeback)
+	r.Put("/chargebacks/{chargebackID}/status", a.changeChargebackStatus)
 }
 
 func (a *API) createMerchant(w http.ResponseWriter, r *http.Request) {
@@ -51,6 +74,55 @@ func (a *API) createMerchant(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(account)
 }
 
+func (a *API) createTerminal(w http.ResponseWriter, r *http.Request) {
+	merchantID := chi.URLParam(r, "merchantID")
+
+	create := models.CreateTerminal{}
+	// the body is optional, a TID is generated without one
+	if err := json.NewDecoder(r.Body).Decode(&create); err != nil && !errors.Is(err, io.EOF) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	terminal, err := a.acquirer.CreateTerminal(merchantID, create)
+	if err != nil {
+		switch {
+		case errors.Is(err, ErrNotFound):
+			http.Error(w, err.Error(), http.StatusNotFound)
+		case errors.Is(err, ErrInvalidTerminalID):
+			http.Error(w, err.Error(), http.StatusBadRequest)
+		case errors.Is(err, ErrTerminalExists):
+			http.Error(w, err.Error(), http.StatusConflict)
+		default:
+			a.logger.Error("failed to create terminal", "err", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(terminal)
+}
+
+func (a *API) listTerminals(w http.ResponseWriter, r *http.Request) {
+	merchantID := chi.URLParam(r, "merchantID")
+
+	terminals, err := a.acquirer.ListTerminals(merchantID)
+	if err != nil {
+		if errors.Is(err, ErrNotFound) {
+			http.Error(w, err.Error(), http.StatusNotFound)
+		} else {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(terminals)
+}
+
 func (a *API) createPayment(w http.ResponseWriter, r *http.Request) {
 	merchantID := chi.URLParam(r, "merchantID")
 
@@ -61,14 +133,41 @@ func (a *API) createPayment(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	payment, err := a.acquirer.CreatePayment(merchantID, create)
+	// a retried request with the same Idempotency-Key gets the first payment
+	// back instead of authorizing again
+	idempotencyKey := r.Header.Get("Idempotency-Key")
+	if len(idempotencyKey) > maxIdempotencyKeyLength {
+		http.Error(w, "Idempotency-Key is too long", http.StatusBadRequest)
+		return
+	}
+
+	var payment *models.Payment
+	var replayed bool
+	if idempotencyKey == "" {
+		payment, err = a.acquirer.CreatePayment(merchantID, create)
+	} else {
+		payment, replayed, err = a.acquirer.CreatePaymentIdempotently(merchantID, idempotencyKey, create)
+	}
 	if err != nil {
-		a.logger.Error("failed to create payment", "err", err)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		switch {
+		case errors.Is(err, ErrIdempotencyKeyReused), errors.Is(err, ErrIdempotencyKeyInProgress):
+			http.Error(w, err.Error(), http.StatusConflict)
+		case errors.Is(err, ErrInvalidCardNumber):
+			http.Error(w, err.Error(), http.StatusBadRequest)
+		case errors.Is(err, ErrNotFound):
+			// unknown merchant or terminal
+			http.Error(w, err.Error(), http.StatusNotFound)
+		default:
+			a.logger.Error("failed to create payment", "err", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
 		return
 	}
 
 	w.Header().Set("Content-Type", "application/json")
+	if replayed {
+		w.Header().Set("Idempotent-Replayed", "true")
+	}
 	w.WriteHeader(http.StatusCreated)
 	json.NewEncoder(w).Encode(payment)
 }
@@ -91,3 +190,291 @@ func (a *API) getPayment(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(http.StatusOK)
 	json.NewEncoder(w).Encode(payment)
 }
+
+func (a *API) createOfflinePayment(w http.ResponseWriter, r *http.Request) {
+	merchantID := chi.URLParam(r, "merchantID")
+
+	create := models.CreateOfflinePayment{}
+	err := json.NewDecoder(r.Body).Decode(&create)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	payment, err := a.acquirer.CreateOfflinePayment(merchantID, create)
+	if err != nil {
+		switch {
+		case errors.Is(err, ErrInvalidCardNumber):
+			http.Error(w, err.Error(), http.StatusBadRequest)
+		case errors.Is(err, ErrNotFound):
+			http.Error(w, err.Error(), http.StatusNotFound)
+		default:
+			a.logger.Error("failed to create offline payment", "err", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(payment)
+}
+
+func (a *API) adviseReversal(w http.ResponseWriter, r *http.Request) {
+	merchantID := chi.URLParam(r, "merchantID")
+	paymentID := chi.URLParam(r, "paymentID")
+
+	payment, err := a.acquirer.AdviseReversal(merchantID, paymentID)
+	if err != nil {
+		switch {
+		case errors.Is(err, ErrNotFound):
+			http.Error(w, err.Error(), http.StatusNotFound)
+		case errors.Is(err, ErrInvalidPaymentStatus):
+			http.Error(w, err.Error(), http.StatusConflict)
+		default:
+			a.logger.Error("failed to advise reversal", "err", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(payment)
+}
+
+// capturePayment captures the payment; an empty body captures everything that
+// was not captured yet.
+func (a *API) capturePayment(w http.ResponseWriter, r *http.Request) {
+	merchantID := chi.URLParam(r, "merchantID")
+	paymentID := chi.URLParam(r, "paymentID")
+
+	capture := models.CapturePayment{}
+	err := json.NewDecoder(r.Body).Decode(&capture)
+	if err != nil && !errors.Is(err, io.EOF) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	payment, err := a.acquirer.CapturePayment(merchantID, paymentID, capture)
+	if err != nil {
+		a.followUpError(w, "failed to capture payment", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(payment)
+}
+
+func (a *API) voidPayment(w http.ResponseWriter, r *http.Request) {
+	merchantID := chi.URLParam(r, "merchantID")
+	paymentID := chi.URLParam(r, "paymentID")
+
+	payment, err := a.acquirer.VoidPayment(merchantID, paymentID)
+	if err != nil {
+		a.followUpError(w, "failed to void payment", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(payment)
+}
+
+// createRefund refunds the payment; an empty body refunds everything that was
+// not refunded yet.
+func (a *API) createRefund(w http.ResponseWriter, r *http.Request) {
+	merchantID := chi.URLParam(r, "merchantID")
+	paymentID := chi.URLParam(r, "paymentID")
+
+	create := models.CreateRefund{}
+	err := json.NewDecoder(r.Body).Decode(&create)
+	if err != nil && !errors.Is(err, io.EOF) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	refund, err := a.acquirer.RefundPayment(merchantID, paymentID, create)
+	if err != nil {
+		a.followUpError(w, "failed to refund payment", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(refund)
+}
+
+// listParkedReversals lists the reversals the issuer would not apply, for
+// manual handling.
+func (a *API) listParkedReversals(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(a.acquirer.ParkedReversals())
+}
+
+// listParkedAdvices lists the advices the issuer would not apply, for manual
+// handling.
+func (a *API) listParkedAdvices(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(a.acquirer.ParkedAdvices())
+}
+
+// closeBatches closes the batches of all merchants and writes the clearing
+// file; an empty body closes today's batches.
+func (a *API) closeBatches(w http.ResponseWriter, r *http.Request) {
+	close := models.CloseBatches{}
+	err := json.NewDecoder(r.Body).Decode(&close)
+	if err != nil && !errors.Is(err, io.EOF) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	file, err := a.acquirer.CloseBatches(close, a.clearingDir)
+	if err != nil {
+		if errors.Is(err, ErrInvalidBusinessDate) {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+		} else {
+			a.logger.Error("failed to close batches", "err", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(file)
+}
+
+func (a *API) listBatches(w http.ResponseWriter, r *http.Request) {
+	merchantID := chi.URLParam(r, "merchantID")
+
+	batches, err := a.acquirer.ListBatches(merchantID)
+	if err != nil {
+		if errors.Is(err, ErrNotFound) {
+			http.Error(w, err.Error(), http.StatusNotFound)
+		} else {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(batches)
+}
+
+// receiveChargeback lands a chargeback on its payment; a repeated chargeback
+// for the same dispute gets the first one with 200.
+func (a *API) receiveChargeback(w http.ResponseWriter, r *http.Request) {
+	create := models.CreateChargeback{}
+	if err := json.NewDecoder(r.Body).Decode(&create); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	chargeback, created, err := a.acquirer.ReceiveChargeback(create)
+	if err != nil {
+		a.chargebackError(w, "failed to receive chargeback", err)
+		return
+	}
+
+	status := http.StatusOK
+	if created {
+		status = http.StatusCreated
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(chargeback)
+}
+
+func (a *API) changeChargebackStatus(w http.ResponseWriter, r *http.Request) {
+	chargebackID := chi.URLParam(r, "chargebackID")
+
+	change := models.ChangeChargebackStatus{}
+	if err := json.NewDecoder(r.Body).Decode(&change); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	chargeback, err := a.acquirer.ChangeChargebackStatus(chargebackID, change)
+	if err != nil {
+		a.chargebackError(w, "failed to change chargeback status", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(chargeback)
+}
+
+func (a *API) listChargebacks(w http.ResponseWriter, r *http.Request) {
+	merchantID := chi.URLParam(r, "merchantID")
+	paymentID := chi.URLParam(r, "paymentID")
+
+	chargebacks, err := a.acquirer.ListChargebacks(merchantID, paymentID)
+	if err != nil {
+		a.chargebackError(w, "failed to list chargebacks", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(chargebacks)
+}
+
+func (a *API) submitRepresentment(w http.ResponseWriter, r *http.Request) {
+	merchantID := chi.URLParam(r, "merchantID")
+	chargebackID := chi.URLParam(r, "chargebackID")
+
+	submit := models.SubmitRepresentment{}
+	if err := json.NewDecoder(r.Body).Decode(&submit); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	chargeback, err := a.acquirer.SubmitRepresentment(merchantID, chargebackID, submit)
+	if err != nil {
+		a.chargebackError(w, "failed to submit representment", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(chargeback)
+}
+
+// chargebackError maps the errors of the chargeback endpoints to responses.
+func (a *API) chargebackError(w http.ResponseWriter, msg string, err error) {
+	switch {
+	case errors.Is(err, ErrNotFound):
+		http.Error(w, err.Error(), http.StatusNotFound)
+	case errors.Is(err, ErrInvalidChargeback):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	case errors.Is(err, ErrInvalidAmount):
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+	case errors.Is(err, ErrInvalidPaymentStatus), errors.Is(err, ErrInvalidChargebackStatus):
+		http.Error(w, err.Error(), http.StatusConflict)
+	default:
+		a.logger.Error(msg, "err", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// followUpError maps the errors of captures, voids and refunds to responses.
+func (a *API) followUpError(w http.ResponseWriter, msg string, err error) {
+	switch {
+	case errors.Is(err, ErrNotFound):
+		http.Error(w, err.Error(), http.StatusNotFound)
+	case errors.Is(err, ErrInvalidPaymentStatus), errors.Is(err, ErrPaymentChanged):
+		http.Error(w, err.Error(), http.StatusConflict)
+	case errors.Is(err, ErrInvalidAmount):
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+	case errors.Is(err, ErrDeclined):
+		http.Error(w, err.Error(), http.StatusPaymentRequired)
+	default:
+		a.logger.Error(msg, "err", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
@@ -2,14 +2,18 @@ package acquirer
 
 import (
 	"context"
+	"database/sql"
 	"fmt"
 	"net"
 	"net/http"
+	"os"
 	"sync"
+	"time"
 
 	"github.com/alovak/cardflow-playground/acquirer/iso8583"
 	"github.com/alovak/cardflow-playground/internal/middleware"
 	"github.com/go-chi/chi/v5"
+	_ "github.com/lib/pq"
 	"golang.org/x/exp/slog"
 )
 
@@ -22,6 +26,12 @@ type App struct {
 	ISO8583ServerAddr string
 	logger            *slog.Logger
 	config            *Config
+	iso8583Client     *iso8583.Client
+	reversalWorker    *reversalWorker
+	cutoverScheduler  *cutoverScheduler
+	adviceForwarder   *adviceForwarder
+	keySweeper        *idempotencyKeySweeper
+	db                *sql.DB
 }
 
 func NewApp(logger *slog.Logger, config *Config) *App {
@@ -45,22 +55,59 @@ func (a *App) Start() error {
 	router := chi.NewRouter()
 	router.Use(middleware.NewStructuredLogger(a.logger))
 
-	repository := NewRepository()
+	repository, err := a.newRepository()
+	if err != nil {
+		return err
+	}
 
 	// setup iso8583Client
 	stanGenerator := iso8583.NewStanGenerator()
-	iso8583Client, err := iso8583.NewClient(a.logger, a.config.ISO8583Addr, stanGenerator)
+	spec, err := iso8583.SpecByName(a.config.ISO8583Spec)
+	if err != nil {
+		return fmt.Errorf("selecting iso8583 spec: %w", err)
+	}
+
+	var cutoverAt time.Duration
+	if a.config.CutoverTime != "" {
+		if cutoverAt, err = parseCutoverTime(a.config.CutoverTime); err != nil {
+			return err
+		}
+	}
+
+	iso8583Client, err := iso8583.NewClient(a.logger, a.config.ISO8583Addr, stanGenerator, spec, a.config.EchoInterval)
 	if err != nil {
 		return fmt.Errorf("creating iso8583 client: %w", err)
 	}
 
-	// connect to iso8583 server
+	// connect to iso8583 server, the client signs on right after connecting
 	if err := iso8583Client.Connect(); err != nil {
 		return fmt.Errorf("connecting to iso8583 server: %w", err)
 	}
+	a.iso8583Client = iso8583Client
+
+	reversals, err := NewReversalQueue(a.config.ReversalQueuePath)
+	if err != nil {
+		return fmt.Errorf("loading reversal queue: %w", err)
+	}
+
+	advices, err := NewAdviceQueue(a.config.AdviceQueuePath)
+	if err != nil {
+		return fmt.Errorf("loading advice queue: %w", err)
+	}
+
+	acq := NewService(repository, iso8583Client, reversals, advices)
+	if a.config.IdempotencyKeyRetention > 0 {
+		acq.idempotencyKeyRetention = a.config.IdempotencyKeyRetention
+	}
+	if a.config.ReversalMaxRejections > 0 {
+		acq.reversalMaxRejections = a.config.ReversalMaxRejections
+	}
+	if a.config.AdviceMaxRejections > 0 {
+		acq.adviceMaxRejections = a.config.AdviceMaxRejections
+	}
 
-	acq := NewService(repository, iso8583Client)
 	api := NewAPI(a.logger, acq)
+	api.clearingDir = a.config.ClearingDir
 	api.AppendRoutes(router)
 
 	l, err := net.Listen("tcp", a.config.HTTPAddr)
@@ -89,6 +136,35 @@ func (a *App) Start() error {
 		a.wg.Done()
 	}()
 
+	// reversals left over from the previous run are sent on the first tick
+	if a.config.ReversalRetryInterval > 0 {
+		a.reversalWorker = newReversalWorker(a.logger, acq, a.config.ReversalRetryInterval)
+		a.reversalWorker.Start()
+	}
+
+	// advices are forwarded as soon as they are queued and after every
+	// (re)connect; the interval only paces the repeats
+	if a.config.AdviceRetryInterval > 0 {
+		a.adviceForwarder = newAdviceForwarder(a.logger, acq, a.config.AdviceRetryInterval)
+		iso8583Client.OnSignOn(a.adviceForwarder.Trigger)
+		a.adviceForwarder.Start()
+		a.adviceForwarder.Trigger()
+	}
+
+	// close the issuer's business day when it takes the date from the network
+	if a.config.CutoverTime != "" {
+		a.cutoverScheduler = newCutoverScheduler(a.logger, iso8583Client, cutoverAt)
+		a.cutoverScheduler.Start()
+	}
+
+	// keys shorter lived than an hour are swept as often as they expire
+	sweepInterval := time.Hour
+	if retention := acq.idempotencyKeyRetention; retention < sweepInterval {
+		sweepInterval = retention
+	}
+	a.keySweeper = newIdempotencyKeySweeper(a.logger, acq, sweepInterval)
+	a.keySweeper.Start()
+
 	return nil
 }
 
@@ -99,5 +175,89 @@ func (a *App) Shutdown() {
 
 	a.wg.Wait()
 
+	if a.reversalWorker != nil {
+		a.reversalWorker.Stop()
+	}
+
+	if a.adviceForwarder != nil {
+		a.adviceForwarder.Stop()
+	}
+
+	if a.keySweeper != nil {
+		a.keySweeper.Stop()
+	}
+
+	if a.cutoverScheduler != nil {
+		a.cutoverScheduler.Stop()
+	}
+
+	// sign off and disconnect once no payments are in flight
+	if a.iso8583Client != nil {
+		if err := a.iso8583Client.Close(); err != nil {
+			a.logger.Error("closing iso8583 client", "err", err)
+		}
+	}
+
+	if a.db != nil {
+		a.db.Close()
+	}
+
 	a.logger.Info("app stopped")
 }
+
+// newRepository chooses the repository backend the same way the issuer does:
+// REPO_BACKEND=pg (default) uses the acquirer schema in DB_DSN, the memory
+// backend is only allowed in tests.
+func (a *App) newRepository() (*Repository, error) {
+	backend := getenv("REPO_BACKEND", "pg")
+	allowMem := getenv("ALLOW_MEM_BACKEND_FOR_TESTS", "false") == "true"
+
+	switch backend {
+	case "pg":
+		dsn := getenv("DB_DSN", "")
+		if dsn == "" {
+			return nil, fmt.Errorf("DB_DSN is required for pg backend")
+		}
+		db, err := sql.Open("postgres", dsn)
+		if err != nil {
+			return nil, fmt.Errorf("open postgres: %w", err)
+		}
+		db.SetMaxIdleConns(5)
+		db.SetMaxOpenConns(10)
+		if err := db.Ping(); err != nil {
+			db.Close()
+			return nil, fmt.Errorf("ping postgres: %w", err)
+		}
+		keyStore, err := OpenKeyStore(a.config)
+		if err != nil {
+			db.Close()
+			return nil, err
+		}
+		repository := NewPGRepository(db, keyStore)
+		// PANs stored before they were sealed
+		sealed, err := repository.SealPaymentCards()
+		if err != nil {
+			db.Close()
+			return nil, fmt.Errorf("sealing payment cards: %w", err)
+		}
+		if sealed > 0 {
+			a.logger.Info("payment cards sealed", slog.Int("sealed", sealed))
+		}
+		a.db = db
+		return repository, nil
+	case "mem":
+		if !allowMem {
+			return nil, fmt.Errorf("mem repository is disabled at runtime; set ALLOW_MEM_BACKEND_FOR_TESTS=true only in tests")
+		}
+		return NewRepository(), nil
+	default:
+		return nil, fmt.Errorf("unsupported REPO_BACKEND=%s", backend)
+	}
+}
+
+func getenv(k, def string) string {
+	if v := os.Getenv(k); v != "" {
+		return v
+	}
+	return def
+}
@@ -0,0 +1,135 @@
+package acquirer
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/alovak/cardflow-playground/acquirer/models"
+	"github.com/google/uuid"
+)
+
+// ErrInvalidChargeback is returned when a chargeback or representment is
+// missing what identifies or supports it.
+var ErrInvalidChargeback = fmt.Errorf("invalid chargeback")
+
+// ReceiveChargeback lands a chargeback the issuer raised on the payment it
+// was raised against, found by the TID and RRN of its authorization. The
+// chargeback is applied once per dispute: a repeat returns the first one and
+// false. It may take what was captured and is not refunded or charged back
+// by another dispute yet (unless the merchant won that one).
+func (a *Service) ReceiveChargeback(create models.CreateChargeback) (*models.Chargeback, bool, error) {
+	if create.DisputeID == "" || create.TID == "" || create.RRN == "" || create.ReasonCode == "" {
+		return nil, false, fmt.Errorf("dispute ID, TID, RRN and reason code are required: %w", ErrInvalidChargeback)
+	}
+
+	payment, err := a.repo.FindPaymentByRRN(create.TID, create.RRN)
+	if err != nil {
+		return nil, false, fmt.Errorf("finding payment: %w", err)
+	}
+
+	if !strings.EqualFold(create.Currency, payment.Currency) {
+		return nil, false, fmt.Errorf("currency %s does not match payment currency %s: %w", create.Currency, payment.Currency, ErrInvalidChargeback)
+	}
+	if payment.CapturedAmount == 0 {
+		return nil, false, fmt.Errorf("payment is %s: %w", payment.Status, ErrInvalidPaymentStatus)
+	}
+	// what is left of the payment is checked when the chargeback is stored
+	if create.Amount <= 0 {
+		return nil, false, fmt.Errorf("chargeback of %d: %w", create.Amount, ErrInvalidAmount)
+	}
+
+	now := time.Now()
+	chargeback, created, err := a.repo.CreateChargeback(&models.Chargeback{
+		ID:         uuid.New().String(),
+		PaymentID:  payment.ID,
+		MerchantID: payment.MerchantID,
+		DisputeID:  create.DisputeID,
+		Amount:     create.Amount,
+		Currency:   payment.Currency,
+		ReasonCode: create.ReasonCode,
+		Status:     models.ChargebackStatusChargeback,
+		CreatedAt:  now,
+		UpdatedAt:  now,
+	})
+	if err != nil {
+		return nil, false, fmt.Errorf("creating chargeback: %w", err)
+	}
+
+	return chargeback, created, nil
+}
+
+// ListChargebacks returns the chargebacks of the merchant's payment.
+func (a *Service) ListChargebacks(merchantID, paymentID string) ([]*models.Chargeback, error) {
+	if _, err := a.GetPayment(merchantID, paymentID); err != nil {
+		return nil, err
+	}
+
+	chargebacks, err := a.repo.ListChargebacks(paymentID)
+	if err != nil {
+		return nil, fmt.Errorf("listing chargebacks: %w", err)
+	}
+
+	return chargebacks, nil
+}
+
+// SubmitRepresentment contests a chargeback of the merchant with evidence.
+func (a *Service) SubmitRepresentment(merchantID, chargebackID string, submit models.SubmitRepresentment) (*models.Chargeback, error) {
+	if strings.TrimSpace(submit.Evidence) == "" {
+		return nil, fmt.Errorf("evidence is required: %w", ErrInvalidChargeback)
+	}
+
+	chargeback, err := a.getChargeback(chargebackID)
+	if err != nil {
+		return nil, err
+	}
+	if chargeback.MerchantID != merchantID {
+		return nil, fmt.Errorf("getting chargeback: %w", ErrNotFound)
+	}
+
+	chargeback.Evidence = submit.Evidence
+
+	return a.moveChargeback(chargeback, models.ChargebackStatusRepresentment)
+}
+
+// ChangeChargebackStatus applies the issuer's response to a chargeback:
+// pre-arbitration when it contests the representment, or the outcome.
+// Representments are only submitted by the merchant.
+func (a *Service) ChangeChargebackStatus(chargebackID string, change models.ChangeChargebackStatus) (*models.Chargeback, error) {
+	if !change.Status.Valid() || change.Status == models.ChargebackStatusChargeback || change.Status == models.ChargebackStatusRepresentment {
+		return nil, fmt.Errorf("status %q: %w", change.Status, ErrInvalidChargebackStatus)
+	}
+
+	chargeback, err := a.getChargeback(chargebackID)
+	if err != nil {
+		return nil, err
+	}
+
+	chargeback.Reason = change.Reason
+
+	return a.moveChargeback(chargeback, change.Status)
+}
+
+// getChargeback returns a copy of the chargeback to change.
+func (a *Service) getChargeback(chargebackID string) (models.Chargeback, error) {
+	chargeback, err := a.repo.GetChargeback(chargebackID)
+	if err != nil {
+		return models.Chargeback{}, fmt.Errorf("getting chargeback: %w", err)
+	}
+
+	return *chargeback, nil
+}
+
+func (a *Service) moveChargeback(chargeback models.Chargeback, status models.ChargebackStatus) (*models.Chargeback, error) {
+	from := chargeback.Status
+	if !from.CanTransitionTo(status) {
+		return nil, fmt.Errorf("%s -> %s: %w", from, status, ErrInvalidChargebackStatus)
+	}
+	chargeback.Status = status
+
+	if err := a.repo.UpdateChargeback(&chargeback, from); err != nil {
+		return nil, fmt.Errorf("updating chargeback: %w", err)
+	}
+
+	return a.repo.GetChargeback(chargeback.ID)
+}
@@ -0,0 +1,204 @@
+package acquirer
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/alovak/cardflow-playground/acquirer/models"
+	"github.com/alovak/cardflow-playground/internal/clearing"
+	"github.com/alovak/cardflow-playground/internal/expiry"
+	"github.com/google/uuid"
+)
+
+// ErrInvalidBusinessDate is returned when batches are closed for a malformed
+// or future business date.
+var ErrInvalidBusinessDate = errors.New("invalid business date")
+
+const businessDateLayout = "2006-01-02"
+
+// CloseBatches closes a batch for every merchant with captures or refunds
+// that were made before the end of the business date and not cleared yet,
+// and writes the batches to a clearing file in dir. The file only shows up
+// under its final name once the batches are stored, so a failed close
+// leaves everything to the next one.
+func (a *Service) CloseBatches(close models.CloseBatches, dir string) (*models.ClearingFile, error) {
+	now := time.Now().UTC()
+
+	businessDate := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+	if close.BusinessDate != "" {
+		date, err := time.Parse(businessDateLayout, close.BusinessDate)
+		if err != nil {
+			return nil, fmt.Errorf("%q: %w", close.BusinessDate, ErrInvalidBusinessDate)
+		}
+		if date.After(businessDate) {
+			return nil, fmt.Errorf("%s is in the future: %w", close.BusinessDate, ErrInvalidBusinessDate)
+		}
+		businessDate = date
+	}
+
+	a.batchMu.Lock()
+	defer a.batchMu.Unlock()
+
+	items, err := a.repo.ListUnclearedItems(businessDate.AddDate(0, 0, 1))
+	if err != nil {
+		return nil, fmt.Errorf("listing uncleared captures and refunds: %w", err)
+	}
+
+	file := &models.ClearingFile{
+		ID:           uuid.New().String(),
+		BusinessDate: businessDate,
+		CreatedAt:    now,
+	}
+	out := &clearing.File{
+		ID:           clearingID(file.ID),
+		BusinessDate: businessDate,
+		CreatedAt:    now,
+	}
+	batchItems := make(map[string][]clearingItem)
+
+	// items come by merchant, so a new merchant starts a new batch
+	var batch *models.Batch
+	for _, item := range items {
+		if batch == nil || batch.MerchantID != item.Payment.MerchantID {
+			merchant, err := a.repo.GetMerchant(item.Payment.MerchantID)
+			if err != nil {
+				return nil, fmt.Errorf("getting merchant %s: %w", item.Payment.MerchantID, err)
+			}
+
+			batch = &models.Batch{
+				ID:           uuid.New().String(),
+				MerchantID:   merchant.ID,
+				MID:          merchant.MID,
+				BusinessDate: businessDate,
+				FileID:       file.ID,
+				ClosedAt:     now,
+			}
+			file.Batches = append(file.Batches, batch)
+			out.Batches = append(out.Batches, clearing.Batch{
+				ID:           clearingID(batch.ID),
+				MID:          merchant.MID,
+				MerchantName: merchant.Name,
+				MCC:          merchant.MCC,
+			})
+		}
+
+		record, err := clearingRecord(item)
+		if err != nil {
+			return nil, err
+		}
+
+		current := &out.Batches[len(out.Batches)-1]
+		current.Records = append(current.Records, record)
+		batchItems[batch.ID] = append(batchItems[batch.ID], item)
+
+		switch item.Code {
+		case clearing.TransactionCodePresentment:
+			batch.Presentments++
+			batch.PresentmentAmount += item.Amount
+		case clearing.TransactionCodeRefund:
+			batch.Refunds++
+			batch.RefundAmount += item.Amount
+		}
+	}
+
+	if dir != "" {
+		if err := os.MkdirAll(dir, 0o700); err != nil {
+			return nil, fmt.Errorf("creating clearing directory: %w", err)
+		}
+	}
+	file.Path = filepath.Join(dir, fmt.Sprintf("clearing-%s-%s.txt", businessDate.Format("20060102"), out.ID))
+
+	tmp, err := writeClearingFile(file.Path, out)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := a.repo.CloseBatches(file.Batches, batchItems); err != nil {
+		os.Remove(tmp)
+		return nil, fmt.Errorf("closing batches: %w", err)
+	}
+
+	if err := os.Rename(tmp, file.Path); err != nil {
+		return nil, fmt.Errorf("publishing clearing file: %w", err)
+	}
+
+	return file, nil
+}
+
+// ListBatches returns the closed batches of the merchant, oldest first.
+func (a *Service) ListBatches(merchantID string) ([]*models.Batch, error) {
+	if _, err := a.repo.GetMerchant(merchantID); err != nil {
+		return nil, fmt.Errorf("getting merchant: %w", err)
+	}
+
+	batches, err := a.repo.ListBatches(merchantID)
+	if err != nil {
+		return nil, fmt.Errorf("listing batches: %w", err)
+	}
+
+	return batches, nil
+}
+
+// clearingRecord presents a capture or refund the way the issuer matches it:
+// by card, TID and RRN of the authorization, and the STAN it was sent with.
+func clearingRecord(item clearingItem) (clearing.Record, error) {
+	expiryYYMM, err := expiry.ParseCardFace(item.Card.ExpirationDate)
+	if err != nil {
+		return clearing.Record{}, fmt.Errorf("parsing expiry of payment %s: %w", item.Payment.ID, err)
+	}
+
+	return clearing.Record{
+		Code:              item.Code,
+		Reference:         clearingID(item.ID),
+		PAN:               item.Card.Number,
+		ExpirationDate:    expiryYYMM,
+		Amount:            item.Amount,
+		Currency:          strings.ToUpper(item.Currency),
+		AuthorizationCode: item.Payment.AuthorizationCode,
+		RRN:               item.Payment.RRN,
+		STAN:              item.STAN,
+		TID:               item.Payment.TID,
+		TransactedAt:      item.CreatedAt,
+	}, nil
+}
+
+// writeClearingFile writes the file next to path and returns the name it
+// was written to.
+func writeClearingFile(path string, f *clearing.File) (string, error) {
+	tmp := path + ".tmp"
+
+	out, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600)
+	if err != nil {
+		return "", fmt.Errorf("creating clearing file: %w", err)
+	}
+
+	if err := clearing.Write(out, f); err != nil {
+		out.Close()
+		os.Remove(tmp)
+		return "", fmt.Errorf("writing clearing file: %w", err)
+	}
+
+	// the records must be on disk before the batches are marked closed
+	if err := out.Sync(); err != nil {
+		out.Close()
+		os.Remove(tmp)
+		return "", fmt.Errorf("syncing clearing file: %w", err)
+	}
+
+	if err := out.Close(); err != nil {
+		os.Remove(tmp)
+		return "", fmt.Errorf("closing clearing file: %w", err)
+	}
+
+	return tmp, nil
+}
+
+// clearingID is the UUID without dashes, as references are written to
+// clearing files.
+func clearingID(id string) string {
+	return strings.ReplaceAll(id, "-", "")
+}
@@ -52,6 +52,30 @@ func (c *client) CreateMerchant(req models.CreateMerchant) (models.Merchant, err
 	return merchant, nil
 }
 
+func (c *client) CreateTerminal(merchantID string, req models.CreateTerminal) (models.Terminal, error) {
+	reqJSON, err := json.Marshal(req)
+	if err != nil {
+		return models.Terminal{}, err
+	}
+
+	res, err := c.httpClient.Post(c.baseURL+"/merchants/"+merchantID+"/terminals", "application/json", bytes.NewReader(reqJSON))
+	if err != nil {
+		return models.Terminal{}, err
+	}
+
+	if res.StatusCode != http.StatusCreated {
+		return models.Terminal{}, fmt.Errorf("unexpected status code: %d; expected: %d", res.StatusCode, http.StatusCreated)
+	}
+
+	var terminal models.Terminal
+	err = json.NewDecoder(res.Body).Decode(&terminal)
+	if err != nil {
+		return models.Terminal{}, err
+	}
+
+	return terminal, nil
+}
+
 func (c *client) CreatePayment(merchantID string, req models.CreatePayment) (models.Payment, error) {
 	reqJSON, err := json.Marshal(req)
 	if err != nil {
@@ -94,3 +118,60 @@ func (c *client) GetPayment(merchantID, paymentID string) (models.Payment, error
 
 	return payment, nil
 }
+
+func (c *client) CapturePayment(merchantID, paymentID string, req models.CapturePayment) (models.Payment, error) {
+	var payment models.Payment
+	err := c.postFollowUp("/merchants/"+merchantID+"/payments/"+paymentID+"/capture", req, http.StatusOK, &payment)
+	return payment, err
+}
+
+func (c *client) VoidPayment(merchantID, paymentID string) (models.Payment, error) {
+	var payment models.Payment
+	err := c.postFollowUp("/merchants/"+merchantID+"/payments/"+paymentID+"/void", nil, http.StatusOK, &payment)
+	return payment, err
+}
+
+func (c *client) RefundPayment(merchantID, paymentID string, req models.CreateRefund) (models.Refund, error) {
+	var refund models.Refund
+	err := c.postFollowUp("/merchants/"+merchantID+"/payments/"+paymentID+"/refunds", req, http.StatusCreated, &refund)
+	return refund, err
+}
+
+// CloseBatches closes the batches of all merchants and writes the clearing file.
+func (c *client) CloseBatches(req models.CloseBatches) (models.ClearingFile, error) {
+	var file models.ClearingFile
+	err := c.postFollowUp("/batches/close", req, http.StatusCreated, &file)
+	return file, err
+}
+
+func (c *client) postFollowUp(path string, req any, expectedStatus int, v any) error {
+	reqJSON, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+
+	res, err := c.httpClient.Post(c.baseURL+path, "application/json", bytes.NewReader(reqJSON))
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != expectedStatus {
+		return fmt.Errorf("unexpected status code: %d; expected: %d", res.StatusCode, expectedStatus)
+	}
+
+	return json.NewDecoder(res.Body).Decode(v)
+}
+
+// ReceiveChargeback sends a chargeback the way the card network does.
+func (c *client) ReceiveChargeback(req models.CreateChargeback) (models.Chargeback, error) {
+	var chargeback models.Chargeback
+	err := c.postFollowUp("/chargebacks", req, http.StatusCreated, &chargeback)
+	return chargeback, err
+}
+
+func (c *client) SubmitRepresentment(merchantID, chargebackID string, req models.SubmitRepresentment) (models.Chargeback, error) {
+	var chargeback models.Chargeback
+	err := c.postFollowUp("/merchants/"+merchantID+"/chargebacks/"+chargebackID+"/representment", req, http.StatusOK, &chargeback)
+	return chargeback, err
+}
@@ -1,13 +1,65 @@
 package acquirer
 
+import "time"
+
 type Config struct {
 	HTTPAddr    string
 	ISO8583Addr string
+	// ISO8583Spec selects the ISO 8583 message spec: "playground" (default) or
+	// "iso87" for the ISO 8583:1987 field assignments. It must match the issuer.
+	ISO8583Spec string
+	// EchoInterval is how long the ISO 8583 connection may stay idle before an
+	// echo test (0800, DE70=301) is sent; 0 keeps the connection library default.
+	EchoInterval time.Duration
+	// CutoverTime is the time of day, "15:04" in UTC, the business day is
+	// closed at by a cutover (0800, DE70=201) to the issuer; empty sends none.
+	// Only an issuer that takes its business date from the network needs it.
+	CutoverTime string
+	// ReversalQueuePath is the file pending reversals are kept in so they
+	// survive a restart; empty keeps them in memory only.
+	ReversalQueuePath string
+	// ReversalRetryInterval is how often queued reversals are sent; 0 disables the retries.
+	ReversalRetryInterval time.Duration
+	// ReversalMaxRejections is how many times the issuer may fail to apply a
+	// reversal (96, 99) before it is parked for manual handling; responses
+	// other than those park it right away.
+	ReversalMaxRejections int
+	// AdviceQueuePath is the file store-and-forward advices are kept in so
+	// they survive a restart; empty keeps them in memory only.
+	AdviceQueuePath string
+	// AdviceRetryInterval is how often unacknowledged advices are repeated;
+	// 0 disables forwarding.
+	AdviceRetryInterval time.Duration
+	// AdviceMaxRejections is how many times the issuer may fail to apply an
+	// advice (96, 99) before it is parked for manual handling; responses
+	// other than those park it right away.
+	AdviceMaxRejections int
+	// IdempotencyKeyRetention is how long an Idempotency-Key of a payment
+	// request replays the first response; expired keys are deleted hourly.
+	IdempotencyKeyRetention time.Duration
+	// KeyStorePath is the key store (see internal/keys) with the DEK the
+	// PANs of payments are sealed with in the database; empty uses
+	// ACQUIRER_KEYS_STORE, and without either a demo DEK.
+	KeyStorePath string
+	// ClearingDir is the directory clearing files are written to when the
+	// batches are closed (POST /batches/close).
+	ClearingDir string
 }
 
 func DefaultConfig() *Config {
 	return &Config{
-		HTTPAddr:    "127.0.0.1:8080",
-		ISO8583Addr: "127.0.0.1:8583",
+		HTTPAddr:              "127.0.0.1:8080",
+		ISO8583Addr:           "127.0.0.1:8583",
+		ISO8583Spec:           "playground",
+		EchoInterval:          30 * time.Second,
+		ReversalQueuePath:     "acquirer-reversals.json",
+		ReversalRetryInterval: 10 * time.Second,
+		ReversalMaxRejections: DefaultMaxRejections,
+		AdviceQueuePath:       "acquirer-advices.json",
+		AdviceRetryInterval:   10 * time.Second,
+		AdviceMaxRejections:   DefaultMaxRejections,
+
+		IdempotencyKeyRetention: 24 * time.Hour,
+		ClearingDir:             "clearing",
 	}
 }
@@ -0,0 +1,95 @@
+package acquirer
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"golang.org/x/exp/slog"
+)
+
+// cutoverRetryInterval is how long after a failed cutover it is sent again.
+const cutoverRetryInterval = time.Minute
+
+// cutoverSender sends the cutover of the business day to the issuer.
+type cutoverSender interface {
+	Cutover() error
+}
+
+// cutoverScheduler sends a cutover every day at the same time of day in
+// UTC, repeating it until the issuer acknowledges it. A cutover due while
+// the acquirer is down is not sent.
+type cutoverScheduler struct {
+	sender cutoverSender
+	// at is the time of day since midnight UTC
+	at     time.Duration
+	logger *slog.Logger
+
+	stop chan struct{}
+	wg   sync.WaitGroup
+}
+
+// parseCutoverTime parses a time of day ("15:04") to the time since midnight.
+func parseCutoverTime(s string) (time.Duration, error) {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, fmt.Errorf("cutover time %q: %w", s, err)
+	}
+
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
+
+func newCutoverScheduler(logger *slog.Logger, sender cutoverSender, at time.Duration) *cutoverScheduler {
+	return &cutoverScheduler{
+		sender: sender,
+		at:     at,
+		logger: logger.With(slog.String("type", "cutover-scheduler")),
+		stop:   make(chan struct{}),
+	}
+}
+
+// Start runs the scheduler in a background goroutine until Stop is called.
+func (s *cutoverScheduler) Start() {
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+
+		next := s.next(time.Now())
+		s.logger.Info("cutover scheduler started", slog.Time("next", next))
+
+		timer := time.NewTimer(time.Until(next))
+		defer timer.Stop()
+
+		for {
+			select {
+			case <-s.stop:
+				s.logger.Info("cutover scheduler stopped")
+				return
+			case <-timer.C:
+				if err := s.sender.Cutover(); err != nil {
+					s.logger.Error("sending cutover", "err", err)
+					timer.Reset(cutoverRetryInterval)
+					continue
+				}
+				timer.Reset(time.Until(s.next(time.Now())))
+			}
+		}
+	}()
+}
+
+// Stop signals the scheduler to exit and waits for the current cutover to finish.
+func (s *cutoverScheduler) Stop() {
+	close(s.stop)
+	s.wg.Wait()
+}
+
+// next returns the first cutover time after now.
+func (s *cutoverScheduler) next(now time.Time) time.Time {
+	now = now.UTC()
+	next := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC).Add(s.at)
+	if !next.After(now) {
+		next = next.AddDate(0, 0, 1)
+	}
+
+	return next
+}
@@ -0,0 +1,68 @@
+package acquirer
+
+import (
+	"sync"
+	"time"
+
+	"golang.org/x/exp/slog"
+)
+
+// idempotencyKeySweeper periodically deletes the idempotency keys past their
+// retention.
+type idempotencyKeySweeper struct {
+	acquirer *Service
+	interval time.Duration
+	logger   *slog.Logger
+
+	stop chan struct{}
+	wg   sync.WaitGroup
+}
+
+func newIdempotencyKeySweeper(logger *slog.Logger, acquirer *Service, interval time.Duration) *idempotencyKeySweeper {
+	return &idempotencyKeySweeper{
+		acquirer: acquirer,
+		interval: interval,
+		logger:   logger.With(slog.String("type", "idempotency-key-sweeper")),
+		stop:     make(chan struct{}),
+	}
+}
+
+// Start runs the sweeper in a background goroutine until Stop is called.
+func (w *idempotencyKeySweeper) Start() {
+	w.wg.Add(1)
+	go func() {
+		defer w.wg.Done()
+
+		w.logger.Info("idempotency key sweeper started", slog.Duration("interval", w.interval))
+
+		ticker := time.NewTicker(w.interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-w.stop:
+				w.logger.Info("idempotency key sweeper stopped")
+				return
+			case <-ticker.C:
+				w.sweep()
+			}
+		}
+	}()
+}
+
+// Stop signals the sweeper to exit and waits for the current run to finish.
+func (w *idempotencyKeySweeper) Stop() {
+	close(w.stop)
+	w.wg.Wait()
+}
+
+func (w *idempotencyKeySweeper) sweep() {
+	n, err := w.acquirer.DeleteExpiredIdempotencyKeys()
+	if err != nil {
+		w.logger.Error("deleting expired idempotency keys", "err", err)
+	}
+
+	if n > 0 {
+		w.logger.Info("expired idempotency keys deleted", slog.Int("deleted", n))
+	}
+}
@@ -0,0 +1,180 @@
+package acquirer_test
+
+import (
+	"database/sql"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/alovak/cardflow-playground/acquirer"
+	"github.com/alovak/cardflow-playground/acquirer/models"
+	_ "github.com/lib/pq"
+	"github.com/stretchr/testify/require"
+)
+
+// TestPGRepository_PaymentLifecycle verifies that payments, their cards and
+// events survive in the acquirer schema. Skips unless DB_DSN is provided and
+// REPO_BACKEND=pg.
+func TestPGRepository_PaymentLifecycle(t *testing.T) {
+	if os.Getenv("REPO_BACKEND") != "pg" {
+		t.Skip("REPO_BACKEND != pg; skipping DB integration test")
+	}
+	dsn := os.Getenv("DB_DSN")
+	if dsn == "" {
+		t.Skip("DB_DSN not set; skipping DB integration test")
+	}
+
+	db, err := sql.Open("postgres", dsn)
+	require.NoError(t, err)
+	defer db.Close()
+
+	reversals, err := acquirer.NewReversalQueue("")
+	require.NoError(t, err)
+	advices, err := acquirer.NewAdviceQueue("")
+	require.NoError(t, err)
+
+	keyStore, err := acquirer.OpenKeyStore(acquirer.DefaultConfig())
+	require.NoError(t, err)
+
+	repo := acquirer.NewPGRepository(db, keyStore)
+	service := acquirer.NewService(repo, &fakeISO8583Client{}, reversals, advices)
+
+	merchant, err := service.CreateMerchant(models.CreateMerchant{Name: "Demo Merchant", MCC: "5411", PostalCode: "12345"})
+	require.NoError(t, err)
+
+	payment, err := service.CreateOfflinePayment(merchant.ID, models.CreateOfflinePayment{
+		Amount:            100_00,
+		Currency:          "usd",
+		AuthorizationCode: "Y1OFFL",
+		Card: models.Card{
+			Number:                "4212340000000006",
+			ExpirationDate:        "12/28",
+			CardVerificationValue: "123",
+		},
+	})
+	require.NoError(t, err)
+
+	_, err = service.CapturePayment(merchant.ID, payment.ID, models.CapturePayment{Amount: 40_00})
+	require.NoError(t, err)
+	_, err = service.RefundPayment(merchant.ID, payment.ID, models.CreateRefund{})
+	require.NoError(t, err)
+
+	// a fresh repository reads everything back from the database
+	reloaded := acquirer.NewPGRepository(db, keyStore)
+
+	stored, err := reloaded.GetPayment(merchant.ID, payment.ID)
+	require.NoError(t, err)
+	require.Equal(t, models.PaymentStatusRefunded, stored.Status)
+	require.Equal(t, "USD", stored.Currency)
+	require.Equal(t, payment.STAN, stored.STAN)
+	require.Equal(t, payment.RRN, stored.RRN)
+	require.Equal(t, "0120", stored.MTI)
+	require.Equal(t, payment.TerminalID, stored.TerminalID)
+	require.Equal(t, payment.TID, stored.TID)
+	require.Equal(t, merchant.MID, stored.MID)
+	require.Equal(t, "Y1OFFL", stored.AuthorizationCode)
+	require.Equal(t, int64(40_00), stored.CapturedAmount)
+	require.Equal(t, int64(40_00), stored.RefundedAmount)
+
+	// the STAN sequence of the terminal survives the repository
+	stan, err := reloaded.NextSTAN(payment.TID, time.Now())
+	require.NoError(t, err)
+	require.Greater(t, stan, payment.STAN)
+
+	card, err := reloaded.GetPaymentCard(payment.ID)
+	require.NoError(t, err)
+	require.Equal(t, "4212340000000006", card.Number)
+	require.Empty(t, card.CardVerificationValue)
+
+	// the PAN is sealed in the database
+	var pan sql.NullString
+	var token string
+	err = db.QueryRow(`select pan, pan_token from acquirer.payment_cards where payment_id = $1`, payment.ID).Scan(&pan, &token)
+	require.NoError(t, err)
+	require.False(t, pan.Valid)
+	require.NotContains(t, token, "4212340000000006")
+
+	events, err := reloaded.ListPaymentEvents(payment.ID)
+	require.NoError(t, err)
+	var statuses []models.PaymentStatus
+	for _, event := range events {
+		statuses = append(statuses, event.Status)
+	}
+	require.Equal(t, []models.PaymentStatus{
+		models.PaymentStatusAuthorized,
+		models.PaymentStatusPartiallyCaptured,
+		models.PaymentStatusRefunded,
+	}, statuses)
+
+	// another instance working from a stale read of the payment is refused
+	stale := models.Payment{ID: payment.ID, Status: models.PaymentStatusPartiallyCaptured, CapturedAmount: 40_00}
+	require.ErrorIs(t, reloaded.UpdatePaymentIf(stale, stored), acquirer.ErrPaymentChanged)
+
+	_, err = reloaded.GetPayment(merchant.ID, "not-a-uuid")
+	require.ErrorIs(t, err, acquirer.ErrNotFound)
+
+	_, err = reloaded.GetMerchant(merchant.ID)
+	require.NoError(t, err)
+
+	// the capture and the refund are cleared in the merchant's batch
+	file, err := service.CloseBatches(models.CloseBatches{}, t.TempDir())
+	require.NoError(t, err)
+	_, err = os.Stat(file.Path)
+	require.NoError(t, err)
+
+	batches, err := reloaded.ListBatches(merchant.ID)
+	require.NoError(t, err)
+	require.Len(t, batches, 1)
+	require.Equal(t, file.ID, batches[0].FileID)
+	require.Equal(t, merchant.MID, batches[0].MID)
+	require.Equal(t, 1, batches[0].Presentments)
+	require.Equal(t, int64(40_00), batches[0].PresentmentAmount)
+	require.Equal(t, 1, batches[0].Refunds)
+	require.Equal(t, int64(40_00), batches[0].RefundAmount)
+
+	// nothing is left to charge back of a refunded payment
+	disputeID := "dispute-" + payment.ID
+	_, _, err = service.ReceiveChargeback(models.CreateChargeback{
+		DisputeID: disputeID, TID: payment.TID, RRN: payment.RRN, Amount: 40_00, Currency: "USD", ReasonCode: "13.1",
+	})
+	require.ErrorIs(t, err, acquirer.ErrInvalidAmount)
+
+	disputed, err := service.CreateOfflinePayment(merchant.ID, models.CreateOfflinePayment{
+		Amount:            100_00,
+		Currency:          "USD",
+		AuthorizationCode: "Y2OFFL",
+		Card:              models.Card{Number: "4212340000000006", ExpirationDate: "12/28"},
+	})
+	require.NoError(t, err)
+	_, err = service.CapturePayment(merchant.ID, disputed.ID, models.CapturePayment{Amount: 40_00})
+	require.NoError(t, err)
+
+	// a chargeback lands on the payment by TID and RRN, once per dispute
+	chargeback, created, err := service.ReceiveChargeback(models.CreateChargeback{
+		DisputeID: disputeID, TID: disputed.TID, RRN: disputed.RRN, Amount: 40_00, Currency: "USD", ReasonCode: "13.1",
+	})
+	require.NoError(t, err)
+	require.True(t, created)
+	repeated, created, err := service.ReceiveChargeback(models.CreateChargeback{
+		DisputeID: disputeID, TID: disputed.TID, RRN: disputed.RRN, Amount: 40_00, Currency: "USD", ReasonCode: "13.1",
+	})
+	require.NoError(t, err)
+	require.False(t, created)
+	require.Equal(t, chargeback.ID, repeated.ID)
+
+	// and takes at most what the other disputes left
+	_, _, err = service.ReceiveChargeback(models.CreateChargeback{
+		DisputeID: disputeID + "-2", TID: disputed.TID, RRN: disputed.RRN, Amount: 1, Currency: "USD", ReasonCode: "13.1",
+	})
+	require.ErrorIs(t, err, acquirer.ErrInvalidAmount)
+
+	_, err = service.SubmitRepresentment(merchant.ID, chargeback.ID, models.SubmitRepresentment{Evidence: "proof of delivery"})
+	require.NoError(t, err)
+
+	chargebacks, err := reloaded.ListChargebacks(disputed.ID)
+	require.NoError(t, err)
+	require.Len(t, chargebacks, 1)
+	require.Equal(t, models.ChargebackStatusRepresentment, chargebacks[0].Status)
+	require.Equal(t, "proof of delivery", chargebacks[0].Evidence)
+	require.Equal(t, merchant.ID, chargebacks[0].MerchantID)
+}
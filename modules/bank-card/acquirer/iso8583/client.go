@@ -2,49 +2,93 @@ package iso8583
 
 import (
 	"fmt"
+	"sync"
 	"time"
 
 	"github.com/alovak/cardflow-playground/acquirer/models"
+	"github.com/alovak/cardflow-playground/internal/expiry"
+	"github.com/alovak/cardflow-playground/internal/iso8583spec"
 	"github.com/moov-io/iso8583"
 	iso8583Connection "github.com/moov-io/iso8583-connection"
 	"golang.org/x/exp/slog"
 )
 
 type Client struct {
-	iso8583Connection *iso8583Connection.Connection
-	logger            *slog.Logger
-	stanGenerator     STANGenerator
+	pool   *iso8583Connection.Pool
+	logger *slog.Logger
+	// stanGenerator numbers network management messages, which are not sent
+	// by a terminal
+	stanGenerator STANGenerator
+	spec          *Spec
+
+	mu       sync.Mutex
+	onSignOn []func()
+
+	inFlightMu sync.Mutex
+	// inFlight holds the STANs of requests waiting for a response; the
+	// connection matches responses by STAN only, and terminals may use the
+	// same STAN at the same time
+	inFlight map[string]chan struct{}
 }
 
 type STANGenerator interface {
 	Next() string
 }
 
-func NewClient(logger *slog.Logger, iso8583ServerAddr string, stanGenerator STANGenerator) (*Client, error) {
-	logger = logger.With(slog.String("type", "iso8583-client"), slog.String("addr", iso8583ServerAddr))
+// NewClient creates a client that signs on as soon as it is connected, sends
+// echo tests every echoInterval the connection is idle (0 keeps the
+// connection library default) and signs off when closed. A dropped
+// connection is re-established in the background and signs on again.
+func NewClient(logger *slog.Logger, iso8583ServerAddr string, stanGenerator STANGenerator, spec *Spec, echoInterval time.Duration) (*Client, error) {
+	logger = logger.With(slog.String("type", "iso8583-client"), slog.String("addr", iso8583ServerAddr), slog.String("spec", spec.Name))
+
+	c := &Client{
+		logger:        logger,
+		stanGenerator: stanGenerator,
+		spec:          spec,
+		inFlight:      make(map[string]chan struct{}),
+	}
+
+	options := []iso8583Connection.Option{
+		iso8583Connection.SendTimeout(5 * time.Second),
+		iso8583Connection.OnConnect(c.signOn),
+		iso8583Connection.OnClose(c.signOff),
+		iso8583Connection.PingHandler(c.echo),
+	}
+	if echoInterval > 0 {
+		options = append(options, iso8583Connection.IdleTime(echoInterval))
+	}
 
-	conn, err := iso8583Connection.New(
-		iso8583ServerAddr,
-		spec,
-		readMessageLength,
-		writeMessageLength,
-		iso8583Connection.SendTimeout(5*time.Second),
+	factory := func(addr string) (*iso8583Connection.Connection, error) {
+		return iso8583Connection.New(
+			addr,
+			spec.MessageSpec(),
+			iso8583spec.ReadMessageLength,
+			iso8583spec.WriteMessageLength,
+			options...,
+		)
+	}
+
+	pool, err := iso8583Connection.NewPool(
+		factory,
+		[]string{iso8583ServerAddr},
+		iso8583Connection.PoolErrorHandler(func(err error) {
+			logger.Warn("iso8583 connection", "err", err)
+		}),
 	)
 	if err != nil {
-		return nil, fmt.Errorf("creating iso8583 connection: %w", err)
+		return nil, fmt.Errorf("creating iso8583 connection pool: %w", err)
 	}
 
-	return &Client{
-		iso8583Connection: conn,
-		logger:            logger,
-		stanGenerator:     stanGenerator,
-	}, nil
+	c.pool = pool
+
+	return c, nil
 }
 
 func (c *Client) Connect() error {
 	c.logger.Info("connecting to ISO 8583 server...")
 
-	if err := c.iso8583Connection.Connect(); err != nil {
+	if err := c.pool.Connect(); err != nil {
 		return fmt.Errorf("connecting to ISO 8583 server: %w", err)
 	}
 
@@ -52,19 +96,171 @@ func (c *Client) Connect() error {
 	return nil
 }
 
+// Close signs off and closes the connection to the ISO 8583 server.
+func (c *Client) Close() error {
+	c.logger.Info("closing connection to ISO 8583 server...")
+
+	if err := c.pool.Close(); err != nil {
+		return fmt.Errorf("closing connection to ISO 8583 server: %w", err)
+	}
+
+	c.logger.Info("connection to ISO 8583 server closed")
+	return nil
+}
+
+// OnSignOn registers h to be called (in its own goroutine) every time the
+// client signs on, including after a reconnect.
+func (c *Client) OnSignOn(h func()) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.onSignOn = append(c.onSignOn, h)
+}
+
+// send sends the message over a signed on connection.
+func (c *Client) send(message *iso8583.Message) (*iso8583.Message, error) {
+	conn, err := c.pool.Get()
+	if err != nil {
+		return nil, err
+	}
+
+	return c.sendOn(conn, message)
+}
+
+// sendOn sends the message over conn. A message waits for the response to
+// another one with the same STAN, so the response cannot be handed to the
+// wrong request.
+func (c *Client) sendOn(conn *iso8583Connection.Connection, message *iso8583.Message) (*iso8583.Message, error) {
+	stan, err := message.GetString(11)
+	if err != nil {
+		return nil, fmt.Errorf("getting STAN: %w", err)
+	}
+
+	for {
+		c.inFlightMu.Lock()
+		pending, ok := c.inFlight[stan]
+		if !ok {
+			c.inFlight[stan] = make(chan struct{})
+			c.inFlightMu.Unlock()
+			break
+		}
+		c.inFlightMu.Unlock()
+		<-pending
+	}
+
+	defer func() {
+		c.inFlightMu.Lock()
+		close(c.inFlight[stan])
+		delete(c.inFlight, stan)
+		c.inFlightMu.Unlock()
+	}()
+
+	return conn.Send(message)
+}
+
+func (c *Client) signOn(conn *iso8583Connection.Connection) error {
+	if err := c.sendNetworkManagement(conn, NetworkCodeSignOn); err != nil {
+		return fmt.Errorf("signing on: %w", err)
+	}
+
+	c.logger.Info("signed on")
+
+	c.mu.Lock()
+	for _, h := range c.onSignOn {
+		go h()
+	}
+	c.mu.Unlock()
+
+	return nil
+}
+
+func (c *Client) signOff(conn *iso8583Connection.Connection) error {
+	if err := c.sendNetworkManagement(conn, NetworkCodeSignOff); err != nil {
+		return fmt.Errorf("signing off: %w", err)
+	}
+
+	c.logger.Info("signed off")
+	return nil
+}
+
+// Cutover tells the issuer the business day is closed (0800, DE70=201).
+func (c *Client) Cutover() error {
+	conn, err := c.pool.Get()
+	if err != nil {
+		return err
+	}
+
+	if err := c.sendNetworkManagement(conn, NetworkCodeCutover); err != nil {
+		return fmt.Errorf("cutover: %w", err)
+	}
+
+	c.logger.Info("cutover sent")
+	return nil
+}
+
+// echo is called by the connection when nothing was sent during the idle time.
+func (c *Client) echo(conn *iso8583Connection.Connection) {
+	if err := c.sendNetworkManagement(conn, NetworkCodeEcho); err != nil {
+		c.logger.Error("echo test failed", "err", err)
+	}
+}
+
+func (c *Client) sendNetworkManagement(conn *iso8583Connection.Connection, code string) error {
+	requestMessage := c.spec.NewMessage()
+	requestData := &NetworkManagementRequest{
+		MTI:                   "0800",
+		TransmissionDateTime:  time.Now().UTC().Format(time.RFC3339),
+		STAN:                  c.stanGenerator.Next(),
+		NetworkManagementCode: code,
+	}
+
+	if err := c.spec.Marshal(requestMessage, requestData); err != nil {
+		return fmt.Errorf("marshaling request data: %w", err)
+	}
+
+	responseMessage, err := c.sendOn(conn, requestMessage)
+	if err != nil {
+		return fmt.Errorf("sending ISO 8583 message to server: %w", err)
+	}
+
+	responseData := &NetworkManagementResponse{}
+	if err := c.spec.Unmarshal(responseMessage, responseData); err != nil {
+		return fmt.Errorf("unmarshaling response data: %w", err)
+	}
+
+	if responseData.ApprovalCode != "00" {
+		return fmt.Errorf("network management request %s declined with code %s", code, responseData.ApprovalCode)
+	}
+
+	return nil
+}
+
+// AuthorizePayment sends an authorization request (0100) with the STAN and
+// RRN of the payment.
 func (c *Client) AuthorizePayment(payment *models.Payment, card models.Card, merchant models.Merchant) (models.AuthorizationResponse, error) {
 	c.logger.Info("authorizing payment", slog.String("payment_id", payment.ID))
 
-	requestMessage := iso8583.NewMessage(spec)
+	// the card expiry comes from the card face (MM/YY); DE9 carries it as YYMM
+	expiryYYMM, err := expiry.ParseCardFace(card.ExpirationDate)
+	if err != nil {
+		return models.AuthorizationResponse{}, fmt.Errorf("parsing card expiration date: %w", err)
+	}
+
+	requestMessage := c.spec.NewMessage()
 	requestData := &AuthorizationRequest{
 		MTI:                   "0100",
 		PrimaryAccountNumber:  card.Number,
 		Amount:                payment.Amount,
 		Currency:              payment.Currency,
 		TransmissionDateTime:  payment.CreatedAt.UTC().Format(time.RFC3339),
-		STAN:                  c.stanGenerator.Next(),
+		STAN:                  payment.STAN,
 		CardVerificationValue: card.CardVerificationValue,
-		ExpirationDate:        card.ExpirationDate,
+		PINBlock:              card.PINBlock,
+		ExpirationDate:        expiryYYMM,
+		TerminalID:            payment.TID,
+		CardAcceptorID:        payment.MID,
+		// repeats of the transaction keep the RRN, the issuer recognizes them by it
+		RetrievalReferenceNumber: payment.RRN,
 		AcceptorInformation: &AcceptorInformation{
 			Name:       merchant.Name,
 			MCC:        merchant.MCC,
@@ -73,20 +269,26 @@ func (c *Client) AuthorizePayment(payment *models.Payment, card models.Card, mer
 		},
 	}
 
-	err := requestMessage.Marshal(requestData)
+	err = c.spec.Marshal(requestMessage, requestData)
 	if err != nil {
 		return models.AuthorizationResponse{}, fmt.Errorf("marshaling request data: %w", err)
 	}
 
-	responseMessage, err := c.iso8583Connection.Send(requestMessage)
+	// from here on the issuer may have seen the request, so failures are
+	// reported as unconfirmed and the payment gets reversed
+	responseMessage, err := c.send(requestMessage)
 	if err != nil {
-		return models.AuthorizationResponse{}, fmt.Errorf("sending ISO 8583 message to server: %w", err)
+		return models.AuthorizationResponse{}, fmt.Errorf("sending ISO 8583 message to server: %w: %w", models.ErrAuthorizationUnconfirmed, err)
 	}
 
 	responseData := &AuthorizationResponse{}
-	err = responseMessage.Unmarshal(responseData)
+	err = c.spec.Unmarshal(responseMessage, responseData)
 	if err != nil {
-		return models.AuthorizationResponse{}, fmt.Errorf("unmarshaling response data: %w", err)
+		return models.AuthorizationResponse{}, fmt.Errorf("unmarshaling response data: %w: %w", models.ErrAuthorizationUnconfirmed, err)
+	}
+
+	if responseData.MTI != "0110" || responseData.ApprovalCode == "" {
+		return models.AuthorizationResponse{}, fmt.Errorf("unexpected response %s: %w", responseData.MTI, models.ErrAuthorizationUnconfirmed)
 	}
 
 	return models.AuthorizationResponse{
@@ -94,3 +296,214 @@ func (c *Client) AuthorizePayment(payment *models.Payment, card models.Card, mer
 		AuthorizationCode: responseData.AuthorizationCode,
 	}, nil
 }
+
+// ReversePayment sends a reversal of an unconfirmed authorization. The first
+// attempt goes out as 0400, later ones as 0401 repeats with the same STAN.
+// The RRN and original data elements let the issuer find the authorization.
+func (c *Client) ReversePayment(reversal models.Reversal, card models.Card) (models.ReversalResponse, error) {
+	c.logger.Info("reversing payment", slog.String("payment_id", reversal.PaymentID), slog.Int("attempt", reversal.Attempts))
+
+	expiryYYMM, err := expiry.ParseCardFace(card.ExpirationDate)
+	if err != nil {
+		return models.ReversalResponse{}, fmt.Errorf("parsing card expiration date: %w", err)
+	}
+
+	mti := "0400"
+	if reversal.Attempts > 1 {
+		mti = "0401"
+	}
+
+	requestMessage := c.spec.NewMessage()
+	requestData := &AuthorizationRequest{
+		MTI:                  mti,
+		PrimaryAccountNumber: card.Number,
+		Amount:               reversal.Amount,
+		Currency:             reversal.Currency,
+		TransmissionDateTime: time.Now().UTC().Format(time.RFC3339),
+		STAN:                 reversal.STAN,
+		ExpirationDate:       expiryYYMM,
+		TerminalID:           reversal.TID,
+		CardAcceptorID:       reversal.MID,
+
+		RetrievalReferenceNumber: reversal.RRN,
+		OriginalDataElements:     formatOriginalData(reversal.Original),
+	}
+
+	if err := c.spec.Marshal(requestMessage, requestData); err != nil {
+		return models.ReversalResponse{}, fmt.Errorf("marshaling request data: %w", err)
+	}
+
+	responseMessage, err := c.send(requestMessage)
+	if err != nil {
+		return models.ReversalResponse{}, fmt.Errorf("sending ISO 8583 message to server: %w", err)
+	}
+
+	responseData := &AuthorizationResponse{}
+	if err := c.spec.Unmarshal(responseMessage, responseData); err != nil {
+		return models.ReversalResponse{}, fmt.Errorf("unmarshaling response data: %w", err)
+	}
+
+	if responseData.MTI != "0410" {
+		return models.ReversalResponse{}, fmt.Errorf("unexpected response %s to reversal", responseData.MTI)
+	}
+
+	return models.ReversalResponse{
+		ApprovalCode: responseData.ApprovalCode,
+	}, nil
+}
+
+// CapturePayment sends a capture (0200) of amount with the given STAN. The
+// RRN and original data elements of the payment let the issuer find the
+// authorization.
+func (c *Client) CapturePayment(payment models.Payment, card models.Card, amount int64, stan string) (models.FinancialResponse, error) {
+	c.logger.Info("capturing payment", slog.String("payment_id", payment.ID), slog.Int64("amount", amount))
+
+	return c.sendFinancial(payment, card, ProcessingCodePurchase, amount, stan)
+}
+
+// RefundPayment sends a refund (0200 with processing code 20) of amount,
+// referring to the authorization like CapturePayment does.
+func (c *Client) RefundPayment(payment models.Payment, card models.Card, amount int64, stan string) (models.FinancialResponse, error) {
+	c.logger.Info("refunding payment", slog.String("payment_id", payment.ID), slog.Int64("amount", amount))
+
+	return c.sendFinancial(payment, card, ProcessingCodeRefund, amount, stan)
+}
+
+// VoidPayment reverses (0400) the whole authorization of the payment before
+// anything was captured.
+func (c *Client) VoidPayment(payment models.Payment, card models.Card, stan string) (models.ReversalResponse, error) {
+	return c.ReversePayment(models.Reversal{
+		PaymentID:  payment.ID,
+		MerchantID: payment.MerchantID,
+		Amount:     payment.Amount,
+		Currency:   payment.Currency,
+		TID:        payment.TID,
+		MID:        payment.MID,
+		STAN:       stan,
+		RRN:        payment.RRN,
+		Original:   payment.OriginalData(),
+		Attempts:   1,
+	}, card)
+}
+
+func (c *Client) sendFinancial(payment models.Payment, card models.Card, processingCode string, amount int64, stan string) (models.FinancialResponse, error) {
+	expiryYYMM, err := expiry.ParseCardFace(card.ExpirationDate)
+	if err != nil {
+		return models.FinancialResponse{}, fmt.Errorf("parsing card expiration date: %w", err)
+	}
+
+	requestMessage := c.spec.NewMessage()
+	requestData := &AuthorizationRequest{
+		MTI:                  "0200",
+		PrimaryAccountNumber: card.Number,
+		Amount:               amount,
+		Currency:             payment.Currency,
+		TransmissionDateTime: time.Now().UTC().Format(time.RFC3339),
+		STAN:                 stan,
+		ExpirationDate:       expiryYYMM,
+		ProcessingCode:       processingCode,
+		TerminalID:           payment.TID,
+		CardAcceptorID:       payment.MID,
+
+		RetrievalReferenceNumber: payment.RRN,
+		OriginalDataElements:     formatOriginalData(payment.OriginalData()),
+	}
+
+	if err := c.spec.Marshal(requestMessage, requestData); err != nil {
+		return models.FinancialResponse{}, fmt.Errorf("marshaling request data: %w", err)
+	}
+
+	responseMessage, err := c.send(requestMessage)
+	if err != nil {
+		return models.FinancialResponse{}, fmt.Errorf("sending ISO 8583 message to server: %w", err)
+	}
+
+	responseData := &AuthorizationResponse{}
+	if err := c.spec.Unmarshal(responseMessage, responseData); err != nil {
+		return models.FinancialResponse{}, fmt.Errorf("unmarshaling response data: %w", err)
+	}
+
+	if responseData.MTI != "0210" {
+		return models.FinancialResponse{}, fmt.Errorf("unexpected response %s to financial request", responseData.MTI)
+	}
+
+	return models.FinancialResponse{
+		ApprovalCode: responseData.ApprovalCode,
+	}, nil
+}
+
+// SendAdvice forwards a stored advice: 0120 for completions, 0420 for
+// reversals, and 0121/0421 when it is a repeat.
+func (c *Client) SendAdvice(advice models.Advice, card models.Card) (models.AdviceResponse, error) {
+	c.logger.Info("sending advice", slog.String("advice_id", advice.ID), slog.String("advice_type", string(advice.Type)), slog.Int("attempt", advice.Attempts))
+
+	var mti, responseMTI string
+	switch advice.Type {
+	case models.AdviceTypeCompletion:
+		mti, responseMTI = "0120", "0130"
+	case models.AdviceTypeReversal:
+		mti, responseMTI = "0420", "0430"
+	default:
+		return models.AdviceResponse{}, fmt.Errorf("unknown advice type: %s", advice.Type)
+	}
+	if advice.Attempts > 1 {
+		mti = mti[:3] + "1"
+	}
+
+	expiryYYMM, err := expiry.ParseCardFace(card.ExpirationDate)
+	if err != nil {
+		return models.AdviceResponse{}, fmt.Errorf("parsing card expiration date: %w", err)
+	}
+
+	requestMessage := c.spec.NewMessage()
+	requestData := &AuthorizationRequest{
+		MTI:                  mti,
+		PrimaryAccountNumber: card.Number,
+		Amount:               advice.Amount,
+		Currency:             advice.Currency,
+		TransmissionDateTime: advice.TransmissionDateTime.UTC().Format(time.RFC3339),
+		STAN:                 advice.STAN,
+		ExpirationDate:       expiryYYMM,
+		AuthorizationCode:    advice.AuthorizationCode,
+		TerminalID:           advice.TID,
+		CardAcceptorID:       advice.MID,
+
+		RetrievalReferenceNumber: advice.RRN,
+		AcceptorInformation: &AcceptorInformation{
+			Name:       advice.Merchant.Name,
+			MCC:        advice.Merchant.MCC,
+			PostalCode: advice.Merchant.PostalCode,
+			WebSite:    advice.Merchant.WebSite,
+		},
+	}
+
+	if advice.Original != nil {
+		requestData.OriginalDataElements = formatOriginalData(*advice.Original)
+	}
+
+	if err := c.spec.Marshal(requestMessage, requestData); err != nil {
+		return models.AdviceResponse{}, fmt.Errorf("marshaling request data: %w", err)
+	}
+
+	responseMessage, err := c.send(requestMessage)
+	if err != nil {
+		return models.AdviceResponse{}, fmt.Errorf("sending ISO 8583 message to server: %w", err)
+	}
+
+	responseData := &AuthorizationResponse{}
+	if err := c.spec.Unmarshal(responseMessage, responseData); err != nil {
+		return models.AdviceResponse{}, fmt.Errorf("unmarshaling response data: %w", err)
+	}
+
+	if responseData.MTI != responseMTI {
+		return models.AdviceResponse{}, fmt.Errorf("unexpected response %s to advice", responseData.MTI)
+	}
+
+	return models.AdviceResponse{
+		ApprovalCode: responseData.ApprovalCode,
+	}, nil
+}
+
+func formatOriginalData(original models.OriginalData) string {
+	return iso8583spec.FormatOriginalDataElements(original.MTI, original.STAN, original.TransmissionDateTime)
+}
@@ -0,0 +1,53 @@
+package acquirer
+
+import (
+	"encoding/hex"
+	"fmt"
+
+	"github.com/alovak/cardflow-playground/internal/keys"
+)
+
+// demoDEK is the DEK of the demo key store, for a playground run without
+// one. It is no secret, so keep a key store anywhere else.
+const demoDEK = "8B0C6F1A3E5D27C49F1B6A0E2D7C3F5849E1A6B07C2D5F3E18A4C6B9D0E7F214"
+
+// OpenKeyStore opens the key store holding the DEK payment PANs are sealed
+// with: cfg.KeyStorePath (ACQUIRER_KEYS_STORE when empty), with the master
+// key in KEYS_MASTER_KEY. Without one it returns a memory store of the demo
+// DEK in DEK_DEMO.
+func OpenKeyStore(cfg *Config) (*keys.Store, error) {
+	path := getenv("ACQUIRER_KEYS_STORE", "")
+	if cfg != nil && cfg.KeyStorePath != "" {
+		path = cfg.KeyStorePath
+	}
+
+	if path == "" {
+		dek, err := hex.DecodeString(getenv("DEK_DEMO", demoDEK))
+		if err != nil {
+			return nil, fmt.Errorf("DEK_DEMO is not hex: %w", err)
+		}
+
+		store := keys.NewStore()
+		if _, err := store.Import(keys.PurposeDEK, keys.AlgorithmAES, dek); err != nil {
+			return nil, fmt.Errorf("demo DEK: %w", err)
+		}
+
+		return store, nil
+	}
+
+	master, err := keys.MasterKeyFromEnv()
+	if err != nil {
+		return nil, err
+	}
+
+	store, err := keys.Open(path, master)
+	if err != nil {
+		return nil, fmt.Errorf("opening key store %s: %w", path, err)
+	}
+
+	if _, err := store.Active(keys.PurposeDEK); err != nil {
+		return nil, fmt.Errorf("key store %s: %w", path, err)
+	}
+
+	return store, nil
+}
@@ -0,0 +1,65 @@
+package models
+
+import "time"
+
+type AdviceType string
+
+const (
+	// AdviceTypeCompletion tells the issuer about a transaction the terminal
+	// approved offline (0120).
+	AdviceTypeCompletion AdviceType = "completion"
+	// AdviceTypeReversal tells the issuer the acquirer reversed a
+	// transaction (0420).
+	AdviceTypeReversal AdviceType = "reversal"
+)
+
+// Advice is a message the issuer has to receive but does not have to
+// approve. Advices are stored and forwarded in order, repeated (0121/0421)
+// until the issuer acknowledges them. The card is loaded from the payment
+// when the advice is sent, so the queue holds no card data.
+type Advice struct {
+	ID         string
+	Type       AdviceType
+	PaymentID  string
+	MerchantID string
+	Amount     int64
+	Currency   string
+	TID        string
+	MID        string
+	STAN       string
+	// RRN of the payment; reversal advices refer to the authorization with
+	// Original as well
+	RRN                  string
+	Original             *OriginalData
+	AuthorizationCode    string
+	TransmissionDateTime time.Time
+	Merchant             Merchant
+	// Attempts counts the advices sent, including the one in flight
+	Attempts      int
+	CreatedAt     time.Time
+	LastAttemptAt time.Time
+	// Rejections counts the responses that did not acknowledge the advice
+	// and ResponseCode is the last of them
+	Rejections   int
+	ResponseCode string
+	// ParkedAt is when the advice was taken out of forwarding because the
+	// issuer rejected it for good or it ran out of attempts; parked advices
+	// are left for manual handling
+	ParkedAt time.Time
+}
+
+type AdviceResponse struct {
+	ApprovalCode string
+}
+
+// CreateOfflinePayment records a payment the terminal approved offline, for
+// example below the floor limit.
+type CreateOfflinePayment struct {
+	Amount            int64
+	Currency          string
+	Card              Card
+	AuthorizationCode string
+	// TerminalID is the ID of the terminal that approved the payment; empty
+	// means the merchant's first terminal
+	TerminalID string
+}
@@ -1,5 +1,13 @@
 package models
 
+import "errors"
+
+// ErrAuthorizationUnconfirmed is returned when an authorization request may
+// have reached the issuer but no usable response came back (timeout,
+// connection error, unreadable response). The issuer may hold funds, so the
+// authorization has to be reversed.
+var ErrAuthorizationUnconfirmed = errors.New("authorization unconfirmed")
+
 type AuthorizationResponse struct {
 	ApprovalCode      string
 	AuthorizationCode string
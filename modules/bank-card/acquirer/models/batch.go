@@ -0,0 +1,34 @@
+package models
+
+import "time"
+
+// CloseBatches closes the batches of the business date (YYYY-MM-DD, UTC);
+// empty means today.
+type CloseBatches struct {
+	BusinessDate string
+}
+
+// Batch is what a merchant captured and refunded since its previous batch,
+// cleared with the issuer in one clearing file.
+type Batch struct {
+	ID                string
+	MerchantID        string
+	MID               string
+	BusinessDate      time.Time
+	FileID            string
+	Presentments      int
+	PresentmentAmount int64
+	Refunds           int
+	RefundAmount      int64
+	ClosedAt          time.Time
+}
+
+// ClearingFile is the clearing file written when the batches of a business
+// day are closed. It is written even when no merchant has a batch.
+type ClearingFile struct {
+	ID           string
+	BusinessDate time.Time
+	Path         string
+	Batches      []*Batch
+	CreatedAt    time.Time
+}
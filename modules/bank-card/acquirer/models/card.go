@@ -1,9 +1,13 @@
 package models
 
 type Card struct {
-	Number                string
+	Number string
+	// ExpirationDate is the expiry as printed on the card: MM/YY or MMYY
 	ExpirationDate        string
 	CardVerificationValue string
+	// PINBlock is the hex of the PIN block the terminal encrypted under the
+	// zone PIN key; sent in DE52 and never stored
+	PINBlock string
 }
 
 type SafeCard struct {
@@ -0,0 +1,89 @@
+package models
+
+import "time"
+
+// ChargebackStatus is the stage of a chargeback. Won and lost are from the
+// merchant's side.
+type ChargebackStatus string
+
+const (
+	// ChargebackStatusChargeback means the issuer charged the payment back
+	// and the merchant may respond.
+	ChargebackStatusChargeback ChargebackStatus = "chargeback"
+	// ChargebackStatusRepresentment means the merchant contested the
+	// chargeback with evidence.
+	ChargebackStatusRepresentment ChargebackStatus = "representment"
+	// ChargebackStatusPreArbitration means the issuer contested the
+	// representment.
+	ChargebackStatusPreArbitration ChargebackStatus = "pre_arbitration"
+	// ChargebackStatusWon means the merchant keeps the funds.
+	ChargebackStatusWon ChargebackStatus = "won"
+	// ChargebackStatusLost means the funds go back to the cardholder.
+	ChargebackStatusLost ChargebackStatus = "lost"
+)
+
+// chargebackStatusTransitions lists the statuses a chargeback may move to
+// from each status. Won and lost are final.
+var chargebackStatusTransitions = map[ChargebackStatus][]ChargebackStatus{
+	ChargebackStatusChargeback:     {ChargebackStatusRepresentment, ChargebackStatusLost},
+	ChargebackStatusRepresentment:  {ChargebackStatusPreArbitration, ChargebackStatusWon},
+	ChargebackStatusPreArbitration: {ChargebackStatusWon, ChargebackStatusLost},
+	ChargebackStatusWon:            {},
+	ChargebackStatusLost:           {},
+}
+
+// Valid reports whether s is one of the known chargeback statuses.
+func (s ChargebackStatus) Valid() bool {
+	_, ok := chargebackStatusTransitions[s]
+	return ok
+}
+
+// CanTransitionTo reports whether a chargeback in status s may be moved to next.
+func (s ChargebackStatus) CanTransitionTo(next ChargebackStatus) bool {
+	for _, allowed := range chargebackStatusTransitions[s] {
+		if allowed == next {
+			return true
+		}
+	}
+	return false
+}
+
+// CreateChargeback is a chargeback the issuer raised for its dispute. The
+// payment is found by the TID and RRN of its authorization.
+type CreateChargeback struct {
+	DisputeID  string
+	TID        string
+	RRN        string
+	Amount     int64
+	Currency   string
+	ReasonCode string
+}
+
+// SubmitRepresentment contests a chargeback with the merchant's evidence.
+type SubmitRepresentment struct {
+	Evidence string
+}
+
+// ChangeChargebackStatus moves a chargeback to the outcome of the issuer's
+// response: pre-arbitration, won or lost.
+type ChangeChargebackStatus struct {
+	Status ChargebackStatus
+	Reason string
+}
+
+type Chargeback struct {
+	ID         string
+	PaymentID  string
+	MerchantID string
+	// DisputeID is the issuer's reference of the dispute
+	DisputeID  string
+	Amount     int64
+	Currency   string
+	ReasonCode string
+	Status     ChargebackStatus
+	// Evidence is what the merchant submitted with the representment
+	Evidence  string
+	Reason    string
+	CreatedAt time.Time
+	UpdatedAt time.Time
+}
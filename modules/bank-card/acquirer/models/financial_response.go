@@ -0,0 +1,6 @@
+package models
+
+// FinancialResponse is the issuer answer to a capture or refund (0210).
+type FinancialResponse struct {
+	ApprovalCode string
+}
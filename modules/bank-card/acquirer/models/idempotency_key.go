@@ -0,0 +1,18 @@
+package models
+
+import "time"
+
+// IdempotencyKey remembers the first payment a merchant created with an
+// Idempotency-Key header, so a retried request gets the same payment instead
+// of a second authorization.
+type IdempotencyKey struct {
+	MerchantID string
+	Key        string
+	// Fingerprint is a hash of the request body; a retry must send the same body
+	Fingerprint string
+	// Payment is the payment as it was returned to the first request; nil
+	// while that request is still in flight
+	Payment   *Payment
+	CreatedAt time.Time
+	ExpiresAt time.Time
+}
@@ -1,5 +1,7 @@
 package models
 
+import "time"
+
 type CreateMerchant struct {
 	Name       string
 	MCC        string // Merchant Category Code
@@ -13,4 +15,23 @@ type Merchant struct {
 	MCC        string // Merchant Category Code
 	PostalCode string
 	WebSite    string
+	// MID is the card acceptor ID (DE42) the issuer knows the merchant by
+	MID string
+}
+
+// CreateTerminal adds a terminal to a merchant. An empty TID gets one
+// generated.
+type CreateTerminal struct {
+	TID string
+}
+
+// Terminal is where a merchant accepts cards. Every terminal numbers its
+// messages with its own STAN sequence, so the issuer matches follow-ups by
+// TID and STAN.
+type Terminal struct {
+	ID         string
+	MerchantID string
+	// TID is the terminal ID (DE41), unique across merchants
+	TID       string
+	CreatedAt time.Time
 }
@@ -6,6 +6,9 @@ type CreatePayment struct {
 	Amount   int64
 	Currency string
 	Card     Card
+	// TerminalID is the ID of the merchant's terminal the card was presented
+	// at; empty means the merchant's first terminal
+	TerminalID string
 }
 
 type PaymentStatus string
@@ -15,8 +18,105 @@ const (
 	PaymentStatusError      PaymentStatus = "error"
 	PaymentStatusAuthorized PaymentStatus = "authorized"
 	PaymentStatusDeclined   PaymentStatus = "declined"
+	// PaymentStatusReversalPending means the authorization, or a capture,
+	// void or refund, was not confirmed and a reversal is queued until the
+	// issuer acknowledges it.
+	PaymentStatusReversalPending PaymentStatus = "reversal_pending"
+	// PaymentStatusReversed means the issuer acknowledged the reversal and
+	// released any hold it placed.
+	PaymentStatusReversed PaymentStatus = "reversed"
+	// PaymentStatusReversalFailed means the issuer rejected the reversal for
+	// good; it was parked and the hold has to be released by hand.
+	PaymentStatusReversalFailed PaymentStatus = "reversal_failed"
+	// PaymentStatusPartiallyCaptured means part of the authorized amount was
+	// captured; the rest may still be captured.
+	PaymentStatusPartiallyCaptured PaymentStatus = "partially_captured"
+	PaymentStatusCaptured          PaymentStatus = "captured"
+	// PaymentStatusVoided means the authorization was reversed before
+	// anything was captured.
+	PaymentStatusVoided PaymentStatus = "voided"
+	// PaymentStatusRefunded means everything captured was refunded.
+	PaymentStatusRefunded PaymentStatus = "refunded"
 )
 
+// paymentStatusTransitions lists the statuses a payment may move to from each
+// status. Partial refunds keep the payment in its captured status. An
+// acknowledged reversal of a capture or refund is not listed: it puts the
+// payment back in the CapturedStatus of what is left, and no follow-up may
+// be sent while it is pending.
+var paymentStatusTransitions = map[PaymentStatus][]PaymentStatus{
+	PaymentStatusPending:           {PaymentStatusAuthorized, PaymentStatusDeclined, PaymentStatusError, PaymentStatusReversalPending},
+	PaymentStatusAuthorized:        {PaymentStatusPartiallyCaptured, PaymentStatusCaptured, PaymentStatusVoided, PaymentStatusReversalPending},
+	PaymentStatusPartiallyCaptured: {PaymentStatusPartiallyCaptured, PaymentStatusCaptured, PaymentStatusRefunded, PaymentStatusReversalPending},
+	PaymentStatusCaptured:          {PaymentStatusRefunded, PaymentStatusReversalPending},
+	PaymentStatusVoided:            {PaymentStatusReversalPending},
+	PaymentStatusRefunded:          {PaymentStatusReversalPending},
+	PaymentStatusReversalPending:   {PaymentStatusReversed, PaymentStatusReversalFailed},
+}
+
+// CapturedStatus is the status of an authorized payment with the captured
+// and refunded amounts of p.
+func CapturedStatus(p Payment) PaymentStatus {
+	switch {
+	case p.CapturedAmount == 0:
+		return PaymentStatusAuthorized
+	case p.RefundedAmount == p.CapturedAmount:
+		return PaymentStatusRefunded
+	case p.CapturedAmount < p.Amount:
+		return PaymentStatusPartiallyCaptured
+	default:
+		return PaymentStatusCaptured
+	}
+}
+
+// CanTransitionTo reports whether a payment in status s may be moved to next.
+func (s PaymentStatus) CanTransitionTo(next PaymentStatus) bool {
+	for _, allowed := range paymentStatusTransitions[s] {
+		if allowed == next {
+			return true
+		}
+	}
+	return false
+}
+
+// CapturePayment captures an authorized payment. A zero Amount captures
+// whatever was not captured yet.
+type CapturePayment struct {
+	Amount int64
+}
+
+// CreateRefund refunds part or all of the captured amount. A zero Amount
+// refunds whatever was not refunded yet.
+type CreateRefund struct {
+	Amount int64
+}
+
+type Refund struct {
+	ID        string
+	PaymentID string
+	Amount    int64
+	Currency  string
+	// STAN of the refund message
+	STAN      string
+	CreatedAt time.Time
+	// BatchID is the settlement batch the refund was cleared in; empty
+	// until the batch is closed
+	BatchID string
+}
+
+// Capture is a capture of a payment the issuer approved. Like refunds, it is
+// presented in the clearing file when the merchant's batch is closed.
+type Capture struct {
+	ID        string
+	PaymentID string
+	Amount    int64
+	Currency  string
+	// STAN of the capture message
+	STAN      string
+	CreatedAt time.Time
+	BatchID   string
+}
+
 type Payment struct {
 	ID                string
 	MerchantID        string
@@ -26,4 +126,46 @@ type Payment struct {
 	Status            PaymentStatus
 	CreatedAt         time.Time
 	AuthorizationCode string
+	// MTI, STAN and RRN of the message that authorized the payment: 0100, or
+	// 0120 when it was approved offline. Captures, voids and refunds quote
+	// the RRN and the original data elements so the issuer can find the
+	// authorization.
+	MTI            string
+	STAN           string
+	RRN            string
+	CapturedAmount int64
+	RefundedAmount int64
+	// TerminalID is the ID of the terminal; TID and MID are the terminal and
+	// card acceptor IDs it was sent with
+	TerminalID string
+	TID        string
+	MID        string
+}
+
+// PaymentEvent is an audit record of a change to a payment, with the status
+// and amounts the change left the payment in.
+type PaymentEvent struct {
+	ID             string
+	PaymentID      string
+	Status         PaymentStatus
+	CapturedAmount int64
+	RefundedAmount int64
+	CreatedAt      time.Time
+}
+
+// OriginalData are the original data elements (DE90) of the message that
+// authorized the payment.
+func (p Payment) OriginalData() OriginalData {
+	return OriginalData{
+		MTI:                  p.MTI,
+		STAN:                 p.STAN,
+		TransmissionDateTime: p.CreatedAt,
+	}
+}
+
+// OriginalData identify the message a follow-up refers to.
+type OriginalData struct {
+	MTI                  string
+	STAN                 string
+	TransmissionDateTime time.Time
 }
@@ -0,0 +1,51 @@
+package models
+
+import "time"
+
+// Reversal is a pending 0400 for an authorization, capture or refund the
+// acquirer could not confirm. It keeps the original data elements so the
+// issuer can find what it reverses; the card is loaded from the payment when it is sent, so the
+// queue holds no card data. It is dropped once the issuer acknowledges it,
+// or parked when the issuer will not.
+type Reversal struct {
+	Type       ReversalType
+	PaymentID  string
+	MerchantID string
+	Amount     int64
+	Currency   string
+	TID        string
+	MID        string
+	// STAN of the reversal, kept by its repeats
+	STAN string
+	// RRN refers to the authorization and Original to the message reversed:
+	// the authorization, or the 0200 of a capture or refund
+	RRN      string
+	Original OriginalData
+	// Attempts counts the reversals sent; every attempt after the first is a 0401 repeat
+	Attempts      int
+	CreatedAt     time.Time
+	LastAttemptAt time.Time
+	// Rejections counts the responses that did not acknowledge the reversal
+	// and ResponseCode is the last of them
+	Rejections   int
+	ResponseCode string
+	// ParkedAt is when the reversal was no longer sent because the issuer
+	// rejected it for good or it ran out of attempts; parked reversals are
+	// left for manual handling
+	ParkedAt time.Time
+}
+
+// ReversalType is what a reversal reverses. The reversal of an authorization
+// leaves the payment reversed; that of a capture or refund gives its amount
+// back to the payment.
+type ReversalType string
+
+const (
+	ReversalTypeAuthorization ReversalType = ""
+	ReversalTypeCapture       ReversalType = "capture"
+	ReversalTypeRefund        ReversalType = "refund"
+)
+
+type ReversalResponse struct {
+	ApprovalCode string
+}
@@ -1,70 +1,1287 @@
 package acquirer
 
 import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"sort"
+	"strings"
 	"sync"
+	"time"
 
 	"github.com/alovak/cardflow-playground/acquirer/models"
+	"github.com/alovak/cardflow-playground/internal/clearing"
+	"github.com/alovak/cardflow-playground/internal/keys"
+	"github.com/google/uuid"
 )
 
 var ErrNotFound = fmt.Errorf("not found")
 
+// ErrTerminalExists is returned when a terminal is created with a TID that is
+// already taken.
+var ErrTerminalExists = fmt.Errorf("terminal ID already exists")
+
+// ErrInvalidPaymentStatus is returned when an operation does not apply to the
+// payment in its current status.
+var ErrInvalidPaymentStatus = fmt.Errorf("invalid payment status")
+
+// ErrPaymentChanged is returned when a payment is updated on the assumption
+// of a status and amounts a concurrent request changed in the meantime.
+var ErrPaymentChanged = fmt.Errorf("payment changed concurrently")
+
+// ErrAlreadyCleared is returned when a batch is closed with a capture or
+// refund another batch cleared already.
+var ErrAlreadyCleared = fmt.Errorf("capture or refund already cleared")
+
+// ErrInvalidChargebackStatus is returned when a chargeback cannot move to the
+// requested status from its current one.
+var ErrInvalidChargebackStatus = fmt.Errorf("invalid chargeback status")
+
+// Repository keeps merchants and payments in memory, or in the acquirer
+// schema when it is created with NewPGRepository.
 type Repository struct {
 	mu sync.RWMutex
 
 	merchants map[string]*models.Merchant
+	// terminals is keyed by merchant ID, in the order they were created
+	terminals map[string][]*models.Terminal
 	payments  map[string]*models.Payment
+	// paymentCards keeps the PAN and expiry of payments for the follow-up
+	// messages the issuer matches by card (advices, reversals)
+	paymentCards  map[string]models.Card
+	refunds       map[string][]*models.Refund
+	captures      map[string][]*models.Capture
+	paymentEvents map[string][]*models.PaymentEvent
+	// batches is keyed by merchant ID, in the order they were closed
+	batches map[string][]*models.Batch
+	// chargebacks is keyed by chargeback ID
+	chargebacks map[string]*models.Chargeback
+	// idempotencyKeys is keyed by merchant ID and key
+	idempotencyKeys map[[2]string]*models.IdempotencyKey
+	// stans keeps the last STAN by TID and transmission date
+	stans map[[2]string]int
+
+	db *sql.DB
+	// keyStore has the DEK the PANs of payment_cards are sealed with
+	keyStore *keys.Store
 }
 
 func NewRepository() *Repository {
 	return &Repository{
-		merchants: make(map[string]*models.Merchant),
-		payments:  make(map[string]*models.Payment),
+		merchants:     make(map[string]*models.Merchant),
+		terminals:     make(map[string][]*models.Terminal),
+		payments:      make(map[string]*models.Payment),
+		paymentCards:  make(map[string]models.Card),
+		refunds:       make(map[string][]*models.Refund),
+		captures:      make(map[string][]*models.Capture),
+		paymentEvents: make(map[string][]*models.PaymentEvent),
+		batches:       make(map[string][]*models.Batch),
+		chargebacks:   make(map[string]*models.Chargeback),
+
+		idempotencyKeys: make(map[[2]string]*models.IdempotencyKey),
+		stans:           make(map[[2]string]int),
 	}
 }
 
+// NewPGRepository constructs a repository backed by the acquirer schema (see
+// migrations/acquirer). The PANs of payments are sealed with the active DEK
+// of the key store.
+func NewPGRepository(db *sql.DB, keyStore *keys.Store) *Repository {
+	return &Repository{db: db, keyStore: keyStore}
+}
+
 func (r *Repository) CreateMerchant(merchant *models.Merchant) error {
-	r.mu.Lock()
-	defer r.mu.Unlock()
+	if r.db == nil {
+		r.mu.Lock()
+		defer r.mu.Unlock()
 
-	r.merchants[merchant.ID] = merchant
+		r.merchants[merchant.ID] = merchant
 
-	return nil
+		return nil
+	}
+
+	_, err := r.db.ExecContext(context.Background(), `
+		insert into acquirer.merchants(merchant_id, name, mcc, postal_code, website, mid)
+		values ($1, $2, $3, $4, $5, $6)
+	`, merchant.ID, merchant.Name, merchant.MCC, merchant.PostalCode, merchant.WebSite, merchant.MID)
+
+	return err
 }
 
 func (r *Repository) GetMerchant(merchantID string) (*models.Merchant, error) {
-	r.mu.RLock()
-	defer r.mu.RUnlock()
+	if r.db == nil {
+		r.mu.RLock()
+		defer r.mu.RUnlock()
+
+		merchant, ok := r.merchants[merchantID]
+		if !ok {
+			return nil, ErrNotFound
+		}
+
+		return merchant, nil
+	}
 
-	merchant, ok := r.merchants[merchantID]
-	if !ok {
+	merchant := &models.Merchant{}
+	var postalCode, webSite sql.NullString
+	err := r.db.QueryRowContext(context.Background(), `
+		select merchant_id, name, mcc, postal_code, website, mid from acquirer.merchants where merchant_id::text = $1
+	`, merchantID).Scan(&merchant.ID, &merchant.Name, &merchant.MCC, &postalCode, &webSite, &merchant.MID)
+	if errors.Is(err, sql.ErrNoRows) {
 		return nil, ErrNotFound
 	}
+	if err != nil {
+		return nil, err
+	}
+
+	merchant.PostalCode = postalCode.String
+	merchant.WebSite = webSite.String
 
 	return merchant, nil
 }
 
-func (r *Repository) CreatePayment(payment *models.Payment) error {
-	r.mu.Lock()
-	defer r.mu.Unlock()
+// CreateTerminal adds a terminal to its merchant. It returns
+// ErrTerminalExists when the TID is taken.
+func (r *Repository) CreateTerminal(terminal *models.Terminal) error {
+	if r.db == nil {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+
+		for _, terminals := range r.terminals {
+			for _, t := range terminals {
+				if t.TID == terminal.TID {
+					return ErrTerminalExists
+				}
+			}
+		}
 
-	r.payments[payment.ID] = payment
+		r.terminals[terminal.MerchantID] = append(r.terminals[terminal.MerchantID], terminal)
+
+		return nil
+	}
+
+	res, err := r.db.ExecContext(context.Background(), `
+		insert into acquirer.terminals(terminal_id, merchant_id, tid, created_at)
+		values ($1, $2, $3, $4)
+		on conflict (tid) do nothing
+	`, terminal.ID, terminal.MerchantID, terminal.TID, terminal.CreatedAt)
+	if err != nil {
+		return err
+	}
+
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return ErrTerminalExists
+	}
 
 	return nil
 }
 
+// GetTerminal returns the terminal of the merchant.
+func (r *Repository) GetTerminal(merchantID, terminalID string) (*models.Terminal, error) {
+	if r.db == nil {
+		r.mu.RLock()
+		defer r.mu.RUnlock()
+
+		for _, terminal := range r.terminals[merchantID] {
+			if terminal.ID == terminalID {
+				return terminal, nil
+			}
+		}
+
+		return nil, ErrNotFound
+	}
+
+	terminal := &models.Terminal{}
+	err := r.db.QueryRowContext(context.Background(), `
+		select terminal_id, merchant_id, tid, created_at
+		  from acquirer.terminals
+		 where terminal_id::text = $1 and merchant_id::text = $2
+	`, terminalID, merchantID).Scan(&terminal.ID, &terminal.MerchantID, &terminal.TID, &terminal.CreatedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return terminal, nil
+}
+
+// ListTerminals returns the terminals of the merchant, oldest first.
+func (r *Repository) ListTerminals(merchantID string) ([]*models.Terminal, error) {
+	if r.db == nil {
+		r.mu.RLock()
+		defer r.mu.RUnlock()
+
+		return append([]*models.Terminal(nil), r.terminals[merchantID]...), nil
+	}
+
+	rows, err := r.db.QueryContext(context.Background(), `
+		select terminal_id, merchant_id, tid, created_at
+		  from acquirer.terminals
+		 where merchant_id::text = $1
+		 order by created_at, terminal_id
+	`, merchantID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var terminals []*models.Terminal
+	for rows.Next() {
+		terminal := &models.Terminal{}
+		if err := rows.Scan(&terminal.ID, &terminal.MerchantID, &terminal.TID, &terminal.CreatedAt); err != nil {
+			return nil, err
+		}
+		terminals = append(terminals, terminal)
+	}
+
+	return terminals, rows.Err()
+}
+
+func (r *Repository) CreatePayment(payment *models.Payment) error {
+	if r.db == nil {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+
+		r.payments[payment.ID] = payment
+		r.addPaymentEvent(payment)
+
+		return nil
+	}
+
+	tx, err := r.db.BeginTx(context.Background(), nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`
+		insert into acquirer.payments(payment_id, merchant_id, amount, currency, card_first6, card_last4, card_expiry,
+		                              status, authorization_code, stan, captured_amount, refunded_amount, created_at,
+		                              terminal_id, tid, mid, mti, rrn)
+		values ($1, $2, $3, $4, $5, $6, $7, $8, nullif($9, ''), nullif($10, ''), $11, $12, $13,
+		        nullif($14, '')::uuid, nullif($15, ''), nullif($16, ''), nullif($17, ''), nullif($18, ''))
+	`, payment.ID, payment.MerchantID, payment.Amount, strings.ToUpper(payment.Currency),
+		payment.Card.First6, payment.Card.Last4, payment.Card.ExpirationDate,
+		string(payment.Status), payment.AuthorizationCode, payment.STAN,
+		payment.CapturedAmount, payment.RefundedAmount, payment.CreatedAt,
+		payment.TerminalID, payment.TID, payment.MID, payment.MTI, payment.RRN)
+	if err != nil {
+		return err
+	}
+
+	if err := insertPaymentEvent(tx, payment); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
 func (r *Repository) GetPayment(merchantID, paymentID string) (*models.Payment, error) {
-	r.mu.RLock()
-	defer r.mu.RUnlock()
+	if r.db == nil {
+		r.mu.RLock()
+		defer r.mu.RUnlock()
+
+		payment, ok := r.payments[paymentID]
+		if !ok {
+			return nil, ErrNotFound
+		}
+
+		if payment.MerchantID != merchantID {
+			return nil, ErrNotFound
+		}
+
+		return payment, nil
+	}
+
+	return r.queryPayment(`payment_id::text = $1 and merchant_id::text = $2`, paymentID, merchantID)
+}
+
+// FindPaymentByRRN returns the payment authorized at the terminal with the
+// given RRN.
+func (r *Repository) FindPaymentByRRN(tid, rrn string) (*models.Payment, error) {
+	if r.db == nil {
+		r.mu.RLock()
+		defer r.mu.RUnlock()
+
+		for _, payment := range r.payments {
+			if payment.TID == tid && payment.RRN == rrn {
+				return payment, nil
+			}
+		}
 
-	payment, ok := r.payments[paymentID]
-	if !ok {
 		return nil, ErrNotFound
 	}
 
-	if payment.MerchantID != merchantID {
+	return r.queryPayment(`tid = $1 and rrn = $2`, tid, rrn)
+}
+
+func (r *Repository) queryPayment(where string, args ...any) (*models.Payment, error) {
+	payment := &models.Payment{}
+	var status string
+	var authorizationCode, stan, terminalID, tid, mid, mti, rrn sql.NullString
+	err := r.db.QueryRowContext(context.Background(), `
+		select payment_id, merchant_id, amount, currency, card_first6, card_last4, card_expiry,
+		       status, authorization_code, stan, captured_amount, refunded_amount, created_at,
+		       terminal_id, tid, mid, mti, rrn
+		  from acquirer.payments
+		 where `+where, args...).Scan(&payment.ID, &payment.MerchantID, &payment.Amount, &payment.Currency,
+		&payment.Card.First6, &payment.Card.Last4, &payment.Card.ExpirationDate,
+		&status, &authorizationCode, &stan, &payment.CapturedAmount, &payment.RefundedAmount, &payment.CreatedAt,
+		&terminalID, &tid, &mid, &mti, &rrn)
+	if errors.Is(err, sql.ErrNoRows) {
 		return nil, ErrNotFound
 	}
+	if err != nil {
+		return nil, err
+	}
+
+	payment.Status = models.PaymentStatus(status)
+	payment.AuthorizationCode = authorizationCode.String
+	payment.STAN = stan.String
+	payment.TerminalID = terminalID.String
+	payment.TID = tid.String
+	payment.MID = mid.String
+	payment.MTI = mti.String
+	payment.RRN = rrn.String
 
 	return payment, nil
 }
+
+func (r *Repository) UpdatePaymentStatus(paymentID string, status models.PaymentStatus) error {
+	if r.db == nil {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+
+		payment, ok := r.payments[paymentID]
+		if !ok {
+			return ErrNotFound
+		}
+
+		payment.Status = status
+		r.addPaymentEvent(payment)
+
+		return nil
+	}
+
+	return r.updatePayment(`
+		update acquirer.payments set status = $2 where payment_id = $1
+		returning status, captured_amount, refunded_amount
+	`, paymentID, string(status))
+}
+
+// UpdatePayment stores the outcome of the authorization (status, STAN,
+// authorization code) and the captured and refunded amounts of the payment.
+func (r *Repository) UpdatePayment(payment *models.Payment) error {
+	if r.db == nil {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+
+		stored, ok := r.payments[payment.ID]
+		if !ok {
+			return ErrNotFound
+		}
+
+		stored.Status = payment.Status
+		stored.STAN = payment.STAN
+		stored.AuthorizationCode = payment.AuthorizationCode
+		stored.CapturedAmount = payment.CapturedAmount
+		stored.RefundedAmount = payment.RefundedAmount
+		r.addPaymentEvent(stored)
+
+		return nil
+	}
+
+	return r.updatePayment(`
+		update acquirer.payments
+		   set status = $2, stan = nullif($3, ''), authorization_code = nullif($4, ''),
+		       captured_amount = $5, refunded_amount = $6
+		 where payment_id = $1
+		returning status, captured_amount, refunded_amount
+	`, payment.ID, string(payment.Status), payment.STAN, payment.AuthorizationCode,
+		payment.CapturedAmount, payment.RefundedAmount)
+}
+
+// UpdatePaymentIf stores the status and the captured and refunded amounts of
+// payment, provided the stored payment still has those of expected; it
+// returns ErrPaymentChanged otherwise. Captures, voids and refunds claim
+// their amount with it, so concurrent ones (on any instance) cannot take
+// more than the payment has left.
+func (r *Repository) UpdatePaymentIf(expected models.Payment, payment *models.Payment) error {
+	if r.db == nil {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+
+		stored, ok := r.payments[payment.ID]
+		if !ok {
+			return ErrNotFound
+		}
+		if stored.Status != expected.Status || stored.CapturedAmount != expected.CapturedAmount || stored.RefundedAmount != expected.RefundedAmount {
+			return ErrPaymentChanged
+		}
+
+		stored.Status = payment.Status
+		stored.CapturedAmount = payment.CapturedAmount
+		stored.RefundedAmount = payment.RefundedAmount
+		r.addPaymentEvent(stored)
+
+		return nil
+	}
+
+	err := r.updatePayment(`
+		update acquirer.payments
+		   set status = $2, captured_amount = $3, refunded_amount = $4
+		 where payment_id = $1 and status = $5 and captured_amount = $6 and refunded_amount = $7
+		returning status, captured_amount, refunded_amount
+	`, payment.ID, string(payment.Status), payment.CapturedAmount, payment.RefundedAmount,
+		string(expected.Status), expected.CapturedAmount, expected.RefundedAmount)
+	if errors.Is(err, ErrNotFound) {
+		// the payment was read before, so it is the condition that failed
+		return ErrPaymentChanged
+	}
+
+	return err
+}
+
+// updatePayment runs the update query, which returns the status and amounts
+// of the payment, and records them as a payment event.
+func (r *Repository) updatePayment(query string, paymentID string, args ...any) error {
+	tx, err := r.db.BeginTx(context.Background(), nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	event := &models.Payment{ID: paymentID}
+	var status string
+	err = tx.QueryRow(query, append([]any{paymentID}, args...)...).Scan(&status, &event.CapturedAmount, &event.RefundedAmount)
+	if errors.Is(err, sql.ErrNoRows) {
+		return ErrNotFound
+	}
+	if err != nil {
+		return err
+	}
+	event.Status = models.PaymentStatus(status)
+
+	if err := insertPaymentEvent(tx, event); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (r *Repository) CreateRefund(refund *models.Refund) error {
+	if r.db == nil {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+
+		r.refunds[refund.PaymentID] = append(r.refunds[refund.PaymentID], refund)
+
+		return nil
+	}
+
+	_, err := r.db.ExecContext(context.Background(), `
+		insert into acquirer.refunds(refund_id, payment_id, amount, currency, stan, created_at)
+		values ($1, $2, $3, $4, nullif($5, ''), $6)
+	`, refund.ID, refund.PaymentID, refund.Amount, strings.ToUpper(refund.Currency), refund.STAN, refund.CreatedAt)
+
+	return err
+}
+
+func (r *Repository) CreateCapture(capture *models.Capture) error {
+	if r.db == nil {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+
+		r.captures[capture.PaymentID] = append(r.captures[capture.PaymentID], capture)
+
+		return nil
+	}
+
+	_, err := r.db.ExecContext(context.Background(), `
+		insert into acquirer.captures(capture_id, payment_id, amount, currency, stan, created_at)
+		values ($1, $2, $3, $4, nullif($5, ''), $6)
+	`, capture.ID, capture.PaymentID, capture.Amount, strings.ToUpper(capture.Currency), capture.STAN, capture.CreatedAt)
+
+	return err
+}
+
+// ListPaymentEvents returns the changes made to the payment, oldest first.
+func (r *Repository) ListPaymentEvents(paymentID string) ([]*models.PaymentEvent, error) {
+	if r.db == nil {
+		r.mu.RLock()
+		defer r.mu.RUnlock()
+
+		return append([]*models.PaymentEvent(nil), r.paymentEvents[paymentID]...), nil
+	}
+
+	rows, err := r.db.QueryContext(context.Background(), `
+		select event_id, payment_id, status, captured_amount, refunded_amount, created_at
+		  from acquirer.payment_events
+		 where payment_id::text = $1
+		 order by created_at, event_id
+	`, paymentID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var events []*models.PaymentEvent
+	for rows.Next() {
+		event := &models.PaymentEvent{}
+		var status string
+		if err := rows.Scan(&event.ID, &event.PaymentID, &status, &event.CapturedAmount, &event.RefundedAmount, &event.CreatedAt); err != nil {
+			return nil, err
+		}
+		event.Status = models.PaymentStatus(status)
+		events = append(events, event)
+	}
+
+	return events, rows.Err()
+}
+
+// StorePaymentCard keeps the card of the payment. Only the PAN and expiry are
+// stored, the CVV and PIN block are dropped; in the database the PAN is
+// sealed with the DEK, bound to the payment.
+func (r *Repository) StorePaymentCard(paymentID string, card models.Card) error {
+	if r.db == nil {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+
+		r.paymentCards[paymentID] = models.Card{
+			Number:         card.Number,
+			ExpirationDate: card.ExpirationDate,
+		}
+
+		return nil
+	}
+
+	token, err := r.sealPAN(paymentID, card.Number)
+	if err != nil {
+		return err
+	}
+
+	_, err = r.db.ExecContext(context.Background(), `
+		insert into acquirer.payment_cards(payment_id, pan_token, expiry) values ($1, $2, $3)
+		on conflict (payment_id) do update set pan = null, pan_token = excluded.pan_token, expiry = excluded.expiry
+	`, paymentID, token, card.ExpirationDate)
+
+	return err
+}
+
+// SealPaymentCards seals the PANs stored in clear before they were sealed,
+// and returns how many it sealed.
+func (r *Repository) SealPaymentCards() (int, error) {
+	if r.db == nil {
+		return 0, nil
+	}
+
+	rows, err := r.db.QueryContext(context.Background(), `
+		select payment_id::text, pan from acquirer.payment_cards where pan is not null
+	`)
+	if err != nil {
+		return 0, err
+	}
+	clear := map[string]string{}
+	for rows.Next() {
+		var paymentID, pan string
+		if err := rows.Scan(&paymentID, &pan); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		clear[paymentID] = pan
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	for paymentID, pan := range clear {
+		token, err := r.sealPAN(paymentID, pan)
+		if err != nil {
+			return 0, err
+		}
+		_, err = r.db.ExecContext(context.Background(), `
+			update acquirer.payment_cards set pan_token = $2, pan = null where payment_id::text = $1
+		`, paymentID, token)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	return len(clear), nil
+}
+
+func (r *Repository) sealPAN(paymentID, pan string) (string, error) {
+	dek, err := r.keyStore.Active(keys.PurposeDEK)
+	if err != nil {
+		return "", fmt.Errorf("sealing PAN: %w", err)
+	}
+
+	return keys.Seal(dek, []byte(pan), []byte(paymentID))
+}
+
+func (r *Repository) unsealPAN(paymentID, token string) (string, error) {
+	pan, err := r.keyStore.Unseal(token, []byte(paymentID))
+	if err != nil {
+		return "", fmt.Errorf("unsealing PAN of payment %s: %w", paymentID, err)
+	}
+
+	return string(pan), nil
+}
+
+func (r *Repository) GetPaymentCard(paymentID string) (models.Card, error) {
+	if r.db == nil {
+		r.mu.RLock()
+		defer r.mu.RUnlock()
+
+		card, ok := r.paymentCards[paymentID]
+		if !ok {
+			return models.Card{}, ErrNotFound
+		}
+
+		return card, nil
+	}
+
+	card := models.Card{}
+	var token string
+	err := r.db.QueryRowContext(context.Background(), `
+		select pan_token, expiry from acquirer.payment_cards where payment_id::text = $1
+	`, paymentID).Scan(&token, &card.ExpirationDate)
+	if errors.Is(err, sql.ErrNoRows) {
+		return models.Card{}, ErrNotFound
+	}
+	if err != nil {
+		return models.Card{}, err
+	}
+
+	card.Number, err = r.unsealPAN(paymentID, token)
+	if err != nil {
+		return models.Card{}, err
+	}
+
+	return card, nil
+}
+
+// ReserveIdempotencyKey stores the key unless the merchant already used it
+// and it has not expired yet. It returns the stored key and whether it was
+// reserved by this call.
+func (r *Repository) ReserveIdempotencyKey(key *models.IdempotencyKey) (*models.IdempotencyKey, bool, error) {
+	if r.db == nil {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+
+		id := [2]string{key.MerchantID, key.Key}
+		if stored, ok := r.idempotencyKeys[id]; ok && stored.ExpiresAt.After(time.Now()) {
+			copied := *stored
+			return &copied, false, nil
+		}
+
+		copied := *key
+		r.idempotencyKeys[id] = &copied
+
+		return key, true, nil
+	}
+
+	// an expired key is taken over as if it was never used
+	err := r.db.QueryRowContext(context.Background(), `
+		insert into acquirer.idempotency_keys(merchant_id, idempotency_key, fingerprint, created_at, expires_at)
+		values ($1, $2, $3, $4, $5)
+		on conflict (merchant_id, idempotency_key) do update
+		   set fingerprint = excluded.fingerprint, payment = null,
+		       created_at = excluded.created_at, expires_at = excluded.expires_at
+		 where acquirer.idempotency_keys.expires_at <= now()
+		returning merchant_id
+	`, key.MerchantID, key.Key, key.Fingerprint, key.CreatedAt, key.ExpiresAt).Scan(new(string))
+	if err == nil {
+		return key, true, nil
+	}
+	if !errors.Is(err, sql.ErrNoRows) {
+		return nil, false, err
+	}
+
+	stored := &models.IdempotencyKey{}
+	var payment []byte
+	err = r.db.QueryRowContext(context.Background(), `
+		select merchant_id, idempotency_key, fingerprint, payment, created_at, expires_at
+		  from acquirer.idempotency_keys
+		 where merchant_id = $1 and idempotency_key = $2
+	`, key.MerchantID, key.Key).Scan(&stored.MerchantID, &stored.Key, &stored.Fingerprint, &payment, &stored.CreatedAt, &stored.ExpiresAt)
+	if err != nil {
+		return nil, false, err
+	}
+
+	if payment != nil {
+		stored.Payment = &models.Payment{}
+		if err := json.Unmarshal(payment, stored.Payment); err != nil {
+			return nil, false, fmt.Errorf("decoding payment of idempotency key: %w", err)
+		}
+	}
+
+	return stored, false, nil
+}
+
+// CompleteIdempotencyKey stores the payment returned to the request that
+// reserved the key.
+func (r *Repository) CompleteIdempotencyKey(merchantID, key string, payment *models.Payment) error {
+	if r.db == nil {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+
+		stored, ok := r.idempotencyKeys[[2]string{merchantID, key}]
+		if !ok {
+			return ErrNotFound
+		}
+
+		copied := *payment
+		stored.Payment = &copied
+
+		return nil
+	}
+
+	encoded, err := json.Marshal(payment)
+	if err != nil {
+		return fmt.Errorf("encoding payment of idempotency key: %w", err)
+	}
+
+	res, err := r.db.ExecContext(context.Background(), `
+		update acquirer.idempotency_keys set payment = $3 where merchant_id = $1 and idempotency_key = $2
+	`, merchantID, key, encoded)
+	if err != nil {
+		return err
+	}
+
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return ErrNotFound
+	}
+
+	return nil
+}
+
+// ReleaseIdempotencyKey forgets a key whose request failed, so it can be
+// retried.
+func (r *Repository) ReleaseIdempotencyKey(merchantID, key string) error {
+	if r.db == nil {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+
+		delete(r.idempotencyKeys, [2]string{merchantID, key})
+
+		return nil
+	}
+
+	_, err := r.db.ExecContext(context.Background(), `
+		delete from acquirer.idempotency_keys where merchant_id = $1 and idempotency_key = $2
+	`, merchantID, key)
+
+	return err
+}
+
+// DeleteExpiredIdempotencyKeys removes the keys that expired before now and
+// returns how many were removed.
+func (r *Repository) DeleteExpiredIdempotencyKeys(now time.Time) (int, error) {
+	if r.db == nil {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+
+		deleted := 0
+		for id, key := range r.idempotencyKeys {
+			if !key.ExpiresAt.After(now) {
+				delete(r.idempotencyKeys, id)
+				deleted++
+			}
+		}
+
+		return deleted, nil
+	}
+
+	res, err := r.db.ExecContext(context.Background(), `
+		delete from acquirer.idempotency_keys where expires_at <= $1
+	`, now)
+	if err != nil {
+		return 0, err
+	}
+
+	n, err := res.RowsAffected()
+
+	return int(n), err
+}
+
+// NextSTAN returns the next STAN of the terminal for the transmission date
+// (UTC). Every terminal starts at 000001 every day and wraps after 999999.
+func (r *Repository) NextSTAN(tid string, transmittedAt time.Time) (string, error) {
+	date := transmittedAt.UTC().Format("2006-01-02")
+
+	if r.db == nil {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+
+		id := [2]string{tid, date}
+		r.stans[id] = r.stans[id]%999999 + 1
+
+		return fmt.Sprintf("%06d", r.stans[id]), nil
+	}
+
+	var stan int
+	err := r.db.QueryRowContext(context.Background(), `
+		insert into acquirer.stan_sequences(tid, transmission_date, last_stan) values ($1, $2, 1)
+		on conflict (tid, transmission_date) do update
+		   set last_stan = acquirer.stan_sequences.last_stan % 999999 + 1
+		returning last_stan
+	`, tid, date).Scan(&stan)
+	if err != nil {
+		return "", err
+	}
+
+	return fmt.Sprintf("%06d", stan), nil
+}
+
+// clearingItem is a capture or refund that was not cleared yet, with the
+// payment and card its clearing record is made of.
+type clearingItem struct {
+	Code      clearing.TransactionCode
+	ID        string
+	Amount    int64
+	Currency  string
+	STAN      string
+	CreatedAt time.Time
+	Payment   models.Payment
+	Card      models.Card
+}
+
+// ListUnclearedItems returns the captures and refunds made before until that
+// are in no batch yet, by merchant and oldest first.
+func (r *Repository) ListUnclearedItems(until time.Time) ([]clearingItem, error) {
+	if r.db == nil {
+		r.mu.RLock()
+		defer r.mu.RUnlock()
+
+		var items []clearingItem
+		add := func(code clearing.TransactionCode, id, paymentID string, amount int64, currency, stan, batchID string, createdAt time.Time) {
+			if batchID != "" || !createdAt.Before(until) {
+				return
+			}
+			items = append(items, clearingItem{
+				Code:      code,
+				ID:        id,
+				Amount:    amount,
+				Currency:  currency,
+				STAN:      stan,
+				CreatedAt: createdAt,
+				Payment:   *r.payments[paymentID],
+				Card:      r.paymentCards[paymentID],
+			})
+		}
+		for _, captures := range r.captures {
+			for _, c := range captures {
+				add(clearing.TransactionCodePresentment, c.ID, c.PaymentID, c.Amount, c.Currency, c.STAN, c.BatchID, c.CreatedAt)
+			}
+		}
+		for _, refunds := range r.refunds {
+			for _, rf := range refunds {
+				add(clearing.TransactionCodeRefund, rf.ID, rf.PaymentID, rf.Amount, rf.Currency, rf.STAN, rf.BatchID, rf.CreatedAt)
+			}
+		}
+
+		sort.Slice(items, func(i, j int) bool {
+			if items[i].Payment.MerchantID != items[j].Payment.MerchantID {
+				return items[i].Payment.MerchantID < items[j].Payment.MerchantID
+			}
+			if !items[i].CreatedAt.Equal(items[j].CreatedAt) {
+				return items[i].CreatedAt.Before(items[j].CreatedAt)
+			}
+			return items[i].ID < items[j].ID
+		})
+
+		return items, nil
+	}
+
+	rows, err := r.db.QueryContext(context.Background(), `
+		select i.code, i.id, i.amount, i.currency, coalesce(i.stan, ''), i.created_at,
+		       p.payment_id, p.merchant_id, coalesce(p.authorization_code, ''), coalesce(p.rrn, ''),
+		       coalesce(p.tid, ''), coalesce(p.mid, ''), pc.pan_token, pc.expiry
+		  from (select '05' as code, capture_id as id, payment_id, amount, currency, stan, created_at
+		          from acquirer.captures where batch_id is null and created_at < $1
+		        union all
+		        select '06', refund_id, payment_id, amount, currency, stan, created_at
+		          from acquirer.refunds where batch_id is null and created_at < $1) i
+		  join acquirer.payments p on p.payment_id = i.payment_id
+		  join acquirer.payment_cards pc on pc.payment_id = i.payment_id
+		 order by p.merchant_id, i.created_at, i.id
+	`, until)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var items []clearingItem
+	for rows.Next() {
+		var item clearingItem
+		var code, token string
+		err := rows.Scan(&code, &item.ID, &item.Amount, &item.Currency, &item.STAN, &item.CreatedAt,
+			&item.Payment.ID, &item.Payment.MerchantID, &item.Payment.AuthorizationCode, &item.Payment.RRN,
+			&item.Payment.TID, &item.Payment.MID, &token, &item.Card.ExpirationDate)
+		if err != nil {
+			return nil, err
+		}
+		item.Card.Number, err = r.unsealPAN(item.Payment.ID, token)
+		if err != nil {
+			return nil, err
+		}
+		item.Code = clearing.TransactionCode(code)
+		items = append(items, item)
+	}
+
+	return items, rows.Err()
+}
+
+// CloseBatches stores the batches and assigns their captures and refunds
+// (keyed by batch ID) to them, all or nothing. It returns ErrAlreadyCleared
+// when one of them is in a batch already.
+func (r *Repository) CloseBatches(batches []*models.Batch, items map[string][]clearingItem) error {
+	if r.db == nil {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+
+		find := func(item clearingItem) *string {
+			if item.Code == clearing.TransactionCodePresentment {
+				for _, c := range r.captures[item.Payment.ID] {
+					if c.ID == item.ID {
+						return &c.BatchID
+					}
+				}
+			}
+			for _, rf := range r.refunds[item.Payment.ID] {
+				if rf.ID == item.ID {
+					return &rf.BatchID
+				}
+			}
+			return nil
+		}
+
+		// check everything first, so nothing changes on conflict
+		for _, batch := range batches {
+			for _, item := range items[batch.ID] {
+				if batchID := find(item); batchID == nil || *batchID != "" {
+					return ErrAlreadyCleared
+				}
+			}
+		}
+		for _, batch := range batches {
+			for _, item := range items[batch.ID] {
+				*find(item) = batch.ID
+			}
+			r.batches[batch.MerchantID] = append(r.batches[batch.MerchantID], batch)
+		}
+
+		return nil
+	}
+
+	tx, err := r.db.BeginTx(context.Background(), nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, batch := range batches {
+		_, err := tx.Exec(`
+			insert into acquirer.batches(batch_id, merchant_id, mid, business_date, file_id,
+			                             presentments, presentment_amount, refunds, refund_amount, closed_at)
+			values ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)
+		`, batch.ID, batch.MerchantID, batch.MID, batch.BusinessDate.Format("2006-01-02"), batch.FileID,
+			batch.Presentments, batch.PresentmentAmount, batch.Refunds, batch.RefundAmount, batch.ClosedAt)
+		if err != nil {
+			return err
+		}
+
+		for _, item := range items[batch.ID] {
+			query := `update acquirer.captures set batch_id = $2 where capture_id = $1 and batch_id is null`
+			if item.Code == clearing.TransactionCodeRefund {
+				query = `update acquirer.refunds set batch_id = $2 where refund_id = $1 and batch_id is null`
+			}
+			res, err := tx.Exec(query, item.ID, batch.ID)
+			if err != nil {
+				return err
+			}
+			if n, _ := res.RowsAffected(); n != 1 {
+				return ErrAlreadyCleared
+			}
+		}
+	}
+
+	return tx.Commit()
+}
+
+// ListBatches returns the closed batches of the merchant, oldest first.
+func (r *Repository) ListBatches(merchantID string) ([]*models.Batch, error) {
+	if r.db == nil {
+		r.mu.RLock()
+		defer r.mu.RUnlock()
+
+		return append([]*models.Batch(nil), r.batches[merchantID]...), nil
+	}
+
+	rows, err := r.db.QueryContext(context.Background(), `
+		select batch_id, merchant_id, mid, business_date, file_id,
+		       presentments, presentment_amount, refunds, refund_amount, closed_at
+		  from acquirer.batches
+		 where merchant_id::text = $1
+		 order by closed_at, batch_id
+	`, merchantID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var batches []*models.Batch
+	for rows.Next() {
+		batch := &models.Batch{}
+		err := rows.Scan(&batch.ID, &batch.MerchantID, &batch.MID, &batch.BusinessDate, &batch.FileID,
+			&batch.Presentments, &batch.PresentmentAmount, &batch.Refunds, &batch.RefundAmount, &batch.ClosedAt)
+		if err != nil {
+			return nil, err
+		}
+		batches = append(batches, batch)
+	}
+
+	return batches, rows.Err()
+}
+
+// CreateChargeback stores the chargeback unless one was raised for the
+// dispute already. It returns the stored chargeback and whether it was
+// created by this call. A new chargeback takes at most what is left of the
+// payment: captured, less refunded and less its chargebacks that were not
+// won; more returns ErrInvalidAmount.
+func (r *Repository) CreateChargeback(chargeback *models.Chargeback) (*models.Chargeback, bool, error) {
+	if r.db == nil {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+
+		payment, ok := r.payments[chargeback.PaymentID]
+		if !ok {
+			return nil, false, ErrNotFound
+		}
+		left := payment.CapturedAmount - payment.RefundedAmount
+		for _, stored := range r.chargebacks {
+			if stored.DisputeID == chargeback.DisputeID {
+				return stored, false, nil
+			}
+			if stored.PaymentID == chargeback.PaymentID && stored.Status != models.ChargebackStatusWon {
+				left -= stored.Amount
+			}
+		}
+		if chargeback.Amount > left {
+			return nil, false, fmt.Errorf("chargeback of %d for %d left: %w", chargeback.Amount, left, ErrInvalidAmount)
+		}
+		r.chargebacks[chargeback.ID] = chargeback
+
+		return chargeback, true, nil
+	}
+
+	tx, err := r.db.BeginTx(context.Background(), nil)
+	if err != nil {
+		return nil, false, err
+	}
+	defer tx.Rollback()
+
+	// the payment's row serializes the chargebacks, captures and refunds of it
+	var left int64
+	err = tx.QueryRow(`
+		select captured_amount - refunded_amount from acquirer.payments where payment_id = $1 for update
+	`, chargeback.PaymentID).Scan(&left)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, false, ErrNotFound
+	}
+	if err != nil {
+		return nil, false, err
+	}
+
+	stored, err := scanChargeback(tx.QueryRow(chargebackQuery+` where dispute_id = $1`, chargeback.DisputeID))
+	if err == nil {
+		return stored, false, nil
+	}
+	if !errors.Is(err, sql.ErrNoRows) {
+		return nil, false, err
+	}
+
+	var charged int64
+	err = tx.QueryRow(`
+		select coalesce(sum(amount), 0) from acquirer.chargebacks where payment_id = $1 and status <> $2
+	`, chargeback.PaymentID, string(models.ChargebackStatusWon)).Scan(&charged)
+	if err != nil {
+		return nil, false, err
+	}
+	if left -= charged; chargeback.Amount > left {
+		return nil, false, fmt.Errorf("chargeback of %d for %d left: %w", chargeback.Amount, left, ErrInvalidAmount)
+	}
+
+	err = tx.QueryRow(`
+		insert into acquirer.chargebacks(chargeback_id, payment_id, merchant_id, dispute_id, amount, currency,
+		                                 reason_code, status)
+		values ($1, $2, $3, $4, $5, $6, $7, $8)
+		on conflict (dispute_id) do nothing
+		returning created_at, updated_at
+	`, chargeback.ID, chargeback.PaymentID, chargeback.MerchantID, chargeback.DisputeID, chargeback.Amount,
+		strings.ToUpper(chargeback.Currency), chargeback.ReasonCode, string(chargeback.Status)).Scan(&chargeback.CreatedAt, &chargeback.UpdatedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		// raised for the dispute on another payment meanwhile
+		tx.Rollback()
+		stored, err := r.queryChargeback(`dispute_id = $1`, chargeback.DisputeID)
+		return stored, false, err
+	}
+	if err != nil {
+		return nil, false, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, false, err
+	}
+
+	return chargeback, true, nil
+}
+
+func (r *Repository) GetChargeback(chargebackID string) (*models.Chargeback, error) {
+	if r.db == nil {
+		r.mu.RLock()
+		defer r.mu.RUnlock()
+
+		chargeback, ok := r.chargebacks[chargebackID]
+		if !ok {
+			return nil, ErrNotFound
+		}
+
+		return chargeback, nil
+	}
+
+	return r.queryChargeback(`chargeback_id::text = $1`, chargebackID)
+}
+
+// ListChargebacks returns the chargebacks of the payment, oldest first.
+func (r *Repository) ListChargebacks(paymentID string) ([]*models.Chargeback, error) {
+	if r.db == nil {
+		r.mu.RLock()
+		defer r.mu.RUnlock()
+
+		var chargebacks []*models.Chargeback
+		for _, chargeback := range r.chargebacks {
+			if chargeback.PaymentID == paymentID {
+				chargebacks = append(chargebacks, chargeback)
+			}
+		}
+		sort.Slice(chargebacks, func(i, j int) bool {
+			return chargebacks[i].CreatedAt.Before(chargebacks[j].CreatedAt)
+		})
+
+		return chargebacks, nil
+	}
+
+	rows, err := r.db.QueryContext(context.Background(), chargebackQuery+`
+		 where payment_id::text = $1
+		 order by created_at, chargeback_id
+	`, paymentID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var chargebacks []*models.Chargeback
+	for rows.Next() {
+		chargeback, err := scanChargeback(rows)
+		if err != nil {
+			return nil, err
+		}
+		chargebacks = append(chargebacks, chargeback)
+	}
+
+	return chargebacks, rows.Err()
+}
+
+// UpdateChargeback stores the status, evidence and reason of the chargeback
+// if it is still in status from; otherwise it returns
+// ErrInvalidChargebackStatus.
+func (r *Repository) UpdateChargeback(chargeback *models.Chargeback, from models.ChargebackStatus) error {
+	if r.db == nil {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+
+		stored, ok := r.chargebacks[chargeback.ID]
+		if !ok {
+			return ErrNotFound
+		}
+		if stored.Status != from {
+			return fmt.Errorf("chargeback is %s: %w", stored.Status, ErrInvalidChargebackStatus)
+		}
+
+		stored.Status = chargeback.Status
+		stored.Evidence = chargeback.Evidence
+		stored.Reason = chargeback.Reason
+		stored.UpdatedAt = time.Now()
+
+		return nil
+	}
+
+	res, err := r.db.ExecContext(context.Background(), `
+		update acquirer.chargebacks
+		   set status = $3, evidence = nullif($4, ''), reason = nullif($5, '')
+		 where chargeback_id = $1 and status = $2
+	`, chargeback.ID, string(from), string(chargeback.Status), chargeback.Evidence, chargeback.Reason)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return fmt.Errorf("chargeback is no longer %s: %w", from, ErrInvalidChargebackStatus)
+	}
+
+	return nil
+}
+
+const chargebackQuery = `
+		select chargeback_id, payment_id, merchant_id, dispute_id, amount, currency, reason_code, status,
+		       coalesce(evidence, ''), coalesce(reason, ''), created_at, updated_at
+		  from acquirer.chargebacks`
+
+func (r *Repository) queryChargeback(where string, args ...any) (*models.Chargeback, error) {
+	chargeback, err := scanChargeback(r.db.QueryRowContext(context.Background(), chargebackQuery+` where `+where, args...))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+
+	return chargeback, err
+}
+
+func scanChargeback(row interface{ Scan(...any) error }) (*models.Chargeback, error) {
+	chargeback := &models.Chargeback{}
+	var status string
+	err := row.Scan(&chargeback.ID, &chargeback.PaymentID, &chargeback.MerchantID, &chargeback.DisputeID,
+		&chargeback.Amount, &chargeback.Currency, &chargeback.ReasonCode, &status,
+		&chargeback.Evidence, &chargeback.Reason, &chargeback.CreatedAt, &chargeback.UpdatedAt)
+	if err != nil {
+		return nil, err
+	}
+	chargeback.Status = models.ChargebackStatus(status)
+
+	return chargeback, nil
+}
+
+// addPaymentEvent records the current state of the payment; r.mu must be held.
+func (r *Repository) addPaymentEvent(payment *models.Payment) {
+	r.paymentEvents[payment.ID] = append(r.paymentEvents[payment.ID], &models.PaymentEvent{
+		ID:             uuid.New().String(),
+		PaymentID:      payment.ID,
+		Status:         payment.Status,
+		CapturedAmount: payment.CapturedAmount,
+		RefundedAmount: payment.RefundedAmount,
+		CreatedAt:      time.Now(),
+	})
+}
+
+func insertPaymentEvent(tx *sql.Tx, payment *models.Payment) error {
+	_, err := tx.Exec(`
+		insert into acquirer.payment_events(event_id, payment_id, status, captured_amount, refunded_amount)
+		values ($1, $2, $3, $4, $5)
+	`, uuid.New().String(), payment.ID, string(payment.Status), payment.CapturedAmount, payment.RefundedAmount)
+
+	return err
+}
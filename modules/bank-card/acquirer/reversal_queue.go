@@ -0,0 +1,141 @@
+package acquirer
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/alovak/cardflow-playground/acquirer/models"
+)
+
+// ReversalQueue holds the reversals that were not acknowledged by the issuer
+// yet, in the order they were queued, and the parked ones the issuer
+// rejected. When it has a path, every change is written to that file so
+// pending reversals survive a restart.
+type ReversalQueue struct {
+	mu sync.Mutex
+
+	path      string
+	reversals []*models.Reversal
+}
+
+// NewReversalQueue loads the queue from path. An empty path keeps the queue
+// in memory only.
+func NewReversalQueue(path string) (*ReversalQueue, error) {
+	q := &ReversalQueue{path: path}
+
+	if path == "" {
+		return q, nil
+	}
+
+	if err := loadQueueFile(path, &q.reversals); err != nil {
+		return nil, fmt.Errorf("loading reversal queue: %w", err)
+	}
+
+	return q, nil
+}
+
+// Add queues a reversal. A payment is reversed only once, so adding a
+// reversal for a payment that is already queued is a no-op.
+func (q *ReversalQueue) Add(reversal *models.Reversal) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	for _, r := range q.reversals {
+		if r.PaymentID == reversal.PaymentID {
+			return nil
+		}
+	}
+
+	q.reversals = append(q.reversals, reversal)
+
+	return q.save()
+}
+
+// Pending returns copies of the queued reversals that are not parked,
+// oldest first.
+func (q *ReversalQueue) Pending() []models.Reversal {
+	return q.list(false)
+}
+
+// Parked returns copies of the parked reversals, oldest first.
+func (q *ReversalQueue) Parked() []models.Reversal {
+	return q.list(true)
+}
+
+func (q *ReversalQueue) list(parked bool) []models.Reversal {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	list := make([]models.Reversal, 0, len(q.reversals))
+	for _, r := range q.reversals {
+		if r.ParkedAt.IsZero() != parked {
+			list = append(list, *r)
+		}
+	}
+
+	return list
+}
+
+// Update stores the attempt counters and the rejections of a queued reversal.
+func (q *ReversalQueue) Update(reversal models.Reversal) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	for _, r := range q.reversals {
+		if r.PaymentID == reversal.PaymentID {
+			r.Attempts = reversal.Attempts
+			r.LastAttemptAt = reversal.LastAttemptAt
+			r.Rejections = reversal.Rejections
+			r.ResponseCode = reversal.ResponseCode
+			return q.save()
+		}
+	}
+
+	return ErrNotFound
+}
+
+// Park stops sending the reversal, keeping it in the file for manual
+// handling with its rejections.
+func (q *ReversalQueue) Park(reversal models.Reversal) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	for _, r := range q.reversals {
+		if r.PaymentID == reversal.PaymentID {
+			r.Rejections = reversal.Rejections
+			r.ResponseCode = reversal.ResponseCode
+			r.ParkedAt = time.Now()
+			return q.save()
+		}
+	}
+
+	return ErrNotFound
+}
+
+// Remove drops the reversal of the payment once the issuer acknowledged it.
+func (q *ReversalQueue) Remove(paymentID string) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	for i, r := range q.reversals {
+		if r.PaymentID == paymentID {
+			q.reversals = append(q.reversals[:i], q.reversals[i+1:]...)
+			return q.save()
+		}
+	}
+
+	return ErrNotFound
+}
+
+func (q *ReversalQueue) save() error {
+	if q.path == "" {
+		return nil
+	}
+
+	if err := saveQueueFile(q.path, q.reversals); err != nil {
+		return fmt.Errorf("saving reversal queue: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,78 @@
+package acquirer
+
+import (
+	"sync"
+	"time"
+
+	"golang.org/x/exp/slog"
+)
+
+// reversalWorker periodically sends the queued reversals until the issuer
+// acknowledges them.
+type reversalWorker struct {
+	acquirer *Service
+	interval time.Duration
+	logger   *slog.Logger
+
+	// parked is how many reversals were parked after the last run
+	parked int
+
+	stop chan struct{}
+	wg   sync.WaitGroup
+}
+
+func newReversalWorker(logger *slog.Logger, acquirer *Service, interval time.Duration) *reversalWorker {
+	return &reversalWorker{
+		acquirer: acquirer,
+		interval: interval,
+		logger:   logger.With(slog.String("type", "reversal-worker")),
+		stop:     make(chan struct{}),
+	}
+}
+
+// Start runs the worker in a background goroutine until Stop is called.
+func (w *reversalWorker) Start() {
+	w.wg.Add(1)
+	go func() {
+		defer w.wg.Done()
+
+		w.logger.Info("reversal worker started", slog.Duration("interval", w.interval))
+
+		ticker := time.NewTicker(w.interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-w.stop:
+				w.logger.Info("reversal worker stopped")
+				return
+			case <-ticker.C:
+				w.process()
+			}
+		}
+	}()
+}
+
+// Stop signals the worker to exit and waits for the current run to finish.
+func (w *reversalWorker) Stop() {
+	close(w.stop)
+	w.wg.Wait()
+}
+
+func (w *reversalWorker) process() {
+	n, err := w.acquirer.ProcessReversals()
+	if err != nil {
+		w.logger.Error("processing reversals", "err", err)
+	}
+
+	if n > 0 {
+		w.logger.Info("payments reversed", slog.Int("reversed", n))
+	}
+
+	// parked reversals need someone to release the holds
+	parked := len(w.acquirer.ParkedReversals())
+	if parked > w.parked {
+		w.logger.Warn("reversals parked for manual handling", slog.Int("parked", parked))
+	}
+	w.parked = parked
+}
@@ -1,75 +1,316 @@
 package acquirer
 
 import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"fmt"
+	"math/big"
+	"sync"
 	"time"
 
 	"github.com/alovak/cardflow-playground/acquirer/models"
 	"github.com/google/uuid"
 )
 
+// ErrInvalidAmount is returned when a capture or refund exceeds what is left
+// of the payment.
+var ErrInvalidAmount = errors.New("invalid amount")
+
+// ErrDeclined is returned when the issuer declines a capture, void or refund.
+var ErrDeclined = errors.New("declined by issuer")
+
+// ErrIdempotencyKeyReused is returned when an Idempotency-Key is sent again
+// with a different request.
+var ErrIdempotencyKeyReused = errors.New("idempotency key reused with a different request")
+
+// ErrIdempotencyKeyInProgress is returned when an Idempotency-Key is sent
+// again while the first request with it is still being processed.
+var ErrIdempotencyKeyInProgress = errors.New("request with the idempotency key is in progress")
+
+// ErrInvalidCardNumber is returned when a payment is made with a PAN that is
+// not 12 to 19 digits.
+var ErrInvalidCardNumber = errors.New("invalid card number")
+
+// ErrInvalidTerminalID is returned when a terminal is created with a TID
+// that does not fit DE41.
+var ErrInvalidTerminalID = errors.New("invalid terminal ID")
+
+// DefaultIdempotencyKeyRetention is how long idempotency keys are kept unless
+// the service is configured otherwise.
+const DefaultIdempotencyKeyRetention = 24 * time.Hour
+
+// DefaultMaxRejections is how many times the issuer may fail to apply a
+// reversal or an advice before it is parked, unless the service is
+// configured otherwise.
+const DefaultMaxRejections = 5
+
 type Service struct {
 	repo          *Repository
 	iso8583Client ISO8583Client
+	reversals     *ReversalQueue
+	advices       *AdviceQueue
+
+	// adviceQueued wakes up the advice forwarder
+	adviceQueued chan struct{}
+
+	// idempotencyKeyRetention is how long a merchant's Idempotency-Key
+	// replays the first payment
+	idempotencyKeyRetention time.Duration
+
+	// reversalMaxRejections and adviceMaxRejections are how many retryable
+	// rejections a reversal or an advice gets before it is parked
+	reversalMaxRejections int
+	adviceMaxRejections   int
+
+	// batchMu serializes closing batches
+	batchMu sync.Mutex
 }
 
 type ISO8583Client interface {
 	AuthorizePayment(payment *models.Payment, card models.Card, merchant models.Merchant) (models.AuthorizationResponse, error)
+	ReversePayment(reversal models.Reversal, card models.Card) (models.ReversalResponse, error)
+	SendAdvice(advice models.Advice, card models.Card) (models.AdviceResponse, error)
+	// CapturePayment, VoidPayment and RefundPayment are sent with their own
+	// STAN and refer to the authorization by the RRN and original data
+	// elements of the payment
+	CapturePayment(payment models.Payment, card models.Card, amount int64, stan string) (models.FinancialResponse, error)
+	VoidPayment(payment models.Payment, card models.Card, stan string) (models.ReversalResponse, error)
+	RefundPayment(payment models.Payment, card models.Card, amount int64, stan string) (models.FinancialResponse, error)
 }
 
-func NewService(repo *Repository, iso8583Client ISO8583Client) *Service {
+func NewService(repo *Repository, iso8583Client ISO8583Client, reversals *ReversalQueue, advices *AdviceQueue) *Service {
 	return &Service{
 		repo:          repo,
 		iso8583Client: iso8583Client,
+		reversals:     reversals,
+		advices:       advices,
+		adviceQueued:  make(chan struct{}, 1),
+
+		idempotencyKeyRetention: DefaultIdempotencyKeyRetention,
+		reversalMaxRejections:   DefaultMaxRejections,
+		adviceMaxRejections:     DefaultMaxRejections,
 	}
 }
 
+// CreateMerchant creates the merchant with a generated MID and a first
+// terminal, so payments can be taken right away.
 func (a *Service) CreateMerchant(create models.CreateMerchant) (*models.Merchant, error) {
+	mid, err := randomDigits(15)
+	if err != nil {
+		return nil, fmt.Errorf("generating MID: %w", err)
+	}
+
 	merchant := &models.Merchant{
 		ID:         uuid.New().String(),
 		Name:       create.Name,
 		MCC:        create.MCC,
 		PostalCode: create.PostalCode,
 		WebSite:    create.WebSite,
+		MID:        mid,
 	}
 
-	err := a.repo.CreateMerchant(merchant)
+	err = a.repo.CreateMerchant(merchant)
 	if err != nil {
 		return nil, fmt.Errorf("creating merchant: %w", err)
 	}
 
+	if _, err := a.CreateTerminal(merchant.ID, models.CreateTerminal{}); err != nil {
+		return nil, err
+	}
+
 	return merchant, nil
 }
 
+// maxTIDLength is the length of DE41
+const maxTIDLength = 8
+
+// CreateTerminal adds a terminal to the merchant. Without a TID one of 8
+// random digits is generated.
+func (a *Service) CreateTerminal(merchantID string, create models.CreateTerminal) (*models.Terminal, error) {
+	if _, err := a.repo.GetMerchant(merchantID); err != nil {
+		return nil, fmt.Errorf("getting merchant: %w", err)
+	}
+
+	if len(create.TID) > maxTIDLength {
+		return nil, fmt.Errorf("TID longer than %d characters: %w", maxTIDLength, ErrInvalidTerminalID)
+	}
+
+	tid := create.TID
+	if tid == "" {
+		var err error
+		if tid, err = randomDigits(maxTIDLength); err != nil {
+			return nil, fmt.Errorf("generating TID: %w", err)
+		}
+	}
+
+	terminal := &models.Terminal{
+		ID:         uuid.New().String(),
+		MerchantID: merchantID,
+		TID:        tid,
+		CreatedAt:  time.Now(),
+	}
+
+	if err := a.repo.CreateTerminal(terminal); err != nil {
+		return nil, fmt.Errorf("creating terminal: %w", err)
+	}
+
+	return terminal, nil
+}
+
+func (a *Service) ListTerminals(merchantID string) ([]*models.Terminal, error) {
+	if _, err := a.repo.GetMerchant(merchantID); err != nil {
+		return nil, fmt.Errorf("getting merchant: %w", err)
+	}
+
+	terminals, err := a.repo.ListTerminals(merchantID)
+	if err != nil {
+		return nil, fmt.Errorf("listing terminals: %w", err)
+	}
+
+	return terminals, nil
+}
+
+// getTerminal returns the terminal of the merchant, or its first terminal
+// when terminalID is empty.
+func (a *Service) getTerminal(merchantID, terminalID string) (*models.Terminal, error) {
+	if terminalID != "" {
+		terminal, err := a.repo.GetTerminal(merchantID, terminalID)
+		if err != nil {
+			return nil, fmt.Errorf("getting terminal: %w", err)
+		}
+		return terminal, nil
+	}
+
+	terminals, err := a.repo.ListTerminals(merchantID)
+	if err != nil {
+		return nil, fmt.Errorf("listing terminals: %w", err)
+	}
+	if len(terminals) == 0 {
+		return nil, fmt.Errorf("merchant has no terminals: %w", ErrNotFound)
+	}
+
+	return terminals[0], nil
+}
+
+// nextSTAN returns the next STAN of the terminal for a message transmitted at
+// transmittedAt.
+func (a *Service) nextSTAN(tid string, transmittedAt time.Time) (string, error) {
+	stan, err := a.repo.NextSTAN(tid, transmittedAt)
+	if err != nil {
+		return "", fmt.Errorf("getting next STAN: %w", err)
+	}
+
+	return stan, nil
+}
+
+// validateCardNumber checks that a PAN is 12 to 19 digits before any of it
+// is stored or sent.
+func validateCardNumber(number string) error {
+	if len(number) < 12 || len(number) > 19 {
+		return fmt.Errorf("card number of %d digits: %w", len(number), ErrInvalidCardNumber)
+	}
+	for _, c := range number {
+		if c < '0' || c > '9' {
+			return fmt.Errorf("card number with a non-digit: %w", ErrInvalidCardNumber)
+		}
+	}
+
+	return nil
+}
+
+// safeCard is what is kept of a validated card on its payment.
+func safeCard(card models.Card) models.SafeCard {
+	return models.SafeCard{
+		First6:         card.Number[:6],
+		Last4:          card.Number[len(card.Number)-4:],
+		ExpirationDate: card.ExpirationDate,
+	}
+}
+
+// newRRN builds the retrieval reference number (DE37) the way terminals
+// usually do: the last digit of the year, the day of the year, the hour and
+// the STAN. STANs are unique per terminal and day, so RRNs are unique per
+// terminal.
+func newRRN(transmittedAt time.Time, stan string) string {
+	t := transmittedAt.UTC()
+	return fmt.Sprintf("%d%03d%02d%s", t.Year()%10, t.YearDay(), t.Hour(), stan)
+}
+
+func randomDigits(n int) (string, error) {
+	digits := make([]byte, n)
+	for i := range digits {
+		d, err := rand.Int(rand.Reader, big.NewInt(10))
+		if err != nil {
+			return "", err
+		}
+		digits[i] = byte('0' + d.Int64())
+	}
+
+	return string(digits), nil
+}
+
+// CreatePayment authorizes a payment taken at one of the merchant's
+// terminals.
 func (a *Service) CreatePayment(merchantID string, create models.CreatePayment) (*models.Payment, error) {
+	if err := validateCardNumber(create.Card.Number); err != nil {
+		return nil, err
+	}
+
+	merchant, err := a.repo.GetMerchant(merchantID)
+	if err != nil {
+		return nil, fmt.Errorf("getting merchant: %w", err)
+	}
+
+	terminal, err := a.getTerminal(merchantID, create.TerminalID)
+	if err != nil {
+		return nil, err
+	}
+
 	payment := &models.Payment{
 		ID:         uuid.New().String(),
 		MerchantID: merchantID,
 		Amount:     create.Amount,
 		Currency:   create.Currency,
-		Card: models.SafeCard{
-			First6:         create.Card.Number[:6],
-			Last4:          create.Card.Number[len(create.Card.Number)-4:],
-			ExpirationDate: create.Card.ExpirationDate,
-		},
-		Status:    models.PaymentStatusPending,
-		CreatedAt: time.Now(),
+		Card:       safeCard(create.Card),
+		Status:     models.PaymentStatusPending,
+		CreatedAt:  time.Now(),
+		TerminalID: terminal.ID,
+		TID:        terminal.TID,
+		MID:        merchant.MID,
+		MTI:        "0100",
 	}
 
-	err := a.repo.CreatePayment(payment)
+	// the STAN is stored before the request is sent, so it is never used twice
+	payment.STAN, err = a.nextSTAN(terminal.TID, payment.CreatedAt)
 	if err != nil {
-		return nil, fmt.Errorf("creating payment: %w", err)
+		return nil, err
 	}
+	payment.RRN = newRRN(payment.CreatedAt, payment.STAN)
 
-	merchant, err := a.repo.GetMerchant(merchantID)
+	err = a.repo.CreatePayment(payment)
 	if err != nil {
-		return nil, fmt.Errorf("getting merchant: %w", err)
+		return nil, fmt.Errorf("creating payment: %w", err)
+	}
+
+	if err := a.repo.StorePaymentCard(payment.ID, create.Card); err != nil {
+		return nil, fmt.Errorf("storing payment card: %w", err)
 	}
 
 	response, err := a.iso8583Client.AuthorizePayment(payment, create.Card, *merchant)
+	if errors.Is(err, models.ErrAuthorizationUnconfirmed) {
+		// the issuer may have placed a hold we will never capture
+		if err := a.queueReversal(payment); err != nil {
+			payment.Status = models.PaymentStatusError
+			a.repo.UpdatePayment(payment)
+			return nil, fmt.Errorf("queueing reversal: %w", err)
+		}
+		return nil, fmt.Errorf("authorizing payment: %w", err)
+	}
 	if err != nil {
 		payment.Status = models.PaymentStatusError
-		// update payment details
+		a.repo.UpdatePayment(payment)
 		return nil, fmt.Errorf("authorizing payment: %w", err)
 	}
 
@@ -81,9 +322,80 @@ func (a *Service) CreatePayment(merchantID string, create models.CreatePayment)
 		payment.Status = models.PaymentStatusDeclined
 	}
 
+	if err := a.repo.UpdatePayment(payment); err != nil {
+		return nil, fmt.Errorf("updating payment: %w", err)
+	}
+
 	return payment, nil
 }
 
+// CreatePaymentIdempotently creates the payment once per merchant and
+// idempotency key. A retry with the same request returns the payment created
+// by the first one (replayed is true) instead of authorizing again. Failed
+// requests release the key so they can be retried.
+func (a *Service) CreatePaymentIdempotently(merchantID, idempotencyKey string, create models.CreatePayment) (payment *models.Payment, replayed bool, err error) {
+	if _, err := a.repo.GetMerchant(merchantID); err != nil {
+		return nil, false, fmt.Errorf("getting merchant: %w", err)
+	}
+
+	now := time.Now()
+	key, reserved, err := a.repo.ReserveIdempotencyKey(&models.IdempotencyKey{
+		MerchantID:  merchantID,
+		Key:         idempotencyKey,
+		Fingerprint: paymentFingerprint(create),
+		CreatedAt:   now,
+		ExpiresAt:   now.Add(a.idempotencyKeyRetention),
+	})
+	if err != nil {
+		return nil, false, fmt.Errorf("reserving idempotency key: %w", err)
+	}
+
+	if !reserved {
+		if key.Fingerprint != paymentFingerprint(create) {
+			return nil, false, ErrIdempotencyKeyReused
+		}
+		if key.Payment == nil {
+			return nil, false, ErrIdempotencyKeyInProgress
+		}
+		return key.Payment, true, nil
+	}
+
+	payment, err = a.CreatePayment(merchantID, create)
+	if err != nil {
+		if releaseErr := a.repo.ReleaseIdempotencyKey(merchantID, idempotencyKey); releaseErr != nil {
+			return nil, false, fmt.Errorf("%w (releasing idempotency key: %v)", err, releaseErr)
+		}
+		return nil, false, err
+	}
+
+	if err := a.repo.CompleteIdempotencyKey(merchantID, idempotencyKey, payment); err != nil {
+		return nil, false, fmt.Errorf("storing payment of idempotency key: %w", err)
+	}
+
+	return payment, false, nil
+}
+
+// DeleteExpiredIdempotencyKeys forgets the idempotency keys past their
+// retention.
+func (a *Service) DeleteExpiredIdempotencyKeys() (int, error) {
+	return a.repo.DeleteExpiredIdempotencyKeys(time.Now())
+}
+
+// paymentFingerprint hashes what identifies a payment request. The PAN is
+// only represented by the digits that may be stored and the CVV is left out,
+// so the fingerprint does not expose card data.
+func paymentFingerprint(create models.CreatePayment) string {
+	var first6, last4 string
+	if n := len(create.Card.Number); n >= 10 {
+		first6, last4 = create.Card.Number[:6], create.Card.Number[n-4:]
+	}
+
+	sum := sha256.Sum256([]byte(fmt.Sprintf("%d|%s|%s|%s|%s|%s",
+		create.Amount, create.Currency, first6, last4, create.Card.ExpirationDate, create.TerminalID)))
+
+	return hex.EncodeToString(sum[:])
+}
+
 func (a *Service) GetPayment(merchantID, paymentID string) (*models.Payment, error) {
 	payment, err := a.repo.GetPayment(merchantID, paymentID)
 	if err != nil {
@@ -92,3 +404,632 @@ func (a *Service) GetPayment(merchantID, paymentID string) (*models.Payment, err
 
 	return payment, nil
 }
+
+// CapturePayment captures all or part of an authorized payment. Several
+// partial captures may follow each other until the authorized amount is
+// captured.
+func (a *Service) CapturePayment(merchantID, paymentID string, capture models.CapturePayment) (*models.Payment, error) {
+
+	payment, card, err := a.getPaymentWithCard(merchantID, paymentID)
+	if err != nil {
+		return nil, err
+	}
+
+	remaining := payment.Amount - payment.CapturedAmount
+	amount := capture.Amount
+	if amount == 0 {
+		amount = remaining
+	}
+	if amount <= 0 || amount > remaining {
+		return nil, fmt.Errorf("capture of %d with %d left to capture: %w", amount, remaining, ErrInvalidAmount)
+	}
+
+	next := models.PaymentStatusCaptured
+	if amount < remaining {
+		next = models.PaymentStatusPartiallyCaptured
+	}
+	if !payment.Status.CanTransitionTo(next) {
+		return nil, fmt.Errorf("payment is %s: %w", payment.Status, ErrInvalidPaymentStatus)
+	}
+
+	stan, err := a.nextSTAN(payment.TID, time.Now())
+	if err != nil {
+		return nil, err
+	}
+
+	claimed := payment
+	claimed.Status = next
+	claimed.CapturedAmount += amount
+	if err := a.claim(payment, claimed); err != nil {
+		return nil, err
+	}
+
+	sentAt := time.Now()
+	response, err := a.iso8583Client.CapturePayment(payment, card, amount, stan)
+	if err != nil {
+		return nil, a.queueFollowUpReversal(payment, models.ReversalTypeCapture, amount, stan, sentAt, fmt.Errorf("capturing payment: %w", err))
+	}
+	if response.ApprovalCode != "00" {
+		return nil, a.release(claimed, payment, fmt.Errorf("capture declined with code %s: %w", response.ApprovalCode, ErrDeclined))
+	}
+
+	captured := &models.Capture{
+		ID:        uuid.New().String(),
+		PaymentID: payment.ID,
+		Amount:    amount,
+		Currency:  payment.Currency,
+		STAN:      stan,
+		CreatedAt: time.Now(),
+	}
+	if err := a.repo.CreateCapture(captured); err != nil {
+		return nil, fmt.Errorf("creating capture: %w", err)
+	}
+
+	return a.repo.GetPayment(merchantID, paymentID)
+}
+
+// VoidPayment reverses an authorized payment before anything was captured;
+// the issuer releases the whole hold.
+func (a *Service) VoidPayment(merchantID, paymentID string) (*models.Payment, error) {
+
+	payment, card, err := a.getPaymentWithCard(merchantID, paymentID)
+	if err != nil {
+		return nil, err
+	}
+
+	if !payment.Status.CanTransitionTo(models.PaymentStatusVoided) {
+		return nil, fmt.Errorf("payment is %s: %w", payment.Status, ErrInvalidPaymentStatus)
+	}
+
+	stan, err := a.nextSTAN(payment.TID, time.Now())
+	if err != nil {
+		return nil, err
+	}
+
+	claimed := payment
+	claimed.Status = models.PaymentStatusVoided
+	if err := a.claim(payment, claimed); err != nil {
+		return nil, err
+	}
+
+	response, err := a.iso8583Client.VoidPayment(payment, card, stan)
+	if err != nil {
+		// the issuer may have released the hold; nothing can be captured
+		// until it acknowledges the reversal
+		err = fmt.Errorf("voiding payment: %w", err)
+		if queueErr := a.queueReversal(&claimed); queueErr != nil {
+			return nil, fmt.Errorf("%w (queueing its reversal: %v)", err, queueErr)
+		}
+		return nil, err
+	}
+	if response.ApprovalCode != "00" {
+		return nil, a.release(claimed, payment, fmt.Errorf("void declined with code %s: %w", response.ApprovalCode, ErrDeclined))
+	}
+
+	return a.repo.GetPayment(merchantID, paymentID)
+}
+
+// RefundPayment refunds all or part of the captured amount. The payment
+// moves to refunded once everything captured is refunded.
+func (a *Service) RefundPayment(merchantID, paymentID string, create models.CreateRefund) (*models.Refund, error) {
+
+	payment, card, err := a.getPaymentWithCard(merchantID, paymentID)
+	if err != nil {
+		return nil, err
+	}
+
+	if !payment.Status.CanTransitionTo(models.PaymentStatusRefunded) {
+		return nil, fmt.Errorf("payment is %s: %w", payment.Status, ErrInvalidPaymentStatus)
+	}
+
+	refundable := payment.CapturedAmount - payment.RefundedAmount
+	amount := create.Amount
+	if amount == 0 {
+		amount = refundable
+	}
+	if amount <= 0 || amount > refundable {
+		return nil, fmt.Errorf("refund of %d with %d left to refund: %w", amount, refundable, ErrInvalidAmount)
+	}
+
+	stan, err := a.nextSTAN(payment.TID, time.Now())
+	if err != nil {
+		return nil, err
+	}
+
+	claimed := payment
+	claimed.RefundedAmount += amount
+	if claimed.RefundedAmount == claimed.CapturedAmount {
+		claimed.Status = models.PaymentStatusRefunded
+	}
+	if err := a.claim(payment, claimed); err != nil {
+		return nil, err
+	}
+
+	sentAt := time.Now()
+	response, err := a.iso8583Client.RefundPayment(payment, card, amount, stan)
+	if err != nil {
+		return nil, a.queueFollowUpReversal(payment, models.ReversalTypeRefund, amount, stan, sentAt, fmt.Errorf("refunding payment: %w", err))
+	}
+	if response.ApprovalCode != "00" {
+		return nil, a.release(claimed, payment, fmt.Errorf("refund declined with code %s: %w", response.ApprovalCode, ErrDeclined))
+	}
+
+	refund := &models.Refund{
+		ID:        uuid.New().String(),
+		PaymentID: payment.ID,
+		Amount:    amount,
+		Currency:  payment.Currency,
+		STAN:      stan,
+		CreatedAt: time.Now(),
+	}
+	if err := a.repo.CreateRefund(refund); err != nil {
+		return nil, fmt.Errorf("creating refund: %w", err)
+	}
+
+	return refund, nil
+}
+
+// claim moves the payment to the status and amounts of a capture, void,
+// refund or reversal advice before it is sent, provided no concurrent one
+// changed it since it was read; the loser of a race gets ErrPaymentChanged
+// and sends nothing.
+func (a *Service) claim(payment, claimed models.Payment) error {
+	if err := a.repo.UpdatePaymentIf(payment, &claimed); err != nil {
+		return fmt.Errorf("updating payment: %w", err)
+	}
+
+	return nil
+}
+
+// release gives back what a capture, void or refund claimed when the issuer
+// declined it, and returns err. One the issuer did not answer may have been
+// applied, so it is reversed instead.
+func (a *Service) release(claimed, payment models.Payment, err error) error {
+	if releaseErr := a.repo.UpdatePaymentIf(claimed, &payment); releaseErr != nil {
+		return fmt.Errorf("%w (releasing the payment: %v)", err, releaseErr)
+	}
+
+	return err
+}
+
+// queueFollowUpReversal queues the reversal of a capture or refund of amount,
+// sent with stan at sentAt, that the issuer did not answer, and returns err.
+// The payment keeps what the capture or refund claimed, and takes no other
+// follow-up, until the issuer acknowledges the reversal and the amount is
+// given back.
+func (a *Service) queueFollowUpReversal(payment models.Payment, reversalType models.ReversalType, amount int64, stan string, sentAt time.Time, err error) error {
+	reversalSTAN, stanErr := a.nextSTAN(payment.TID, time.Now())
+	if stanErr != nil {
+		return fmt.Errorf("%w (queueing its reversal: %v)", err, stanErr)
+	}
+
+	// a capture or refund running at the same time may have changed the
+	// amounts since this one was claimed
+	pendingErr := a.changePayment(payment.MerchantID, payment.ID, func(p *models.Payment) {
+		p.Status = models.PaymentStatusReversalPending
+	})
+	if pendingErr != nil {
+		return fmt.Errorf("%w (queueing its reversal: %v)", err, pendingErr)
+	}
+
+	queueErr := a.reversals.Add(&models.Reversal{
+		Type:       reversalType,
+		PaymentID:  payment.ID,
+		MerchantID: payment.MerchantID,
+		Amount:     amount,
+		Currency:   payment.Currency,
+		TID:        payment.TID,
+		MID:        payment.MID,
+		STAN:       reversalSTAN,
+		RRN:        payment.RRN,
+		Original: models.OriginalData{
+			MTI:                  "0200",
+			STAN:                 stan,
+			TransmissionDateTime: sentAt,
+		},
+		CreatedAt: time.Now(),
+	})
+	if queueErr != nil {
+		return fmt.Errorf("%w (queueing its reversal: %v)", err, queueErr)
+	}
+
+	return err
+}
+
+// changePayment applies change to the stored status and amounts of the
+// payment, reading it again when a concurrent follow-up changed it in between.
+func (a *Service) changePayment(merchantID, paymentID string, change func(*models.Payment)) error {
+	for {
+		payment, err := a.repo.GetPayment(merchantID, paymentID)
+		if err != nil {
+			return fmt.Errorf("getting payment: %w", err)
+		}
+
+		changed := *payment
+		change(&changed)
+		err = a.repo.UpdatePaymentIf(*payment, &changed)
+		if !errors.Is(err, ErrPaymentChanged) {
+			return err
+		}
+	}
+}
+
+// getPaymentWithCard returns a copy of the payment and its card, for the
+// follow-up messages the issuer matches by card and RRN.
+func (a *Service) getPaymentWithCard(merchantID, paymentID string) (models.Payment, models.Card, error) {
+	payment, err := a.repo.GetPayment(merchantID, paymentID)
+	if err != nil {
+		return models.Payment{}, models.Card{}, fmt.Errorf("getting payment: %w", err)
+	}
+
+	card, err := a.repo.GetPaymentCard(paymentID)
+	if err != nil {
+		return models.Payment{}, models.Card{}, fmt.Errorf("getting payment card: %w", err)
+	}
+
+	return *payment, card, nil
+}
+
+func (a *Service) queueReversal(payment *models.Payment) error {
+	stan, err := a.nextSTAN(payment.TID, time.Now())
+	if err != nil {
+		return err
+	}
+
+	err = a.reversals.Add(&models.Reversal{
+		PaymentID:  payment.ID,
+		MerchantID: payment.MerchantID,
+		Amount:     payment.Amount,
+		Currency:   payment.Currency,
+		TID:        payment.TID,
+		MID:        payment.MID,
+		STAN:       stan,
+		RRN:        payment.RRN,
+		Original:   payment.OriginalData(),
+		CreatedAt:  time.Now(),
+	})
+	if err != nil {
+		return err
+	}
+
+	// the reversal refers to the STAN and RRN, so they are stored with the status
+	payment.Status = models.PaymentStatusReversalPending
+
+	return a.repo.UpdatePayment(payment)
+}
+
+// ProcessReversals sends the queued reversals in order. A reversal stays
+// queued, and is repeated as 0401, until the issuer acknowledges it. It stops
+// at the first send error as the issuer is most likely unreachable. A
+// reversal the issuer rejects for good, or keeps failing, is parked and its
+// payment marked reversal_failed for manual handling.
+func (a *Service) ProcessReversals() (int, error) {
+	reversed := 0
+
+	for _, reversal := range a.reversals.Pending() {
+		// count the attempt before sending, so a crash after the send still
+		// makes the next attempt a repeat
+		reversal.Attempts++
+		reversal.LastAttemptAt = time.Now()
+		if err := a.reversals.Update(reversal); err != nil {
+			return reversed, fmt.Errorf("updating reversal: %w", err)
+		}
+
+		card, err := a.repo.GetPaymentCard(reversal.PaymentID)
+		if err != nil {
+			return reversed, fmt.Errorf("getting card of payment %s: %w", reversal.PaymentID, err)
+		}
+
+		response, err := a.iso8583Client.ReversePayment(reversal, card)
+		if err != nil {
+			return reversed, fmt.Errorf("reversing payment %s: %w", reversal.PaymentID, err)
+		}
+
+		code := response.ApprovalCode
+		if !acknowledged(code) {
+			// 91: the issuer did not look at the reversal
+			if code != "91" {
+				reversal.Rejections++
+			}
+			reversal.ResponseCode = code
+			if retryable(code) && reversal.Rejections < a.reversalMaxRejections {
+				if err := a.reversals.Update(reversal); err != nil {
+					return reversed, fmt.Errorf("updating reversal: %w", err)
+				}
+				continue
+			}
+
+			if err := a.reversals.Park(reversal); err != nil {
+				return reversed, fmt.Errorf("parking reversal: %w", err)
+			}
+			// the issuer may still hold the funds
+			if err := a.repo.UpdatePaymentStatus(reversal.PaymentID, models.PaymentStatusReversalFailed); err != nil {
+				return reversed, fmt.Errorf("updating payment status: %w", err)
+			}
+			continue
+		}
+
+		if err := a.reversals.Remove(reversal.PaymentID); err != nil {
+			return reversed, fmt.Errorf("removing reversal: %w", err)
+		}
+
+		if err := a.reversed(reversal); err != nil {
+			return reversed, err
+		}
+
+		reversed++
+	}
+
+	return reversed, nil
+}
+
+// reversed updates the payment of an acknowledged reversal: the reversal of
+// an authorization leaves it reversed, that of a capture or refund gives the
+// amount back.
+func (a *Service) reversed(reversal models.Reversal) error {
+	var err error
+	switch reversal.Type {
+	case models.ReversalTypeCapture:
+		err = a.changePayment(reversal.MerchantID, reversal.PaymentID, func(p *models.Payment) {
+			p.CapturedAmount -= reversal.Amount
+			p.Status = models.CapturedStatus(*p)
+		})
+	case models.ReversalTypeRefund:
+		err = a.changePayment(reversal.MerchantID, reversal.PaymentID, func(p *models.Payment) {
+			p.RefundedAmount -= reversal.Amount
+			p.Status = models.CapturedStatus(*p)
+		})
+	default:
+		err = a.repo.UpdatePaymentStatus(reversal.PaymentID, models.PaymentStatusReversed)
+	}
+	if err != nil {
+		return fmt.Errorf("updating payment: %w", err)
+	}
+
+	return nil
+}
+
+// ParkedReversals returns the reversals that were parked for manual handling.
+func (a *Service) ParkedReversals() []models.Reversal {
+	return a.reversals.Parked()
+}
+
+// CreateOfflinePayment records a payment the terminal approved offline and
+// queues a completion advice (0120) to let the issuer know.
+func (a *Service) CreateOfflinePayment(merchantID string, create models.CreateOfflinePayment) (*models.Payment, error) {
+	if err := validateCardNumber(create.Card.Number); err != nil {
+		return nil, err
+	}
+
+	merchant, err := a.repo.GetMerchant(merchantID)
+	if err != nil {
+		return nil, fmt.Errorf("getting merchant: %w", err)
+	}
+
+	terminal, err := a.getTerminal(merchantID, create.TerminalID)
+	if err != nil {
+		return nil, err
+	}
+
+	payment := &models.Payment{
+		ID:                uuid.New().String(),
+		MerchantID:        merchantID,
+		Amount:            create.Amount,
+		Currency:          create.Currency,
+		Card:              safeCard(create.Card),
+		Status:            models.PaymentStatusAuthorized,
+		CreatedAt:         time.Now(),
+		AuthorizationCode: create.AuthorizationCode,
+		TerminalID:        terminal.ID,
+		TID:               terminal.TID,
+		MID:               merchant.MID,
+		MTI:               "0120",
+	}
+
+	// the advice is repeated with the same STAN and RRN
+	payment.STAN, err = a.nextSTAN(terminal.TID, payment.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	payment.RRN = newRRN(payment.CreatedAt, payment.STAN)
+
+	if err := a.repo.CreatePayment(payment); err != nil {
+		return nil, fmt.Errorf("creating payment: %w", err)
+	}
+
+	if err := a.repo.StorePaymentCard(payment.ID, create.Card); err != nil {
+		return nil, fmt.Errorf("storing payment card: %w", err)
+	}
+
+	err = a.queueAdvice(&models.Advice{
+		Type:                 models.AdviceTypeCompletion,
+		PaymentID:            payment.ID,
+		MerchantID:           merchantID,
+		Amount:               payment.Amount,
+		Currency:             payment.Currency,
+		TID:                  payment.TID,
+		MID:                  payment.MID,
+		STAN:                 payment.STAN,
+		RRN:                  payment.RRN,
+		AuthorizationCode:    payment.AuthorizationCode,
+		TransmissionDateTime: payment.CreatedAt,
+		Merchant:             *merchant,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("queueing completion advice: %w", err)
+	}
+
+	return payment, nil
+}
+
+// AdviseReversal reverses an authorized payment and queues a reversal advice
+// (0420) for the issuer. The payment is reversed once the issuer acknowledges
+// the advice.
+func (a *Service) AdviseReversal(merchantID, paymentID string) (*models.Payment, error) {
+	payment, err := a.repo.GetPayment(merchantID, paymentID)
+	if err != nil {
+		return nil, fmt.Errorf("getting payment: %w", err)
+	}
+
+	if payment.Status != models.PaymentStatusAuthorized {
+		return nil, fmt.Errorf("payment is %s: %w", payment.Status, ErrInvalidPaymentStatus)
+	}
+
+	merchant, err := a.repo.GetMerchant(merchantID)
+	if err != nil {
+		return nil, fmt.Errorf("getting merchant: %w", err)
+	}
+
+	now := time.Now()
+	stan, err := a.nextSTAN(payment.TID, now)
+	if err != nil {
+		return nil, err
+	}
+
+	// a capture or void running at the same time gets ErrPaymentChanged, or
+	// wins and this one does, so the issuer never gets a reversal advice for
+	// an authorization that was captured
+	claimed := *payment
+	claimed.Status = models.PaymentStatusReversalPending
+	if err := a.claim(*payment, claimed); err != nil {
+		return nil, err
+	}
+
+	original := payment.OriginalData()
+	err = a.queueAdvice(&models.Advice{
+		Type:       models.AdviceTypeReversal,
+		PaymentID:  payment.ID,
+		MerchantID: merchantID,
+		Amount:     payment.Amount,
+		Currency:   payment.Currency,
+		TID:        payment.TID,
+		MID:        payment.MID,
+		STAN:       stan,
+		// the issuer finds the authorization by the RRN and original data elements
+		RRN:                  payment.RRN,
+		Original:             &original,
+		AuthorizationCode:    payment.AuthorizationCode,
+		TransmissionDateTime: now,
+		Merchant:             *merchant,
+	})
+	if err != nil {
+		return nil, a.release(claimed, *payment, fmt.Errorf("queueing reversal advice: %w", err))
+	}
+
+	return a.repo.GetPayment(merchantID, paymentID)
+}
+
+func (a *Service) queueAdvice(advice *models.Advice) error {
+	advice.ID = uuid.New().String()
+	advice.CreatedAt = time.Now()
+
+	if err := a.advices.Add(advice); err != nil {
+		return err
+	}
+
+	// wake up the forwarder, unless it is already due to run
+	select {
+	case a.adviceQueued <- struct{}{}:
+	default:
+	}
+
+	return nil
+}
+
+// ForwardAdvices sends the queued advices in order. Advices are repeated
+// (0121/0421) until the issuer acknowledges them; forwarding stops at the
+// first one that is not acknowledged so the order is kept. An advice the
+// issuer rejects for good, or keeps failing, is parked instead so it does
+// not hold up the ones behind it.
+func (a *Service) ForwardAdvices() (int, error) {
+	forwarded := 0
+
+	for _, advice := range a.advices.Pending() {
+		// count the attempt before sending, so a crash after the send still
+		// makes the next attempt a repeat
+		advice.Attempts++
+		advice.LastAttemptAt = time.Now()
+		if err := a.advices.Update(advice); err != nil {
+			return forwarded, fmt.Errorf("updating advice: %w", err)
+		}
+
+		card, err := a.repo.GetPaymentCard(advice.PaymentID)
+		if err != nil {
+			return forwarded, fmt.Errorf("getting card of payment %s: %w", advice.PaymentID, err)
+		}
+
+		response, err := a.iso8583Client.SendAdvice(advice, card)
+		if err != nil {
+			return forwarded, fmt.Errorf("sending advice %s: %w", advice.ID, err)
+		}
+
+		code := response.ApprovalCode
+		if !acknowledged(code) {
+			// 91: the issuer did not look at the advice
+			if code != "91" {
+				advice.Rejections++
+			}
+			advice.ResponseCode = code
+			if retryable(code) && advice.Rejections < a.adviceMaxRejections {
+				if err := a.advices.Update(advice); err != nil {
+					return forwarded, fmt.Errorf("updating advice: %w", err)
+				}
+				return forwarded, fmt.Errorf("advice %s not acknowledged: %s", advice.ID, code)
+			}
+
+			if err := a.parkAdvice(advice); err != nil {
+				return forwarded, err
+			}
+			continue
+		}
+
+		if err := a.advices.Remove(advice.ID); err != nil {
+			return forwarded, fmt.Errorf("removing advice: %w", err)
+		}
+
+		if advice.Type == models.AdviceTypeReversal {
+			if err := a.repo.UpdatePaymentStatus(advice.PaymentID, models.PaymentStatusReversed); err != nil {
+				return forwarded, fmt.Errorf("updating payment status: %w", err)
+			}
+		}
+
+		forwarded++
+	}
+
+	return forwarded, nil
+}
+
+// parkAdvice takes an advice the issuer would not apply out of forwarding.
+// The payment of a parked reversal advice is marked reversal_failed, as the
+// issuer may still hold the funds.
+func (a *Service) parkAdvice(advice models.Advice) error {
+	if err := a.advices.Park(advice); err != nil {
+		return fmt.Errorf("parking advice: %w", err)
+	}
+
+	if advice.Type == models.AdviceTypeReversal {
+		if err := a.repo.UpdatePaymentStatus(advice.PaymentID, models.PaymentStatusReversalFailed); err != nil {
+			return fmt.Errorf("updating payment status: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// ParkedAdvices returns the advices that were parked for manual handling.
+func (a *Service) ParkedAdvices() []models.Advice {
+	return a.advices.Parked()
+}
+
+// acknowledged reports whether the issuer acknowledged a reversal or an
+// advice: 00, or 25 when it has nothing to apply it to.
+func acknowledged(code string) bool {
+	return code == "00" || code == "25"
+}
+
+// retryable reports whether a response that did not acknowledge a reversal
+// or an advice may change when it is repeated: the issuer was unavailable
+// (91) or failed (96, 99). Any other response is final.
+func retryable(code string) bool {
+	return code == "91" || code == "96" || code == "99"
+}
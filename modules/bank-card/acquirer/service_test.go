@@ -0,0 +1,1198 @@
+package acquirer_test
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/alovak/cardflow-playground/acquirer"
+	"github.com/alovak/cardflow-playground/acquirer/models"
+	"github.com/alovak/cardflow-playground/internal/clearing"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeISO8583Client times out every authorization unless approveAuthorizations
+// is set, answers reversals and advices with the queued responses (and
+// approval codes, 00 once they run out) and approves captures, voids and
+// refunds.
+type fakeISO8583Client struct {
+	approveAuthorizations bool
+	authorizations        int
+
+	reversals         []models.Reversal
+	reversalCards     []models.Card
+	reversalResponses []error
+	reversalCodes     []string
+
+	advices         []models.Advice
+	adviceResponses []error
+	adviceCodes     []string
+
+	// onCapture runs while a capture is with the issuer; captureCode is
+	// its response, 00 when empty
+	onCapture   func()
+	captureCode string
+
+	// followUpErr is returned for captures, voids and refunds, as if the
+	// issuer did not answer
+	followUpErr error
+
+	// amounts, STANs and quoted RRNs of the captures, voids and refunds sent
+	captures []int64
+	refunds  []int64
+	voids    []string
+	stans    []string
+	quoted   []string
+}
+
+func (c *fakeISO8583Client) AuthorizePayment(payment *models.Payment, card models.Card, merchant models.Merchant) (models.AuthorizationResponse, error) {
+	c.authorizations++
+	if c.approveAuthorizations {
+		return models.AuthorizationResponse{ApprovalCode: "00", AuthorizationCode: "123456"}, nil
+	}
+	return models.AuthorizationResponse{}, fmt.Errorf("sending ISO 8583 message to server: %w: %w", models.ErrAuthorizationUnconfirmed, errors.New("message send timeout"))
+}
+
+func (c *fakeISO8583Client) ReversePayment(reversal models.Reversal, card models.Card) (models.ReversalResponse, error) {
+	c.reversals = append(c.reversals, reversal)
+	c.reversalCards = append(c.reversalCards, card)
+
+	err := c.reversalResponses[0]
+	c.reversalResponses = c.reversalResponses[1:]
+	if err != nil {
+		return models.ReversalResponse{}, err
+	}
+
+	code := "00"
+	if len(c.reversalCodes) > 0 {
+		code, c.reversalCodes = c.reversalCodes[0], c.reversalCodes[1:]
+	}
+
+	return models.ReversalResponse{ApprovalCode: code}, nil
+}
+
+func (c *fakeISO8583Client) SendAdvice(advice models.Advice, card models.Card) (models.AdviceResponse, error) {
+	c.advices = append(c.advices, advice)
+
+	err := c.adviceResponses[0]
+	c.adviceResponses = c.adviceResponses[1:]
+	if err != nil {
+		return models.AdviceResponse{}, err
+	}
+
+	code := "00"
+	if len(c.adviceCodes) > 0 {
+		code, c.adviceCodes = c.adviceCodes[0], c.adviceCodes[1:]
+	}
+
+	return models.AdviceResponse{ApprovalCode: code}, nil
+}
+
+func (c *fakeISO8583Client) CapturePayment(payment models.Payment, card models.Card, amount int64, stan string) (models.FinancialResponse, error) {
+	c.captures = append(c.captures, amount)
+	c.stans = append(c.stans, stan)
+	c.quoted = append(c.quoted, payment.RRN)
+	if c.onCapture != nil {
+		onCapture := c.onCapture
+		c.onCapture = nil
+		onCapture()
+	}
+	if c.followUpErr != nil {
+		return models.FinancialResponse{}, c.followUpErr
+	}
+	if c.captureCode != "" {
+		return models.FinancialResponse{ApprovalCode: c.captureCode}, nil
+	}
+	return models.FinancialResponse{ApprovalCode: "00"}, nil
+}
+
+func (c *fakeISO8583Client) VoidPayment(payment models.Payment, card models.Card, stan string) (models.ReversalResponse, error) {
+	c.voids = append(c.voids, payment.ID)
+	c.stans = append(c.stans, stan)
+	c.quoted = append(c.quoted, payment.RRN)
+	if c.followUpErr != nil {
+		return models.ReversalResponse{}, c.followUpErr
+	}
+	return models.ReversalResponse{ApprovalCode: "00"}, nil
+}
+
+func (c *fakeISO8583Client) RefundPayment(payment models.Payment, card models.Card, amount int64, stan string) (models.FinancialResponse, error) {
+	c.refunds = append(c.refunds, amount)
+	c.stans = append(c.stans, stan)
+	c.quoted = append(c.quoted, payment.RRN)
+	if c.followUpErr != nil {
+		return models.FinancialResponse{}, c.followUpErr
+	}
+	return models.FinancialResponse{ApprovalCode: "00"}, nil
+}
+
+func TestCreatePayment_ReversesUnconfirmedAuthorization(t *testing.T) {
+	queuePath := filepath.Join(t.TempDir(), "reversals.json")
+
+	reversals, err := acquirer.NewReversalQueue(queuePath)
+	require.NoError(t, err)
+
+	repo := acquirer.NewRepository()
+	client := &fakeISO8583Client{
+		// the first reversal is lost as well, the repeat is acknowledged
+		reversalResponses: []error{errors.New("message send timeout"), nil},
+	}
+	advices, err := acquirer.NewAdviceQueue("")
+	require.NoError(t, err)
+
+	service := acquirer.NewService(repo, client, reversals, advices)
+
+	merchant, err := service.CreateMerchant(models.CreateMerchant{Name: "Demo Merchant", MCC: "5411"})
+	require.NoError(t, err)
+
+	_, err = service.CreatePayment(merchant.ID, models.CreatePayment{
+		Amount:   10_00,
+		Currency: "USD",
+		Card: models.Card{
+			Number:                "4212340000000006",
+			ExpirationDate:        "12/28",
+			CardVerificationValue: "123",
+		},
+	})
+	require.ErrorIs(t, err, models.ErrAuthorizationUnconfirmed)
+
+	pending := reversals.Pending()
+	require.Len(t, pending, 1)
+
+	// the queue file refers to the payment and holds no card data
+	queued, err := os.ReadFile(queuePath)
+	require.NoError(t, err)
+	require.NotContains(t, string(queued), "4212340000000006")
+
+	payment, err := service.GetPayment(merchant.ID, pending[0].PaymentID)
+	require.NoError(t, err)
+	require.Equal(t, models.PaymentStatusReversalPending, payment.Status)
+
+	// the reversal has its own STAN and refers to the authorization
+	require.NotEqual(t, payment.STAN, pending[0].STAN)
+	require.Equal(t, payment.RRN, pending[0].RRN)
+	require.Equal(t, models.OriginalData{MTI: "0100", STAN: payment.STAN, TransmissionDateTime: payment.CreatedAt}, pending[0].Original)
+
+	// the queue survives a restart
+	reloaded, err := acquirer.NewReversalQueue(queuePath)
+	require.NoError(t, err)
+	require.Len(t, reloaded.Pending(), 1)
+	require.Equal(t, pending[0].PaymentID, reloaded.Pending()[0].PaymentID)
+	require.Equal(t, pending[0].STAN, reloaded.Pending()[0].STAN)
+
+	// first attempt (0400) gets no answer, the reversal stays queued
+	n, err := service.ProcessReversals()
+	require.Error(t, err)
+	require.Equal(t, 0, n)
+	require.Len(t, reversals.Pending(), 1)
+
+	// second attempt (0401) is acknowledged
+	n, err = service.ProcessReversals()
+	require.NoError(t, err)
+	require.Equal(t, 1, n)
+	require.Empty(t, reversals.Pending())
+
+	require.Len(t, client.reversals, 2)
+	require.Equal(t, 1, client.reversals[0].Attempts)
+	require.Equal(t, 2, client.reversals[1].Attempts)
+	// the card is loaded from the payment, without the CVV
+	require.Equal(t, models.Card{Number: "4212340000000006", ExpirationDate: "12/28"}, client.reversalCards[1])
+
+	payment, err = service.GetPayment(merchant.ID, pending[0].PaymentID)
+	require.NoError(t, err)
+	require.Equal(t, models.PaymentStatusReversed, payment.Status)
+}
+
+func TestProcessReversals_ParksRejectedReversals(t *testing.T) {
+	queuePath := filepath.Join(t.TempDir(), "reversals.json")
+
+	reversals, err := acquirer.NewReversalQueue(queuePath)
+	require.NoError(t, err)
+	advices, err := acquirer.NewAdviceQueue("")
+	require.NoError(t, err)
+
+	client := &fakeISO8583Client{}
+	service := acquirer.NewService(acquirer.NewRepository(), client, reversals, advices)
+
+	merchant, err := service.CreateMerchant(models.CreateMerchant{Name: "Demo Merchant", MCC: "5411"})
+	require.NoError(t, err)
+
+	create := models.CreatePayment{
+		Amount:   10_00,
+		Currency: "USD",
+		Card:     models.Card{Number: "4212340000000006", ExpirationDate: "12/28", CardVerificationValue: "123"},
+	}
+	for i := 0; i < 2; i++ {
+		_, err = service.CreatePayment(merchant.ID, create)
+		require.ErrorIs(t, err, models.ErrAuthorizationUnconfirmed)
+	}
+	pending := reversals.Pending()
+	require.Len(t, pending, 2)
+
+	// the first reversal is rejected for good, the second one fails and is
+	// repeated, 91 does not count
+	client.reversalResponses = []error{nil, nil}
+	client.reversalCodes = []string{"12", "91"}
+	n, err := service.ProcessReversals()
+	require.NoError(t, err)
+	require.Equal(t, 0, n)
+	require.Len(t, reversals.Pending(), 1)
+
+	for i := 0; i < acquirer.DefaultMaxRejections; i++ {
+		require.Len(t, reversals.Pending(), 1)
+		client.reversalResponses = []error{nil}
+		client.reversalCodes = []string{"96"}
+		_, err = service.ProcessReversals()
+		require.NoError(t, err)
+	}
+
+	// both are parked, survive a restart and are no longer sent
+	require.Empty(t, reversals.Pending())
+	parked := service.ParkedReversals()
+	require.Len(t, parked, 2)
+	require.Equal(t, "12", parked[0].ResponseCode)
+	require.Equal(t, 1, parked[0].Rejections)
+	require.Equal(t, "96", parked[1].ResponseCode)
+	require.Equal(t, acquirer.DefaultMaxRejections, parked[1].Rejections)
+	require.Equal(t, acquirer.DefaultMaxRejections+1, parked[1].Attempts)
+
+	reloaded, err := acquirer.NewReversalQueue(queuePath)
+	require.NoError(t, err)
+	require.Empty(t, reloaded.Pending())
+	require.Len(t, reloaded.Parked(), 2)
+
+	n, err = service.ProcessReversals()
+	require.NoError(t, err)
+	require.Equal(t, 0, n)
+	require.Len(t, client.reversals, acquirer.DefaultMaxRejections+2)
+
+	for _, reversal := range parked {
+		payment, err := service.GetPayment(merchant.ID, reversal.PaymentID)
+		require.NoError(t, err)
+		require.Equal(t, models.PaymentStatusReversalFailed, payment.Status)
+	}
+}
+
+func TestForwardAdvices_InOrderUntilAcknowledged(t *testing.T) {
+	queuePath := filepath.Join(t.TempDir(), "advices.json")
+
+	advices, err := acquirer.NewAdviceQueue(queuePath)
+	require.NoError(t, err)
+
+	reversals, err := acquirer.NewReversalQueue("")
+	require.NoError(t, err)
+
+	client := &fakeISO8583Client{
+		// the issuer is down for the first run
+		adviceResponses: []error{errors.New("no connections (online)"), nil, nil},
+	}
+	service := acquirer.NewService(acquirer.NewRepository(), client, reversals, advices)
+
+	merchant, err := service.CreateMerchant(models.CreateMerchant{Name: "Demo Merchant", MCC: "5411"})
+	require.NoError(t, err)
+
+	payment, err := service.CreateOfflinePayment(merchant.ID, models.CreateOfflinePayment{
+		Amount:            25_00,
+		Currency:          "USD",
+		AuthorizationCode: "Y1OFFL",
+		Card: models.Card{
+			Number:                "4212340000000006",
+			ExpirationDate:        "12/28",
+			CardVerificationValue: "123",
+		},
+	})
+	require.NoError(t, err)
+	require.Equal(t, models.PaymentStatusAuthorized, payment.Status)
+
+	payment, err = service.AdviseReversal(merchant.ID, payment.ID)
+	require.NoError(t, err)
+	require.Equal(t, models.PaymentStatusReversalPending, payment.Status)
+
+	_, err = service.AdviseReversal(merchant.ID, payment.ID)
+	require.ErrorIs(t, err, acquirer.ErrInvalidPaymentStatus)
+
+	// both advices survive a restart, completion first
+	reloaded, err := acquirer.NewAdviceQueue(queuePath)
+	require.NoError(t, err)
+	require.Len(t, reloaded.Pending(), 2)
+	require.Equal(t, models.AdviceTypeCompletion, reloaded.Pending()[0].Type)
+	require.Equal(t, models.AdviceTypeReversal, reloaded.Pending()[1].Type)
+	queued, err := os.ReadFile(queuePath)
+	require.NoError(t, err)
+	require.NotContains(t, string(queued), "4212340000000006")
+
+	// the first completion advice is not acknowledged, the reversal waits for it
+	n, err := service.ForwardAdvices()
+	require.Error(t, err)
+	require.Equal(t, 0, n)
+	require.Len(t, client.advices, 1)
+
+	n, err = service.ForwardAdvices()
+	require.NoError(t, err)
+	require.Equal(t, 2, n)
+	require.Empty(t, advices.Pending())
+
+	require.Len(t, client.advices, 3)
+	// the repeat keeps the STAN and RRN, the reversal refers to the
+	// completion by its RRN and original data elements
+	require.Equal(t, models.AdviceTypeCompletion, client.advices[1].Type)
+	require.Equal(t, 2, client.advices[1].Attempts)
+	require.Equal(t, client.advices[0].STAN, client.advices[1].STAN)
+	require.Equal(t, payment.RRN, client.advices[1].RRN)
+	require.Equal(t, models.AdviceTypeReversal, client.advices[2].Type)
+	require.Equal(t, 1, client.advices[2].Attempts)
+	require.NotEqual(t, payment.STAN, client.advices[2].STAN)
+	require.Equal(t, payment.RRN, client.advices[2].RRN)
+	require.Equal(t, "0120", client.advices[2].Original.MTI)
+	require.Equal(t, payment.STAN, client.advices[2].Original.STAN)
+
+	payment, err = service.GetPayment(merchant.ID, payment.ID)
+	require.NoError(t, err)
+	require.Equal(t, models.PaymentStatusReversed, payment.Status)
+}
+
+func TestForwardAdvices_ParksRejectedAdvices(t *testing.T) {
+	queuePath := filepath.Join(t.TempDir(), "advices.json")
+
+	advices, err := acquirer.NewAdviceQueue(queuePath)
+	require.NoError(t, err)
+
+	reversals, err := acquirer.NewReversalQueue("")
+	require.NoError(t, err)
+
+	client := &fakeISO8583Client{}
+	service := acquirer.NewService(acquirer.NewRepository(), client, reversals, advices)
+
+	merchant, err := service.CreateMerchant(models.CreateMerchant{Name: "Demo Merchant", MCC: "5411"})
+	require.NoError(t, err)
+
+	offline := models.CreateOfflinePayment{
+		Amount:            25_00,
+		Currency:          "USD",
+		AuthorizationCode: "Y1OFFL",
+		Card:              models.Card{Number: "4212340000000006", ExpirationDate: "12/28"},
+	}
+	first, err := service.CreateOfflinePayment(merchant.ID, offline)
+	require.NoError(t, err)
+	_, err = service.AdviseReversal(merchant.ID, first.ID)
+	require.NoError(t, err)
+	second, err := service.CreateOfflinePayment(merchant.ID, offline)
+	require.NoError(t, err)
+
+	// the issuer rejects the reversal advice for good: it is parked and the
+	// completion behind it is still forwarded
+	client.adviceResponses = []error{nil, nil, nil}
+	client.adviceCodes = []string{"00", "12", "00"}
+	n, err := service.ForwardAdvices()
+	require.NoError(t, err)
+	require.Equal(t, 2, n)
+	require.Empty(t, advices.Pending())
+
+	parked := service.ParkedAdvices()
+	require.Len(t, parked, 1)
+	require.Equal(t, models.AdviceTypeReversal, parked[0].Type)
+	require.Equal(t, "12", parked[0].ResponseCode)
+	require.False(t, parked[0].ParkedAt.IsZero())
+
+	payment, err := service.GetPayment(merchant.ID, first.ID)
+	require.NoError(t, err)
+	require.Equal(t, models.PaymentStatusReversalFailed, payment.Status)
+
+	// parked advices survive a restart but are not forwarded again
+	reloaded, err := acquirer.NewAdviceQueue(queuePath)
+	require.NoError(t, err)
+	require.Empty(t, reloaded.Pending())
+	require.Len(t, reloaded.Parked(), 1)
+
+	// a failing issuer is given a few more tries, 91 does not count
+	_, err = service.AdviseReversal(merchant.ID, second.ID)
+	require.NoError(t, err)
+	client.adviceCodes = []string{"91"}
+	for i := 0; i < acquirer.DefaultMaxRejections; i++ {
+		client.adviceCodes = append(client.adviceCodes, "99")
+	}
+	for range client.adviceCodes {
+		client.adviceResponses = append(client.adviceResponses, nil)
+	}
+	for i := 0; i < acquirer.DefaultMaxRejections; i++ {
+		_, err = service.ForwardAdvices()
+		require.Error(t, err)
+		require.Len(t, advices.Pending(), 1)
+	}
+	n, err = service.ForwardAdvices()
+	require.NoError(t, err)
+	require.Equal(t, 0, n)
+	require.Empty(t, advices.Pending())
+	require.Len(t, service.ParkedAdvices(), 2)
+	require.Equal(t, acquirer.DefaultMaxRejections, service.ParkedAdvices()[1].Rejections)
+}
+
+func TestCaptureVoidAndRefund(t *testing.T) {
+	reversals, err := acquirer.NewReversalQueue("")
+	require.NoError(t, err)
+	advices, err := acquirer.NewAdviceQueue("")
+	require.NoError(t, err)
+
+	client := &fakeISO8583Client{}
+	service := acquirer.NewService(acquirer.NewRepository(), client, reversals, advices)
+
+	merchant, err := service.CreateMerchant(models.CreateMerchant{Name: "Demo Merchant", MCC: "5411"})
+	require.NoError(t, err)
+
+	// offline payments are authorized without asking the issuer
+	authorize := func() *models.Payment {
+		payment, err := service.CreateOfflinePayment(merchant.ID, models.CreateOfflinePayment{
+			Amount:            100_00,
+			Currency:          "USD",
+			AuthorizationCode: "Y1OFFL",
+			Card: models.Card{
+				Number:         "4212340000000006",
+				ExpirationDate: "12/28",
+			},
+		})
+		require.NoError(t, err)
+		return payment
+	}
+
+	payment := authorize()
+
+	_, err = service.CapturePayment(merchant.ID, payment.ID, models.CapturePayment{Amount: 100_01})
+	require.ErrorIs(t, err, acquirer.ErrInvalidAmount)
+
+	captured, err := service.CapturePayment(merchant.ID, payment.ID, models.CapturePayment{Amount: 40_00})
+	require.NoError(t, err)
+	require.Equal(t, models.PaymentStatusPartiallyCaptured, captured.Status)
+
+	// no amount captures the rest
+	captured, err = service.CapturePayment(merchant.ID, payment.ID, models.CapturePayment{})
+	require.NoError(t, err)
+	require.Equal(t, models.PaymentStatusCaptured, captured.Status)
+	require.Equal(t, int64(100_00), captured.CapturedAmount)
+	require.Equal(t, []int64{40_00, 60_00}, client.captures)
+
+	_, err = service.VoidPayment(merchant.ID, payment.ID)
+	require.ErrorIs(t, err, acquirer.ErrInvalidPaymentStatus)
+
+	refund, err := service.RefundPayment(merchant.ID, payment.ID, models.CreateRefund{Amount: 30_00})
+	require.NoError(t, err)
+	require.Equal(t, int64(30_00), refund.Amount)
+
+	refunded, err := service.GetPayment(merchant.ID, payment.ID)
+	require.NoError(t, err)
+	require.Equal(t, models.PaymentStatusCaptured, refunded.Status)
+
+	_, err = service.RefundPayment(merchant.ID, payment.ID, models.CreateRefund{Amount: 70_01})
+	require.ErrorIs(t, err, acquirer.ErrInvalidAmount)
+
+	_, err = service.RefundPayment(merchant.ID, payment.ID, models.CreateRefund{})
+	require.NoError(t, err)
+
+	refunded, err = service.GetPayment(merchant.ID, payment.ID)
+	require.NoError(t, err)
+	require.Equal(t, models.PaymentStatusRefunded, refunded.Status)
+	require.Equal(t, int64(100_00), refunded.RefundedAmount)
+	require.Equal(t, []int64{30_00, 70_00}, client.refunds)
+
+	_, err = service.RefundPayment(merchant.ID, payment.ID, models.CreateRefund{})
+	require.ErrorIs(t, err, acquirer.ErrInvalidPaymentStatus)
+
+	// a voided payment cannot be captured
+	voided := authorize()
+
+	_, err = service.RefundPayment(merchant.ID, voided.ID, models.CreateRefund{})
+	require.ErrorIs(t, err, acquirer.ErrInvalidPaymentStatus)
+
+	voided, err = service.VoidPayment(merchant.ID, voided.ID)
+	require.NoError(t, err)
+	require.Equal(t, models.PaymentStatusVoided, voided.Status)
+
+	_, err = service.CapturePayment(merchant.ID, voided.ID, models.CapturePayment{})
+	require.ErrorIs(t, err, acquirer.ErrInvalidPaymentStatus)
+
+	// every follow-up gets a STAN of its own and quotes the RRN of the authorization
+	require.Equal(t, []string{payment.RRN, payment.RRN, payment.RRN, payment.RRN, voided.RRN}, client.quoted)
+	stans := map[string]bool{payment.STAN: true, voided.STAN: true}
+	for _, stan := range client.stans {
+		require.False(t, stans[stan], "STAN %s used twice", stan)
+		stans[stan] = true
+	}
+}
+
+func TestCapturePayment_ClaimsTheAmountBeforeSending(t *testing.T) {
+	reversals, err := acquirer.NewReversalQueue("")
+	require.NoError(t, err)
+	advices, err := acquirer.NewAdviceQueue("")
+	require.NoError(t, err)
+
+	repo := acquirer.NewRepository()
+	client := &fakeISO8583Client{}
+	service := acquirer.NewService(repo, client, reversals, advices)
+
+	merchant, err := service.CreateMerchant(models.CreateMerchant{Name: "Demo Merchant", MCC: "5411"})
+	require.NoError(t, err)
+
+	payment, err := service.CreateOfflinePayment(merchant.ID, models.CreateOfflinePayment{
+		Amount:            100_00,
+		Currency:          "USD",
+		AuthorizationCode: "Y1OFFL",
+		Card:              models.Card{Number: "4212340000000006", ExpirationDate: "12/28"},
+	})
+	require.NoError(t, err)
+
+	// a capture that arrives while another is with the issuer only gets
+	// what the first one left, and is not held up by it; a reversal advice
+	// is refused rather than sent for a captured authorization
+	var concurrent, advised error
+	client.onCapture = func() {
+		_, concurrent = service.CapturePayment(merchant.ID, payment.ID, models.CapturePayment{Amount: 60_00})
+		_, advised = service.AdviseReversal(merchant.ID, payment.ID)
+	}
+	captured, err := service.CapturePayment(merchant.ID, payment.ID, models.CapturePayment{Amount: 60_00})
+	require.NoError(t, err)
+	require.ErrorIs(t, concurrent, acquirer.ErrInvalidAmount)
+	require.ErrorIs(t, advised, acquirer.ErrInvalidPaymentStatus)
+	for _, advice := range advices.Pending() {
+		require.NotEqual(t, models.AdviceTypeReversal, advice.Type)
+	}
+	require.Equal(t, int64(60_00), captured.CapturedAmount)
+
+	// a declined capture gives the amount back
+	client.captureCode = "05"
+	_, err = service.CapturePayment(merchant.ID, payment.ID, models.CapturePayment{})
+	require.ErrorIs(t, err, acquirer.ErrDeclined)
+	declined, err := service.GetPayment(merchant.ID, payment.ID)
+	require.NoError(t, err)
+	require.Equal(t, models.PaymentStatusPartiallyCaptured, declined.Status)
+	require.Equal(t, int64(60_00), declined.CapturedAmount)
+
+	// an update on a stale read of the payment is refused
+	stale := models.Payment{ID: payment.ID, Status: models.PaymentStatusAuthorized}
+	update := *declined
+	update.CapturedAmount = 100_00
+	require.ErrorIs(t, repo.UpdatePaymentIf(stale, &update), acquirer.ErrPaymentChanged)
+}
+
+func TestCaptureVoidAndRefund_ReversesUnanswered(t *testing.T) {
+	reversals, err := acquirer.NewReversalQueue("")
+	require.NoError(t, err)
+	advices, err := acquirer.NewAdviceQueue("")
+	require.NoError(t, err)
+
+	client := &fakeISO8583Client{}
+	service := acquirer.NewService(acquirer.NewRepository(), client, reversals, advices)
+
+	merchant, err := service.CreateMerchant(models.CreateMerchant{Name: "Demo Merchant", MCC: "5411"})
+	require.NoError(t, err)
+
+	authorize := func() *models.Payment {
+		payment, err := service.CreateOfflinePayment(merchant.ID, models.CreateOfflinePayment{
+			Amount:            100_00,
+			Currency:          "USD",
+			AuthorizationCode: "Y1OFFL",
+			Card:              models.Card{Number: "4212340000000006", ExpirationDate: "12/28"},
+		})
+		require.NoError(t, err)
+		return payment
+	}
+
+	getPayment := func(paymentID string) *models.Payment {
+		payment, err := service.GetPayment(merchant.ID, paymentID)
+		require.NoError(t, err)
+		return payment
+	}
+
+	payment := authorize()
+	_, err = service.CapturePayment(merchant.ID, payment.ID, models.CapturePayment{Amount: 40_00})
+	require.NoError(t, err)
+
+	// the issuer may have applied a capture it did not answer, so it keeps
+	// its amount and nothing else is sent until it is reversed
+	client.followUpErr = errors.New("message send timeout")
+	_, err = service.CapturePayment(merchant.ID, payment.ID, models.CapturePayment{Amount: 60_00})
+	require.Error(t, err)
+
+	pending := getPayment(payment.ID)
+	require.Equal(t, models.PaymentStatusReversalPending, pending.Status)
+	require.Equal(t, int64(100_00), pending.CapturedAmount)
+
+	_, err = service.CapturePayment(merchant.ID, payment.ID, models.CapturePayment{Amount: 60_00})
+	require.ErrorIs(t, err, acquirer.ErrInvalidAmount)
+	_, err = service.RefundPayment(merchant.ID, payment.ID, models.CreateRefund{})
+	require.ErrorIs(t, err, acquirer.ErrInvalidPaymentStatus)
+
+	// the reversal refers to the capture
+	queued := reversals.Pending()
+	require.Len(t, queued, 1)
+	require.Equal(t, models.ReversalTypeCapture, queued[0].Type)
+	require.Equal(t, int64(60_00), queued[0].Amount)
+	require.Equal(t, payment.RRN, queued[0].RRN)
+	require.Equal(t, "0200", queued[0].Original.MTI)
+	require.Equal(t, client.stans[len(client.stans)-1], queued[0].Original.STAN)
+
+	client.reversalResponses = []error{nil}
+	n, err := service.ProcessReversals()
+	require.NoError(t, err)
+	require.Equal(t, 1, n)
+
+	// once acknowledged, the amount can be captured again
+	restored := getPayment(payment.ID)
+	require.Equal(t, models.PaymentStatusPartiallyCaptured, restored.Status)
+	require.Equal(t, int64(40_00), restored.CapturedAmount)
+
+	client.followUpErr = nil
+	_, err = service.CapturePayment(merchant.ID, payment.ID, models.CapturePayment{})
+	require.NoError(t, err)
+
+	// an unanswered refund is reversed the same way
+	client.followUpErr = errors.New("message send timeout")
+	_, err = service.RefundPayment(merchant.ID, payment.ID, models.CreateRefund{Amount: 30_00})
+	require.Error(t, err)
+	require.Equal(t, models.PaymentStatusReversalPending, getPayment(payment.ID).Status)
+	require.Equal(t, models.ReversalTypeRefund, reversals.Pending()[0].Type)
+
+	client.reversalResponses = []error{nil}
+	// the issuer never got the refund
+	client.reversalCodes = []string{"25"}
+	_, err = service.ProcessReversals()
+	require.NoError(t, err)
+
+	restored = getPayment(payment.ID)
+	require.Equal(t, models.PaymentStatusCaptured, restored.Status)
+	require.Equal(t, int64(0), restored.RefundedAmount)
+
+	// an unanswered void reverses the authorization, which stays claimed
+	// until the issuer acknowledges it
+	voided := authorize()
+	_, err = service.VoidPayment(merchant.ID, voided.ID)
+	require.Error(t, err)
+	require.Equal(t, models.PaymentStatusReversalPending, getPayment(voided.ID).Status)
+
+	_, err = service.CapturePayment(merchant.ID, voided.ID, models.CapturePayment{})
+	require.ErrorIs(t, err, acquirer.ErrInvalidPaymentStatus)
+
+	queued = reversals.Pending()
+	require.Len(t, queued, 1)
+	require.Equal(t, models.ReversalTypeAuthorization, queued[0].Type)
+	require.Equal(t, voided.OriginalData(), queued[0].Original)
+
+	client.reversalResponses = []error{nil}
+	_, err = service.ProcessReversals()
+	require.NoError(t, err)
+	require.Equal(t, models.PaymentStatusReversed, getPayment(voided.ID).Status)
+}
+
+func TestCreatePayment_RejectsInvalidCardNumbers(t *testing.T) {
+	reversals, err := acquirer.NewReversalQueue("")
+	require.NoError(t, err)
+	advices, err := acquirer.NewAdviceQueue("")
+	require.NoError(t, err)
+
+	client := &fakeISO8583Client{approveAuthorizations: true}
+	service := acquirer.NewService(acquirer.NewRepository(), client, reversals, advices)
+
+	merchant, err := service.CreateMerchant(models.CreateMerchant{Name: "Demo Merchant", MCC: "5411"})
+	require.NoError(t, err)
+
+	for _, number := range []string{"", "4212", "42123400000", "42123400000000000006", "4212 3400 0000 0006"} {
+		card := models.Card{Number: number, ExpirationDate: "12/28"}
+
+		_, err := service.CreatePayment(merchant.ID, models.CreatePayment{Amount: 10_00, Currency: "USD", Card: card})
+		require.ErrorIs(t, err, acquirer.ErrInvalidCardNumber, number)
+
+		_, err = service.CreateOfflinePayment(merchant.ID, models.CreateOfflinePayment{Amount: 10_00, Currency: "USD", AuthorizationCode: "Y1OFFL", Card: card})
+		require.ErrorIs(t, err, acquirer.ErrInvalidCardNumber, number)
+	}
+	require.Zero(t, client.authorizations)
+	require.Empty(t, advices.Pending())
+
+	_, err = service.CreatePayment(merchant.ID, models.CreatePayment{Amount: 10_00, Currency: "USD",
+		Card: models.Card{Number: "421234000006", ExpirationDate: "12/28"}})
+	require.NoError(t, err)
+}
+
+func TestCreatePaymentIdempotently(t *testing.T) {
+	reversals, err := acquirer.NewReversalQueue("")
+	require.NoError(t, err)
+	advices, err := acquirer.NewAdviceQueue("")
+	require.NoError(t, err)
+
+	repo := acquirer.NewRepository()
+	client := &fakeISO8583Client{approveAuthorizations: true}
+	service := acquirer.NewService(repo, client, reversals, advices)
+
+	merchant, err := service.CreateMerchant(models.CreateMerchant{Name: "Demo Merchant", MCC: "5411"})
+	require.NoError(t, err)
+
+	create := models.CreatePayment{
+		Amount:   10_00,
+		Currency: "USD",
+		Card: models.Card{
+			Number:                "4212340000000006",
+			ExpirationDate:        "12/28",
+			CardVerificationValue: "123",
+		},
+	}
+
+	payment, replayed, err := service.CreatePaymentIdempotently(merchant.ID, "order-1", create)
+	require.NoError(t, err)
+	require.False(t, replayed)
+	require.Equal(t, models.PaymentStatusAuthorized, payment.Status)
+
+	// the retry gets the same payment and the issuer sees one authorization
+	replay, replayed, err := service.CreatePaymentIdempotently(merchant.ID, "order-1", create)
+	require.NoError(t, err)
+	require.True(t, replayed)
+	require.Equal(t, payment.ID, replay.ID)
+	require.Equal(t, payment.STAN, replay.STAN)
+	require.Equal(t, 1, client.authorizations)
+
+	// the replay is the original response, later changes do not show up
+	_, err = service.CapturePayment(merchant.ID, payment.ID, models.CapturePayment{})
+	require.NoError(t, err)
+	replay, _, err = service.CreatePaymentIdempotently(merchant.ID, "order-1", create)
+	require.NoError(t, err)
+	require.Equal(t, models.PaymentStatusAuthorized, replay.Status)
+
+	different := create
+	different.Amount = 20_00
+	_, _, err = service.CreatePaymentIdempotently(merchant.ID, "order-1", different)
+	require.ErrorIs(t, err, acquirer.ErrIdempotencyKeyReused)
+
+	// keys are per merchant
+	other, err := service.CreateMerchant(models.CreateMerchant{Name: "Other Merchant", MCC: "5411"})
+	require.NoError(t, err)
+	_, replayed, err = service.CreatePaymentIdempotently(other.ID, "order-1", different)
+	require.NoError(t, err)
+	require.False(t, replayed)
+	require.Equal(t, 2, client.authorizations)
+
+	// once expired, the key starts over
+	n, err := repo.DeleteExpiredIdempotencyKeys(time.Now().Add(acquirer.DefaultIdempotencyKeyRetention + time.Minute))
+	require.NoError(t, err)
+	require.Equal(t, 2, n)
+
+	_, replayed, err = service.CreatePaymentIdempotently(merchant.ID, "order-1", different)
+	require.NoError(t, err)
+	require.False(t, replayed)
+	require.Equal(t, 3, client.authorizations)
+}
+
+func TestCreatePaymentIdempotently_ReleasesKeyOfFailedRequest(t *testing.T) {
+	reversals, err := acquirer.NewReversalQueue("")
+	require.NoError(t, err)
+	advices, err := acquirer.NewAdviceQueue("")
+	require.NoError(t, err)
+
+	client := &fakeISO8583Client{}
+	service := acquirer.NewService(acquirer.NewRepository(), client, reversals, advices)
+
+	merchant, err := service.CreateMerchant(models.CreateMerchant{Name: "Demo Merchant", MCC: "5411"})
+	require.NoError(t, err)
+
+	create := models.CreatePayment{
+		Amount:   10_00,
+		Currency: "USD",
+		Card:     models.Card{Number: "4212340000000006", ExpirationDate: "12/28"},
+	}
+
+	// the authorization times out and gets reversed, the retry authorizes again
+	_, _, err = service.CreatePaymentIdempotently(merchant.ID, "order-1", create)
+	require.ErrorIs(t, err, models.ErrAuthorizationUnconfirmed)
+
+	client.approveAuthorizations = true
+	payment, replayed, err := service.CreatePaymentIdempotently(merchant.ID, "order-1", create)
+	require.NoError(t, err)
+	require.False(t, replayed)
+	require.Equal(t, models.PaymentStatusAuthorized, payment.Status)
+	require.Equal(t, 2, client.authorizations)
+}
+
+func TestTerminals(t *testing.T) {
+	advices, err := acquirer.NewAdviceQueue("")
+	require.NoError(t, err)
+	reversals, err := acquirer.NewReversalQueue("")
+	require.NoError(t, err)
+
+	client := &fakeISO8583Client{approveAuthorizations: true}
+	service := acquirer.NewService(acquirer.NewRepository(), client, reversals, advices)
+
+	merchant, err := service.CreateMerchant(models.CreateMerchant{Name: "Demo Merchant", MCC: "5411"})
+	require.NoError(t, err)
+	require.Len(t, merchant.MID, 15)
+
+	// every merchant starts with a terminal
+	terminals, err := service.ListTerminals(merchant.ID)
+	require.NoError(t, err)
+	require.Len(t, terminals, 1)
+	require.Len(t, terminals[0].TID, 8)
+
+	second, err := service.CreateTerminal(merchant.ID, models.CreateTerminal{TID: "T2"})
+	require.NoError(t, err)
+
+	_, err = service.CreateTerminal(merchant.ID, models.CreateTerminal{TID: "T2"})
+	require.ErrorIs(t, err, acquirer.ErrTerminalExists)
+
+	_, err = service.CreateTerminal(merchant.ID, models.CreateTerminal{TID: "T23456789"})
+	require.ErrorIs(t, err, acquirer.ErrInvalidTerminalID)
+
+	offline := func(terminalID string) (*models.Payment, error) {
+		return service.CreateOfflinePayment(merchant.ID, models.CreateOfflinePayment{
+			Amount:            10_00,
+			Currency:          "USD",
+			Card:              models.Card{Number: "4212340000000006", ExpirationDate: "12/28"},
+			AuthorizationCode: "Y1OFFL",
+			TerminalID:        terminalID,
+		})
+	}
+
+	// without a terminal the first one takes the payment
+	first, err := offline("")
+	require.NoError(t, err)
+	require.Equal(t, terminals[0].ID, first.TerminalID)
+	require.Equal(t, terminals[0].TID, first.TID)
+	require.Equal(t, merchant.MID, first.MID)
+
+	// STANs are numbered per terminal
+	other, err := offline(second.ID)
+	require.NoError(t, err)
+	require.Equal(t, "T2", other.TID)
+	require.Equal(t, "000001", first.STAN)
+	require.Equal(t, "000001", other.STAN)
+
+	again, err := offline(second.ID)
+	require.NoError(t, err)
+	require.Equal(t, "000002", again.STAN)
+
+	// the issuer is told which terminal approved the payment
+	pending := advices.Pending()
+	require.Len(t, pending, 3)
+	require.Equal(t, "T2", pending[1].TID)
+	require.Equal(t, merchant.MID, pending[1].MID)
+
+	_, err = offline("unknown")
+	require.ErrorIs(t, err, acquirer.ErrNotFound)
+
+	payment, err := service.CreatePayment(merchant.ID, models.CreatePayment{
+		Amount:     10_00,
+		Currency:   "USD",
+		Card:       models.Card{Number: "4212340000000006", ExpirationDate: "12/28", CardVerificationValue: "123"},
+		TerminalID: second.ID,
+	})
+	require.NoError(t, err)
+	require.Equal(t, second.ID, payment.TerminalID)
+	require.Equal(t, "T2", payment.TID)
+}
+
+func TestRepository_NextSTAN(t *testing.T) {
+	repo := acquirer.NewRepository()
+
+	day := time.Date(2026, time.October, 16, 23, 59, 0, 0, time.UTC)
+
+	next := func(tid string, at time.Time) string {
+		stan, err := repo.NextSTAN(tid, at)
+		require.NoError(t, err)
+		return stan
+	}
+
+	require.Equal(t, "000001", next("T1", day))
+	require.Equal(t, "000002", next("T1", day))
+	// terminals and days have sequences of their own
+	require.Equal(t, "000001", next("T2", day))
+	require.Equal(t, "000001", next("T1", day.Add(time.Minute)))
+	require.Equal(t, "000003", next("T1", day))
+}
+
+func TestCreatePayment_RetrievalReferenceNumber(t *testing.T) {
+	reversals, err := acquirer.NewReversalQueue("")
+	require.NoError(t, err)
+	advices, err := acquirer.NewAdviceQueue("")
+	require.NoError(t, err)
+
+	service := acquirer.NewService(acquirer.NewRepository(), &fakeISO8583Client{approveAuthorizations: true}, reversals, advices)
+
+	merchant, err := service.CreateMerchant(models.CreateMerchant{Name: "Demo Merchant", MCC: "5411"})
+	require.NoError(t, err)
+
+	payment, err := service.CreatePayment(merchant.ID, models.CreatePayment{
+		Amount:   10_00,
+		Currency: "USD",
+		Card:     models.Card{Number: "4212340000000006", ExpirationDate: "12/28", CardVerificationValue: "123"},
+	})
+	require.NoError(t, err)
+
+	// YDDDhh followed by the STAN
+	createdAt := payment.CreatedAt.UTC()
+	require.Equal(t, fmt.Sprintf("%d%03d%02d%s", createdAt.Year()%10, createdAt.YearDay(), createdAt.Hour(), payment.STAN), payment.RRN)
+	require.Equal(t, "0100", payment.MTI)
+}
+
+func TestCloseBatches(t *testing.T) {
+	reversals, err := acquirer.NewReversalQueue("")
+	require.NoError(t, err)
+	advices, err := acquirer.NewAdviceQueue("")
+	require.NoError(t, err)
+
+	client := &fakeISO8583Client{}
+	service := acquirer.NewService(acquirer.NewRepository(), client, reversals, advices)
+	dir := t.TempDir()
+
+	pay := func(merchantID string) *models.Payment {
+		payment, err := service.CreateOfflinePayment(merchantID, models.CreateOfflinePayment{
+			Amount:            100_00,
+			Currency:          "USD",
+			AuthorizationCode: "Y1OFFL",
+			Card:              models.Card{Number: "4212340000000006", ExpirationDate: "12/28"},
+		})
+		require.NoError(t, err)
+		return payment
+	}
+
+	grocery, err := service.CreateMerchant(models.CreateMerchant{Name: "Grocery", MCC: "5411"})
+	require.NoError(t, err)
+	diner, err := service.CreateMerchant(models.CreateMerchant{Name: "Diner", MCC: "5812"})
+	require.NoError(t, err)
+	idle, err := service.CreateMerchant(models.CreateMerchant{Name: "Idle", MCC: "5999"})
+	require.NoError(t, err)
+
+	groceryPayment := pay(grocery.ID)
+	_, err = service.CapturePayment(grocery.ID, groceryPayment.ID, models.CapturePayment{Amount: 40_00})
+	require.NoError(t, err)
+	_, err = service.CapturePayment(grocery.ID, groceryPayment.ID, models.CapturePayment{})
+	require.NoError(t, err)
+	_, err = service.RefundPayment(grocery.ID, groceryPayment.ID, models.CreateRefund{Amount: 25_00})
+	require.NoError(t, err)
+
+	dinerPayment := pay(diner.ID)
+	_, err = service.CapturePayment(diner.ID, dinerPayment.ID, models.CapturePayment{Amount: 12_50})
+	require.NoError(t, err)
+
+	// payments that were only authorized are not presented
+	pay(idle.ID)
+
+	_, err = service.CloseBatches(models.CloseBatches{BusinessDate: time.Now().UTC().AddDate(0, 0, 1).Format("2006-01-02")}, dir)
+	require.ErrorIs(t, err, acquirer.ErrInvalidBusinessDate)
+	_, err = service.CloseBatches(models.CloseBatches{BusinessDate: "16.10.2026"}, dir)
+	require.ErrorIs(t, err, acquirer.ErrInvalidBusinessDate)
+
+	// nothing was made before yesterday ended
+	empty, err := service.CloseBatches(models.CloseBatches{BusinessDate: time.Now().UTC().AddDate(0, 0, -1).Format("2006-01-02")}, dir)
+	require.NoError(t, err)
+	require.Empty(t, empty.Batches)
+
+	file, err := service.CloseBatches(models.CloseBatches{}, dir)
+	require.NoError(t, err)
+	require.Len(t, file.Batches, 2)
+	require.Equal(t, dir, filepath.Dir(file.Path))
+
+	byMerchant := map[string]*models.Batch{}
+	for _, batch := range file.Batches {
+		byMerchant[batch.MerchantID] = batch
+	}
+	require.Equal(t, 2, byMerchant[grocery.ID].Presentments)
+	require.Equal(t, int64(100_00), byMerchant[grocery.ID].PresentmentAmount)
+	require.Equal(t, 1, byMerchant[grocery.ID].Refunds)
+	require.Equal(t, int64(25_00), byMerchant[grocery.ID].RefundAmount)
+	require.Equal(t, grocery.MID, byMerchant[grocery.ID].MID)
+	require.Equal(t, 1, byMerchant[diner.ID].Presentments)
+	require.Equal(t, int64(12_50), byMerchant[diner.ID].PresentmentAmount)
+
+	f, err := os.Open(file.Path)
+	require.NoError(t, err)
+	defer f.Close()
+	cleared, err := clearing.Read(f)
+	require.NoError(t, err)
+	require.Len(t, cleared.Batches, 2)
+
+	var records []clearing.Record
+	for _, batch := range cleared.Batches {
+		records = append(records, batch.Records...)
+		if batch.MID == grocery.MID {
+			require.Equal(t, "Grocery", batch.MerchantName)
+			require.Equal(t, "5411", batch.MCC)
+		}
+	}
+	require.Len(t, records, 4)
+
+	// every record quotes the authorization and the STAN the capture or
+	// refund was sent with
+	var stans []string
+	codes := map[clearing.TransactionCode]int{}
+	for _, record := range records {
+		codes[record.Code]++
+		stans = append(stans, record.STAN)
+		require.Equal(t, "4212340000000006", record.PAN)
+		require.Equal(t, "2812", record.ExpirationDate)
+		require.Equal(t, "USD", record.Currency)
+		require.Equal(t, "Y1OFFL", record.AuthorizationCode)
+		require.Len(t, record.Reference, 32)
+		// RRNs are only unique per terminal
+		if record.TID == groceryPayment.TID {
+			require.Equal(t, groceryPayment.RRN, record.RRN)
+		} else {
+			require.Equal(t, dinerPayment.TID, record.TID)
+			require.Equal(t, dinerPayment.RRN, record.RRN)
+		}
+	}
+	require.Equal(t, map[clearing.TransactionCode]int{clearing.TransactionCodePresentment: 3, clearing.TransactionCodeRefund: 1}, codes)
+	require.ElementsMatch(t, client.stans, stans)
+
+	// cleared captures and refunds are not presented again
+	next, err := service.CloseBatches(models.CloseBatches{}, dir)
+	require.NoError(t, err)
+	require.Empty(t, next.Batches)
+
+	batches, err := service.ListBatches(grocery.ID)
+	require.NoError(t, err)
+	require.Len(t, batches, 1)
+	require.Equal(t, file.ID, batches[0].FileID)
+
+	batches, err = service.ListBatches(idle.ID)
+	require.NoError(t, err)
+	require.Empty(t, batches)
+
+	_, err = service.ListBatches("unknown")
+	require.ErrorIs(t, err, acquirer.ErrNotFound)
+
+	// no temporary files are left behind
+	entries, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	require.Len(t, entries, 3)
+	for _, entry := range entries {
+		require.Equal(t, ".txt", filepath.Ext(entry.Name()))
+	}
+}
+
+func TestChargebacks(t *testing.T) {
+	reversals, err := acquirer.NewReversalQueue("")
+	require.NoError(t, err)
+	advices, err := acquirer.NewAdviceQueue("")
+	require.NoError(t, err)
+
+	service := acquirer.NewService(acquirer.NewRepository(), &fakeISO8583Client{}, reversals, advices)
+
+	merchant, err := service.CreateMerchant(models.CreateMerchant{Name: "Shop", MCC: "5732"})
+	require.NoError(t, err)
+	other, err := service.CreateMerchant(models.CreateMerchant{Name: "Other", MCC: "5411"})
+	require.NoError(t, err)
+
+	payment, err := service.CreateOfflinePayment(merchant.ID, models.CreateOfflinePayment{
+		Amount:            100_00,
+		Currency:          "USD",
+		AuthorizationCode: "Y1OFFL",
+		Card:              models.Card{Number: "4212340000000006", ExpirationDate: "12/28"},
+	})
+	require.NoError(t, err)
+
+	create := models.CreateChargeback{
+		DisputeID:  "dispute-1",
+		TID:        payment.TID,
+		RRN:        payment.RRN,
+		Amount:     60_00,
+		Currency:   "USD",
+		ReasonCode: "13.1",
+	}
+
+	// nothing was captured yet
+	_, _, err = service.ReceiveChargeback(create)
+	require.ErrorIs(t, err, acquirer.ErrInvalidPaymentStatus)
+
+	_, err = service.CapturePayment(merchant.ID, payment.ID, models.CapturePayment{Amount: 80_00})
+	require.NoError(t, err)
+
+	unknown := create
+	unknown.RRN = "000000000000"
+	_, _, err = service.ReceiveChargeback(unknown)
+	require.ErrorIs(t, err, acquirer.ErrNotFound)
+
+	tooMuch := create
+	tooMuch.Amount = 90_00
+	_, _, err = service.ReceiveChargeback(tooMuch)
+	require.ErrorIs(t, err, acquirer.ErrInvalidAmount)
+
+	otherCurrency := create
+	otherCurrency.Currency = "EUR"
+	_, _, err = service.ReceiveChargeback(otherCurrency)
+	require.ErrorIs(t, err, acquirer.ErrInvalidChargeback)
+
+	chargeback, created, err := service.ReceiveChargeback(create)
+	require.NoError(t, err)
+	require.True(t, created)
+	require.Equal(t, payment.ID, chargeback.PaymentID)
+	require.Equal(t, merchant.ID, chargeback.MerchantID)
+	require.Equal(t, models.ChargebackStatusChargeback, chargeback.Status)
+
+	// the network may repeat the chargeback
+	repeated, created, err := service.ReceiveChargeback(create)
+	require.NoError(t, err)
+	require.False(t, created)
+	require.Equal(t, chargeback.ID, repeated.ID)
+
+	chargebacks, err := service.ListChargebacks(merchant.ID, payment.ID)
+	require.NoError(t, err)
+	require.Len(t, chargebacks, 1)
+	_, err = service.ListChargebacks(other.ID, payment.ID)
+	require.ErrorIs(t, err, acquirer.ErrNotFound)
+
+	// the issuer cannot decide before the merchant responded
+	_, err = service.ChangeChargebackStatus(chargeback.ID, models.ChangeChargebackStatus{Status: models.ChargebackStatusWon})
+	require.ErrorIs(t, err, acquirer.ErrInvalidChargebackStatus)
+	_, err = service.ChangeChargebackStatus(chargeback.ID, models.ChangeChargebackStatus{Status: models.ChargebackStatusRepresentment})
+	require.ErrorIs(t, err, acquirer.ErrInvalidChargebackStatus)
+
+	_, err = service.SubmitRepresentment(merchant.ID, chargeback.ID, models.SubmitRepresentment{})
+	require.ErrorIs(t, err, acquirer.ErrInvalidChargeback)
+	_, err = service.SubmitRepresentment(other.ID, chargeback.ID, models.SubmitRepresentment{Evidence: "proof of delivery"})
+	require.ErrorIs(t, err, acquirer.ErrNotFound)
+
+	chargeback, err = service.SubmitRepresentment(merchant.ID, chargeback.ID, models.SubmitRepresentment{Evidence: "proof of delivery"})
+	require.NoError(t, err)
+	require.Equal(t, models.ChargebackStatusRepresentment, chargeback.Status)
+	require.Equal(t, "proof of delivery", chargeback.Evidence)
+
+	_, err = service.SubmitRepresentment(merchant.ID, chargeback.ID, models.SubmitRepresentment{Evidence: "again"})
+	require.ErrorIs(t, err, acquirer.ErrInvalidChargebackStatus)
+
+	chargeback, err = service.ChangeChargebackStatus(chargeback.ID, models.ChangeChargebackStatus{Status: models.ChargebackStatusPreArbitration, Reason: "signature does not match"})
+	require.NoError(t, err)
+	require.Equal(t, models.ChargebackStatusPreArbitration, chargeback.Status)
+
+	chargeback, err = service.ChangeChargebackStatus(chargeback.ID, models.ChangeChargebackStatus{Status: models.ChargebackStatusLost, Reason: "arbitration"})
+	require.NoError(t, err)
+	require.Equal(t, models.ChargebackStatusLost, chargeback.Status)
+	require.Equal(t, "arbitration", chargeback.Reason)
+
+	// lost is final
+	_, err = service.ChangeChargebackStatus(chargeback.ID, models.ChangeChargebackStatus{Status: models.ChargebackStatusWon})
+	require.ErrorIs(t, err, acquirer.ErrInvalidChargebackStatus)
+
+	// another dispute takes at most what is not refunded or charged back yet:
+	// 80_00 captured, 10_00 refunded and 60_00 lost leave 10_00
+	_, err = service.RefundPayment(merchant.ID, payment.ID, models.CreateRefund{Amount: 10_00})
+	require.NoError(t, err)
+
+	second := create
+	second.DisputeID = "dispute-2"
+	second.Amount = 10_01
+	_, _, err = service.ReceiveChargeback(second)
+	require.ErrorIs(t, err, acquirer.ErrInvalidAmount)
+
+	second.Amount = 10_00
+	_, created, err = service.ReceiveChargeback(second)
+	require.NoError(t, err)
+	require.True(t, created)
+
+	third := create
+	third.DisputeID = "dispute-3"
+	third.Amount = 1
+	_, _, err = service.ReceiveChargeback(third)
+	require.ErrorIs(t, err, acquirer.ErrInvalidAmount)
+
+	// a repeat is not a new chargeback, so it still gets the first one
+	repeated, created, err = service.ReceiveChargeback(create)
+	require.NoError(t, err)
+	require.False(t, created)
+	require.Equal(t, chargeback.ID, repeated.ID)
+}
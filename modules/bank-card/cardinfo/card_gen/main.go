@@ -30,6 +30,7 @@ var (
 	flagVerbose   = flag.Bool("verbose", false, "print full PAN (otherwise masked)")
 	flagDCVVStep  = flag.Int("dcvv-step", 30, "display CVV step seconds (UI-only, default 30s)")
 	flagCardName  = flag.String("card-name", "", "cardholder name for card face imprint")
+	flagCVV       = flag.String("cvv-provider", "demo", "CVV algorithm: demo (HMAC, CVK_DEMO) or visa (Visa CVV, CVK_HEX_DEMO)")
 )
 
 func main() {
@@ -50,13 +51,25 @@ func main() {
 	expCardFace := expiry.CardFace(now, years)
 	expYYMM := expiry.YYMM(now, years)
 
-    // 使用统一 Provider（严格 Demo 版）
-    key := must1(security.StrictDemoKey())
-    defer security.Wipe(key)
-    provider := security.NewDemoProviderStrict(key)
+    // 使用统一 Provider：严格 Demo 版或 Visa CVV 算法
+    var provider security.CVVProvider
+    switch *flagCVV {
+    case "demo":
+        key := must1(security.StrictDemoKey())
+        defer security.Wipe(key)
+        provider = security.NewDemoProviderStrict(key)
+    case "visa":
+        key := security.DemoVisaCVK()
+        defer security.Wipe(key)
+        provider = security.NewVisaProvider(key)
+    default:
+        fail("-cvv-provider must be demo or visa")
+    }
     panNoCD := pan[:len(pan)-1]
-    staticCVV := must1(provider.ComputeCVV2(panNoCD, expYYMM, "101", 3))
-    dcvv, ttlSec, err := provider.ComputeDisplayDCVV(panNoCD, expYYMM, "101", time.Duration(*flagDCVVStep)*time.Second, 3)
+    staticCVV := must1(provider.ComputeCVV2(panNoCD, expYYMM, security.ServiceCodeCVV1, 3))
+    cvv2 := must1(provider.ComputeCVV2(panNoCD, expYYMM, security.ServiceCodeCVV2, 3))
+    icvv := must1(provider.ComputeCVV2(panNoCD, expYYMM, security.ServiceCodeICVV, 3))
+    dcvv, ttlSec, err := provider.ComputeDisplayDCVV(panNoCD, expYYMM, security.ServiceCodeCVV1, time.Duration(*flagDCVVStep)*time.Second, 3)
     must(err)
 
 	printPAN := cardgen.MaskPAN(pan)
@@ -72,6 +85,7 @@ func main() {
 	}
     if *flagShowCVV {
         fmt.Printf("CVV(static, one-time): %s\n", staticCVV)
+        fmt.Printf("CVV2(card face): %s  iCVV(chip): %s\n", cvv2, icvv)
     }
     fmt.Printf("CVV(dynamic, UI-only): %s (expires in %ds)\n", dcvv, ttlSec)
 
@@ -0,0 +1,122 @@
+// Command issuer-clearing posts an acquirer clearing file against the
+// issuer's authorizations and writes the records it could not simply match
+// to an exceptions file.
+//
+//	DB_DSN=postgres://... issuer-clearing -exceptions exceptions.txt clearing-20261016-<id>.txt
+//
+// Records are posted once, so a file can be ingested again after a failure.
+package main
+
+import (
+	"database/sql"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/alovak/cardflow-playground/internal/clearing"
+	"github.com/alovak/cardflow-playground/issuer"
+	"github.com/alovak/cardflow-playground/log"
+	_ "github.com/lib/pq"
+	"golang.org/x/exp/slog"
+)
+
+func main() {
+	exceptionsPath := flag.String("exceptions", "", "exceptions file to write (default: <clearing file>.exceptions)")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "usage: %s [-exceptions path] <clearing file>\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if flag.NArg() != 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	logger := log.New().With(slog.String("app", "issuer-clearing"))
+
+	if err := run(logger, flag.Arg(0), *exceptionsPath); err != nil {
+		logger.Error("ingesting clearing file", "err", err)
+		os.Exit(1)
+	}
+}
+
+func run(logger *slog.Logger, path, exceptionsPath string) error {
+	if exceptionsPath == "" {
+		exceptionsPath = path + ".exceptions"
+	}
+
+	in, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	// the whole file is checked against its trailers before anything is posted
+	file, err := clearing.Read(in)
+	if err != nil {
+		return fmt.Errorf("reading %s: %w", path, err)
+	}
+
+	dsn := os.Getenv("DB_DSN")
+	if dsn == "" {
+		return fmt.Errorf("DB_DSN is required")
+	}
+	db, err := sql.Open("postgres", dsn)
+	if err != nil {
+		return fmt.Errorf("open postgres: %w", err)
+	}
+	defer db.Close()
+	if err := db.Ping(); err != nil {
+		return fmt.Errorf("ping postgres: %w", err)
+	}
+
+	cfg := issuer.DefaultConfig()
+	store, err := issuer.OpenKeyStore(cfg)
+	if err != nil {
+		return err
+	}
+	repository, err := issuer.NewPGRepositoryWithKeys(db, store, cfg)
+	if err != nil {
+		return err
+	}
+	service := issuer.NewService(repository, cfg)
+
+	report, err := service.IngestClearingFile(file)
+	// the exceptions found so far are written even when posting stopped
+	if report != nil {
+		if werr := writeExceptions(exceptionsPath, report.Exceptions); werr != nil && err == nil {
+			err = werr
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	logger.Info("clearing file ingested",
+		slog.String("file_id", report.FileID),
+		slog.Int("records", report.Records),
+		slog.Int("posted", report.Posted),
+		slog.Int("matched", report.Matched),
+		slog.Int("force_posted", report.ForcePosted),
+		slog.Int("rejected", report.Rejected),
+		slog.Int("duplicates", report.Duplicates),
+		slog.String("exceptions", exceptionsPath),
+	)
+
+	return nil
+}
+
+func writeExceptions(path string, exceptions []clearing.Exception) error {
+	out, err := os.Create(path)
+	if err != nil {
+		return fmt.Errorf("creating exceptions file: %w", err)
+	}
+
+	if err := clearing.WriteExceptions(out, exceptions); err != nil {
+		out.Close()
+		return fmt.Errorf("writing exceptions file: %w", err)
+	}
+
+	return out.Close()
+}
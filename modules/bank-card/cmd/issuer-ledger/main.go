@@ -0,0 +1,99 @@
+// Command issuer-ledger verifies the issuer's ledger: every journal entry
+// must balance and the account balances, a projection of the ledger, must
+// match the sum of its postings. The check is written as JSON to stdout.
+//
+//	DB_DSN=postgres://... issuer-ledger
+//
+// The exit code is 0 when the ledger is consistent, 1 when the check found
+// discrepancies and 2 when it could not run.
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/alovak/cardflow-playground/issuer"
+	"github.com/alovak/cardflow-playground/log"
+	_ "github.com/lib/pq"
+	"golang.org/x/exp/slog"
+)
+
+const (
+	exitConsistent    = 0
+	exitDiscrepancies = 1
+	exitFailed        = 2
+)
+
+// errDiscrepancies is returned when the check is written but is not consistent.
+var errDiscrepancies = errors.New("discrepancies found")
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "usage: %s\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if flag.NArg() != 0 {
+		flag.Usage()
+		os.Exit(exitFailed)
+	}
+
+	logger := log.New().With(slog.String("app", "issuer-ledger"))
+
+	err := run(context.Background(), logger)
+	switch {
+	case errors.Is(err, errDiscrepancies):
+		os.Exit(exitDiscrepancies)
+	case err != nil:
+		logger.Error("checking ledger", "err", err)
+		os.Exit(exitFailed)
+	}
+	os.Exit(exitConsistent)
+}
+
+func run(ctx context.Context, logger *slog.Logger) error {
+	dsn := os.Getenv("DB_DSN")
+	if dsn == "" {
+		return fmt.Errorf("DB_DSN is required")
+	}
+	db, err := sql.Open("postgres", dsn)
+	if err != nil {
+		return fmt.Errorf("open postgres: %w", err)
+	}
+	defer db.Close()
+	if err := db.PingContext(ctx); err != nil {
+		return fmt.Errorf("ping postgres: %w", err)
+	}
+
+	// balances are checked as stored, the PAN hash key is never used
+	service := issuer.NewService(issuer.NewPGRepository(db, nil), issuer.DefaultConfig())
+
+	check, err := service.CheckLedger(ctx)
+	if err != nil {
+		return err
+	}
+
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(check); err != nil {
+		return fmt.Errorf("writing check: %w", err)
+	}
+
+	logger.Info("ledger checked",
+		slog.Int("accounts", check.Accounts),
+		slog.Int("journals", check.Journals),
+		slog.Int("unbalanced", len(check.Unbalanced)),
+		slog.Int("discrepancies", len(check.Discrepancies)),
+	)
+
+	if !check.Consistent() {
+		return errDiscrepancies
+	}
+	return nil
+}
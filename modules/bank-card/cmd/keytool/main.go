@@ -0,0 +1,290 @@
+// Command keytool manages the issuer's key store (see internal/keys). The
+// store is the file in KEYS_STORE, decrypted with the hex master key in
+// KEYS_MASTER_KEY.
+//
+//	keytool list
+//	keytool import -purpose CVK -alg TDES [-components 2] [-kcv 08D7B4] < components
+//	keytool import -tr31 B0120C0TC00E0200KC0C0008D7B4KP0C00D1D812... [-kcv 08D7B4]
+//	keytool export -purpose CVK [-version 1] [-kbpk-version 1] [-exportability E]
+//	keytool retire -purpose CVK -version 1
+//	keytool kcv -alg TDES 0123456789ABCDEFFEDCBA9876543210
+//
+// import reads the clear components of a key in hex, one per line, so each
+// custodian can type theirs without it reaching the shell history. The KCV
+// of every component and of the key are printed; with -kcv the key is only
+// imported when its KCV is the expected one. With -tr31 it imports the key
+// of a TR-31 key block instead, unwrapped under the active ZMK; export
+// wraps a key under a ZMK in a TR-31 key block, version B under a TDES ZMK
+// and D under an AES one.
+package main
+
+import (
+	"bufio"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/alovak/cardflow-playground/internal/keys"
+	"github.com/alovak/cardflow-playground/internal/tr31"
+)
+
+const usage = `usage: keytool <command> [flags]
+
+commands:
+  list     list the keys of the store
+  import   import a key from its clear components, read from stdin, or a TR-31 key block
+  export   export a key in a TR-31 key block
+  retire   retire a key version
+  kcv      compute the KCV of a clear key
+`
+
+func main() {
+	if len(os.Args) < 2 {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+
+	var err error
+	switch cmd, args := os.Args[1], os.Args[2:]; cmd {
+	case "list":
+		err = list(args)
+	case "import":
+		err = importKey(args, os.Stdin)
+	case "export":
+		err = export(args)
+	case "retire":
+		err = retire(args)
+	case "kcv":
+		err = kcv(args)
+	default:
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "keytool: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+// openStore opens the store in KEYS_STORE with the master key in KEYS_MASTER_KEY.
+func openStore() (*keys.Store, error) {
+	path := os.Getenv("KEYS_STORE")
+	if path == "" {
+		return nil, fmt.Errorf("KEYS_STORE is not set")
+	}
+	master, err := keys.MasterKeyFromEnv()
+	if err != nil {
+		return nil, err
+	}
+	return keys.Open(path, master)
+}
+
+func list(args []string) error {
+	fs := flag.NewFlagSet("list", flag.ExitOnError)
+	fs.Parse(args)
+
+	store, err := openStore()
+	if err != nil {
+		return err
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "PURPOSE\tVERSION\tALGORITHM\tSTATE\tKCV\tCREATED")
+	for _, k := range store.List() {
+		fmt.Fprintf(w, "%s\t%d\t%s\t%s\t%s\t%s\n", k.Purpose, k.Version, k.Algorithm, k.State, k.KCV, k.CreatedAt.Format("2006-01-02 15:04:05"))
+	}
+	return w.Flush()
+}
+
+func importKey(args []string, stdin io.Reader) error {
+	fs := flag.NewFlagSet("import", flag.ExitOnError)
+	purposeName := fs.String("purpose", "", "key purpose: CVK, PVK, ZPK, ZMK, PAN_PEPPER or DEK")
+	algName := fs.String("alg", "", "key algorithm: TDES, AES or HMAC")
+	count := fs.Int("components", 2, "number of clear components")
+	block := fs.String("tr31", "", "TR-31 key block to import instead of components")
+	expected := fs.String("kcv", "", "expected KCV of the key")
+	fs.Parse(args)
+
+	if *block != "" {
+		return importBlock(*block, *expected)
+	}
+	purpose, err := keys.ParsePurpose(*purposeName)
+	if err != nil {
+		return err
+	}
+	alg, err := keys.ParseAlgorithm(*algName)
+	if err != nil {
+		return err
+	}
+
+	components, err := readComponents(stdin, *count, alg)
+	if err != nil {
+		return err
+	}
+	material, err := keys.CombineComponents(components...)
+	if err != nil {
+		return err
+	}
+	if err := keys.Validate(purpose, alg, material); err != nil {
+		return err
+	}
+	if *expected != "" {
+		if err := keys.CheckKCV(alg, material, *expected); err != nil {
+			return err
+		}
+	}
+
+	store, err := openStore()
+	if err != nil {
+		return err
+	}
+	key, err := store.Import(purpose, alg, material)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("imported %s\n", key)
+	return nil
+}
+
+// importBlock imports the key of a TR-31 key block wrapped under the active ZMK.
+func importBlock(block, expected string) error {
+	store, err := openStore()
+	if err != nil {
+		return err
+	}
+	kbpk, err := store.Active(keys.PurposeZMK)
+	if err != nil {
+		return err
+	}
+	purpose, alg, material, err := tr31.Import(kbpk, strings.TrimSpace(block))
+	if err != nil {
+		return err
+	}
+	if expected != "" {
+		if err := keys.CheckKCV(alg, material, expected); err != nil {
+			return err
+		}
+	}
+	key, err := store.Import(purpose, alg, material)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("imported %s from a key block under %s\n", key, kbpk)
+	return nil
+}
+
+func export(args []string) error {
+	fs := flag.NewFlagSet("export", flag.ExitOnError)
+	purposeName := fs.String("purpose", "", "purpose of the key to export")
+	version := fs.Int("version", 0, "version of the key, the active one when 0")
+	kbpkVersion := fs.Int("kbpk-version", 0, "version of the ZMK to wrap it under, the active one when 0")
+	exportability := fs.String("exportability", "E", "exportability of the key: E, N or S")
+	fs.Parse(args)
+
+	purpose, err := keys.ParsePurpose(*purposeName)
+	if err != nil {
+		return err
+	}
+	if len(*exportability) != 1 || !strings.Contains("ENS", *exportability) {
+		return fmt.Errorf("exportability %q is not E, N or S", *exportability)
+	}
+	store, err := openStore()
+	if err != nil {
+		return err
+	}
+	key, err := store.Get(purpose, *version)
+	if err != nil {
+		return err
+	}
+	kbpk, err := store.Get(keys.PurposeZMK, *kbpkVersion)
+	if err != nil {
+		return err
+	}
+	block, err := tr31.Export(kbpk, key, (*exportability)[0])
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "%s under %s\n", key, kbpk)
+	fmt.Println(block)
+	return nil
+}
+
+// readComponents reads count hex components, one per line, printing the
+// KCV of each.
+func readComponents(r io.Reader, count int, alg keys.Algorithm) ([][]byte, error) {
+	scanner := bufio.NewScanner(r)
+	var components [][]byte
+	for i := 1; i <= count; i++ {
+		fmt.Fprintf(os.Stderr, "component %d of %d: ", i, count)
+		if !scanner.Scan() {
+			if err := scanner.Err(); err != nil {
+				return nil, err
+			}
+			return nil, errors.New("missing component")
+		}
+		component, err := hex.DecodeString(strings.TrimSpace(scanner.Text()))
+		if err != nil {
+			return nil, fmt.Errorf("component %d: %w", i, err)
+		}
+		componentKCV, err := keys.KCV(alg, component)
+		if err != nil {
+			return nil, fmt.Errorf("component %d: %w", i, err)
+		}
+		fmt.Fprintf(os.Stderr, "KCV %s\n", componentKCV)
+		components = append(components, component)
+	}
+	return components, nil
+}
+
+func retire(args []string) error {
+	fs := flag.NewFlagSet("retire", flag.ExitOnError)
+	purposeName := fs.String("purpose", "", "key purpose")
+	version := fs.Int("version", 0, "key version")
+	fs.Parse(args)
+
+	purpose, err := keys.ParsePurpose(*purposeName)
+	if err != nil {
+		return err
+	}
+	store, err := openStore()
+	if err != nil {
+		return err
+	}
+	if err := store.Retire(purpose, *version); err != nil {
+		return err
+	}
+	key, err := store.Get(purpose, *version)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("retired %s\n", key)
+	return nil
+}
+
+func kcv(args []string) error {
+	fs := flag.NewFlagSet("kcv", flag.ExitOnError)
+	algName := fs.String("alg", "TDES", "key algorithm: TDES, AES or HMAC")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		return errors.New("kcv takes the clear key in hex")
+	}
+
+	alg, err := keys.ParseAlgorithm(*algName)
+	if err != nil {
+		return err
+	}
+	key, err := hex.DecodeString(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	value, err := keys.KCV(alg, key)
+	if err != nil {
+		return err
+	}
+	fmt.Println(value)
+	return nil
+}
@@ -0,0 +1,238 @@
+// Command recon reconciles the acquirer's payments with the issuer's
+// authorizations and reports what matched, what differs in amount, currency
+// or authorization code, and what is missing on either side.
+//
+//	DB_DSN=postgres://... recon -from 2026-10-15 -to 2026-10-15 -json report.json -csv report.csv
+//	DB_DSN=postgres://... recon -from 2026-10-15 -export snapshot.json
+//	recon -snapshot snapshot.json -csv -
+//
+// Both sides are read from DB_DSN, or from ACQUIRER_DB_DSN and ISSUER_DB_DSN
+// when they live in different databases, or from an exported snapshot.
+//
+// The exit code is 0 when everything matched, 1 when the report has
+// discrepancies and 2 when the reconciliation could not run.
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/alovak/cardflow-playground/internal/recon"
+	"github.com/alovak/cardflow-playground/log"
+	_ "github.com/lib/pq"
+	"golang.org/x/exp/slog"
+)
+
+const (
+	exitReconciled    = 0
+	exitDiscrepancies = 1
+	exitFailed        = 2
+)
+
+// errDiscrepancies is returned when the report is written but does not reconcile.
+var errDiscrepancies = errors.New("discrepancies found")
+
+type options struct {
+	from, to     string
+	snapshotPath string
+	exportPath   string
+	jsonPath     string
+	csvPath      string
+}
+
+func main() {
+	var opts options
+	flag.StringVar(&opts.from, "from", "", "first day to reconcile, YYYY-MM-DD (UTC)")
+	flag.StringVar(&opts.to, "to", "", "last day to reconcile, YYYY-MM-DD (UTC)")
+	flag.StringVar(&opts.snapshotPath, "snapshot", "", "read both sides from an exported snapshot instead of the databases")
+	flag.StringVar(&opts.exportPath, "export", "", "export both sides to a snapshot file instead of reconciling")
+	flag.StringVar(&opts.jsonPath, "json", "", "JSON report file, - for stdout")
+	flag.StringVar(&opts.csvPath, "csv", "", "CSV report file, - for stdout")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "usage: %s [-from date] [-to date] [-snapshot path | -export path] [-json path] [-csv path]\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if flag.NArg() != 0 {
+		flag.Usage()
+		os.Exit(exitFailed)
+	}
+
+	logger := log.New().With(slog.String("app", "recon"))
+
+	err := run(context.Background(), logger, opts)
+	switch {
+	case errors.Is(err, errDiscrepancies):
+		os.Exit(exitDiscrepancies)
+	case err != nil:
+		logger.Error("reconciling", "err", err)
+		os.Exit(exitFailed)
+	}
+	os.Exit(exitReconciled)
+}
+
+func run(ctx context.Context, logger *slog.Logger, opts options) error {
+	window, err := parseWindow(opts.from, opts.to)
+	if err != nil {
+		return err
+	}
+
+	var acquirer recon.AcquirerRepository
+	var issuer recon.IssuerRepository
+	if opts.snapshotPath != "" {
+		snapshot, err := readSnapshot(opts.snapshotPath)
+		if err != nil {
+			return err
+		}
+		acquirer, issuer = snapshot, snapshot
+	} else {
+		acquirerDB, err := openDB("ACQUIRER_DB_DSN")
+		if err != nil {
+			return err
+		}
+		defer acquirerDB.Close()
+
+		issuerDB, err := openDB("ISSUER_DB_DSN")
+		if err != nil {
+			return err
+		}
+		defer issuerDB.Close()
+
+		acquirer, issuer = recon.NewPGAcquirerRepository(acquirerDB), recon.NewPGIssuerRepository(issuerDB)
+	}
+
+	if opts.exportPath != "" {
+		snapshot, err := recon.Export(ctx, acquirer, issuer, window)
+		if err != nil {
+			return err
+		}
+		if err := writeFile(opts.exportPath, func(w io.Writer) error { return recon.WriteSnapshot(w, snapshot) }); err != nil {
+			return fmt.Errorf("writing snapshot: %w", err)
+		}
+		logger.Info("snapshot exported",
+			slog.Int("payments", len(snapshot.Payments)),
+			slog.Int("auths", len(snapshot.Auths)),
+			slog.String("path", opts.exportPath),
+		)
+		return nil
+	}
+
+	report, err := recon.Run(ctx, acquirer, issuer, window)
+	if err != nil {
+		return err
+	}
+
+	jsonPath := opts.jsonPath
+	if jsonPath == "" && opts.csvPath == "" {
+		jsonPath = "-"
+	}
+	if jsonPath != "" {
+		if err := writeFile(jsonPath, func(w io.Writer) error { return recon.WriteJSON(w, report) }); err != nil {
+			return fmt.Errorf("writing JSON report: %w", err)
+		}
+	}
+	if opts.csvPath != "" {
+		if err := writeFile(opts.csvPath, func(w io.Writer) error { return recon.WriteCSV(w, report) }); err != nil {
+			return fmt.Errorf("writing CSV report: %w", err)
+		}
+	}
+
+	logger.Info("reconciliation done",
+		slog.Int("matched", report.Summary.Matched),
+		slog.Int("amount_mismatch", report.Summary.AmountMismatch),
+		slog.Int("missing_at_issuer", report.Summary.MissingAtIssuer),
+		slog.Int("missing_at_acquirer", report.Summary.MissingAtAcquirer),
+	)
+
+	if !report.Reconciled() {
+		return errDiscrepancies
+	}
+
+	return nil
+}
+
+// parseWindow turns the inclusive days into a window ending at midnight
+// after the last day.
+func parseWindow(from, to string) (recon.Window, error) {
+	var window recon.Window
+
+	if from != "" {
+		day, err := time.Parse("2006-01-02", from)
+		if err != nil {
+			return window, fmt.Errorf("invalid -from: %w", err)
+		}
+		window.From = day
+	}
+
+	if to != "" {
+		day, err := time.Parse("2006-01-02", to)
+		if err != nil {
+			return window, fmt.Errorf("invalid -to: %w", err)
+		}
+		window.To = day.AddDate(0, 0, 1)
+	}
+
+	if !window.From.IsZero() && !window.To.IsZero() && !window.From.Before(window.To) {
+		return window, fmt.Errorf("-from is after -to")
+	}
+
+	return window, nil
+}
+
+// openDB connects to the DSN in the given variable, or in DB_DSN when it is
+// not set.
+func openDB(variable string) (*sql.DB, error) {
+	dsn := os.Getenv(variable)
+	if dsn == "" {
+		dsn = os.Getenv("DB_DSN")
+	}
+	if dsn == "" {
+		return nil, fmt.Errorf("DB_DSN or %s is required", variable)
+	}
+
+	db, err := sql.Open("postgres", dsn)
+	if err != nil {
+		return nil, fmt.Errorf("open postgres: %w", err)
+	}
+	if err := db.Ping(); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("ping postgres: %w", err)
+	}
+
+	return db, nil
+}
+
+func readSnapshot(path string) (*recon.Snapshot, error) {
+	in, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer in.Close()
+
+	return recon.ReadSnapshot(in)
+}
+
+func writeFile(path string, write func(io.Writer) error) error {
+	if path == "-" {
+		return write(os.Stdout)
+	}
+
+	out, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+
+	if err := write(out); err != nil {
+		out.Close()
+		return err
+	}
+
+	return out.Close()
+}
@@ -1,6 +1,7 @@
 package main_test
 
 import (
+    "encoding/hex"
     "fmt"
     "testing"
     "os"
@@ -11,6 +12,7 @@ import (
 	"github.com/alovak/cardflow-playground/issuer"
 	issuerClient "github.com/alovak/cardflow-playground/issuer/client"
 	issuerModels "github.com/alovak/cardflow-playground/issuer/models"
+	"github.com/alovak/cardflow-playground/internal/security"
 	"github.com/alovak/cardflow-playground/log"
 	"github.com/stretchr/testify/require"
 )
@@ -19,9 +21,19 @@ func TestEndToEndTransaction(t *testing.T) {
     // Force in-memory repository for fast E2E tests
     os.Setenv("REPO_BACKEND", "mem")
     os.Setenv("ALLOW_MEM_BACKEND_FOR_TESTS", "true")
+
+	// the flow must not depend on the ISO 8583 spec both sides agree on
+	for _, spec := range []string{"playground", "iso87"} {
+		t.Run(spec, func(t *testing.T) {
+			testEndToEndTransaction(t, spec)
+		})
+	}
+}
+
+func testEndToEndTransaction(t *testing.T, spec string) {
 	// Initialize the issuer and acquirer components here
-	issuerBasePath, iso8583ServerAddr := setupIssuer(t)
-	acquirerBasePath := setupAcquirer(t, iso8583ServerAddr)
+	issuerBasePath, iso8583ServerAddr := setupIssuer(t, spec)
+	acquirerBasePath := setupAcquirer(t, iso8583ServerAddr, spec)
 
 	// configure the issuer client
 	issuerClient := issuerClient.New(issuerBasePath)
@@ -38,6 +50,15 @@ func TestEndToEndTransaction(t *testing.T) {
 	card, err := issuerClient.IssueCard(accountID)
 	require.NoError(t, err)
 
+	// Cards are issued inactive; activate it before use
+	status, err := issuerClient.ChangeCardStatus(accountID, card.ID, issuerModels.ChangeCardStatus{
+		Status: issuerModels.CardStatusActive,
+		Reason: "cardholder activation",
+		Actor:  "e2e",
+	})
+	require.NoError(t, err)
+	require.Equal(t, issuerModels.CardStatusActive, status.Status)
+
 	// Given: Create a new merchant for the acquirer
 	merchant, err := acquirerClient.CreateMerchant(models.CreateMerchant{
 		Name:       "Demo Merchant",
@@ -89,12 +110,38 @@ func TestEndToEndTransaction(t *testing.T) {
 
 	require.Equal(t, int64(100_00-10_00), account.AvailableBalance)
 	require.Equal(t, int64(10_00), account.HoldBalance)
+
+	// PINs travel as format 0 and format 4 blocks over either spec
+	_, err = issuerClient.SetPIN(accountID, card.ID, issuerModels.SetPIN{CardNumber: card.Number, PIN: "1234"})
+	require.NoError(t, err)
+
+	for _, format := range []int{security.PINBlockFormat0, security.PINBlockFormat4} {
+		pinBlock, err := security.EncryptPINBlock(format, "1234", card.Number, security.DemoZPK())
+		require.NoError(t, err)
+
+		payment, err := acquirerClient.CreatePayment(merchant.ID, models.CreatePayment{
+			Card: models.Card{
+				Number:         card.Number,
+				ExpirationDate: card.ExpirationDate,
+				PINBlock:       hex.EncodeToString(pinBlock),
+			},
+			Amount:   5_00,
+			Currency: "USD",
+		})
+		require.NoError(t, err, "format %d", format)
+		require.Equal(t, models.PaymentStatusAuthorized, payment.Status, "format %d", format)
+	}
+
+	account, err = issuerClient.GetAccount(accountID)
+	require.NoError(t, err)
+	require.Equal(t, int64(100_00-10_00-2*5_00), account.AvailableBalance)
 }
 
-func setupIssuer(t *testing.T) (string, string) {
+func setupIssuer(t *testing.T, spec string) (string, string) {
 	app := issuer.NewApp(log.New(), &issuer.Config{
 		HTTPAddr:    "127.0.0.1:0", // use random port
 		ISO8583Addr: "127.0.0.1:0", // use random port
+		ISO8583Spec: spec,
 	})
 	err := app.Start()
 	require.NoError(t, err)
@@ -105,10 +152,11 @@ func setupIssuer(t *testing.T) (string, string) {
 	return fmt.Sprintf("http://%s", app.Addr), app.ISO8583ServerAddr
 }
 
-func setupAcquirer(t *testing.T, iso8583ServerAddr string) string {
+func setupAcquirer(t *testing.T, iso8583ServerAddr, spec string) string {
 	app := acquirer.NewApp(log.New(), &acquirer.Config{
 		HTTPAddr:    "127.0.0.1:0", // use random port
 		ISO8583Addr: iso8583ServerAddr,
+		ISO8583Spec: spec,
 	})
 	err := app.Start()
 	require.NoError(t, err)
@@ -0,0 +1,526 @@
+// Package clearing reads and writes the fixed-width clearing file the
+// acquirer sends the issuer at the end of the day.
+//
+// A file is a sequence of 200 character records, one per line:
+//
+//	H  file header: file ID, business date, creation time
+//	B  batch header: one batch per merchant with its MID, name and MCC
+//	D  detail: a presentment (05) or refund (06) of the batch
+//	T  batch trailer: detail count and amount totals of the batch
+//	Z  file trailer: batch and detail counts and amount totals of the file
+//
+// Numeric fields are right-justified and zero-filled, alphanumeric fields
+// are left-justified and space-filled. Amounts are in minor units; the
+// totals are control totals across currencies.
+package clearing
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// RecordLength is the length of every record, without the line break.
+const RecordLength = 200
+
+const (
+	dateLayout     = "20060102"
+	dateTimeLayout = "20060102150405"
+)
+
+// TransactionCode tells what a detail record does to the cardholder account.
+type TransactionCode string
+
+const (
+	// TransactionCodePresentment debits the cardholder for a capture.
+	TransactionCodePresentment TransactionCode = "05"
+	// TransactionCodeRefund credits the cardholder back.
+	TransactionCodeRefund TransactionCode = "06"
+)
+
+type File struct {
+	ID           string
+	BusinessDate time.Time
+	CreatedAt    time.Time
+	Batches      []Batch
+}
+
+// Batch is what a merchant captured and refunded since its previous batch.
+type Batch struct {
+	ID           string
+	MID          string
+	MerchantName string
+	MCC          string
+	Records      []Record
+}
+
+// Record is a presentment or refund. The issuer finds the authorization by
+// card, TID and RRN; STAN is the one of the capture or refund message, so
+// the issuer can tell it was already posted online.
+type Record struct {
+	Code              TransactionCode
+	Reference         string
+	PAN               string
+	ExpirationDate    string
+	Amount            int64
+	Currency          string
+	AuthorizationCode string
+	RRN               string
+	STAN              string
+	TID               string
+	TransactedAt      time.Time
+}
+
+// Totals are the control totals of a batch or a file.
+type Totals struct {
+	Records           int
+	PresentmentAmount int64
+	RefundAmount      int64
+}
+
+func (t *Totals) add(record Record) {
+	t.Records++
+	switch record.Code {
+	case TransactionCodePresentment:
+		t.PresentmentAmount += record.Amount
+	case TransactionCodeRefund:
+		t.RefundAmount += record.Amount
+	}
+}
+
+// Totals returns the control totals of the batch.
+func (b Batch) Totals() Totals {
+	var totals Totals
+	for _, record := range b.Records {
+		totals.add(record)
+	}
+	return totals
+}
+
+// Totals returns the control totals of the file.
+func (f *File) Totals() Totals {
+	var totals Totals
+	for _, batch := range f.Batches {
+		for _, record := range batch.Records {
+			totals.add(record)
+		}
+	}
+	return totals
+}
+
+// field is the position of a value in a record.
+type field struct {
+	offset, length int
+	numeric        bool
+}
+
+// field layouts; offset 0 is the record type
+var (
+	headerFileID       = field{1, 32, false}
+	headerBusinessDate = field{33, 8, true}
+	headerCreatedAt    = field{41, 14, true}
+
+	batchID           = field{1, 32, false}
+	batchMID          = field{33, 15, false}
+	batchMerchantName = field{48, 25, false}
+	batchMCC          = field{73, 4, false}
+
+	detailCode              = field{1, 2, true}
+	detailReference         = field{3, 32, false}
+	detailPAN               = field{35, 19, false}
+	detailExpirationDate    = field{54, 4, false}
+	detailAmount            = field{58, 12, true}
+	detailCurrency          = field{70, 3, false}
+	detailAuthorizationCode = field{73, 6, false}
+	detailRRN               = field{79, 12, false}
+	detailSTAN              = field{91, 6, true}
+	detailTID               = field{97, 8, false}
+	detailTransactedAt      = field{105, 14, true}
+
+	trailerBatchID           = field{1, 32, false}
+	trailerRecords           = field{33, 8, true}
+	trailerPresentmentAmount = field{41, 15, true}
+	trailerRefundAmount      = field{56, 15, true}
+
+	fileTrailerBatches           = field{1, 8, true}
+	fileTrailerRecords           = field{9, 8, true}
+	fileTrailerPresentmentAmount = field{17, 15, true}
+	fileTrailerRefundAmount      = field{32, 15, true}
+)
+
+// record builds one fixed-width record.
+type record []byte
+
+func newRecord(recordType byte) record {
+	r := record(strings.Repeat(" ", RecordLength))
+	r[0] = recordType
+	return r
+}
+
+func (r record) set(f field, value string) error {
+	if len(value) > f.length {
+		return fmt.Errorf("value %q is longer than %d characters", value, f.length)
+	}
+	if f.numeric {
+		value = strings.Repeat("0", f.length-len(value)) + value
+	} else {
+		value += strings.Repeat(" ", f.length-len(value))
+	}
+	copy(r[f.offset:], value)
+	return nil
+}
+
+func (r record) setInt(f field, value int64) error {
+	if value < 0 {
+		return fmt.Errorf("negative value %d", value)
+	}
+	return r.set(f, strconv.FormatInt(value, 10))
+}
+
+func (r record) get(f field) string {
+	return strings.TrimRight(string(r[f.offset:f.offset+f.length]), " ")
+}
+
+func (r record) getInt(f field) (int64, error) {
+	value := r.get(f)
+	n, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid number %q at %d", value, f.offset)
+	}
+	return n, nil
+}
+
+func (r record) getTime(f field, layout string) (time.Time, error) {
+	value := r.get(f)
+	t, err := time.Parse(layout, value)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid date %q at %d", value, f.offset)
+	}
+	return t, nil
+}
+
+// Write writes the file with its trailers computed from the records.
+func Write(w io.Writer, f *File) error {
+	bw := bufio.NewWriter(w)
+
+	write := func(r record, err error) error {
+		if err != nil {
+			return err
+		}
+		if _, err := bw.Write(r); err != nil {
+			return err
+		}
+		return bw.WriteByte('\n')
+	}
+
+	if err := write(formatHeader(f)); err != nil {
+		return fmt.Errorf("writing file header: %w", err)
+	}
+
+	for _, batch := range f.Batches {
+		if err := write(formatBatchHeader(batch)); err != nil {
+			return fmt.Errorf("writing header of batch %s: %w", batch.ID, err)
+		}
+		for _, detail := range batch.Records {
+			if err := write(formatDetail(detail)); err != nil {
+				return fmt.Errorf("writing record %s: %w", detail.Reference, err)
+			}
+		}
+		if err := write(formatBatchTrailer(batch)); err != nil {
+			return fmt.Errorf("writing trailer of batch %s: %w", batch.ID, err)
+		}
+	}
+
+	if err := write(formatFileTrailer(f)); err != nil {
+		return fmt.Errorf("writing file trailer: %w", err)
+	}
+
+	return bw.Flush()
+}
+
+func formatHeader(f *File) (record, error) {
+	r := newRecord('H')
+	return r, firstError(
+		r.set(headerFileID, f.ID),
+		r.set(headerBusinessDate, f.BusinessDate.Format(dateLayout)),
+		r.set(headerCreatedAt, f.CreatedAt.UTC().Format(dateTimeLayout)),
+	)
+}
+
+func formatBatchHeader(b Batch) (record, error) {
+	r := newRecord('B')
+	name := b.MerchantName
+	if len(name) > batchMerchantName.length {
+		name = name[:batchMerchantName.length]
+	}
+	return r, firstError(
+		r.set(batchID, b.ID),
+		r.set(batchMID, b.MID),
+		r.set(batchMerchantName, name),
+		r.set(batchMCC, b.MCC),
+	)
+}
+
+func formatDetail(d Record) (record, error) {
+	if d.Code != TransactionCodePresentment && d.Code != TransactionCodeRefund {
+		return nil, fmt.Errorf("unknown transaction code %q", d.Code)
+	}
+	r := newRecord('D')
+	return r, firstError(
+		r.set(detailCode, string(d.Code)),
+		r.set(detailReference, d.Reference),
+		r.set(detailPAN, d.PAN),
+		r.set(detailExpirationDate, d.ExpirationDate),
+		r.setInt(detailAmount, d.Amount),
+		r.set(detailCurrency, strings.ToUpper(d.Currency)),
+		r.set(detailAuthorizationCode, d.AuthorizationCode),
+		r.set(detailRRN, d.RRN),
+		r.set(detailSTAN, d.STAN),
+		r.set(detailTID, d.TID),
+		r.set(detailTransactedAt, d.TransactedAt.UTC().Format(dateTimeLayout)),
+	)
+}
+
+func formatBatchTrailer(b Batch) (record, error) {
+	totals := b.Totals()
+	r := newRecord('T')
+	return r, firstError(
+		r.set(trailerBatchID, b.ID),
+		r.setInt(trailerRecords, int64(totals.Records)),
+		r.setInt(trailerPresentmentAmount, totals.PresentmentAmount),
+		r.setInt(trailerRefundAmount, totals.RefundAmount),
+	)
+}
+
+func formatFileTrailer(f *File) (record, error) {
+	totals := f.Totals()
+	r := newRecord('Z')
+	return r, firstError(
+		r.setInt(fileTrailerBatches, int64(len(f.Batches))),
+		r.setInt(fileTrailerRecords, int64(totals.Records)),
+		r.setInt(fileTrailerPresentmentAmount, totals.PresentmentAmount),
+		r.setInt(fileTrailerRefundAmount, totals.RefundAmount),
+	)
+}
+
+// Read parses a clearing file. It fails on malformed records and when the
+// trailers do not match the records, so a truncated file is never posted.
+func Read(r io.Reader) (*File, error) {
+	scanner := bufio.NewScanner(r)
+
+	var f *File
+	var batch *Batch
+	var trailer bool
+	line := 0
+
+	for scanner.Scan() {
+		line++
+		text := strings.TrimRight(scanner.Text(), "\r")
+		if len(text) != RecordLength {
+			return nil, fmt.Errorf("line %d: record is %d characters long, want %d", line, len(text), RecordLength)
+		}
+		rec := record(text)
+
+		var err error
+		switch {
+		case trailer:
+			err = fmt.Errorf("record after the file trailer")
+		case rec[0] == 'H':
+			if f != nil {
+				err = fmt.Errorf("second file header")
+				break
+			}
+			f, err = parseHeader(rec)
+		case f == nil:
+			err = fmt.Errorf("missing file header")
+		case rec[0] == 'B':
+			if batch != nil {
+				err = fmt.Errorf("batch %s has no trailer", batch.ID)
+				break
+			}
+			batch = &Batch{
+				ID:           rec.get(batchID),
+				MID:          rec.get(batchMID),
+				MerchantName: rec.get(batchMerchantName),
+				MCC:          rec.get(batchMCC),
+			}
+		case rec[0] == 'D':
+			if batch == nil {
+				err = fmt.Errorf("detail record outside of a batch")
+				break
+			}
+			var detail Record
+			detail, err = parseDetail(rec)
+			batch.Records = append(batch.Records, detail)
+		case rec[0] == 'T':
+			if batch == nil {
+				err = fmt.Errorf("batch trailer without a batch")
+				break
+			}
+			err = checkTotals(batch.Totals(), rec, trailerRecords, trailerPresentmentAmount, trailerRefundAmount)
+			f.Batches = append(f.Batches, *batch)
+			batch = nil
+		case rec[0] == 'Z':
+			if batch != nil {
+				err = fmt.Errorf("batch %s has no trailer", batch.ID)
+				break
+			}
+			var batches int64
+			batches, err = rec.getInt(fileTrailerBatches)
+			if err == nil && batches != int64(len(f.Batches)) {
+				err = fmt.Errorf("trailer counts %d batches, file has %d", batches, len(f.Batches))
+			}
+			if err == nil {
+				err = checkTotals(f.Totals(), rec, fileTrailerRecords, fileTrailerPresentmentAmount, fileTrailerRefundAmount)
+			}
+			trailer = true
+		default:
+			err = fmt.Errorf("unknown record type %q", rec[0])
+		}
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	if !trailer {
+		return nil, fmt.Errorf("missing file trailer")
+	}
+
+	return f, nil
+}
+
+func parseHeader(r record) (*File, error) {
+	businessDate, err := r.getTime(headerBusinessDate, dateLayout)
+	if err != nil {
+		return nil, err
+	}
+	createdAt, err := r.getTime(headerCreatedAt, dateTimeLayout)
+	if err != nil {
+		return nil, err
+	}
+	return &File{
+		ID:           r.get(headerFileID),
+		BusinessDate: businessDate,
+		CreatedAt:    createdAt,
+	}, nil
+}
+
+func parseDetail(r record) (Record, error) {
+	code := TransactionCode(r.get(detailCode))
+	if code != TransactionCodePresentment && code != TransactionCodeRefund {
+		return Record{}, fmt.Errorf("unknown transaction code %q", code)
+	}
+	amount, err := r.getInt(detailAmount)
+	if err != nil {
+		return Record{}, err
+	}
+	transactedAt, err := r.getTime(detailTransactedAt, dateTimeLayout)
+	if err != nil {
+		return Record{}, err
+	}
+	return Record{
+		Code:              code,
+		Reference:         r.get(detailReference),
+		PAN:               r.get(detailPAN),
+		ExpirationDate:    r.get(detailExpirationDate),
+		Amount:            amount,
+		Currency:          r.get(detailCurrency),
+		AuthorizationCode: r.get(detailAuthorizationCode),
+		RRN:               r.get(detailRRN),
+		STAN:              r.get(detailSTAN),
+		TID:               r.get(detailTID),
+		TransactedAt:      transactedAt,
+	}, nil
+}
+
+func checkTotals(totals Totals, r record, records, presentments, refunds field) error {
+	want := []int64{int64(totals.Records), totals.PresentmentAmount, totals.RefundAmount}
+	for i, f := range []field{records, presentments, refunds} {
+		got, err := r.getInt(f)
+		if err != nil {
+			return err
+		}
+		if got != want[i] {
+			return fmt.Errorf("trailer total %d does not match %d of the records", got, want[i])
+		}
+	}
+	return nil
+}
+
+func firstError(errs ...error) error {
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Action is what the issuer did with a record it could not simply match.
+type Action string
+
+const (
+	// ActionForcePosted means the record was posted without a usable
+	// authorization, or for more than the authorization held.
+	ActionForcePosted Action = "FORCE_POSTED"
+	// ActionRejected means the record was not posted.
+	ActionRejected Action = "REJECTED"
+)
+
+// Exception is a record the issuer reports back for manual handling.
+type Exception struct {
+	BatchID string
+	Record  Record
+	Action  Action
+	Reason  string
+}
+
+var (
+	exceptionBatchID   = field{1, 32, false}
+	exceptionReference = field{33, 32, false}
+	exceptionCode      = field{65, 2, true}
+	exceptionAmount    = field{67, 12, true}
+	exceptionCurrency  = field{79, 3, false}
+	exceptionRRN       = field{82, 12, false}
+	exceptionTID       = field{94, 8, false}
+	exceptionAction    = field{102, 12, false}
+	exceptionReason    = field{114, 86, false}
+)
+
+// WriteExceptions writes one 'E' record per exception. Reasons longer than
+// the field are cut.
+func WriteExceptions(w io.Writer, exceptions []Exception) error {
+	bw := bufio.NewWriter(w)
+
+	for _, e := range exceptions {
+		reason := e.Reason
+		if len(reason) > exceptionReason.length {
+			reason = reason[:exceptionReason.length]
+		}
+		r := newRecord('E')
+		err := firstError(
+			r.set(exceptionBatchID, e.BatchID),
+			r.set(exceptionReference, e.Record.Reference),
+			r.set(exceptionCode, string(e.Record.Code)),
+			r.setInt(exceptionAmount, e.Record.Amount),
+			r.set(exceptionCurrency, e.Record.Currency),
+			r.set(exceptionRRN, e.Record.RRN),
+			r.set(exceptionTID, e.Record.TID),
+			r.set(exceptionAction, string(e.Action)),
+			r.set(exceptionReason, reason),
+		)
+		if err != nil {
+			return fmt.Errorf("writing exception of record %s: %w", e.Record.Reference, err)
+		}
+		bw.Write(r)
+		bw.WriteByte('\n')
+	}
+
+	return bw.Flush()
+}
@@ -0,0 +1,123 @@
+package clearing
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func testFile() *File {
+	transactedAt := time.Date(2026, time.October, 16, 14, 30, 5, 0, time.UTC)
+
+	return &File{
+		ID:           "c1e2a7f0b5d94a3c8e6f1a2b3c4d5e6f",
+		BusinessDate: time.Date(2026, time.October, 16, 0, 0, 0, 0, time.UTC),
+		CreatedAt:    time.Date(2026, time.October, 17, 0, 5, 0, 0, time.UTC),
+		Batches: []Batch{
+			{
+				ID:           "0b3c9a1e2d4f4e6a8b7c5d3e1f2a4b6c",
+				MID:          "123456789012345",
+				MerchantName: "A merchant with a name that does not fit",
+				MCC:          "5411",
+				Records: []Record{
+					{
+						Code:              TransactionCodePresentment,
+						Reference:         "9f8e7d6c5b4a49382716a5b4c3d2e1f0",
+						PAN:               "4212340000000006",
+						ExpirationDate:    "2812",
+						Amount:            40_00,
+						Currency:          "USD",
+						AuthorizationCode: "123456",
+						RRN:               "628914000001",
+						STAN:              "000002",
+						TID:               "T1",
+						TransactedAt:      transactedAt,
+					},
+					{
+						Code:         TransactionCodeRefund,
+						Reference:    "1a2b3c4d5e6f47089a1b2c3d4e5f6a7b",
+						PAN:          "4212340000000006",
+						Amount:       15_00,
+						Currency:     "USD",
+						RRN:          "628914000001",
+						STAN:         "000003",
+						TID:          "T1",
+						TransactedAt: transactedAt,
+					},
+				},
+			},
+			{
+				ID:  "2c4e6a8b0d1f43a5b7c9e1f3a5b7c9d1",
+				MID: "987654321098765",
+				MCC: "5812",
+			},
+		},
+	}
+}
+
+func TestWriteAndRead(t *testing.T) {
+	var buf bytes.Buffer
+	require.NoError(t, Write(&buf, testFile()))
+
+	lines := strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n")
+	require.Len(t, lines, 8)
+	for _, line := range lines {
+		require.Len(t, line, RecordLength)
+	}
+	require.Equal(t, "D05", lines[2][:3])
+	require.Equal(t, "T0b3c9a1e2d4f4e6a8b7c5d3e1f2a4b6c00000002000000000004000000000000001500", lines[4][:71])
+
+	f, err := Read(&buf)
+	require.NoError(t, err)
+
+	want := testFile()
+	// names are cut to the field length
+	want.Batches[0].MerchantName = "A merchant with a name th"
+	require.Equal(t, want, f)
+	require.Equal(t, Totals{Records: 2, PresentmentAmount: 40_00, RefundAmount: 15_00}, f.Totals())
+}
+
+func TestRead_RejectsInconsistentFiles(t *testing.T) {
+	var buf bytes.Buffer
+	require.NoError(t, Write(&buf, testFile()))
+	lines := strings.SplitAfter(buf.String(), "\n")
+
+	tests := map[string]string{
+		"truncated":        strings.Join(lines[:len(lines)-2], ""),
+		"missing record":   strings.Join(append(lines[:2:2], lines[3:]...), ""),
+		"changed amount":   strings.Replace(buf.String(), "000000004000USD", "000000004100USD", 1),
+		"short record":     strings.Replace(buf.String(), lines[1], lines[1][:150]+"\n", 1),
+		"missing header":   strings.Join(lines[1:], ""),
+		"unknown code":     strings.Replace(buf.String(), "D05", "D07", 1),
+		"unclosed batch":   strings.Join(append(lines[:4:4], lines[len(lines)-2:]...), ""),
+		"after the end":    buf.String() + lines[0],
+		"invalid business": strings.Replace(buf.String(), "H"+testFile().ID+"20261016", "H"+testFile().ID+"20261316", 1),
+	}
+
+	for name, content := range tests {
+		t.Run(name, func(t *testing.T) {
+			_, err := Read(strings.NewReader(content))
+			require.Error(t, err)
+		})
+	}
+}
+
+func TestWriteExceptions(t *testing.T) {
+	f := testFile()
+
+	var buf bytes.Buffer
+	err := WriteExceptions(&buf, []Exception{
+		{BatchID: f.Batches[0].ID, Record: f.Batches[0].Records[0], Action: ActionForcePosted, Reason: "no matching authorization"},
+		{BatchID: f.Batches[0].ID, Record: f.Batches[0].Records[1], Action: ActionRejected, Reason: strings.Repeat("x", 100)},
+	})
+	require.NoError(t, err)
+
+	lines := strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n")
+	require.Len(t, lines, 2)
+	require.Len(t, lines[0], RecordLength)
+	require.Len(t, lines[1], RecordLength)
+	require.Contains(t, lines[0], "05000000004000USD628914000001T1      FORCE_POSTED"+"no matching authorization")
+}
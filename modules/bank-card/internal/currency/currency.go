@@ -0,0 +1,48 @@
+// Package currency converts between ISO 4217 alphabetic and numeric currency codes.
+package currency
+
+import (
+	"fmt"
+	"strings"
+)
+
+var alphaToNumeric = map[string]string{
+	"AUD": "036",
+	"CAD": "124",
+	"CHF": "756",
+	"CNY": "156",
+	"EUR": "978",
+	"GBP": "826",
+	"HKD": "344",
+	"INR": "356",
+	"JPY": "392",
+	"NZD": "554",
+	"SGD": "702",
+	"USD": "840",
+}
+
+var numericToAlpha = func() map[string]string {
+	m := make(map[string]string, len(alphaToNumeric))
+	for alpha, numeric := range alphaToNumeric {
+		m[numeric] = alpha
+	}
+	return m
+}()
+
+// Numeric returns the ISO 4217 numeric code (e.g. "840") for an alphabetic code (e.g. "USD").
+func Numeric(alpha string) (string, error) {
+	numeric, ok := alphaToNumeric[strings.ToUpper(alpha)]
+	if !ok {
+		return "", fmt.Errorf("unsupported currency: %q", alpha)
+	}
+	return numeric, nil
+}
+
+// Alpha returns the ISO 4217 alphabetic code (e.g. "USD") for a numeric code (e.g. "840").
+func Alpha(numeric string) (string, error) {
+	alpha, ok := numericToAlpha[numeric]
+	if !ok {
+		return "", fmt.Errorf("unsupported numeric currency: %q", numeric)
+	}
+	return alpha, nil
+}
@@ -0,0 +1,75 @@
+// Package iso8583spec holds the ISO 8583 dialects the acquirer and the
+// issuer talk: the message types, the playground and 1987 specs and the
+// mapping of the types onto them. Both sides use this package, so they
+// cannot drift apart.
+package iso8583spec
+
+import (
+	"fmt"
+
+	"github.com/moov-io/iso8583"
+)
+
+// Spec is an ISO 8583 dialect: the message spec used on the wire and the
+// mapping of our message structs (AuthorizationRequest, ...) onto its fields.
+// The same structs are used with every spec, so the handlers do not depend
+// on the field layout.
+type Spec struct {
+	Name string
+
+	messageSpec *iso8583.MessageSpec
+	marshal     func(message *iso8583.Message, v any) error
+	unmarshal   func(message *iso8583.Message, v any) error
+}
+
+var (
+	// SpecPlayground is the original CardFlow Playground spec. It is kept for
+	// compatibility; its field assignments do not follow ISO 8583.
+	SpecPlayground = &Spec{
+		Name:        "playground",
+		messageSpec: spec,
+		marshal:     func(message *iso8583.Message, v any) error { return message.Marshal(v) },
+		unmarshal:   func(message *iso8583.Message, v any) error { return message.Unmarshal(v) },
+	}
+
+	// SpecISO87 follows the ISO 8583:1987 field assignments (see spec87.go).
+	SpecISO87 = &Spec{
+		Name:        "iso87",
+		messageSpec: spec87,
+		marshal:     marshal87,
+		unmarshal:   unmarshal87,
+	}
+)
+
+// SpecByName returns the spec with the given name. An empty name selects the
+// playground spec.
+func SpecByName(name string) (*Spec, error) {
+	switch name {
+	case "", SpecPlayground.Name:
+		return SpecPlayground, nil
+	case SpecISO87.Name:
+		return SpecISO87, nil
+	default:
+		return nil, fmt.Errorf("unknown ISO 8583 spec: %s", name)
+	}
+}
+
+// MessageSpec returns the message spec used on the wire, for the connections.
+func (s *Spec) MessageSpec() *iso8583.MessageSpec {
+	return s.messageSpec
+}
+
+// NewMessage returns an empty message for the spec.
+func (s *Spec) NewMessage() *iso8583.Message {
+	return iso8583.NewMessage(s.messageSpec)
+}
+
+// Marshal sets the message fields from v using the spec field mapping.
+func (s *Spec) Marshal(message *iso8583.Message, v any) error {
+	return s.marshal(message, v)
+}
+
+// Unmarshal populates v from the message fields using the spec field mapping.
+func (s *Spec) Unmarshal(message *iso8583.Message, v any) error {
+	return s.unmarshal(message, v)
+}
@@ -0,0 +1,106 @@
+package iso8583spec
+
+import (
+	"fmt"
+	"time"
+)
+
+// Processing codes (DE3). The first two digits are the transaction type,
+// the next two the account type it is from.
+const (
+	ProcessingCodePurchase       = "000000"
+	ProcessingCodeCashWithdrawal = "010000"
+	ProcessingCodeRefund         = "200000"
+	ProcessingCodeBalanceInquiry = "310000"
+)
+
+// Network management information codes (DE70) of 0800 messages.
+const (
+	NetworkCodeSignOn  = "001"
+	NetworkCodeSignOff = "002"
+	NetworkCodeCutover = "201"
+	NetworkCodeEcho    = "301"
+)
+
+type AuthorizationRequest struct {
+	MTI                   string               `index:"0"`
+	PrimaryAccountNumber  string               `index:"2"`
+	Amount                int64                `index:"3"`
+	TransmissionDateTime  string               `index:"4"`
+	Currency              string               `index:"7"`
+	CardVerificationValue string               `index:"8"`
+	ExpirationDate        string               `index:"9"` // YYMM
+	AcceptorInformation   *AcceptorInformation `index:"10"`
+	STAN                  string               `index:"11"`
+	// ProcessingCode tells purchases from refunds in financial requests
+	// (0200); empty means purchase
+	ProcessingCode string `index:"12"`
+	// TerminalID (DE41) and CardAcceptorID (DE42) identify the terminal and
+	// merchant; the acquirer numbers STANs per terminal
+	TerminalID     string `index:"13"`
+	CardAcceptorID string `index:"14"`
+	// RetrievalReferenceNumber (DE37) stays the same for all messages of a
+	// transaction; follow-ups quote the one of the original authorization
+	RetrievalReferenceNumber string `index:"15"`
+	// OriginalDataElements (DE90) refer captures, refunds and reversals to
+	// the original message, see FormatOriginalDataElements
+	OriginalDataElements string `index:"16"`
+	// AuthorizationCode is only sent in advices (0120), for approvals made offline
+	AuthorizationCode string `index:"6"`
+	// PINBlock (DE52) is the hex of the ISO 9564 PIN block encrypted under the
+	// zone PIN key: 8 bytes in format 0, 16 in format 4
+	PINBlock string `index:"18"`
+}
+
+type AuthorizationResponse struct {
+	MTI               string `index:"0"`
+	ApprovalCode      string `index:"5"`
+	AuthorizationCode string `index:"6"`
+	STAN              string `index:"11"`
+	// AdditionalAmounts (DE54) carries the balances of a balance inquiry
+	AdditionalAmounts string `index:"17"`
+}
+
+type AcceptorInformation struct {
+	Name       string `index:"01"`
+	MCC        string `index:"02"`
+	PostalCode string `index:"03"`
+	WebSite    string `index:"04"`
+}
+
+type NetworkManagementRequest struct {
+	MTI                   string `index:"0"`
+	TransmissionDateTime  string `index:"4"`
+	STAN                  string `index:"11"`
+	NetworkManagementCode string `index:"70"`
+}
+
+type NetworkManagementResponse struct {
+	MTI                   string `index:"0"`
+	ApprovalCode          string `index:"5"`
+	STAN                  string `index:"11"`
+	NetworkManagementCode string `index:"70"`
+}
+
+// FormatOriginalDataElements builds DE90 from the MTI, STAN and transmission
+// date and time of the original message. The acquiring and forwarding
+// institution IDs are not used and left as zeros.
+func FormatOriginalDataElements(mti, stan string, transmittedAt time.Time) string {
+	return fmt.Sprintf("%-4s%06s%s%011d%011d", mti, stan, transmittedAt.UTC().Format(transmissionDateTimeLayout87), 0, 0)
+}
+
+// ParseOriginalDataElements reads the MTI, STAN and transmission date and
+// time of the original message from DE90. DE90 carries no year, it is
+// restored relative to now.
+func ParseOriginalDataElements(value string, now time.Time) (mti, stan string, transmittedAt time.Time, err error) {
+	if len(value) < 20 {
+		return "", "", time.Time{}, fmt.Errorf("original data elements too short: %q", value)
+	}
+
+	transmittedAt, err = parseTransmissionDateTime87(value[10:20], now)
+	if err != nil {
+		return "", "", time.Time{}, err
+	}
+
+	return value[:4], value[4:10], transmittedAt, nil
+}
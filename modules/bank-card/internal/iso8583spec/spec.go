@@ -1,4 +1,4 @@
-package iso8583
+package iso8583spec
 
 import (
 	"fmt"
@@ -52,7 +52,6 @@ var spec *iso8583.MessageSpec = &iso8583.MessageSpec{
 			Description: "Approval Code",
 			Enc:         encoding.ASCII,
 			Pref:        prefix.ASCII.Fixed,
-			Pad:         padding.Left('0'),
 		}),
 		6: field.NewString(&field.Spec{
 			Length:      6,
@@ -66,11 +65,13 @@ var spec *iso8583.MessageSpec = &iso8583.MessageSpec{
 			Enc:         encoding.ASCII,
 			Pref:        prefix.ASCII.Fixed,
 		}),
+		// CVVs are 3 digits (4 for some schemes), so DE8 carries its
+		// length; a fixed 4 could not pack a 3 digit CVV at all
 		8: field.NewString(&field.Spec{
 			Length:      4,
 			Description: "Card Verification Value (CVV)",
 			Enc:         encoding.ASCII,
-			Pref:        prefix.ASCII.Fixed,
+			Pref:        prefix.ASCII.LL,
 		}),
 		9: field.NewString(&field.Spec{
 			Length:      4,
@@ -120,10 +121,61 @@ var spec *iso8583.MessageSpec = &iso8583.MessageSpec{
 			Enc:         encoding.ASCII,
 			Pref:        prefix.ASCII.Fixed,
 		}),
+		12: field.NewString(&field.Spec{
+			Length:      6,
+			Description: "Processing Code",
+			Enc:         encoding.ASCII,
+			Pref:        prefix.ASCII.Fixed,
+		}),
+		13: field.NewString(&field.Spec{
+			Length:      8,
+			Description: "Card Acceptor Terminal Identification",
+			Enc:         encoding.ASCII,
+			Pref:        prefix.ASCII.Fixed,
+			Pad:         padding.Right(' '),
+		}),
+		14: field.NewString(&field.Spec{
+			Length:      15,
+			Description: "Card Acceptor Identification Code",
+			Enc:         encoding.ASCII,
+			Pref:        prefix.ASCII.Fixed,
+			Pad:         padding.Right(' '),
+		}),
+		15: field.NewString(&field.Spec{
+			Length:      12,
+			Description: "Retrieval Reference Number",
+			Enc:         encoding.ASCII,
+			Pref:        prefix.ASCII.Fixed,
+		}),
+		16: field.NewString(&field.Spec{
+			Length:      42,
+			Description: "Original Data Elements",
+			Enc:         encoding.ASCII,
+			Pref:        prefix.ASCII.Fixed,
+		}),
+		17: field.NewString(&field.Spec{
+			Length:      120,
+			Description: "Additional Amounts",
+			Enc:         encoding.ASCII,
+			Pref:        prefix.ASCII.LLL,
+		}),
+		18: field.NewString(&field.Spec{
+			Length:      32,
+			Description: "PIN Data (hex)",
+			Enc:         encoding.ASCII,
+			Pref:        prefix.ASCII.LL,
+		}),
+		70: field.NewString(&field.Spec{
+			Length:      3,
+			Description: "Network Management Information Code",
+			Enc:         encoding.ASCII,
+			Pref:        prefix.ASCII.Fixed,
+		}),
 	},
 }
 
-func readMessageLength(r io.Reader) (int, error) {
+// ReadMessageLength reads the 2 byte binary length header of a message.
+func ReadMessageLength(r io.Reader) (int, error) {
 	header := network.NewBinary2BytesHeader()
 	n, err := header.ReadFrom(r)
 	if err != nil {
@@ -133,7 +185,8 @@ func readMessageLength(r io.Reader) (int, error) {
 	return header.Length(), nil
 }
 
-func writeMessageLength(w io.Writer, length int) (int, error) {
+// WriteMessageLength writes the 2 byte binary length header of a message.
+func WriteMessageLength(w io.Writer, length int) (int, error) {
 	header := network.NewBinary2BytesHeader()
 	header.SetLength(length)
 
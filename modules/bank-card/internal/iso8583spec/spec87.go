@@ -0,0 +1,465 @@
+package iso8583spec
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/alovak/cardflow-playground/internal/currency"
+	"github.com/moov-io/iso8583"
+	"github.com/moov-io/iso8583/encoding"
+	"github.com/moov-io/iso8583/field"
+	"github.com/moov-io/iso8583/padding"
+	"github.com/moov-io/iso8583/prefix"
+	"github.com/moov-io/iso8583/sort"
+)
+
+// spec87 assigns the data elements as ISO 8583:1987 does. CVV2 and the
+// merchant postal code/website have no standard element and travel in the
+// private additional data (DE48). DE52 is variable (LL, up to 16 bytes)
+// rather than a fixed 8 bytes, so it carries format 4 (AES) PIN blocks as
+// well as format 0 ones.
+var spec87 *iso8583.MessageSpec = &iso8583.MessageSpec{
+	Name: "ISO 8583:1987 CardFlow Playground ASCII Specification",
+	Fields: map[int]field.Field{
+		0: field.NewString(&field.Spec{
+			Length:      4,
+			Description: "Message Type Indicator",
+			Enc:         encoding.ASCII,
+			Pref:        prefix.ASCII.Fixed,
+		}),
+		1: field.NewBitmap(&field.Spec{
+			Length:      8,
+			Description: "Bitmap",
+			Enc:         encoding.Binary,
+			Pref:        prefix.Binary.Fixed,
+		}),
+		2: field.NewString(&field.Spec{
+			Length:      19,
+			Description: "Primary Account Number (PAN)",
+			Enc:         encoding.ASCII,
+			Pref:        prefix.ASCII.LL,
+		}),
+		3: field.NewString(&field.Spec{
+			Length:      6,
+			Description: "Processing Code",
+			Enc:         encoding.ASCII,
+			Pref:        prefix.ASCII.Fixed,
+		}),
+		4: field.NewNumeric(&field.Spec{
+			Length:      12,
+			Description: "Amount, Transaction",
+			Enc:         encoding.ASCII,
+			Pref:        prefix.ASCII.Fixed,
+			Pad:         padding.Left('0'),
+		}),
+		7: field.NewString(&field.Spec{
+			Length:      10,
+			Description: "Transmission Date & Time (MMDDhhmmss)",
+			Enc:         encoding.ASCII,
+			Pref:        prefix.ASCII.Fixed,
+		}),
+		11: field.NewString(&field.Spec{
+			Length:      6,
+			Description: "Systems Trace Audit Number (STAN)",
+			Enc:         encoding.ASCII,
+			Pref:        prefix.ASCII.Fixed,
+		}),
+		12: field.NewString(&field.Spec{
+			Length:      6,
+			Description: "Time, Local Transaction (hhmmss)",
+			Enc:         encoding.ASCII,
+			Pref:        prefix.ASCII.Fixed,
+		}),
+		13: field.NewString(&field.Spec{
+			Length:      4,
+			Description: "Date, Local Transaction (MMDD)",
+			Enc:         encoding.ASCII,
+			Pref:        prefix.ASCII.Fixed,
+		}),
+		14: field.NewString(&field.Spec{
+			Length:      4,
+			Description: "Date, Expiration (YYMM)",
+			Enc:         encoding.ASCII,
+			Pref:        prefix.ASCII.Fixed,
+		}),
+		18: field.NewString(&field.Spec{
+			Length:      4,
+			Description: "Merchant Type (MCC)",
+			Enc:         encoding.ASCII,
+			Pref:        prefix.ASCII.Fixed,
+		}),
+		37: field.NewString(&field.Spec{
+			Length:      12,
+			Description: "Retrieval Reference Number",
+			Enc:         encoding.ASCII,
+			Pref:        prefix.ASCII.Fixed,
+		}),
+		38: field.NewString(&field.Spec{
+			Length:      6,
+			Description: "Authorization Identification Response",
+			Enc:         encoding.ASCII,
+			Pref:        prefix.ASCII.Fixed,
+		}),
+		39: field.NewString(&field.Spec{
+			Length:      2,
+			Description: "Response Code",
+			Enc:         encoding.ASCII,
+			Pref:        prefix.ASCII.Fixed,
+		}),
+		41: field.NewString(&field.Spec{
+			Length:      8,
+			Description: "Card Acceptor Terminal Identification",
+			Enc:         encoding.ASCII,
+			Pref:        prefix.ASCII.Fixed,
+			Pad:         padding.Right(' '),
+		}),
+		42: field.NewString(&field.Spec{
+			Length:      15,
+			Description: "Card Acceptor Identification Code",
+			Enc:         encoding.ASCII,
+			Pref:        prefix.ASCII.Fixed,
+			Pad:         padding.Right(' '),
+		}),
+		43: field.NewString(&field.Spec{
+			Length:      40,
+			Description: "Card Acceptor Name/Location",
+			Enc:         encoding.ASCII,
+			Pref:        prefix.ASCII.Fixed,
+		}),
+		48: field.NewComposite(&field.Spec{
+			Length:      999,
+			Description: "Additional Data - Private",
+			Pref:        prefix.ASCII.LLL,
+			Tag: &field.TagSpec{
+				Length: 2,
+				Enc:    encoding.ASCII,
+				Sort:   sort.StringsByInt,
+			},
+			Subfields: map[string]field.Field{
+				"01": field.NewString(&field.Spec{
+					Length:      4,
+					Description: "Card Verification Value 2 (CVV2)",
+					Enc:         encoding.ASCII,
+					Pref:        prefix.ASCII.LL,
+				}),
+				"02": field.NewString(&field.Spec{
+					Length:      10,
+					Description: "Merchant Postal Code",
+					Enc:         encoding.ASCII,
+					Pref:        prefix.ASCII.LL,
+				}),
+				"03": field.NewString(&field.Spec{
+					Length:      299,
+					Description: "Merchant Website",
+					Enc:         encoding.ASCII,
+					Pref:        prefix.ASCII.LLL,
+				}),
+			},
+		}),
+		49: field.NewString(&field.Spec{
+			Length:      3,
+			Description: "Currency Code, Transaction",
+			Enc:         encoding.ASCII,
+			Pref:        prefix.ASCII.Fixed,
+		}),
+		52: field.NewBinary(&field.Spec{
+			Length:      16,
+			Description: "Personal Identification Number Data",
+			Enc:         encoding.Binary,
+			Pref:        prefix.ASCII.LL,
+		}),
+		54: field.NewString(&field.Spec{
+			Length:      120,
+			Description: "Additional Amounts",
+			Enc:         encoding.ASCII,
+			Pref:        prefix.ASCII.LLL,
+		}),
+		70: field.NewString(&field.Spec{
+			Length:      3,
+			Description: "Network Management Information Code",
+			Enc:         encoding.ASCII,
+			Pref:        prefix.ASCII.Fixed,
+		}),
+		90: field.NewString(&field.Spec{
+			Length:      42,
+			Description: "Original Data Elements",
+			Enc:         encoding.ASCII,
+			Pref:        prefix.ASCII.Fixed,
+		}),
+	},
+}
+
+const (
+	// DE7 and DE13 carry no year
+	transmissionDateTimeLayout87 = "0102150405"
+	localTimeLayout87            = "150405"
+	localDateLayout87            = "0102"
+)
+
+type authorizationRequest87 struct {
+	MTI                  string            `index:"0"`
+	PrimaryAccountNumber string            `index:"2"`
+	ProcessingCode       string            `index:"3"`
+	Amount               int64             `index:"4"`
+	TransmissionDateTime string            `index:"7"`
+	STAN                 string            `index:"11"`
+	LocalTime            string            `index:"12"`
+	LocalDate            string            `index:"13"`
+	ExpirationDate       string            `index:"14"`
+	MCC                  string            `index:"18"`
+	RetrievalReference   string            `index:"37"`
+	AuthorizationCode    string            `index:"38"`
+	TerminalID           string            `index:"41"`
+	CardAcceptorID       string            `index:"42"`
+	AcceptorNameLocation string            `index:"43"`
+	AdditionalData       *additionalData87 `index:"48"`
+	Currency             string            `index:"49"`
+	PINData              string            `index:"52"`
+	OriginalDataElements string            `index:"90"`
+}
+
+type additionalData87 struct {
+	CardVerificationValue string `index:"01"`
+	PostalCode            string `index:"02"`
+	WebSite               string `index:"03"`
+}
+
+type authorizationResponse87 struct {
+	MTI               string `index:"0"`
+	STAN              string `index:"11"`
+	AuthorizationCode string `index:"38"`
+	ApprovalCode      string `index:"39"`
+	AdditionalAmounts string `index:"54"`
+}
+
+type networkManagementRequest87 struct {
+	MTI                   string `index:"0"`
+	TransmissionDateTime  string `index:"7"`
+	STAN                  string `index:"11"`
+	NetworkManagementCode string `index:"70"`
+}
+
+type networkManagementResponse87 struct {
+	MTI                   string `index:"0"`
+	STAN                  string `index:"11"`
+	ApprovalCode          string `index:"39"`
+	NetworkManagementCode string `index:"70"`
+}
+
+func marshal87(message *iso8583.Message, v any) error {
+	switch m := v.(type) {
+	case *AuthorizationRequest:
+		wire, err := toAuthorizationRequest87(m)
+		if err != nil {
+			return err
+		}
+		return message.Marshal(wire)
+	case *AuthorizationResponse:
+		return message.Marshal(&authorizationResponse87{
+			MTI:               m.MTI,
+			STAN:              m.STAN,
+			AuthorizationCode: m.AuthorizationCode,
+			ApprovalCode:      m.ApprovalCode,
+			AdditionalAmounts: m.AdditionalAmounts,
+		})
+	case *NetworkManagementRequest:
+		wire := &networkManagementRequest87{
+			MTI:                   m.MTI,
+			STAN:                  m.STAN,
+			NetworkManagementCode: m.NetworkManagementCode,
+		}
+		if m.TransmissionDateTime != "" {
+			transmittedAt, err := time.Parse(time.RFC3339, m.TransmissionDateTime)
+			if err != nil {
+				return fmt.Errorf("parsing transmission date time: %w", err)
+			}
+			wire.TransmissionDateTime = transmittedAt.UTC().Format(transmissionDateTimeLayout87)
+		}
+		return message.Marshal(wire)
+	case *NetworkManagementResponse:
+		return message.Marshal(&networkManagementResponse87{
+			MTI:                   m.MTI,
+			STAN:                  m.STAN,
+			ApprovalCode:          m.ApprovalCode,
+			NetworkManagementCode: m.NetworkManagementCode,
+		})
+	default:
+		return fmt.Errorf("%T is not supported by the ISO 8583:1987 spec", v)
+	}
+}
+
+func unmarshal87(message *iso8583.Message, v any) error {
+	switch m := v.(type) {
+	case *AuthorizationRequest:
+		wire := &authorizationRequest87{}
+		if err := message.Unmarshal(wire); err != nil {
+			return err
+		}
+		return fromAuthorizationRequest87(wire, m)
+	case *AuthorizationResponse:
+		wire := &authorizationResponse87{}
+		if err := message.Unmarshal(wire); err != nil {
+			return err
+		}
+		m.MTI = wire.MTI
+		m.STAN = wire.STAN
+		m.AuthorizationCode = wire.AuthorizationCode
+		m.ApprovalCode = wire.ApprovalCode
+		m.AdditionalAmounts = wire.AdditionalAmounts
+		return nil
+	case *NetworkManagementRequest:
+		wire := &networkManagementRequest87{}
+		if err := message.Unmarshal(wire); err != nil {
+			return err
+		}
+		m.MTI = wire.MTI
+		m.STAN = wire.STAN
+		m.NetworkManagementCode = wire.NetworkManagementCode
+		if wire.TransmissionDateTime != "" {
+			transmittedAt, err := parseTransmissionDateTime87(wire.TransmissionDateTime, time.Now().UTC())
+			if err != nil {
+				return err
+			}
+			m.TransmissionDateTime = transmittedAt.Format(time.RFC3339)
+		}
+		return nil
+	case *NetworkManagementResponse:
+		wire := &networkManagementResponse87{}
+		if err := message.Unmarshal(wire); err != nil {
+			return err
+		}
+		m.MTI = wire.MTI
+		m.STAN = wire.STAN
+		m.ApprovalCode = wire.ApprovalCode
+		m.NetworkManagementCode = wire.NetworkManagementCode
+		return nil
+	default:
+		return fmt.Errorf("%T is not supported by the ISO 8583:1987 spec", v)
+	}
+}
+
+func toAuthorizationRequest87(req *AuthorizationRequest) (*authorizationRequest87, error) {
+	wire := &authorizationRequest87{
+		MTI:                  req.MTI,
+		PrimaryAccountNumber: req.PrimaryAccountNumber,
+		ProcessingCode:       req.ProcessingCode,
+		Amount:               req.Amount,
+		STAN:                 req.STAN,
+		ExpirationDate:       req.ExpirationDate,
+		AuthorizationCode:    req.AuthorizationCode,
+		TerminalID:           req.TerminalID,
+		CardAcceptorID:       req.CardAcceptorID,
+		RetrievalReference:   req.RetrievalReferenceNumber,
+		OriginalDataElements: req.OriginalDataElements,
+		PINData:              req.PINBlock,
+	}
+	if wire.ProcessingCode == "" {
+		wire.ProcessingCode = ProcessingCodePurchase
+	}
+
+	if req.Currency != "" {
+		numeric, err := currency.Numeric(req.Currency)
+		if err != nil {
+			return nil, err
+		}
+		wire.Currency = numeric
+	}
+
+	if req.TransmissionDateTime != "" {
+		transmittedAt, err := time.Parse(time.RFC3339, req.TransmissionDateTime)
+		if err != nil {
+			return nil, fmt.Errorf("parsing transmission date time: %w", err)
+		}
+		wire.TransmissionDateTime = transmittedAt.UTC().Format(transmissionDateTimeLayout87)
+		wire.LocalTime = transmittedAt.Local().Format(localTimeLayout87)
+		wire.LocalDate = transmittedAt.Local().Format(localDateLayout87)
+	}
+
+	// DE52 holds up to 16 bytes: format 0 (8) and format 4 (16) PIN blocks
+	if len(req.PINBlock) > 32 {
+		return nil, fmt.Errorf("PIN block of %d bytes does not fit DE52", len(req.PINBlock)/2)
+	}
+
+	if req.CardVerificationValue != "" {
+		wire.AdditionalData = &additionalData87{CardVerificationValue: req.CardVerificationValue}
+	}
+
+	if info := req.AcceptorInformation; info != nil {
+		wire.MCC = info.MCC
+		// name (25) + city (13) + country code (2); we only know the name
+		wire.AcceptorNameLocation = fmt.Sprintf("%-25.25s%-13s%-2s", info.Name, "", "")
+		if info.PostalCode != "" || info.WebSite != "" {
+			if wire.AdditionalData == nil {
+				wire.AdditionalData = &additionalData87{}
+			}
+			wire.AdditionalData.PostalCode = info.PostalCode
+			wire.AdditionalData.WebSite = info.WebSite
+		}
+	}
+
+	return wire, nil
+}
+
+func fromAuthorizationRequest87(wire *authorizationRequest87, req *AuthorizationRequest) error {
+	req.MTI = wire.MTI
+	req.PrimaryAccountNumber = wire.PrimaryAccountNumber
+	req.Amount = wire.Amount
+	req.STAN = wire.STAN
+	req.ExpirationDate = wire.ExpirationDate
+	req.AuthorizationCode = wire.AuthorizationCode
+	req.ProcessingCode = wire.ProcessingCode
+	req.TerminalID = wire.TerminalID
+	req.CardAcceptorID = wire.CardAcceptorID
+	req.RetrievalReferenceNumber = wire.RetrievalReference
+	req.OriginalDataElements = wire.OriginalDataElements
+	req.PINBlock = strings.ToUpper(wire.PINData)
+
+	if wire.Currency != "" {
+		alpha, err := currency.Alpha(wire.Currency)
+		if err != nil {
+			return err
+		}
+		req.Currency = alpha
+	}
+
+	if wire.TransmissionDateTime != "" {
+		transmittedAt, err := parseTransmissionDateTime87(wire.TransmissionDateTime, time.Now().UTC())
+		if err != nil {
+			return err
+		}
+		req.TransmissionDateTime = transmittedAt.Format(time.RFC3339)
+	}
+
+	info := &AcceptorInformation{MCC: wire.MCC}
+	if len(wire.AcceptorNameLocation) >= 25 {
+		info.Name = strings.TrimSpace(wire.AcceptorNameLocation[:25])
+	} else {
+		info.Name = strings.TrimSpace(wire.AcceptorNameLocation)
+	}
+	if wire.AdditionalData != nil {
+		req.CardVerificationValue = wire.AdditionalData.CardVerificationValue
+		info.PostalCode = wire.AdditionalData.PostalCode
+		info.WebSite = wire.AdditionalData.WebSite
+	}
+	req.AcceptorInformation = info
+
+	return nil
+}
+
+// parseTransmissionDateTime87 restores the year DE7 does not carry: the
+// transmission happened within the last year relative to now.
+func parseTransmissionDateTime87(value string, now time.Time) (time.Time, error) {
+	t, err := time.Parse(transmissionDateTimeLayout87, value)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("parsing transmission date time: %w", err)
+	}
+
+	t = t.AddDate(now.Year()-t.Year(), 0, 0)
+	// allow for clock skew between the parties around new year
+	if t.After(now.Add(24 * time.Hour)) {
+		t = t.AddDate(-1, 0, 0)
+	}
+
+	return t, nil
+}
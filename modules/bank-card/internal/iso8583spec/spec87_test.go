@@ -0,0 +1,124 @@
+package iso8583spec
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSpecISO87_AuthorizationRequestRoundTrip(t *testing.T) {
+	transmittedAt := time.Now().UTC().Add(-time.Hour).Truncate(time.Second)
+
+	req := &AuthorizationRequest{
+		MTI:                      "0100",
+		PrimaryAccountNumber:     "4212340000000006",
+		Amount:                   1_234_567_89, // does not fit the playground 6 digit amount
+		TransmissionDateTime:     transmittedAt.Format(time.RFC3339),
+		Currency:                 "USD",
+		CardVerificationValue:    "123",
+		ExpirationDate:           "2812",
+		STAN:                     "000042",
+		ProcessingCode:           ProcessingCodePurchase,
+		TerminalID:               "T0000001",
+		CardAcceptorID:           "M12345",
+		RetrievalReferenceNumber: "601412000042",
+		OriginalDataElements:     "0100000041" + transmittedAt.Format("0102150405") + "0000000000000000000000",
+		AcceptorInformation: &AcceptorInformation{
+			MCC:        "5411",
+			Name:       "Demo Merchant",
+			PostalCode: "12345",
+			WebSite:    "https://demo.merchant.com",
+		},
+	}
+
+	message := SpecISO87.NewMessage()
+	require.NoError(t, SpecISO87.Marshal(message, req))
+
+	packed, err := message.Pack()
+	require.NoError(t, err)
+
+	received := SpecISO87.NewMessage()
+	require.NoError(t, received.Unpack(packed))
+
+	// standard data elements are where ISO 8583:1987 puts them
+	currency, err := received.GetString(49)
+	require.NoError(t, err)
+	require.Equal(t, "840", currency)
+
+	expiry, err := received.GetString(14)
+	require.NoError(t, err)
+	require.Equal(t, "2812", expiry)
+
+	processingCode, err := received.GetString(3)
+	require.NoError(t, err)
+	require.Equal(t, ProcessingCodePurchase, processingCode)
+
+	terminalID, err := received.GetString(41)
+	require.NoError(t, err)
+	require.Equal(t, "T0000001", terminalID)
+
+	rrn, err := received.GetString(37)
+	require.NoError(t, err)
+	require.Equal(t, "601412000042", rrn)
+
+	got := &AuthorizationRequest{}
+	require.NoError(t, SpecISO87.Unmarshal(received, got))
+	require.Equal(t, req, got)
+}
+
+func TestSpecISO87_AuthorizationResponseRoundTrip(t *testing.T) {
+	resp := &AuthorizationResponse{
+		MTI:               "0110",
+		STAN:              "000042",
+		ApprovalCode:      "00",
+		AuthorizationCode: "A1B2C3",
+	}
+
+	message := SpecISO87.NewMessage()
+	require.NoError(t, SpecISO87.Marshal(message, resp))
+
+	packed, err := message.Pack()
+	require.NoError(t, err)
+
+	received := SpecISO87.NewMessage()
+	require.NoError(t, received.Unpack(packed))
+
+	got := &AuthorizationResponse{}
+	require.NoError(t, SpecISO87.Unmarshal(received, got))
+	require.Equal(t, resp, got)
+}
+
+func TestParseTransmissionDateTime87_YearRollover(t *testing.T) {
+	now := time.Date(2026, time.January, 1, 0, 5, 0, 0, time.UTC)
+
+	got, err := parseTransmissionDateTime87("1231235959", now)
+	require.NoError(t, err)
+	require.Equal(t, time.Date(2025, time.December, 31, 23, 59, 59, 0, time.UTC), got)
+}
+
+func TestSpecByName(t *testing.T) {
+	spec, err := SpecByName("")
+	require.NoError(t, err)
+	require.Equal(t, SpecPlayground, spec)
+
+	spec, err = SpecByName("iso87")
+	require.NoError(t, err)
+	require.Equal(t, SpecISO87, spec)
+
+	_, err = SpecByName("iso93")
+	require.Error(t, err)
+}
+
+func TestParseOriginalDataElements(t *testing.T) {
+	now := time.Date(2026, time.October, 16, 12, 0, 0, 0, time.UTC)
+
+	mti, stan, transmittedAt, err := ParseOriginalDataElements("0100000042101611300500000000000000000000000", now)
+	require.NoError(t, err)
+	require.Equal(t, "0100", mti)
+	require.Equal(t, "000042", stan)
+	require.Equal(t, time.Date(2026, time.October, 16, 11, 30, 5, 0, time.UTC), transmittedAt)
+
+	_, _, _, err = ParseOriginalDataElements("0100000042", now)
+	require.Error(t, err)
+}
@@ -0,0 +1,40 @@
+package iso8583spec
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSpecPlayground_CardVerificationValue(t *testing.T) {
+	for _, cvv := range []string{"123", "1234"} {
+		req := &AuthorizationRequest{
+			MTI:                   "0100",
+			PrimaryAccountNumber:  "4212340000000006",
+			Amount:                10_00,
+			Currency:              "USD",
+			CardVerificationValue: cvv,
+			ExpirationDate:        "2812",
+			STAN:                  "000042",
+		}
+
+		message := SpecPlayground.NewMessage()
+		require.NoError(t, SpecPlayground.Marshal(message, req))
+
+		packed, err := message.Pack()
+		require.NoError(t, err)
+
+		received := SpecPlayground.NewMessage()
+		require.NoError(t, received.Unpack(packed))
+
+		// the length goes on the wire in front of the CVV
+		raw, err := received.GetField(8).Pack()
+		require.NoError(t, err)
+		require.Equal(t, fmt.Sprintf("%02d%s", len(cvv), cvv), string(raw))
+
+		got := &AuthorizationRequest{}
+		require.NoError(t, SpecPlayground.Unmarshal(received, got))
+		require.Equal(t, cvv, got.CardVerificationValue)
+	}
+}
@@ -0,0 +1,69 @@
+package keys
+
+import "crypto/cipher"
+
+// CMAC computes the CMAC (NIST SP 800-38B) of msg with a 64 or 128 bit
+// block cipher: TDES-CMAC or AES-CMAC.
+func CMAC(block cipher.Block, msg []byte) []byte {
+	size := block.BlockSize()
+	k1, k2 := cmacSubkeys(block)
+
+	// the last block is XOR'ed with K1 when complete, padded with 10..0 and
+	// XOR'ed with K2 otherwise
+	n := (len(msg) + size - 1) / size
+	if n == 0 {
+		n = 1
+	}
+	last := make([]byte, size)
+	rest := msg[(n-1)*size:]
+	if len(rest) == size {
+		xorBytes(last, rest, k1)
+	} else {
+		copy(last, rest)
+		last[len(rest)] = 0x80
+		xorBytes(last, last, k2)
+	}
+
+	mac := make([]byte, size)
+	for i := 0; i < n-1; i++ {
+		xorBytes(mac, mac, msg[i*size:(i+1)*size])
+		block.Encrypt(mac, mac)
+	}
+	xorBytes(mac, mac, last)
+	block.Encrypt(mac, mac)
+	return mac
+}
+
+// cmacSubkeys derives K1 and K2 by doubling the encrypted zero block in
+// GF(2^64) or GF(2^128).
+func cmacSubkeys(block cipher.Block) ([]byte, []byte) {
+	size := block.BlockSize()
+	rb := byte(0x87)
+	if size == 8 {
+		rb = 0x1b
+	}
+	l := make([]byte, size)
+	block.Encrypt(l, l)
+	k1 := shiftLeft(l, rb)
+	k2 := shiftLeft(k1, rb)
+	return k1, k2
+}
+
+func shiftLeft(b []byte, rb byte) []byte {
+	out := make([]byte, len(b))
+	var carry byte
+	for i := len(b) - 1; i >= 0; i-- {
+		out[i] = b[i]<<1 | carry
+		carry = b[i] >> 7
+	}
+	if b[0]&0x80 != 0 {
+		out[len(out)-1] ^= rb
+	}
+	return out
+}
+
+func xorBytes(dst, a, b []byte) {
+	for i := range dst {
+		dst[i] = a[i] ^ b[i]
+	}
+}
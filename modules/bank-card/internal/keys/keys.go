@@ -0,0 +1,239 @@
+// Package keys holds the cryptographic keys of the issuer and the acquirer:
+// a store of typed, versioned keys encrypted at rest under a local master
+// key.
+//
+// Every key has a purpose (what it may be used for), an algorithm, a
+// version and a state. Versions of a purpose are numbered from 1 in the
+// order they are imported; the active key of a purpose is its highest
+// active version. Retired keys are kept so data protected by them can still
+// be verified or decrypted, but are never picked as the active key.
+//
+// Keys are identified to people by their key check value (KCV), computed
+// the standard way for the algorithm:
+//
+//	TDES  the first 3 bytes of the key encrypting a block of zeros
+//	AES   the first 5 bytes of the AES-CMAC of a block of zeros (X9.24-1)
+//	HMAC  the first 3 bytes of the HMAC-SHA256 of a block of zeros
+//
+// Clear keys enter the store as components: two or more random values of
+// the key's length held by different custodians, XOR'ed into the key.
+package keys
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/des"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Purpose is what a key may be used for.
+type Purpose string
+
+const (
+	// PurposeCVK derives card verification values (CVV, CVV2, iCVV, dCVV).
+	PurposeCVK Purpose = "CVK"
+	// PurposePVK derives PIN verification values.
+	PurposePVK Purpose = "PVK"
+	// PurposeZPK encrypts the PIN blocks exchanged with the acquirer.
+	PurposeZPK Purpose = "ZPK"
+	// PurposeZMK encrypts other keys exchanged with a partner.
+	PurposeZMK Purpose = "ZMK"
+	// PurposePANPepper keys the HMAC PANs are looked up by.
+	PurposePANPepper Purpose = "PAN_PEPPER"
+	// PurposeDEK encrypts data at rest, such as PANs.
+	PurposeDEK Purpose = "DEK"
+)
+
+// Algorithm is the algorithm a key is for.
+type Algorithm string
+
+const (
+	// AlgorithmTDES is a double (16 bytes) or triple (24 bytes) length DES key.
+	AlgorithmTDES Algorithm = "TDES"
+	// AlgorithmAES is a 128, 192 or 256 bit AES key.
+	AlgorithmAES Algorithm = "AES"
+	// AlgorithmHMAC is an HMAC-SHA256 key of any length.
+	AlgorithmHMAC Algorithm = "HMAC"
+)
+
+// purposeAlgorithms lists the algorithms each purpose may have.
+var purposeAlgorithms = map[Purpose][]Algorithm{
+	// the demo CVV provider derives CVVs with HMAC
+	PurposeCVK:       {AlgorithmTDES, AlgorithmHMAC},
+	PurposePVK:       {AlgorithmTDES},
+	PurposeZPK:       {AlgorithmTDES, AlgorithmAES},
+	PurposeZMK:       {AlgorithmTDES, AlgorithmAES},
+	PurposePANPepper: {AlgorithmHMAC},
+	PurposeDEK:       {AlgorithmAES},
+}
+
+// State tells whether a key is in use.
+type State string
+
+const (
+	// StateActive keys protect new data.
+	StateActive State = "active"
+	// StateRetired keys only verify or decrypt what they protected before.
+	StateRetired State = "retired"
+)
+
+var (
+	// ErrNotFound is returned when the store has no key of the purpose and version.
+	ErrNotFound = errors.New("key not found")
+	// ErrInvalidKey is returned for key material that does not suit the
+	// algorithm, or an algorithm that does not suit the purpose.
+	ErrInvalidKey = errors.New("invalid key")
+	// ErrKCVMismatch is returned when a key or component does not have the
+	// expected check value.
+	ErrKCVMismatch = errors.New("key check value does not match")
+)
+
+// Key is a version of a key of the store. Its material never leaves the
+// store in JSON.
+type Key struct {
+	Purpose   Purpose
+	Version   int
+	Algorithm Algorithm
+	State     State
+	KCV       string
+	CreatedAt time.Time
+
+	material []byte
+}
+
+// Material returns a copy of the clear key.
+func (k *Key) Material() []byte {
+	return append([]byte(nil), k.material...)
+}
+
+// String identifies the key without its material, e.g. "CVK v2 (TDES, KCV 08D7B4)".
+func (k *Key) String() string {
+	return fmt.Sprintf("%s v%d (%s, KCV %s)", k.Purpose, k.Version, k.Algorithm, k.KCV)
+}
+
+// ParsePurpose returns the purpose with the given name, in any case.
+func ParsePurpose(name string) (Purpose, error) {
+	p := Purpose(strings.ToUpper(name))
+	if _, ok := purposeAlgorithms[p]; !ok {
+		return "", fmt.Errorf("unknown key purpose %q", name)
+	}
+	return p, nil
+}
+
+// ParseAlgorithm returns the algorithm with the given name, in any case.
+func ParseAlgorithm(name string) (Algorithm, error) {
+	a := Algorithm(strings.ToUpper(name))
+	switch a {
+	case AlgorithmTDES, AlgorithmAES, AlgorithmHMAC:
+		return a, nil
+	}
+	return "", fmt.Errorf("unknown key algorithm %q", name)
+}
+
+// Validate checks that the material suits the algorithm and the algorithm
+// suits the purpose.
+func Validate(purpose Purpose, alg Algorithm, material []byte) error {
+	allowed, ok := purposeAlgorithms[purpose]
+	if !ok {
+		return fmt.Errorf("unknown key purpose %q: %w", purpose, ErrInvalidKey)
+	}
+	suits := false
+	for _, a := range allowed {
+		suits = suits || a == alg
+	}
+	if !suits {
+		return fmt.Errorf("%s keys cannot be %s: %w", purpose, alg, ErrInvalidKey)
+	}
+	switch n := len(material); alg {
+	case AlgorithmTDES:
+		if n != 16 && n != 24 {
+			return fmt.Errorf("TDES keys are 16 or 24 bytes (got %d): %w", n, ErrInvalidKey)
+		}
+	case AlgorithmAES:
+		if n != 16 && n != 24 && n != 32 {
+			return fmt.Errorf("AES keys are 16, 24 or 32 bytes (got %d): %w", n, ErrInvalidKey)
+		}
+	case AlgorithmHMAC:
+		if n == 0 {
+			return fmt.Errorf("HMAC keys cannot be empty: %w", ErrInvalidKey)
+		}
+	}
+	return nil
+}
+
+// KCV computes the key check value of a key of the algorithm, in upper case hex.
+func KCV(alg Algorithm, material []byte) (string, error) {
+	var kcv []byte
+	switch alg {
+	case AlgorithmTDES:
+		block, err := NewTripleDES(material)
+		if err != nil {
+			return "", err
+		}
+		kcv = make([]byte, des.BlockSize)
+		block.Encrypt(kcv, kcv)
+		kcv = kcv[:3]
+	case AlgorithmAES:
+		block, err := aes.NewCipher(material)
+		if err != nil {
+			return "", fmt.Errorf("%v: %w", err, ErrInvalidKey)
+		}
+		kcv = CMAC(block, make([]byte, aes.BlockSize))[:5]
+	case AlgorithmHMAC:
+		mac := hmac.New(sha256.New, material)
+		mac.Write(make([]byte, 16))
+		kcv = mac.Sum(nil)[:3]
+	default:
+		return "", fmt.Errorf("unknown key algorithm %q: %w", alg, ErrInvalidKey)
+	}
+	return strings.ToUpper(hex.EncodeToString(kcv)), nil
+}
+
+// CheckKCV compares the check value of a key with the expected one, in any case.
+func CheckKCV(alg Algorithm, material []byte, expected string) error {
+	kcv, err := KCV(alg, material)
+	if err != nil {
+		return err
+	}
+	if !strings.EqualFold(kcv, expected) {
+		return fmt.Errorf("got %s, want %s: %w", kcv, strings.ToUpper(expected), ErrKCVMismatch)
+	}
+	return nil
+}
+
+// CombineComponents XORs the clear components of a key into the key. It
+// takes at least two components, all of the same length.
+func CombineComponents(components ...[]byte) ([]byte, error) {
+	if len(components) < 2 {
+		return nil, fmt.Errorf("a key takes at least 2 components (got %d): %w", len(components), ErrInvalidKey)
+	}
+	key := make([]byte, len(components[0]))
+	for i, c := range components {
+		if len(c) != len(key) {
+			return nil, fmt.Errorf("component %d is %d bytes, component 1 is %d: %w", i+1, len(c), len(key), ErrInvalidKey)
+		}
+		for j := range key {
+			key[j] ^= c[j]
+		}
+	}
+	return key, nil
+}
+
+// NewTripleDES returns a TDES cipher of a double or triple length key; a
+// double length key K1K2 is used as K1K2K1.
+func NewTripleDES(key []byte) (cipher.Block, error) {
+	switch len(key) {
+	case 16:
+		key = append(append([]byte{}, key...), key[:8]...)
+	case 24:
+	default:
+		return nil, fmt.Errorf("TDES keys are 16 or 24 bytes (got %d): %w", len(key), ErrInvalidKey)
+	}
+	return des.NewTripleDESCipher(key)
+}
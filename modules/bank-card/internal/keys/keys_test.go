@@ -0,0 +1,164 @@
+package keys
+
+import (
+	"bytes"
+	"crypto/aes"
+	"encoding/hex"
+	"errors"
+	"path/filepath"
+	"testing"
+)
+
+func mustHex(t *testing.T, s string) []byte {
+	t.Helper()
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		t.Fatalf("hex %q: %v", s, err)
+	}
+	return b
+}
+
+func TestKCV(t *testing.T) {
+	for _, tc := range []struct {
+		alg  Algorithm
+		key  string
+		want string
+	}{
+		{AlgorithmTDES, "0123456789ABCDEFFEDCBA9876543210", "08D7B4"},
+		{AlgorithmTDES, "0123456789ABCDEFFEDCBA98765432100123456789ABCDEF", "08D7B4"},
+		// AES-CMAC of a zero block, leftmost 5 bytes
+		{AlgorithmAES, "2b7e151628aed2a6abf7158809cf4f3c", "7AD386C376"},
+		{AlgorithmAES, "000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f", "377822C093"},
+	} {
+		got, err := KCV(tc.alg, mustHex(t, tc.key))
+		if err != nil || got != tc.want {
+			t.Fatalf("KCV %s %s got %s, %v want %s", tc.alg, tc.key, got, err, tc.want)
+		}
+	}
+
+	if kcv, err := KCV(AlgorithmHMAC, []byte("dev-secret-pepper")); err != nil || len(kcv) != 6 {
+		t.Fatalf("HMAC KCV %q, %v", kcv, err)
+	}
+	if err := CheckKCV(AlgorithmTDES, mustHex(t, "0123456789ABCDEFFEDCBA9876543210"), "08d7b5"); !errors.Is(err, ErrKCVMismatch) {
+		t.Fatalf("wrong KCV: %v", err)
+	}
+}
+
+func TestCMAC(t *testing.T) {
+	aesBlock, _ := aes.NewCipher(mustHex(t, "2b7e151628aed2a6abf7158809cf4f3c"))
+	tdesBlock, _ := NewTripleDES(mustHex(t, "0123456789ABCDEFFEDCBA9876543210"))
+	for _, tc := range []struct {
+		name string
+		mac  []byte
+		want string
+	}{
+		// RFC 4493 examples 1 and 2
+		{"aes empty", CMAC(aesBlock, nil), "bb1d6929e95937287fa37d129b756746"},
+		{"aes one block", CMAC(aesBlock, mustHex(t, "6bc1bee22e409f96e93d7e117393172a")), "070a16b46b4d4144f79bdd9dd04a287c"},
+		{"tdes one block", CMAC(tdesBlock, make([]byte, 16)), "b795e96bf195e5f6"},
+		{"tdes padded", CMAC(tdesBlock, mustHex(t, "6bc1bee22e409f96e93d7e117393172aae2d8a57")), "18d864160c494386"},
+	} {
+		if got := hex.EncodeToString(tc.mac); got != tc.want {
+			t.Fatalf("%s: got %s want %s", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestCombineComponents(t *testing.T) {
+	key, err := CombineComponents(
+		mustHex(t, "0123456789ABCDEF0123456789ABCDEF"),
+		mustHex(t, "00000000000000000000000000000000"),
+		mustHex(t, "0000000000000000FFFFFFFFFFFFFFFF"),
+	)
+	if err != nil {
+		t.Fatalf("combine: %v", err)
+	}
+	if got := hex.EncodeToString(key); got != "0123456789abcdeffedcba9876543210" {
+		t.Fatalf("got %s", got)
+	}
+
+	if _, err := CombineComponents(mustHex(t, "0123456789ABCDEF")); !errors.Is(err, ErrInvalidKey) {
+		t.Fatalf("one component: %v", err)
+	}
+	if _, err := CombineComponents(mustHex(t, "0123456789ABCDEF"), mustHex(t, "01")); !errors.Is(err, ErrInvalidKey) {
+		t.Fatalf("components of different lengths: %v", err)
+	}
+}
+
+func TestStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "keys.json")
+	master := bytes.Repeat([]byte{0x42}, 32)
+
+	s, err := Open(path, master)
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	if _, err := s.Active(PurposeCVK); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("empty store: %v", err)
+	}
+
+	v1, err := s.ImportComponents(PurposeCVK, AlgorithmTDES,
+		mustHex(t, "0123456789ABCDEF0123456789ABCDEF"),
+		mustHex(t, "0000000000000000FFFFFFFFFFFFFFFF"))
+	if err != nil {
+		t.Fatalf("import v1: %v", err)
+	}
+	if v1.Version != 1 || v1.State != StateActive || v1.KCV != "08D7B4" {
+		t.Fatalf("v1: %s %s", v1, v1.State)
+	}
+	v2, err := s.Import(PurposeCVK, AlgorithmTDES, mustHex(t, "89ABCDEF0123456776543210FEDCBA98"))
+	if err != nil || v2.Version != 2 {
+		t.Fatalf("import v2: %v, %v", v2, err)
+	}
+	if _, err := s.Import(PurposeDEK, AlgorithmTDES, mustHex(t, "0123456789ABCDEFFEDCBA9876543210")); !errors.Is(err, ErrInvalidKey) {
+		t.Fatalf("TDES DEK: %v", err)
+	}
+	if _, err := s.Import(PurposeDEK, AlgorithmAES, bytes.Repeat([]byte{7}, 32)); err != nil {
+		t.Fatalf("import DEK: %v", err)
+	}
+
+	active, _ := s.Active(PurposeCVK)
+	if active.Version != 2 {
+		t.Fatalf("active %s", active)
+	}
+	if err := s.Retire(PurposeCVK, 2); err != nil {
+		t.Fatalf("retire: %v", err)
+	}
+
+	dek, _ := s.Active(PurposeDEK)
+	token, err := Seal(dek, []byte("4111111111111111"), []byte("card-1"))
+	if err != nil {
+		t.Fatalf("seal: %v", err)
+	}
+
+	// everything survives reopening the file
+	s, err = Open(path, master)
+	if err != nil {
+		t.Fatalf("reopen: %v", err)
+	}
+	active, _ = s.Active(PurposeCVK)
+	if active.Version != 1 || !bytes.Equal(active.Material(), mustHex(t, "0123456789ABCDEFFEDCBA9876543210")) {
+		t.Fatalf("active after retiring v2: %s", active)
+	}
+	if retired, err := s.Get(PurposeCVK, 2); err != nil || retired.State != StateRetired {
+		t.Fatalf("v2 after reopening: %v, %v", retired, err)
+	}
+	if _, err := s.Get(PurposeCVK, 3); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("v3: %v", err)
+	}
+	if len(s.List()) != 3 {
+		t.Fatalf("list: %v", s.List())
+	}
+
+	pan, err := s.Unseal(token, []byte("card-1"))
+	if err != nil || string(pan) != "4111111111111111" {
+		t.Fatalf("unseal: %q, %v", pan, err)
+	}
+	if _, err := s.Unseal(token, []byte("card-2")); err == nil {
+		t.Fatalf("unsealed with another aad")
+	}
+
+	if _, err := Open(path, bytes.Repeat([]byte{0x43}, 32)); !errors.Is(err, ErrKCVMismatch) {
+		t.Fatalf("wrong master key: %v", err)
+	}
+}
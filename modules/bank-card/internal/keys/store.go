@@ -0,0 +1,362 @@
+package keys
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MasterKeyEnv names the environment variable holding the master key in hex.
+const MasterKeyEnv = "KEYS_MASTER_KEY"
+
+// Store holds the keys by purpose and version. A store opened from a file
+// writes every change back to it, each key encrypted with AES-256-GCM under
+// the master key; a memory store is lost with the process.
+type Store struct {
+	mu        sync.RWMutex
+	path      string
+	master    cipher.AEAD
+	masterKCV string
+	// keys holds the versions of each purpose, version 1 first
+	keys map[Purpose][]*Key
+}
+
+// storeFile is the JSON the store is kept in.
+type storeFile struct {
+	// MasterKCV tells a wrong master key from a corrupt file
+	MasterKCV string      `json:"master_kcv"`
+	Keys      []storedKey `json:"keys"`
+}
+
+type storedKey struct {
+	Purpose   Purpose   `json:"purpose"`
+	Version   int       `json:"version"`
+	Algorithm Algorithm `json:"algorithm"`
+	State     State     `json:"state"`
+	KCV       string    `json:"kcv"`
+	CreatedAt time.Time `json:"created_at"`
+	// Material is the nonce and the AES-GCM ciphertext of the key, base64
+	Material string `json:"material"`
+}
+
+// NewStore returns an empty store kept in memory only.
+func NewStore() *Store {
+	return &Store{keys: make(map[Purpose][]*Key)}
+}
+
+// MasterKeyFromEnv returns the master key from KEYS_MASTER_KEY.
+func MasterKeyFromEnv() ([]byte, error) {
+	value := os.Getenv(MasterKeyEnv)
+	if value == "" {
+		return nil, fmt.Errorf("%s is not set", MasterKeyEnv)
+	}
+	master, err := hex.DecodeString(value)
+	if err != nil {
+		return nil, fmt.Errorf("%s is not hex: %w", MasterKeyEnv, err)
+	}
+	return master, nil
+}
+
+// Open opens the store kept in the file at path with the 32 byte master key.
+// A missing file is an empty store, created on the first change.
+func Open(path string, master []byte) (*Store, error) {
+	if len(master) != 32 {
+		return nil, fmt.Errorf("the master key is 32 bytes (got %d): %w", len(master), ErrInvalidKey)
+	}
+	block, err := aes.NewCipher(master)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	masterKCV, err := KCV(AlgorithmAES, master)
+	if err != nil {
+		return nil, err
+	}
+	s := &Store{path: path, master: aead, masterKCV: masterKCV, keys: make(map[Purpose][]*Key)}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var file storeFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("reading %s: %w", path, err)
+	}
+	if file.MasterKCV != masterKCV {
+		return nil, fmt.Errorf("the master key of %s has KCV %s, not %s: %w", path, file.MasterKCV, masterKCV, ErrKCVMismatch)
+	}
+	for _, stored := range file.Keys {
+		key, err := s.decrypt(stored)
+		if err != nil {
+			return nil, fmt.Errorf("reading %s v%d: %w", stored.Purpose, stored.Version, err)
+		}
+		s.keys[key.Purpose] = append(s.keys[key.Purpose], key)
+	}
+	for purpose, versions := range s.keys {
+		sort.Slice(versions, func(i, j int) bool { return versions[i].Version < versions[j].Version })
+		for i, key := range versions {
+			if key.Version != i+1 {
+				return nil, fmt.Errorf("reading %s: %s v%d is missing", path, purpose, i+1)
+			}
+		}
+	}
+	return s, nil
+}
+
+// Import adds the clear key as the next version of the purpose, active.
+func (s *Store) Import(purpose Purpose, alg Algorithm, material []byte) (*Key, error) {
+	if err := Validate(purpose, alg, material); err != nil {
+		return nil, err
+	}
+	kcv, err := KCV(alg, material)
+	if err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := &Key{
+		Purpose:   purpose,
+		Version:   len(s.keys[purpose]) + 1,
+		Algorithm: alg,
+		State:     StateActive,
+		KCV:       kcv,
+		CreatedAt: time.Now().UTC(),
+		material:  append([]byte(nil), material...),
+	}
+	s.keys[purpose] = append(s.keys[purpose], key)
+	if err := s.save(); err != nil {
+		s.keys[purpose] = s.keys[purpose][:key.Version-1]
+		return nil, err
+	}
+	copied := *key
+	return &copied, nil
+}
+
+// ImportComponents XORs the clear components into a key and imports it.
+func (s *Store) ImportComponents(purpose Purpose, alg Algorithm, components ...[]byte) (*Key, error) {
+	material, err := CombineComponents(components...)
+	if err != nil {
+		return nil, err
+	}
+	return s.Import(purpose, alg, material)
+}
+
+// Get returns the key of the purpose and version; version 0 is the active key.
+func (s *Store) Get(purpose Purpose, version int) (*Key, error) {
+	if version == 0 {
+		return s.Active(purpose)
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	versions := s.keys[purpose]
+	if version < 0 || version > len(versions) {
+		return nil, fmt.Errorf("%s v%d: %w", purpose, version, ErrNotFound)
+	}
+	copied := *versions[version-1]
+	return &copied, nil
+}
+
+// Active returns the highest active version of the purpose.
+func (s *Store) Active(purpose Purpose) (*Key, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	versions := s.keys[purpose]
+	for i := len(versions) - 1; i >= 0; i-- {
+		if versions[i].State == StateActive {
+			copied := *versions[i]
+			return &copied, nil
+		}
+	}
+	return nil, fmt.Errorf("no active %s: %w", purpose, ErrNotFound)
+}
+
+// Retire stops a key version from being the active one. It stays in the
+// store to verify or decrypt what it protected.
+func (s *Store) Retire(purpose Purpose, version int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	versions := s.keys[purpose]
+	if version < 1 || version > len(versions) {
+		return fmt.Errorf("%s v%d: %w", purpose, version, ErrNotFound)
+	}
+	key := versions[version-1]
+	previous := key.State
+	key.State = StateRetired
+	if err := s.save(); err != nil {
+		key.State = previous
+		return err
+	}
+	return nil
+}
+
+// List returns every key of the store by purpose and version.
+func (s *Store) List() []*Key {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var out []*Key
+	for _, versions := range s.keys {
+		for _, key := range versions {
+			copied := *key
+			out = append(out, &copied)
+		}
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Purpose != out[j].Purpose {
+			return out[i].Purpose < out[j].Purpose
+		}
+		return out[i].Version < out[j].Version
+	})
+	return out
+}
+
+// Seal encrypts plaintext with AES-GCM under the key, binding aad to it.
+// The token names the key version, so Store.Unseal finds the key after it
+// was retired: "DEK:3:<nonce and ciphertext, base64>".
+func Seal(key *Key, plaintext, aad []byte) (string, error) {
+	aead, err := newAEAD(key)
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	sealed := aead.Seal(nonce, nonce, plaintext, aad)
+	return fmt.Sprintf("%s:%d:%s", key.Purpose, key.Version, base64.StdEncoding.EncodeToString(sealed)), nil
+}
+
+// Unseal decrypts a token of Seal with the key version it names.
+func (s *Store) Unseal(token string, aad []byte) ([]byte, error) {
+	parts := strings.SplitN(token, ":", 3)
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("malformed sealed token")
+	}
+	version, err := strconv.Atoi(parts[1])
+	if err != nil || version < 1 {
+		return nil, fmt.Errorf("malformed sealed token version %q", parts[1])
+	}
+	key, err := s.Get(Purpose(parts[0]), version)
+	if err != nil {
+		return nil, err
+	}
+	sealed, err := base64.StdEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("malformed sealed token: %w", err)
+	}
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) < aead.NonceSize() {
+		return nil, fmt.Errorf("malformed sealed token")
+	}
+	return aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], aad)
+}
+
+func newAEAD(key *Key) (cipher.AEAD, error) {
+	if key.Algorithm != AlgorithmAES {
+		return nil, fmt.Errorf("%s cannot seal data: %w", key, ErrInvalidKey)
+	}
+	block, err := aes.NewCipher(key.material)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// keyAAD binds the encrypted material of a key to what the key is.
+func keyAAD(purpose Purpose, version int, alg Algorithm) []byte {
+	return []byte(fmt.Sprintf("%s|%d|%s", purpose, version, alg))
+}
+
+// save writes the store to its file, replacing it at once. Memory stores
+// are not saved. The caller holds the lock.
+func (s *Store) save() error {
+	if s.path == "" {
+		return nil
+	}
+	file := storeFile{MasterKCV: s.masterKCV}
+	for _, versions := range s.keys {
+		for _, key := range versions {
+			nonce := make([]byte, s.master.NonceSize())
+			if _, err := rand.Read(nonce); err != nil {
+				return err
+			}
+			sealed := s.master.Seal(nonce, nonce, key.material, keyAAD(key.Purpose, key.Version, key.Algorithm))
+			file.Keys = append(file.Keys, storedKey{
+				Purpose:   key.Purpose,
+				Version:   key.Version,
+				Algorithm: key.Algorithm,
+				State:     key.State,
+				KCV:       key.KCV,
+				CreatedAt: key.CreatedAt,
+				Material:  base64.StdEncoding.EncodeToString(sealed),
+			})
+		}
+	}
+	sort.Slice(file.Keys, func(i, j int) bool {
+		if file.Keys[i].Purpose != file.Keys[j].Purpose {
+			return file.Keys[i].Purpose < file.Keys[j].Purpose
+		}
+		return file.Keys[i].Version < file.Keys[j].Version
+	})
+
+	data, err := json.MarshalIndent(file, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := s.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.path)
+}
+
+// decrypt opens a key of the file and checks it against its KCV.
+func (s *Store) decrypt(stored storedKey) (*Key, error) {
+	sealed, err := base64.StdEncoding.DecodeString(stored.Material)
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) < s.master.NonceSize() {
+		return nil, fmt.Errorf("encrypted key is too short")
+	}
+	n := s.master.NonceSize()
+	material, err := s.master.Open(nil, sealed[:n], sealed[n:], keyAAD(stored.Purpose, stored.Version, stored.Algorithm))
+	if err != nil {
+		return nil, fmt.Errorf("decrypting: %w", err)
+	}
+	if err := Validate(stored.Purpose, stored.Algorithm, material); err != nil {
+		return nil, err
+	}
+	if err := CheckKCV(stored.Algorithm, material, stored.KCV); err != nil {
+		return nil, err
+	}
+	return &Key{
+		Purpose:   stored.Purpose,
+		Version:   stored.Version,
+		Algorithm: stored.Algorithm,
+		State:     stored.State,
+		KCV:       strings.ToUpper(stored.KCV),
+		CreatedAt: stored.CreatedAt,
+		material:  material,
+	}, nil
+}
@@ -0,0 +1,97 @@
+package recon
+
+import (
+	"context"
+	"database/sql"
+	"strings"
+	"time"
+)
+
+// PGAcquirerRepository reads the payments of the acquirer schema.
+type PGAcquirerRepository struct {
+	db *sql.DB
+}
+
+func NewPGAcquirerRepository(db *sql.DB) *PGAcquirerRepository {
+	return &PGAcquirerRepository{db: db}
+}
+
+func (r *PGAcquirerRepository) ListPayments(ctx context.Context, window Window) ([]Payment, error) {
+	rows, err := r.db.QueryContext(ctx, `
+		select payment_id, merchant_id, coalesce(tid, ''), coalesce(stan, ''), coalesce(rrn, ''),
+		       coalesce(authorization_code, ''), amount, captured_amount, refunded_amount,
+		       currency, status, created_at
+		  from acquirer.payments
+		 where ($1::timestamptz is null or created_at >= $1)
+		   and ($2::timestamptz is null or created_at < $2)
+		 order by created_at
+	`, nullTime(window.From), nullTime(window.To))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var payments []Payment
+	for rows.Next() {
+		var p Payment
+		if err := rows.Scan(&p.PaymentID, &p.MerchantID, &p.TID, &p.STAN, &p.RRN,
+			&p.AuthorizationCode, &p.Amount, &p.CapturedAmount, &p.RefundedAmount,
+			&p.Currency, &p.Status, &p.CreatedAt); err != nil {
+			return nil, err
+		}
+		p.AuthorizationCode = strings.TrimSpace(p.AuthorizationCode)
+		payments = append(payments, p)
+	}
+
+	return payments, rows.Err()
+}
+
+// PGIssuerRepository reads the authorizations of the issuer schema with the
+// amounts posted against them.
+type PGIssuerRepository struct {
+	db *sql.DB
+}
+
+func NewPGIssuerRepository(db *sql.DB) *PGIssuerRepository {
+	return &PGIssuerRepository{db: db}
+}
+
+func (r *PGIssuerRepository) ListAuths(ctx context.Context, window Window) ([]Auth, error) {
+	rows, err := r.db.QueryContext(ctx, `
+		select a.auth_id, a.terminal_id, coalesce(a.stan, 0), coalesce(a.rrn, ''),
+		       coalesce(a.authorization_code, ''), a.amount,
+		       coalesce((select sum(t.amount) from issuer.transactions t
+		                  where t.auth_id = a.auth_id and t.status = 'CAPTURED'), 0),
+		       coalesce((select -sum(t.amount) from issuer.transactions t
+		                  where t.auth_id = a.auth_id and t.status = 'REFUNDED'), 0),
+		       a.currency, a.status, a.transmitted_at, a.created_at
+		  from issuer.auths a
+		 where ($1::timestamptz is null or a.created_at >= $1)
+		   and ($2::timestamptz is null or a.created_at < $2)
+		 order by a.created_at
+	`, nullTime(window.From), nullTime(window.To))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var auths []Auth
+	for rows.Next() {
+		var a Auth
+		var transmittedAt sql.NullTime
+		if err := rows.Scan(&a.AuthID, &a.TerminalID, &a.STAN, &a.RRN,
+			&a.AuthorizationCode, &a.Amount, &a.CapturedAmount, &a.RefundedAmount,
+			&a.Currency, &a.Status, &transmittedAt, &a.CreatedAt); err != nil {
+			return nil, err
+		}
+		a.AuthorizationCode = strings.TrimSpace(a.AuthorizationCode)
+		a.TransmittedAt = transmittedAt.Time
+		auths = append(auths, a)
+	}
+
+	return auths, rows.Err()
+}
+
+func nullTime(t time.Time) sql.NullTime {
+	return sql.NullTime{Time: t, Valid: !t.IsZero()}
+}
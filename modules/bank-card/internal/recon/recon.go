@@ -0,0 +1,309 @@
+// Package recon reconciles the acquirer's payments with the issuer's
+// authorizations.
+//
+// A payment and an authorization are the same transaction when they share
+// the TID and RRN, or, without an RRN, the TID, STAN and transmission date.
+// Matched pairs must agree on the authorization code, currency and the
+// authorized, captured and refunded amounts.
+package recon
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Payment is an acquirer payment as the reconciliation sees it.
+type Payment struct {
+	PaymentID         string
+	MerchantID        string
+	TID               string
+	STAN              string
+	RRN               string
+	AuthorizationCode string
+	Amount            int64
+	CapturedAmount    int64
+	RefundedAmount    int64
+	Currency          string
+	Status            string
+	CreatedAt         time.Time
+}
+
+// Auth is an issuer authorization with the amounts its transactions
+// captured and refunded.
+type Auth struct {
+	AuthID            string
+	TerminalID        string
+	STAN              int
+	RRN               string
+	AuthorizationCode string
+	Amount            int64
+	CapturedAmount    int64
+	RefundedAmount    int64
+	Currency          string
+	Status            string
+	TransmittedAt     time.Time
+	CreatedAt         time.Time
+}
+
+// AcquirerRepository reads the acquirer's payments created in the window.
+type AcquirerRepository interface {
+	ListPayments(ctx context.Context, window Window) ([]Payment, error)
+}
+
+// IssuerRepository reads the issuer's authorizations created in the window.
+type IssuerRepository interface {
+	ListAuths(ctx context.Context, window Window) ([]Auth, error)
+}
+
+// Window limits the reconciliation to transactions created in [From, To);
+// zero times leave that end open.
+type Window struct {
+	From time.Time
+	To   time.Time
+}
+
+func (w Window) Contains(t time.Time) bool {
+	return (w.From.IsZero() || !t.Before(w.From)) && (w.To.IsZero() || t.Before(w.To))
+}
+
+// widen returns the window extended by d on both ends, so a transaction
+// created on one side just before the window still finds its counterpart.
+func (w Window) widen(d time.Duration) Window {
+	if !w.From.IsZero() {
+		w.From = w.From.Add(-d)
+	}
+	if !w.To.IsZero() {
+		w.To = w.To.Add(d)
+	}
+	return w
+}
+
+// windowMargin is how far apart the two sides may have recorded the same
+// transaction.
+const windowMargin = time.Hour
+
+// payment statuses the issuer must know about
+var acquirerInScope = map[string]bool{
+	"authorized":         true,
+	"partially_captured": true,
+	"captured":           true,
+	"refunded":           true,
+}
+
+// auth statuses the acquirer must know about; EXCEPTION auths are advices
+// the issuer recorded without a hold
+var issuerInScope = map[string]bool{
+	"AUTHORIZED": true,
+	"CAPTURED":   true,
+	"EXCEPTION":  true,
+}
+
+// Entry is a line of the report: a payment, an authorization or both, with
+// what does not match.
+type Entry struct {
+	Payment     *Payment
+	Auth        *Auth
+	Differences []string
+}
+
+// Summary counts the entries of every section.
+type Summary struct {
+	Matched           int
+	AmountMismatch    int
+	MissingAtIssuer   int
+	MissingAtAcquirer int
+}
+
+type Report struct {
+	GeneratedAt       time.Time
+	From              time.Time
+	To                time.Time
+	Summary           Summary
+	Matched           []Entry
+	AmountMismatch    []Entry
+	MissingAtIssuer   []Entry
+	MissingAtAcquirer []Entry
+}
+
+// Reconciled reports whether every transaction matched.
+func (r *Report) Reconciled() bool {
+	return len(r.AmountMismatch) == 0 && len(r.MissingAtIssuer) == 0 && len(r.MissingAtAcquirer) == 0
+}
+
+// Run reads both sides and reconciles them.
+func Run(ctx context.Context, acquirer AcquirerRepository, issuer IssuerRepository, window Window) (*Report, error) {
+	payments, err := acquirer.ListPayments(ctx, window.widen(windowMargin))
+	if err != nil {
+		return nil, fmt.Errorf("listing acquirer payments: %w", err)
+	}
+
+	auths, err := issuer.ListAuths(ctx, window.widen(windowMargin))
+	if err != nil {
+		return nil, fmt.Errorf("listing issuer authorizations: %w", err)
+	}
+
+	return Reconcile(payments, auths, window), nil
+}
+
+// Reconcile matches the payments with the authorizations. Both may reach
+// beyond the window; an entry belongs to the window by the time of its
+// payment, or of its authorization when the acquirer has none.
+func Reconcile(payments []Payment, auths []Auth, window Window) *Report {
+	report := &Report{
+		GeneratedAt: time.Now().UTC(),
+		From:        window.From,
+		To:          window.To,
+	}
+
+	byKey := make(map[string]int)
+	for i, auth := range auths {
+		for _, key := range authKeys(auth) {
+			if _, ok := byKey[key]; !ok {
+				byKey[key] = i
+			}
+		}
+	}
+
+	matched := make([]bool, len(auths))
+	for i := range payments {
+		payment := &payments[i]
+
+		var auth *Auth
+		for _, key := range paymentKeys(*payment) {
+			if j, ok := byKey[key]; ok && !matched[j] {
+				matched[j] = true
+				auth = &auths[j]
+				break
+			}
+		}
+
+		if !window.Contains(payment.CreatedAt) {
+			continue
+		}
+
+		paymentInScope := acquirerInScope[payment.Status]
+		authInScope := auth != nil && issuerInScope[auth.Status]
+
+		switch {
+		case paymentInScope && authInScope:
+			entry := Entry{Payment: payment, Auth: auth, Differences: compare(*payment, *auth)}
+			if len(entry.Differences) == 0 {
+				report.Matched = append(report.Matched, entry)
+			} else {
+				report.AmountMismatch = append(report.AmountMismatch, entry)
+			}
+		case paymentInScope:
+			entry := Entry{Payment: payment, Auth: auth}
+			if auth != nil {
+				entry.Differences = []string{fmt.Sprintf("issuer authorization is %s", auth.Status)}
+			}
+			report.MissingAtIssuer = append(report.MissingAtIssuer, entry)
+		case authInScope:
+			report.MissingAtAcquirer = append(report.MissingAtAcquirer, Entry{
+				Payment:     payment,
+				Auth:        auth,
+				Differences: []string{fmt.Sprintf("acquirer payment is %s", payment.Status)},
+			})
+		}
+	}
+
+	for i := range auths {
+		auth := &auths[i]
+		if matched[i] || !issuerInScope[auth.Status] || !window.Contains(auth.CreatedAt) {
+			continue
+		}
+		report.MissingAtAcquirer = append(report.MissingAtAcquirer, Entry{Auth: auth})
+	}
+
+	for _, section := range [][]Entry{report.Matched, report.AmountMismatch, report.MissingAtIssuer, report.MissingAtAcquirer} {
+		sortEntries(section)
+	}
+
+	report.Summary = Summary{
+		Matched:           len(report.Matched),
+		AmountMismatch:    len(report.AmountMismatch),
+		MissingAtIssuer:   len(report.MissingAtIssuer),
+		MissingAtAcquirer: len(report.MissingAtAcquirer),
+	}
+
+	return report
+}
+
+// compare lists what a matched payment and authorization disagree on.
+func compare(payment Payment, auth Auth) []string {
+	var differences []string
+
+	differ := func(field string, acquirer, issuer any) {
+		differences = append(differences, fmt.Sprintf("%s: acquirer %v, issuer %v", field, acquirer, issuer))
+	}
+
+	if payment.Amount != auth.Amount {
+		differ("amount", payment.Amount, auth.Amount)
+	}
+	if !strings.EqualFold(payment.Currency, auth.Currency) {
+		differ("currency", payment.Currency, auth.Currency)
+	}
+	if payment.CapturedAmount != auth.CapturedAmount {
+		differ("captured amount", payment.CapturedAmount, auth.CapturedAmount)
+	}
+	if payment.RefundedAmount != auth.RefundedAmount {
+		differ("refunded amount", payment.RefundedAmount, auth.RefundedAmount)
+	}
+	if strings.TrimSpace(payment.AuthorizationCode) != strings.TrimSpace(auth.AuthorizationCode) {
+		differ("authorization code", payment.AuthorizationCode, auth.AuthorizationCode)
+	}
+
+	return differences
+}
+
+// paymentKeys returns the keys a payment is matched by, the RRN one first.
+func paymentKeys(payment Payment) []string {
+	var keys []string
+	if payment.RRN != "" {
+		keys = append(keys, rrnKey(payment.TID, payment.RRN))
+	}
+	if stan, err := strconv.Atoi(payment.STAN); err == nil && stan > 0 {
+		keys = append(keys, stanKey(payment.TID, stan, payment.CreatedAt))
+	}
+	return keys
+}
+
+func authKeys(auth Auth) []string {
+	var keys []string
+	if auth.RRN != "" {
+		keys = append(keys, rrnKey(auth.TerminalID, auth.RRN))
+	}
+	if auth.STAN > 0 {
+		transmittedAt := auth.TransmittedAt
+		if transmittedAt.IsZero() {
+			transmittedAt = auth.CreatedAt
+		}
+		keys = append(keys, stanKey(auth.TerminalID, auth.STAN, transmittedAt))
+	}
+	return keys
+}
+
+func rrnKey(tid, rrn string) string {
+	return "rrn/" + strings.TrimSpace(tid) + "/" + rrn
+}
+
+// STANs are only unique per terminal and day
+func stanKey(tid string, stan int, at time.Time) string {
+	return fmt.Sprintf("stan/%s/%06d/%s", strings.TrimSpace(tid), stan, at.UTC().Format("2006-01-02"))
+}
+
+func sortEntries(entries []Entry) {
+	at := func(e Entry) time.Time {
+		if e.Payment != nil {
+			return e.Payment.CreatedAt
+		}
+		return e.Auth.CreatedAt
+	}
+	sort.SliceStable(entries, func(i, j int) bool {
+		return at(entries[i]).Before(at(entries[j]))
+	})
+}
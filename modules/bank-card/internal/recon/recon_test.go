@@ -0,0 +1,189 @@
+package recon
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+var day = time.Date(2026, time.October, 15, 0, 0, 0, 0, time.UTC)
+
+func payment(id, tid, stan, rrn string, amount int64, status string, at time.Time) Payment {
+	return Payment{
+		PaymentID:         id,
+		MerchantID:        "merchant",
+		TID:               tid,
+		STAN:              stan,
+		RRN:               rrn,
+		AuthorizationCode: "A1B2C3",
+		Amount:            amount,
+		CapturedAmount:    amount,
+		Currency:          "USD",
+		Status:            status,
+		CreatedAt:         at,
+	}
+}
+
+func auth(id, tid string, stan int, rrn string, amount int64, status string, at time.Time) Auth {
+	return Auth{
+		AuthID:            id,
+		TerminalID:        tid,
+		STAN:              stan,
+		RRN:               rrn,
+		AuthorizationCode: "A1B2C3",
+		Amount:            amount,
+		CapturedAmount:    amount,
+		Currency:          "USD",
+		Status:            status,
+		TransmittedAt:     at,
+		CreatedAt:         at,
+	}
+}
+
+func testSnapshot() *Snapshot {
+	at := day.Add(10 * time.Hour)
+
+	mismatched := auth("a-mismatch", "T1", 2, "6288100000002", 1500, "CAPTURED", at)
+	mismatched.CapturedAmount = 1000
+
+	return &Snapshot{
+		Payments: []Payment{
+			payment("p-matched", "T1", "000001", "6288100000001", 1000, "captured", at),
+			payment("p-mismatch", "T1", "000002", "6288100000002", 1500, "captured", at),
+			// no RRN, matched by STAN and date
+			payment("p-stan", "T2", "000001", "", 700, "captured", at),
+			payment("p-missing", "T1", "000003", "6288100000003", 900, "authorized", at),
+			payment("p-reversed", "T1", "000004", "6288100000004", 800, "authorized", at),
+			payment("p-voided", "T1", "000005", "6288100000005", 600, "voided", at),
+			payment("p-declined", "T1", "000006", "6288100000006", 500, "declined", at),
+			// the day before, only its authorization is in the margin
+			payment("p-before", "T1", "000007", "6223923000007", 400, "captured", day.Add(-time.Minute)),
+		},
+		Auths: []Auth{
+			auth("a-matched", "T1", 1, "6288100000001", 1000, "CAPTURED", at),
+			mismatched,
+			auth("a-stan", "T2", 1, "", 700, "CAPTURED", at.Add(time.Second)),
+			auth("a-reversed", "T1", 4, "6288100000004", 800, "REVERSED", at),
+			auth("a-voided", "T1", 5, "6288100000005", 600, "AUTHORIZED", at),
+			auth("a-unknown", "T3", 1, "6288100000001", 300, "AUTHORIZED", at),
+			auth("a-before", "T1", 7, "6223923000007", 400, "CAPTURED", day.Add(time.Second)),
+			// the STAN is the same but on another day
+			auth("a-other-day", "T2", 1, "", 700, "REVERSED", at.AddDate(0, 0, 1)),
+		},
+	}
+}
+
+func ids(entries []Entry) []string {
+	var ids []string
+	for _, e := range entries {
+		switch {
+		case e.Payment != nil:
+			ids = append(ids, e.Payment.PaymentID)
+		default:
+			ids = append(ids, e.Auth.AuthID)
+		}
+	}
+	return ids
+}
+
+func TestRun(t *testing.T) {
+	snapshot := testSnapshot()
+
+	report, err := Run(context.Background(), snapshot, snapshot, Window{From: day, To: day.AddDate(0, 0, 1)})
+	require.NoError(t, err)
+
+	require.Equal(t, []string{"p-matched", "p-stan"}, ids(report.Matched))
+	require.Equal(t, "a-stan", report.Matched[1].Auth.AuthID)
+
+	require.Equal(t, []string{"p-mismatch"}, ids(report.AmountMismatch))
+	require.Equal(t, []string{"captured amount: acquirer 1500, issuer 1000"}, report.AmountMismatch[0].Differences)
+
+	require.Equal(t, []string{"p-missing", "p-reversed"}, ids(report.MissingAtIssuer))
+	require.Nil(t, report.MissingAtIssuer[0].Auth)
+	require.Equal(t, []string{"issuer authorization is REVERSED"}, report.MissingAtIssuer[1].Differences)
+
+	// a-before matched a payment of the day before, so it is not reported
+	require.Equal(t, []string{"p-voided", "a-unknown"}, ids(report.MissingAtAcquirer))
+	require.Equal(t, []string{"acquirer payment is voided"}, report.MissingAtAcquirer[0].Differences)
+
+	require.Equal(t, Summary{Matched: 2, AmountMismatch: 1, MissingAtIssuer: 2, MissingAtAcquirer: 2}, report.Summary)
+	require.False(t, report.Reconciled())
+}
+
+func TestReconcile_Differences(t *testing.T) {
+	at := day.Add(time.Hour)
+	p := payment("p", "T1", "000001", "6288100000001", 1000, "captured", at)
+	a := auth("a", "T1", 1, "6288100000001", 1200, "CAPTURED", at)
+	a.Currency = "EUR"
+	a.CapturedAmount = 1000
+	a.RefundedAmount = 100
+	a.AuthorizationCode = "ZZZZZZ"
+
+	report := Reconcile([]Payment{p}, []Auth{a}, Window{})
+
+	require.Len(t, report.AmountMismatch, 1)
+	require.Equal(t, []string{
+		"amount: acquirer 1000, issuer 1200",
+		"currency: acquirer USD, issuer EUR",
+		"refunded amount: acquirer 0, issuer 100",
+		"authorization code: acquirer A1B2C3, issuer ZZZZZZ",
+	}, report.AmountMismatch[0].Differences)
+}
+
+func TestReconcile_Reconciled(t *testing.T) {
+	at := day.Add(time.Hour)
+
+	report := Reconcile(
+		[]Payment{payment("p", "T1", "000001", "6288100000001", 1000, "captured", at)},
+		[]Auth{auth("a", "T1", 1, "6288100000001", 1000, "CAPTURED", at)},
+		Window{},
+	)
+
+	require.True(t, report.Reconciled())
+	require.Equal(t, 1, report.Summary.Matched)
+}
+
+func TestSnapshotRoundTrip(t *testing.T) {
+	snapshot := testSnapshot()
+
+	var buf bytes.Buffer
+	require.NoError(t, WriteSnapshot(&buf, snapshot))
+
+	read, err := ReadSnapshot(&buf)
+	require.NoError(t, err)
+	require.Equal(t, snapshot, read)
+}
+
+func TestWriteCSV(t *testing.T) {
+	snapshot := testSnapshot()
+	report, err := Run(context.Background(), snapshot, snapshot, Window{From: day, To: day.AddDate(0, 0, 1)})
+	require.NoError(t, err)
+
+	var buf bytes.Buffer
+	require.NoError(t, WriteCSV(&buf, report))
+
+	rows, err := csv.NewReader(&buf).ReadAll()
+	require.NoError(t, err)
+	require.Len(t, rows, 1+7)
+	require.Equal(t, csvHeader, rows[0])
+
+	// the mismatch row carries both sides
+	mismatch := rows[3]
+	require.Equal(t, SectionAmountMismatch, mismatch[0])
+	require.Equal(t, []string{"T1", "6288100000002", "000002", "p-mismatch"}, mismatch[1:5])
+	require.Equal(t, "a-mismatch", mismatch[12])
+	require.Equal(t, "1500", mismatch[9])
+	require.Equal(t, "1000", mismatch[16])
+	require.Equal(t, "captured amount: acquirer 1500, issuer 1000", mismatch[20])
+
+	// an authorization unknown to the acquirer has only the issuer's side
+	unknown := rows[7]
+	require.Equal(t, SectionMissingAtAcquirer, unknown[0])
+	require.Equal(t, []string{"T3", "6288100000001", "1"}, unknown[1:4])
+	require.Empty(t, unknown[4])
+	require.Equal(t, "a-unknown", unknown[12])
+}
@@ -0,0 +1,95 @@
+package recon
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Report sections as they are named in the CSV output.
+const (
+	SectionMatched           = "matched"
+	SectionAmountMismatch    = "amount_mismatch"
+	SectionMissingAtIssuer   = "missing_at_issuer"
+	SectionMissingAtAcquirer = "missing_at_acquirer"
+)
+
+var csvHeader = []string{
+	"section", "tid", "rrn", "stan",
+	"payment_id", "merchant_id", "acquirer_status", "acquirer_authorization_code",
+	"acquirer_amount", "acquirer_captured_amount", "acquirer_refunded_amount", "acquirer_currency",
+	"auth_id", "issuer_status", "issuer_authorization_code",
+	"issuer_amount", "issuer_captured_amount", "issuer_refunded_amount", "issuer_currency",
+	"created_at", "differences",
+}
+
+func WriteJSON(w io.Writer, report *Report) error {
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(report)
+}
+
+// WriteCSV writes every entry of the report as a row, section by section.
+func WriteCSV(w io.Writer, report *Report) error {
+	writer := csv.NewWriter(w)
+
+	if err := writer.Write(csvHeader); err != nil {
+		return err
+	}
+
+	sections := []struct {
+		name    string
+		entries []Entry
+	}{
+		{SectionMatched, report.Matched},
+		{SectionAmountMismatch, report.AmountMismatch},
+		{SectionMissingAtIssuer, report.MissingAtIssuer},
+		{SectionMissingAtAcquirer, report.MissingAtAcquirer},
+	}
+	for _, section := range sections {
+		for _, entry := range section.entries {
+			if err := writer.Write(csvRow(section.name, entry)); err != nil {
+				return err
+			}
+		}
+	}
+
+	writer.Flush()
+	return writer.Error()
+}
+
+func csvRow(section string, entry Entry) []string {
+	row := make([]string, len(csvHeader))
+	row[0] = section
+
+	var createdAt time.Time
+	if a := entry.Auth; a != nil {
+		row[1], row[2] = a.TerminalID, a.RRN
+		if a.STAN > 0 {
+			row[3] = strconv.Itoa(a.STAN)
+		}
+		row[12], row[13], row[14] = a.AuthID, a.Status, a.AuthorizationCode
+		row[15] = strconv.FormatInt(a.Amount, 10)
+		row[16] = strconv.FormatInt(a.CapturedAmount, 10)
+		row[17] = strconv.FormatInt(a.RefundedAmount, 10)
+		row[18] = a.Currency
+		createdAt = a.CreatedAt
+	}
+	// the acquirer's identifiers win, they are what the merchant sees
+	if p := entry.Payment; p != nil {
+		row[1], row[2], row[3] = p.TID, p.RRN, p.STAN
+		row[4], row[5], row[6], row[7] = p.PaymentID, p.MerchantID, p.Status, p.AuthorizationCode
+		row[8] = strconv.FormatInt(p.Amount, 10)
+		row[9] = strconv.FormatInt(p.CapturedAmount, 10)
+		row[10] = strconv.FormatInt(p.RefundedAmount, 10)
+		row[11] = p.Currency
+		createdAt = p.CreatedAt
+	}
+	row[19] = createdAt.UTC().Format(time.RFC3339)
+	row[20] = strings.Join(entry.Differences, "; ")
+
+	return row
+}
@@ -0,0 +1,64 @@
+package recon
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+)
+
+// Snapshot is an export of both sides, so a reconciliation can be repeated
+// or investigated away from the databases. It implements both repositories.
+type Snapshot struct {
+	Payments []Payment
+	Auths    []Auth
+}
+
+// Export reads both sides into a snapshot.
+func Export(ctx context.Context, acquirer AcquirerRepository, issuer IssuerRepository, window Window) (*Snapshot, error) {
+	payments, err := acquirer.ListPayments(ctx, window)
+	if err != nil {
+		return nil, fmt.Errorf("listing acquirer payments: %w", err)
+	}
+
+	auths, err := issuer.ListAuths(ctx, window)
+	if err != nil {
+		return nil, fmt.Errorf("listing issuer authorizations: %w", err)
+	}
+
+	return &Snapshot{Payments: payments, Auths: auths}, nil
+}
+
+func ReadSnapshot(r io.Reader) (*Snapshot, error) {
+	snapshot := &Snapshot{}
+	if err := json.NewDecoder(r).Decode(snapshot); err != nil {
+		return nil, fmt.Errorf("decoding snapshot: %w", err)
+	}
+	return snapshot, nil
+}
+
+func WriteSnapshot(w io.Writer, snapshot *Snapshot) error {
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(snapshot)
+}
+
+func (s *Snapshot) ListPayments(_ context.Context, window Window) ([]Payment, error) {
+	var payments []Payment
+	for _, p := range s.Payments {
+		if window.Contains(p.CreatedAt) {
+			payments = append(payments, p)
+		}
+	}
+	return payments, nil
+}
+
+func (s *Snapshot) ListAuths(_ context.Context, window Window) ([]Auth, error) {
+	var auths []Auth
+	for _, a := range s.Auths {
+		if window.Contains(a.CreatedAt) {
+			auths = append(auths, a)
+		}
+	}
+	return auths, nil
+}
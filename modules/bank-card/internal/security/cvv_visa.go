@@ -0,0 +1,150 @@
+package security
+
+import (
+	"crypto/des"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/alovak/cardflow-playground/internal/cardgen"
+	"github.com/alovak/cardflow-playground/internal/expiry"
+)
+
+// Visa CVV 使用的 service code：同一算法、同一 CVK，仅 service code 不同。
+const (
+	ServiceCodeCVV1 = "101" // 磁条（track 1/2）
+	ServiceCodeCVV2 = "000" // 卡面印刷，卡不在场交易
+	ServiceCodeICVV = "999" // 芯片卡上的 track 2 等效数据
+)
+
+// DemoVisaCVK returns the demo double-length CVK (CVKA||CVKB) of the Visa
+// provider: hex from CVK_HEX_DEMO or a static fallback (NOT SAFE FOR PROD).
+func DemoVisaCVK() []byte {
+	return demoHexKey("CVK_HEX_DEMO", "0123456789ABCDEFFEDCBA9876543210")
+}
+
+// VisaCVV 按 Visa CVV 算法计算 CVV（width 位，3 或 4）：
+//  1. PAN + YYMM + service code 右补 0 至 32 个半字节，分为块 1、块 2；
+//  2. 块 1 用 CVKA 做单 DES 加密，结果与块 2 异或；
+//  3. 用 CVKA/CVKB 做 3DES（E-D-E）加密；
+//  4. 十进制化：先从左到右取 0-9，不足时再取 A-F 减 10。
+func VisaCVV(cvka, cvkb []byte, pan, expiryYYMM, serviceCode string, width int) (string, error) {
+	pan = cardgen.NormalizePAN(pan)
+	if len(pan) < 12 || len(pan) > 19 || !cardgen.IsDigits(pan) {
+		return "", fmt.Errorf("PAN must be 12..19 digits")
+	}
+	if err := expiry.ValidateYYMM(expiryYYMM); err != nil {
+		return "", err
+	}
+	if err := validateServiceCode(serviceCode); err != nil {
+		return "", err
+	}
+	return visaCVV(cvka, cvkb, pan+expiryYYMM+serviceCode, normalizeWidth(width))
+}
+
+// visaCVV 对任意不超过 32 位的数字串执行 Visa CVV 算法。
+func visaCVV(cvka, cvkb []byte, digits string, width int) (string, error) {
+	if len(cvka) != 8 || len(cvkb) != 8 {
+		return "", fmt.Errorf("CVKA and CVKB must be 8 bytes each")
+	}
+	if len(digits) > 32 {
+		return "", fmt.Errorf("CVV data must be at most 32 digits (got %d)", len(digits))
+	}
+	data, err := hex.DecodeString(digits + strings.Repeat("0", 32-len(digits)))
+	if err != nil {
+		return "", err
+	}
+
+	single, err := des.NewCipher(cvka)
+	if err != nil {
+		return "", err
+	}
+	triple, err := newTripleDES(append(append([]byte{}, cvka...), cvkb...))
+	if err != nil {
+		return "", err
+	}
+
+	block := make([]byte, des.BlockSize)
+	single.Encrypt(block, data[:8])
+	xor(block, data[8:])
+	triple.Encrypt(block, block)
+
+	return decimalize(block, width), nil
+}
+
+// decimalize：Visa 十进制化表，先取十进制半字节，不足时再取 A-F 减 10。
+func decimalize(b []byte, n int) string {
+	nibbles := hex.EncodeToString(b)
+	out := make([]byte, 0, n)
+	for i := 0; i < len(nibbles) && len(out) < n; i++ {
+		if c := nibbles[i]; c >= '0' && c <= '9' {
+			out = append(out, c)
+		}
+	}
+	for i := 0; i < len(nibbles) && len(out) < n; i++ {
+		if c := nibbles[i]; c >= 'a' && c <= 'f' {
+			out = append(out, '0'+c-'a')
+		}
+	}
+	return string(out)
+}
+
+// VisaProvider：纯 Go（crypto/des）实现的 Visa CVV 算法，
+// 与 HSM/行业工具的 CVV1、CVV2、iCVV 结果一致。
+// cvk 为双倍长密钥 CVKA||CVKB。
+type VisaProvider struct {
+	cvk []byte
+}
+
+func NewVisaProvider(cvk []byte) *VisaProvider { return &VisaProvider{cvk: cvk} }
+
+// ComputeCVV2 由 PAN 去校验位补回 Luhn 校验位后按 Visa 算法计算；
+// service code 决定是 CVV1（101）、CVV2（000）还是 iCVV（999）。
+func (p *VisaProvider) ComputeCVV2(panNoCD, yymm, sc string, width int) (string, error) {
+	if len(p.cvk) != 16 {
+		return "", fmt.Errorf("cvk must be 16 bytes (CVKA||CVKB)")
+	}
+	if err := validatePanNoCD(panNoCD); err != nil {
+		return "", err
+	}
+	return VisaCVV(p.cvk[:8], p.cvk[8:], buildValidPAN(panNoCD), yymm, sc, width)
+}
+
+// ComputeDisplayDCVV 用同一算法计算展示用动态 CVV：时间窗序号（十进制）
+// 接在 PAN + YYMM + service code 之后，截取到 32 位以内。非网络标准。
+func (p *VisaProvider) ComputeDisplayDCVV(panNoCD, yymm, sc string, step time.Duration, width int) (string, int, error) {
+	return p.ComputeDCVVAt(panNoCD, yymm, sc, time.Now(), step, width)
+}
+
+// ComputeDCVVAt 计算 at 所在时间窗的动态 CVV，返回 cvv 及该窗剩余秒数。
+func (p *VisaProvider) ComputeDCVVAt(panNoCD, yymm, sc string, at time.Time, step time.Duration, width int) (string, int, error) {
+	if len(p.cvk) != 16 {
+		return "", 0, fmt.Errorf("cvk must be 16 bytes (CVKA||CVKB)")
+	}
+	if err := validatePanNoCD(panNoCD); err != nil {
+		return "", 0, err
+	}
+	if err := expiry.ValidateYYMM(yymm); err != nil {
+		return "", 0, err
+	}
+	if err := validateServiceCode(sc); err != nil {
+		return "", 0, err
+	}
+
+	step = normalizeStep(step)
+	now := at.UTC()
+	sec := int64(step / time.Second)
+
+	digits := buildValidPAN(panNoCD) + yymm + sc
+	window := fmt.Sprintf("%020d", now.Unix()/sec)
+	digits += window[len(window)-(32-len(digits)):]
+
+	cvv, err := visaCVV(p.cvk[:8], p.cvk[8:], digits, normalizeWidth(width))
+	if err != nil {
+		return "", 0, err
+	}
+	return cvv, int(sec - now.Unix()%sec), nil
+}
+
+var _ CVVProvider = (*VisaProvider)(nil)
@@ -0,0 +1,87 @@
+package security
+
+import (
+	"encoding/hex"
+	"testing"
+	"time"
+)
+
+// Published Visa CVV test vectors, with CVKA 0123456789ABCDEF and CVKB FEDCBA9876543210.
+func TestVisaCVV(t *testing.T) {
+	cvka, _ := hex.DecodeString("0123456789ABCDEF")
+	cvkb, _ := hex.DecodeString("FEDCBA9876543210")
+
+	tests := []struct {
+		pan, expiry, serviceCode string
+		want                     string
+	}{
+		{"4123456789012345", "8701", "101", "561"},
+		{"4999988887777000", "9105", "111", "245"},
+		{"4123456789012345", "8701", ServiceCodeCVV2, "636"},
+		{"4123456789012345", "8701", ServiceCodeICVV, "651"},
+		{"5413330089020011", "2512", ServiceCodeCVV1, "536"},
+	}
+	for _, tt := range tests {
+		got, err := VisaCVV(cvka, cvkb, tt.pan, tt.expiry, tt.serviceCode, 3)
+		if err != nil {
+			t.Fatalf("%s/%s/%s: %v", tt.pan, tt.expiry, tt.serviceCode, err)
+		}
+		if got != tt.want {
+			t.Fatalf("%s/%s/%s got %s want %s", tt.pan, tt.expiry, tt.serviceCode, got, tt.want)
+		}
+	}
+
+	// 4 digits continue the same decimalization
+	if got, _ := VisaCVV(cvka, cvkb, "4123456789012345", "8701", "101", 4); got != "5614" {
+		t.Fatalf("4-digit CVV got %s want 5614", got)
+	}
+}
+
+func TestVisaProvider(t *testing.T) {
+	cvk, _ := hex.DecodeString("0123456789ABCDEFFEDCBA9876543210")
+	p := NewVisaProvider(cvk)
+
+	// the provider takes the PAN without its check digit and restores it
+	cvv, err := p.ComputeCVV2("541333008902001", "2512", ServiceCodeCVV1, 3)
+	if err != nil {
+		t.Fatalf("compute: %v", err)
+	}
+	if cvv != "536" {
+		t.Fatalf("got %s want 536", cvv)
+	}
+
+	dcvv, ttl, err := p.ComputeDisplayDCVV("541333008902001", "2512", ServiceCodeCVV1, 30*time.Second, 3)
+	if err != nil {
+		t.Fatalf("display dcvv: %v", err)
+	}
+	if len(dcvv) != 3 || ttl < 1 || ttl > 30 {
+		t.Fatalf("display dcvv %q, ttl %d", dcvv, ttl)
+	}
+
+	// window 56666666 of 30s: CVV data 5413330089020011 2512101 056666666
+	for _, tc := range []struct {
+		unix int64
+		cvv  string
+		ttl  int
+	}{
+		{1699999990, "481", 20},
+		{1700000009, "481", 1},
+		{1700000010, "626", 30},
+	} {
+		cvv, ttl, err := p.ComputeDCVVAt("541333008902001", "2512", ServiceCodeCVV1, time.Unix(tc.unix, 0), 30*time.Second, 3)
+		if err != nil || cvv != tc.cvv || ttl != tc.ttl {
+			t.Fatalf("dcvv at %d got %s, %d, %v want %s, %d", tc.unix, cvv, ttl, err, tc.cvv, tc.ttl)
+		}
+	}
+
+	if _, err := NewVisaProvider(cvk[:8]).ComputeCVV2("541333008902001", "2512", ServiceCodeCVV2, 3); err == nil {
+		t.Fatalf("single-length CVK accepted")
+	}
+}
+
+func TestDecimalize(t *testing.T) {
+	// only two decimal digits: the second pass takes A-F minus 10
+	if got := decimalize([]byte{0xAB, 0x1C, 0xDE, 0xF2, 0xAA, 0xBB, 0xCC, 0xDD}, 4); got != "1201" {
+		t.Fatalf("got %s want 1201", got)
+	}
+}
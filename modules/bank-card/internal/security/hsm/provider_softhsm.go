@@ -25,6 +25,8 @@ type SoftHSMProvider struct {
     p11      *pkcs11.Ctx
     sess     pkcs11.SessionHandle
     cvk      pkcs11.ObjectHandle
+    pvkLabel string
+    pvk      pkcs11.ObjectHandle
 }
 
 func NewSoftHSMProvider(libPath string, slotID uint, pin, cvkLabel string) *SoftHSMProvider {
@@ -39,7 +41,7 @@ func (p *SoftHSMProvider) Open() error {
     if err := p.p11.Initialize(); err != nil {
         return err
     }
-    sess, err := p.p11.OpenSession(pkcs11.SlotID(p.slotID), pkcs11.CKF_SERIAL_SESSION|pkcs11.CKF_RW_SESSION)
+    sess, err := p.p11.OpenSession(p.slotID, pkcs11.CKF_SERIAL_SESSION|pkcs11.CKF_RW_SESSION)
     if err != nil {
         _ = p.p11.Finalize()
         return err
@@ -81,6 +83,7 @@ func (p *SoftHSMProvider) Close() {
         _ = p.p11.Finalize()
         p.p11.Destroy()
         p.p11 = nil
+        p.pvk = 0
     }
 }
 
@@ -153,6 +156,11 @@ func (p *SoftHSMProvider) ComputeCVV2(panNoCD, yymm, sc string, width int) (stri
 }
 
 func (p *SoftHSMProvider) ComputeDisplayDCVV(panNoCD, yymm, sc string, step time.Duration, width int) (string, int, error) {
+    return p.ComputeDCVVAt(panNoCD, yymm, sc, time.Now(), step, width)
+}
+
+// ComputeDCVVAt 计算 at 所在时间窗的动态 CVV，返回 cvv 及该窗剩余秒数。
+func (p *SoftHSMProvider) ComputeDCVVAt(panNoCD, yymm, sc string, at time.Time, step time.Duration, width int) (string, int, error) {
     // 归一化步长：至少1s、按秒对齐
     if step < time.Second {
         step = time.Second
@@ -171,7 +179,7 @@ func (p *SoftHSMProvider) ComputeDisplayDCVV(panNoCD, yymm, sc string, step time
     if panNoCD == "" || !cardgen.IsDigits(panNoCD) {
         return "", 0, fmt.Errorf("panNoCD must be digits only")
     }
-    now := time.Now().UTC()
+    now := at.UTC()
     window := uint64(now.Unix()) / uint64(step.Seconds())
     data := assembleData(panNoCD, yymm, sc, &window)
     mac, err := p.mac(data)
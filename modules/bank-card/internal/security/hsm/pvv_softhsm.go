@@ -0,0 +1,69 @@
+//go:build softhsm
+
+package hsm
+
+import (
+    "fmt"
+
+    "github.com/miekg/pkcs11"
+
+    "github.com/alovak/cardflow-playground/internal/security"
+)
+
+// SetPVKLabel 设置 PVK 的标签；PVK 在首次计算 PVV 时查找，
+// 没有 PVK 的 token 仍可用于 CVV。
+// PKCS#11 库每个进程只能初始化一次，所以 PVV 与 CVV 共用同一会话。
+func (p *SoftHSMProvider) SetPVKLabel(label string) {
+    p.pvkLabel = label
+    p.pvk = 0
+}
+
+func (p *SoftHSMProvider) findPVK() (pkcs11.ObjectHandle, error) {
+    if p.pvk != 0 {
+        return p.pvk, nil
+    }
+    if p.p11 == nil {
+        return 0, fmt.Errorf("softhsm session is not open")
+    }
+    template := []*pkcs11.Attribute{
+        pkcs11.NewAttribute(pkcs11.CKA_LABEL, p.pvkLabel),
+        pkcs11.NewAttribute(pkcs11.CKA_CLASS, pkcs11.CKO_SECRET_KEY),
+        pkcs11.NewAttribute(pkcs11.CKA_KEY_TYPE, pkcs11.CKK_DES3),
+    }
+    if err := p.p11.FindObjectsInit(p.sess, template); err != nil {
+        return 0, err
+    }
+    objs, _, err := p.p11.FindObjects(p.sess, 1)
+    _ = p.p11.FindObjectsFinal(p.sess)
+    if err != nil {
+        return 0, err
+    }
+    if len(objs) == 0 {
+        return 0, fmt.Errorf("pvk not found by label=%s", p.pvkLabel)
+    }
+    p.pvk = objs[0]
+    return p.pvk, nil
+}
+
+// ComputePVV：TSP 在 HSM 内以 CKM_DES3_ECB 加密后十进制化，PVK 不出 token。
+func (p *SoftHSMProvider) ComputePVV(pan, pin string, pvki int) (string, error) {
+    tsp, err := security.PVVInput(pan, pin, pvki)
+    if err != nil {
+        return "", err
+    }
+    pvk, err := p.findPVK()
+    if err != nil {
+        return "", err
+    }
+    mech := []*pkcs11.Mechanism{pkcs11.NewMechanism(pkcs11.CKM_DES3_ECB, nil)}
+    if err := p.p11.EncryptInit(p.sess, mech, pvk); err != nil {
+        return "", err
+    }
+    out, err := p.p11.Encrypt(p.sess, tsp)
+    if err != nil {
+        return "", err
+    }
+    return security.DecimalizePVV(out), nil
+}
+
+var _ security.PVVProvider = (*SoftHSMProvider)(nil)
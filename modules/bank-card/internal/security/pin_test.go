@@ -0,0 +1,86 @@
+package security
+
+import (
+	"encoding/hex"
+	"errors"
+	"testing"
+)
+
+var testZPK, _ = hex.DecodeString("89ABCDEF0123456776543210FEDCBA98")
+
+func TestPINBlockFormat0(t *testing.T) {
+	clear, err := ClearPINBlock0("1234", "5413330089020011")
+	if err != nil {
+		t.Fatalf("clear block: %v", err)
+	}
+	if got := hex.EncodeToString(clear); got != "041207cff76fdffe" {
+		t.Fatalf("clear block got %s want 041207cff76fdffe", got)
+	}
+
+	block, err := EncryptPINBlock(PINBlockFormat0, "1234", "5413330089020011", testZPK)
+	if err != nil {
+		t.Fatalf("encrypt: %v", err)
+	}
+	if got := hex.EncodeToString(block); got != "4838fcaa30fed491" {
+		t.Fatalf("encrypted block got %s want 4838fcaa30fed491", got)
+	}
+
+	pin, err := DecryptPINBlock(block, "5413330089020011", testZPK)
+	if err != nil || pin != "1234" {
+		t.Fatalf("decrypt got %q, %v", pin, err)
+	}
+
+	// another PAN garbles the block
+	if _, err := DecryptPINBlock(block, "4111111111111111", testZPK); !errors.Is(err, ErrInvalidPINBlock) {
+		t.Fatalf("decrypt with another PAN: %v", err)
+	}
+}
+
+func TestPINBlockFormat4(t *testing.T) {
+	// PIN field 441234AAAAAAAAAA with a zero random fill
+	block, _ := hex.DecodeString("049569ca2765d8010f681b3f08c18ad0")
+	pin, err := DecryptPINBlock(block, "5413330089020011", testZPK)
+	if err != nil || pin != "1234" {
+		t.Fatalf("decrypt got %q, %v", pin, err)
+	}
+
+	for _, want := range []string{"0000", "987654", "123456789012"} {
+		block, err := EncryptPINBlock(PINBlockFormat4, want, "4111111111111111", testZPK)
+		if err != nil {
+			t.Fatalf("encrypt %s: %v", want, err)
+		}
+		if len(block) != 16 {
+			t.Fatalf("format 4 block of %d bytes", len(block))
+		}
+		pin, err := DecryptPINBlock(block, "4111111111111111", testZPK)
+		if err != nil || pin != want {
+			t.Fatalf("round trip of %s got %q, %v", want, pin, err)
+		}
+	}
+}
+
+func TestPINBlock_InvalidPIN(t *testing.T) {
+	for _, pin := range []string{"", "123", "1234567890123", "12a4"} {
+		if _, err := EncryptPINBlock(PINBlockFormat0, pin, "4111111111111111", testZPK); !errors.Is(err, ErrInvalidPIN) {
+			t.Fatalf("PIN %q: %v", pin, err)
+		}
+	}
+}
+
+func TestSoftwarePVVProvider(t *testing.T) {
+	pvk, _ := hex.DecodeString("0123456789ABCDEFFEDCBA9876543210")
+	p := NewSoftwarePVVProvider(pvk)
+
+	// TSP 1111111111111234 encrypts to 946B41C3A8F83E68
+	pvv, err := p.ComputePVV("4111111111111111", "1234", 1)
+	if err != nil {
+		t.Fatalf("compute: %v", err)
+	}
+	if pvv != "9464" {
+		t.Fatalf("pvv got %s want 9464", pvv)
+	}
+
+	if other, _ := p.ComputePVV("4111111111111111", "1235", 1); other == pvv {
+		t.Fatalf("another PIN gave the same PVV")
+	}
+}
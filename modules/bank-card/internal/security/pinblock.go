@@ -0,0 +1,212 @@
+package security
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/des"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/alovak/cardflow-playground/internal/cardgen"
+)
+
+// ISO 9564-1 PIN block 格式。
+// 格式 0 为 8 字节，在 3DES 区域 PIN 密钥（ZPK）下加密；
+// 格式 4 为 16 字节，在 AES 密钥下加密。
+const (
+	PINBlockFormat0 = 0
+	PINBlockFormat4 = 4
+)
+
+var (
+	// ErrInvalidPIN：PIN 不是 4-12 位数字。
+	ErrInvalidPIN = errors.New("invalid PIN")
+	// ErrInvalidPINBlock：PIN block 解密后格式不正确（密钥或 PAN 不匹配时也会出现）。
+	ErrInvalidPINBlock = errors.New("invalid PIN block")
+)
+
+// ValidatePIN 校验 PIN 为 4-12 位数字。
+func ValidatePIN(pin string) error {
+	if len(pin) < 4 || len(pin) > 12 || !cardgen.IsDigits(pin) {
+		return ErrInvalidPIN
+	}
+	return nil
+}
+
+// EncryptPINBlock 按 format（0 或 4）组装 PIN block 并在 zpk 下加密。
+// 格式 0 的 zpk 为 16/24 字节 3DES 密钥，格式 4 为 16/24/32 字节 AES 密钥。
+func EncryptPINBlock(format int, pin, pan string, zpk []byte) ([]byte, error) {
+	if err := ValidatePIN(pin); err != nil {
+		return nil, err
+	}
+	pan = cardgen.NormalizePAN(pan)
+
+	switch format {
+	case PINBlockFormat0:
+		block, err := newTripleDES(zpk)
+		if err != nil {
+			return nil, err
+		}
+		clear, err := ClearPINBlock0(pin, pan)
+		if err != nil {
+			return nil, err
+		}
+		out := make([]byte, des.BlockSize)
+		block.Encrypt(out, clear)
+		return out, nil
+	case PINBlockFormat4:
+		block, err := aes.NewCipher(zpk)
+		if err != nil {
+			return nil, fmt.Errorf("format 4 key: %w", err)
+		}
+		pinField, err := pinField4(pin)
+		if err != nil {
+			return nil, err
+		}
+		panField, err := panField4(pan)
+		if err != nil {
+			return nil, err
+		}
+		// A = E(PIN field)；B = A xor PAN field；结果 = E(B)
+		out := make([]byte, aes.BlockSize)
+		block.Encrypt(out, pinField)
+		xor(out, panField)
+		block.Encrypt(out, out)
+		return out, nil
+	default:
+		return nil, fmt.Errorf("PIN block format %d is not supported", format)
+	}
+}
+
+// DecryptPINBlock 解密 PIN block 并取出 PIN。格式由长度决定：
+// 8 字节为格式 0，16 字节为格式 4。
+func DecryptPINBlock(encrypted []byte, pan string, zpk []byte) (string, error) {
+	pan = cardgen.NormalizePAN(pan)
+
+	switch len(encrypted) {
+	case des.BlockSize:
+		block, err := newTripleDES(zpk)
+		if err != nil {
+			return "", err
+		}
+		panField, err := panField0(pan)
+		if err != nil {
+			return "", err
+		}
+		clear := make([]byte, des.BlockSize)
+		block.Decrypt(clear, encrypted)
+		xor(clear, panField)
+		return parsePINField(clear, 0x0, 'F')
+	case aes.BlockSize:
+		block, err := aes.NewCipher(zpk)
+		if err != nil {
+			return "", fmt.Errorf("format 4 key: %w", err)
+		}
+		panField, err := panField4(pan)
+		if err != nil {
+			return "", err
+		}
+		field := make([]byte, aes.BlockSize)
+		block.Decrypt(field, encrypted)
+		xor(field, panField)
+		block.Decrypt(field, field)
+		// 后 8 字节为随机填充，不校验
+		return parsePINField(field[:8], 0x4, 'A')
+	default:
+		return "", fmt.Errorf("%d bytes: %w", len(encrypted), ErrInvalidPINBlock)
+	}
+}
+
+// ClearPINBlock0 返回格式 0 的明文 PIN block：PIN 字段 xor PAN 字段。
+func ClearPINBlock0(pin, pan string) ([]byte, error) {
+	if err := ValidatePIN(pin); err != nil {
+		return nil, err
+	}
+	pinField, err := hex.DecodeString(fmt.Sprintf("0%X%s", len(pin), pin) + strings.Repeat("F", 14-len(pin)))
+	if err != nil {
+		return nil, err
+	}
+	panField, err := panField0(cardgen.NormalizePAN(pan))
+	if err != nil {
+		return nil, err
+	}
+	xor(pinField, panField)
+	return pinField, nil
+}
+
+// panField0：0000 + PAN 去校验位后的最右 12 位。
+func panField0(pan string) ([]byte, error) {
+	if len(pan) < 13 || !cardgen.IsDigits(pan) {
+		return nil, fmt.Errorf("PAN must be at least 13 digits")
+	}
+	noCD := pan[:len(pan)-1]
+	return hex.DecodeString("0000" + noCD[len(noCD)-12:])
+}
+
+// pinField4：4 + 长度 + PIN，以 A 填充至 16 个半字节，后接 8 字节随机数。
+func pinField4(pin string) ([]byte, error) {
+	field, err := hex.DecodeString(fmt.Sprintf("4%X%s", len(pin), pin) + strings.Repeat("A", 14-len(pin)))
+	if err != nil {
+		return nil, err
+	}
+	random := make([]byte, 8)
+	if _, err := rand.Read(random); err != nil {
+		return nil, err
+	}
+	return append(field, random...), nil
+}
+
+// panField4：PAN 长度减 12（M）+ PAN（不足 12 位左补 0），右补 0 至 32 个半字节。
+func panField4(pan string) ([]byte, error) {
+	if len(pan) == 0 || len(pan) > 19 || !cardgen.IsDigits(pan) {
+		return nil, fmt.Errorf("PAN must be 1-19 digits")
+	}
+	m := 0
+	if len(pan) > 12 {
+		m = len(pan) - 12
+	} else {
+		pan = strings.Repeat("0", 12-len(pan)) + pan
+	}
+	s := fmt.Sprintf("%d%s", m, pan)
+	return hex.DecodeString(s + strings.Repeat("0", 32-len(s)))
+}
+
+// parsePINField 校验控制位、长度与填充并返回 PIN。
+func parsePINField(field []byte, control byte, fill byte) (string, error) {
+	nibbles := strings.ToUpper(hex.EncodeToString(field))
+	if nibbles[0] != "0123456789ABCDEF"[control] {
+		return "", fmt.Errorf("control field %c: %w", nibbles[0], ErrInvalidPINBlock)
+	}
+	n := strings.IndexByte("0123456789ABCDEF", nibbles[1])
+	if n < 4 || n > 12 {
+		return "", fmt.Errorf("PIN length %d: %w", n, ErrInvalidPINBlock)
+	}
+	pin := nibbles[2 : 2+n]
+	if !cardgen.IsDigits(pin) || strings.Trim(nibbles[2+n:], string(fill)) != "" {
+		return "", ErrInvalidPINBlock
+	}
+	return pin, nil
+}
+
+// newTripleDES 接受双倍长（K1K2，按 K1K2K1 使用）或三倍长 3DES 密钥。
+func newTripleDES(key []byte) (cipher.Block, error) {
+	switch len(key) {
+	case 16:
+		k := make([]byte, 0, 24)
+		k = append(append(k, key...), key[:8]...)
+		return des.NewTripleDESCipher(k)
+	case 24:
+		return des.NewTripleDESCipher(key)
+	default:
+		return nil, fmt.Errorf("3DES key must be 16 or 24 bytes (got %d)", len(key))
+	}
+}
+
+func xor(dst, src []byte) {
+	for i := range dst {
+		dst[i] ^= src[i]
+	}
+}
@@ -12,5 +12,16 @@ type CVVProvider interface {
     // ComputeDisplayDCVV 计算用于 UI 展示的动态 CVV，返回 {cvv, ttlSec}。
     // step 为时间窗大小，width 取 3 或 4（其他值将按实现默认到 3）。
     ComputeDisplayDCVV(panNoCD, expiryYYMM, serviceCode string, step time.Duration, width int) (string, int, error)
+
+    // ComputeDCVVAt 计算 at 所在时间窗（at.Unix()/step）的动态 CVV 及该窗剩余秒数，
+    // 供发卡行在容忍时钟偏差时校验相邻时间窗。
+    ComputeDCVVAt(panNoCD, expiryYYMM, serviceCode string, at time.Time, step time.Duration, width int) (string, int, error)
 }
 
+
+// PVVProvider 计算 Visa PVV（PIN Verification Value），用于校验 PIN。
+// 实现可为软件（crypto/des）或 HSM（PKCS#11），PVK 不离开实现。
+type PVVProvider interface {
+    // ComputePVV 由完整 PAN、PIN（取最左 4 位）与 PVKI 计算 4 位 PVV。
+    ComputePVV(pan, pin string, pvki int) (string, error)
+}
@@ -1,5 +1,3 @@
-//go:build demo
-
 package security
 
 import (
@@ -43,6 +41,11 @@ func (p *DemoProvider) ComputeCVV2(panNoCD, yymm, sc string, width int) (string,
 
 // ComputeDisplayDCVV 计算用于展示的动态 CVV，返回 cvv 及剩余秒数。
 func (p *DemoProvider) ComputeDisplayDCVV(panNoCD, yymm, sc string, step time.Duration, width int) (string, int, error) {
+    return p.ComputeDCVVAt(panNoCD, yymm, sc, time.Now(), step, width)
+}
+
+// ComputeDCVVAt 计算 at 所在时间窗的动态 CVV，返回 cvv 及该窗剩余秒数。
+func (p *DemoProvider) ComputeDCVVAt(panNoCD, yymm, sc string, at time.Time, step time.Duration, width int) (string, int, error) {
     if len(p.key) == 0 {
         return "", 0, fmt.Errorf("cvv demo key is required")
     }
@@ -65,8 +68,7 @@ func (p *DemoProvider) ComputeDisplayDCVV(panNoCD, yymm, sc string, step time.Du
     pan := buildValidPAN(panNoCD)
     // 统一归一化步长（至少1s、按秒对齐），并使用 UTC 时间
     step = normalizeStep(step)
-    now := time.Now().UTC()
-    cvv, ttl, err := DynamicCVVWithTTLStrict(pan, yymm, sc, now, step, width, p.key)
+    cvv, ttl, err := DynamicCVVWithTTLStrict(pan, yymm, sc, at.UTC(), step, width, p.key)
     if err != nil {
         return "", 0, err
     }
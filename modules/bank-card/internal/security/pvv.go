@@ -0,0 +1,86 @@
+package security
+
+import (
+	"crypto/des"
+	"encoding/hex"
+	"fmt"
+	"os"
+
+	"github.com/alovak/cardflow-playground/internal/cardgen"
+)
+
+// 注意：演示密钥仅供开发/离线联调，生产环境请使用 HSM 中的 PVK/ZPK。
+
+// DemoPVK returns the demo PIN verification key: hex from PVK_DEMO or a static
+// double-length fallback (NOT SAFE FOR PROD).
+func DemoPVK() []byte {
+	return demoHexKey("PVK_DEMO", "0123456789ABCDEFFEDCBA9876543210")
+}
+
+// DemoZPK returns the demo zone PIN key PIN blocks are encrypted under: hex
+// from ZPK_DEMO or a static fallback (NOT SAFE FOR PROD). The same 16 bytes
+// are a double-length 3DES key for format 0 and an AES-128 key for format 4.
+func DemoZPK() []byte {
+	return demoHexKey("ZPK_DEMO", "89ABCDEF0123456776543210FEDCBA98")
+}
+
+// demoHexKey：环境变量不是合法十六进制时返回 nil，由使用方报错。
+func demoHexKey(env, fallback string) []byte {
+	value := os.Getenv(env)
+	if value == "" {
+		value = fallback
+	}
+	key, err := hex.DecodeString(value)
+	if err != nil {
+		return nil
+	}
+	return key
+}
+
+// PVVInput 组装 Visa PVV 的转换源（TSP）：PAN 去校验位后的最右 11 位 +
+// PVKI（1 位）+ PIN 的最左 4 位，共 16 个半字节。
+func PVVInput(pan, pin string, pvki int) ([]byte, error) {
+	pan = cardgen.NormalizePAN(pan)
+	if len(pan) < 12 || !cardgen.IsDigits(pan) {
+		return nil, fmt.Errorf("PAN must be at least 12 digits")
+	}
+	if err := ValidatePIN(pin); err != nil {
+		return nil, err
+	}
+	if pvki < 0 || pvki > 9 {
+		return nil, fmt.Errorf("PVKI must be 0-9 (got %d)", pvki)
+	}
+	noCD := pan[:len(pan)-1]
+	return hex.DecodeString(fmt.Sprintf("%s%d%s", noCD[len(noCD)-11:], pvki, pin[:4]))
+}
+
+// DecimalizePVV 用与 CVV 相同的十进制化表从 TSP 的密文中取 4 位 PVV。
+func DecimalizePVV(encrypted []byte) string {
+	return decimalize(encrypted, 4)
+}
+
+// SoftwarePVVProvider：纯 Go（crypto/des）实现的 PVV 计算，PVK 在进程内存中。
+type SoftwarePVVProvider struct {
+	pvk []byte
+}
+
+func NewSoftwarePVVProvider(pvk []byte) *SoftwarePVVProvider {
+	return &SoftwarePVVProvider{pvk: pvk}
+}
+
+// ComputePVV 在 PVK（双倍长 3DES）下加密 TSP 并十进制化。
+func (p *SoftwarePVVProvider) ComputePVV(pan, pin string, pvki int) (string, error) {
+	block, err := newTripleDES(p.pvk)
+	if err != nil {
+		return "", fmt.Errorf("pvk: %w", err)
+	}
+	tsp, err := PVVInput(pan, pin, pvki)
+	if err != nil {
+		return "", err
+	}
+	out := make([]byte, des.BlockSize)
+	block.Encrypt(out, tsp)
+	return DecimalizePVV(out), nil
+}
+
+var _ PVVProvider = (*SoftwarePVVProvider)(nil)
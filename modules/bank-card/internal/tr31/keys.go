@@ -0,0 +1,131 @@
+package tr31
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/alovak/cardflow-playground/internal/keys"
+)
+
+type usage struct {
+	usage   string
+	purpose keys.Purpose
+	mode    byte
+}
+
+// usages are the key usages of the purposes of the key store. K0 and K1
+// (a TR-31 KBPK) both import as a ZMK; a ZMK exports as K0.
+var usages = []usage{
+	{"C0", keys.PurposeCVK, ModeGenerate},
+	{"V2", keys.PurposePVK, ModeGenerate},
+	{"P0", keys.PurposeZPK, ModeBoth},
+	{"K0", keys.PurposeZMK, ModeBoth},
+	{"K1", keys.PurposeZMK, ModeBoth},
+	{"D0", keys.PurposeDEK, ModeBoth},
+}
+
+var algorithms = map[byte]keys.Algorithm{
+	AlgorithmTDES: keys.AlgorithmTDES,
+	AlgorithmAES:  keys.AlgorithmAES,
+	AlgorithmHMAC: keys.AlgorithmHMAC,
+}
+
+// Import unwraps a key block under the KBPK, a TDES or AES ZMK of the key
+// store, and returns the purpose, algorithm and clear value of its key. A
+// "KC" optional block must match the key's KCV.
+func Import(kbpk *keys.Key, block string) (keys.Purpose, keys.Algorithm, []byte, error) {
+	h, material, err := Unwrap(kbpk.Material(), block)
+	if err != nil {
+		return "", "", nil, err
+	}
+	purpose, ok := purposeOf(h.KeyUsage)
+	if !ok {
+		return "", "", nil, fmt.Errorf("key usage %s: %w", h.KeyUsage, ErrUnsupported)
+	}
+	alg, ok := algorithms[h.Algorithm]
+	if !ok {
+		return "", "", nil, fmt.Errorf("algorithm %q: %w", h.Algorithm, ErrUnsupported)
+	}
+	if err := keys.Validate(purpose, alg, material); err != nil {
+		return "", "", nil, err
+	}
+	if kc, ok := h.Block("KC"); ok {
+		// the KCV method ("00" legacy, "01" CMAC) and the KCV
+		if len(kc) < 2 {
+			return "", "", nil, fmt.Errorf("optional block KC %q: %w", kc, ErrMalformed)
+		}
+		if err := keys.CheckKCV(alg, material, kc[2:]); err != nil {
+			return "", "", nil, err
+		}
+	}
+	return purpose, alg, material, nil
+}
+
+// Export wraps a key of the store under the KBPK in a version B block for a
+// TDES KBPK, a version D block for an AES one. The header carries the KCVs
+// of the key ("KC") and of the KBPK ("KP").
+func Export(kbpk, key *keys.Key, exportability byte) (string, error) {
+	version := VersionB
+	switch kbpk.Algorithm {
+	case keys.AlgorithmTDES:
+	case keys.AlgorithmAES:
+		version = VersionD
+	default:
+		return "", fmt.Errorf("%s cannot wrap keys: %w", kbpk, ErrInvalidKBPK)
+	}
+
+	u, ok := usageOf(key.Purpose)
+	if !ok {
+		return "", fmt.Errorf("%s has no key usage: %w", key.Purpose, ErrUnsupported)
+	}
+	h := Header{
+		Version:       version,
+		KeyUsage:      u.usage,
+		Algorithm:     algorithmCode(key.Algorithm),
+		ModeOfUse:     u.mode,
+		KeyVersion:    "00",
+		Exportability: exportability,
+	}
+	if key.Algorithm != keys.AlgorithmHMAC {
+		h.Blocks = append(h.Blocks, OptionalBlock{ID: "KC", Data: kcvBlock(key)})
+	}
+	h.Blocks = append(h.Blocks, OptionalBlock{ID: "KP", Data: kcvBlock(kbpk)})
+	return Wrap(kbpk.Material(), h, key.Material())
+}
+
+// usageOf returns the first key usage of the purpose.
+func usageOf(purpose keys.Purpose) (usage, bool) {
+	for _, u := range usages {
+		if u.purpose == purpose {
+			return u, true
+		}
+	}
+	return usage{}, false
+}
+
+func algorithmCode(alg keys.Algorithm) byte {
+	for code, a := range algorithms {
+		if a == alg {
+			return code
+		}
+	}
+	return 0
+}
+
+func purposeOf(usage string) (keys.Purpose, bool) {
+	for _, u := range usages {
+		if u.usage == strings.ToUpper(usage) {
+			return u.purpose, true
+		}
+	}
+	return "", false
+}
+
+// kcvBlock is the data of a KC or KP block: the KCV method, "00" for the
+// encrypted zero block of TDES, "01" for the CMAC of AES, and the KCV.
+func kcvBlock(key *keys.Key) string {
+	if key.Algorithm == keys.AlgorithmAES {
+		return "01" + key.KCV
+	}
+	return "00" + key.KCV
+}
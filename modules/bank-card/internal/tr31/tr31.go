@@ -0,0 +1,407 @@
+// Package tr31 parses, builds, wraps and unwraps ANSI X9.143 (TR-31) key
+// blocks, the format keys are exchanged with partners in.
+//
+// A key block is printable ASCII: a 16 character header, optional blocks,
+// the encrypted key in hex and the MAC in hex.
+//
+//	D0160P0AE00E0100  version, length, usage, algorithm, mode of use,
+//	                  key version, exportability, optional blocks, reserved
+//	KC1001377822C093  optional blocks: ID, length in hex, data
+//	...               encrypted key data, then the MAC
+//
+// Two versions are supported, both binding the key to its header with the
+// key derivation method: the encryption and MAC keys are derived from the
+// key block protection key (KBPK) with CMAC in counter mode (NIST SP
+// 800-108), the MAC is the CMAC of the header and the clear key data, and
+// the key data is encrypted in CBC mode with the MAC as IV.
+//
+//	B  TDES KBPK, TDES-CMAC, 8 byte MAC
+//	D  AES KBPK, AES-CMAC, 16 byte MAC
+package tr31
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/alovak/cardflow-playground/internal/keys"
+)
+
+// Version is the key block version ID, the first character of the header.
+type Version byte
+
+const (
+	// VersionB protects keys under a TDES KBPK.
+	VersionB Version = 'B'
+	// VersionD protects keys under an AES KBPK.
+	VersionD Version = 'D'
+)
+
+// Algorithms of the wrapped key.
+const (
+	AlgorithmTDES = 'T'
+	AlgorithmAES  = 'A'
+	AlgorithmHMAC = 'H'
+)
+
+// Modes of use of the wrapped key.
+const (
+	ModeBoth     = 'B' // encrypt and decrypt, wrap and unwrap
+	ModeGenerate = 'C' // compute and verify: MAC, CVV, PVV
+	ModeDecrypt  = 'D'
+	ModeEncrypt  = 'E'
+	ModeVerify   = 'V'
+	ModeNone     = 'N'
+)
+
+// Exportability of the wrapped key.
+const (
+	ExportTrusted   = 'E' // may be exported under a trusted key
+	ExportNone      = 'N' // may not be exported
+	ExportSensitive = 'S' // may be exported under any key
+)
+
+const headerLen = 16
+
+var (
+	ErrMalformed   = errors.New("malformed key block")
+	ErrUnsupported = errors.New("unsupported key block")
+	ErrInvalidKBPK = errors.New("invalid key block protection key")
+	ErrInvalidMAC  = errors.New("key block MAC does not verify")
+)
+
+// Header is what a key block tells about its key.
+type Header struct {
+	Version       Version
+	KeyUsage      string // two characters: "C0" CVK, "P0" PIN encryption, ...
+	Algorithm     byte
+	ModeOfUse     byte
+	KeyVersion    string // two characters, "00" when not used
+	Exportability byte
+	// Blocks are the optional blocks, without the padding block
+	Blocks []OptionalBlock
+}
+
+// OptionalBlock is an optional block of the header, such as "KS" (key set
+// ID) or "KC" (KCV of the wrapped key).
+type OptionalBlock struct {
+	ID   string
+	Data string
+}
+
+// Block returns the data of the optional block with the ID.
+func (h Header) Block(id string) (string, bool) {
+	for _, b := range h.Blocks {
+		if b.ID == id {
+			return b.Data, true
+		}
+	}
+	return "", false
+}
+
+// blockSize is the cipher block size of the version.
+func (v Version) blockSize() (int, error) {
+	switch v {
+	case VersionB:
+		return 8, nil
+	case VersionD:
+		return 16, nil
+	}
+	return 0, fmt.Errorf("version %q: %w", byte(v), ErrUnsupported)
+}
+
+// encode returns the header and its optional blocks, padded with a "PB"
+// block to a multiple of the cipher block size, for a block of total
+// length bodyLen plus the header's.
+func (h Header) encode(bodyLen int) (string, error) {
+	size, err := h.Version.blockSize()
+	if err != nil {
+		return "", err
+	}
+	if len(h.KeyUsage) != 2 || h.KeyVersion != "" && len(h.KeyVersion) != 2 {
+		return "", fmt.Errorf("key usage %q, key version %q: %w", h.KeyUsage, h.KeyVersion, ErrMalformed)
+	}
+	for _, c := range []byte{h.Algorithm, h.ModeOfUse, h.Exportability} {
+		if !printable(string(c)) {
+			return "", fmt.Errorf("header field %q: %w", c, ErrMalformed)
+		}
+	}
+	keyVersion := h.KeyVersion
+	if keyVersion == "" {
+		keyVersion = "00"
+	}
+
+	var blocks strings.Builder
+	count := len(h.Blocks)
+	for _, b := range h.Blocks {
+		if len(b.ID) != 2 || b.ID == "PB" || !printable(b.ID+b.Data) {
+			return "", fmt.Errorf("optional block %q: %w", b.ID, ErrMalformed)
+		}
+		blocks.WriteString(encodeOptionalBlock(b))
+	}
+	if pad := (headerLen + blocks.Len()) % size; pad != 0 {
+		pad = size - pad
+		if pad < 4 {
+			pad += size
+		}
+		blocks.WriteString(fmt.Sprintf("PB%02X%s", pad, strings.Repeat("0", pad-4)))
+		count++
+	}
+	if count > 99 {
+		return "", fmt.Errorf("%d optional blocks: %w", count, ErrMalformed)
+	}
+
+	total := headerLen + blocks.Len() + bodyLen
+	if total > 9999 {
+		return "", fmt.Errorf("key block of %d characters: %w", total, ErrMalformed)
+	}
+	return fmt.Sprintf("%c%04d%s%c%c%s%c%02d00%s", h.Version, total, h.KeyUsage, h.Algorithm, h.ModeOfUse,
+		keyVersion, h.Exportability, count, blocks.String()), nil
+}
+
+// encodeOptionalBlock writes the length in two hex digits, or as "00", the
+// number of digits and the length when it does not fit.
+func encodeOptionalBlock(b OptionalBlock) string {
+	if n := 4 + len(b.Data); n <= 0xFF {
+		return fmt.Sprintf("%s%02X%s", b.ID, n, b.Data)
+	}
+	n := 10 + len(b.Data)
+	return fmt.Sprintf("%s0004%04X%s", b.ID, n, b.Data)
+}
+
+// ParseHeader reads the header of a key block and returns it with the
+// length of the header and its optional blocks.
+func ParseHeader(block string) (Header, int, error) {
+	if len(block) < headerLen || !printable(block) {
+		return Header{}, 0, fmt.Errorf("header: %w", ErrMalformed)
+	}
+	h := Header{
+		Version:       Version(block[0]),
+		KeyUsage:      block[5:7],
+		Algorithm:     block[7],
+		ModeOfUse:     block[8],
+		KeyVersion:    block[9:11],
+		Exportability: block[11],
+	}
+	if _, err := h.Version.blockSize(); err != nil {
+		return Header{}, 0, err
+	}
+	total, err := strconv.Atoi(block[1:5])
+	if err != nil || total != len(block) {
+		return Header{}, 0, fmt.Errorf("length %q of a block of %d characters: %w", block[1:5], len(block), ErrMalformed)
+	}
+	count, err := strconv.Atoi(block[12:14])
+	if err != nil {
+		return Header{}, 0, fmt.Errorf("number of optional blocks %q: %w", block[12:14], ErrMalformed)
+	}
+
+	pos := headerLen
+	for i := 0; i < count; i++ {
+		if pos+4 > len(block) {
+			return Header{}, 0, fmt.Errorf("optional block %d: %w", i+1, ErrMalformed)
+		}
+		id := block[pos : pos+2]
+		n, dataStart, err := optionalBlockLength(block, pos)
+		if err != nil {
+			return Header{}, 0, fmt.Errorf("optional block %s: %w", id, err)
+		}
+		if n < dataStart-pos || pos+n > len(block) {
+			return Header{}, 0, fmt.Errorf("optional block %s of %d characters: %w", id, n, ErrMalformed)
+		}
+		if id != "PB" {
+			h.Blocks = append(h.Blocks, OptionalBlock{ID: id, Data: block[dataStart : pos+n]})
+		}
+		pos += n
+	}
+	return h, pos, nil
+}
+
+// optionalBlockLength returns the length of the optional block at pos and
+// where its data starts.
+func optionalBlockLength(block string, pos int) (int, int, error) {
+	n, err := strconv.ParseUint(block[pos+2:pos+4], 16, 8)
+	if err != nil {
+		return 0, 0, ErrMalformed
+	}
+	if n != 0 {
+		return int(n), pos + 4, nil
+	}
+	// extended length: "00", the number of hex digits of the length, the length
+	if pos+6 > len(block) {
+		return 0, 0, ErrMalformed
+	}
+	digits, err := strconv.ParseUint(block[pos+4:pos+6], 16, 8)
+	if err != nil || digits == 0 || digits > 8 || pos+6+int(digits) > len(block) {
+		return 0, 0, ErrMalformed
+	}
+	n, err = strconv.ParseUint(block[pos+6:pos+6+int(digits)], 16, 32)
+	if err != nil {
+		return 0, 0, ErrMalformed
+	}
+	return int(n), pos + 6 + int(digits), nil
+}
+
+// Wrap builds the key block of the key under the KBPK: a TDES KBPK for
+// version B, an AES one for version D.
+func Wrap(kbpk []byte, h Header, key []byte) (string, error) {
+	size, err := h.Version.blockSize()
+	if err != nil {
+		return "", err
+	}
+	kbek, kbmk, err := deriveKeys(h.Version, kbpk)
+	if err != nil {
+		return "", err
+	}
+	if len(key) == 0 || len(key) > 0xFFFF/8 {
+		return "", fmt.Errorf("key of %d bytes: %w", len(key), ErrMalformed)
+	}
+
+	// the key is padded to the longest key of its algorithm so the block
+	// does not tell the key length, then to whole cipher blocks
+	padded := len(key)
+	switch h.Algorithm {
+	case AlgorithmTDES:
+		padded = maxInt(padded, 24)
+	case AlgorithmAES:
+		padded = maxInt(padded, 32)
+	}
+	dataLen := 2 + padded
+	dataLen += (size - dataLen%size) % size
+	data := make([]byte, dataLen)
+	data[0], data[1] = byte(len(key)*8>>8), byte(len(key)*8)
+	copy(data[2:], key)
+	if _, err := rand.Read(data[2+len(key):]); err != nil {
+		return "", err
+	}
+
+	macLen := size
+	header, err := h.encode(2*len(data) + 2*macLen)
+	if err != nil {
+		return "", err
+	}
+	mac := computeMAC(kbmk, header, data)
+	encrypted := make([]byte, len(data))
+	cipher.NewCBCEncrypter(kbek, mac[:size]).CryptBlocks(encrypted, data)
+	return header + strings.ToUpper(hex.EncodeToString(encrypted)+hex.EncodeToString(mac)), nil
+}
+
+// Unwrap verifies the key block under the KBPK and returns its header and
+// the clear key.
+func Unwrap(kbpk []byte, block string) (Header, []byte, error) {
+	h, pos, err := ParseHeader(block)
+	if err != nil {
+		return Header{}, nil, err
+	}
+	size, _ := h.Version.blockSize()
+	if pos%size != 0 {
+		return Header{}, nil, fmt.Errorf("header of %d characters: %w", pos, ErrMalformed)
+	}
+	kbek, kbmk, err := deriveKeys(h.Version, kbpk)
+	if err != nil {
+		return Header{}, nil, err
+	}
+
+	body, err := hex.DecodeString(block[pos:])
+	if err != nil || len(body) < 2*size || len(body)%size != 0 {
+		return Header{}, nil, fmt.Errorf("key data: %w", ErrMalformed)
+	}
+	encrypted, mac := body[:len(body)-size], body[len(body)-size:]
+	data := make([]byte, len(encrypted))
+	cipher.NewCBCDecrypter(kbek, mac).CryptBlocks(data, encrypted)
+
+	if !hmac.Equal(mac, computeMAC(kbmk, block[:pos], data)) {
+		return Header{}, nil, ErrInvalidMAC
+	}
+	bits := int(data[0])<<8 | int(data[1])
+	if bits == 0 || bits%8 != 0 || 2+bits/8 > len(data) {
+		return Header{}, nil, fmt.Errorf("key length of %d bits: %w", bits, ErrMalformed)
+	}
+	return h, data[2 : 2+bits/8], nil
+}
+
+// deriveKeys derives the key block encryption and MAC keys (KBEK, KBMK)
+// from the KBPK. Each CMAC of the derivation data is one block of them:
+//
+//	counter (1) | usage 0000 encryption, 0001 MAC (2) | 00 | algorithm (2) | length in bits (2)
+func deriveKeys(version Version, kbpk []byte) (cipher.Block, cipher.Block, error) {
+	var (
+		block     cipher.Block
+		algorithm uint16
+		err       error
+	)
+	switch version {
+	case VersionB:
+		switch len(kbpk) {
+		case 16:
+			algorithm = 0x0000
+		case 24:
+			algorithm = 0x0001
+		default:
+			return nil, nil, fmt.Errorf("version B takes a TDES KBPK of 16 or 24 bytes, not %d: %w", len(kbpk), ErrInvalidKBPK)
+		}
+		block, err = keys.NewTripleDES(kbpk)
+	case VersionD:
+		switch len(kbpk) {
+		case 16, 24, 32:
+			algorithm = uint16(len(kbpk) / 8) // 0002, 0003, 0004
+		default:
+			return nil, nil, fmt.Errorf("version D takes an AES KBPK of 16, 24 or 32 bytes, not %d: %w", len(kbpk), ErrInvalidKBPK)
+		}
+		block, err = aes.NewCipher(kbpk)
+	default:
+		return nil, nil, fmt.Errorf("version %q: %w", byte(version), ErrUnsupported)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	bits := len(kbpk) * 8
+	derive := func(usage byte) []byte {
+		var out []byte
+		for counter := byte(1); len(out) < len(kbpk); counter++ {
+			data := []byte{counter, 0, usage, 0, byte(algorithm >> 8), byte(algorithm), byte(bits >> 8), byte(bits)}
+			out = append(out, keys.CMAC(block, data)...)
+		}
+		return out[:len(kbpk)]
+	}
+	newCipher := keys.NewTripleDES
+	if version == VersionD {
+		newCipher = aes.NewCipher
+	}
+	kbek, err := newCipher(derive(0))
+	if err != nil {
+		return nil, nil, err
+	}
+	kbmk, err := newCipher(derive(1))
+	if err != nil {
+		return nil, nil, err
+	}
+	return kbek, kbmk, nil
+}
+
+// computeMAC is the CMAC under the KBMK of the header and the clear key data.
+func computeMAC(kbmk cipher.Block, header string, data []byte) []byte {
+	return keys.CMAC(kbmk, append([]byte(header), data...))
+}
+
+func printable(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] < 0x20 || s[i] > 0x7E {
+			return false
+		}
+	}
+	return true
+}
+
+func maxInt(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
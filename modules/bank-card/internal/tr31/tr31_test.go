@@ -0,0 +1,162 @@
+package tr31
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/alovak/cardflow-playground/internal/keys"
+)
+
+func mustHex(t *testing.T, s string) []byte {
+	t.Helper()
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		t.Fatalf("hex %q: %v", s, err)
+	}
+	return b
+}
+
+func TestUnwrapVectors(t *testing.T) {
+	// ANSI X9.143 examples of a PIN encryption key
+	for _, tc := range []struct {
+		kbpk  string
+		block string
+	}{
+		{"DD7515F2BFC17F85CE48F3CA25CB21F6", "B0080P0TE00E000094B420079CC80BA3461F86FE26EFC4A3B8E4FA4C5F5341176EED7B727B8A248E"},
+		{"88E1AB2A2E3DD38C1FA039A536500CC8A87AB9D62DC92C01058FA79F44657DE6", "D0112P0AE00E0000B82679114F470F540165EDFBF7E250FCEA43F810D215F8D207E2E417C07156A27E8E31DA05F7425509593D03A457DC34"},
+	} {
+		h, key, err := Unwrap(mustHex(t, tc.kbpk), tc.block)
+		if err != nil {
+			t.Fatalf("unwrap %s: %v", tc.block[:16], err)
+		}
+		if h.KeyUsage != "P0" || h.ModeOfUse != ModeEncrypt || h.Exportability != ExportTrusted {
+			t.Fatalf("header %+v", h)
+		}
+		if got := strings.ToUpper(hex.EncodeToString(key)); got != "3F419E1CB7079442AA37474C2EFBF8B8" {
+			t.Fatalf("key %s", got)
+		}
+	}
+}
+
+func TestWrap(t *testing.T) {
+	key := mustHex(t, "0123456789ABCDEFFEDCBA9876543210")
+	long := strings.Repeat("X", 300)
+	for _, tc := range []struct {
+		version Version
+		kbpk    []byte
+	}{
+		{VersionB, bytes.Repeat([]byte{0x11}, 16)},
+		{VersionB, bytes.Repeat([]byte{0x12}, 24)},
+		{VersionD, bytes.Repeat([]byte{0x21}, 16)},
+		{VersionD, bytes.Repeat([]byte{0x22}, 24)},
+		{VersionD, bytes.Repeat([]byte{0x23}, 32)},
+	} {
+		h := Header{
+			Version:       tc.version,
+			KeyUsage:      "C0",
+			Algorithm:     AlgorithmTDES,
+			ModeOfUse:     ModeGenerate,
+			KeyVersion:    "01",
+			Exportability: ExportNone,
+			Blocks:        []OptionalBlock{{ID: "KS", Data: "00604B120F9292800000"}, {ID: "HM", Data: long}},
+		}
+		block, err := Wrap(tc.kbpk, h, key)
+		if err != nil {
+			t.Fatalf("wrap %c/%d: %v", tc.version, len(tc.kbpk), err)
+		}
+
+		parsed, pos, err := ParseHeader(block)
+		if err != nil {
+			t.Fatalf("parse %s: %v", block, err)
+		}
+		size, _ := tc.version.blockSize()
+		if pos%size != 0 || !strings.Contains(block[:pos], "PB") {
+			t.Fatalf("header of %d characters is not padded: %s", pos, block[:pos])
+		}
+		if parsed.KeyVersion != "01" || len(parsed.Blocks) != 2 {
+			t.Fatalf("parsed %+v", parsed)
+		}
+		if data, _ := parsed.Block("HM"); data != long {
+			t.Fatalf("extended length block %q", data)
+		}
+
+		_, clear, err := Unwrap(tc.kbpk, block)
+		if err != nil || !bytes.Equal(clear, key) {
+			t.Fatalf("unwrap %c/%d: %X, %v", tc.version, len(tc.kbpk), clear, err)
+		}
+
+		// the header is bound to the key
+		tampered := block[:8] + "E" + block[9:]
+		if _, _, err := Unwrap(tc.kbpk, tampered); !errors.Is(err, ErrInvalidMAC) {
+			t.Fatalf("tampered mode of use: %v", err)
+		}
+		wrong := append([]byte(nil), tc.kbpk...)
+		wrong[0] ^= 0x02 // not a DES parity bit
+		if _, _, err := Unwrap(wrong, block); !errors.Is(err, ErrInvalidMAC) {
+			t.Fatalf("wrong KBPK: %v", err)
+		}
+	}
+
+	if _, err := Wrap(bytes.Repeat([]byte{1}, 32), Header{Version: VersionB, KeyUsage: "C0", Algorithm: 'T', ModeOfUse: 'C', Exportability: 'N'}, key); !errors.Is(err, ErrInvalidKBPK) {
+		t.Fatalf("version B under an AES-256 KBPK: %v", err)
+	}
+	if _, _, err := ParseHeader("A0072P0TE00E0000"); !errors.Is(err, ErrUnsupported) {
+		t.Fatalf("version A: %v", err)
+	}
+	if _, _, err := ParseHeader("B0096P0TE00E0000"); !errors.Is(err, ErrMalformed) {
+		t.Fatalf("wrong length: %v", err)
+	}
+}
+
+func TestImportExport(t *testing.T) {
+	store := keys.NewStore()
+	tdesZMK, _ := store.Import(keys.PurposeZMK, keys.AlgorithmTDES, mustHex(t, "89E88CF7931444F334BD7547FC3F380C"))
+	cvk, _ := store.Import(keys.PurposeCVK, keys.AlgorithmTDES, mustHex(t, "0123456789ABCDEFFEDCBA9876543210"))
+	aesZMK, _ := store.Import(keys.PurposeZMK, keys.AlgorithmAES, bytes.Repeat([]byte{0x5A}, 32))
+	zpk, _ := store.Import(keys.PurposeZPK, keys.AlgorithmAES, bytes.Repeat([]byte{0x3C}, 16))
+
+	for _, tc := range []struct {
+		kbpk, key *keys.Key
+		prefix    string
+	}{
+		{tdesZMK, cvk, "B"},
+		{aesZMK, zpk, "D"},
+		{aesZMK, cvk, "D"},
+	} {
+		block, err := Export(tc.kbpk, tc.key, ExportTrusted)
+		if err != nil {
+			t.Fatalf("export %s: %v", tc.key, err)
+		}
+		if !strings.HasPrefix(block, tc.prefix) || !strings.Contains(block, "KC") || !strings.Contains(block, "KP") {
+			t.Fatalf("block %s", block)
+		}
+		purpose, alg, material, err := Import(tc.kbpk, block)
+		if err != nil {
+			t.Fatalf("import %s: %v", block, err)
+		}
+		if purpose != tc.key.Purpose || alg != tc.key.Algorithm || !bytes.Equal(material, tc.key.Material()) {
+			t.Fatalf("imported %s %s %X, want %s", purpose, alg, material, tc.key)
+		}
+	}
+
+	// the KCV in the KC block must be the key's
+	h := Header{Version: VersionB, KeyUsage: "C0", Algorithm: AlgorithmTDES, ModeOfUse: ModeGenerate, Exportability: ExportTrusted,
+		Blocks: []OptionalBlock{{ID: "KC", Data: "00000000"}}}
+	block, err := Wrap(tdesZMK.Material(), h, cvk.Material())
+	if err != nil {
+		t.Fatalf("wrap: %v", err)
+	}
+	if _, _, _, err := Import(tdesZMK, block); !errors.Is(err, keys.ErrKCVMismatch) {
+		t.Fatalf("wrong KC: %v", err)
+	}
+
+	// keys the store has no purpose for are refused
+	h = Header{Version: VersionB, KeyUsage: "M3", Algorithm: AlgorithmTDES, ModeOfUse: ModeGenerate, Exportability: ExportTrusted}
+	block, _ = Wrap(tdesZMK.Material(), h, cvk.Material())
+	if _, _, _, err := Import(tdesZMK, block); !errors.Is(err, ErrUnsupported) {
+		t.Fatalf("key usage M3: %v", err)
+	}
+}
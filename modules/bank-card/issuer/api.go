@@ -5,6 +5,7 @@ import (
 	"errors"
 	"net/http"
 
+	"github.com/alovak/cardflow-playground/internal/security"
 	"github.com/alovak/cardflow-playground/issuer/models"
 	"github.com/go-chi/chi/v5"
 )
@@ -28,7 +29,31 @@ func (a *API) AppendRoutes(r chi.Router) {
             r.Post("/cards", a.issueCard)
             // Allow setting cardholder name after card issuance (Core Bank link step)
             r.Post("/cards/{cardID}/holder", a.setCardholderName)
+            // Card lifecycle: read current status + audit trail, move to another status
+            r.Get("/cards/{cardID}/status", a.getCardStatus)
+            r.Put("/cards/{cardID}/status", a.changeCardStatus)
+            // Replacing a card closes it and issues a new one for the replacement fee
+            r.Post("/cards/{cardID}/replace", a.replaceCard)
+            // PIN: set the first one, change with the old PIN, reset by issuer operations (unblocks), tries left
+            r.Get("/cards/{cardID}/pin", a.getPINStatus)
+            r.Put("/cards/{cardID}/pin", a.setPIN)
+            r.Post("/cards/{cardID}/pin/change", a.changePIN)
+            r.Post("/cards/{cardID}/pin/reset", a.resetPIN)
+            // dCVV: enable dynamic CVVs, read the current code and its TTL for the app
+            r.Get("/cards/{cardID}/dcvv", a.getDCVV)
+            r.Put("/cards/{cardID}/dcvv", a.setDCVV)
             r.Get("/transactions", a.getTransactions)
+            // Disputes: the cardholder disputes a posted transaction, the dispute moves
+            // through chargeback, representment and pre-arbitration to WON or LOST
+            r.Post("/transactions/{txID}/disputes", a.openDispute)
+            r.Get("/disputes", a.listDisputes)
+            r.Get("/disputes/{disputeID}", a.getDispute)
+            r.Put("/disputes/{disputeID}/status", a.changeDisputeStatus)
+            // Credit accounts: payments towards the balance, monthly statements
+            r.Post("/payments", a.makePayment)
+            r.Get("/statements", a.listStatements)
+            // Fees: what a hypothetical transaction would be charged, nothing is posted
+            r.Post("/fees/quote", a.quoteFees)
         })
     })
 }
@@ -43,7 +68,11 @@ func (a *API) createAccount(w http.ResponseWriter, r *http.Request) {
 
 	account, err := a.issuer.CreateAccount(create)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		if errors.Is(err, models.ErrInvalidAccount) {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+		} else {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
 		return
 	}
 
@@ -67,7 +96,10 @@ func (a *API) getAccount(w http.ResponseWriter, r *http.Request) {
 
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
-	json.NewEncoder(w).Encode(account)
+	json.NewEncoder(w).Encode(struct {
+		*models.Account
+		OpenToBuy int64
+	}{account, account.OpenToBuy()})
 }
 
 func (a *API) issueCard(w http.ResponseWriter, r *http.Request) {
@@ -124,6 +156,71 @@ func (a *API) setCardholderName(w http.ResponseWriter, r *http.Request) {
     }{updated, face})
 }
 
+func (a *API) getCardStatus(w http.ResponseWriter, r *http.Request) {
+    accountID := chi.URLParam(r, "accountID")
+    cardID := chi.URLParam(r, "cardID")
+
+    card, history, err := a.issuer.GetCardStatus(accountID, cardID)
+    if err != nil {
+        if errors.Is(err, ErrNotFound) {
+            http.Error(w, err.Error(), http.StatusNotFound)
+        } else {
+            http.Error(w, err.Error(), http.StatusInternalServerError)
+        }
+        return
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    w.WriteHeader(http.StatusOK)
+    json.NewEncoder(w).Encode(models.CardStatusResponse{
+        CardID:  card.ID,
+        Status:  card.Status,
+        History: history,
+    })
+}
+
+// changeCardStatus moves a card to another lifecycle status.
+// Request body: {"status": "FROZEN", "reason": "customer request", "actor": "support:jdoe"}
+func (a *API) changeCardStatus(w http.ResponseWriter, r *http.Request) {
+    accountID := chi.URLParam(r, "accountID")
+    cardID := chi.URLParam(r, "cardID")
+
+    change := models.ChangeCardStatus{}
+    if err := json.NewDecoder(r.Body).Decode(&change); err != nil {
+        http.Error(w, err.Error(), http.StatusBadRequest)
+        return
+    }
+    if !change.Status.Valid() {
+        http.Error(w, "unknown card status", http.StatusBadRequest)
+        return
+    }
+    if change.Actor == "" {
+        http.Error(w, "actor is required", http.StatusBadRequest)
+        return
+    }
+
+    card, audit, err := a.issuer.ChangeCardStatus(accountID, cardID, change)
+    if err != nil {
+        switch {
+        case errors.Is(err, ErrNotFound):
+            http.Error(w, err.Error(), http.StatusNotFound)
+        case errors.Is(err, models.ErrInvalidCardStatusTransition):
+            http.Error(w, err.Error(), http.StatusConflict)
+        default:
+            http.Error(w, err.Error(), http.StatusInternalServerError)
+        }
+        return
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    w.WriteHeader(http.StatusOK)
+    json.NewEncoder(w).Encode(models.CardStatusResponse{
+        CardID:  card.ID,
+        Status:  card.Status,
+        History: []*models.CardStatusChange{audit},
+    })
+}
+
 // formatCardFace returns "MM/YY [NAME]" if name provided; accepts expiry in YYMM or MMYY.
 func formatCardFace(exp, name string) string {
     mm, yy := "", ""
@@ -159,3 +256,377 @@ func (a *API) getTransactions(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(http.StatusOK)
 	json.NewEncoder(w).Encode(transactions)
 }
+
+// openDispute disputes a transaction and credits the account provisionally.
+// Request body: {"ReasonCode": "13.1", "Amount": 1000, "Description": "never delivered"}; a zero
+// Amount disputes the whole transaction.
+func (a *API) openDispute(w http.ResponseWriter, r *http.Request) {
+    accountID := chi.URLParam(r, "accountID")
+    txID := chi.URLParam(r, "txID")
+
+    create := models.CreateDispute{}
+    if err := json.NewDecoder(r.Body).Decode(&create); err != nil {
+        http.Error(w, err.Error(), http.StatusBadRequest)
+        return
+    }
+
+    dispute, err := a.issuer.OpenDispute(accountID, txID, create)
+    if err != nil {
+        disputeError(w, err)
+        return
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    w.WriteHeader(http.StatusCreated)
+    json.NewEncoder(w).Encode(dispute)
+}
+
+func (a *API) listDisputes(w http.ResponseWriter, r *http.Request) {
+    accountID := chi.URLParam(r, "accountID")
+
+    disputes, err := a.issuer.ListDisputes(accountID)
+    if err != nil {
+        disputeError(w, err)
+        return
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    w.WriteHeader(http.StatusOK)
+    json.NewEncoder(w).Encode(disputes)
+}
+
+func (a *API) getDispute(w http.ResponseWriter, r *http.Request) {
+    accountID := chi.URLParam(r, "accountID")
+    disputeID := chi.URLParam(r, "disputeID")
+
+    dispute, err := a.issuer.GetDispute(accountID, disputeID)
+    if err != nil {
+        disputeError(w, err)
+        return
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    w.WriteHeader(http.StatusOK)
+    json.NewEncoder(w).Encode(dispute)
+}
+
+// changeDisputeStatus moves a dispute to another status.
+// Request body: {"Status": "REPRESENTMENT", "Reason": "proof of delivery", "Actor": "acquirer"}
+func (a *API) changeDisputeStatus(w http.ResponseWriter, r *http.Request) {
+    accountID := chi.URLParam(r, "accountID")
+    disputeID := chi.URLParam(r, "disputeID")
+
+    change := models.ChangeDisputeStatus{}
+    if err := json.NewDecoder(r.Body).Decode(&change); err != nil {
+        http.Error(w, err.Error(), http.StatusBadRequest)
+        return
+    }
+    if !change.Status.Valid() {
+        http.Error(w, "unknown dispute status", http.StatusBadRequest)
+        return
+    }
+    if change.Actor == "" {
+        http.Error(w, "actor is required", http.StatusBadRequest)
+        return
+    }
+
+    dispute, err := a.issuer.ChangeDisputeStatus(accountID, disputeID, change)
+    if err != nil {
+        disputeError(w, err)
+        return
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    w.WriteHeader(http.StatusOK)
+    json.NewEncoder(w).Encode(dispute)
+}
+
+// makePayment pays towards the balance of a credit account.
+// Request body: {"Amount": 2500, "Currency": "USD"}
+func (a *API) makePayment(w http.ResponseWriter, r *http.Request) {
+    accountID := chi.URLParam(r, "accountID")
+
+    create := models.CreatePayment{}
+    if err := json.NewDecoder(r.Body).Decode(&create); err != nil {
+        http.Error(w, err.Error(), http.StatusBadRequest)
+        return
+    }
+
+    payment, err := a.issuer.MakePayment(accountID, create)
+    if err != nil {
+        creditError(w, err)
+        return
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    w.WriteHeader(http.StatusCreated)
+    json.NewEncoder(w).Encode(payment)
+}
+
+func (a *API) listStatements(w http.ResponseWriter, r *http.Request) {
+    accountID := chi.URLParam(r, "accountID")
+
+    statements, err := a.issuer.ListStatements(accountID)
+    if err != nil {
+        creditError(w, err)
+        return
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    w.WriteHeader(http.StatusOK)
+    json.NewEncoder(w).Encode(statements)
+}
+
+// quoteFees quotes the fees of a transaction without charging them.
+// Request body: {"Type": "atm_withdrawal", "MCC": "6011", "Amount": 10000, "Currency": "EUR"};
+// Type defaults to the one of the MCC, Currency to the account's.
+func (a *API) quoteFees(w http.ResponseWriter, r *http.Request) {
+    accountID := chi.URLParam(r, "accountID")
+
+    req := models.FeeRequest{}
+    if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+        http.Error(w, err.Error(), http.StatusBadRequest)
+        return
+    }
+
+    quote, err := a.issuer.QuoteFees(accountID, req)
+    if err != nil {
+        feeError(w, err)
+        return
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    w.WriteHeader(http.StatusOK)
+    json.NewEncoder(w).Encode(quote)
+}
+
+// replaceCard closes a card and issues its replacement, charging the
+// replacement fee. The response is the new card with the fees charged.
+func (a *API) replaceCard(w http.ResponseWriter, r *http.Request) {
+    accountID := chi.URLParam(r, "accountID")
+    cardID := chi.URLParam(r, "cardID")
+
+    card, fees, err := a.issuer.ReplaceCard(accountID, cardID)
+    if err != nil {
+        feeError(w, err)
+        return
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    w.WriteHeader(http.StatusCreated)
+    json.NewEncoder(w).Encode(struct {
+        *models.Card
+        CardFace string `json:"card_face"`
+        Fees     []*models.Transaction
+    }{card, formatCardFace(card.ExpirationDate, card.CardholderName), fees})
+}
+
+// getPINStatus tells whether the card has a PIN, whether it is blocked and
+// how many wrong attempts it has left.
+func (a *API) getPINStatus(w http.ResponseWriter, r *http.Request) {
+    accountID := chi.URLParam(r, "accountID")
+    cardID := chi.URLParam(r, "cardID")
+
+    status, err := a.issuer.GetPINStatus(accountID, cardID)
+    if err != nil {
+        pinError(w, err)
+        return
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    w.WriteHeader(http.StatusOK)
+    json.NewEncoder(w).Encode(status)
+}
+
+// setPIN sets the first PIN of a card.
+// Request body: {"CardNumber": "4212345678901234", "PIN": "1234"}
+func (a *API) setPIN(w http.ResponseWriter, r *http.Request) {
+    accountID := chi.URLParam(r, "accountID")
+    cardID := chi.URLParam(r, "cardID")
+
+    req := models.SetPIN{}
+    if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+        http.Error(w, err.Error(), http.StatusBadRequest)
+        return
+    }
+
+    status, err := a.issuer.SetPIN(accountID, cardID, req)
+    if err != nil {
+        pinError(w, err)
+        return
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    w.WriteHeader(http.StatusOK)
+    json.NewEncoder(w).Encode(status)
+}
+
+// changePIN changes the PIN of a card.
+// Request body: {"CardNumber": "4212345678901234", "OldPIN": "1234", "NewPIN": "4321"}
+func (a *API) changePIN(w http.ResponseWriter, r *http.Request) {
+    accountID := chi.URLParam(r, "accountID")
+    cardID := chi.URLParam(r, "cardID")
+
+    req := models.ChangePIN{}
+    if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+        http.Error(w, err.Error(), http.StatusBadRequest)
+        return
+    }
+
+    status, err := a.issuer.ChangePIN(accountID, cardID, req)
+    if err != nil {
+        pinError(w, err)
+        return
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    w.WriteHeader(http.StatusOK)
+    json.NewEncoder(w).Encode(status)
+}
+
+// resetPIN is issuer operations replacing a forgotten or blocked PIN.
+// Request body: {"CardNumber": "4212345678901234", "PIN": "1234", "Reason": "forgotten", "Actor": "ops"}
+func (a *API) resetPIN(w http.ResponseWriter, r *http.Request) {
+    accountID := chi.URLParam(r, "accountID")
+    cardID := chi.URLParam(r, "cardID")
+
+    req := models.ResetPIN{}
+    if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+        http.Error(w, err.Error(), http.StatusBadRequest)
+        return
+    }
+    if req.Actor == "" {
+        http.Error(w, "actor is required", http.StatusBadRequest)
+        return
+    }
+
+    status, reset, err := a.issuer.ResetPIN(accountID, cardID, req)
+    if err != nil {
+        pinError(w, err)
+        return
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    w.WriteHeader(http.StatusOK)
+    json.NewEncoder(w).Encode(struct {
+        *models.PINStatus
+        Reset *models.PINReset
+    }{status, reset})
+}
+
+// getDCVV returns the current dynamic CVV of a card and its TTL. The issuer
+// only keeps a hash of the PAN, so the app sends it in the X-Card-Number header.
+func (a *API) getDCVV(w http.ResponseWriter, r *http.Request) {
+    accountID := chi.URLParam(r, "accountID")
+    cardID := chi.URLParam(r, "cardID")
+
+    dcvv, err := a.issuer.GetDCVV(accountID, cardID, r.Header.Get("X-Card-Number"))
+    if err != nil {
+        dcvvError(w, err)
+        return
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    w.Header().Set("Cache-Control", "no-store")
+    w.WriteHeader(http.StatusOK)
+    json.NewEncoder(w).Encode(dcvv)
+}
+
+// setDCVV enables or disables the dynamic CVVs of a card.
+// Request body: {"Enabled": true}
+func (a *API) setDCVV(w http.ResponseWriter, r *http.Request) {
+    accountID := chi.URLParam(r, "accountID")
+    cardID := chi.URLParam(r, "cardID")
+
+    req := models.SetDCVV{}
+    if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+        http.Error(w, err.Error(), http.StatusBadRequest)
+        return
+    }
+
+    status, err := a.issuer.SetDCVV(accountID, cardID, req)
+    if err != nil {
+        dcvvError(w, err)
+        return
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    w.WriteHeader(http.StatusOK)
+    json.NewEncoder(w).Encode(status)
+}
+
+// dcvvError maps the errors of the dCVV endpoints to responses.
+func dcvvError(w http.ResponseWriter, err error) {
+    switch {
+    case errors.Is(err, ErrNotFound):
+        http.Error(w, err.Error(), http.StatusNotFound)
+    case errors.Is(err, models.ErrCardNumberMismatch):
+        http.Error(w, err.Error(), http.StatusBadRequest)
+    case errors.Is(err, models.ErrDCVVNotEnabled):
+        http.Error(w, err.Error(), http.StatusConflict)
+    default:
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+    }
+}
+
+// pinError maps the errors of the PIN endpoints to responses.
+func pinError(w http.ResponseWriter, err error) {
+    switch {
+    case errors.Is(err, ErrNotFound):
+        http.Error(w, err.Error(), http.StatusNotFound)
+    case errors.Is(err, security.ErrInvalidPIN), errors.Is(err, models.ErrCardNumberMismatch):
+        http.Error(w, err.Error(), http.StatusBadRequest)
+    case errors.Is(err, models.ErrIncorrectPIN), errors.Is(err, models.ErrPINNotSet):
+        http.Error(w, err.Error(), http.StatusForbidden)
+    case errors.Is(err, models.ErrPINBlocked):
+        http.Error(w, err.Error(), http.StatusLocked)
+    case errors.Is(err, models.ErrPINAlreadySet):
+        http.Error(w, err.Error(), http.StatusConflict)
+    default:
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+    }
+}
+
+// feeError maps the errors of the fee endpoints to responses.
+func feeError(w http.ResponseWriter, err error) {
+    switch {
+    case errors.Is(err, ErrNotFound):
+        http.Error(w, err.Error(), http.StatusNotFound)
+    case errors.Is(err, models.ErrInvalidFeeRequest):
+        http.Error(w, err.Error(), http.StatusBadRequest)
+    case errors.Is(err, models.ErrInvalidCardStatusTransition):
+        http.Error(w, err.Error(), http.StatusConflict)
+    default:
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+    }
+}
+
+// creditError maps the errors of the credit endpoints to responses.
+func creditError(w http.ResponseWriter, err error) {
+    switch {
+    case errors.Is(err, ErrNotFound):
+        http.Error(w, err.Error(), http.StatusNotFound)
+    case errors.Is(err, models.ErrInvalidAmount):
+        http.Error(w, err.Error(), http.StatusBadRequest)
+    case errors.Is(err, models.ErrNotCreditAccount):
+        http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+    default:
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+    }
+}
+
+// disputeError maps the errors of the dispute endpoints to responses.
+func disputeError(w http.ResponseWriter, err error) {
+    switch {
+    case errors.Is(err, ErrNotFound):
+        http.Error(w, err.Error(), http.StatusNotFound)
+    case errors.Is(err, models.ErrInvalidReasonCode):
+        http.Error(w, err.Error(), http.StatusBadRequest)
+    case errors.Is(err, models.ErrTransactionNotDisputable):
+        http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+    case errors.Is(err, ErrConflict), errors.Is(err, models.ErrInvalidDisputeStatusTransition):
+        http.Error(w, err.Error(), http.StatusConflict)
+    default:
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+    }
+}
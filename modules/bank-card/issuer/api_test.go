@@ -74,3 +74,68 @@ func TestDevEndpoints_NotImplementedOnMem(t *testing.T) {
     // mount dev routes via app-like router to test capture/reverse with mem
     // direct call handlers require repository; here we only check 404 (not mounted in API) so we simulate via app endpoints test skipped.
 }
+
+func TestCardStatus_Lifecycle(t *testing.T) {
+    api := issuer.NewAPI(issuer.NewService(issuer.NewRepository(), issuer.DefaultConfig()))
+    r := chi.NewRouter()
+    api.AppendRoutes(r)
+
+    body := bytes.NewBufferString(`{"balance":10000,"currency":"USD"}`)
+    w := httptest.NewRecorder()
+    r.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/accounts/", body))
+    require.Equal(t, http.StatusCreated, w.Code)
+    var acc models.Account
+    require.NoError(t, json.NewDecoder(w.Body).Decode(&acc))
+
+    w = httptest.NewRecorder()
+    r.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/accounts/"+acc.ID+"/cards", nil))
+    require.Equal(t, http.StatusCreated, w.Code)
+    var card models.Card
+    require.NoError(t, json.NewDecoder(w.Body).Decode(&card))
+    require.Equal(t, models.CardStatusIssued, card.Status)
+
+    statusURL := "/accounts/" + acc.ID + "/cards/" + card.ID + "/status"
+    changeStatus := func(status models.CardStatus) *httptest.ResponseRecorder {
+        jsonReq, _ := json.Marshal(models.ChangeCardStatus{Status: status, Reason: "test", Actor: "tester"})
+        w := httptest.NewRecorder()
+        r.ServeHTTP(w, httptest.NewRequest(http.MethodPut, statusURL, bytes.NewReader(jsonReq)))
+        return w
+    }
+
+    require.Equal(t, http.StatusOK, changeStatus(models.CardStatusActive).Code)
+    require.Equal(t, http.StatusOK, changeStatus(models.CardStatusFrozen).Code)
+    require.Equal(t, http.StatusOK, changeStatus(models.CardStatusLost).Code)
+
+    // LOST cards can only be closed
+    require.Equal(t, http.StatusConflict, changeStatus(models.CardStatusActive).Code)
+    require.Equal(t, http.StatusBadRequest, changeStatus("BROKEN").Code)
+
+    w = httptest.NewRecorder()
+    r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, statusURL, nil))
+    require.Equal(t, http.StatusOK, w.Code)
+    var status models.CardStatusResponse
+    require.NoError(t, json.NewDecoder(w.Body).Decode(&status))
+    require.Equal(t, models.CardStatusLost, status.Status)
+    require.Len(t, status.History, 3)
+    require.Equal(t, models.CardStatusIssued, status.History[0].FromStatus)
+    require.Equal(t, models.CardStatusActive, status.History[0].ToStatus)
+    require.Equal(t, "tester", status.History[2].Actor)
+}
+
+func TestDisputes_Validation(t *testing.T) {
+    api := issuer.NewAPI(issuer.NewService(issuer.NewRepository(), issuer.DefaultConfig()))
+    r := chi.NewRouter()
+    api.AppendRoutes(r)
+
+    w := httptest.NewRecorder()
+    r.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/accounts/acc/transactions/tx/disputes", bytes.NewBufferString(`{"ReasonCode":"99.9"}`)))
+    require.Equal(t, http.StatusBadRequest, w.Code)
+
+    w = httptest.NewRecorder()
+    r.ServeHTTP(w, httptest.NewRequest(http.MethodPut, "/accounts/acc/disputes/d/status", bytes.NewBufferString(`{"Status":"SETTLED","Actor":"tester"}`)))
+    require.Equal(t, http.StatusBadRequest, w.Code)
+
+    w = httptest.NewRecorder()
+    r.ServeHTTP(w, httptest.NewRequest(http.MethodPut, "/accounts/acc/disputes/d/status", bytes.NewBufferString(`{"Status":"CHARGEBACK"}`)))
+    require.Equal(t, http.StatusBadRequest, w.Code)
+}
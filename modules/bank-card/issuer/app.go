@@ -31,6 +31,10 @@ type App struct {
 	logger            *slog.Logger
 	iso8583Server     io.Closer
 	config            *Config
+	closeCVV          func()
+	holdSweeper       *holdSweeper
+	creditCycler      *creditCycler
+	businessDayRoller *businessDayRoller
 }
 
 func NewApp(logger *slog.Logger, config *Config) *App {
@@ -54,6 +58,10 @@ func (a *App) Start() error {
     router := chi.NewRouter()
     router.Use(middleware.NewStructuredLogger(a.logger))
     // Choose repository backend: default to pg for runtime; allow mem only when explicitly enabled for tests
+    store, err := OpenKeyStore(a.config)
+    if err != nil {
+        return fmt.Errorf("opening key store: %w", err)
+    }
     var repository *Repository
     backend := getenv("REPO_BACKEND", "pg")
     allowMem := getenv("ALLOW_MEM_BACKEND_FOR_TESTS", "false") == "true"
@@ -72,8 +80,10 @@ func (a *App) Start() error {
         if err := db.Ping(); err != nil {
             return fmt.Errorf("ping postgres: %w", err)
         }
-        hashKey := []byte(getenv("PAN_HASH_KEY", "dev-secret-pepper"))
-        repository = NewPGRepository(db, hashKey)
+        repository, err = NewPGRepositoryWithKeys(db, store, a.config)
+        if err != nil {
+            return err
+        }
     case "mem":
         if !allowMem {
             return fmt.Errorf("mem repository is disabled at runtime; set ALLOW_MEM_BACKEND_FOR_TESTS=true only in tests")
@@ -99,15 +109,47 @@ func (a *App) Start() error {
     }
 
     iss := NewService(repository, a.config)
+    closeCVV, err := iss.UseKeyStore(store)
+    if err != nil {
+        return err
+    }
+    a.closeCVV = closeCVV
 
-	iso8583Server := issuer8583.NewServer(a.logger, a.config.ISO8583Addr, iss)
-	err := iso8583Server.Start()
+    spec, err := issuer8583.SpecByName(a.config.ISO8583Spec)
+    if err != nil { return fmt.Errorf("selecting iso8583 spec: %w", err) }
+
+    // Roll the business date over to today before taking messages, unless the network's cutovers move it
+    switch a.config.Cutover {
+    case "", CutoverSchedule:
+        if a.config.CutoverInterval > 0 {
+            a.businessDayRoller = newBusinessDayRoller(a.logger, iss, a.config.CutoverInterval)
+            a.businessDayRoller.Start()
+        }
+    case CutoverNetwork:
+    default:
+        return fmt.Errorf("unsupported Cutover=%s", a.config.Cutover)
+    }
+
+	iso8583Server := issuer8583.NewServer(a.logger, a.config.ISO8583Addr, iss, spec)
+	err = iso8583Server.Start()
 	if err != nil {
 		return fmt.Errorf("starting iso8583 server: %w", err)
 	}
 	a.ISO8583ServerAddr = iso8583Server.Addr
 	a.iso8583Server = iso8583Server
 
+    // Release expired holds in the background; the memory backend has no hold expiry
+    if repository.db != nil && a.config.HoldReleaseInterval > 0 {
+        a.holdSweeper = newHoldSweeper(a.logger, repository, a.config.HoldReleaseInterval, a.config.HoldReleaseBatch)
+        a.holdSweeper.Start()
+    }
+
+    // Run the end of day of credit accounts for business dates closed by a cutover
+    if repository.db != nil && a.config.Credit.CycleInterval > 0 {
+        a.creditCycler = newCreditCycler(a.logger, iss, a.config.Credit.CycleInterval)
+        a.creditCycler.Start()
+    }
+
     api := NewAPI(iss)
     api.AppendRoutes(router)
 
@@ -122,11 +164,21 @@ func (a *App) Start() error {
     })
     router.Post("/dev/holds/release", func(w http.ResponseWriter, r *http.Request){
         ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second); defer cancel()
-        n, err := repository.ReleaseExpiredHolds(ctx, 500)
+        batch := a.config.HoldReleaseBatch
+        if batch <= 0 { batch = 500 }
+        n, err := repository.ReleaseExpiredHolds(ctx, batch)
         if err != nil { http.Error(w, err.Error(), http.StatusInternalServerError); return }
         w.Header().Set("Content-Type", "application/json")
         w.Write([]byte(fmt.Sprintf("{\"released\":%d}", n)))
     })
+    router.Post("/dev/credit/cycle", func(w http.ResponseWriter, r *http.Request){
+        if repository.db == nil { http.Error(w, "not implemented for memory backend", http.StatusNotImplemented); return }
+        ctx, cancel := context.WithTimeout(r.Context(), time.Minute); defer cancel()
+        statements, err := iss.RunCreditCycle(ctx)
+        if err != nil { http.Error(w, err.Error(), http.StatusInternalServerError); return }
+        w.Header().Set("Content-Type", "application/json")
+        w.Write([]byte(fmt.Sprintf("{\"statements\":%d}", len(statements))))
+    })
     router.Post("/dev/auths/{id}/capture", func(w http.ResponseWriter, r *http.Request){
         if repository.db == nil { http.Error(w, "not implemented for memory backend", http.StatusNotImplemented); return }
         id := chi.URLParam(r, "id")
@@ -136,7 +188,9 @@ func (a *App) Start() error {
         cur := r.URL.Query().Get("currency")
         if cur == "" { cur = "USD" }
         ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second); defer cancel()
-        if err := repository.CaptureAuth(ctx, id, amt, cur); err != nil { http.Error(w, err.Error(), http.StatusBadRequest); return }
+        businessDate, err := iss.BusinessDate()
+        if err != nil { http.Error(w, err.Error(), http.StatusInternalServerError); return }
+        if err := repository.CaptureAuth(ctx, id, amt, cur, 0, iss.feeRules(), businessDate); err != nil { http.Error(w, err.Error(), http.StatusBadRequest); return }
         w.WriteHeader(http.StatusNoContent)
     })
     router.Post("/dev/auths/{id}/reverse", func(w http.ResponseWriter, r *http.Request){
@@ -195,5 +249,21 @@ func (a *App) Shutdown() {
 
 	a.wg.Wait()
 
+	if a.holdSweeper != nil {
+		a.holdSweeper.Stop()
+	}
+
+	if a.creditCycler != nil {
+		a.creditCycler.Stop()
+	}
+
+	if a.businessDayRoller != nil {
+		a.businessDayRoller.Stop()
+	}
+
+	if a.closeCVV != nil {
+		a.closeCVV()
+	}
+
 	a.logger.Info("app stopped")
 }
@@ -0,0 +1,75 @@
+package issuer
+
+import (
+	"sync"
+	"time"
+
+	"golang.org/x/exp/slog"
+)
+
+// businessDayRoller periodically rolls the business date over to the
+// calendar date (Config.Cutover "schedule"), catching up with the days
+// the issuer was down. The date only ever moves forward, so several issuer
+// instances may run it.
+type businessDayRoller struct {
+	service  *Service
+	interval time.Duration
+	logger   *slog.Logger
+
+	stop chan struct{}
+	wg   sync.WaitGroup
+}
+
+func newBusinessDayRoller(logger *slog.Logger, service *Service, interval time.Duration) *businessDayRoller {
+	return &businessDayRoller{
+		service:  service,
+		interval: interval,
+		logger:   logger.With(slog.String("type", "business-day-roller")),
+		stop:     make(chan struct{}),
+	}
+}
+
+// Start rolls the business date over once and then in a background
+// goroutine until Stop is called.
+func (r *businessDayRoller) Start() {
+	last := r.roll(time.Time{})
+
+	r.wg.Add(1)
+	go func() {
+		defer r.wg.Done()
+
+		r.logger.Info("business day roller started", slog.Duration("interval", r.interval))
+
+		ticker := time.NewTicker(r.interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-r.stop:
+				r.logger.Info("business day roller stopped")
+				return
+			case <-ticker.C:
+				last = r.roll(last)
+			}
+		}
+	}()
+}
+
+// Stop signals the roller to exit and waits for the current run to finish.
+func (r *businessDayRoller) Stop() {
+	close(r.stop)
+	r.wg.Wait()
+}
+
+// roll rolls the business date over and returns it, logging when it moved past last.
+func (r *businessDayRoller) roll(last time.Time) time.Time {
+	businessDate, err := r.service.RollBusinessDate()
+	if err != nil {
+		r.logger.Error("rolling business date", "err", err)
+		return last
+	}
+	if businessDate.After(last) {
+		r.logger.Info("business date", slog.String("business_date", businessDate.Format("2006-01-02")))
+	}
+	return businessDate
+}
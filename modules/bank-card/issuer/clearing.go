@@ -0,0 +1,94 @@
+package issuer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+
+	"github.com/alovak/cardflow-playground/internal/clearing"
+	"github.com/alovak/cardflow-playground/issuer/models"
+)
+
+// ClearingReport sums up what ingesting a clearing file did. Exceptions are
+// the force-posted and rejected records, for manual handling.
+type ClearingReport struct {
+	FileID      string
+	Records     int
+	Posted      int
+	Matched     int
+	ForcePosted int
+	Rejected    int
+	Duplicates  int
+	Exceptions  []clearing.Exception
+}
+
+// IngestClearingFile posts every record of the file against its
+// authorization. Records are applied once, so a file can be ingested again
+// after a failure; records posted before are counted as duplicates.
+func (i *Service) IngestClearingFile(f *clearing.File) (*ClearingReport, error) {
+	if i.repo.db == nil {
+		return nil, fmt.Errorf("not supported in memory repo")
+	}
+
+	report := &ClearingReport{FileID: f.ID}
+
+	for _, batch := range f.Batches {
+		for _, record := range batch.Records {
+			result, reason, err := i.postClearingRecord(f.ID, batch.ID, record)
+			if err != nil {
+				return report, fmt.Errorf("posting record %s: %w", record.Reference, err)
+			}
+
+			report.Records++
+			switch result {
+			case models.ClearingResultPosted:
+				report.Posted++
+			case models.ClearingResultMatched:
+				report.Matched++
+			case models.ClearingResultDuplicate:
+				report.Duplicates++
+			case models.ClearingResultForcePosted:
+				report.ForcePosted++
+				report.Exceptions = append(report.Exceptions, clearing.Exception{
+					BatchID: batch.ID, Record: record, Action: clearing.ActionForcePosted, Reason: reason,
+				})
+			case models.ClearingResultRejected:
+				report.Rejected++
+				report.Exceptions = append(report.Exceptions, clearing.Exception{
+					BatchID: batch.ID, Record: record, Action: clearing.ActionRejected, Reason: reason,
+				})
+			}
+		}
+	}
+
+	return report, nil
+}
+
+func (i *Service) postClearingRecord(fileID, batchID string, record clearing.Record) (models.ClearingResult, string, error) {
+	card, err := i.repo.FindCardForAuthorization(models.Card{Number: record.PAN, ExpirationDate: record.ExpirationDate})
+	if errors.Is(err, ErrNotFound) {
+		card = nil
+	} else if err != nil {
+		return "", "", fmt.Errorf("finding card: %w", err)
+	}
+
+	// a missing STAN only means the record cannot be matched to an online posting
+	stan, _ := strconv.Atoi(record.STAN)
+	businessDate, err := i.BusinessDate()
+	if err != nil {
+		return "", "", err
+	}
+
+	return i.repo.PostClearingRecord(context.Background(), card, models.ClearingRecord{
+		Reference:  record.Reference,
+		FileID:     fileID,
+		BatchID:    batchID,
+		Refund:     record.Code == clearing.TransactionCodeRefund,
+		Amount:     record.Amount,
+		Currency:   record.Currency,
+		TerminalID: record.TID,
+		RRN:        record.RRN,
+		STAN:       stan,
+	}, i.feeRules(), businessDate)
+}
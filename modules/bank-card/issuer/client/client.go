@@ -55,20 +55,20 @@ func (i *client) CreateAccount(req models.CreateAccount) (string, error) {
 }
 
 // GetAccount returns the account for the given account ID or an error.
-func (i *client) GetAccount(accountID string) (models.Account, error) {
+func (i *client) GetAccount(accountID string) (*models.Account, error) {
 	res, err := i.httpClient.Get(i.baseURL + "/accounts/" + accountID)
 	if err != nil {
-		return models.Account{}, err
+		return nil, err
 	}
 
 	if res.StatusCode != http.StatusOK {
-		return models.Account{}, fmt.Errorf("unexpected status code: %d; expected: %d", res.StatusCode, http.StatusOK)
+		return nil, fmt.Errorf("unexpected status code: %d; expected: %d", res.StatusCode, http.StatusOK)
 	}
 
-	var account models.Account
-	err = json.NewDecoder(res.Body).Decode(&account)
+	account := &models.Account{}
+	err = json.NewDecoder(res.Body).Decode(account)
 	if err != nil {
-		return models.Account{}, err
+		return nil, err
 	}
 
 	return account, nil
@@ -95,6 +95,38 @@ func (i *client) IssueCard(accountID string) (models.Card, error) {
 	return card, nil
 }
 
+// ChangeCardStatus moves the card to the given status and returns the
+// updated status or an error.
+func (i *client) ChangeCardStatus(accountID, cardID string, req models.ChangeCardStatus) (models.CardStatusResponse, error) {
+	reqJSON, err := json.Marshal(req)
+	if err != nil {
+		return models.CardStatusResponse{}, err
+	}
+
+	httpReq, err := http.NewRequest(http.MethodPut, i.baseURL+"/accounts/"+accountID+"/cards/"+cardID+"/status", bytes.NewReader(reqJSON))
+	if err != nil {
+		return models.CardStatusResponse{}, err
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+
+	res, err := i.httpClient.Do(httpReq)
+	if err != nil {
+		return models.CardStatusResponse{}, err
+	}
+
+	if res.StatusCode != http.StatusOK {
+		return models.CardStatusResponse{}, fmt.Errorf("unexpected status code: %d; expected: %d", res.StatusCode, http.StatusOK)
+	}
+
+	var status models.CardStatusResponse
+	err = json.NewDecoder(res.Body).Decode(&status)
+	if err != nil {
+		return models.CardStatusResponse{}, err
+	}
+
+	return status, nil
+}
+
 // GetTransactions returns the list of transactions for the given card ID
 // and account ID or an error.
 func (i *client) GetTransactions(accountID string) ([]models.Transaction, error) {
@@ -115,3 +147,203 @@ func (i *client) GetTransactions(accountID string) ([]models.Transaction, error)
 
 	return transactions, nil
 }
+
+// OpenDispute disputes the transaction and returns the dispute or an error.
+func (i *client) OpenDispute(accountID, transactionID string, req models.CreateDispute) (models.Dispute, error) {
+	reqJSON, err := json.Marshal(req)
+	if err != nil {
+		return models.Dispute{}, err
+	}
+
+	res, err := i.httpClient.Post(i.baseURL+"/accounts/"+accountID+"/transactions/"+transactionID+"/disputes", "application/json", bytes.NewReader(reqJSON))
+	if err != nil {
+		return models.Dispute{}, err
+	}
+
+	if res.StatusCode != http.StatusCreated {
+		return models.Dispute{}, fmt.Errorf("unexpected status code: %d; expected: %d", res.StatusCode, http.StatusCreated)
+	}
+
+	var dispute models.Dispute
+	err = json.NewDecoder(res.Body).Decode(&dispute)
+	if err != nil {
+		return models.Dispute{}, err
+	}
+
+	return dispute, nil
+}
+
+// ChangeDisputeStatus moves the dispute to another status and returns it
+// with its history or an error.
+func (i *client) ChangeDisputeStatus(accountID, disputeID string, req models.ChangeDisputeStatus) (models.Dispute, error) {
+	reqJSON, err := json.Marshal(req)
+	if err != nil {
+		return models.Dispute{}, err
+	}
+
+	httpReq, err := http.NewRequest(http.MethodPut, i.baseURL+"/accounts/"+accountID+"/disputes/"+disputeID+"/status", bytes.NewReader(reqJSON))
+	if err != nil {
+		return models.Dispute{}, err
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+
+	res, err := i.httpClient.Do(httpReq)
+	if err != nil {
+		return models.Dispute{}, err
+	}
+
+	if res.StatusCode != http.StatusOK {
+		return models.Dispute{}, fmt.Errorf("unexpected status code: %d; expected: %d", res.StatusCode, http.StatusOK)
+	}
+
+	var dispute models.Dispute
+	err = json.NewDecoder(res.Body).Decode(&dispute)
+	if err != nil {
+		return models.Dispute{}, err
+	}
+
+	return dispute, nil
+}
+
+// MakePayment pays towards the balance of the credit account and returns the
+// payment or an error.
+func (i *client) MakePayment(accountID string, req models.CreatePayment) (models.Payment, error) {
+	reqJSON, err := json.Marshal(req)
+	if err != nil {
+		return models.Payment{}, err
+	}
+
+	res, err := i.httpClient.Post(i.baseURL+"/accounts/"+accountID+"/payments", "application/json", bytes.NewReader(reqJSON))
+	if err != nil {
+		return models.Payment{}, err
+	}
+
+	if res.StatusCode != http.StatusCreated {
+		return models.Payment{}, fmt.Errorf("unexpected status code: %d; expected: %d", res.StatusCode, http.StatusCreated)
+	}
+
+	var payment models.Payment
+	err = json.NewDecoder(res.Body).Decode(&payment)
+	if err != nil {
+		return models.Payment{}, err
+	}
+
+	return payment, nil
+}
+
+// QuoteFees returns the fees the account would be charged for the
+// transaction, without charging them, or an error.
+func (i *client) QuoteFees(accountID string, req models.FeeRequest) (models.FeeQuote, error) {
+	reqJSON, err := json.Marshal(req)
+	if err != nil {
+		return models.FeeQuote{}, err
+	}
+
+	res, err := i.httpClient.Post(i.baseURL+"/accounts/"+accountID+"/fees/quote", "application/json", bytes.NewReader(reqJSON))
+	if err != nil {
+		return models.FeeQuote{}, err
+	}
+
+	if res.StatusCode != http.StatusOK {
+		return models.FeeQuote{}, fmt.Errorf("unexpected status code: %d; expected: %d", res.StatusCode, http.StatusOK)
+	}
+
+	var quote models.FeeQuote
+	err = json.NewDecoder(res.Body).Decode(&quote)
+	if err != nil {
+		return models.FeeQuote{}, err
+	}
+
+	return quote, nil
+}
+
+// SetPIN sets the first PIN of the card and returns its PIN status, or an
+// error.
+func (i *client) SetPIN(accountID, cardID string, req models.SetPIN) (models.PINStatus, error) {
+	reqJSON, err := json.Marshal(req)
+	if err != nil {
+		return models.PINStatus{}, err
+	}
+
+	httpReq, err := http.NewRequest(http.MethodPut, i.baseURL+"/accounts/"+accountID+"/cards/"+cardID+"/pin", bytes.NewReader(reqJSON))
+	if err != nil {
+		return models.PINStatus{}, err
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+
+	res, err := i.httpClient.Do(httpReq)
+	if err != nil {
+		return models.PINStatus{}, err
+	}
+
+	if res.StatusCode != http.StatusOK {
+		return models.PINStatus{}, fmt.Errorf("unexpected status code: %d; expected: %d", res.StatusCode, http.StatusOK)
+	}
+
+	var status models.PINStatus
+	err = json.NewDecoder(res.Body).Decode(&status)
+	if err != nil {
+		return models.PINStatus{}, err
+	}
+
+	return status, nil
+}
+
+// SetDCVV enables or disables the dynamic CVVs of the card and returns the
+// setting, or an error.
+func (i *client) SetDCVV(accountID, cardID string, req models.SetDCVV) (models.DCVVStatus, error) {
+	reqJSON, err := json.Marshal(req)
+	if err != nil {
+		return models.DCVVStatus{}, err
+	}
+
+	httpReq, err := http.NewRequest(http.MethodPut, i.baseURL+"/accounts/"+accountID+"/cards/"+cardID+"/dcvv", bytes.NewReader(reqJSON))
+	if err != nil {
+		return models.DCVVStatus{}, err
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+
+	res, err := i.httpClient.Do(httpReq)
+	if err != nil {
+		return models.DCVVStatus{}, err
+	}
+
+	if res.StatusCode != http.StatusOK {
+		return models.DCVVStatus{}, fmt.Errorf("unexpected status code: %d; expected: %d", res.StatusCode, http.StatusOK)
+	}
+
+	var status models.DCVVStatus
+	err = json.NewDecoder(res.Body).Decode(&status)
+	if err != nil {
+		return models.DCVVStatus{}, err
+	}
+
+	return status, nil
+}
+
+// GetDCVV returns the current dynamic CVV of the card with the given number
+// and its TTL, or an error.
+func (i *client) GetDCVV(accountID, cardID, cardNumber string) (models.DynamicCVV, error) {
+	httpReq, err := http.NewRequest(http.MethodGet, i.baseURL+"/accounts/"+accountID+"/cards/"+cardID+"/dcvv", nil)
+	if err != nil {
+		return models.DynamicCVV{}, err
+	}
+	httpReq.Header.Set("X-Card-Number", cardNumber)
+
+	res, err := i.httpClient.Do(httpReq)
+	if err != nil {
+		return models.DynamicCVV{}, err
+	}
+
+	if res.StatusCode != http.StatusOK {
+		return models.DynamicCVV{}, fmt.Errorf("unexpected status code: %d; expected: %d", res.StatusCode, http.StatusOK)
+	}
+
+	var dcvv models.DynamicCVV
+	err = json.NewDecoder(res.Body).Decode(&dcvv)
+	if err != nil {
+		return models.DynamicCVV{}, err
+	}
+
+	return dcvv, nil
+}
@@ -1,9 +1,19 @@
 package issuer
 
+import (
+    "time"
+
+    "github.com/alovak/cardflow-playground/internal/keys"
+    "github.com/alovak/cardflow-playground/issuer/models"
+)
+
 // Config is a configuration for the issuer application
 type Config struct {
     HTTPAddr    string
     ISO8583Addr string
+    // ISO8583Spec selects the ISO 8583 message spec: "playground" (default) or
+    // "iso87" for the ISO 8583:1987 field assignments. Acquirers must use the same spec.
+    ISO8583Spec string
     // ExpiryTZ is an IANA timezone name for expiry computations (e.g., "Australia/Sydney").
     ExpiryTZ string
     // ProductYears maps card product to validity years (e.g., credit=3, debit=5).
@@ -12,13 +22,197 @@ type Config struct {
     CardProduct string
     // BINPrefix sets the issuer BIN prefix used to generate PANs (6/8/9 digits). Demo default: 421234
     BINPrefix string
+    // CVVProvider selects how CVV2 is derived and verified: "demo" (HMAC with the CVK),
+    // "visa" (the Visa CVV algorithm in software with a double length TDES CVK)
+    // or "softhsm" (PKCS#11, only available in binaries built with the softhsm tag).
+    CVVProvider string
+    // CVVServiceCode is the service code fed into the CVV derivation; "000" for CVV2
+    // ("101" gives the magnetic stripe CVV1, "999" the chip iCVV).
+    CVVServiceCode string
+    // Keys selects the key store the CVK, PVK, ZPK, ZMK, PAN hash pepper and
+    // DEK are looked up in. The SoftHSM providers use the keys on the token instead.
+    Keys KeysConfig
+    // SoftHSM configures the PKCS#11 token used when CVVProvider is "softhsm".
+    // Empty fields fall back to SOFTHSM_LIB, SOFTHSM_SLOT, SOFTHSM_PIN,
+    // SOFTHSM_CVK_LABEL and SOFTHSM_PVK_LABEL.
+    SoftHSM SoftHSMConfig
+    // PIN configures how PINs are derived and verified.
+    PIN PINConfig
+    // DCVV configures dynamic CVVs of cards that have them enabled.
+    DCVV DCVVConfig
+    // HoldTTL is how long an authorization hold lasts before the sweeper releases it.
+    HoldTTL time.Duration
+    // HoldTTLByMCC overrides HoldTTL for merchant categories with long-running
+    // authorizations (lodging, car rental).
+    HoldTTLByMCC map[string]time.Duration
+    // HoldReleaseInterval is how often the background sweeper releases expired holds; 0 disables it.
+    HoldReleaseInterval time.Duration
+    // HoldReleaseBatch limits how many holds are released per transaction.
+    HoldReleaseBatch int
+    // Cutover selects what closes the business day: "schedule" (default)
+    // rolls it over to the calendar date in ExpiryTZ, and "network" moves it
+    // one day on each cutover message (0800, DE70=201) of the acquirer. The
+    // business date is kept in the database, so it survives restarts and is
+    // the same on every instance.
+    Cutover string
+    // CutoverInterval is how often the scheduled rollover checks the calendar date; 0 disables it.
+    CutoverInterval time.Duration
+    // Credit holds the terms of credit accounts.
+    Credit CreditConfig
+    // Fees are charged when a transaction is captured or presented, each
+    // matching rule as a transaction of its own. Card replacement fees are
+    // charged when a card is replaced.
+    Fees []models.FeeRule
+    // Transactions sets the limits and checks of each transaction type an
+    // authorization may have (see models.TransactionTypeForProcessingCode).
+    // Types without a policy are declined.
+    Transactions map[models.TransactionType]TransactionPolicy
+}
+
+// The sources of the business date (see Config.Cutover).
+const (
+    CutoverSchedule = "schedule"
+    CutoverNetwork  = "network"
+)
+
+// TransactionPolicy is how authorizations of one transaction type are
+// handled. Amounts are in minor units; a zero limit means no limit.
+type TransactionPolicy struct {
+    // MaxAmount limits a single authorization.
+    MaxAmount int64
+    // DailyAmount limits what a card authorizes per calendar day in ExpiryTZ
+    // (PostgreSQL only).
+    DailyAmount int64
+    // LimitCode is the response code of an authorization over a limit.
+    LimitCode string
+    // RequirePIN declines authorizations without a PIN block.
+    RequirePIN bool
+}
+
+// KeysConfig selects the keys of the issuer. With a key store (see
+// internal/keys), keys are decrypted with the master key in KEYS_MASTER_KEY;
+// without one, they are the demo keys of the environment: CVK_DEMO (or
+// CVK_HEX_DEMO for the visa CVV provider), PVK_DEMO, ZPK_DEMO, ZMK_DEMO and
+// PAN_HASH_KEY.
+type KeysConfig struct {
+    // StorePath is the key store file; empty falls back to KEYS_STORE.
+    StorePath string
+    // Versions pins the key version of a purpose; the active key is used otherwise.
+    Versions map[keys.Purpose]int
+    // Blocks are TR-31 key blocks wrapped under the active ZMK, imported into
+    // the store at start as the active key of their purpose unless the store
+    // has the key already. Empty falls back to CVK_TR31 and ZPK_TR31.
+    Blocks map[keys.Purpose]string
+}
+
+// PINConfig configures PIN verification. PINs are never stored: the issuer
+// keeps their Visa PVV and recomputes it from the PIN block (DE52), which is
+// decrypted with the zone PIN key (ZPK).
+type PINConfig struct {
+    // PVVProvider selects how PVVs are derived: "demo" (3DES in software with
+    // the PVK of the key store) or "softhsm" (PKCS#11 with the PVK labelled
+    // SoftHSM.PVKLabel; needs CVVProvider "softhsm", whose session it shares).
+    PVVProvider string
+    // PVKI is the PVK index new PINs are derived with (0-9).
+    PVKI int
+    // MaxTries is how many wrong PINs in a row block the PIN until it is set again.
+    MaxTries int
+}
+
+// DCVVConfig configures dynamic CVVs: codes derived by the CVV provider for
+// a time window instead of the printed CVV2. Cards with dCVV enabled only
+// accept dynamic codes, each in at most one approved authorization.
+type DCVVConfig struct {
+    // Step is how long one code is valid.
+    Step time.Duration
+    // Tolerance is how many windows before or after the current one are
+    // accepted, for the clock skew between the app and the issuer.
+    Tolerance int
+}
+
+// CreditConfig holds the terms of the credit product. Amounts are in minor units.
+type CreditConfig struct {
+    // PurchaseAPRBps is the annual rate on purchases in basis points, given to
+    // new accounts; interest accrues daily at PurchaseAPRBps/365.
+    PurchaseAPRBps int
+    // GracePeriodDays is how long after a statement closes its payment is
+    // due. Interest of a cycle is waived when the previous statement was
+    // paid in full by its due date. At most 27, so a payment is due before
+    // the next statement closes.
+    GracePeriodDays int
+    // MinimumPaymentBps is the part of the statement balance due, plus the
+    // interest and fees of the cycle; at least MinimumPaymentFloor, at most
+    // the balance.
+    MinimumPaymentBps   int
+    MinimumPaymentFloor int64
+    // LateFee is charged when less than the minimum payment was paid by the due date.
+    LateFee int64
+    // CycleInterval is how often the end of day of credit accounts runs for
+    // business dates closed by a cutover; 0 disables it.
+    CycleInterval time.Duration
+}
+
+// SoftHSMConfig holds the PKCS#11 settings for the SoftHSM CVV and PVV providers.
+type SoftHSMConfig struct {
+    LibPath  string
+    SlotID   uint
+    PIN      string
+    CVKLabel string
+    PVKLabel string
 }
 
 func DefaultConfig() *Config {
     return &Config{
-        HTTPAddr:    "localhost:9090",
-        ISO8583Addr: "localhost:8583",
-        CardProduct: "debit",
-        BINPrefix:   "421234",
+        HTTPAddr:       "localhost:9090",
+        ISO8583Addr:    "localhost:8583",
+        ISO8583Spec:    "playground",
+        CardProduct:    "debit",
+        BINPrefix:      "421234",
+        CVVProvider:    "demo",
+        CVVServiceCode: "000",
+        PIN:            PINConfig{PVVProvider: "demo", PVKI: 1, MaxTries: 3},
+        DCVV:           DCVVConfig{Step: 5 * time.Minute, Tolerance: 1},
+        HoldTTL:        defaultHoldTTL,
+        HoldTTLByMCC: map[string]time.Duration{
+            "7011": 31 * 24 * time.Hour, // hotels, motels, resorts
+            "7512": 31 * 24 * time.Hour, // car rental
+        },
+        HoldReleaseInterval: time.Minute,
+        HoldReleaseBatch:    500,
+        Cutover:             CutoverSchedule,
+        CutoverInterval:     time.Minute,
+        Credit: CreditConfig{
+            PurchaseAPRBps:      2499,
+            GracePeriodDays:     25,
+            MinimumPaymentBps:   100,
+            MinimumPaymentFloor: 25_00,
+            LateFee:             29_00,
+            CycleInterval:       time.Minute,
+        },
+        Fees: []models.FeeRule{
+            {Name: "ATM withdrawal", Types: []models.TransactionType{models.TransactionTypeATMWithdrawal}, Flat: 2_50},
+            {Name: "cash advance", Types: []models.TransactionType{models.TransactionTypeCashAdvance}, RateBps: 500, Min: 10_00},
+            {Name: "card replacement", Types: []models.TransactionType{models.TransactionTypeCardReplacement}, Flat: 5_00},
+        },
+        Transactions: map[models.TransactionType]TransactionPolicy{
+            models.TransactionTypePurchase:       {MaxAmount: 50_000_00, LimitCode: models.ApprovalCodeExceedsLimit},
+            models.TransactionTypeATMWithdrawal:  {MaxAmount: 500_00, DailyAmount: 1_000_00, LimitCode: models.ApprovalCodeExceedsLimit, RequirePIN: true},
+            models.TransactionTypeCashAdvance:    {MaxAmount: 1_000_00, DailyAmount: 2_000_00, LimitCode: models.ApprovalCodeExceedsLimit, RequirePIN: true},
+            models.TransactionTypeRefund:         {MaxAmount: 5_000_00, LimitCode: models.ApprovalCodeInvalidAmount},
+            models.TransactionTypeBalanceInquiry: {},
+        },
+    }
+}
+
+const defaultHoldTTL = 7 * 24 * time.Hour
+
+// HoldTTLFor returns the hold lifetime for an authorization from a merchant with the given MCC.
+func (c *Config) HoldTTLFor(mcc string) time.Duration {
+    if ttl, ok := c.HoldTTLByMCC[mcc]; ok && ttl > 0 {
+        return ttl
+    }
+    if c.HoldTTL > 0 {
+        return c.HoldTTL
     }
+    return defaultHoldTTL
 }
@@ -0,0 +1,104 @@
+package issuer
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/alovak/cardflow-playground/issuer/models"
+)
+
+// MinimumPayment returns what is due of a statement balance: MinimumPaymentBps
+// of it plus the interest and fees of the cycle, at least MinimumPaymentFloor
+// and at most the balance. Nothing is due on a balance in credit.
+func (c CreditConfig) MinimumPayment(balance, interest, fees int64) int64 {
+	if balance <= 0 {
+		return 0
+	}
+	minimum := balance*int64(c.MinimumPaymentBps)/10_000 + interest + fees
+	if minimum < c.MinimumPaymentFloor {
+		minimum = c.MinimumPaymentFloor
+	}
+	if minimum > balance {
+		minimum = balance
+	}
+	return minimum
+}
+
+// creditTerms returns the credit terms of the configuration, with a grace
+// period that keeps the due date before the next statement.
+func (i *Service) creditTerms() CreditConfig {
+	terms := DefaultConfig().Credit
+	if i.cfg != nil {
+		terms = i.cfg.Credit
+	}
+	if terms.GracePeriodDays > 27 {
+		terms.GracePeriodDays = 27
+	}
+	return terms
+}
+
+// MakePayment pays towards the balance of a credit account. The payment is
+// booked to the current business date and counts towards the latest
+// statement when made by its due date.
+func (i *Service) MakePayment(accountID string, create models.CreatePayment) (*models.Payment, error) {
+	if create.Amount <= 0 {
+		return nil, fmt.Errorf("payment of %d: %w", create.Amount, models.ErrInvalidAmount)
+	}
+
+	businessDate, err := i.BusinessDate()
+	if err != nil {
+		return nil, err
+	}
+	payment, err := i.repo.CreatePayment(context.Background(), accountID, create.Amount, create.Currency, businessDate)
+	if err != nil {
+		return nil, fmt.Errorf("creating payment: %w", err)
+	}
+
+	return payment, nil
+}
+
+func (i *Service) ListStatements(accountID string) ([]*models.Statement, error) {
+	statements, err := i.repo.ListStatements(context.Background(), accountID)
+	if err != nil {
+		return nil, fmt.Errorf("listing statements: %w", err)
+	}
+
+	return statements, nil
+}
+
+// RunCreditCycle runs the end of day of every credit account for each
+// business date closed by a cutover that it has not run for yet: interest
+// accrual, late fees and, on the statement day, the statement. Every day of
+// an account is closed in its own transaction, so a failed run resumes where
+// it stopped. It returns the statements it closed.
+func (i *Service) RunCreditCycle(ctx context.Context) ([]*models.Statement, error) {
+	businessDate, err := i.BusinessDate()
+	if err != nil {
+		return nil, err
+	}
+	through := businessDate.AddDate(0, 0, -1)
+	terms := i.creditTerms()
+
+	accountIDs, err := i.repo.ListCreditAccountsToClose(ctx, through)
+	if err != nil {
+		return nil, fmt.Errorf("listing credit accounts: %w", err)
+	}
+
+	var statements []*models.Statement
+	for _, accountID := range accountIDs {
+		for {
+			day, statement, closed, err := i.repo.CloseCreditDay(ctx, accountID, through, terms)
+			if err != nil {
+				return statements, fmt.Errorf("closing %s of account %s: %w", day.Format("2006-01-02"), accountID, err)
+			}
+			if !closed {
+				break
+			}
+			if statement != nil {
+				statements = append(statements, statement)
+			}
+		}
+	}
+
+	return statements, nil
+}
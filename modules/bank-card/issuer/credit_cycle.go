@@ -0,0 +1,72 @@
+package issuer
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"golang.org/x/exp/slog"
+)
+
+// creditCycler periodically runs the end of day of credit accounts for the
+// business dates closed by a cutover. Each day of an account is closed once,
+// under a lock of its account row, so several issuer instances may run it.
+type creditCycler struct {
+	service  *Service
+	interval time.Duration
+	logger   *slog.Logger
+
+	stop chan struct{}
+	wg   sync.WaitGroup
+}
+
+func newCreditCycler(logger *slog.Logger, service *Service, interval time.Duration) *creditCycler {
+	return &creditCycler{
+		service:  service,
+		interval: interval,
+		logger:   logger.With(slog.String("type", "credit-cycler")),
+		stop:     make(chan struct{}),
+	}
+}
+
+// Start runs the cycler in a background goroutine until Stop is called.
+func (c *creditCycler) Start() {
+	c.wg.Add(1)
+	go func() {
+		defer c.wg.Done()
+
+		c.logger.Info("credit cycler started", slog.Duration("interval", c.interval))
+
+		ticker := time.NewTicker(c.interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-c.stop:
+				c.logger.Info("credit cycler stopped")
+				return
+			case <-ticker.C:
+				c.run()
+			}
+		}
+	}()
+}
+
+// Stop signals the cycler to exit and waits for the current run to finish.
+func (c *creditCycler) Stop() {
+	close(c.stop)
+	c.wg.Wait()
+}
+
+func (c *creditCycler) run() {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+	defer cancel()
+
+	statements, err := c.service.RunCreditCycle(ctx)
+	if err != nil {
+		c.logger.Error("running credit cycle", "err", err)
+	}
+	if len(statements) > 0 {
+		c.logger.Info("closed statements", slog.Int("statements", len(statements)))
+	}
+}
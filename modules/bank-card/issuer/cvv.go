@@ -0,0 +1,58 @@
+package issuer
+
+import (
+	"fmt"
+
+	"github.com/alovak/cardflow-playground/internal/keys"
+	"github.com/alovak/cardflow-playground/internal/security"
+)
+
+// newCVVProvider returns the CVV providers selected by cfg.CVVProvider, one
+// for each CVK version of the store, and a function releasing their
+// resources. New cards get the version pinned in cfg.Keys.Versions, the
+// active one otherwise.
+func newCVVProvider(cfg *Config, store *keys.Store) (byKeyVersion[security.CVVProvider], func(), error) {
+	name := ""
+	if cfg != nil {
+		name = cfg.CVVProvider
+	}
+
+	switch name {
+	case "", "demo", "visa":
+		cvk, err := issuerKey(store, cfg, keys.PurposeCVK)
+		if err != nil {
+			return byKeyVersion[security.CVVProvider]{}, nil, err
+		}
+		providers := byKeyVersion[security.CVVProvider]{current: cvk.Version, values: map[int]security.CVVProvider{}}
+		for _, key := range keyVersions(store, keys.PurposeCVK) {
+			provider, err := cvvProviderFor(name, key)
+			if err != nil && key.Version == cvk.Version {
+				return byKeyVersion[security.CVVProvider]{}, nil, err
+			}
+			// an earlier CVK of another provider issued no card this one verifies
+			if err == nil {
+				providers.values[key.Version] = provider
+			}
+		}
+		return providers, func() {}, nil
+	case "softhsm":
+		provider, closeFn, err := newSoftHSMProvider(cfg.SoftHSM)
+		if err != nil {
+			return byKeyVersion[security.CVVProvider]{}, nil, err
+		}
+		return singleKeyVersion(provider), closeFn, nil
+	default:
+		return byKeyVersion[security.CVVProvider]{}, nil, fmt.Errorf("unsupported CVV provider: %s", name)
+	}
+}
+
+// cvvProviderFor returns the software CVV provider of the name keyed by cvk.
+func cvvProviderFor(name string, cvk *keys.Key) (security.CVVProvider, error) {
+	if name != "visa" {
+		return security.NewDemoProviderStrict(cvk.Material()), nil
+	}
+	if cvk.Algorithm != keys.AlgorithmTDES || len(cvk.Material()) != 16 {
+		return nil, fmt.Errorf("visa CVV provider needs a double length TDES CVK, not %s", cvk)
+	}
+	return security.NewVisaProvider(cvk.Material()), nil
+}
@@ -0,0 +1,13 @@
+//go:build !softhsm
+
+package issuer
+
+import (
+	"fmt"
+
+	"github.com/alovak/cardflow-playground/internal/security"
+)
+
+func newSoftHSMProvider(SoftHSMConfig) (security.CVVProvider, func(), error) {
+	return nil, nil, fmt.Errorf("softhsm CVV provider requires a binary built with -tags softhsm")
+}
@@ -0,0 +1,37 @@
+//go:build softhsm
+
+package issuer
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/alovak/cardflow-playground/internal/security"
+	"github.com/alovak/cardflow-playground/internal/security/hsm"
+)
+
+func newSoftHSMProvider(cfg SoftHSMConfig) (security.CVVProvider, func(), error) {
+	if cfg.LibPath == "" {
+		cfg.LibPath = getenv("SOFTHSM_LIB", "/usr/lib/softhsm/libsofthsm2.so")
+	}
+	if cfg.SlotID == 0 {
+		slot, err := strconv.ParseUint(getenv("SOFTHSM_SLOT", "0"), 10, 32)
+		if err != nil {
+			return nil, nil, fmt.Errorf("parsing SOFTHSM_SLOT: %w", err)
+		}
+		cfg.SlotID = uint(slot)
+	}
+	if cfg.PIN == "" {
+		cfg.PIN = getenv("SOFTHSM_PIN", "")
+	}
+	if cfg.CVKLabel == "" {
+		cfg.CVKLabel = getenv("SOFTHSM_CVK_LABEL", "cvk")
+	}
+
+	provider := hsm.NewSoftHSMProvider(cfg.LibPath, cfg.SlotID, cfg.PIN, cfg.CVKLabel)
+	if err := provider.Open(); err != nil {
+		return nil, nil, fmt.Errorf("opening softhsm session: %w", err)
+	}
+
+	return provider, provider.Close, nil
+}
@@ -0,0 +1,109 @@
+package issuer
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"time"
+
+	"github.com/alovak/cardflow-playground/internal/cardgen"
+	"github.com/alovak/cardflow-playground/issuer/models"
+)
+
+// dcvvConfig returns the dCVV settings, falling back to the defaults.
+func (i *Service) dcvvConfig() DCVVConfig {
+	if i.cfg == nil || i.cfg.DCVV.Step < time.Second {
+		return DefaultConfig().DCVV
+	}
+	cfg := i.cfg.DCVV
+	if cfg.Tolerance < 0 {
+		cfg.Tolerance = 0
+	}
+	return cfg
+}
+
+// SetDCVV enables or disables the dynamic CVVs of a card.
+func (i *Service) SetDCVV(accountID, cardID string, req models.SetDCVV) (*models.DCVVStatus, error) {
+	if err := i.repo.SetCardDCVV(accountID, cardID, req.Enabled); err != nil {
+		return nil, fmt.Errorf("setting dcvv: %w", err)
+	}
+	return &models.DCVVStatus{CardID: cardID, Enabled: req.Enabled}, nil
+}
+
+// GetDCVV returns the dynamic CVV of a card for the current time window and
+// when it expires. The issuer only keeps a hash of the PAN, so the caller
+// passes it, like in the PIN requests.
+func (i *Service) GetDCVV(accountID, cardID, pan string) (*models.DynamicCVV, error) {
+	if err := i.checkCardNumber(accountID, cardID, pan); err != nil {
+		return nil, err
+	}
+	card, err := i.repo.GetCard(accountID, cardID)
+	if err != nil {
+		return nil, fmt.Errorf("finding card: %w", err)
+	}
+	if !card.DCVVEnabled {
+		return nil, models.ErrDCVVNotEnabled
+	}
+
+	now := i.now()
+	cvv, ttl, err := i.computeDCVV(pan, card.ExpirationDate, card.CVKVersion, now)
+	if err != nil {
+		return nil, fmt.Errorf("computing dcvv: %w", err)
+	}
+	step := i.dcvvConfig().Step
+	return &models.DynamicCVV{
+		CardID:    cardID,
+		CVV:       cvv,
+		TTL:       ttl,
+		ExpiresAt: dcvvWindow(now, step).Add(step),
+	}, nil
+}
+
+// computeDCVV derives the dynamic CVV of the time window at falls in and the
+// seconds left in it, with the CVK version of the card.
+func (i *Service) computeDCVV(pan, expiryYYMM string, cvkVersion int, at time.Time) (string, int, error) {
+	pan = cardgen.NormalizePAN(pan)
+	if len(pan) < 2 {
+		return "", 0, fmt.Errorf("pan is too short")
+	}
+	provider, err := i.cvv.get(cvkVersion)
+	if err != nil {
+		return "", 0, fmt.Errorf("finding cvk: %w", err)
+	}
+	return provider.ComputeDCVVAt(pan[:len(pan)-1], expiryYYMM, i.cvvServiceCode(), at, i.dcvvConfig().Step, 3)
+}
+
+// verifyDCVV compares the presented code with the dynamic CVVs of the current
+// time window and of Tolerance windows on either side, nearest first, in
+// constant time. It returns the start of the window that matched.
+func (i *Service) verifyDCVV(pan, expiryYYMM string, cvkVersion int, presented string) (time.Time, bool, error) {
+	if presented == "" {
+		return time.Time{}, false, nil
+	}
+	cfg := i.dcvvConfig()
+	now := i.now()
+	offsets := []int{0}
+	for k := 1; k <= cfg.Tolerance; k++ {
+		offsets = append(offsets, -k, k)
+	}
+	for _, k := range offsets {
+		at := now.Add(time.Duration(k) * cfg.Step)
+		expected, _, err := i.computeDCVV(pan, expiryYYMM, cvkVersion, at)
+		if err != nil {
+			return time.Time{}, false, err
+		}
+		if subtle.ConstantTimeCompare([]byte(expected), []byte(presented)) == 1 {
+			return dcvvWindow(at, cfg.Step), true, nil
+		}
+	}
+	return time.Time{}, false, nil
+}
+
+// dcvvWindow returns the start of the time window t falls in; the providers
+// number windows as Unix seconds divided by the step in whole seconds.
+func dcvvWindow(t time.Time, step time.Duration) time.Time {
+	sec := int64(step / time.Second)
+	if sec < 1 {
+		sec = 1
+	}
+	return time.Unix(t.Unix()/sec*sec, 0).UTC()
+}
@@ -0,0 +1,67 @@
+package issuer
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/alovak/cardflow-playground/issuer/models"
+	"github.com/google/uuid"
+)
+
+// OpenDispute disputes a posted transaction of the account on behalf of the
+// cardholder and credits the disputed amount provisionally.
+func (i *Service) OpenDispute(accountID, transactionID string, create models.CreateDispute) (*models.Dispute, error) {
+	if _, ok := models.DisputeReasonCodes[create.ReasonCode]; !ok {
+		return nil, fmt.Errorf("%q: %w", create.ReasonCode, models.ErrInvalidReasonCode)
+	}
+
+	dispute := &models.Dispute{
+		ID:            uuid.New().String(),
+		AccountID:     accountID,
+		TransactionID: transactionID,
+		Amount:        create.Amount,
+		ReasonCode:    create.ReasonCode,
+		Description:   create.Description,
+	}
+
+	if err := i.repo.CreateDispute(context.Background(), dispute); err != nil {
+		return nil, fmt.Errorf("creating dispute: %w", err)
+	}
+
+	return dispute, nil
+}
+
+// GetDispute returns the dispute with its status history.
+func (i *Service) GetDispute(accountID, disputeID string) (*models.Dispute, error) {
+	dispute, err := i.repo.GetDispute(context.Background(), accountID, disputeID)
+	if err != nil {
+		return nil, fmt.Errorf("finding dispute: %w", err)
+	}
+
+	return dispute, nil
+}
+
+func (i *Service) ListDisputes(accountID string) ([]*models.Dispute, error) {
+	disputes, err := i.repo.ListDisputes(context.Background(), accountID)
+	if err != nil {
+		return nil, fmt.Errorf("listing disputes: %w", err)
+	}
+
+	return disputes, nil
+}
+
+// ChangeDisputeStatus moves a dispute through its lifecycle, e.g. OPENED ->
+// CHARGEBACK when the chargeback is sent or CHARGEBACK -> REPRESENTMENT when
+// the merchant contests it. Disallowed transitions return
+// models.ErrInvalidDisputeStatusTransition.
+func (i *Service) ChangeDisputeStatus(accountID, disputeID string, change models.ChangeDisputeStatus) (*models.Dispute, error) {
+	if !change.Status.Valid() {
+		return nil, fmt.Errorf("unknown dispute status %q: %w", change.Status, models.ErrInvalidDisputeStatusTransition)
+	}
+
+	if _, err := i.repo.UpdateDisputeStatus(context.Background(), accountID, disputeID, change); err != nil {
+		return nil, fmt.Errorf("updating dispute status: %w", err)
+	}
+
+	return i.GetDispute(accountID, disputeID)
+}
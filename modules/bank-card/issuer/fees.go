@@ -0,0 +1,80 @@
+package issuer
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/alovak/cardflow-playground/issuer/models"
+)
+
+// feeRules returns the fee rules of the configuration.
+func (i *Service) feeRules() []models.FeeRule {
+	if i.cfg == nil {
+		return DefaultConfig().Fees
+	}
+	return i.cfg.Fees
+}
+
+// QuoteFees returns the fees a transaction would be charged on the account,
+// without charging them. A request without a type is typed by its MCC.
+func (i *Service) QuoteFees(accountID string, req models.FeeRequest) (*models.FeeQuote, error) {
+	if req.Type == "" {
+		req.Type = models.TransactionTypeForMCC(req.MCC)
+	}
+	if !req.Type.Valid() || req.Amount < 0 {
+		return nil, fmt.Errorf("%s of %d: %w", req.Type, req.Amount, models.ErrInvalidFeeRequest)
+	}
+
+	account, err := i.repo.GetAccount(accountID)
+	if err != nil {
+		return nil, fmt.Errorf("finding account: %w", err)
+	}
+	req.AccountCurrency = account.Currency
+	if req.Currency == "" {
+		req.Currency = account.Currency
+	}
+	// transactions in another currency are declined (see AuthorizeRequest)
+	if !strings.EqualFold(req.Currency, account.Currency) {
+		return nil, fmt.Errorf("%s is not the account currency %s: %w", req.Currency, account.Currency, models.ErrInvalidFeeRequest)
+	}
+
+	quote := models.QuoteFees(i.feeRules(), req)
+	return &quote, nil
+}
+
+// ReplaceCard closes the card, unless it is closed already, issues a new one
+// for the account and charges the card replacement fee. It returns the new
+// card and the fees charged.
+func (i *Service) ReplaceCard(accountID, cardID string) (*models.Card, []*models.Transaction, error) {
+	card, err := i.repo.GetCard(accountID, cardID)
+	if err != nil {
+		return nil, nil, fmt.Errorf("finding card: %w", err)
+	}
+	if card.Status != models.CardStatusClosed {
+		change := models.ChangeCardStatus{Status: models.CardStatusClosed, Reason: "replaced", Actor: "issuer"}
+		if _, _, err := i.ChangeCardStatus(accountID, cardID, change); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	replacement, err := i.IssueCard(accountID)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	quote, err := i.QuoteFees(accountID, models.FeeRequest{Type: models.TransactionTypeCardReplacement})
+	if err != nil {
+		return nil, nil, err
+	}
+	businessDate, err := i.BusinessDate()
+	if err != nil {
+		return nil, nil, err
+	}
+	fees, err := i.repo.ChargeFee(context.Background(), accountID, replacement.ID, *quote, businessDate)
+	if err != nil {
+		return nil, nil, fmt.Errorf("charging replacement fee: %w", err)
+	}
+
+	return replacement, fees, nil
+}
@@ -0,0 +1,95 @@
+package issuer
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"golang.org/x/exp/slog"
+)
+
+// holdSweeper periodically releases authorization holds whose hold_expires_at
+// has passed. It is safe to run on several issuer instances at once: each
+// batch locks its rows with "for update skip locked".
+type holdSweeper struct {
+	repo     *Repository
+	interval time.Duration
+	batch    int
+	logger   *slog.Logger
+
+	stop chan struct{}
+	wg   sync.WaitGroup
+}
+
+func newHoldSweeper(logger *slog.Logger, repo *Repository, interval time.Duration, batch int) *holdSweeper {
+	if batch <= 0 {
+		batch = 500
+	}
+
+	return &holdSweeper{
+		repo:     repo,
+		interval: interval,
+		batch:    batch,
+		logger:   logger.With(slog.String("type", "hold-sweeper")),
+		stop:     make(chan struct{}),
+	}
+}
+
+// Start runs the sweeper in a background goroutine until Stop is called.
+func (s *holdSweeper) Start() {
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+
+		s.logger.Info("hold sweeper started", slog.Duration("interval", s.interval))
+
+		ticker := time.NewTicker(s.interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-s.stop:
+				s.logger.Info("hold sweeper stopped")
+				return
+			case <-ticker.C:
+				s.sweep()
+			}
+		}
+	}()
+}
+
+// Stop signals the sweeper to exit and waits for the current sweep to finish.
+func (s *holdSweeper) Stop() {
+	close(s.stop)
+	s.wg.Wait()
+}
+
+// sweep releases expired holds batch by batch until a batch comes back short
+// or the sweeper is stopped.
+func (s *holdSweeper) sweep() {
+	total := 0
+	for {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		n, err := s.repo.ReleaseExpiredHolds(ctx, s.batch)
+		cancel()
+		if err != nil {
+			s.logger.Error("releasing expired holds", "err", err)
+			return
+		}
+
+		total += n
+		if n < s.batch {
+			break
+		}
+
+		select {
+		case <-s.stop:
+			return
+		default:
+		}
+	}
+
+	if total > 0 {
+		s.logger.Info("released expired holds", slog.Int("released", total))
+	}
+}
@@ -1,14 +1,22 @@
 package issuer_test
 
 import (
+    "context"
     "database/sql"
+    "encoding/hex"
+    "errors"
+    "fmt"
     "os"
     "testing"
     "time"
 
     issuer "github.com/alovak/cardflow-playground/issuer"
     "github.com/alovak/cardflow-playground/issuer/models"
+    "github.com/alovak/cardflow-playground/internal/clearing"
     "github.com/alovak/cardflow-playground/internal/expiry"
+    "github.com/alovak/cardflow-playground/internal/keys"
+    "github.com/alovak/cardflow-playground/internal/security"
+    "github.com/google/uuid"
     _ "github.com/lib/pq"
 )
 
@@ -64,3 +72,1129 @@ func TestCardExpiryStoredAsYYMM(t *testing.T) {
     }
 }
 
+// TestHoldExpiryAndRelease verifies that authorizations get hold_expires_at and that
+// ReleaseExpiredHolds returns expired holds to the available balance.
+func TestHoldExpiryAndRelease(t *testing.T) {
+    if os.Getenv("REPO_BACKEND") != "pg" {
+        t.Skip("REPO_BACKEND != pg; skipping DB integration test")
+    }
+    dsn := os.Getenv("DB_DSN")
+    if dsn == "" {
+        t.Skip("DB_DSN not set; skipping DB integration test")
+    }
+
+    db, err := sql.Open("postgres", dsn)
+    if err != nil { t.Fatalf("open db: %v", err) }
+    defer db.Close()
+
+    repo := issuer.NewPGRepository(db, []byte("test-pan-hash-key"))
+    cfg := issuer.DefaultConfig()
+    svc := issuer.NewService(repo, cfg)
+
+    acc, err := svc.CreateAccount(models.CreateAccount{Balance: 10000, Currency: "USD"})
+    if err != nil { t.Fatalf("create account: %v", err) }
+    card, err := svc.IssueCard(acc.ID)
+    if err != nil { t.Fatalf("issue card: %v", err) }
+    if _, _, err := svc.ChangeCardStatus(acc.ID, card.ID, models.ChangeCardStatus{Status: models.CardStatusActive, Actor: "test"}); err != nil {
+        t.Fatalf("activate card: %v", err)
+    }
+    yymm, _ := expiry.ParseCardFace(card.ExpirationDate)
+    presented := *card
+    presented.ExpirationDate = yymm
+
+    stan := int(time.Now().UnixNano() % 999999)
+    res, err := svc.AuthorizeRequest(models.AuthorizationRequest{
+        Amount: 2500, Currency: "USD", Card: presented,
+        Merchant: models.Merchant{Name: "Hotel", MCC: "7011"}, STAN: &stan,
+    })
+    if err != nil { t.Fatalf("authorize: %v", err) }
+    if res.ApprovalCode != models.ApprovalCodeApproved { t.Fatalf("approval code = %s", res.ApprovalCode) }
+
+    var expiresAt time.Time
+    if err := db.QueryRow(`select hold_expires_at from issuer.auths where card_id=$1 and stan=$2`, card.ID, stan).Scan(&expiresAt); err != nil {
+        t.Fatalf("scan hold_expires_at: %v", err)
+    }
+    if d := time.Until(expiresAt); d < 30*24*time.Hour {
+        t.Fatalf("hotel hold expires in %v, want >= 30 days", d)
+    }
+
+    // expire the hold and release it
+    if _, err := db.Exec(`update issuer.auths set hold_expires_at = now() - interval '1 minute' where card_id=$1`, card.ID); err != nil {
+        t.Fatalf("expire hold: %v", err)
+    }
+    if _, err := repo.ReleaseExpiredHolds(context.Background(), 100); err != nil {
+        t.Fatalf("release holds: %v", err)
+    }
+    account, err := svc.GetAccount(acc.ID)
+    if err != nil { t.Fatalf("get account: %v", err) }
+    if account.AvailableBalance != 10000 || account.HoldBalance != 0 {
+        t.Fatalf("balances after release: available=%d hold=%d", account.AvailableBalance, account.HoldBalance)
+    }
+}
+
+func TestAdvicesAreIdempotent(t *testing.T) {
+    if os.Getenv("REPO_BACKEND") != "pg" {
+        t.Skip("REPO_BACKEND != pg; skipping DB integration test")
+    }
+    dsn := os.Getenv("DB_DSN")
+    if dsn == "" {
+        t.Skip("DB_DSN not set; skipping DB integration test")
+    }
+
+    db, err := sql.Open("postgres", dsn)
+    if err != nil { t.Fatalf("open db: %v", err) }
+    defer db.Close()
+
+    repo := issuer.NewPGRepository(db, []byte("test-pan-hash-key"))
+    svc := issuer.NewService(repo, issuer.DefaultConfig())
+
+    acc, err := svc.CreateAccount(models.CreateAccount{Balance: 10000, Currency: "USD"})
+    if err != nil { t.Fatalf("create account: %v", err) }
+    card, err := svc.IssueCard(acc.ID)
+    if err != nil { t.Fatalf("issue card: %v", err) }
+
+    // offline approvals are recorded whatever the card status, and only once
+    stan := int(time.Now().UnixNano() % 999999)
+    advice := models.AuthorizationRequest{
+        Amount: 2500, Currency: "USD", Card: models.Card{Number: card.Number},
+        Merchant: models.Merchant{Name: "Demo Merchant", MCC: "5411", TerminalID: "T0000001"}, STAN: &stan,
+        RRN: fmt.Sprintf("6289%08d", stan),
+    }
+    for i := 0; i < 2; i++ {
+        if err := svc.AdviseAuthorization(advice, "Y1OFFL"); err != nil { t.Fatalf("advice %d: %v", i, err) }
+    }
+    account, err := svc.GetAccount(acc.ID)
+    if err != nil { t.Fatalf("get account: %v", err) }
+    if account.AvailableBalance != 7500 || account.HoldBalance != 2500 {
+        t.Fatalf("balances after advice: available=%d hold=%d", account.AvailableBalance, account.HoldBalance)
+    }
+
+    // the reversal advice releases the hold, repeats are acknowledged too
+    yymm, _ := expiry.ParseCardFace(card.ExpirationDate)
+    original := models.OriginalTransaction{
+        Card: models.Card{Number: card.Number, ExpirationDate: yymm}, TerminalID: "T0000001", RRN: advice.RRN,
+    }
+    for i := 0; i < 2; i++ {
+        if err := svc.ReverseAuthorization(original); err != nil { t.Fatalf("reversal advice %d: %v", i, err) }
+    }
+    account, err = svc.GetAccount(acc.ID)
+    if err != nil { t.Fatalf("get account: %v", err) }
+    if account.AvailableBalance != 10000 || account.HoldBalance != 0 {
+        t.Fatalf("balances after reversal: available=%d hold=%d", account.AvailableBalance, account.HoldBalance)
+    }
+
+    // an advice the balance does not cover is an EXCEPTION without a hold;
+    // its reversal is acknowledged all the same
+    short := advice
+    short.Amount, short.RRN = 50000, fmt.Sprintf("6290%08d", stan)
+    if err := svc.AdviseAuthorization(short, "Y1OFFL"); err != nil { t.Fatalf("short advice: %v", err) }
+    original.RRN = short.RRN
+    if err := svc.ReverseAuthorization(original); err != nil { t.Fatalf("reversal of the exception: %v", err) }
+    var status string
+    if err := db.QueryRow(`select status from issuer.auths where rrn=$1`, short.RRN).Scan(&status); err != nil { t.Fatalf("auth status: %v", err) }
+    if status != "REVERSED" { t.Fatalf("exception auth is %s after its reversal", status) }
+
+    // so is one in another currency than the account's, which cannot be held
+    foreign := advice
+    foreign.Currency, foreign.RRN = "EUR", fmt.Sprintf("6292%08d", stan)
+    if err := svc.AdviseAuthorization(foreign, "Y1OFFL"); err != nil { t.Fatalf("foreign advice: %v", err) }
+    if err := db.QueryRow(`select status from issuer.auths where rrn=$1`, foreign.RRN).Scan(&status); err != nil { t.Fatalf("auth status: %v", err) }
+    if status != "EXCEPTION" { t.Fatalf("foreign advice is %s", status) }
+    account, err = svc.GetAccount(acc.ID)
+    if err != nil { t.Fatalf("get account: %v", err) }
+    if account.AvailableBalance != 10000 || account.HoldBalance != 0 {
+        t.Fatalf("balances after foreign advice: available=%d hold=%d", account.AvailableBalance, account.HoldBalance)
+    }
+
+    // a captured one has nothing left to release
+    captured := advice
+    captured.RRN = fmt.Sprintf("6291%08d", stan)
+    if err := svc.AdviseAuthorization(captured, "Y1OFFL"); err != nil { t.Fatalf("captured advice: %v", err) }
+    original.RRN = captured.RRN
+    if err := svc.CaptureAuthorization(original, stan, captured.Amount, "USD"); err != nil { t.Fatalf("capture: %v", err) }
+    if err := svc.ReverseAuthorization(original); !errors.Is(err, models.ErrNothingToReverse) { t.Fatalf("reversal of a captured auth: %v", err) }
+}
+
+// TestAuthorizationsAreIdempotentByRRN verifies that a repeated request (same
+// RRN) gets the first answer, while a new transaction that reuses the STAN of
+// an older one (acquirers restart STANs every day) is authorized on its own.
+func TestAuthorizationsAreIdempotentByRRN(t *testing.T) {
+    if os.Getenv("REPO_BACKEND") != "pg" {
+        t.Skip("REPO_BACKEND != pg; skipping DB integration test")
+    }
+    dsn := os.Getenv("DB_DSN")
+    if dsn == "" {
+        t.Skip("DB_DSN not set; skipping DB integration test")
+    }
+
+    db, err := sql.Open("postgres", dsn)
+    if err != nil { t.Fatalf("open db: %v", err) }
+    defer db.Close()
+
+    repo := issuer.NewPGRepository(db, []byte("test-pan-hash-key"))
+    svc := issuer.NewService(repo, issuer.DefaultConfig())
+
+    acc, err := svc.CreateAccount(models.CreateAccount{Balance: 10000, Currency: "USD"})
+    if err != nil { t.Fatalf("create account: %v", err) }
+    card, err := svc.IssueCard(acc.ID)
+    if err != nil { t.Fatalf("issue card: %v", err) }
+    if _, _, err := svc.ChangeCardStatus(acc.ID, card.ID, models.ChangeCardStatus{Status: models.CardStatusActive, Actor: "test"}); err != nil {
+        t.Fatalf("activate card: %v", err)
+    }
+    yymm, _ := expiry.ParseCardFace(card.ExpirationDate)
+    presented := *card
+    presented.ExpirationDate = yymm
+
+    stan := 1
+    authorize := func(rrn string, transmittedAt time.Time) string {
+        res, err := svc.AuthorizeRequest(models.AuthorizationRequest{
+            Amount: 1000, Currency: "USD", Card: presented,
+            Merchant: models.Merchant{Name: "Demo Merchant", MCC: "5411", TerminalID: "T0000001"},
+            STAN: &stan, RRN: rrn, TransmittedAt: transmittedAt,
+        })
+        if err != nil { t.Fatalf("authorize %s: %v", rrn, err) }
+        if res.ApprovalCode != models.ApprovalCodeApproved { t.Fatalf("authorize %s: approval code = %s", rrn, res.ApprovalCode) }
+        return res.AuthorizationCode
+    }
+
+    yesterday := time.Now().UTC().Add(-24 * time.Hour).Truncate(time.Second)
+    today := time.Now().UTC().Truncate(time.Second)
+    rrn := fmt.Sprintf("%012d", time.Now().UnixNano()%1e12)
+
+    first := authorize(rrn, yesterday)
+    if repeat := authorize(rrn, yesterday); repeat != first {
+        t.Fatalf("repeated request got authorization code %s, want %s", repeat, first)
+    }
+    authorize(fmt.Sprintf("%012d", time.Now().UnixNano()%1e12), today)
+
+    account, err := svc.GetAccount(acc.ID)
+    if err != nil { t.Fatalf("get account: %v", err) }
+    if account.HoldBalance != 2000 {
+        t.Fatalf("hold balance = %d, want both transactions held", account.HoldBalance)
+    }
+
+    // the capture finds yesterday's authorization by its original data elements
+    original := models.OriginalTransaction{
+        Card: presented, TerminalID: "T0000001", MTI: "0100", STAN: stan, TransmittedAt: yesterday,
+    }
+    if err := svc.CaptureAuthorization(original, 43, 1000, "USD"); err != nil { t.Fatalf("capture: %v", err) }
+}
+
+// TestIngestClearingFile posts presentments and refunds against their
+// authorizations. Skips unless DB_DSN is provided and REPO_BACKEND=pg.
+func TestIngestClearingFile(t *testing.T) {
+    if os.Getenv("REPO_BACKEND") != "pg" {
+        t.Skip("REPO_BACKEND != pg; skipping DB integration test")
+    }
+    dsn := os.Getenv("DB_DSN")
+    if dsn == "" {
+        t.Skip("DB_DSN not set; skipping DB integration test")
+    }
+
+    db, err := sql.Open("postgres", dsn)
+    if err != nil { t.Fatalf("open db: %v", err) }
+    defer db.Close()
+
+    repo := issuer.NewPGRepository(db, []byte("test-pan-hash-key"))
+    svc := issuer.NewService(repo, issuer.DefaultConfig())
+
+    acc, err := svc.CreateAccount(models.CreateAccount{Balance: 10000, Currency: "USD"})
+    if err != nil { t.Fatalf("create account: %v", err) }
+    card, err := svc.IssueCard(acc.ID)
+    if err != nil { t.Fatalf("issue card: %v", err) }
+    if _, _, err := svc.ChangeCardStatus(acc.ID, card.ID, models.ChangeCardStatus{Status: models.CardStatusActive, Actor: "test"}); err != nil {
+        t.Fatalf("activate card: %v", err)
+    }
+    yymm, _ := expiry.ParseCardFace(card.ExpirationDate)
+    presented := *card
+    presented.ExpirationDate = yymm
+
+    prefix := fmt.Sprintf("%09d", time.Now().UnixNano()%1e9)
+    authorize := func(rrn string, amount int64) {
+        stan := 1
+        res, err := svc.AuthorizeRequest(models.AuthorizationRequest{
+            Amount: amount, Currency: "USD", Card: presented,
+            Merchant: models.Merchant{Name: "Demo Merchant", MCC: "5411", TerminalID: "T1"},
+            STAN: &stan, RRN: prefix + rrn, TransmittedAt: time.Now().UTC(),
+        })
+        if err != nil { t.Fatalf("authorize %s: %v", rrn, err) }
+        if res.ApprovalCode != models.ApprovalCodeApproved { t.Fatalf("authorize %s: approval code = %s", rrn, res.ApprovalCode) }
+    }
+    authorize("001", 4000)
+    authorize("002", 3000)
+
+    // the first one was captured online with STAN 7
+    if err := svc.CaptureAuthorization(models.OriginalTransaction{Card: presented, TerminalID: "T1", RRN: prefix + "001"}, 7, 4000, "USD"); err != nil {
+        t.Fatalf("capture: %v", err)
+    }
+
+    record := func(ref string, code clearing.TransactionCode, pan, rrn string, amount int64, stan string) clearing.Record {
+        return clearing.Record{
+            Code: code, Reference: prefix + ref, PAN: pan, ExpirationDate: yymm, Amount: amount,
+            Currency: "USD", RRN: prefix + rrn, STAN: stan, TID: "T1", TransactedAt: time.Now().UTC(),
+        }
+    }
+    file := &clearing.File{ID: prefix, BusinessDate: time.Now().UTC(), CreatedAt: time.Now().UTC(), Batches: []clearing.Batch{{
+        ID: prefix + "B", MID: "M1", Records: []clearing.Record{
+            record("R1", clearing.TransactionCodePresentment, card.Number, "001", 4000, "000007"),
+            record("R2", clearing.TransactionCodePresentment, card.Number, "002", 3500, "000008"),
+            record("R3", clearing.TransactionCodePresentment, card.Number, "003", 1000, "000009"),
+            record("R4", clearing.TransactionCodeRefund, card.Number, "002", 500, "000010"),
+            record("R5", clearing.TransactionCodeRefund, card.Number, "003", 500, "000011"),
+            record("R6", clearing.TransactionCodePresentment, "4000000000000002", "004", 100, "000012"),
+        },
+    }}}
+
+    report, err := svc.IngestClearingFile(file)
+    if err != nil { t.Fatalf("ingest: %v", err) }
+    // R1 was posted online; R2 exceeds its authorization and R3 has none;
+    // R5 refunds nothing captured and R6 is for an unknown card
+    if report.Matched != 1 || report.Posted != 1 || report.ForcePosted != 2 || report.Rejected != 2 || len(report.Exceptions) != 4 {
+        t.Fatalf("unexpected report: %+v", report)
+    }
+    wantActions := map[string]clearing.Action{
+        prefix + "R2": clearing.ActionForcePosted, prefix + "R3": clearing.ActionForcePosted,
+        prefix + "R5": clearing.ActionRejected, prefix + "R6": clearing.ActionRejected,
+    }
+    for _, e := range report.Exceptions {
+        if wantActions[e.Record.Reference] != e.Action || e.Reason == "" {
+            t.Fatalf("unexpected exception %s: %s %q", e.Record.Reference, e.Action, e.Reason)
+        }
+    }
+
+    // 100.00 - 40.00 captured online - 35.00 - 10.00 + 5.00, no hold left
+    account, err := svc.GetAccount(acc.ID)
+    if err != nil { t.Fatalf("get account: %v", err) }
+    if account.AvailableBalance != 2000 || account.HoldBalance != 0 {
+        t.Fatalf("balances = %d/%d, want 2000/0", account.AvailableBalance, account.HoldBalance)
+    }
+
+    // ingesting the file again changes nothing
+    report, err = svc.IngestClearingFile(file)
+    if err != nil { t.Fatalf("ingest again: %v", err) }
+    if report.Duplicates != 6 || len(report.Exceptions) != 0 {
+        t.Fatalf("unexpected report of the repeat: %+v", report)
+    }
+    account, err = svc.GetAccount(acc.ID)
+    if err != nil { t.Fatalf("get account: %v", err) }
+    if account.AvailableBalance != 2000 {
+        t.Fatalf("available balance = %d after the repeat, want 2000", account.AvailableBalance)
+    }
+}
+
+// TestDisputes opens disputes of captured transactions and checks the
+// provisional credit and its reversal. Skips unless DB_DSN is provided and REPO_BACKEND=pg.
+func TestDisputes(t *testing.T) {
+    if os.Getenv("REPO_BACKEND") != "pg" {
+        t.Skip("REPO_BACKEND != pg; skipping DB integration test")
+    }
+    dsn := os.Getenv("DB_DSN")
+    if dsn == "" {
+        t.Skip("DB_DSN not set; skipping DB integration test")
+    }
+
+    db, err := sql.Open("postgres", dsn)
+    if err != nil { t.Fatalf("open db: %v", err) }
+    defer db.Close()
+
+    repo := issuer.NewPGRepository(db, []byte("test-pan-hash-key"))
+    svc := issuer.NewService(repo, issuer.DefaultConfig())
+
+    acc, err := svc.CreateAccount(models.CreateAccount{Balance: 10000, Currency: "USD"})
+    if err != nil { t.Fatalf("create account: %v", err) }
+    card, err := svc.IssueCard(acc.ID)
+    if err != nil { t.Fatalf("issue card: %v", err) }
+    if _, _, err := svc.ChangeCardStatus(acc.ID, card.ID, models.ChangeCardStatus{Status: models.CardStatusActive, Actor: "test"}); err != nil {
+        t.Fatalf("activate card: %v", err)
+    }
+    yymm, _ := expiry.ParseCardFace(card.ExpirationDate)
+    presented := *card
+    presented.ExpirationDate = yymm
+
+    prefix := fmt.Sprintf("%09d", time.Now().UnixNano()%1e9)
+    purchase := func(rrn string, amount int64) string {
+        stan := 1
+        res, err := svc.AuthorizeRequest(models.AuthorizationRequest{
+            Amount: amount, Currency: "USD", Card: presented,
+            Merchant: models.Merchant{Name: "Demo Merchant", MCC: "5411", TerminalID: "T1"},
+            STAN: &stan, RRN: prefix + rrn, TransmittedAt: time.Now().UTC(),
+        })
+        if err != nil { t.Fatalf("authorize %s: %v", rrn, err) }
+        if res.ApprovalCode != models.ApprovalCodeApproved { t.Fatalf("authorize %s: approval code = %s", rrn, res.ApprovalCode) }
+        if err := svc.CaptureAuthorization(models.OriginalTransaction{Card: presented, TerminalID: "T1", RRN: prefix + rrn}, 2, amount, "USD"); err != nil {
+            t.Fatalf("capture %s: %v", rrn, err)
+        }
+        transactions, err := svc.ListTransactions(acc.ID)
+        if err != nil { t.Fatalf("list transactions: %v", err) }
+        // newest first
+        return transactions[0].ID
+    }
+    balance := func() int64 {
+        account, err := svc.GetAccount(acc.ID)
+        if err != nil { t.Fatalf("get account: %v", err) }
+        return account.AvailableBalance
+    }
+    move := func(disputeID string, status models.DisputeStatus) error {
+        _, err := svc.ChangeDisputeStatus(acc.ID, disputeID, models.ChangeDisputeStatus{Status: status, Actor: "test"})
+        return err
+    }
+
+    lostTx := purchase("001", 3000)
+    wonTx := purchase("002", 2000)
+    if got := balance(); got != 5000 {
+        t.Fatalf("available balance = %d after the purchases, want 5000", got)
+    }
+
+    if _, err := svc.OpenDispute(acc.ID, lostTx, models.CreateDispute{ReasonCode: "13.1", Amount: 3500}); !errors.Is(err, models.ErrTransactionNotDisputable) {
+        t.Fatalf("dispute above the amount: err = %v", err)
+    }
+
+    lost, err := svc.OpenDispute(acc.ID, lostTx, models.CreateDispute{ReasonCode: "13.1", Description: "never delivered"})
+    if err != nil { t.Fatalf("open dispute: %v", err) }
+    if lost.Status != models.DisputeStatusOpened || lost.Amount != 3000 || lost.RRN != prefix+"001" || lost.TerminalID != "T1" {
+        t.Fatalf("unexpected dispute: %+v", lost)
+    }
+    if _, err := svc.OpenDispute(acc.ID, lostTx, models.CreateDispute{ReasonCode: "13.1"}); !errors.Is(err, issuer.ErrConflict) {
+        t.Fatalf("second dispute: err = %v", err)
+    }
+    won, err := svc.OpenDispute(acc.ID, wonTx, models.CreateDispute{ReasonCode: "10.4", Amount: 500})
+    if err != nil { t.Fatalf("open dispute: %v", err) }
+    // the provisional credits
+    if got := balance(); got != 8500 {
+        t.Fatalf("available balance = %d after opening the disputes, want 8500", got)
+    }
+    if _, err := svc.OpenDispute(acc.ID, won.ProvisionalCreditID, models.CreateDispute{ReasonCode: "10.4"}); !errors.Is(err, models.ErrTransactionNotDisputable) {
+        t.Fatalf("dispute of the provisional credit: err = %v", err)
+    }
+
+    for _, status := range []models.DisputeStatus{models.DisputeStatusChargeback, models.DisputeStatusRepresentment, models.DisputeStatusLost} {
+        if err := move(lost.ID, status); err != nil { t.Fatalf("move to %s: %v", status, err) }
+    }
+    for _, status := range []models.DisputeStatus{models.DisputeStatusChargeback, models.DisputeStatusWon} {
+        if err := move(won.ID, status); err != nil { t.Fatalf("move to %s: %v", status, err) }
+    }
+    if err := move(won.ID, models.DisputeStatusLost); !errors.Is(err, models.ErrInvalidDisputeStatusTransition) {
+        t.Fatalf("moving a won dispute: err = %v", err)
+    }
+
+    // the lost dispute's credit was reversed, the won one's stays
+    if got := balance(); got != 5500 {
+        t.Fatalf("available balance = %d after the outcomes, want 5500", got)
+    }
+
+    dispute, err := svc.GetDispute(acc.ID, lost.ID)
+    if err != nil { t.Fatalf("get dispute: %v", err) }
+    if dispute.Status != models.DisputeStatusLost || len(dispute.History) != 3 || dispute.History[0].FromStatus != models.DisputeStatusOpened {
+        t.Fatalf("unexpected dispute: %+v", dispute)
+    }
+    disputes, err := svc.ListDisputes(acc.ID)
+    if err != nil { t.Fatalf("list disputes: %v", err) }
+    if len(disputes) != 2 {
+        t.Fatalf("%d disputes listed, want 2", len(disputes))
+    }
+}
+
+// TestLedger checks that holds, captures, refunds and reversals post balanced
+// journals and that the checker finds balances that drifted from the ledger.
+// Skips unless DB_DSN is provided and REPO_BACKEND=pg.
+func TestLedger(t *testing.T) {
+    if os.Getenv("REPO_BACKEND") != "pg" {
+        t.Skip("REPO_BACKEND != pg; skipping DB integration test")
+    }
+    dsn := os.Getenv("DB_DSN")
+    if dsn == "" {
+        t.Skip("DB_DSN not set; skipping DB integration test")
+    }
+
+    db, err := sql.Open("postgres", dsn)
+    if err != nil { t.Fatalf("open db: %v", err) }
+    defer db.Close()
+
+    ctx := context.Background()
+    repo := issuer.NewPGRepository(db, []byte("test-pan-hash-key"))
+    svc := issuer.NewService(repo, issuer.DefaultConfig())
+
+    acc, err := svc.CreateAccount(models.CreateAccount{Balance: 10000, Currency: "USD"})
+    if err != nil { t.Fatalf("create account: %v", err) }
+    card, err := svc.IssueCard(acc.ID)
+    if err != nil { t.Fatalf("issue card: %v", err) }
+    if _, _, err := svc.ChangeCardStatus(acc.ID, card.ID, models.ChangeCardStatus{Status: models.CardStatusActive, Actor: "test"}); err != nil {
+        t.Fatalf("activate card: %v", err)
+    }
+    yymm, _ := expiry.ParseCardFace(card.ExpirationDate)
+    presented := *card
+    presented.ExpirationDate = yymm
+
+    rrn := fmt.Sprintf("%012d", time.Now().UnixNano()%1e12)
+    stan := 1
+    res, err := svc.AuthorizeRequest(models.AuthorizationRequest{
+        Amount: 3000, Currency: "USD", Card: presented,
+        Merchant: models.Merchant{Name: "Demo Merchant", MCC: "5411", TerminalID: "T1"},
+        STAN: &stan, RRN: rrn, TransmittedAt: time.Now().UTC(),
+    })
+    if err != nil || res.ApprovalCode != models.ApprovalCodeApproved { t.Fatalf("authorize: %v, %+v", err, res) }
+    original := models.OriginalTransaction{Card: presented, TerminalID: "T1", RRN: rrn}
+    if err := svc.CaptureAuthorization(original, 2, 1000, "USD"); err != nil { t.Fatalf("capture: %v", err) }
+    if err := svc.RefundAuthorization(original, 3, 400, "USD"); err != nil { t.Fatalf("refund: %v", err) }
+    if err := svc.ReverseAuthorization(original); err != nil { t.Fatalf("reverse: %v", err) }
+
+    account, err := svc.GetAccount(acc.ID)
+    if err != nil { t.Fatalf("get account: %v", err) }
+    if account.AvailableBalance != 9400 || account.HoldBalance != 0 {
+        t.Fatalf("balances = %d/%d, want 9400/0", account.AvailableBalance, account.HoldBalance)
+    }
+
+    rows, err := db.QueryContext(ctx, `select kind from issuer.journal_entries where account_id=$1 order by created_at, kind`, acc.ID)
+    if err != nil { t.Fatalf("list journals: %v", err) }
+    var kinds []string
+    for rows.Next() {
+        var kind string
+        if err := rows.Scan(&kind); err != nil { t.Fatalf("scan journal: %v", err) }
+        kinds = append(kinds, kind)
+    }
+    rows.Close()
+    want := []string{"OPENING", "HOLD", "CAPTURE", "REFUND", "REVERSAL"}
+    if fmt.Sprint(kinds) != fmt.Sprint(want) {
+        t.Fatalf("journals = %v, want %v", kinds, want)
+    }
+
+    check, err := svc.CheckLedger(ctx)
+    if err != nil { t.Fatalf("check ledger: %v", err) }
+    if !check.Consistent() { t.Fatalf("ledger is not consistent: %+v", check) }
+
+    // the ledger is append-only and every entry must balance
+    if _, err := db.ExecContext(ctx, `update issuer.postings set amount = amount + 1 where ledger_account=$1`, "customer:"+acc.ID+":available"); err == nil {
+        t.Fatalf("updating a posting succeeded")
+    }
+    tx, err := db.BeginTx(ctx, nil)
+    if err != nil { t.Fatalf("begin: %v", err) }
+    if _, err := tx.ExecContext(ctx, `
+      with e as (insert into issuer.journal_entries(entry_id, kind, currency) values (gen_random_uuid(), 'OPENING', 'USD') returning entry_id)
+      insert into issuer.postings(entry_id, ledger_account, amount) select entry_id, 'funding:USD', 1 from e
+    `); err != nil { tx.Rollback(); t.Fatalf("insert posting: %v", err) }
+    if err := tx.Commit(); err == nil {
+        t.Fatalf("committing an unbalanced entry succeeded")
+    }
+
+    // a balance that drifted from the ledger is reported
+    if _, err := db.ExecContext(ctx, `update issuer.accounts set available_balance = available_balance + 1 where account_id=$1`, acc.ID); err != nil {
+        t.Fatalf("tamper balance: %v", err)
+    }
+    defer db.ExecContext(ctx, `update issuer.accounts set available_balance = available_balance - 1 where account_id=$1`, acc.ID)
+    check, err = svc.CheckLedger(ctx)
+    if err != nil { t.Fatalf("check ledger: %v", err) }
+    var found bool
+    for _, d := range check.Discrepancies {
+        if d.AccountID == acc.ID && d.AvailableBalance == 9401 && d.LedgerAvailable == 9400 { found = true }
+    }
+    if check.Consistent() || !found { t.Fatalf("drifted balance not reported: %+v", check) }
+}
+
+// TestCreditCycle runs a credit account through two statement cycles: the
+// first in the grace period, then a missed minimum payment with its late fee
+// and the interest of the next cycle. Skips unless DB_DSN is provided and REPO_BACKEND=pg.
+func TestCreditCycle(t *testing.T) {
+    if os.Getenv("REPO_BACKEND") != "pg" {
+        t.Skip("REPO_BACKEND != pg; skipping DB integration test")
+    }
+    dsn := os.Getenv("DB_DSN")
+    if dsn == "" {
+        t.Skip("DB_DSN not set; skipping DB integration test")
+    }
+
+    db, err := sql.Open("postgres", dsn)
+    if err != nil { t.Fatalf("open db: %v", err) }
+    defer db.Close()
+
+    ctx := context.Background()
+    repo := issuer.NewPGRepository(db, []byte("test-pan-hash-key"))
+    // each cutover closes a day, so the test walks through two months
+    cfg := issuer.DefaultConfig()
+    cfg.Cutover = issuer.CutoverNetwork
+    svc := issuer.NewService(repo, cfg)
+    terms := cfg.Credit
+
+    acc, err := svc.CreateAccount(models.CreateAccount{Product: models.ProductCredit, CreditLimit: 1000_00, Currency: "USD"})
+    if err != nil { t.Fatalf("create account: %v", err) }
+    card, err := svc.IssueCard(acc.ID)
+    if err != nil { t.Fatalf("issue card: %v", err) }
+    if _, _, err := svc.ChangeCardStatus(acc.ID, card.ID, models.ChangeCardStatus{Status: models.CardStatusActive, Actor: "test"}); err != nil {
+        t.Fatalf("activate card: %v", err)
+    }
+    yymm, _ := expiry.ParseCardFace(card.ExpirationDate)
+    presented := *card
+    presented.ExpirationDate = yymm
+
+    rrn := fmt.Sprintf("%012d", time.Now().UnixNano()%1e12)
+    stan := 1
+    authorize := func(rrn string, amount int64) string {
+        res, err := svc.AuthorizeRequest(models.AuthorizationRequest{
+            Amount: amount, Currency: "USD", Card: presented,
+            Merchant: models.Merchant{Name: "Demo Merchant", MCC: "5411", TerminalID: "T1"},
+            STAN: &stan, RRN: rrn, TransmittedAt: time.Now().UTC(),
+        })
+        if err != nil { t.Fatalf("authorize: %v", err) }
+        return res.ApprovalCode
+    }
+    if code := authorize(rrn, 300_00); code != models.ApprovalCodeApproved { t.Fatalf("purchase: approval code = %s", code) }
+    // the open-to-buy is what is left of the limit
+    if code := authorize(rrn[1:]+"1", 800_00); code != models.ApprovalCodeInsufficientFunds { t.Fatalf("purchase over the limit: approval code = %s", code) }
+    if err := svc.CaptureAuthorization(models.OriginalTransaction{Card: presented, TerminalID: "T1", RRN: rrn}, 2, 300_00, "USD"); err != nil {
+        t.Fatalf("capture: %v", err)
+    }
+
+    // advance runs end of day until the account has n statements or the
+    // business date passed until
+    advance := func(n int, until time.Time) []*models.Statement {
+        for day := 0; day < 62; day++ {
+            statements, err := svc.ListStatements(acc.ID)
+            if err != nil { t.Fatalf("list statements: %v", err) }
+            businessDate, err := svc.BusinessDate()
+            if err != nil { t.Fatalf("business date: %v", err) }
+            if len(statements) >= n && businessDate.Format("2006-01-02") > until.Format("2006-01-02") {
+                return statements
+            }
+            if _, err := svc.Cutover(); err != nil { t.Fatalf("cutover: %v", err) }
+            if _, err := svc.RunCreditCycle(ctx); err != nil { t.Fatalf("run credit cycle: %v", err) }
+        }
+        t.Fatalf("no statement %d after two months", n)
+        return nil
+    }
+
+    statements := advance(1, time.Time{})
+    first := statements[0]
+    if first.ClosingBalance != 300_00 || first.Interest != 0 || first.MinimumPayment != terms.MinimumPaymentFloor {
+        t.Fatalf("unexpected first statement: %+v", first)
+    }
+
+    // less than the minimum payment by the due date
+    if _, err := svc.MakePayment(acc.ID, models.CreatePayment{Amount: 10_00, Currency: "USD"}); err != nil { t.Fatalf("payment: %v", err) }
+    if _, err := svc.MakePayment(acc.ID, models.CreatePayment{Amount: 10_00, Currency: "EUR"}); !errors.Is(err, models.ErrInvalidAmount) {
+        t.Fatalf("payment in another currency: err = %v", err)
+    }
+    statements = advance(1, first.DueDate)
+    if !statements[0].LateFeeCharged || statements[0].Paid != 10_00 {
+        t.Fatalf("late fee not charged: %+v", statements[0])
+    }
+
+    // the first statement was not paid in full, so the next cycle pays interest
+    statements = advance(2, time.Time{})
+    second := statements[0]
+    if second.OpeningBalance != 300_00 || second.Interest <= 0 || second.Fees != terms.LateFee ||
+        second.ClosingBalance != 300_00-10_00+terms.LateFee+second.Interest {
+        t.Fatalf("unexpected second statement: %+v", second)
+    }
+
+    account, err := svc.GetAccount(acc.ID)
+    if err != nil { t.Fatalf("get account: %v", err) }
+    if account.Owed() != second.ClosingBalance || account.OpenToBuy() != 1000_00-second.ClosingBalance {
+        t.Fatalf("owed %d, open-to-buy %d after the second statement %+v", account.Owed(), account.OpenToBuy(), second)
+    }
+
+    check, err := svc.CheckLedger(ctx)
+    if err != nil { t.Fatalf("check ledger: %v", err) }
+    if !check.Consistent() { t.Fatalf("ledger is not consistent: %+v", check) }
+}
+
+func TestBusinessDateIsPersisted(t *testing.T) {
+    if os.Getenv("REPO_BACKEND") != "pg" { t.Skip("pg backend only") }
+    dsn := os.Getenv("DB_DSN")
+    if dsn == "" { t.Skip("DB_DSN not set") }
+    db, err := sql.Open("postgres", dsn)
+    if err != nil { t.Fatalf("open db: %v", err) }
+    defer db.Close()
+
+    repo := issuer.NewPGRepository(db, []byte("test-pan-hash-key"))
+    network := issuer.DefaultConfig()
+    network.Cutover = issuer.CutoverNetwork
+    closed, err := issuer.NewService(repo, network).Cutover()
+    if err != nil { t.Fatalf("cutover: %v", err) }
+
+    // another instance, or the same one after a restart, is on the same day
+    svc := issuer.NewService(repo, issuer.DefaultConfig())
+    businessDate, err := svc.BusinessDate()
+    if err != nil { t.Fatalf("business date: %v", err) }
+    if !businessDate.Equal(closed) { t.Fatalf("business date = %s, want %s", businessDate, closed) }
+
+    // the scheduled rollover never moves it back, and a cutover only catches up with the calendar
+    rolled, err := svc.RollBusinessDate()
+    if err != nil { t.Fatalf("roll: %v", err) }
+    if rolled.Before(closed) || rolled.Before(time.Now().AddDate(0, 0, -1)) { t.Fatalf("rolled to %s, closed %s", rolled, closed) }
+    again, err := svc.Cutover()
+    if err != nil { t.Fatalf("scheduled cutover: %v", err) }
+    if !again.Equal(rolled) { t.Fatalf("scheduled cutover moved %s to %s", rolled, again) }
+}
+
+// TestCaptureFees verifies that withdrawals in another currency than the
+// account's are declined, that capturing an ATM withdrawal charges the ATM fee
+// as a transaction linked to the authorization, and that withdrawals stop at
+// the daily limit.
+// Skips unless DB_DSN is provided and REPO_BACKEND=pg.
+func TestCaptureFees(t *testing.T) {
+    if os.Getenv("REPO_BACKEND") != "pg" {
+        t.Skip("REPO_BACKEND != pg; skipping DB integration test")
+    }
+    dsn := os.Getenv("DB_DSN")
+    if dsn == "" {
+        t.Skip("DB_DSN not set; skipping DB integration test")
+    }
+
+    db, err := sql.Open("postgres", dsn)
+    if err != nil { t.Fatalf("open db: %v", err) }
+    defer db.Close()
+
+    ctx := context.Background()
+    repo := issuer.NewPGRepository(db, []byte("test-pan-hash-key"))
+    svc := issuer.NewService(repo, issuer.DefaultConfig())
+
+    acc, err := svc.CreateAccount(models.CreateAccount{Balance: 2000_00, Currency: "USD"})
+    if err != nil { t.Fatalf("create account: %v", err) }
+    card, err := svc.IssueCard(acc.ID)
+    if err != nil { t.Fatalf("issue card: %v", err) }
+    if _, _, err := svc.ChangeCardStatus(acc.ID, card.ID, models.ChangeCardStatus{Status: models.CardStatusActive, Actor: "test"}); err != nil {
+        t.Fatalf("activate card: %v", err)
+    }
+    yymm, _ := expiry.ParseCardFace(card.ExpirationDate)
+    presented := *card
+    presented.ExpirationDate = yymm
+    if _, err := svc.SetPIN(acc.ID, card.ID, models.SetPIN{CardNumber: card.Number, PIN: "1234"}); err != nil { t.Fatalf("set pin: %v", err) }
+    block, err := security.EncryptPINBlock(security.PINBlockFormat0, "1234", card.Number, security.DemoZPK())
+    if err != nil { t.Fatalf("pin block: %v", err) }
+
+    rrn := fmt.Sprintf("%012d", time.Now().UnixNano()%1e12)
+    stan := 1
+    withdraw := func(rrn string, amount int64, currency string) string {
+        res, err := svc.AuthorizeRequest(models.AuthorizationRequest{
+            Amount: amount, Currency: currency, Card: presented,
+            Merchant: models.Merchant{Name: "Demo ATM", MCC: "6011", TerminalID: "ATM1"},
+            STAN: &stan, RRN: rrn, TransmittedAt: time.Now().UTC(),
+            ProcessingCode: "010000", PINBlock: hex.EncodeToString(block),
+        })
+        if err != nil { t.Fatalf("authorize: %v", err) }
+        return res.ApprovalCode
+    }
+    // there are no exchange rates to hold EUR of a USD account with
+    if code := withdraw(rrn[1:]+"1", 100_00, "EUR"); code != models.ApprovalCodeNotPermitted { t.Fatalf("withdrawal in EUR: approval code = %s", code) }
+    if code := withdraw(rrn, 100_00, "USD"); code != models.ApprovalCodeApproved { t.Fatalf("approval code = %s", code) }
+    if err := svc.CaptureAuthorization(models.OriginalTransaction{Card: presented, TerminalID: "ATM1", RRN: rrn}, 2, 100_00, "USD"); err != nil {
+        t.Fatalf("capture: %v", err)
+    }
+
+    transactions, err := svc.ListTransactions(acc.ID)
+    if err != nil { t.Fatalf("list transactions: %v", err) }
+    var authID string
+    fees := map[string]int64{}
+    for _, tx := range transactions {
+        switch tx.Status {
+        case "CAPTURED":
+            authID = tx.AuthID
+        case models.TransactionStatusFee:
+            if tx.Currency != "USD" { t.Fatalf("fee in %s", tx.Currency) }
+            fees[tx.Description] += tx.Amount
+        }
+    }
+    if authID == "" { t.Fatalf("no capture in %+v", transactions) }
+    for _, tx := range transactions {
+        if tx.Status == models.TransactionStatusFee && tx.AuthID != authID {
+            t.Fatalf("fee %s not linked to auth %s", tx.ID, authID)
+        }
+    }
+    if len(fees) != 1 || fees["ATM withdrawal"] != 2_50 {
+        t.Fatalf("unexpected fees: %v", fees)
+    }
+
+    account, err := svc.GetAccount(acc.ID)
+    if err != nil { t.Fatalf("get account: %v", err) }
+    if account.AvailableBalance != 2000_00-100_00-2_50 || account.HoldBalance != 0 {
+        t.Fatalf("available %d, hold %d after capture with fees", account.AvailableBalance, account.HoldBalance)
+    }
+
+    // reversing the capture gives its fees back, capturing again charges them again
+    reversal := models.OriginalTransaction{Card: presented, TerminalID: "ATM1", RRN: rrn, MTI: "0200", STAN: 2}
+    if err := svc.ReverseAuthorization(reversal); err != nil { t.Fatalf("reverse capture: %v", err) }
+    account, err = svc.GetAccount(acc.ID)
+    if err != nil { t.Fatalf("get account: %v", err) }
+    if account.AvailableBalance != 2000_00-100_00 || account.HoldBalance != 100_00 {
+        t.Fatalf("available %d, hold %d after reversing the capture", account.AvailableBalance, account.HoldBalance)
+    }
+    if err := svc.CaptureAuthorization(models.OriginalTransaction{Card: presented, TerminalID: "ATM1", RRN: rrn}, 3, 100_00, "USD"); err != nil {
+        t.Fatalf("capture again: %v", err)
+    }
+    account, err = svc.GetAccount(acc.ID)
+    if err != nil { t.Fatalf("get account: %v", err) }
+    if account.AvailableBalance != 2000_00-100_00-2_50 || account.HoldBalance != 0 {
+        t.Fatalf("available %d, hold %d after capturing again", account.AvailableBalance, account.HoldBalance)
+    }
+
+    // the captured withdrawal counts towards the daily limit
+    limit := issuer.DefaultConfig().Transactions[models.TransactionTypeATMWithdrawal]
+    if code := withdraw(rrn[1:]+"2", limit.MaxAmount, "USD"); code != models.ApprovalCodeApproved { t.Fatalf("second withdrawal: approval code = %s", code) }
+    if code := withdraw(rrn[1:]+"3", limit.DailyAmount-100_00-limit.MaxAmount+1, "USD"); code != limit.LimitCode {
+        t.Fatalf("withdrawal over the daily limit: approval code = %s", code)
+    }
+
+    check, err := svc.CheckLedger(ctx)
+    if err != nil { t.Fatalf("check ledger: %v", err) }
+    if !check.Consistent() { t.Fatalf("ledger is not consistent: %+v", check) }
+}
+
+// TestDailyLimitDayInExpiryTZ verifies that the daily limit counts from
+// midnight in ExpiryTZ, whatever the timezone of the database session.
+// Skips unless DB_DSN is provided and REPO_BACKEND=pg.
+func TestDailyLimitDayInExpiryTZ(t *testing.T) {
+    if os.Getenv("REPO_BACKEND") != "pg" {
+        t.Skip("REPO_BACKEND != pg; skipping DB integration test")
+    }
+    dsn := os.Getenv("DB_DSN")
+    if dsn == "" {
+        t.Skip("DB_DSN not set; skipping DB integration test")
+    }
+
+    db, err := sql.Open("postgres", dsn)
+    if err != nil { t.Fatalf("open db: %v", err) }
+    defer db.Close()
+
+    // UTC+14: its midnight is the morning of the day before in UTC
+    cfg := issuer.DefaultConfig()
+    cfg.ExpiryTZ = "Pacific/Kiritimati"
+    loc, err := time.LoadLocation(cfg.ExpiryTZ)
+    if err != nil { t.Skipf("no tzdata: %v", err) }
+    policy := cfg.Transactions[models.TransactionTypePurchase]
+    policy.DailyAmount = 100_00
+    cfg.Transactions[models.TransactionTypePurchase] = policy
+    repo := issuer.NewPGRepository(db, []byte("test-pan-hash-key"))
+    svc := issuer.NewService(repo, cfg)
+
+    acc, err := svc.CreateAccount(models.CreateAccount{Balance: 1000_00, Currency: "USD"})
+    if err != nil { t.Fatalf("create account: %v", err) }
+    card, err := svc.IssueCard(acc.ID)
+    if err != nil { t.Fatalf("issue card: %v", err) }
+    if _, _, err := svc.ChangeCardStatus(acc.ID, card.ID, models.ChangeCardStatus{Status: models.CardStatusActive, Actor: "test"}); err != nil {
+        t.Fatalf("activate card: %v", err)
+    }
+    yymm, _ := expiry.ParseCardFace(card.ExpirationDate)
+    presented := *card
+    presented.ExpirationDate = yymm
+
+    rrn := fmt.Sprintf("%012d", time.Now().UnixNano()%1e12)
+    stan := 1
+    purchase := func(rrn string) string {
+        res, err := svc.AuthorizeRequest(models.AuthorizationRequest{
+            Amount: 60_00, Currency: "USD", Card: presented,
+            Merchant: models.Merchant{Name: "Demo Merchant", MCC: "5411", TerminalID: "T1"},
+            STAN: &stan, RRN: rrn, TransmittedAt: time.Now().UTC(),
+        })
+        if err != nil { t.Fatalf("authorize: %v", err) }
+        return res.ApprovalCode
+    }
+    if code := purchase(rrn[1:] + "1"); code != models.ApprovalCodeApproved { t.Fatalf("approval code = %s", code) }
+    if code := purchase(rrn[1:] + "2"); code != policy.LimitCode { t.Fatalf("purchase over the daily limit: approval code = %s", code) }
+
+    // a minute before midnight in ExpiryTZ is yesterday, even when it is today in UTC
+    now := time.Now().In(loc)
+    yesterday := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, loc).Add(-time.Minute)
+    if _, err := db.Exec(`UPDATE issuer.auths SET created_at=$2 WHERE card_id=$1`, card.ID, yesterday); err != nil {
+        t.Fatalf("backdate authorization: %v", err)
+    }
+    if code := purchase(rrn[1:] + "3"); code != models.ApprovalCodeApproved { t.Fatalf("purchase the next day: approval code = %s", code) }
+}
+
+// TestReverseCaptureAndRefund verifies that a 0400 referring to a capture or
+// refund (0200) undoes just that one, fees included, and that one that never
+// arrived has nothing to reverse.
+// Skips unless DB_DSN is provided and REPO_BACKEND=pg.
+func TestReverseCaptureAndRefund(t *testing.T) {
+    if os.Getenv("REPO_BACKEND") != "pg" {
+        t.Skip("REPO_BACKEND != pg; skipping DB integration test")
+    }
+    dsn := os.Getenv("DB_DSN")
+    if dsn == "" {
+        t.Skip("DB_DSN not set; skipping DB integration test")
+    }
+
+    db, err := sql.Open("postgres", dsn)
+    if err != nil { t.Fatalf("open db: %v", err) }
+    defer db.Close()
+
+    ctx := context.Background()
+    repo := issuer.NewPGRepository(db, []byte("test-pan-hash-key"))
+    svc := issuer.NewService(repo, issuer.DefaultConfig())
+
+    acc, err := svc.CreateAccount(models.CreateAccount{Balance: 1000_00, Currency: "USD"})
+    if err != nil { t.Fatalf("create account: %v", err) }
+    card, err := svc.IssueCard(acc.ID)
+    if err != nil { t.Fatalf("issue card: %v", err) }
+    if _, _, err := svc.ChangeCardStatus(acc.ID, card.ID, models.ChangeCardStatus{Status: models.CardStatusActive, Actor: "test"}); err != nil {
+        t.Fatalf("activate card: %v", err)
+    }
+    yymm, _ := expiry.ParseCardFace(card.ExpirationDate)
+    presented := *card
+    presented.ExpirationDate = yymm
+
+    rrn := fmt.Sprintf("%012d", time.Now().UnixNano()%1e12)
+    stan := 1
+    res, err := svc.AuthorizeRequest(models.AuthorizationRequest{
+        Amount: 100_00, Currency: "USD", Card: presented,
+        Merchant: models.Merchant{Name: "Demo Merchant", MCC: "5411", TerminalID: "T1"},
+        STAN: &stan, RRN: rrn, TransmittedAt: time.Now().UTC(),
+    })
+    if err != nil { t.Fatalf("authorize: %v", err) }
+    if res.ApprovalCode != models.ApprovalCodeApproved { t.Fatalf("approval code = %s", res.ApprovalCode) }
+    original := models.OriginalTransaction{Card: presented, TerminalID: "T1", RRN: rrn}
+    financial := func(stan int) models.OriginalTransaction {
+        o := original
+        o.MTI, o.STAN = "0200", stan
+        return o
+    }
+    balances := func(available, hold int64) {
+        t.Helper()
+        account, err := svc.GetAccount(acc.ID)
+        if err != nil { t.Fatalf("get account: %v", err) }
+        if account.AvailableBalance != available || account.HoldBalance != hold {
+            t.Fatalf("available %d, hold %d; want %d, %d", account.AvailableBalance, account.HoldBalance, available, hold)
+        }
+    }
+
+    if err := svc.CaptureAuthorization(original, 2, 100_00, "USD"); err != nil { t.Fatalf("capture: %v", err) }
+    balances(900_00, 0)
+
+    // the capture goes back on hold, and can be sent again; repeats are no-ops
+    for range []int{1, 2} {
+        if err := svc.ReverseAuthorization(financial(2)); err != nil { t.Fatalf("reverse capture: %v", err) }
+        balances(900_00, 100_00)
+    }
+    if err := svc.CaptureAuthorization(original, 3, 100_00, "USD"); err != nil { t.Fatalf("capture again: %v", err) }
+    balances(900_00, 0)
+
+    if err := svc.RefundAuthorization(original, 4, 30_00, "USD"); err != nil { t.Fatalf("refund: %v", err) }
+    balances(930_00, 0)
+    if err := svc.ReverseAuthorization(financial(4)); err != nil { t.Fatalf("reverse refund: %v", err) }
+    balances(900_00, 0)
+
+    // a refund that never arrived has nothing to reverse
+    if err := svc.ReverseAuthorization(financial(5)); !errors.Is(err, models.ErrNothingToReverse) {
+        t.Fatalf("reverse unknown refund: %v", err)
+    }
+
+    check, err := svc.CheckLedger(ctx)
+    if err != nil { t.Fatalf("check ledger: %v", err) }
+    if !check.Consistent() { t.Fatalf("ledger is not consistent: %+v", check) }
+}
+
+// TestPINRetryCounter verifies that wrong PINs are counted in the database
+// and block the PIN until it is set again.
+// Skips unless DB_DSN is provided and REPO_BACKEND=pg.
+func TestPINRetryCounter(t *testing.T) {
+    if os.Getenv("REPO_BACKEND") != "pg" {
+        t.Skip("REPO_BACKEND != pg; skipping DB integration test")
+    }
+    dsn := os.Getenv("DB_DSN")
+    if dsn == "" {
+        t.Skip("DB_DSN not set; skipping DB integration test")
+    }
+
+    db, err := sql.Open("postgres", dsn)
+    if err != nil { t.Fatalf("open db: %v", err) }
+    defer db.Close()
+
+    repo := issuer.NewPGRepository(db, []byte("test-pan-hash-key"))
+    svc := issuer.NewService(repo, issuer.DefaultConfig())
+
+    acc, err := svc.CreateAccount(models.CreateAccount{Balance: 100_00, Currency: "USD"})
+    if err != nil { t.Fatalf("create account: %v", err) }
+    card, err := svc.IssueCard(acc.ID)
+    if err != nil { t.Fatalf("issue card: %v", err) }
+    if _, err := svc.SetPIN(acc.ID, card.ID, models.SetPIN{CardNumber: card.Number, PIN: "1234"}); err != nil { t.Fatalf("set pin: %v", err) }
+
+    change := models.ChangePIN{CardNumber: card.Number, OldPIN: "0000", NewPIN: "4321"}
+    for attempt := 1; attempt <= 2; attempt++ {
+        if _, err := svc.ChangePIN(acc.ID, card.ID, change); !errors.Is(err, models.ErrIncorrectPIN) {
+            t.Fatalf("wrong PIN %d: %v", attempt, err)
+        }
+    }
+    if _, err := svc.ChangePIN(acc.ID, card.ID, change); !errors.Is(err, models.ErrPINBlocked) {
+        t.Fatalf("third wrong PIN: %v", err)
+    }
+    change.OldPIN = "1234"
+    if _, err := svc.ChangePIN(acc.ID, card.ID, change); !errors.Is(err, models.ErrPINBlocked) {
+        t.Fatalf("right PIN while blocked: %v", err)
+    }
+
+    // only issuer operations may replace the PIN without the old one
+    if _, err := svc.SetPIN(acc.ID, card.ID, models.SetPIN{CardNumber: card.Number, PIN: "1234"}); !errors.Is(err, models.ErrPINAlreadySet) {
+        t.Fatalf("set pin again: %v", err)
+    }
+    status, reset, err := svc.ResetPIN(acc.ID, card.ID, models.ResetPIN{CardNumber: card.Number, PIN: "1234", Reason: "blocked", Actor: "ops"})
+    if err != nil { t.Fatalf("reset pin: %v", err) }
+    if status.Blocked || status.TriesLeft != 3 { t.Fatalf("after reset: %+v", status) }
+    var actor string
+    if err := db.QueryRow(`select actor from issuer.card_pin_resets where reset_id=$1`, reset.ID).Scan(&actor); err != nil || actor != "ops" {
+        t.Fatalf("reset record: %q, %v", actor, err)
+    }
+    if _, err := svc.ChangePIN(acc.ID, card.ID, change); err != nil { t.Fatalf("change pin: %v", err) }
+}
+
+// TestDCVVReplay verifies that the dynamic CVV of a window is used by one
+// approved authorization: its repeats (same RRN) still get the first answer,
+// another authorization is declined.
+func TestDCVVReplay(t *testing.T) {
+    if os.Getenv("REPO_BACKEND") != "pg" {
+        t.Skip("REPO_BACKEND != pg; skipping DB integration test")
+    }
+    dsn := os.Getenv("DB_DSN")
+    if dsn == "" {
+        t.Skip("DB_DSN not set; skipping DB integration test")
+    }
+
+    db, err := sql.Open("postgres", dsn)
+    if err != nil { t.Fatalf("open db: %v", err) }
+    defer db.Close()
+
+    repo := issuer.NewPGRepository(db, []byte("test-pan-hash-key"))
+    svc := issuer.NewService(repo, issuer.DefaultConfig())
+
+    acc, err := svc.CreateAccount(models.CreateAccount{Balance: 100_00, Currency: "USD"})
+    if err != nil { t.Fatalf("create account: %v", err) }
+    card, err := svc.IssueCard(acc.ID)
+    if err != nil { t.Fatalf("issue card: %v", err) }
+    if _, _, err := svc.ChangeCardStatus(acc.ID, card.ID, models.ChangeCardStatus{Status: models.CardStatusActive, Actor: "test"}); err != nil {
+        t.Fatalf("activate card: %v", err)
+    }
+    if _, err := svc.SetDCVV(acc.ID, card.ID, models.SetDCVV{Enabled: true}); err != nil { t.Fatalf("enable dcvv: %v", err) }
+    stored, err := repo.GetCard(acc.ID, card.ID)
+    if err != nil || !stored.DCVVEnabled { t.Fatalf("stored card: %+v, %v", stored, err) }
+
+    dcvv, err := svc.GetDCVV(acc.ID, card.ID, card.Number)
+    if err != nil { t.Fatalf("get dcvv: %v", err) }
+    yymm, _ := expiry.ParseCardFace(card.ExpirationDate)
+    presented := *card
+    presented.ExpirationDate = yymm
+    presented.CardVerificationValue = dcvv.CVV
+
+    stan := 1
+    authorize := func(rrn string, amount int64) models.AuthorizationResponse {
+        res, err := svc.AuthorizeRequest(models.AuthorizationRequest{
+            Amount: amount, Currency: "USD", Card: presented,
+            Merchant: models.Merchant{Name: "Demo Merchant", MCC: "5411", TerminalID: "T0000001"},
+            STAN: &stan, RRN: rrn, TransmittedAt: time.Now().UTC(),
+        })
+        if err != nil { t.Fatalf("authorize %s: %v", rrn, err) }
+        return res
+    }
+    rrn := func() string { return fmt.Sprintf("%012d", time.Now().UnixNano()%1e12) }
+
+    // a decline does not use the code up
+    if res := authorize(rrn(), 1000_00); res.ApprovalCode != models.ApprovalCodeInsufficientFunds {
+        t.Fatalf("over the balance: approval code = %s", res.ApprovalCode)
+    }
+    first := rrn()
+    approved := authorize(first, 10_00)
+    if approved.ApprovalCode != models.ApprovalCodeApproved { t.Fatalf("first use: approval code = %s", approved.ApprovalCode) }
+    if repeat := authorize(first, 10_00); repeat != approved { t.Fatalf("repeat got %+v, want %+v", repeat, approved) }
+    if res := authorize(rrn(), 10_00); res.ApprovalCode != models.ApprovalCodeCVVMismatch {
+        t.Fatalf("replay: approval code = %s", res.ApprovalCode)
+    }
+}
+
+// TestPANPepperRotation verifies that cards hashed with an earlier version of
+// the PAN pepper are still found once a new version is active, and that the
+// versions are recorded with the cards.
+// Skips unless DB_DSN is provided and REPO_BACKEND=pg.
+func TestPANPepperRotation(t *testing.T) {
+    if os.Getenv("REPO_BACKEND") != "pg" {
+        t.Skip("REPO_BACKEND != pg; skipping DB integration test")
+    }
+    dsn := os.Getenv("DB_DSN")
+    if dsn == "" {
+        t.Skip("DB_DSN not set; skipping DB integration test")
+    }
+
+    db, err := sql.Open("postgres", dsn)
+    if err != nil { t.Fatalf("open db: %v", err) }
+    defer db.Close()
+
+    store := keys.NewStore()
+    if _, err := store.Import(keys.PurposePANPepper, keys.AlgorithmHMAC, []byte("test-pepper-1")); err != nil { t.Fatalf("import pepper: %v", err) }
+    if _, err := store.Import(keys.PurposeCVK, keys.AlgorithmHMAC, security.DemoKey()); err != nil { t.Fatalf("import cvk: %v", err) }
+    if _, err := store.Import(keys.PurposePVK, keys.AlgorithmTDES, security.DemoPVK()); err != nil { t.Fatalf("import pvk: %v", err) }
+    if _, err := store.Import(keys.PurposeZPK, keys.AlgorithmTDES, security.DemoZPK()); err != nil { t.Fatalf("import zpk: %v", err) }
+    cfg := issuer.DefaultConfig()
+    newService := func() *issuer.Service {
+        repo, err := issuer.NewPGRepositoryWithKeys(db, store, cfg)
+        if err != nil { t.Fatalf("repository: %v", err) }
+        svc := issuer.NewService(repo, cfg)
+        closeCVV, err := svc.UseKeyStore(store)
+        if err != nil { t.Fatalf("use key store: %v", err) }
+        t.Cleanup(closeCVV)
+        return svc
+    }
+
+    svc := newService()
+    acc, err := svc.CreateAccount(models.CreateAccount{Balance: 100_00, Currency: "USD"})
+    if err != nil { t.Fatalf("create account: %v", err) }
+    card, err := svc.IssueCard(acc.ID)
+    if err != nil { t.Fatalf("issue card: %v", err) }
+    if _, err := svc.SetPIN(acc.ID, card.ID, models.SetPIN{CardNumber: card.Number, PIN: "1234"}); err != nil { t.Fatalf("set pin: %v", err) }
+
+    var panHashVersion, cvkVersion, pvkVersion int
+    if err := db.QueryRow(`select pan_hash_version, cvk_version from issuer.cards where card_id=$1`, card.ID).Scan(&panHashVersion, &cvkVersion); err != nil { t.Fatalf("card versions: %v", err) }
+    if err := db.QueryRow(`select pvk_version from issuer.card_pins where card_id=$1`, card.ID).Scan(&pvkVersion); err != nil { t.Fatalf("pin version: %v", err) }
+    if panHashVersion != 1 || cvkVersion != 1 || pvkVersion != 1 {
+        t.Fatalf("versions: pan hash %d, cvk %d, pvk %d", panHashVersion, cvkVersion, pvkVersion)
+    }
+
+    // a new pepper, CVK and PVK become the active ones
+    if _, err := store.Import(keys.PurposePANPepper, keys.AlgorithmHMAC, []byte("test-pepper-2")); err != nil { t.Fatalf("import pepper: %v", err) }
+    if _, err := store.Import(keys.PurposeCVK, keys.AlgorithmHMAC, []byte("test-cvk-2")); err != nil { t.Fatalf("import cvk: %v", err) }
+    if _, err := store.Import(keys.PurposePVK, keys.AlgorithmTDES, mustHex(t, "0123456789ABCDEFFEDCBA9876543210")); err != nil { t.Fatalf("import pvk: %v", err) }
+    svc = newService()
+
+    if _, _, err := svc.ChangeCardStatus(acc.ID, card.ID, models.ChangeCardStatus{Status: models.CardStatusActive, Actor: "test"}); err != nil { t.Fatalf("activate: %v", err) }
+    presented := *card
+    presented.ExpirationDate, err = expiry.ParseCardFace(card.ExpirationDate)
+    if err != nil { t.Fatalf("expiry: %v", err) }
+    res, err := svc.AuthorizeRequest(models.AuthorizationRequest{
+        Amount:   10_00,
+        Currency: "USD",
+        Card:     presented,
+        Merchant: models.Merchant{Name: "Demo Shop", MCC: "5411"},
+    })
+    if err != nil { t.Fatalf("authorize: %v", err) }
+    if res.ApprovalCode != models.ApprovalCodeApproved { t.Fatalf("card of the earlier pepper and CVK: %s", res.ApprovalCode) }
+    change := models.ChangePIN{CardNumber: card.Number, OldPIN: "1234", NewPIN: "4321"}
+    if _, err := svc.ChangePIN(acc.ID, card.ID, change); err != nil { t.Fatalf("change pin of the earlier PVK: %v", err) }
+    if err := db.QueryRow(`select pvk_version from issuer.card_pins where card_id=$1`, card.ID).Scan(&pvkVersion); err != nil || pvkVersion != 2 {
+        t.Fatalf("changed pin version: %d, %v", pvkVersion, err)
+    }
+
+    // an instance still on the earlier pepper and one on the new pepper
+    // issuing the same PAN at the same time: only one of them gets it
+    pepper1, err := store.Get(keys.PurposePANPepper, 1)
+    if err != nil { t.Fatalf("pepper 1: %v", err) }
+    pepper2, err := store.Get(keys.PurposePANPepper, 2)
+    if err != nil { t.Fatalf("pepper 2: %v", err) }
+    earlier := issuer.NewPGRepository(db, nil)
+    earlier.PepperPANs(pepper1, []*keys.Key{pepper1})
+    current := issuer.NewPGRepository(db, nil)
+    current.PepperPANs(pepper2, []*keys.Key{pepper1, pepper2})
+    for attempt := 0; attempt < 10; attempt++ {
+        pan := fmt.Sprintf("9%015d", time.Now().UnixNano()%1e15)
+        errs := make(chan error, 2)
+        for _, repo := range []*issuer.Repository{earlier, current} {
+            go func(repo *issuer.Repository) {
+                errs <- repo.CreateCard(&models.Card{ID: uuid.New().String(), AccountID: acc.ID, Number: pan, ExpirationDate: "2812"})
+            }(repo)
+        }
+        issued := 0
+        for range []*issuer.Repository{earlier, current} {
+            err := <-errs
+            switch {
+            case err == nil:
+                issued++
+            case !errors.Is(err, issuer.ErrConflict):
+                t.Fatalf("issue %s: %v", pan, err)
+            }
+        }
+        if issued != 1 { t.Fatalf("PAN %s issued %d times", pan, issued) }
+    }
+}
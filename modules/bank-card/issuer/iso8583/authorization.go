@@ -1,27 +1,71 @@
 package iso8583
 
-type AuthorizationRequest struct {
-	MTI                   string               `index:"0"`
-	PrimaryAccountNumber  string               `index:"2"`
-	Amount                int64                `index:"3"`
-	TransmissionDateTime  string               `index:"4"`
-	Currency              string               `index:"7"`
-	CardVerificationValue string               `index:"8"`
-	ExpirationDate        string               `index:"9"`
-	AcceptorInformation   *AcceptorInformation `index:"10"`
-	STAN                  string               `index:"11"`
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/alovak/cardflow-playground/internal/currency"
+)
+
+// Amount types of DE54
+const (
+	AmountTypeLedgerBalance    = "01"
+	AmountTypeAvailableBalance = "02"
+)
+
+// AdditionalAmount is one amount of DE54. Amount is in minor units of the
+// alphabetic Currency and negative for a debit balance.
+type AdditionalAmount struct {
+	AccountType string
+	AmountType  string
+	Currency    string
+	Amount      int64
 }
 
-type AuthorizationResponse struct {
-	MTI               string `index:"0"`
-	ApprovalCode      string `index:"5"`
-	AuthorizationCode string `index:"6"`
-	STAN              string `index:"11"`
+// additionalAmountLength is the length of one amount in DE54: account type
+// (2), amount type (2), numeric currency code (3), C or D (1) and the amount (12).
+const additionalAmountLength = 20
+
+// FormatAdditionalAmounts builds DE54 from the amounts.
+func FormatAdditionalAmounts(amounts []AdditionalAmount) (string, error) {
+	var value string
+	for _, a := range amounts {
+		numeric, err := currency.Numeric(a.Currency)
+		if err != nil {
+			return "", err
+		}
+		sign, amount := "C", a.Amount
+		if amount < 0 {
+			sign, amount = "D", -amount
+		}
+		value += fmt.Sprintf("%-2.2s%-2.2s%s%s%012d", a.AccountType, a.AmountType, numeric, sign, amount)
+	}
+	return value, nil
 }
 
-type AcceptorInformation struct {
-	Name       string `index:"01"`
-	MCC        string `index:"02"`
-	PostalCode string `index:"03"`
-	WebSite    string `index:"04"`
+// ParseAdditionalAmounts reads the amounts of DE54.
+func ParseAdditionalAmounts(value string) ([]AdditionalAmount, error) {
+	if len(value)%additionalAmountLength != 0 {
+		return nil, fmt.Errorf("additional amounts of length %d", len(value))
+	}
+	var amounts []AdditionalAmount
+	for ; value != ""; value = value[additionalAmountLength:] {
+		alpha, err := currency.Alpha(value[4:7])
+		if err != nil {
+			return nil, err
+		}
+		amount, err := strconv.ParseInt(value[8:20], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("parsing additional amount: %w", err)
+		}
+		switch value[7] {
+		case 'C':
+		case 'D':
+			amount = -amount
+		default:
+			return nil, fmt.Errorf("additional amount sign %q", value[7])
+		}
+		amounts = append(amounts, AdditionalAmount{AccountType: value[:2], AmountType: value[2:4], Currency: alpha, Amount: amount})
+	}
+	return amounts, nil
 }
@@ -0,0 +1,36 @@
+package iso8583
+
+import "github.com/alovak/cardflow-playground/internal/iso8583spec"
+
+// The dialect is shared with the acquirer's client (see internal/iso8583spec).
+type (
+	Spec                      = iso8583spec.Spec
+	AuthorizationRequest      = iso8583spec.AuthorizationRequest
+	AuthorizationResponse     = iso8583spec.AuthorizationResponse
+	AcceptorInformation       = iso8583spec.AcceptorInformation
+	NetworkManagementRequest  = iso8583spec.NetworkManagementRequest
+	NetworkManagementResponse = iso8583spec.NetworkManagementResponse
+)
+
+const (
+	ProcessingCodePurchase       = iso8583spec.ProcessingCodePurchase
+	ProcessingCodeCashWithdrawal = iso8583spec.ProcessingCodeCashWithdrawal
+	ProcessingCodeRefund         = iso8583spec.ProcessingCodeRefund
+	ProcessingCodeBalanceInquiry = iso8583spec.ProcessingCodeBalanceInquiry
+
+	NetworkCodeSignOn  = iso8583spec.NetworkCodeSignOn
+	NetworkCodeSignOff = iso8583spec.NetworkCodeSignOff
+	NetworkCodeCutover = iso8583spec.NetworkCodeCutover
+	NetworkCodeEcho    = iso8583spec.NetworkCodeEcho
+)
+
+var (
+	SpecPlayground = iso8583spec.SpecPlayground
+	SpecISO87      = iso8583spec.SpecISO87
+)
+
+// SpecByName returns the spec with the given name. An empty name selects the
+// playground spec.
+func SpecByName(name string) (*Spec, error) {
+	return iso8583spec.SpecByName(name)
+}
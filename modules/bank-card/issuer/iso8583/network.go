@@ -0,0 +1,43 @@
+package iso8583
+
+import (
+	"sync"
+	"time"
+
+	iso8583Connection "github.com/moov-io/iso8583-connection"
+)
+
+// peers keeps track of the acquirer connections that are signed on. Financial
+// messages are only accepted from signed on peers.
+type peers struct {
+	mu       sync.Mutex
+	signedOn map[*iso8583Connection.Connection]time.Time
+}
+
+func newPeers() *peers {
+	return &peers{
+		signedOn: make(map[*iso8583Connection.Connection]time.Time),
+	}
+}
+
+func (p *peers) signOn(c *iso8583Connection.Connection) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.signedOn[c] = time.Now()
+}
+
+func (p *peers) signOff(c *iso8583Connection.Connection) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	delete(p.signedOn, c)
+}
+
+func (p *peers) isSignedOn(c *iso8583Connection.Connection) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	_, ok := p.signedOn[c]
+	return ok
+}
@@ -1,10 +1,13 @@
 package iso8583
 
 import (
+    "errors"
     "fmt"
     "strconv"
     "strings"
+    "time"
 
+	"github.com/alovak/cardflow-playground/internal/iso8583spec"
 	"github.com/alovak/cardflow-playground/issuer/models"
 	"github.com/moov-io/iso8583"
 	iso8583Connection "github.com/moov-io/iso8583-connection"
@@ -19,38 +22,58 @@ type Server struct {
 	server     *iso8583Server.Server
 	logger     *slog.Logger
 	authorizer Authorizer
+	spec       *Spec
+	peers      *peers
 }
 
 // Authorizer is an interface that defines the authorization logic.
 type Authorizer interface {
     AuthorizeRequest(req models.AuthorizationRequest) (models.AuthorizationResponse, error)
-    CaptureByStan(pan, expiry string, stan int, amount int64, currency string) error
-    ReverseByStan(pan, expiry string, stan int) error
+    // CaptureAuthorization, RefundAuthorization and ReverseAuthorization find
+    // the authorization by card, terminal (DE41) and RRN (DE37), or by the
+    // original data elements (DE90) without an RRN.
+    // stan is the one of the 0200 itself, which clearing records quote.
+    CaptureAuthorization(original models.OriginalTransaction, stan int, amount int64, currency string) error
+    // RefundAuthorization credits back captured funds of the original
+    // authorization (0200 with processing code 20).
+    RefundAuthorization(original models.OriginalTransaction, stan int, amount int64, currency string) error
+    ReverseAuthorization(original models.OriginalTransaction) error
+    // AdviseAuthorization records an authorization the acquirer approved
+    // offline (0120). Repeated advices must not be applied twice.
+    AdviseAuthorization(req models.AuthorizationRequest, authorizationCode string) error
+    // Cutover rolls the business date when the network signals a cutover (DE70=201).
+    Cutover() (time.Time, error)
 }
 
-// NewServer creates a new Server instance with the given logger, address and authorizer.
-func NewServer(logger *slog.Logger, addr string, authorizer Authorizer) *Server {
-	logger = logger.With(slog.String("type", "iso8583-server"), slog.String("addr", addr))
+// NewServer creates a new Server instance with the given logger, address,
+// authorizer and the ISO 8583 spec the acquirers speak.
+func NewServer(logger *slog.Logger, addr string, authorizer Authorizer, spec *Spec) *Server {
+	logger = logger.With(slog.String("type", "iso8583-server"), slog.String("addr", addr), slog.String("spec", spec.Name))
 
 	s := &Server{
 		logger:     logger,
 		Addr:       addr,
 		authorizer: authorizer,
+		spec:       spec,
+		peers:      newPeers(),
 	}
 
 	// here we create an instance of the ISO 8583 server
 	iso8583Server := iso8583Server.New(
-		// this is the ISO 8583 spec we defined in spec.go
-		spec,
+		// this is the ISO 8583 spec we defined in spec.go or spec87.go
+		spec.MessageSpec(),
 
 		// part of binary framing, it reads the message length from the connection
-		readMessageLength,
+		iso8583spec.ReadMessageLength,
 
 		// part of binary framing, it writes the message length to the connection
-		writeMessageLength,
+		iso8583spec.WriteMessageLength,
 
 		// here we define a function that will be called when a new message is received`
 		iso8583Connection.InboundMessageHandler(s.handleRequest),
+
+		// a peer that drops the connection has to sign on again
+		iso8583Connection.ConnectionClosedHandler(s.peers.signOff),
 	)
 
 	s.server = iso8583Server
@@ -97,14 +120,29 @@ func (s *Server) handleRequest(c *iso8583Connection.Connection, message *iso8583
 
 	logger.Info("handling request")
 
+	// financial messages are only accepted from signed on peers
+	if mti != "0800" && !s.peers.isSignedOn(c) {
+		err = s.rejectNotSignedOn(c, message, mti)
+		if err != nil {
+			logger.Error("failed to reject request", "err", err)
+		}
+		return
+	}
+
 	// here we handle different MTIs
     switch mti {
+    case "0800":
+        err = s.handleNetworkManagement(c, message)
     case "0100":
         err = s.handleAuthorizationRequest(c, message)
-    case "0200": // demo: treat as capture request
-        err = s.handleFinancialCapture(c, message)
-    case "0400": // demo: treat as reversal request
+    case "0200": // demo: capture or refund of an authorization
+        err = s.handleFinancialRequest(c, message)
+    case "0400", "0401": // demo: treat as reversal request, 0401 is a repeat
         err = s.handleReversalRequest(c, message)
+    case "0120", "0121":
+        err = s.handleAuthorizationAdvice(c, message)
+    case "0420", "0421":
+        err = s.handleReversalAdvice(c, message)
     default:
         err = fmt.Errorf("unknown MTI: %s", mti)
     }
@@ -114,60 +152,314 @@ func (s *Server) handleRequest(c *iso8583Connection.Connection, message *iso8583
 	}
 }
 
-func (s *Server) handleFinancialCapture(c *iso8583Connection.Connection, message *iso8583.Message) error {
-    req := &AuthorizationRequest{}
-    if err := message.Unmarshal(req); err != nil { return fmt.Errorf("unmarshal capture: %w", err) }
-    // parse STAN
-    var stan int
-    fmt.Sscanf(req.STAN, "%d", &stan)
-    if err := s.authorizer.CaptureByStan(req.PrimaryAccountNumber, req.ExpirationDate, stan, req.Amount, req.Currency); err != nil {
-        return err
-    }
-    // respond 0210 minimal
-    resp := &AuthorizationResponse{MTI: "0210", STAN: req.STAN, ApprovalCode: "00"}
-    msg := iso8583.NewMessage(spec)
-    if err := msg.Marshal(resp); err != nil { return err }
-    return c.Reply(msg)
+// handleNetworkManagement handles sign-on, sign-off, echo and cutover requests.
+func (s *Server) handleNetworkManagement(c *iso8583Connection.Connection, message *iso8583.Message) error {
+	req := &NetworkManagementRequest{}
+	if err := s.spec.Unmarshal(message, req); err != nil {
+		return fmt.Errorf("unmarshaling network management request: %w", err)
+	}
+
+	logger := s.logger.With(slog.String("stan", req.STAN), slog.String("network_code", req.NetworkManagementCode))
+
+	approvalCode := models.ApprovalCodeApproved
+
+	switch req.NetworkManagementCode {
+	case NetworkCodeSignOn:
+		s.peers.signOn(c)
+		logger.Info("peer signed on")
+	case NetworkCodeSignOff:
+		s.peers.signOff(c)
+		logger.Info("peer signed off")
+	case NetworkCodeEcho:
+		// nothing to do, the reply is the echo
+	case NetworkCodeCutover:
+		if !s.peers.isSignedOn(c) {
+			approvalCode = models.ApprovalCodeIssuerUnavailable
+			break
+		}
+		businessDate, err := s.authorizer.Cutover()
+		if err != nil {
+			logger.Error("failed to roll business date", "err", err)
+			approvalCode = models.ApprovalCodeSystemError
+			break
+		}
+		logger.Info("cutover", slog.String("business_date", businessDate.Format("2006-01-02")))
+	default:
+		approvalCode = models.ApprovalCodeInvalidRequest
+	}
+
+	resp := &NetworkManagementResponse{
+		MTI:                   "0810",
+		STAN:                  req.STAN,
+		ApprovalCode:          approvalCode,
+		NetworkManagementCode: req.NetworkManagementCode,
+	}
+
+	responseMessage := s.spec.NewMessage()
+	if err := s.spec.Marshal(responseMessage, resp); err != nil {
+		return fmt.Errorf("marshaling network management response: %w", err)
+	}
+
+	return c.Reply(responseMessage)
+}
+
+// rejectNotSignedOn replies to a financial request from a peer that has not
+// signed on.
+func (s *Server) rejectNotSignedOn(c *iso8583Connection.Connection, message *iso8583.Message, mti string) error {
+	if len(mti) != 4 {
+		return fmt.Errorf("unknown MTI: %s", mti)
+	}
+
+	stan, err := message.GetString(11)
+	if err != nil {
+		return fmt.Errorf("getting STAN: %w", err)
+	}
+
+	s.logger.Warn("rejecting request from peer that is not signed on", slog.String("mti", mti), slog.String("stan", stan))
+
+	// the response class is the request class + 1 (0100 -> 0110)
+	resp := &AuthorizationResponse{
+		MTI:          mti[:2] + string(mti[2]+1) + mti[3:],
+		STAN:         stan,
+		ApprovalCode: models.ApprovalCodeIssuerUnavailable,
+	}
+
+	responseMessage := s.spec.NewMessage()
+	if err := s.spec.Marshal(responseMessage, resp); err != nil {
+		return fmt.Errorf("marshaling response: %w", err)
+	}
+
+	return c.Reply(responseMessage)
+}
+
+// handleFinancialRequest captures (processing code 00) or refunds (20) an
+// authorization the acquirer refers to by its RRN and original data elements.
+func (s *Server) handleFinancialRequest(c *iso8583Connection.Connection, message *iso8583.Message) error {
+	req := &AuthorizationRequest{}
+	if err := s.spec.Unmarshal(message, req); err != nil {
+		return fmt.Errorf("unmarshaling financial request: %w", err)
+	}
+
+	original := originalTransaction(req)
+	stan := 0
+	if p := parseSTAN(req.STAN); p != nil {
+		stan = *p
+	}
+
+	var err error
+	switch req.ProcessingCode {
+	case "", ProcessingCodePurchase:
+		err = s.authorizer.CaptureAuthorization(original, stan, req.Amount, req.Currency)
+	case ProcessingCodeRefund:
+		err = s.authorizer.RefundAuthorization(original, stan, req.Amount, req.Currency)
+	default:
+		err = fmt.Errorf("unsupported processing code %q: %w", req.ProcessingCode, models.ErrInvalidAuthorizationStatus)
+	}
+
+	approvalCode := models.ApprovalCodeApproved
+	switch {
+	case err == nil:
+	case errors.Is(err, models.ErrAuthorizationNotFound):
+		approvalCode = models.ApprovalCodeUnableToLocate
+	case errors.Is(err, models.ErrInvalidAmount):
+		approvalCode = models.ApprovalCodeInvalidAmount
+	case errors.Is(err, models.ErrInvalidAuthorizationStatus):
+		approvalCode = models.ApprovalCodeInvalidTransaction
+	default:
+		s.logger.Error("failed to apply financial request", slog.String("stan", req.STAN), "err", err)
+		approvalCode = models.ApprovalCodeSystemError
+	}
+
+	resp := &AuthorizationResponse{MTI: "0210", STAN: req.STAN, ApprovalCode: approvalCode}
+
+	responseMessage := s.spec.NewMessage()
+	if err := s.spec.Marshal(responseMessage, resp); err != nil {
+		return fmt.Errorf("marshaling financial response: %w", err)
+	}
+
+	return c.Reply(responseMessage)
 }
 
 func (s *Server) handleReversalRequest(c *iso8583Connection.Connection, message *iso8583.Message) error {
     req := &AuthorizationRequest{}
-    if err := message.Unmarshal(req); err != nil { return fmt.Errorf("unmarshal reversal: %w", err) }
-    var stan int
-    fmt.Sscanf(req.STAN, "%d", &stan)
-    if err := s.authorizer.ReverseByStan(req.PrimaryAccountNumber, req.ExpirationDate, stan); err != nil {
-        return err
+    if err := s.spec.Unmarshal(message, req); err != nil { return fmt.Errorf("unmarshal reversal: %w", err) }
+    // the acquirer repeats the reversal (0401) until it gets an answer, so
+    // reply even when it could not be applied
+    approvalCode := models.ApprovalCodeApproved
+    if err := s.authorizer.ReverseAuthorization(originalTransaction(req)); err != nil {
+        // a captured or refunded authorization has no hold left, and a
+        // capture or refund that never arrived has nothing to undo:
+        // acknowledge them like an unknown one so the acquirer stops repeating
+        if errors.Is(err, models.ErrAuthorizationNotFound) || errors.Is(err, models.ErrNothingToReverse) {
+            approvalCode = models.ApprovalCodeUnableToLocate
+        } else {
+            s.logger.Error("failed to reverse authorization", slog.String("stan", req.STAN), "err", err)
+            approvalCode = models.ApprovalCodeSystemError
+        }
     }
-    resp := &AuthorizationResponse{MTI: "0410", STAN: req.STAN, ApprovalCode: "00"}
-    msg := iso8583.NewMessage(spec)
-    if err := msg.Marshal(resp); err != nil { return err }
+    resp := &AuthorizationResponse{MTI: "0410", STAN: req.STAN, ApprovalCode: approvalCode}
+    msg := s.spec.NewMessage()
+    if err := s.spec.Marshal(msg, resp); err != nil { return err }
     return c.Reply(msg)
 }
 
+// handleAuthorizationAdvice applies an authorization the acquirer approved
+// offline. The acquirer repeats the advice (0121) until it is acknowledged.
+func (s *Server) handleAuthorizationAdvice(c *iso8583Connection.Connection, message *iso8583.Message) error {
+	req := &AuthorizationRequest{}
+	if err := s.spec.Unmarshal(message, req); err != nil {
+		return fmt.Errorf("unmarshaling authorization advice: %w", err)
+	}
+
+	authRequest := models.AuthorizationRequest{
+		Amount:   req.Amount,
+		Currency: req.Currency,
+		Card: models.Card{
+			Number:         req.PrimaryAccountNumber,
+			ExpirationDate: req.ExpirationDate,
+		},
+		STAN:           parseSTAN(req.STAN),
+		RRN:            req.RetrievalReferenceNumber,
+		TransmittedAt:  parseTransmissionDateTime(req.TransmissionDateTime),
+		ProcessingCode: req.ProcessingCode,
+	}
+	if req.AcceptorInformation != nil {
+		authRequest.Merchant = models.Merchant{
+			Name:       req.AcceptorInformation.Name,
+			MCC:        req.AcceptorInformation.MCC,
+			PostalCode: req.AcceptorInformation.PostalCode,
+			WebSite:    req.AcceptorInformation.WebSite,
+		}
+	}
+	authRequest.Merchant.TerminalID = req.TerminalID
+	authRequest.Merchant.CardAcceptorID = req.CardAcceptorID
+
+	approvalCode := models.ApprovalCodeApproved
+	if err := s.authorizer.AdviseAuthorization(authRequest, req.AuthorizationCode); err != nil {
+		if errors.Is(err, models.ErrAuthorizationNotFound) {
+			approvalCode = models.ApprovalCodeUnableToLocate
+		} else {
+			s.logger.Error("failed to apply authorization advice", slog.String("stan", req.STAN), "err", err)
+			approvalCode = models.ApprovalCodeSystemError
+		}
+	}
+
+	return s.replyAdvice(c, "0130", req.STAN, approvalCode)
+}
+
+// handleReversalAdvice applies a reversal the acquirer already made. Reversing
+// is idempotent, so repeats (0421) are acknowledged the same way.
+func (s *Server) handleReversalAdvice(c *iso8583Connection.Connection, message *iso8583.Message) error {
+	req := &AuthorizationRequest{}
+	if err := s.spec.Unmarshal(message, req); err != nil {
+		return fmt.Errorf("unmarshaling reversal advice: %w", err)
+	}
+
+	approvalCode := models.ApprovalCodeApproved
+	if err := s.authorizer.ReverseAuthorization(originalTransaction(req)); err != nil {
+		if errors.Is(err, models.ErrAuthorizationNotFound) || errors.Is(err, models.ErrNothingToReverse) {
+			approvalCode = models.ApprovalCodeUnableToLocate
+		} else {
+			s.logger.Error("failed to apply reversal advice", slog.String("stan", req.STAN), "err", err)
+			approvalCode = models.ApprovalCodeSystemError
+		}
+	}
+
+	return s.replyAdvice(c, "0430", req.STAN, approvalCode)
+}
+
+func (s *Server) replyAdvice(c *iso8583Connection.Connection, mti, stan, approvalCode string) error {
+	resp := &AuthorizationResponse{MTI: mti, STAN: stan, ApprovalCode: approvalCode}
+
+	responseMessage := s.spec.NewMessage()
+	if err := s.spec.Marshal(responseMessage, resp); err != nil {
+		return fmt.Errorf("marshaling advice response: %w", err)
+	}
+
+	return c.Reply(responseMessage)
+}
+
+// parseSTAN returns the STAN as a number, nil when it is missing or malformed.
+func parseSTAN(stan string) *int {
+	v, err := strconv.Atoi(strings.TrimLeft(stan, "0"))
+	if err != nil {
+		return nil
+	}
+	return &v
+}
+
+// parseTransmissionDateTime returns the zero time when the transmission date
+// and time is missing or malformed.
+func parseTransmissionDateTime(value string) time.Time {
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return time.Time{}
+	}
+	return t
+}
+
+// formatBalances returns DE54 for the balances of a balance inquiry, for the
+// account type the processing code asked for.
+func formatBalances(processingCode string, balances *models.Balances) (string, error) {
+	accountType := "00"
+	if len(processingCode) >= 4 {
+		accountType = processingCode[2:4]
+	}
+	return FormatAdditionalAmounts([]AdditionalAmount{
+		{AccountType: accountType, AmountType: AmountTypeLedgerBalance, Currency: balances.Currency, Amount: balances.Ledger},
+		{AccountType: accountType, AmountType: AmountTypeAvailableBalance, Currency: balances.Currency, Amount: balances.Available},
+	})
+}
+
+// originalTransaction returns what identifies the authorization a follow-up
+// refers to. Malformed original data elements are left out, so the
+// authorization is only found by its RRN.
+func originalTransaction(req *AuthorizationRequest) models.OriginalTransaction {
+	original := models.OriginalTransaction{
+		Card: models.Card{
+			Number:         req.PrimaryAccountNumber,
+			ExpirationDate: req.ExpirationDate,
+		},
+		TerminalID: req.TerminalID,
+		RRN:        req.RetrievalReferenceNumber,
+	}
+
+	if req.OriginalDataElements == "" {
+		return original
+	}
+
+	mti, stan, transmittedAt, err := iso8583spec.ParseOriginalDataElements(req.OriginalDataElements, time.Now().UTC())
+	if err != nil {
+		return original
+	}
+	original.MTI = mti
+	original.TransmittedAt = transmittedAt
+	if p := parseSTAN(stan); p != nil {
+		original.STAN = *p
+	}
+
+	return original
+}
+
 // handleAuthorizationRequest handles authorization requests.
 func (s *Server) handleAuthorizationRequest(c *iso8583Connection.Connection, message *iso8583.Message) error {
 	// here we unmarshal the message into our AuthorizationRequest struct
 	requestData := &AuthorizationRequest{}
-	if err := message.Unmarshal(requestData); err != nil {
+	if err := s.spec.Unmarshal(message, requestData); err != nil {
 		return fmt.Errorf("unmarshaling message: %w", err)
 	}
 
 	s.logger.With(
 		slog.String("mti", requestData.MTI),
 		slog.String("stan", requestData.STAN),
+		slog.String("processing_code", requestData.ProcessingCode),
 		slog.Int64("amount", requestData.Amount),
 		slog.String("currency", requestData.Currency),
 	).Info("handling authorization request")
 
 	// here we create an instance of our authorization request
 	// and pass it to the authorizer
-    // Parse STAN to optional int (trim leading zeros)
-    var stanPtr *int
-    if s := strings.TrimLeft(requestData.STAN, "0"); s != "" {
-        if v, err := strconv.Atoi(s); err == nil {
-            stanPtr = &v
-        }
-    }
+    stanPtr := parseSTAN(requestData.STAN)
 
     authRequest := models.AuthorizationRequest{
         Amount:   requestData.Amount,
@@ -182,8 +474,14 @@ func (s *Server) handleAuthorizationRequest(c *iso8583Connection.Connection, mes
             MCC:        requestData.AcceptorInformation.MCC,
             PostalCode: requestData.AcceptorInformation.PostalCode,
             WebSite:    requestData.AcceptorInformation.WebSite,
+            TerminalID:     requestData.TerminalID,
+            CardAcceptorID: requestData.CardAcceptorID,
         },
         STAN: stanPtr,
+        RRN:  requestData.RetrievalReferenceNumber,
+        TransmittedAt: parseTransmissionDateTime(requestData.TransmissionDateTime),
+        ProcessingCode: requestData.ProcessingCode,
+        PINBlock:       requestData.PINBlock,
     }
 
 	// we define a variable that will hold the response data
@@ -206,11 +504,18 @@ func (s *Server) handleAuthorizationRequest(c *iso8583Connection.Connection, mes
 			ApprovalCode:      authResponse.ApprovalCode,
 			AuthorizationCode: authResponse.AuthorizationCode,
 		}
+		if balances := authResponse.Balances; balances != nil {
+			responseData.AdditionalAmounts, err = formatBalances(requestData.ProcessingCode, balances)
+			if err != nil {
+				s.logger.Error("failed to format balances", slog.String("stan", requestData.STAN), "err", err)
+				responseData.ApprovalCode = models.ApprovalCodeSystemError
+			}
+		}
 	}
 
 	// create response message and marshal the response data into it
-	responseMessage := iso8583.NewMessage(spec)
-	if err := responseMessage.Marshal(responseData); err != nil {
+	responseMessage := s.spec.NewMessage()
+	if err := s.spec.Marshal(responseMessage, responseData); err != nil {
 		return fmt.Errorf("marshaling response: %w", err)
 	}
 
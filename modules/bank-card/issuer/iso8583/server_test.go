@@ -0,0 +1,394 @@
+package iso8583
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alovak/cardflow-playground/internal/iso8583spec"
+	"github.com/alovak/cardflow-playground/issuer/models"
+	"github.com/alovak/cardflow-playground/log"
+	iso8583Connection "github.com/moov-io/iso8583-connection"
+	"github.com/stretchr/testify/require"
+)
+
+type stubAuthorizer struct {
+	cutovers int
+	advised  []models.AuthorizationRequest
+	reversed []int
+	captured []int64
+	refunded []int64
+	// originals the captures and refunds referred to, and their own STANs
+	originals []models.OriginalTransaction
+	stans     []int
+	pinBlocks []string
+}
+
+// balance inquiries find an overdrawn account
+func (a *stubAuthorizer) AuthorizeRequest(req models.AuthorizationRequest) (models.AuthorizationResponse, error) {
+	a.pinBlocks = append(a.pinBlocks, req.PINBlock)
+	resp := models.AuthorizationResponse{ApprovalCode: models.ApprovalCodeApproved, AuthorizationCode: "123456"}
+	if strings.HasPrefix(req.ProcessingCode, "31") {
+		resp.Balances = &models.Balances{Currency: "USD", Available: 15_00, Ledger: -5_00}
+	}
+	return resp, nil
+}
+
+// captures and refunds over 100.00 exceed the authorization
+func (a *stubAuthorizer) CaptureAuthorization(original models.OriginalTransaction, stan int, amount int64, currency string) error {
+	if amount > 100_00 {
+		return models.ErrInvalidAmount
+	}
+	a.captured = append(a.captured, amount)
+	a.originals = append(a.originals, original)
+	a.stans = append(a.stans, stan)
+	return nil
+}
+
+func (a *stubAuthorizer) RefundAuthorization(original models.OriginalTransaction, stan int, amount int64, currency string) error {
+	if amount > 100_00 {
+		return models.ErrInvalidAmount
+	}
+	a.refunded = append(a.refunded, amount)
+	a.originals = append(a.originals, original)
+	a.stans = append(a.stans, stan)
+	return nil
+}
+
+func (a *stubAuthorizer) ReverseAuthorization(original models.OriginalTransaction) error {
+	a.reversed = append(a.reversed, original.STAN)
+	return nil
+}
+
+func (a *stubAuthorizer) AdviseAuthorization(req models.AuthorizationRequest, authorizationCode string) error {
+	if authorizationCode == "" {
+		return models.ErrAuthorizationNotFound
+	}
+	a.advised = append(a.advised, req)
+	return nil
+}
+
+func (a *stubAuthorizer) Cutover() (time.Time, error) {
+	a.cutovers++
+	return time.Now(), nil
+}
+
+func TestServer_NetworkManagement(t *testing.T) {
+	for _, spec := range []*Spec{SpecPlayground, SpecISO87} {
+		t.Run(spec.Name, func(t *testing.T) {
+			authorizer := &stubAuthorizer{}
+			server := NewServer(log.New(), "127.0.0.1:0", authorizer, spec)
+			require.NoError(t, server.Start())
+			t.Cleanup(func() { server.Close() })
+
+			conn, err := iso8583Connection.New(server.Addr, spec.MessageSpec(), iso8583spec.ReadMessageLength, iso8583spec.WriteMessageLength)
+			require.NoError(t, err)
+			require.NoError(t, conn.Connect())
+			t.Cleanup(func() { conn.Close() })
+
+			stan := 0
+			nextSTAN := func() string {
+				stan++
+				return fmt.Sprintf("%06d", stan)
+			}
+
+			networkRequest := func(code string) *NetworkManagementResponse {
+				message := spec.NewMessage()
+				require.NoError(t, spec.Marshal(message, &NetworkManagementRequest{
+					MTI:                   "0800",
+					TransmissionDateTime:  time.Now().UTC().Format(time.RFC3339),
+					STAN:                  nextSTAN(),
+					NetworkManagementCode: code,
+				}))
+				reply, err := conn.Send(message)
+				require.NoError(t, err)
+
+				resp := &NetworkManagementResponse{}
+				require.NoError(t, spec.Unmarshal(reply, resp))
+				require.Equal(t, "0810", resp.MTI)
+				require.Equal(t, code, resp.NetworkManagementCode)
+				return resp
+			}
+
+			authorize := func() *AuthorizationResponse {
+				message := spec.NewMessage()
+				require.NoError(t, spec.Marshal(message, &AuthorizationRequest{
+					MTI:                  "0100",
+					PrimaryAccountNumber: "4212340000000006",
+					Amount:               10_00,
+					TransmissionDateTime: time.Now().UTC().Format(time.RFC3339),
+					Currency:             "USD",
+					ExpirationDate:       "2812",
+					STAN:                 nextSTAN(),
+					AcceptorInformation:  &AcceptorInformation{Name: "Demo Merchant", MCC: "5411"},
+				}))
+				reply, err := conn.Send(message)
+				require.NoError(t, err)
+
+				resp := &AuthorizationResponse{}
+				require.NoError(t, spec.Unmarshal(reply, resp))
+				require.Equal(t, "0110", resp.MTI)
+				return resp
+			}
+
+			// echo tests are answered before sign-on
+			require.Equal(t, models.ApprovalCodeApproved, networkRequest(NetworkCodeEcho).ApprovalCode)
+
+			// financial traffic and cutover are rejected until the peer signs on
+			require.Equal(t, models.ApprovalCodeIssuerUnavailable, authorize().ApprovalCode)
+			require.Equal(t, models.ApprovalCodeIssuerUnavailable, networkRequest(NetworkCodeCutover).ApprovalCode)
+			require.Equal(t, 0, authorizer.cutovers)
+
+			require.Equal(t, models.ApprovalCodeApproved, networkRequest(NetworkCodeSignOn).ApprovalCode)
+			require.Equal(t, models.ApprovalCodeApproved, authorize().ApprovalCode)
+
+			require.Equal(t, models.ApprovalCodeApproved, networkRequest(NetworkCodeCutover).ApprovalCode)
+			require.Equal(t, 1, authorizer.cutovers)
+
+			require.Equal(t, models.ApprovalCodeApproved, networkRequest(NetworkCodeSignOff).ApprovalCode)
+			require.Equal(t, models.ApprovalCodeIssuerUnavailable, authorize().ApprovalCode)
+		})
+	}
+}
+
+func TestServer_Advices(t *testing.T) {
+	authorizer := &stubAuthorizer{}
+	server := NewServer(log.New(), "127.0.0.1:0", authorizer, SpecISO87)
+	require.NoError(t, server.Start())
+	t.Cleanup(func() { server.Close() })
+
+	conn, err := iso8583Connection.New(server.Addr, SpecISO87.MessageSpec(), iso8583spec.ReadMessageLength, iso8583spec.WriteMessageLength)
+	require.NoError(t, err)
+	require.NoError(t, conn.Connect())
+	t.Cleanup(func() { conn.Close() })
+
+	send := func(v any) *AuthorizationResponse {
+		message := SpecISO87.NewMessage()
+		require.NoError(t, SpecISO87.Marshal(message, v))
+		reply, err := conn.Send(message)
+		require.NoError(t, err)
+
+		resp := &AuthorizationResponse{}
+		require.NoError(t, SpecISO87.Unmarshal(reply, resp))
+		return resp
+	}
+
+	send(&NetworkManagementRequest{MTI: "0800", STAN: "000001", NetworkManagementCode: NetworkCodeSignOn})
+
+	transmittedAt := time.Now().UTC().Add(-time.Minute).Truncate(time.Second)
+
+	advice := func(mti, stan, authorizationCode string) *AuthorizationRequest {
+		return &AuthorizationRequest{
+			MTI:                  mti,
+			PrimaryAccountNumber: "4212340000000006",
+			Amount:               25_00,
+			TransmissionDateTime: time.Now().UTC().Format(time.RFC3339),
+			Currency:             "USD",
+			ExpirationDate:       "2812",
+			STAN:                 stan,
+			AuthorizationCode:    authorizationCode,
+			TerminalID:           "T0000001",
+			CardAcceptorID:       "000000000012345",
+			AcceptorInformation:  &AcceptorInformation{Name: "Demo Merchant", MCC: "5411"},
+			// RRN of the offline approval
+			RetrievalReferenceNumber: "601412000002",
+		}
+	}
+
+	resp := send(advice("0120", "000002", "Y1OFFL"))
+	require.Equal(t, "0130", resp.MTI)
+	require.Equal(t, models.ApprovalCodeApproved, resp.ApprovalCode)
+	require.Len(t, authorizer.advised, 1)
+	require.Equal(t, 2, *authorizer.advised[0].STAN)
+	require.Equal(t, "5411", authorizer.advised[0].Merchant.MCC)
+	require.Equal(t, "T0000001", authorizer.advised[0].Merchant.TerminalID)
+	require.Equal(t, "000000000012345", authorizer.advised[0].Merchant.CardAcceptorID)
+	require.Equal(t, "601412000002", authorizer.advised[0].RRN)
+
+	// nothing to apply the advice to
+	resp = send(advice("0121", "000003", ""))
+	require.Equal(t, "0130", resp.MTI)
+	require.Equal(t, models.ApprovalCodeUnableToLocate, resp.ApprovalCode)
+
+	// the reversal advice has its own STAN and refers to the original one in DE90
+	reversal := advice("0421", "000004", "Y1OFFL")
+	reversal.OriginalDataElements = fmt.Sprintf("%-4s%06s%s%022d", "0120", "2", transmittedAt.Format("0102150405"), 0)
+	resp = send(reversal)
+	require.Equal(t, "0430", resp.MTI)
+	require.Equal(t, models.ApprovalCodeApproved, resp.ApprovalCode)
+	require.Equal(t, []int{2}, authorizer.reversed)
+}
+
+func TestServer_CaptureAndRefund(t *testing.T) {
+	for _, spec := range []*Spec{SpecPlayground, SpecISO87} {
+		t.Run(spec.Name, func(t *testing.T) {
+			authorizer := &stubAuthorizer{}
+			server := NewServer(log.New(), "127.0.0.1:0", authorizer, spec)
+			require.NoError(t, server.Start())
+			t.Cleanup(func() { server.Close() })
+
+			conn, err := iso8583Connection.New(server.Addr, spec.MessageSpec(), iso8583spec.ReadMessageLength, iso8583spec.WriteMessageLength)
+			require.NoError(t, err)
+			require.NoError(t, conn.Connect())
+			t.Cleanup(func() { conn.Close() })
+
+			signOn := spec.NewMessage()
+			require.NoError(t, spec.Marshal(signOn, &NetworkManagementRequest{MTI: "0800", STAN: "000001", NetworkManagementCode: NetworkCodeSignOn}))
+			_, err = conn.Send(signOn)
+			require.NoError(t, err)
+
+			transmittedAt := time.Now().UTC().Add(-time.Hour).Truncate(time.Second)
+
+			financial := func(processingCode string, amount int64) *AuthorizationResponse {
+				message := spec.NewMessage()
+				require.NoError(t, spec.Marshal(message, &AuthorizationRequest{
+					MTI:                  "0200",
+					PrimaryAccountNumber: "4212340000000006",
+					Amount:               amount,
+					TransmissionDateTime: time.Now().UTC().Format(time.RFC3339),
+					Currency:             "USD",
+					ExpirationDate:       "2812",
+					STAN:                 "000043",
+					ProcessingCode:       processingCode,
+					TerminalID:           "T1",
+					CardAcceptorID:       "M1",
+					// the RRN and original data elements of the authorization
+					RetrievalReferenceNumber: "601412000042",
+					OriginalDataElements:     fmt.Sprintf("%-4s%06s%s%022d", "0100", "42", transmittedAt.Format("0102150405"), 0),
+				}))
+				reply, err := conn.Send(message)
+				require.NoError(t, err)
+
+				resp := &AuthorizationResponse{}
+				require.NoError(t, spec.Unmarshal(reply, resp))
+				require.Equal(t, "0210", resp.MTI)
+				return resp
+			}
+
+			require.Equal(t, models.ApprovalCodeApproved, financial(ProcessingCodePurchase, 60_00).ApprovalCode)
+			require.Equal(t, models.ApprovalCodeApproved, financial(ProcessingCodeRefund, 20_00).ApprovalCode)
+			require.Equal(t, models.ApprovalCodeInvalidAmount, financial(ProcessingCodeRefund, 200_00).ApprovalCode)
+			require.Equal(t, models.ApprovalCodeInvalidTransaction, financial("310000", 1_00).ApprovalCode)
+
+			require.Equal(t, []int64{60_00}, authorizer.captured)
+			require.Equal(t, []int64{20_00}, authorizer.refunded)
+
+			require.Len(t, authorizer.originals, 2)
+			require.Equal(t, []int{43, 43}, authorizer.stans)
+			original := authorizer.originals[0]
+			// fixed width DE41 is unpadded again
+			require.Equal(t, "T1", original.TerminalID)
+			require.Equal(t, "601412000042", original.RRN)
+			require.Equal(t, "0100", original.MTI)
+			require.Equal(t, 42, original.STAN)
+			require.True(t, transmittedAt.Equal(original.TransmittedAt))
+		})
+	}
+}
+
+func TestServer_BalanceInquiry(t *testing.T) {
+	for _, spec := range []*Spec{SpecPlayground, SpecISO87} {
+		t.Run(spec.Name, func(t *testing.T) {
+			server := NewServer(log.New(), "127.0.0.1:0", &stubAuthorizer{}, spec)
+			require.NoError(t, server.Start())
+			t.Cleanup(func() { server.Close() })
+
+			conn, err := iso8583Connection.New(server.Addr, spec.MessageSpec(), iso8583spec.ReadMessageLength, iso8583spec.WriteMessageLength)
+			require.NoError(t, err)
+			require.NoError(t, conn.Connect())
+			t.Cleanup(func() { conn.Close() })
+
+			signOn := spec.NewMessage()
+			require.NoError(t, spec.Marshal(signOn, &NetworkManagementRequest{MTI: "0800", STAN: "000001", NetworkManagementCode: NetworkCodeSignOn}))
+			_, err = conn.Send(signOn)
+			require.NoError(t, err)
+
+			authorize := func(processingCode string) *AuthorizationResponse {
+				message := spec.NewMessage()
+				require.NoError(t, spec.Marshal(message, &AuthorizationRequest{
+					MTI:                  "0100",
+					PrimaryAccountNumber: "4212340000000006",
+					TransmissionDateTime: time.Now().UTC().Format(time.RFC3339),
+					Currency:             "USD",
+					ExpirationDate:       "2812",
+					STAN:                 "000002",
+					ProcessingCode:       processingCode,
+					AcceptorInformation:  &AcceptorInformation{Name: "Demo ATM", MCC: "6011"},
+				}))
+				reply, err := conn.Send(message)
+				require.NoError(t, err)
+
+				resp := &AuthorizationResponse{}
+				require.NoError(t, spec.Unmarshal(reply, resp))
+				require.Equal(t, "0110", resp.MTI)
+				return resp
+			}
+
+			// checking account (20)
+			resp := authorize("312000")
+			require.Equal(t, models.ApprovalCodeApproved, resp.ApprovalCode)
+			amounts, err := ParseAdditionalAmounts(resp.AdditionalAmounts)
+			require.NoError(t, err)
+			require.Equal(t, []AdditionalAmount{
+				{AccountType: "20", AmountType: AmountTypeLedgerBalance, Currency: "USD", Amount: -5_00},
+				{AccountType: "20", AmountType: AmountTypeAvailableBalance, Currency: "USD", Amount: 15_00},
+			}, amounts)
+			require.Equal(t, "2001840D0000000005002002840C000000001500", resp.AdditionalAmounts)
+
+			// other transactions carry no amounts
+			require.Empty(t, authorize(ProcessingCodePurchase).AdditionalAmounts)
+		})
+	}
+}
+
+func TestServer_PINBlock(t *testing.T) {
+	const format0 = "4838FCAA30FED491"
+	const format4 = "049569CA2765D8010F681B3F08C18AD0"
+
+	for _, spec := range []*Spec{SpecPlayground, SpecISO87} {
+		t.Run(spec.Name, func(t *testing.T) {
+			authorizer := &stubAuthorizer{}
+			server := NewServer(log.New(), "127.0.0.1:0", authorizer, spec)
+			require.NoError(t, server.Start())
+			t.Cleanup(func() { server.Close() })
+
+			conn, err := iso8583Connection.New(server.Addr, spec.MessageSpec(), iso8583spec.ReadMessageLength, iso8583spec.WriteMessageLength)
+			require.NoError(t, err)
+			require.NoError(t, conn.Connect())
+			t.Cleanup(func() { conn.Close() })
+
+			signOn := spec.NewMessage()
+			require.NoError(t, spec.Marshal(signOn, &NetworkManagementRequest{MTI: "0800", STAN: "000001", NetworkManagementCode: NetworkCodeSignOn}))
+			_, err = conn.Send(signOn)
+			require.NoError(t, err)
+
+			request := func(pinBlock string) *AuthorizationRequest {
+				return &AuthorizationRequest{
+					MTI:                  "0100",
+					PrimaryAccountNumber: "5413330089020011",
+					Amount:               20_00,
+					TransmissionDateTime: time.Now().UTC().Format(time.RFC3339),
+					Currency:             "USD",
+					ExpirationDate:       "2812",
+					STAN:                 "000002",
+					ProcessingCode:       ProcessingCodeCashWithdrawal,
+					AcceptorInformation:  &AcceptorInformation{Name: "Demo ATM", MCC: "6011"},
+					PINBlock:             pinBlock,
+				}
+			}
+
+			message := spec.NewMessage()
+			require.NoError(t, spec.Marshal(message, request(format0)))
+			_, err = conn.Send(message)
+			require.NoError(t, err)
+			require.Equal(t, []string{format0}, authorizer.pinBlocks)
+
+			message = spec.NewMessage()
+			require.NoError(t, spec.Marshal(message, request(format4)))
+			_, err = conn.Send(message)
+			require.NoError(t, err)
+			require.Equal(t, []string{format0, format4}, authorizer.pinBlocks)
+		})
+	}
+}
@@ -0,0 +1,258 @@
+package issuer
+
+import (
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sort"
+
+	"github.com/alovak/cardflow-playground/internal/keys"
+	"github.com/alovak/cardflow-playground/internal/security"
+	"github.com/alovak/cardflow-playground/internal/tr31"
+)
+
+// OpenKeyStore opens the key store of cfg.Keys (KEYS_STORE when
+// cfg.Keys.StorePath is empty) with the master key in KEYS_MASTER_KEY.
+// Without a store it returns a memory store of the demo keys from the
+// environment, so keys are looked up the same way either way. The keys of
+// the TR-31 blocks of cfg.Keys are then imported into it.
+func OpenKeyStore(cfg *Config) (*keys.Store, error) {
+	path := getenv("KEYS_STORE", "")
+	if cfg != nil && cfg.Keys.StorePath != "" {
+		path = cfg.Keys.StorePath
+	}
+	var store *keys.Store
+	if path == "" {
+		demo, err := demoKeyStore(cfg)
+		if err != nil {
+			return nil, err
+		}
+		store = demo
+	} else {
+		master, err := keys.MasterKeyFromEnv()
+		if err != nil {
+			return nil, err
+		}
+		store, err = keys.Open(path, master)
+		if err != nil {
+			return nil, fmt.Errorf("opening key store %s: %w", path, err)
+		}
+	}
+	if err := importKeyBlocks(store, cfg); err != nil {
+		return nil, err
+	}
+	return store, nil
+}
+
+// demoKeyStore holds the keys the issuer used before it had a key store:
+// the CVK of the configured CVV provider (CVK_DEMO for the HMAC demo,
+// CVK_HEX_DEMO for visa), PVK_DEMO, ZPK_DEMO and PAN_HASH_KEY, and the ZMK
+// of ZMK_DEMO to unwrap key blocks with. It has no DEK, so PANs are not
+// encrypted.
+func demoKeyStore(cfg *Config) (*keys.Store, error) {
+	cvk, cvkAlgorithm := security.DemoKey(), keys.AlgorithmHMAC
+	if cfg != nil && cfg.CVVProvider == "visa" {
+		cvk, cvkAlgorithm = security.DemoVisaCVK(), keys.AlgorithmTDES
+	}
+	zmk, err := hex.DecodeString(getenv("ZMK_DEMO", "C1D0F8FB4958670DBA40AB1F3752EF0D"))
+	if err != nil {
+		return nil, fmt.Errorf("ZMK_DEMO is not hex: %w", err)
+	}
+	store := keys.NewStore()
+	for _, k := range []struct {
+		purpose   keys.Purpose
+		algorithm keys.Algorithm
+		material  []byte
+	}{
+		{keys.PurposeCVK, cvkAlgorithm, cvk},
+		{keys.PurposePVK, keys.AlgorithmTDES, security.DemoPVK()},
+		{keys.PurposeZPK, keys.AlgorithmTDES, security.DemoZPK()},
+		{keys.PurposeZMK, keys.AlgorithmTDES, zmk},
+		{keys.PurposePANPepper, keys.AlgorithmHMAC, []byte(getenv("PAN_HASH_KEY", "dev-secret-pepper"))},
+	} {
+		if _, err := store.Import(k.purpose, k.algorithm, k.material); err != nil {
+			return nil, fmt.Errorf("demo %s: %w", k.purpose, err)
+		}
+	}
+	return store, nil
+}
+
+// importKeyBlocks imports the keys of the TR-31 blocks of cfg.Keys.Blocks
+// (CVK_TR31 and ZPK_TR31 when empty), unwrapped under the active ZMK. A key
+// the store has already, by KCV, is skipped, so a store kept in a file does
+// not get a new version at every start.
+func importKeyBlocks(store *keys.Store, cfg *Config) error {
+	blocks := map[keys.Purpose]string{}
+	if cfg != nil && len(cfg.Keys.Blocks) > 0 {
+		blocks = cfg.Keys.Blocks
+	} else {
+		for purpose, env := range map[keys.Purpose]string{keys.PurposeCVK: "CVK_TR31", keys.PurposeZPK: "ZPK_TR31"} {
+			if block := getenv(env, ""); block != "" {
+				blocks[purpose] = block
+			}
+		}
+	}
+	if len(blocks) == 0 {
+		return nil
+	}
+
+	kbpk, err := store.Active(keys.PurposeZMK)
+	if err != nil {
+		return fmt.Errorf("unwrapping key blocks: %w", err)
+	}
+	purposes := make([]keys.Purpose, 0, len(blocks))
+	for purpose := range blocks {
+		purposes = append(purposes, purpose)
+	}
+	sort.Slice(purposes, func(i, j int) bool { return purposes[i] < purposes[j] })
+
+	for _, purpose := range purposes {
+		blockPurpose, alg, material, err := tr31.Import(kbpk, blocks[purpose])
+		if err != nil {
+			return fmt.Errorf("%s key block: %w", purpose, err)
+		}
+		if blockPurpose != purpose {
+			return fmt.Errorf("%s key block holds a %s", purpose, blockPurpose)
+		}
+		kcv, err := keys.KCV(alg, material)
+		if err != nil {
+			return fmt.Errorf("%s key block: %w", purpose, err)
+		}
+		if hasKey(store, purpose, kcv) {
+			continue
+		}
+		if _, err := store.Import(purpose, alg, material); err != nil {
+			return fmt.Errorf("%s key block: %w", purpose, err)
+		}
+	}
+	return nil
+}
+
+// hasKey tells whether the store has a version of the purpose with the KCV.
+func hasKey(store *keys.Store, purpose keys.Purpose, kcv string) bool {
+	for _, key := range store.List() {
+		if key.Purpose == purpose && key.KCV == kcv {
+			return true
+		}
+	}
+	return false
+}
+
+// issuerKey returns the key of the purpose at the version pinned in
+// cfg.Keys.Versions, the active one otherwise.
+func issuerKey(store *keys.Store, cfg *Config, purpose keys.Purpose) (*keys.Key, error) {
+	version := 0
+	if cfg != nil {
+		version = cfg.Keys.Versions[purpose]
+	}
+	key, err := store.Get(purpose, version)
+	if err != nil {
+		return nil, fmt.Errorf("finding %s key: %w", purpose, err)
+	}
+	return key, nil
+}
+
+// keyVersions returns every version of the purpose, retired ones included.
+func keyVersions(store *keys.Store, purpose keys.Purpose) []*keys.Key {
+	var versions []*keys.Key
+	for _, key := range store.List() {
+		if key.Purpose == purpose {
+			versions = append(versions, key)
+		}
+	}
+	return versions
+}
+
+// byKeyVersion holds what is built from each version of a key. Cards and
+// PINs record the version they were issued under and are verified with it;
+// version 0, recorded before versions were, is the current one.
+type byKeyVersion[T any] struct {
+	current int
+	values  map[int]T
+}
+
+// singleKeyVersion holds v as the current version 0, for keys the store does
+// not version, like the ones on a PKCS#11 token.
+func singleKeyVersion[T any](v T) byKeyVersion[T] {
+	return byKeyVersion[T]{values: map[int]T{0: v}}
+}
+
+// get returns the value of the version, the current one for 0.
+func (b byKeyVersion[T]) get(version int) (T, error) {
+	if version == 0 {
+		version = b.current
+	}
+	v, ok := b.values[version]
+	if !ok {
+		var zero T
+		return zero, fmt.Errorf("key v%d: %w", version, keys.ErrNotFound)
+	}
+	return v, nil
+}
+
+// UseKeyStore keys the CVV and PVV providers and the PIN block decryption
+// of the service with the store: every CVK and PVK version, so cards and
+// PINs are verified with the version they were issued under, and the ZPK.
+// It returns a function releasing the providers' resources.
+func (i *Service) UseKeyStore(store *keys.Store) (func(), error) {
+	cvv, closeCVV, err := newCVVProvider(i.cfg, store)
+	if err != nil {
+		return nil, fmt.Errorf("creating cvv provider: %w", err)
+	}
+	current, err := cvv.get(0)
+	if err != nil {
+		closeCVV()
+		return nil, fmt.Errorf("creating cvv provider: %w", err)
+	}
+	pvv, err := newPVVProvider(i.cfg, current, store)
+	if err != nil {
+		closeCVV()
+		return nil, fmt.Errorf("creating pvv provider: %w", err)
+	}
+	zpk, err := issuerKey(store, i.cfg, keys.PurposeZPK)
+	if err != nil {
+		closeCVV()
+		return nil, err
+	}
+	i.cvv, i.pvv, i.zpk = cvv, pvv, zpk.Material()
+	return closeCVV, nil
+}
+
+// PANHashKey returns the pepper of the PAN hashes cards are looked up by.
+func PANHashKey(store *keys.Store, cfg *Config) ([]byte, error) {
+	key, err := issuerKey(store, cfg, keys.PurposePANPepper)
+	if err != nil {
+		return nil, err
+	}
+	return key.Material(), nil
+}
+
+// NewPGRepositoryWithKeys returns a db-backed repository hashing the PANs of
+// new cards with the current PAN pepper of the store and finding cards
+// hashed with any of its versions. With a DEK in the store the PANs of new
+// cards are encrypted too.
+func NewPGRepositoryWithKeys(db *sql.DB, store *keys.Store, cfg *Config) (*Repository, error) {
+	pepper, err := issuerKey(store, cfg, keys.PurposePANPepper)
+	if err != nil {
+		return nil, err
+	}
+	repository := NewPGRepository(db, pepper.Material())
+	repository.PepperPANs(pepper, keyVersions(store, keys.PurposePANPepper))
+	dek, err := panEncryptionKey(store, cfg)
+	if err != nil {
+		return nil, err
+	}
+	repository.EncryptPANs(dek)
+	return repository, nil
+}
+
+// panEncryptionKey returns the DEK PANs are encrypted with, or nil when the
+// store has none.
+func panEncryptionKey(store *keys.Store, cfg *Config) (*keys.Key, error) {
+	key, err := issuerKey(store, cfg, keys.PurposeDEK)
+	if errors.Is(err, keys.ErrNotFound) {
+		return nil, nil
+	}
+	return key, err
+}
@@ -0,0 +1,19 @@
+package issuer
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/alovak/cardflow-playground/issuer/models"
+)
+
+// CheckLedger verifies that every journal entry balances and that the
+// account balances, a projection of the ledger, match its postings.
+func (i *Service) CheckLedger(ctx context.Context) (*models.LedgerCheck, error) {
+	check, err := i.repo.CheckLedger(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("checking ledger: %w", err)
+	}
+
+	return check, nil
+}
@@ -3,13 +3,33 @@ package models
 import (
 	"errors"
 	"sync"
+	"time"
 )
 
 var ErrInsufficientFunds = errors.New("insufficient funds")
 
+var (
+	// ErrInvalidAccount is returned for an account request that does not fit
+	// its product, e.g. a credit account without a limit.
+	ErrInvalidAccount = errors.New("invalid account")
+	// ErrNotCreditAccount is returned for credit operations on a debit account.
+	ErrNotCreditAccount = errors.New("not a credit account")
+)
+
+// Account products. Debit accounts spend a prefunded balance, credit
+// accounts spend against their credit limit.
+const (
+	ProductDebit  = "debit"
+	ProductCredit = "credit"
+)
+
+// CreateAccount opens an account. Debit accounts (the default) are funded
+// with Balance; credit accounts start at zero and get CreditLimit.
 type CreateAccount struct {
-	Balance  int64
-	Currency string
+	Balance     int64
+	Currency    string
+	Product     string
+	CreditLimit int64
 }
 
 type Account struct {
@@ -17,15 +37,41 @@ type Account struct {
 	AvailableBalance int64
 	HoldBalance      int64
 	Currency         string
+	Product          string
+	// CreditLimit is what a credit account may owe; 0 for debit accounts.
+	CreditLimit int64
+	// StatementDay is the day of the month a credit account's statement
+	// closes on.
+	StatementDay int
+	// PurchaseAPRBps is the annual interest rate on purchases in basis points.
+	PurchaseAPRBps int
+	// OpenedOn is the business date the account was opened on.
+	OpenedOn time.Time
 
 	mu sync.Mutex
 }
 
+// OpenToBuy is what the account may still spend: the available balance plus
+// the credit limit. Held amounts are already taken from the available
+// balance, which goes negative as a credit account draws on its limit.
+func (a *Account) OpenToBuy() int64 {
+	return a.AvailableBalance + a.CreditLimit
+}
+
+// Owed is the posted balance a credit account owes, without pending holds;
+// 0 when it is in credit.
+func (a *Account) Owed() int64 {
+	if owed := -(a.AvailableBalance + a.HoldBalance); owed > 0 {
+		return owed
+	}
+	return 0
+}
+
 func (a *Account) Hold(amount int64) error {
 	a.mu.Lock()
 	defer a.mu.Unlock()
 
-	if a.AvailableBalance < amount {
+	if a.OpenToBuy() < amount {
 		return ErrInsufficientFunds
 	}
 
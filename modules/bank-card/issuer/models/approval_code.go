@@ -1,10 +1,24 @@
 package models
 
 var (
-	ApprovalCodeApproved          = "00"
-	ApprovalCodeDeclined          = "05"
-	ApprovalCodeInvalidRequest    = "10"
-	ApprovalCodeInvalidCard       = "14"
-	ApprovalCodeInsufficientFunds = "51"
-	ApprovalCodeSystemError       = "99"
+	ApprovalCodeApproved           = "00"
+	ApprovalCodeDeclined           = "05"
+	ApprovalCodeInvalidRequest     = "10"
+	ApprovalCodeInvalidTransaction = "12" // the transaction is not supported or not allowed for the authorization
+	ApprovalCodeInvalidAmount      = "13"
+	ApprovalCodeInvalidCard        = "14"
+	ApprovalCodeUnableToLocate     = "25" // no original authorization for a capture, refund or reversal
+	ApprovalCodeLostCard           = "41"
+	ApprovalCodeStolenCard         = "43"
+	ApprovalCodeInsufficientFunds  = "51"
+	ApprovalCodeExpiredCard        = "54"
+	ApprovalCodeIncorrectPIN       = "55" // the PIN is wrong or missing
+	ApprovalCodeNotPermitted       = "57" // the card may not make this type of transaction
+	ApprovalCodeExceedsLimit       = "61" // over the amount limit of the transaction type
+	ApprovalCodeRestrictedCard     = "62"
+	ApprovalCodePINTriesExceeded   = "75" // the PIN is blocked after too many wrong attempts
+	ApprovalCodeInvalidExpiry      = "80" // expiry date does not match the card on file
+	ApprovalCodeCVVMismatch        = "N7" // CVV2 verification failed
+	ApprovalCodeIssuerUnavailable  = "91" // the acquirer is not signed on
+	ApprovalCodeSystemError        = "99"
 )
@@ -1,15 +1,75 @@
 package models
 
+import (
+	"errors"
+	"time"
+)
+
+// ErrAuthorizationNotFound is returned when a capture or reversal refers to an
+// authorization the issuer does not have.
+var ErrAuthorizationNotFound = errors.New("authorization not found")
+
+// ErrInvalidAmount is returned when a capture or refund exceeds what is left
+// of the authorization.
+var ErrInvalidAmount = errors.New("invalid amount")
+
+// ErrInvalidAuthorizationStatus is returned when a capture or refund does not
+// apply to the authorization in its current status.
+var ErrInvalidAuthorizationStatus = errors.New("invalid authorization status")
+
+// ErrNothingToReverse is returned when a reversal refers to an authorization
+// that was already captured or refunded: there is no hold left to release.
+var ErrNothingToReverse = errors.New("nothing to reverse")
+
+// ErrLimitExceeded is returned when an authorization would take a card over
+// the daily limit of its transaction type.
+var ErrLimitExceeded = errors.New("limit exceeded")
+
 type AuthorizationRequest struct {
     Amount   int64
     Currency string
     Card     Card
     Merchant Merchant
-    // Optional STAN (DE11) for idempotency; nil when not provided
+    // Optional STAN (DE11); nil when not provided. STANs are only unique per
+    // terminal and day
     STAN     *int
+    // RRN is the retrieval reference number (DE37) the acquirer gave the
+    // transaction; repeats carry the same one, so it is the idempotency key
+    RRN      string
+    // TransmittedAt is the transmission date and time (DE7)
+    TransmittedAt time.Time
+    // ProcessingCode (DE3) tells the transaction type, see
+    // TransactionTypeForProcessingCode; empty means purchase
+    ProcessingCode string
+    // PINBlock is the encrypted PIN block (DE52) of card-present
+    // transactions, empty without a PIN
+    PINBlock string
+}
+
+// OriginalTransaction identifies the authorization a capture, refund or
+// reversal refers to: by card, terminal and RRN, or by the original data
+// elements (DE90) when the RRN is missing.
+type OriginalTransaction struct {
+    Card       Card
+    TerminalID string
+    RRN        string
+    // MTI, STAN and TransmittedAt of the original message (DE90)
+    MTI           string
+    STAN          int
+    TransmittedAt time.Time
 }
 
 type AuthorizationResponse struct {
 	AuthorizationCode string
 	ApprovalCode      string
+	// Balances answers a balance inquiry (DE54); nil for other transactions.
+	Balances *Balances
+}
+
+// Balances of an account as reported to the acquirer. Ledger is the posted
+// balance; Available is what may be spent, including the credit limit.
+type Balances struct {
+	Currency  string
+	Available int64
+	Ledger    int64
 }
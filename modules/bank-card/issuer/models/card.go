@@ -1,5 +1,12 @@
 package models
 
+import (
+    "errors"
+    "time"
+)
+
+var ErrInvalidCardStatusTransition = errors.New("invalid card status transition")
+
 type Card struct {
     ID                    string
     AccountID             string
@@ -8,4 +15,75 @@ type Card struct {
     CardVerificationValue string
     // CardholderName is the user-provided name to display on card face
     CardholderName        string
+    Status                CardStatus
+    // DCVVEnabled makes the card accept dynamic CVVs instead of the printed one
+    DCVVEnabled           bool
+    // CVKVersion is the key store version of the CVK its CVVs are derived
+    // with; 0 for cards issued before versions were recorded
+    CVKVersion            int
+}
+
+// CardStatus mirrors the issuer.cards.status check constraint.
+type CardStatus string
+
+const (
+    CardStatusIssued CardStatus = "ISSUED"
+    CardStatusActive CardStatus = "ACTIVE"
+    CardStatusFrozen CardStatus = "FROZEN"
+    CardStatusLost   CardStatus = "LOST"
+    CardStatusStolen CardStatus = "STOLEN"
+    CardStatusClosed CardStatus = "CLOSED"
+)
+
+// cardStatusTransitions lists the statuses a card may move to from each status.
+// LOST and STOLEN are terminal except for closing; CLOSED is final.
+var cardStatusTransitions = map[CardStatus][]CardStatus{
+    CardStatusIssued: {CardStatusActive, CardStatusLost, CardStatusStolen, CardStatusClosed},
+    CardStatusActive: {CardStatusFrozen, CardStatusLost, CardStatusStolen, CardStatusClosed},
+    CardStatusFrozen: {CardStatusActive, CardStatusLost, CardStatusStolen, CardStatusClosed},
+    CardStatusLost:   {CardStatusClosed},
+    CardStatusStolen: {CardStatusClosed},
+    CardStatusClosed: {},
+}
+
+// Valid reports whether s is one of the known card statuses.
+func (s CardStatus) Valid() bool {
+    _, ok := cardStatusTransitions[s]
+    return ok
+}
+
+// CanTransitionTo reports whether a card in status s may be moved to next.
+func (s CardStatus) CanTransitionTo(next CardStatus) bool {
+    for _, allowed := range cardStatusTransitions[s] {
+        if allowed == next {
+            return true
+        }
+    }
+    return false
+}
+
+// ChangeCardStatus is a request to move a card to another status.
+// Actor identifies who asked for the change and is kept in the audit trail.
+type ChangeCardStatus struct {
+    Status CardStatus
+    Reason string
+    Actor  string
+}
+
+// CardStatusChange is an audit record of a single card status transition.
+type CardStatusChange struct {
+    ID         string
+    CardID     string
+    FromStatus CardStatus
+    ToStatus   CardStatus
+    Reason     string
+    Actor      string
+    ChangedAt  time.Time
+}
+
+// CardStatusResponse is returned by the card status endpoints.
+type CardStatusResponse struct {
+    CardID  string
+    Status  CardStatus
+    History []*CardStatusChange
 }
@@ -0,0 +1,37 @@
+package models
+
+// ClearingRecord is a presentment or refund from an acquirer's clearing
+// file. The authorization is found by card, terminal and RRN; STAN is the
+// one of the capture or refund message that may have posted it online.
+type ClearingRecord struct {
+	Reference string
+	FileID    string
+	BatchID   string
+	Refund    bool
+	Amount    int64
+	Currency  string
+	// TerminalID and RRN identify the authorization
+	TerminalID string
+	RRN        string
+	STAN       int
+}
+
+// ClearingResult is what posting a clearing record did.
+type ClearingResult string
+
+const (
+	// ClearingResultPosted means the record was matched to its
+	// authorization and posted.
+	ClearingResultPosted ClearingResult = "POSTED"
+	// ClearingResultMatched means the record was matched to a transaction
+	// the capture or refund already posted online.
+	ClearingResultMatched ClearingResult = "MATCHED"
+	// ClearingResultForcePosted means a presentment was posted without a
+	// usable authorization, or for more than it held.
+	ClearingResultForcePosted ClearingResult = "FORCE_POSTED"
+	// ClearingResultRejected means the record was not posted.
+	ClearingResultRejected ClearingResult = "REJECTED"
+	// ClearingResultDuplicate means the record was posted from an earlier
+	// file already.
+	ClearingResultDuplicate ClearingResult = "DUPLICATE"
+)
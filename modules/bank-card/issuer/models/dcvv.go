@@ -0,0 +1,36 @@
+package models
+
+import (
+	"errors"
+	"time"
+)
+
+var (
+	// ErrDCVVNotEnabled is returned when a dynamic CVV is asked for a card
+	// without dCVV.
+	ErrDCVVNotEnabled = errors.New("dCVV not enabled for the card")
+	// ErrDCVVReplayed is returned when the dynamic CVV of a time window was
+	// already used in an approved authorization.
+	ErrDCVVReplayed = errors.New("dCVV already used")
+)
+
+// SetDCVV enables or disables dynamic CVVs of a card. While enabled, the
+// printed CVV2 is not accepted.
+type SetDCVV struct {
+	Enabled bool
+}
+
+// DCVVStatus is returned when the dCVV setting of a card changes.
+type DCVVStatus struct {
+	CardID  string
+	Enabled bool
+}
+
+// DynamicCVV is the code a card accepts in the current time window.
+type DynamicCVV struct {
+	CardID string
+	CVV    string
+	// TTL is how many seconds are left until the next code.
+	TTL       int
+	ExpiresAt time.Time
+}
@@ -0,0 +1,123 @@
+package models
+
+import (
+	"errors"
+	"time"
+)
+
+var (
+	ErrInvalidDisputeStatusTransition = errors.New("invalid dispute status transition")
+	ErrInvalidReasonCode              = errors.New("invalid dispute reason code")
+	// ErrTransactionNotDisputable is returned when the transaction is not a
+	// posted purchase or the amount exceeds it.
+	ErrTransactionNotDisputable = errors.New("transaction cannot be disputed")
+)
+
+// DisputeReasonCodes are the dispute reasons a cardholder may give, by the
+// network's reason code.
+var DisputeReasonCodes = map[string]string{
+	"10.4":   "Other fraud - card-absent environment",
+	"11.3":   "No authorization",
+	"12.6.1": "Duplicate processing",
+	"13.1":   "Merchandise/services not received",
+	"13.3":   "Not as described or defective merchandise/services",
+	"13.6":   "Credit not processed",
+}
+
+// DisputeStatus mirrors the issuer.disputes.status check constraint. WON
+// and LOST are from the cardholder's side.
+type DisputeStatus string
+
+const (
+	// DisputeStatusOpened means the cardholder disputed the transaction and
+	// got a provisional credit.
+	DisputeStatusOpened DisputeStatus = "OPENED"
+	// DisputeStatusChargeback means the chargeback was sent to the acquirer.
+	DisputeStatusChargeback DisputeStatus = "CHARGEBACK"
+	// DisputeStatusRepresentment means the merchant contested the chargeback
+	// with evidence.
+	DisputeStatusRepresentment DisputeStatus = "REPRESENTMENT"
+	// DisputeStatusPreArbitration means the issuer contested the
+	// representment.
+	DisputeStatusPreArbitration DisputeStatus = "PRE_ARBITRATION"
+	// DisputeStatusWon means the provisional credit became final.
+	DisputeStatusWon DisputeStatus = "WON"
+	// DisputeStatusLost means the provisional credit was reversed.
+	DisputeStatusLost DisputeStatus = "LOST"
+)
+
+// disputeStatusTransitions lists the statuses a dispute may move to from each
+// status. WON and LOST are final.
+var disputeStatusTransitions = map[DisputeStatus][]DisputeStatus{
+	DisputeStatusOpened:         {DisputeStatusChargeback, DisputeStatusLost},
+	DisputeStatusChargeback:     {DisputeStatusRepresentment, DisputeStatusWon},
+	DisputeStatusRepresentment:  {DisputeStatusPreArbitration, DisputeStatusLost},
+	DisputeStatusPreArbitration: {DisputeStatusWon, DisputeStatusLost},
+	DisputeStatusWon:            {},
+	DisputeStatusLost:           {},
+}
+
+// Valid reports whether s is one of the known dispute statuses.
+func (s DisputeStatus) Valid() bool {
+	_, ok := disputeStatusTransitions[s]
+	return ok
+}
+
+// CanTransitionTo reports whether a dispute in status s may be moved to next.
+func (s DisputeStatus) CanTransitionTo(next DisputeStatus) bool {
+	for _, allowed := range disputeStatusTransitions[s] {
+		if allowed == next {
+			return true
+		}
+	}
+	return false
+}
+
+// CreateDispute disputes a transaction. A zero Amount disputes all of it.
+type CreateDispute struct {
+	ReasonCode  string
+	Amount      int64
+	Description string
+}
+
+type Dispute struct {
+	ID            string
+	AccountID     string
+	TransactionID string
+	AuthID        string
+	Amount        int64
+	Currency      string
+	ReasonCode    string
+	Description   string
+	Status        DisputeStatus
+	// ProvisionalCreditID is the transaction that credited the account when
+	// the dispute was opened
+	ProvisionalCreditID string
+	// TerminalID and RRN identify the authorization at the acquirer, which
+	// the chargeback is sent against
+	TerminalID string
+	RRN        string
+	CreatedAt  time.Time
+	UpdatedAt  time.Time
+	History    []*DisputeStatusChange
+}
+
+// ChangeDisputeStatus is a request to move a dispute to another status.
+// Actor identifies who asked for the change and is kept in the audit trail.
+type ChangeDisputeStatus struct {
+	Status DisputeStatus
+	Reason string
+	Actor  string
+}
+
+// DisputeStatusChange is an audit record of a single dispute status
+// transition.
+type DisputeStatusChange struct {
+	ID         string
+	DisputeID  string
+	FromStatus DisputeStatus
+	ToStatus   DisputeStatus
+	Reason     string
+	Actor      string
+	ChangedAt  time.Time
+}
@@ -0,0 +1,121 @@
+package models
+
+import (
+	"errors"
+	"strings"
+)
+
+// ErrInvalidFeeRequest is returned for a fee quote without a known
+// transaction type or with a negative amount.
+var ErrInvalidFeeRequest = errors.New("invalid fee request")
+
+// Currency conditions of a fee rule.
+const (
+	// FeeCurrencyForeign matches transactions in another currency than the
+	// account's. The issuer has no exchange rates and declines those, so
+	// for now it matches none.
+	FeeCurrencyForeign = "foreign"
+	// FeeCurrencyDomestic matches transactions in the account's currency.
+	FeeCurrencyDomestic = "domestic"
+)
+
+// FeeRule charges a fee for the transactions it matches. Empty conditions
+// match everything. The fee is RateBps of the amount plus Flat, kept within
+// Min and Max when they are set.
+type FeeRule struct {
+	Name string
+	// Types the rule applies to.
+	Types []TransactionType
+	// MCCs the rule applies to.
+	MCCs []string
+	// Currency is FeeCurrencyForeign, FeeCurrencyDomestic or empty for both.
+	Currency string
+	RateBps  int
+	Flat     int64
+	Min      int64
+	Max      int64
+}
+
+// FeeRequest describes a transaction to charge fees for. Amount is in the
+// minor units of Currency.
+type FeeRequest struct {
+	Type            TransactionType
+	MCC             string
+	Amount          int64
+	Currency        string
+	AccountCurrency string
+}
+
+// Foreign reports whether the transaction is in another currency than the account's.
+func (r FeeRequest) Foreign() bool {
+	return !strings.EqualFold(r.Currency, r.AccountCurrency)
+}
+
+// Matches reports whether the rule applies to the transaction.
+func (f FeeRule) Matches(req FeeRequest) bool {
+	if len(f.Types) > 0 && !contains(f.Types, req.Type) {
+		return false
+	}
+	if len(f.MCCs) > 0 && !contains(f.MCCs, req.MCC) {
+		return false
+	}
+	switch f.Currency {
+	case FeeCurrencyForeign:
+		return req.Foreign()
+	case FeeCurrencyDomestic:
+		return !req.Foreign()
+	}
+	return true
+}
+
+// Amount returns the fee the rule charges on amount.
+func (f FeeRule) Amount(amount int64) int64 {
+	fee := amount*int64(f.RateBps)/10_000 + f.Flat
+	if f.Min > 0 && fee < f.Min {
+		fee = f.Min
+	}
+	if f.Max > 0 && fee > f.Max {
+		fee = f.Max
+	}
+	return fee
+}
+
+// Fee is what one rule charges for a transaction.
+type Fee struct {
+	Rule   string
+	Amount int64
+}
+
+// FeeQuote is the fees of a transaction, in the account's currency.
+type FeeQuote struct {
+	Type     TransactionType
+	Amount   int64
+	Currency string
+	Fees     []Fee
+	Total    int64
+}
+
+// QuoteFees applies every matching rule to the transaction. Rules that
+// come to no fee are left out.
+func QuoteFees(rules []FeeRule, req FeeRequest) FeeQuote {
+	quote := FeeQuote{Type: req.Type, Amount: req.Amount, Currency: strings.ToUpper(req.AccountCurrency)}
+	for _, rule := range rules {
+		if !rule.Matches(req) {
+			continue
+		}
+		if amount := rule.Amount(req.Amount); amount > 0 {
+			quote.Fees = append(quote.Fees, Fee{Rule: rule.Name, Amount: amount})
+			quote.Total += amount
+		}
+	}
+	return quote
+}
+
+func contains[T comparable](list []T, v T) bool {
+	for _, item := range list {
+		if item == v {
+			return true
+		}
+	}
+	return false
+}
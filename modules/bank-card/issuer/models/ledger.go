@@ -0,0 +1,159 @@
+package models
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// ErrUnbalancedJournal is returned for a journal entry whose postings do not
+// sum to zero.
+var ErrUnbalancedJournal = errors.New("unbalanced journal entry")
+
+// LedgerAccountKind mirrors the issuer.ledger_accounts.kind check constraint.
+type LedgerAccountKind string
+
+const (
+	// LedgerAccountCustomerAvailable is what the cardholder may spend; its
+	// balance is projected to issuer.accounts.available_balance.
+	LedgerAccountCustomerAvailable LedgerAccountKind = "CUSTOMER_AVAILABLE"
+	// LedgerAccountCustomerHold is what authorizations hold until they are
+	// captured or released; projected to issuer.accounts.hold_balance.
+	LedgerAccountCustomerHold LedgerAccountKind = "CUSTOMER_HOLD"
+	// LedgerAccountSettlement is what the issuer owes to or is owed by the
+	// network for captured, refunded and disputed transactions.
+	LedgerAccountSettlement LedgerAccountKind = "SETTLEMENT"
+	// LedgerAccountFees collects the fees charged to cardholders.
+	LedgerAccountFees LedgerAccountKind = "FEES"
+	// LedgerAccountFunding is where the money paid into the accounts comes
+	// from, e.g. the opening balance or a payment of a credit account.
+	LedgerAccountFunding LedgerAccountKind = "FUNDING"
+	// LedgerAccountInterest collects the interest charged on credit accounts.
+	LedgerAccountInterest LedgerAccountKind = "INTEREST"
+)
+
+// LedgerAccount is an account of the ledger. Customer accounts belong to an
+// issuer account, the others are one per currency.
+type LedgerAccount struct {
+	Code      string
+	Kind      LedgerAccountKind
+	AccountID string
+	Currency  string
+}
+
+func CustomerAvailable(accountID, currency string) LedgerAccount {
+	return LedgerAccount{Code: "customer:" + accountID + ":available", Kind: LedgerAccountCustomerAvailable, AccountID: accountID, Currency: currency}
+}
+
+func CustomerHold(accountID, currency string) LedgerAccount {
+	return LedgerAccount{Code: "customer:" + accountID + ":hold", Kind: LedgerAccountCustomerHold, AccountID: accountID, Currency: currency}
+}
+
+func Settlement(currency string) LedgerAccount {
+	return LedgerAccount{Code: "settlement:" + currency, Kind: LedgerAccountSettlement, Currency: currency}
+}
+
+func Fees(currency string) LedgerAccount {
+	return LedgerAccount{Code: "fees:" + currency, Kind: LedgerAccountFees, Currency: currency}
+}
+
+func Funding(currency string) LedgerAccount {
+	return LedgerAccount{Code: "funding:" + currency, Kind: LedgerAccountFunding, Currency: currency}
+}
+
+func Interest(currency string) LedgerAccount {
+	return LedgerAccount{Code: "interest:" + currency, Kind: LedgerAccountInterest, Currency: currency}
+}
+
+// JournalKind tells what moved the money of a journal entry.
+type JournalKind string
+
+const (
+	JournalOpening                   JournalKind = "OPENING"
+	JournalHold                      JournalKind = "HOLD"
+	JournalCapture                   JournalKind = "CAPTURE"
+	JournalForcePost                 JournalKind = "FORCE_POST"
+	JournalRelease                   JournalKind = "RELEASE"
+	JournalReversal                  JournalKind = "REVERSAL"
+	JournalRefund                    JournalKind = "REFUND"
+	JournalProvisionalCredit         JournalKind = "PROVISIONAL_CREDIT"
+	JournalProvisionalCreditReversal JournalKind = "PROVISIONAL_CREDIT_REVERSAL"
+	JournalPayment                   JournalKind = "PAYMENT"
+	JournalInterest                  JournalKind = "INTEREST"
+	JournalLateFee                   JournalKind = "LATE_FEE"
+	JournalFee                       JournalKind = "FEE"
+)
+
+// Posting changes the balance of a ledger account by Amount.
+type Posting struct {
+	Account LedgerAccount
+	Amount  int64
+}
+
+// Transfer returns the postings that move amount from one ledger account to
+// another, or none for a zero amount.
+func Transfer(from, to LedgerAccount, amount int64) []Posting {
+	if amount == 0 {
+		return nil
+	}
+	return []Posting{{Account: from, Amount: -amount}, {Account: to, Amount: amount}}
+}
+
+// Journal is an entry of the append-only ledger: postings of one currency
+// that sum to zero. AuthID and TxID link it to what caused it.
+type Journal struct {
+	ID        string
+	Kind      JournalKind
+	AccountID string
+	AuthID    string
+	TxID      string
+	Currency  string
+	Postings  []Posting
+	CreatedAt time.Time
+}
+
+// Validate returns ErrUnbalancedJournal unless the postings are non-zero,
+// of the journal's currency and sum to zero.
+func (j *Journal) Validate() error {
+	var sum int64
+	for _, p := range j.Postings {
+		if p.Amount == 0 {
+			return fmt.Errorf("zero posting to %s: %w", p.Account.Code, ErrUnbalancedJournal)
+		}
+		if p.Account.Currency != j.Currency {
+			return fmt.Errorf("posting to %s in %s, journal in %s: %w", p.Account.Code, p.Account.Currency, j.Currency, ErrUnbalancedJournal)
+		}
+		sum += p.Amount
+	}
+	if sum != 0 {
+		return fmt.Errorf("%s postings sum to %d: %w", j.Kind, sum, ErrUnbalancedJournal)
+	}
+	return nil
+}
+
+// LedgerDiscrepancy is an account whose balance columns differ from the sum
+// of the postings to its customer ledger accounts.
+type LedgerDiscrepancy struct {
+	AccountID        string
+	Currency         string
+	AvailableBalance int64
+	LedgerAvailable  int64
+	HoldBalance      int64
+	LedgerHold       int64
+}
+
+// LedgerCheck is the result of verifying the balance columns against the
+// ledger. Unbalanced lists journal entries whose postings do not sum to zero.
+type LedgerCheck struct {
+	CheckedAt     time.Time
+	Accounts      int
+	Journals      int
+	Unbalanced    []string
+	Discrepancies []LedgerDiscrepancy
+}
+
+// Consistent reports whether the ledger is balanced and every account's
+// balances match it.
+func (c *LedgerCheck) Consistent() bool {
+	return len(c.Unbalanced) == 0 && len(c.Discrepancies) == 0
+}
@@ -5,4 +5,8 @@ type Merchant struct {
 	MCC        string // Merchant Category Code
 	PostalCode string
 	WebSite    string
+	// TerminalID (DE41) and CardAcceptorID (DE42) identify where the card was
+	// presented; STANs are only unique per terminal
+	TerminalID     string
+	CardAcceptorID string
 }
@@ -0,0 +1,77 @@
+package models
+
+import (
+	"errors"
+	"time"
+)
+
+var (
+	// ErrPINNotSet is returned when a card without a PIN is asked to verify one.
+	ErrPINNotSet = errors.New("PIN not set")
+	// ErrIncorrectPIN is returned for a wrong PIN.
+	ErrIncorrectPIN = errors.New("incorrect PIN")
+	// ErrPINBlocked is returned once a card had too many wrong PINs in a row;
+	// a reset by issuer operations unblocks it.
+	ErrPINBlocked = errors.New("PIN blocked")
+	// ErrPINAlreadySet is returned when a PIN is set for a card that has one;
+	// it is changed with the old PIN or reset by issuer operations.
+	ErrPINAlreadySet = errors.New("PIN already set")
+	// ErrCardNumberMismatch is returned when the PAN of a PIN request is not
+	// the one of the card.
+	ErrCardNumberMismatch = errors.New("card number does not match the card")
+)
+
+// CardPIN is what the issuer keeps of a card's PIN: its PVV, derived with
+// the PVK of index PVKI, never the PIN itself.
+type CardPIN struct {
+	CardID string
+	PVKI   int
+	PVV    string
+	// PVKVersion is the key store version of the PVK the PVV is derived
+	// with; 0 for PINs set before versions were recorded
+	PVKVersion     int
+	FailedAttempts int
+	Blocked        bool
+	UpdatedAt      time.Time
+}
+
+// SetPIN sets the first PIN of a card. The issuer only keeps a hash of the
+// PAN, so the request carries it to derive the PVV.
+type SetPIN struct {
+	CardNumber string
+	PIN        string
+}
+
+// ResetPIN is issuer operations setting a new PIN for a card whose PIN was
+// forgotten or blocked, without the old one. Actor is who reset it.
+type ResetPIN struct {
+	CardNumber string
+	PIN        string
+	Reason     string
+	Actor      string
+}
+
+// PINReset records a PIN reset.
+type PINReset struct {
+	ID      string
+	CardID  string
+	Reason  string
+	Actor   string
+	ResetAt time.Time
+}
+
+// ChangePIN changes the PIN of a card. A wrong OldPIN counts as a wrong
+// attempt, like one in an authorization.
+type ChangePIN struct {
+	CardNumber string
+	OldPIN     string
+	NewPIN     string
+}
+
+// PINStatus is returned by the PIN endpoints.
+type PINStatus struct {
+	CardID    string
+	Set       bool
+	Blocked   bool
+	TriesLeft int
+}
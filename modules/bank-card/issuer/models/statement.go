@@ -0,0 +1,45 @@
+package models
+
+import "time"
+
+// Statement closes a cycle of a credit account. Balances are what the
+// account owes, negative when it is in credit.
+type Statement struct {
+	ID             string
+	AccountID      string
+	PeriodStart    time.Time
+	PeriodEnd      time.Time
+	OpeningBalance int64
+	ClosingBalance int64
+	// Interest and Fees were charged in the cycle; interest is waived while
+	// the account is in its grace period.
+	Interest       int64
+	Fees           int64
+	MinimumPayment int64
+	DueDate        time.Time
+	// Paid is what was paid after the statement closed, up to the due date.
+	Paid           int64
+	LateFeeCharged bool
+	CreatedAt      time.Time
+}
+
+// PaidInFull reports whether the statement balance was paid by the due date.
+func (s *Statement) PaidInFull() bool {
+	return s.Paid >= s.ClosingBalance
+}
+
+// CreatePayment pays towards the balance of a credit account.
+type CreatePayment struct {
+	Amount   int64
+	Currency string
+}
+
+// Payment is a posted payment. It counts towards the latest statement when
+// it is made by that statement's due date.
+type Payment struct {
+	TransactionID string
+	AccountID     string
+	Amount        int64
+	Currency      string
+	BusinessDate  time.Time
+}
@@ -4,12 +4,15 @@ type Transaction struct {
 	ID                string
 	AccountID         string
 	CardID            string
+	AuthID            string
 	Amount            int64
 	Currency          string
 	AuthorizationCode string
 	ApprovalCode      string
 	Status            TransactionStatus
 	Merchant          Merchant
+	// Description tells what a fee was charged for.
+	Description string
 }
 
 type TransactionStatus string
@@ -17,4 +20,71 @@ type TransactionStatus string
 const (
 	TransactionStatusAuthorized TransactionStatus = "authorized"
 	TransactionStatusDeclined   TransactionStatus = "declined"
+	// TransactionStatusFee is a fee charged to the account.
+	TransactionStatusFee TransactionStatus = "FEE"
 )
+
+// TransactionType is what a transaction does for the cardholder. The
+// processing code of an authorization tells it; limits and fee rules are
+// set per type.
+type TransactionType string
+
+const (
+	TransactionTypePurchase        TransactionType = "purchase"
+	TransactionTypeATMWithdrawal   TransactionType = "atm_withdrawal"
+	TransactionTypeCashAdvance     TransactionType = "cash_advance"
+	TransactionTypeRefund          TransactionType = "refund"
+	TransactionTypeBalanceInquiry  TransactionType = "balance_inquiry"
+	TransactionTypeCardReplacement TransactionType = "card_replacement"
+)
+
+// Valid reports whether t is one of the known transaction types.
+func (t TransactionType) Valid() bool {
+	switch t {
+	case TransactionTypePurchase, TransactionTypeATMWithdrawal, TransactionTypeCashAdvance,
+		TransactionTypeRefund, TransactionTypeBalanceInquiry, TransactionTypeCardReplacement:
+		return true
+	}
+	return false
+}
+
+// TransactionTypeForMCC tells the type of a card transaction by the
+// merchant's category: ATMs (6011) pay out withdrawals, cash disbursed over
+// the counter (6010) is a cash advance, everything else is a purchase.
+func TransactionTypeForMCC(mcc string) TransactionType {
+	switch mcc {
+	case "6011":
+		return TransactionTypeATMWithdrawal
+	case "6010":
+		return TransactionTypeCashAdvance
+	}
+	return TransactionTypePurchase
+}
+
+// TransactionTypeForProcessingCode tells the type of an authorization by the
+// transaction type code, the first two digits of its processing code (DE3):
+// 00 purchase, 01 cash withdrawal (a cash advance at MCC 6010, an ATM
+// withdrawal elsewhere), 20 refund and 31 balance inquiry. An empty
+// processing code is a purchase. It returns false for other codes.
+func TransactionTypeForProcessingCode(code, mcc string) (TransactionType, bool) {
+	if code == "" {
+		return TransactionTypePurchase, true
+	}
+	if len(code) < 2 {
+		return "", false
+	}
+	switch code[:2] {
+	case "00":
+		return TransactionTypePurchase, true
+	case "01":
+		if mcc == "6010" {
+			return TransactionTypeCashAdvance, true
+		}
+		return TransactionTypeATMWithdrawal, true
+	case "20":
+		return TransactionTypeRefund, true
+	case "31":
+		return TransactionTypeBalanceInquiry, true
+	}
+	return "", false
+}
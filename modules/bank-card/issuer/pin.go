@@ -0,0 +1,248 @@
+package issuer
+
+import (
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+
+	"github.com/alovak/cardflow-playground/internal/cardgen"
+	"github.com/alovak/cardflow-playground/internal/keys"
+	"github.com/alovak/cardflow-playground/internal/security"
+	"github.com/alovak/cardflow-playground/issuer/models"
+)
+
+// newPVVProvider returns the PVV providers selected by cfg.PIN.PVVProvider,
+// one for each PVK version of the store; new PINs get the version pinned in
+// cfg.Keys.Versions, the active one otherwise. The PKCS#11 library can only
+// be initialized once per process, so the softhsm provider is the CVV
+// provider's session.
+func newPVVProvider(cfg *Config, cvv security.CVVProvider, store *keys.Store) (byKeyVersion[security.PVVProvider], error) {
+	name, label := "", ""
+	if cfg != nil {
+		name, label = cfg.PIN.PVVProvider, cfg.SoftHSM.PVKLabel
+	}
+
+	switch name {
+	case "", "demo":
+		pvk, err := issuerKey(store, cfg, keys.PurposePVK)
+		if err != nil {
+			return byKeyVersion[security.PVVProvider]{}, err
+		}
+		providers := byKeyVersion[security.PVVProvider]{current: pvk.Version, values: map[int]security.PVVProvider{}}
+		for _, key := range keyVersions(store, keys.PurposePVK) {
+			providers.values[key.Version] = security.NewSoftwarePVVProvider(key.Material())
+		}
+		return providers, nil
+	case "softhsm":
+		p, ok := cvv.(interface {
+			security.PVVProvider
+			SetPVKLabel(string)
+		})
+		if !ok {
+			return byKeyVersion[security.PVVProvider]{}, fmt.Errorf("softhsm PVV provider requires the softhsm CVV provider")
+		}
+		if label == "" {
+			label = getenv("SOFTHSM_PVK_LABEL", "pvk")
+		}
+		p.SetPVKLabel(label)
+		return singleKeyVersion[security.PVVProvider](p), nil
+	default:
+		return byKeyVersion[security.PVVProvider]{}, fmt.Errorf("unsupported PVV provider: %s", name)
+	}
+}
+
+// pinConfig returns the PIN settings, falling back to the defaults.
+func (i *Service) pinConfig() PINConfig {
+	if i.cfg == nil || i.cfg.PIN.MaxTries <= 0 {
+		return DefaultConfig().PIN
+	}
+	return i.cfg.PIN
+}
+
+// GetPINStatus tells whether the card has a PIN and how many wrong
+// attempts it has left.
+func (i *Service) GetPINStatus(accountID, cardID string) (*models.PINStatus, error) {
+	if _, err := i.repo.GetCard(accountID, cardID); err != nil {
+		return nil, fmt.Errorf("finding card: %w", err)
+	}
+	pin, err := i.repo.GetCardPIN(cardID)
+	if errors.Is(err, ErrNotFound) {
+		return &models.PINStatus{CardID: cardID}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("finding pin: %w", err)
+	}
+	return i.pinStatus(pin), nil
+}
+
+// SetPIN sets the first PIN of a card. Knowing the PAN is not enough to
+// replace a PIN: a card that has one returns models.ErrPINAlreadySet, its
+// PIN is changed with ChangePIN or reset with ResetPIN.
+func (i *Service) SetPIN(accountID, cardID string, req models.SetPIN) (*models.PINStatus, error) {
+	if err := security.ValidatePIN(req.PIN); err != nil {
+		return nil, err
+	}
+	if err := i.checkCardNumber(accountID, cardID, req.CardNumber); err != nil {
+		return nil, err
+	}
+	pin, err := i.derivePVV(cardID, req.CardNumber, req.PIN)
+	if err != nil {
+		return nil, err
+	}
+	stored, err := i.repo.AddCardPIN(accountID, pin)
+	if err != nil {
+		return nil, fmt.Errorf("storing pin: %w", err)
+	}
+	return i.pinStatus(stored), nil
+}
+
+// ResetPIN is issuer operations replacing the PIN of a card without the old
+// one, unblocking it. The reset is recorded with its actor.
+func (i *Service) ResetPIN(accountID, cardID string, req models.ResetPIN) (*models.PINStatus, *models.PINReset, error) {
+	if err := security.ValidatePIN(req.PIN); err != nil {
+		return nil, nil, err
+	}
+	if err := i.checkCardNumber(accountID, cardID, req.CardNumber); err != nil {
+		return nil, nil, err
+	}
+	pin, err := i.derivePVV(cardID, req.CardNumber, req.PIN)
+	if err != nil {
+		return nil, nil, err
+	}
+	stored, reset, err := i.repo.ResetCardPIN(accountID, pin, req)
+	if err != nil {
+		return nil, nil, fmt.Errorf("resetting pin: %w", err)
+	}
+	return i.pinStatus(stored), reset, nil
+}
+
+// ChangePIN verifies the old PIN of a card and sets the new one. A wrong old
+// PIN counts towards blocking the PIN.
+func (i *Service) ChangePIN(accountID, cardID string, req models.ChangePIN) (*models.PINStatus, error) {
+	if err := security.ValidatePIN(req.NewPIN); err != nil {
+		return nil, err
+	}
+	if err := i.checkCardNumber(accountID, cardID, req.CardNumber); err != nil {
+		return nil, err
+	}
+	if err := i.verifyPIN(cardID, req.CardNumber, req.OldPIN); err != nil {
+		return nil, err
+	}
+	pin, err := i.derivePVV(cardID, req.CardNumber, req.NewPIN)
+	if err != nil {
+		return nil, err
+	}
+	stored, err := i.repo.SetCardPIN(accountID, pin)
+	if err != nil {
+		return nil, fmt.Errorf("storing pin: %w", err)
+	}
+	return i.pinStatus(stored), nil
+}
+
+// derivePVV returns what the card keeps of pin: its PVV under the PVK
+// index and version new PINs are derived with.
+func (i *Service) derivePVV(cardID, pan, pin string) (models.CardPIN, error) {
+	pvki := i.pinConfig().PVKI
+	provider, err := i.pvv.get(i.pvv.current)
+	if err != nil {
+		return models.CardPIN{}, fmt.Errorf("finding pvk: %w", err)
+	}
+	pvv, err := provider.ComputePVV(pan, pin, pvki)
+	if err != nil {
+		return models.CardPIN{}, fmt.Errorf("computing pvv: %w", err)
+	}
+	return models.CardPIN{CardID: cardID, PVKI: pvki, PVV: pvv, PVKVersion: i.pvv.current}, nil
+}
+
+// checkCardNumber makes sure the PAN of a PIN request is the card's.
+func (i *Service) checkCardNumber(accountID, cardID, pan string) error {
+	if _, err := i.repo.GetCard(accountID, cardID); err != nil {
+		return fmt.Errorf("finding card: %w", err)
+	}
+	card, err := i.repo.FindCardForAuthorization(models.Card{Number: cardgen.NormalizePAN(pan)})
+	if errors.Is(err, ErrNotFound) || (err == nil && card.ID != cardID) {
+		return models.ErrCardNumberMismatch
+	}
+	if err != nil {
+		return fmt.Errorf("finding card: %w", err)
+	}
+	return nil
+}
+
+// verifyPIN recomputes the PVV of pin and compares it with the card's in
+// constant time, counting the attempt. It returns models.ErrPINNotSet,
+// models.ErrPINBlocked (also when this attempt blocked the PIN) or
+// models.ErrIncorrectPIN.
+func (i *Service) verifyPIN(cardID, pan, pin string) error {
+	stored, err := i.repo.GetCardPIN(cardID)
+	if errors.Is(err, ErrNotFound) {
+		return models.ErrPINNotSet
+	}
+	if err != nil {
+		return fmt.Errorf("finding pin: %w", err)
+	}
+	if stored.Blocked {
+		return models.ErrPINBlocked
+	}
+
+	correct := false
+	if security.ValidatePIN(pin) == nil {
+		provider, err := i.pvv.get(stored.PVKVersion)
+		if err != nil {
+			return fmt.Errorf("finding pvk: %w", err)
+		}
+		pvv, err := provider.ComputePVV(pan, pin, stored.PVKI)
+		if err != nil {
+			return fmt.Errorf("computing pvv: %w", err)
+		}
+		correct = subtle.ConstantTimeCompare([]byte(pvv), []byte(stored.PVV)) == 1
+	}
+
+	attempt, err := i.repo.RecordPINAttempt(cardID, correct, i.pinConfig().MaxTries)
+	if err != nil {
+		return fmt.Errorf("recording pin attempt: %w", err)
+	}
+	switch {
+	case attempt.Blocked:
+		return models.ErrPINBlocked
+	case !correct:
+		return models.ErrIncorrectPIN
+	}
+	return nil
+}
+
+// verifyPINBlock decrypts the PIN block (DE52) of an authorization and
+// verifies the PIN. It returns the response code of a declined PIN, or ""
+// when the PIN is correct. A block that does not decrypt is declined
+// without counting as an attempt.
+func (i *Service) verifyPINBlock(cardID, pan, pinBlock string) (string, error) {
+	encrypted, err := hex.DecodeString(pinBlock)
+	if err != nil {
+		return models.ApprovalCodeIncorrectPIN, nil
+	}
+	pin, err := security.DecryptPINBlock(encrypted, pan, i.zpk)
+	if err != nil {
+		return models.ApprovalCodeIncorrectPIN, nil
+	}
+
+	err = i.verifyPIN(cardID, pan, pin)
+	switch {
+	case err == nil:
+		return "", nil
+	case errors.Is(err, models.ErrPINBlocked):
+		return models.ApprovalCodePINTriesExceeded, nil
+	case errors.Is(err, models.ErrIncorrectPIN), errors.Is(err, models.ErrPINNotSet):
+		return models.ApprovalCodeIncorrectPIN, nil
+	default:
+		return "", err
+	}
+}
+
+func (i *Service) pinStatus(pin *models.CardPIN) *models.PINStatus {
+	left := i.pinConfig().MaxTries - pin.FailedAttempts
+	if pin.Blocked || left < 0 {
+		left = 0
+	}
+	return &models.PINStatus{CardID: pin.CardID, Set: true, Blocked: pin.Blocked, TriesLeft: left}
+}
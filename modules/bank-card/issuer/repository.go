@@ -3,13 +3,17 @@ package issuer
 import (
     "context"
     "database/sql"
+    "encoding/binary"
     "errors"
     "fmt"
     "strings"
     "sync"
+    "time"
 
     "github.com/alovak/cardflow-playground/internal/cardgen"
+    "github.com/alovak/cardflow-playground/internal/keys"
     "github.com/alovak/cardflow-playground/issuer/models"
+    "github.com/google/uuid"
     "github.com/jackc/pgconn"
     "github.com/lib/pq"
 )
@@ -17,22 +21,42 @@ import (
 var ErrNotFound = fmt.Errorf("not found")
 
 type Repository struct {
-    Cards        []*models.Card
-    Accounts     []*models.Account
-    Transactions []*models.Transaction
+    Cards             []*models.Card
+    Accounts          []*models.Account
+    Transactions      []*models.Transaction
+    CardStatusChanges []*models.CardStatusChange
+    PINResets         []*models.PINReset
+    // PINs holds the PVV and retry counter of each card with a PIN, by card ID
+    PINs map[string]*models.CardPIN
 
     mu sync.RWMutex
+    // dcvvUses maps the time windows whose dynamic CVV was used to the RRN
+    // of the authorization that used it
+    dcvvUses map[dcvvUse]string
     panIndex map[string]struct{}
     db      *sql.DB
     hashKey []byte
+    // hashVersion is the key store version of hashKey, recorded with the hashes of new cards
+    hashVersion int
+    // earlierHashKeys are the other versions of the PAN pepper; cards hashed with them are still found
+    earlierHashKeys [][]byte
+    // lockHashKey is the earliest version of the PAN pepper, known to every
+    // instance whatever version it hashes new cards with; nil uses hashKey
+    lockHashKey []byte
+    // panKey encrypts the PANs of new cards into pan_token; nil keeps none
+    panKey *keys.Key
 }
 
 func NewRepository() *Repository {
     return &Repository{
-        Cards:        make([]*models.Card, 0),
-        Accounts:     make([]*models.Account, 0),
-        Transactions: make([]*models.Transaction, 0),
-        panIndex:     make(map[string]struct{}),
+        Cards:             make([]*models.Card, 0),
+        Accounts:          make([]*models.Account, 0),
+        Transactions:      make([]*models.Transaction, 0),
+        CardStatusChanges: make([]*models.CardStatusChange, 0),
+        PINResets:         make([]*models.PINReset, 0),
+        PINs:              make(map[string]*models.CardPIN),
+        dcvvUses:          make(map[dcvvUse]string),
+        panIndex:          make(map[string]struct{}),
     }
 }
 
@@ -41,6 +65,47 @@ func NewPGRepository(db *sql.DB, hashKey []byte) *Repository {
     return &Repository{db: db, hashKey: hashKey}
 }
 
+// PepperPANs makes the repository hash the PANs of new cards with the
+// current pepper, recording its version, and find cards by the hash of their
+// PAN under any of the peppers, so a new pepper version does not lose the
+// cards hashed with an earlier one.
+func (r *Repository) PepperPANs(current *keys.Key, peppers []*keys.Key) {
+    r.hashKey, r.hashVersion = current.Material(), current.Version
+    r.earlierHashKeys = nil
+    earliest := current
+    for _, pepper := range peppers {
+        if pepper.Version != current.Version {
+            r.earlierHashKeys = append(r.earlierHashKeys, pepper.Material())
+        }
+        if pepper.Version < earliest.Version { earliest = pepper }
+    }
+    r.lockHashKey = earliest.Material()
+}
+
+// panLock is the key of the advisory lock issuing a PAN takes: its hash under
+// the earliest pepper, the same on instances that issue with different ones.
+func (r *Repository) panLock(pan string) int64 {
+    key := r.lockHashKey
+    if key == nil { key = r.hashKey }
+    return int64(binary.BigEndian.Uint64(cardgen.HashPANHMAC(pan, key)))
+}
+
+// panHashes returns the hashes of a PAN under the current pepper and the earlier ones.
+func (r *Repository) panHashes(pan string) [][]byte {
+    hashes := [][]byte{cardgen.HashPANHMAC(pan, r.hashKey)}
+    for _, key := range r.earlierHashKeys {
+        hashes = append(hashes, cardgen.HashPANHMAC(pan, key))
+    }
+    return hashes
+}
+
+// EncryptPANs makes the repository keep the PANs of new cards in DB mode,
+// encrypted with the DEK; the token names its version. A nil DEK keeps only
+// the PAN hash.
+func (r *Repository) EncryptPANs(dek *keys.Key) {
+    r.panKey = dek
+}
+
 func (r *Repository) CreateAccount(account *models.Account) error {
     if r.db == nil {
         r.mu.Lock()
@@ -48,11 +113,23 @@ func (r *Repository) CreateAccount(account *models.Account) error {
         r.Accounts = append(r.Accounts, account)
         return nil
     }
-    _, err := r.db.ExecContext(context.Background(), `
-        INSERT INTO issuer.accounts(account_id, core_account_id, currency, available_balance, hold_balance)
-        VALUES ($1,$2,$3,$4,$5)
-    `, account.ID, account.ID, strings.ToUpper(account.Currency), account.AvailableBalance, account.HoldBalance)
-    return err
+    ctx := context.Background()
+    tx, err := r.db.BeginTx(ctx, nil)
+    if err != nil { return err }
+    defer tx.Rollback()
+    // balances start at zero; the opening journal posts them
+    currency := strings.ToUpper(account.Currency)
+    if _, err := tx.ExecContext(ctx, `
+        INSERT INTO issuer.accounts(account_id, core_account_id, currency, available_balance, hold_balance,
+                                    product, credit_limit, statement_day, purchase_apr_bps, opened_on)
+        VALUES ($1,$2,$3,0,0,$4,$5,nullif($6,0),$7,$8)
+    `, account.ID, account.ID, currency, account.Product, account.CreditLimit, account.StatementDay, account.PurchaseAPRBps,
+        account.OpenedOn.Format("2006-01-02")); err != nil { return err }
+    opening := &models.Journal{Kind: models.JournalOpening, AccountID: account.ID, Currency: currency}
+    opening.Postings = append(models.Transfer(models.Funding(currency), models.CustomerAvailable(account.ID, currency), account.AvailableBalance),
+        models.Transfer(models.Funding(currency), models.CustomerHold(account.ID, currency), account.HoldBalance)...)
+    if err := r.postJournal(ctx, tx, opening); err != nil { return err }
+    return tx.Commit()
 }
 
 func (r *Repository) GetAccount(accountID string) (*models.Account, error) {
@@ -66,16 +143,18 @@ func (r *Repository) GetAccount(accountID string) (*models.Account, error) {
         }
         return nil, ErrNotFound
     }
-    row := r.db.QueryRowContext(context.Background(), `SELECT account_id, currency, available_balance, hold_balance FROM issuer.accounts WHERE account_id=$1`, accountID)
-    var id, cur string
-    var avail, hold int64
-    if err := row.Scan(&id, &cur, &avail, &hold); err != nil {
+    row := r.db.QueryRowContext(context.Background(), `
+        SELECT account_id, currency, available_balance, hold_balance, product, credit_limit, coalesce(statement_day, 0), purchase_apr_bps, opened_on
+          FROM issuer.accounts WHERE account_id=$1
+    `, accountID)
+    var a models.Account
+    if err := row.Scan(&a.ID, &a.Currency, &a.AvailableBalance, &a.HoldBalance, &a.Product, &a.CreditLimit, &a.StatementDay, &a.PurchaseAPRBps, &a.OpenedOn); err != nil {
         if errors.Is(err, sql.ErrNoRows) {
             return nil, ErrNotFound
         }
         return nil, err
     }
-    return &models.Account{ID: id, Currency: cur, AvailableBalance: avail, HoldBalance: hold}, nil
+    return &a, nil
 }
 
 var ErrConflict = fmt.Errorf("conflict")
@@ -87,24 +166,177 @@ func (r *Repository) CreateCard(card *models.Card) error {
         if _, ok := r.panIndex[card.Number]; ok {
             return fmt.Errorf("card number exists: %w", ErrConflict)
         }
-        r.Cards = append(r.Cards, card)
+        if card.Status == "" {
+            card.Status = models.CardStatusIssued
+        }
+        // keep a copy without the CVV: like the DB, memory never stores it
+        stored := *card
+        stored.CardVerificationValue = ""
+        r.Cards = append(r.Cards, &stored)
         r.panIndex[card.Number] = struct{}{}
         return nil
     }
     panNorm := cardgen.NormalizePAN(card.Number)
     bin := panNorm
     if len(bin) > 9 { bin = bin[:9] }
-    if len(bin) >= 6 { bin = bin[:len(bin)] } // keep up to 9; ensure not empty
     last4 := cardgen.LastN(panNorm, 4)
-    hash := cardgen.HashPANHMAC(panNorm, r.hashKey)
-    _, err := r.db.ExecContext(context.Background(), `
-        INSERT INTO issuer.cards(card_id, account_id, bin, last4, expiry_yymm, status, pan_hash)
-        VALUES ($1,$2,$3,$4,$5,'ISSUED',$6)
-    `, card.ID, card.AccountID, bin, last4, card.ExpirationDate, hash)
+    hashes := r.panHashes(panNorm)
+    ctx := context.Background()
+    tx, err := r.db.BeginTx(ctx, nil)
+    if err != nil { return err }
+    defer tx.Rollback()
+    // the unique constraint only sees a PAN hashed with the same pepper; the
+    // lock makes concurrent issuances of the PAN, under any pepper, check the
+    // earlier ones and insert in turn
+    if _, err := tx.ExecContext(ctx, `select pg_advisory_xact_lock($1)`, r.panLock(panNorm)); err != nil { return err }
+    if len(hashes) > 1 {
+        var exists bool
+        err := tx.QueryRowContext(ctx, `select exists(select 1 from issuer.cards where pan_hash = any($1))`, pq.Array(hashes[1:])).Scan(&exists)
+        if err != nil { return err }
+        if exists { return ErrConflict }
+    }
+    var token sql.NullString
+    if r.panKey != nil {
+        // the card ID is authenticated with the PAN, so a token cannot be moved to another card
+        sealed, err := keys.Seal(r.panKey, []byte(panNorm), []byte(card.ID))
+        if err != nil { return fmt.Errorf("encrypting pan: %w", err) }
+        token = sql.NullString{String: sealed, Valid: true}
+    }
+    _, err = tx.ExecContext(ctx, `
+        INSERT INTO issuer.cards(card_id, account_id, bin, last4, expiry_yymm, status, pan_hash, pan_token, pan_hash_version, cvk_version)
+        VALUES ($1,$2,$3,$4,$5,'ISSUED',$6,$7,nullif($8,0),nullif($9,0))
+    `, card.ID, card.AccountID, bin, last4, card.ExpirationDate, hashes[0], token, r.hashVersion, card.CVKVersion)
     if isUniqueViolation(err) {
         return ErrConflict
     }
-    return err
+    if err != nil { return err }
+    if err := tx.Commit(); err != nil { return err }
+    card.Status = models.CardStatusIssued
+    return nil
+}
+
+// GetCard returns the card with the given ID if it belongs to the account.
+// In DB mode only the last four digits of the PAN are available.
+func (r *Repository) GetCard(accountID, cardID string) (*models.Card, error) {
+    if r.db == nil {
+        r.mu.RLock()
+        defer r.mu.RUnlock()
+        for _, c := range r.Cards {
+            if c.ID == cardID && c.AccountID == accountID {
+                return c, nil
+            }
+        }
+        return nil, ErrNotFound
+    }
+    row := r.db.QueryRowContext(context.Background(), `SELECT card_id, account_id, last4, expiry_yymm, status, dcvv_enabled, coalesce(cvk_version, 0) FROM issuer.cards WHERE card_id=$1 AND account_id=$2`, cardID, accountID)
+    var id, acc, last4, exp, status string
+    var dcvv bool
+    var cvkVersion int
+    if err := row.Scan(&id, &acc, &last4, &exp, &status, &dcvv, &cvkVersion); err != nil {
+        if errors.Is(err, sql.ErrNoRows) { return nil, ErrNotFound }
+        return nil, err
+    }
+    return &models.Card{ID: id, AccountID: acc, Number: "****"+last4, ExpirationDate: exp, Status: models.CardStatus(status), DCVVEnabled: dcvv, CVKVersion: cvkVersion}, nil
+}
+
+// UpdateCardStatus moves a card to a new status and records the change in the audit trail.
+// The transition is validated against the current status under a lock (row lock in DB mode),
+// so concurrent updates cannot skip a state. Returns models.ErrInvalidCardStatusTransition
+// when the move is not allowed.
+func (r *Repository) UpdateCardStatus(accountID, cardID string, change models.ChangeCardStatus) (*models.Card, *models.CardStatusChange, error) {
+    if r.db == nil {
+        r.mu.Lock()
+        defer r.mu.Unlock()
+        for _, c := range r.Cards {
+            if c.ID != cardID || c.AccountID != accountID {
+                continue
+            }
+            if !c.Status.CanTransitionTo(change.Status) {
+                return nil, nil, fmt.Errorf("%s -> %s: %w", c.Status, change.Status, models.ErrInvalidCardStatusTransition)
+            }
+            audit := &models.CardStatusChange{
+                ID:         uuid.New().String(),
+                CardID:     c.ID,
+                FromStatus: c.Status,
+                ToStatus:   change.Status,
+                Reason:     change.Reason,
+                Actor:      change.Actor,
+                ChangedAt:  time.Now().UTC(),
+            }
+            c.Status = change.Status
+            r.CardStatusChanges = append(r.CardStatusChanges, audit)
+            return c, audit, nil
+        }
+        return nil, nil, ErrNotFound
+    }
+    ctx := context.Background()
+    tx, err := r.db.BeginTx(ctx, nil)
+    if err != nil { return nil, nil, err }
+    defer tx.Rollback()
+    if _, err := tx.ExecContext(ctx, "set local statement_timeout = '3s'"); err != nil { return nil, nil, err }
+
+    var last4, exp, status string
+    var dcvv bool
+    var cvkVersion int
+    err = tx.QueryRowContext(ctx, `
+      select last4, expiry_yymm, status, dcvv_enabled, coalesce(cvk_version, 0) from issuer.cards where card_id=$1 and account_id=$2 for update
+    `, cardID, accountID).Scan(&last4, &exp, &status, &dcvv, &cvkVersion)
+    if errors.Is(err, sql.ErrNoRows) { return nil, nil, ErrNotFound }
+    if err != nil { return nil, nil, err }
+    from := models.CardStatus(status)
+    if !from.CanTransitionTo(change.Status) {
+        return nil, nil, fmt.Errorf("%s -> %s: %w", from, change.Status, models.ErrInvalidCardStatusTransition)
+    }
+
+    if _, err := tx.ExecContext(ctx, `update issuer.cards set status=$2 where card_id=$1`, cardID, string(change.Status)); err != nil { return nil, nil, err }
+    audit := &models.CardStatusChange{
+        ID:         uuid.New().String(),
+        CardID:     cardID,
+        FromStatus: from,
+        ToStatus:   change.Status,
+        Reason:     change.Reason,
+        Actor:      change.Actor,
+    }
+    if err := tx.QueryRowContext(ctx, `
+      insert into issuer.card_status_changes(change_id, card_id, from_status, to_status, reason, actor)
+      values ($1,$2,$3,$4,$5,$6)
+      returning changed_at
+    `, audit.ID, cardID, string(from), string(change.Status), change.Reason, change.Actor).Scan(&audit.ChangedAt); err != nil {
+        return nil, nil, err
+    }
+    if err := tx.Commit(); err != nil { return nil, nil, err }
+    card := &models.Card{ID: cardID, AccountID: accountID, Number: "****"+last4, ExpirationDate: exp, Status: change.Status, DCVVEnabled: dcvv, CVKVersion: cvkVersion}
+    return card, audit, nil
+}
+
+// ListCardStatusChanges returns the status audit trail of a card, oldest first.
+func (r *Repository) ListCardStatusChanges(accountID, cardID string) ([]*models.CardStatusChange, error) {
+    if _, err := r.GetCard(accountID, cardID); err != nil {
+        return nil, err
+    }
+    if r.db == nil {
+        r.mu.RLock(); defer r.mu.RUnlock()
+        var changes []*models.CardStatusChange
+        for _, ch := range r.CardStatusChanges {
+            if ch.CardID == cardID { changes = append(changes, ch) }
+        }
+        return changes, nil
+    }
+    rows, err := r.db.QueryContext(context.Background(), `
+      select change_id, card_id, from_status, to_status, coalesce(reason, ''), actor, changed_at
+        from issuer.card_status_changes where card_id=$1 order by changed_at asc
+    `, cardID)
+    if err != nil { return nil, err }
+    defer rows.Close()
+    var out []*models.CardStatusChange
+    for rows.Next() {
+        var ch models.CardStatusChange; var from, to string
+        if err := rows.Scan(&ch.ID, &ch.CardID, &from, &to, &ch.Reason, &ch.Actor, &ch.ChangedAt); err != nil { return nil, err }
+        ch.FromStatus = models.CardStatus(from)
+        ch.ToStatus = models.CardStatus(to)
+        out = append(out, &ch)
+    }
+    return out, rows.Err()
 }
 
 // UpdateCardholderName updates the in-memory cardholder name for a card and returns the updated card.
@@ -124,6 +356,227 @@ func (r *Repository) UpdateCardholderName(accountID, cardID, name string) (*mode
     return nil, ErrNotFound
 }
 
+// AddCardPIN stores the PVV of the first PIN of a card;
+// models.ErrPINAlreadySet when it has one.
+func (r *Repository) AddCardPIN(accountID string, pin models.CardPIN) (*models.CardPIN, error) {
+    if _, err := r.GetCard(accountID, pin.CardID); err != nil {
+        return nil, err
+    }
+    if r.db == nil {
+        r.mu.Lock()
+        defer r.mu.Unlock()
+        if _, ok := r.PINs[pin.CardID]; ok { return nil, models.ErrPINAlreadySet }
+        stored := &models.CardPIN{CardID: pin.CardID, PVKI: pin.PVKI, PVV: pin.PVV, PVKVersion: pin.PVKVersion, UpdatedAt: time.Now().UTC()}
+        r.PINs[pin.CardID] = stored
+        copied := *stored
+        return &copied, nil
+    }
+    stored := &models.CardPIN{CardID: pin.CardID, PVKI: pin.PVKI, PVV: pin.PVV, PVKVersion: pin.PVKVersion}
+    err := r.db.QueryRowContext(context.Background(), `
+      insert into issuer.card_pins(card_id, pvki, pvv, pvk_version) values ($1,$2,$3,nullif($4,0))
+      on conflict (card_id) do nothing
+      returning updated_at
+    `, pin.CardID, pin.PVKI, pin.PVV, pin.PVKVersion).Scan(&stored.UpdatedAt)
+    if errors.Is(err, sql.ErrNoRows) { return nil, models.ErrPINAlreadySet }
+    if err != nil { return nil, err }
+    return stored, nil
+}
+
+// ResetCardPIN stores the PVV of a card's new PIN like SetCardPIN and
+// records who reset it.
+func (r *Repository) ResetCardPIN(accountID string, pin models.CardPIN, reset models.ResetPIN) (*models.CardPIN, *models.PINReset, error) {
+    if _, err := r.GetCard(accountID, pin.CardID); err != nil {
+        return nil, nil, err
+    }
+    audit := &models.PINReset{ID: uuid.New().String(), CardID: pin.CardID, Reason: reset.Reason, Actor: reset.Actor}
+    if r.db == nil {
+        r.mu.Lock()
+        defer r.mu.Unlock()
+        stored := &models.CardPIN{CardID: pin.CardID, PVKI: pin.PVKI, PVV: pin.PVV, PVKVersion: pin.PVKVersion, UpdatedAt: time.Now().UTC()}
+        r.PINs[pin.CardID] = stored
+        audit.ResetAt = stored.UpdatedAt
+        r.PINResets = append(r.PINResets, audit)
+        copied := *stored
+        return &copied, audit, nil
+    }
+    ctx := context.Background()
+    tx, err := r.db.BeginTx(ctx, nil)
+    if err != nil { return nil, nil, err }
+    defer tx.Rollback()
+    stored := &models.CardPIN{CardID: pin.CardID, PVKI: pin.PVKI, PVV: pin.PVV, PVKVersion: pin.PVKVersion}
+    if err := tx.QueryRowContext(ctx, `
+      insert into issuer.card_pins(card_id, pvki, pvv, pvk_version) values ($1,$2,$3,nullif($4,0))
+      on conflict (card_id) do update set pvki=excluded.pvki, pvv=excluded.pvv, pvk_version=excluded.pvk_version,
+        failed_attempts=0, blocked=false, updated_at=now()
+      returning updated_at
+    `, pin.CardID, pin.PVKI, pin.PVV, pin.PVKVersion).Scan(&stored.UpdatedAt); err != nil { return nil, nil, err }
+    if err := tx.QueryRowContext(ctx, `
+      insert into issuer.card_pin_resets(reset_id, card_id, reason, actor) values ($1,$2,$3,$4)
+      returning reset_at
+    `, audit.ID, pin.CardID, reset.Reason, reset.Actor).Scan(&audit.ResetAt); err != nil { return nil, nil, err }
+    if err := tx.Commit(); err != nil { return nil, nil, err }
+    return stored, audit, nil
+}
+
+// SetCardPIN stores the PVV of a card's new PIN and clears its wrong
+// attempts, unblocking it.
+func (r *Repository) SetCardPIN(accountID string, pin models.CardPIN) (*models.CardPIN, error) {
+    if _, err := r.GetCard(accountID, pin.CardID); err != nil {
+        return nil, err
+    }
+    if r.db == nil {
+        r.mu.Lock()
+        defer r.mu.Unlock()
+        stored := &models.CardPIN{CardID: pin.CardID, PVKI: pin.PVKI, PVV: pin.PVV, PVKVersion: pin.PVKVersion, UpdatedAt: time.Now().UTC()}
+        r.PINs[pin.CardID] = stored
+        copied := *stored
+        return &copied, nil
+    }
+    stored := &models.CardPIN{CardID: pin.CardID, PVKI: pin.PVKI, PVV: pin.PVV, PVKVersion: pin.PVKVersion}
+    err := r.db.QueryRowContext(context.Background(), `
+      insert into issuer.card_pins(card_id, pvki, pvv, pvk_version) values ($1,$2,$3,nullif($4,0))
+      on conflict (card_id) do update set pvki=excluded.pvki, pvv=excluded.pvv, pvk_version=excluded.pvk_version,
+        failed_attempts=0, blocked=false, updated_at=now()
+      returning updated_at
+    `, pin.CardID, pin.PVKI, pin.PVV, pin.PVKVersion).Scan(&stored.UpdatedAt)
+    if err != nil { return nil, err }
+    return stored, nil
+}
+
+// GetCardPIN returns the PIN record of a card; ErrNotFound when it has no PIN.
+func (r *Repository) GetCardPIN(cardID string) (*models.CardPIN, error) {
+    if r.db == nil {
+        r.mu.RLock()
+        defer r.mu.RUnlock()
+        pin, ok := r.PINs[cardID]
+        if !ok { return nil, ErrNotFound }
+        copied := *pin
+        return &copied, nil
+    }
+    pin := &models.CardPIN{CardID: cardID}
+    err := r.db.QueryRowContext(context.Background(), `
+      select pvki, pvv, coalesce(pvk_version, 0), failed_attempts, blocked, updated_at from issuer.card_pins where card_id=$1
+    `, cardID).Scan(&pin.PVKI, &pin.PVV, &pin.PVKVersion, &pin.FailedAttempts, &pin.Blocked, &pin.UpdatedAt)
+    if errors.Is(err, sql.ErrNoRows) { return nil, ErrNotFound }
+    if err != nil { return nil, err }
+    return pin, nil
+}
+
+// RecordPINAttempt counts a PIN verification of the card: a correct PIN
+// clears the wrong attempts, a wrong one adds to them and blocks the PIN at
+// maxTries. A blocked PIN stays blocked either way. It returns the record
+// after the attempt.
+func (r *Repository) RecordPINAttempt(cardID string, correct bool, maxTries int) (*models.CardPIN, error) {
+    if r.db == nil {
+        r.mu.Lock()
+        defer r.mu.Unlock()
+        pin, ok := r.PINs[cardID]
+        if !ok { return nil, ErrNotFound }
+        switch {
+        case pin.Blocked:
+        case correct:
+            pin.FailedAttempts = 0
+        default:
+            pin.FailedAttempts++
+            pin.Blocked = pin.FailedAttempts >= maxTries
+        }
+        pin.UpdatedAt = time.Now().UTC()
+        copied := *pin
+        return &copied, nil
+    }
+    pin := &models.CardPIN{CardID: cardID}
+    err := r.db.QueryRowContext(context.Background(), `
+      update issuer.card_pins set
+        failed_attempts = case when blocked then failed_attempts when $2 then 0 else failed_attempts + 1 end,
+        blocked = blocked or (not $2 and failed_attempts + 1 >= $3),
+        updated_at = now()
+      where card_id=$1
+      returning pvki, pvv, failed_attempts, blocked, updated_at
+    `, cardID, correct, maxTries).Scan(&pin.PVKI, &pin.PVV, &pin.FailedAttempts, &pin.Blocked, &pin.UpdatedAt)
+    if errors.Is(err, sql.ErrNoRows) { return nil, ErrNotFound }
+    if err != nil { return nil, err }
+    return pin, nil
+}
+
+// SetCardDCVV enables or disables dynamic CVVs of a card.
+func (r *Repository) SetCardDCVV(accountID, cardID string, enabled bool) error {
+    if r.db == nil {
+        r.mu.Lock()
+        defer r.mu.Unlock()
+        for _, c := range r.Cards {
+            if c.ID == cardID && c.AccountID == accountID {
+                c.DCVVEnabled = enabled
+                return nil
+            }
+        }
+        return ErrNotFound
+    }
+    res, err := r.db.ExecContext(context.Background(), `
+      update issuer.cards set dcvv_enabled=$3 where card_id=$1 and account_id=$2
+    `, cardID, accountID, enabled)
+    if err != nil { return err }
+    n, err := res.RowsAffected()
+    if err != nil { return err }
+    if n == 0 { return ErrNotFound }
+    return nil
+}
+
+// dcvvUse is a time window of a card whose dynamic CVV was used.
+type dcvvUse struct {
+    cardID string
+    window int64
+}
+
+// ClaimDCVV records that the authorization with the given RRN uses the
+// dynamic CVV of the card's time window starting at window. It returns
+// models.ErrDCVVReplayed when another authorization already used it. A
+// repeat of the same RRN is not a replay but claims nothing: claimed is
+// false, so a decline of the repeat does not release the original's claim.
+func (r *Repository) ClaimDCVV(cardID string, window time.Time, rrn string) (claimed bool, err error) {
+    if r.db == nil {
+        r.mu.Lock()
+        defer r.mu.Unlock()
+        key := dcvvUse{cardID: cardID, window: window.Unix()}
+        if used, ok := r.dcvvUses[key]; ok {
+            if rrn != "" && used == rrn { return false, nil }
+            return false, models.ErrDCVVReplayed
+        }
+        r.dcvvUses[key] = rrn
+        return true, nil
+    }
+    ctx := context.Background()
+    res, err := r.db.ExecContext(ctx, `
+      insert into issuer.dcvv_uses(card_id, window_start, rrn) values ($1,$2,nullif($3,''))
+      on conflict (card_id, window_start) do nothing
+    `, cardID, window.UTC(), rrn)
+    if err != nil { return false, err }
+    n, err := res.RowsAffected()
+    if err != nil { return false, err }
+    if n == 1 { return true, nil }
+    var used sql.NullString
+    err = r.db.QueryRowContext(ctx, `
+      select rrn from issuer.dcvv_uses where card_id=$1 and window_start=$2
+    `, cardID, window.UTC()).Scan(&used)
+    if err != nil { return false, err }
+    if rrn != "" && used.String == rrn { return false, nil }
+    return false, models.ErrDCVVReplayed
+}
+
+// ReleaseDCVV frees the claim of a time window whose authorization was not
+// approved, so the code can still be used.
+func (r *Repository) ReleaseDCVV(cardID string, window time.Time) error {
+    if r.db == nil {
+        r.mu.Lock()
+        defer r.mu.Unlock()
+        delete(r.dcvvUses, dcvvUse{cardID: cardID, window: window.Unix()})
+        return nil
+    }
+    _, err := r.db.ExecContext(context.Background(), `
+      delete from issuer.dcvv_uses where card_id=$1 and window_start=$2
+    `, cardID, window.UTC())
+    return err
+}
+
 // ExistsCardNumber reports whether a PAN already exists.
 func (r *Repository) ExistsCardNumber(pan string) (bool, error) {
     r.mu.RLock()
@@ -132,24 +585,29 @@ func (r *Repository) ExistsCardNumber(pan string) (bool, error) {
     return ok, nil
 }
 
+// FindCardForAuthorization looks up a card by PAN. Expiry and CVV are not matched here:
+// the stored YYMM is returned so the service can tell an expired card from a wrong expiry,
+// and the CVV is never stored, so the service recomputes it.
 func (r *Repository) FindCardForAuthorization(card models.Card) (*models.Card, error) {
     if r.db == nil {
         r.mu.RLock()
         defer r.mu.RUnlock()
         for _, c := range r.Cards {
-            match := c.Number == card.Number && c.ExpirationDate == card.ExpirationDate && c.CardVerificationValue == card.CardVerificationValue
-            if match { return c, nil }
+            if c.Number == card.Number { return c, nil }
         }
         return nil, ErrNotFound
     }
-    hash := cardgen.HashPANHMAC(cardgen.NormalizePAN(card.Number), r.hashKey)
-    row := r.db.QueryRowContext(context.Background(), `SELECT card_id, account_id, last4, expiry_yymm FROM issuer.cards WHERE pan_hash=$1 AND expiry_yymm=$2`, hash, card.ExpirationDate)
-    var id, acc, last4, exp string
-    if err := row.Scan(&id, &acc, &last4, &exp); err != nil {
+    // the card may be hashed with an earlier version of the pepper
+    hashes := r.panHashes(cardgen.NormalizePAN(card.Number))
+    row := r.db.QueryRowContext(context.Background(), `SELECT card_id, account_id, last4, expiry_yymm, status, dcvv_enabled, coalesce(cvk_version, 0) FROM issuer.cards WHERE pan_hash = any($1)`, pq.Array(hashes))
+    var id, acc, last4, exp, status string
+    var dcvv bool
+    var cvkVersion int
+    if err := row.Scan(&id, &acc, &last4, &exp, &status, &dcvv, &cvkVersion); err != nil {
         if errors.Is(err, sql.ErrNoRows) { return nil, ErrNotFound }
         return nil, err
     }
-    return &models.Card{ID: id, AccountID: acc, Number: "****"+last4, ExpirationDate: exp}, nil
+    return &models.Card{ID: id, AccountID: acc, Number: "****"+last4, ExpirationDate: exp, Status: models.CardStatus(status), DCVVEnabled: dcvv, CVKVersion: cvkVersion}, nil
 }
 
 func (r *Repository) CreateTransaction(transaction *models.Transaction) error {
@@ -175,13 +633,18 @@ func (r *Repository) ListTransactions(accountID string) ([]*models.Transaction,
         }
         return transactions, nil
     }
-    rows, err := r.db.QueryContext(context.Background(), `SELECT tx_id, account_id, card_id, amount, currency, status, authorization_code FROM issuer.transactions WHERE account_id=$1 ORDER BY created_at DESC`, accountID)
+    // payments, interest and fees have no card; only online authorizations have a code
+    rows, err := r.db.QueryContext(context.Background(), `
+        SELECT tx_id, account_id, coalesce(card_id::text, ''), coalesce(auth_id::text, ''), amount, currency, status,
+               coalesce(authorization_code, ''), coalesce(description, '')
+          FROM issuer.transactions WHERE account_id=$1 ORDER BY created_at DESC
+    `, accountID)
     if err != nil { return nil, err }
     defer rows.Close()
     var out []*models.Transaction
     for rows.Next() {
         var t models.Transaction; var status string
-        if err := rows.Scan(&t.ID, &t.AccountID, &t.CardID, &t.Amount, &t.Currency, &status, &t.AuthorizationCode); err != nil { return nil, err }
+        if err := rows.Scan(&t.ID, &t.AccountID, &t.CardID, &t.AuthID, &t.Amount, &t.Currency, &status, &t.AuthorizationCode, &t.Description); err != nil { return nil, err }
         t.Status = models.TransactionStatus(status)
         out = append(out, &t)
     }
@@ -189,8 +652,12 @@ func (r *Repository) ListTransactions(accountID string) ([]*models.Transaction,
 }
 
 // CreateAuthAndHold performs atomic authorization in DB backend.
+// holdExpiresAt is stored on the auth so ReleaseExpiredHolds can return the funds later.
+// A request with an RRN is applied once per (card, terminal, RRN); repeats get the codes of the first one.
+// dailyLimit caps what the card authorizes for txType in the day starting at
+// dayStart (0 for no cap); going over it returns models.ErrLimitExceeded.
 // Returns (approvalCode, authorizationCode, dup, error). When dup is true, codes originate from existing auth.
-func (r *Repository) CreateAuthAndHold(accountID, cardID string, amount int64, currency, approvalCode, authorizationCode, merchantName, mcc string, stan *int) (string, string, bool, error) {
+func (r *Repository) CreateAuthAndHold(accountID, cardID string, req models.AuthorizationRequest, txType models.TransactionType, dailyLimit int64, dayStart time.Time, approvalCode, authorizationCode string, holdExpiresAt time.Time) (string, string, bool, error) {
     if r.db == nil {
         // Memory repo path (tests): simulate success, no idempotency
         return approvalCode, authorizationCode, false, nil
@@ -201,94 +668,212 @@ func (r *Repository) CreateAuthAndHold(accountID, cardID string, amount int64, c
     // set per-transaction statement timeout to avoid long hangs
     if _, err := tx.ExecContext(context.Background(), `set local statement_timeout = '3s'`); err != nil { return "", "", false, err }
 
-    // If STAN is provided, try insert-first with ON CONFLICT DO NOTHING
-    if stan != nil {
-        var insertedID string
+    // If RRN is provided, try insert-first with ON CONFLICT DO NOTHING
+    var insertedID string
+    if req.RRN != "" {
         // Try insert authorized auth; if conflict, SELECT existing
         row := tx.QueryRowContext(context.Background(), `
           insert into issuer.auths(auth_id, account_id, card_id, amount, currency, status,
-                                   approval_code, authorization_code, merchant_name, mcc, stan)
-          values(gen_random_uuid(), $1,$2,$3,$4,'AUTHORIZED',$5,$6,$7,$8,$9)
-          on conflict (card_id, stan) where stan is not null do nothing
+                                   approval_code, authorization_code, merchant_name, mcc, stan, hold_expires_at,
+                                   terminal_id, card_acceptor_id, rrn, transmitted_at, transaction_type, processing_code)
+          values(gen_random_uuid(), $1,$2,$3,$4,'AUTHORIZED',$5,$6,$7,$8,$9,$10,$11,nullif($12,''),$13,$14,$15,nullif($16,''))
+          on conflict (card_id, terminal_id, rrn) where rrn is not null do nothing
           returning auth_id
-        `, accountID, cardID, amount, strings.ToUpper(currency), approvalCode, authorizationCode, merchantName, mcc, *stan)
+        `, accountID, cardID, req.Amount, strings.ToUpper(req.Currency), approvalCode, authorizationCode, req.Merchant.Name, req.Merchant.MCC, req.STAN, holdExpiresAt,
+            req.Merchant.TerminalID, req.Merchant.CardAcceptorID, req.RRN, nullTime(req.TransmittedAt), string(txType), req.ProcessingCode)
         _ = row.Scan(&insertedID)
         if insertedID == "" {
             // duplicate: fetch existing and validate semantics
             var existedAmount int64
             var existedCurr, existedAppr, existedAuth string
             if err := tx.QueryRowContext(context.Background(), `
-                select amount, currency, approval_code, authorization_code from issuer.auths where card_id=$1 and stan=$2
-            `, cardID, *stan).Scan(&existedAmount, &existedCurr, &existedAppr, &existedAuth); err != nil {
+                select amount, currency, approval_code, authorization_code from issuer.auths where card_id=$1 and terminal_id=$2 and rrn=$3
+            `, cardID, req.Merchant.TerminalID, req.RRN).Scan(&existedAmount, &existedCurr, &existedAppr, &existedAuth); err != nil {
                 return "", "", false, err
             }
-            if existedAmount != amount || strings.ToUpper(existedCurr) != strings.ToUpper(currency) {
+            if existedAmount != req.Amount || strings.ToUpper(existedCurr) != strings.ToUpper(req.Currency) {
                 return "", "", false, fmt.Errorf("%w", models.ErrInsufficientFunds) // semantic mismatch; could be dedicated error
             }
             if err := tx.Commit(); err != nil { return "", "", false, err }
             return existedAppr, existedAuth, true, nil
         }
-        // On fresh insert with STAN, proceed to adjust balances
+        // On fresh insert with RRN, proceed to adjust balances
     }
 
-    res, err := tx.ExecContext(context.Background(), `
-        UPDATE issuer.accounts
-           SET available_balance = available_balance - $2,
-               hold_balance      = hold_balance      + $2,
-               updated_at        = now()
-         WHERE account_id=$1 AND available_balance >= $2
-    `, accountID, amount)
-    if err != nil { return "", "", false, err }
-    if rows, _ := res.RowsAffected(); rows == 0 {
+    // the account row lock serializes holds on the account; credit accounts
+    // may spend up to their limit (open-to-buy)
+    var currency string
+    var available, creditLimit int64
+    err = tx.QueryRowContext(context.Background(), `
+        SELECT currency, available_balance, credit_limit FROM issuer.accounts WHERE account_id=$1 FOR UPDATE
+    `, accountID).Scan(&currency, &available, &creditLimit)
+    if errors.Is(err, sql.ErrNoRows) || (err == nil && available+creditLimit < req.Amount) {
         return "", "", false, models.ErrInsufficientFunds
     }
-    if stan == nil {
-        _, err = tx.ExecContext(context.Background(), `
-            INSERT INTO issuer.auths(auth_id, account_id, card_id, amount, currency, status, approval_code, authorization_code, merchant_name, mcc)
-            VALUES (gen_random_uuid(), $1,$2,$3,$4,'AUTHORIZED',$5,$6,$7,$8)
-        `, accountID, cardID, amount, strings.ToUpper(currency), approvalCode, authorizationCode, merchantName, mcc)
+    if err != nil { return "", "", false, err }
+    // the day's authorizations of the type, without the one just inserted
+    if dailyLimit > 0 {
+        var today int64
+        if err := tx.QueryRowContext(context.Background(), `
+            SELECT coalesce(sum(amount), 0) FROM issuer.auths
+             WHERE card_id=$1 AND transaction_type=$2 AND status IN ('AUTHORIZED','CAPTURED')
+               AND created_at >= $4 AND auth_id IS DISTINCT FROM nullif($3,'')::uuid
+        `, cardID, string(txType), insertedID, dayStart).Scan(&today); err != nil { return "", "", false, err }
+        if today+req.Amount > dailyLimit { return "", "", false, models.ErrLimitExceeded }
+    }
+    if req.RRN == "" {
+        err = tx.QueryRowContext(context.Background(), `
+            INSERT INTO issuer.auths(auth_id, account_id, card_id, amount, currency, status, approval_code, authorization_code, merchant_name, mcc, stan, hold_expires_at, terminal_id, card_acceptor_id, transmitted_at, transaction_type, processing_code)
+            VALUES (gen_random_uuid(), $1,$2,$3,$4,'AUTHORIZED',$5,$6,$7,$8,$9,$10,$11,nullif($12,''),$13,$14,nullif($15,''))
+            RETURNING auth_id
+        `, accountID, cardID, req.Amount, strings.ToUpper(req.Currency), approvalCode, authorizationCode, req.Merchant.Name, req.Merchant.MCC, req.STAN, holdExpiresAt,
+            req.Merchant.TerminalID, req.Merchant.CardAcceptorID, nullTime(req.TransmittedAt), string(txType), req.ProcessingCode).Scan(&insertedID)
         if err != nil { return "", "", false, err }
     }
+    hold := &models.Journal{Kind: models.JournalHold, AccountID: accountID, AuthID: insertedID, Currency: currency,
+        Postings: models.Transfer(models.CustomerAvailable(accountID, currency), models.CustomerHold(accountID, currency), req.Amount)}
+    if err := r.postJournal(context.Background(), tx, hold); err != nil { return "", "", false, err }
     if err := tx.Commit(); err != nil { return "", "", false, err }
     return approvalCode, authorizationCode, false, nil
 }
 
-// CaptureAuth moves funds from hold to transactions; minimal full capture path.
-func (r *Repository) CaptureAuth(ctx context.Context, authID string, amount int64, currency string) error {
+// CreateAdvisedAuth records an authorization approved offline by the acquirer
+// and holds its amount. It returns true when the advice was already applied,
+// which advices are recognized by (card, terminal, RRN).
+// An advice cannot be declined: when the available balance does not cover it,
+// or it is in another currency than the account's, the auth is stored as
+// EXCEPTION without a hold and left for manual handling.
+func (r *Repository) CreateAdvisedAuth(ctx context.Context, accountID, cardID string, req models.AuthorizationRequest, txType models.TransactionType, authorizationCode string, holdExpiresAt time.Time) (bool, error) {
+    if r.db == nil { return false, fmt.Errorf("not supported in memory repo") }
+    tx, err := r.db.BeginTx(ctx, nil)
+    if err != nil { return false, err }
+    defer tx.Rollback()
+    if _, err := tx.ExecContext(ctx, "set local statement_timeout = '3s'"); err != nil { return false, err }
+
+    var currency string
+    var available, creditLimit int64
+    if err := tx.QueryRowContext(ctx, `
+      select currency, available_balance, credit_limit from issuer.accounts where account_id=$1 for update
+    `, accountID).Scan(&currency, &available, &creditLimit); err != nil { return false, err }
+    status := "AUTHORIZED"
+    if available+creditLimit < req.Amount || !strings.EqualFold(currency, req.Currency) { status = "EXCEPTION" }
+
+    var authID string
+    err = tx.QueryRowContext(ctx, `
+      insert into issuer.auths(auth_id, account_id, card_id, amount, currency, status,
+                               approval_code, authorization_code, merchant_name, mcc, stan, hold_expires_at,
+                               terminal_id, card_acceptor_id, rrn, transmitted_at, transaction_type, processing_code)
+      values(gen_random_uuid(), $1,$2,$3,$4,$5,$6,$7,$8,$9,$10,$11,$12,nullif($13,''),$14,$15,$16,nullif($17,''))
+      on conflict (card_id, terminal_id, rrn) where rrn is not null do nothing
+      returning auth_id
+    `, accountID, cardID, req.Amount, strings.ToUpper(req.Currency), status, models.ApprovalCodeApproved, authorizationCode, req.Merchant.Name, req.Merchant.MCC, req.STAN, holdExpiresAt,
+        req.Merchant.TerminalID, req.Merchant.CardAcceptorID, req.RRN, nullTime(req.TransmittedAt), string(txType), req.ProcessingCode).Scan(&authID)
+    if err == sql.ErrNoRows {
+        // repeated advice: the first one took the hold
+        return true, nil
+    }
+    if err != nil { return false, err }
+    if status == "AUTHORIZED" {
+        hold := &models.Journal{Kind: models.JournalHold, AccountID: accountID, AuthID: authID, Currency: currency,
+            Postings: models.Transfer(models.CustomerAvailable(accountID, currency), models.CustomerHold(accountID, currency), req.Amount)}
+        if err := r.postJournal(ctx, tx, hold); err != nil { return false, err }
+    }
+    return false, tx.Commit()
+}
+
+// CaptureAuth moves funds from hold to transactions. A capture may be partial;
+// the authorization stays AUTHORIZED until its whole amount is captured.
+// amount <= 0 captures whatever is left. stan is the one of the capture
+// message (0 without one); clearing matches the presentment by it.
+// The fee rules matching the capture are charged with it, booked to businessDate.
+func (r *Repository) CaptureAuth(ctx context.Context, authID string, amount int64, currency string, stan int, fees []models.FeeRule, businessDate time.Time) error {
     if r.db == nil { return fmt.Errorf("not supported in memory repo") }
     tx, err := r.db.BeginTx(ctx, nil)
     if err != nil { return err }
     defer tx.Rollback()
     if _, err := tx.ExecContext(ctx, "set local statement_timeout = '3s'"); err != nil { return err }
 
-    var accountID, cardID, curr, status string
-    var authAmount int64
+    var accountID, cardID, curr, status, txType, mcc, accountCurrency string
+    var authAmount, captured int64
     err = tx.QueryRowContext(ctx, `
-      select account_id, card_id, amount, currency, status from issuer.auths where auth_id=$1 for update
-    `, authID).Scan(&accountID, &cardID, &authAmount, &curr, &status)
-    if err == sql.ErrNoRows { return fmt.Errorf("auth not found") }
+      select a.account_id, a.card_id, a.amount, a.currency, a.status, a.transaction_type, coalesce(a.mcc, ''), acc.currency,
+             coalesce((select sum(t.amount) from issuer.transactions t
+                        where t.auth_id=a.auth_id and t.status='CAPTURED'), 0)
+        from issuer.auths a join issuer.accounts acc on acc.account_id = a.account_id
+       where a.auth_id=$1 for update of a
+    `, authID).Scan(&accountID, &cardID, &authAmount, &curr, &status, &txType, &mcc, &accountCurrency, &captured)
+    if err == sql.ErrNoRows { return models.ErrAuthorizationNotFound }
     if err != nil { return err }
-    if status != "AUTHORIZED" { return fmt.Errorf("bad auth status: %s", status) }
-    if strings.ToUpper(curr) != strings.ToUpper(currency) { return fmt.Errorf("currency mismatch") }
-    if amount <= 0 { amount = authAmount }
-    if amount > authAmount { return fmt.Errorf("invalid capture amount") }
-
-    if _, err := tx.ExecContext(ctx, `
-      update issuer.accounts set hold_balance = hold_balance - $2, updated_at=now() where account_id=$1
-    `, accountID, amount); err != nil { return err }
+    if status != "AUTHORIZED" { return fmt.Errorf("auth is %s: %w", status, models.ErrInvalidAuthorizationStatus) }
+    if strings.ToUpper(curr) != strings.ToUpper(currency) { return fmt.Errorf("currency mismatch: %w", models.ErrInvalidAmount) }
+    remaining := authAmount - captured
+    if amount <= 0 { amount = remaining }
+    if amount > remaining { return fmt.Errorf("capture of %d exceeds remaining %d: %w", amount, remaining, models.ErrInvalidAmount) }
 
-    if _, err := tx.ExecContext(ctx, `
-      insert into issuer.transactions(tx_id, account_id, card_id, auth_id, amount, currency, status, posted_at)
-      values (gen_random_uuid(), $1,$2,$3,$4,$5,'CAPTURED', now())
-    `, accountID, cardID, authID, amount, strings.ToUpper(currency)); err != nil { return err }
+    var txID string
+    currency = strings.ToUpper(currency)
+    if err := tx.QueryRowContext(ctx, `
+      insert into issuer.transactions(tx_id, account_id, card_id, auth_id, amount, currency, status, stan, posted_at)
+      values (gen_random_uuid(), $1,$2,$3,$4,$5,'CAPTURED', nullif($6, 0), now())
+      returning tx_id
+    `, accountID, cardID, authID, amount, currency, stan).Scan(&txID); err != nil { return err }
+    capture := &models.Journal{Kind: models.JournalCapture, AccountID: accountID, AuthID: authID, TxID: txID, Currency: currency,
+        Postings: models.Transfer(models.CustomerHold(accountID, currency), models.Settlement(currency), amount)}
+    if err := r.postJournal(ctx, tx, capture); err != nil { return err }
+    quote := models.QuoteFees(fees, models.FeeRequest{Type: models.TransactionType(txType), MCC: mcc, Amount: amount,
+        Currency: currency, AccountCurrency: accountCurrency})
+    if _, err := r.chargeFees(ctx, tx, accountID, cardID, authID, stan, quote, businessDate); err != nil { return err }
 
     newStatus := "CAPTURED"
-    if amount < authAmount { newStatus = "AUTHORIZED" }
+    if amount < remaining { newStatus = "AUTHORIZED" }
     if _, err := tx.ExecContext(ctx, `update issuer.auths set status=$2 where auth_id=$1`, authID, newStatus); err != nil { return err }
     return tx.Commit()
 }
 
+// RefundAuth credits back captured funds of an authorization. Refunds are
+// stored as negative REFUNDED transactions linked to the auth, so together
+// they never exceed what was captured. amount <= 0 refunds whatever is left.
+func (r *Repository) RefundAuth(ctx context.Context, authID string, amount int64, currency string, stan int) error {
+    if r.db == nil { return fmt.Errorf("not supported in memory repo") }
+    tx, err := r.db.BeginTx(ctx, nil)
+    if err != nil { return err }
+    defer tx.Rollback()
+    if _, err := tx.ExecContext(ctx, "set local statement_timeout = '3s'"); err != nil { return err }
+
+    var accountID, cardID, curr string
+    var captured, refunded int64
+    err = tx.QueryRowContext(ctx, `
+      select a.account_id, a.card_id, a.currency,
+             coalesce((select sum(t.amount) from issuer.transactions t
+                        where t.auth_id=a.auth_id and t.status='CAPTURED'), 0),
+             coalesce((select -sum(t.amount) from issuer.transactions t
+                        where t.auth_id=a.auth_id and t.status='REFUNDED'), 0)
+        from issuer.auths a where a.auth_id=$1 for update of a
+    `, authID).Scan(&accountID, &cardID, &curr, &captured, &refunded)
+    if err == sql.ErrNoRows { return models.ErrAuthorizationNotFound }
+    if err != nil { return err }
+    if captured == 0 { return fmt.Errorf("nothing captured: %w", models.ErrInvalidAuthorizationStatus) }
+    if strings.ToUpper(curr) != strings.ToUpper(currency) { return fmt.Errorf("currency mismatch: %w", models.ErrInvalidAmount) }
+    refundable := captured - refunded
+    if amount <= 0 { amount = refundable }
+    if amount <= 0 || amount > refundable { return fmt.Errorf("refund of %d exceeds refundable %d: %w", amount, refundable, models.ErrInvalidAmount) }
+
+    var txID string
+    currency = strings.ToUpper(currency)
+    if err := tx.QueryRowContext(ctx, `
+      insert into issuer.transactions(tx_id, account_id, card_id, auth_id, amount, currency, status, stan, posted_at)
+      values (gen_random_uuid(), $1,$2,$3,$4,$5,'REFUNDED', nullif($6, 0), now())
+      returning tx_id
+    `, accountID, cardID, authID, -amount, currency, stan).Scan(&txID); err != nil { return err }
+    refund := &models.Journal{Kind: models.JournalRefund, AccountID: accountID, AuthID: authID, TxID: txID, Currency: currency,
+        Postings: models.Transfer(models.Settlement(currency), models.CustomerAvailable(accountID, currency), amount)}
+    if err := r.postJournal(ctx, tx, refund); err != nil { return err }
+    return tx.Commit()
+}
+
 // ReleaseExpiredHolds releases expired authorized holds in batches, returns count released.
+// Rows locked by another instance are skipped, so several sweepers can run concurrently.
+// Only the part of a hold that was not captured yet is returned to the available balance.
 func (r *Repository) ReleaseExpiredHolds(ctx context.Context, batch int) (int, error) {
     if r.db == nil { return 0, fmt.Errorf("not supported in memory repo") }
     tx, err := r.db.BeginTx(ctx, nil)
@@ -296,29 +881,30 @@ func (r *Repository) ReleaseExpiredHolds(ctx context.Context, batch int) (int, e
     defer tx.Rollback()
     if _, err := tx.ExecContext(ctx, "set local statement_timeout = '5s'"); err != nil { return 0, err }
     rows, err := tx.QueryContext(ctx, `
-      select auth_id, account_id, amount from issuer.auths
-       where status='AUTHORIZED' and hold_expires_at <= now()
-       order by hold_expires_at asc
-       limit $1 for update skip locked
+      select a.auth_id, a.account_id, a.currency,
+             a.amount - coalesce((select sum(t.amount) from issuer.transactions t
+                                   where t.auth_id=a.auth_id and t.status='CAPTURED'), 0)
+        from issuer.auths a
+       where a.status='AUTHORIZED' and a.hold_expires_at <= now()
+       order by a.hold_expires_at asc
+       limit $1 for update of a skip locked
     `, batch)
     if err != nil { return 0, err }
     defer rows.Close()
-    type item struct{ AuthID, AccountID string; Amount int64 }
+    type item struct{ AuthID, AccountID, Currency string; Amount int64 }
     var list []item
     for rows.Next() {
         var it item
-        if err := rows.Scan(&it.AuthID, &it.AccountID, &it.Amount); err != nil { return 0, err }
+        if err := rows.Scan(&it.AuthID, &it.AccountID, &it.Currency, &it.Amount); err != nil { return 0, err }
         list = append(list, it)
     }
     if err := rows.Err(); err != nil { return 0, err }
     if len(list) == 0 { _ = tx.Commit(); return 0, nil }
-    agg := map[string]int64{}
-    for _, it := range list { agg[it.AccountID] += it.Amount }
-    for acc, sum := range agg {
-        if _, err := tx.ExecContext(ctx, `update issuer.accounts set hold_balance = hold_balance - $2, updated_at=now() where account_id=$1`, acc, sum); err != nil { return 0, err }
-    }
-    // mark auths reversed
+    // one release journal per auth, then mark it reversed
     for _, it := range list {
+        release := &models.Journal{Kind: models.JournalRelease, AccountID: it.AccountID, AuthID: it.AuthID, Currency: it.Currency,
+            Postings: models.Transfer(models.CustomerHold(it.AccountID, it.Currency), models.CustomerAvailable(it.AccountID, it.Currency), it.Amount)}
+        if err := r.postJournal(ctx, tx, release); err != nil { return 0, err }
         if _, err := tx.ExecContext(ctx, `update issuer.auths set status='REVERSED' where auth_id=$1`, it.AuthID); err != nil { return 0, err }
     }
     if err := tx.Commit(); err != nil { return 0, err }
@@ -326,31 +912,883 @@ func (r *Repository) ReleaseExpiredHolds(ctx context.Context, batch int) (int, e
 }
 
 // ReverseAuth reverses a single authorized hold (manual release for one auth).
+// Reversing a REVERSED auth is a no-op and an EXCEPTION one has no hold to
+// release; a captured or refunded one returns models.ErrNothingToReverse.
 func (r *Repository) ReverseAuth(ctx context.Context, authID string) error {
     if r.db == nil { return fmt.Errorf("not supported in memory repo") }
     tx, err := r.db.BeginTx(ctx, nil)
     if err != nil { return err }
     defer tx.Rollback()
     if _, err := tx.ExecContext(ctx, "set local statement_timeout = '3s'"); err != nil { return err }
-    var accountID string
-    var amount int64
+    var accountID, currency string
+    var remaining int64
     var status string
-    if err := tx.QueryRowContext(ctx, `select account_id, amount, status from issuer.auths where auth_id=$1 for update`, authID).Scan(&accountID, &amount, &status); err != nil {
+    // only the part of the hold that was not captured yet is released
+    if err := tx.QueryRowContext(ctx, `
+      select a.account_id, a.currency,
+             a.amount - coalesce((select sum(t.amount) from issuer.transactions t
+                                   where t.auth_id=a.auth_id and t.status='CAPTURED'), 0),
+             a.status
+        from issuer.auths a where a.auth_id=$1 for update of a
+    `, authID).Scan(&accountID, &currency, &remaining, &status); err != nil {
         return err
     }
-    if status != "AUTHORIZED" { return fmt.Errorf("bad auth status: %s", status) }
-    if _, err := tx.ExecContext(ctx, `update issuer.accounts set hold_balance = hold_balance - $2, updated_at=now() where account_id=$1`, accountID, amount); err != nil { return err }
+    switch status {
+    case "REVERSED":
+        return nil
+    case "EXCEPTION":
+        // the advice the balance did not cover took no hold
+        if _, err := tx.ExecContext(ctx, `update issuer.auths set status='REVERSED' where auth_id=$1`, authID); err != nil { return err }
+        return tx.Commit()
+    case "AUTHORIZED":
+    default:
+        return fmt.Errorf("auth is %s: %w", status, models.ErrNothingToReverse)
+    }
+    reversal := &models.Journal{Kind: models.JournalReversal, AccountID: accountID, AuthID: authID, Currency: currency,
+        Postings: models.Transfer(models.CustomerHold(accountID, currency), models.CustomerAvailable(accountID, currency), remaining)}
+    if err := r.postJournal(ctx, tx, reversal); err != nil { return err }
     if _, err := tx.ExecContext(ctx, `update issuer.auths set status='REVERSED' where auth_id=$1`, authID); err != nil { return err }
     return tx.Commit()
 }
 
-// FindAuthByCardStan returns auth id and details for (card_id, stan).
-func (r *Repository) FindAuthByCardStan(ctx context.Context, cardID string, stan int) (authID string, amount int64, currency string, status string, err error) {
+// ReverseFinancial reverses the capture or refund of an authorization sent
+// with stan, which the acquirer could not confirm. A capture goes back on
+// hold, or to the available balance once the authorization no longer holds
+// anything, and the fees charged with it are given back; a refund is debited
+// again. Reversing one that was reversed already is a no-op; one that never
+// arrived returns models.ErrNothingToReverse.
+func (r *Repository) ReverseFinancial(ctx context.Context, authID string, stan int) error {
+    if r.db == nil { return fmt.Errorf("not supported in memory repo") }
+    tx, err := r.db.BeginTx(ctx, nil)
+    if err != nil { return err }
+    defer tx.Rollback()
+    if _, err := tx.ExecContext(ctx, "set local statement_timeout = '3s'"); err != nil { return err }
+
+    var accountID, authStatus string
+    err = tx.QueryRowContext(ctx, `select account_id, status from issuer.auths where auth_id=$1 for update`, authID).Scan(&accountID, &authStatus)
+    if err == sql.ErrNoRows { return models.ErrAuthorizationNotFound }
+    if err != nil { return err }
+
+    var txID, status, currency string
+    var amount int64
+    err = tx.QueryRowContext(ctx, `
+      select tx_id, status, amount, currency from issuer.transactions
+       where auth_id=$1 and stan=$2 and status in ('CAPTURED','REFUNDED','REVERSED')
+       order by created_at desc limit 1
+    `, authID, stan).Scan(&txID, &status, &amount, &currency)
+    if err == sql.ErrNoRows { return fmt.Errorf("no capture or refund with STAN %d: %w", stan, models.ErrNothingToReverse) }
+    if err != nil { return err }
+
+    reversal := &models.Journal{Kind: models.JournalReversal, AccountID: accountID, AuthID: authID, TxID: txID, Currency: currency}
+    switch status {
+    case "REVERSED":
+        return nil
+    case "CAPTURED":
+        to := models.CustomerHold(accountID, currency)
+        if authStatus != "AUTHORIZED" && authStatus != "CAPTURED" { to = models.CustomerAvailable(accountID, currency) }
+        reversal.Postings = models.Transfer(models.Settlement(currency), to, amount)
+        if err := r.reverseFees(ctx, tx, accountID, authID, stan); err != nil { return err }
+        if authStatus == "CAPTURED" {
+            if _, err := tx.ExecContext(ctx, `update issuer.auths set status='AUTHORIZED' where auth_id=$1`, authID); err != nil { return err }
+        }
+    case "REFUNDED":
+        reversal.Postings = models.Transfer(models.CustomerAvailable(accountID, currency), models.Settlement(currency), -amount)
+    }
+    if err := r.postJournal(ctx, tx, reversal); err != nil { return err }
+    if _, err := tx.ExecContext(ctx, `update issuer.transactions set status='REVERSED' where tx_id=$1`, txID); err != nil { return err }
+    return tx.Commit()
+}
+
+// reverseFees gives back the fees charged with the capture of an
+// authorization sent with stan.
+func (r *Repository) reverseFees(ctx context.Context, tx *sql.Tx, accountID, authID string, stan int) error {
+    rows, err := tx.QueryContext(ctx, `
+      select tx_id, amount, currency from issuer.transactions
+       where auth_id=$1 and stan=$2 and status='FEE'
+    `, authID, stan)
+    if err != nil { return err }
+    defer rows.Close()
+    var fees []*models.Journal
+    for rows.Next() {
+        var txID, currency string
+        var amount int64
+        if err := rows.Scan(&txID, &amount, &currency); err != nil { return err }
+        fees = append(fees, &models.Journal{Kind: models.JournalReversal, AccountID: accountID, AuthID: authID, TxID: txID, Currency: currency,
+            Postings: models.Transfer(models.Fees(currency), models.CustomerAvailable(accountID, currency), amount)})
+    }
+    if err := rows.Err(); err != nil { return err }
+    for _, fee := range fees {
+        if err := r.postJournal(ctx, tx, fee); err != nil { return err }
+        if _, err := tx.ExecContext(ctx, `update issuer.transactions set status='REVERSED' where tx_id=$1`, fee.TxID); err != nil { return err }
+    }
+    return nil
+}
+
+// FindOriginalAuth returns auth id and details of the authorization a
+// follow-up refers to: by (card_id, terminal_id, rrn), or by the STAN and
+// transmission date and time of the original data elements without an RRN.
+func (r *Repository) FindOriginalAuth(ctx context.Context, cardID string, original models.OriginalTransaction) (authID string, amount int64, currency string, status string, err error) {
     if r.db == nil { return "", 0, "", "", fmt.Errorf("not supported in memory repo") }
-    err = r.db.QueryRowContext(ctx, `select auth_id, amount, currency, status from issuer.auths where card_id=$1 and stan=$2`, cardID, stan).Scan(&authID, &amount, &currency, &status)
+    if original.RRN != "" {
+        err = r.db.QueryRowContext(ctx, `
+          select auth_id, amount, currency, status from issuer.auths where card_id=$1 and terminal_id=$2 and rrn=$3
+        `, cardID, original.TerminalID, original.RRN).Scan(&authID, &amount, &currency, &status)
+        return
+    }
+    if original.STAN == 0 || original.TransmittedAt.IsZero() { return "", 0, "", "", sql.ErrNoRows }
+    err = r.db.QueryRowContext(ctx, `
+      select auth_id, amount, currency, status from issuer.auths
+       where card_id=$1 and terminal_id=$2 and stan=$3 and transmitted_at=$4
+       order by created_at desc limit 1
+    `, cardID, original.TerminalID, original.STAN, original.TransmittedAt).Scan(&authID, &amount, &currency, &status)
     return
 }
 
+// PostClearingRecord applies a record of a clearing file in one transaction;
+// card is nil when the PAN is unknown. A record is applied once by its
+// reference, repeats return ClearingResultDuplicate.
+//
+// A presentment that was captured online (same auth and STAN) is only
+// matched. Otherwise it is taken from the hold of its authorization, and
+// whatever the hold does not cover is force-posted against the available
+// balance, even without an authorization. Refunds are only posted against
+// what was captured. The reason explains force-posted and rejected records.
+// The fee rules matching a posted presentment are charged with it, booked
+// to businessDate; matched ones were charged by their capture.
+func (r *Repository) PostClearingRecord(ctx context.Context, card *models.Card, rec models.ClearingRecord, fees []models.FeeRule, businessDate time.Time) (models.ClearingResult, string, error) {
+    if r.db == nil { return "", "", fmt.Errorf("not supported in memory repo") }
+    tx, err := r.db.BeginTx(ctx, nil)
+    if err != nil { return "", "", err }
+    defer tx.Rollback()
+    if _, err := tx.ExecContext(ctx, "set local statement_timeout = '3s'"); err != nil { return "", "", err }
+
+    var seen bool
+    if err := tx.QueryRowContext(ctx, `select exists(select 1 from issuer.clearing_records where reference=$1)`, rec.Reference).Scan(&seen); err != nil { return "", "", err }
+    if seen { return models.ClearingResultDuplicate, "", nil }
+
+    currency := strings.ToUpper(rec.Currency)
+    code := "05"
+    if rec.Refund { code = "06" }
+    var cardID, authID, txID sql.NullString
+    result, reason := models.ClearingResultRejected, ""
+
+    // record stores the outcome; a concurrent ingestion of the same record
+    // loses on the primary key and rolls back
+    record := func() (models.ClearingResult, string, error) {
+        _, err := tx.ExecContext(ctx, `
+          insert into issuer.clearing_records(reference, file_id, batch_id, code, card_id, auth_id, tx_id, amount, currency, result, reason)
+          values ($1,$2,$3,$4,$5,$6,$7,$8,$9,$10,nullif($11,''))
+        `, rec.Reference, rec.FileID, rec.BatchID, code, cardID, authID, txID, rec.Amount, currency, string(result), reason)
+        if isUniqueViolation(err) { return models.ClearingResultDuplicate, "", nil }
+        if err != nil { return "", "", err }
+        return result, reason, tx.Commit()
+    }
+
+    if card == nil {
+        reason = "unknown card"
+        return record()
+    }
+    cardID = sql.NullString{String: card.ID, Valid: true}
+
+    var accountCurrency string
+    if err := tx.QueryRowContext(ctx, `select currency from issuer.accounts where account_id=$1 for update`, card.AccountID).Scan(&accountCurrency); err != nil { return "", "", err }
+    if strings.ToUpper(accountCurrency) != currency {
+        reason = fmt.Sprintf("currency %s does not match account currency %s", currency, accountCurrency)
+        return record()
+    }
+
+    var authAmount, captured, refunded int64
+    var authCurrency, status, mcc string
+    txType := string(models.TransactionTypePurchase)
+    if rec.RRN != "" {
+        err = tx.QueryRowContext(ctx, `
+          select a.auth_id, a.amount, a.currency, a.status, a.transaction_type, coalesce(a.mcc, ''),
+                 coalesce((select sum(t.amount) from issuer.transactions t
+                            where t.auth_id=a.auth_id and t.status='CAPTURED'), 0),
+                 coalesce((select -sum(t.amount) from issuer.transactions t
+                            where t.auth_id=a.auth_id and t.status='REFUNDED'), 0)
+            from issuer.auths a
+           where a.card_id=$1 and a.terminal_id=$2 and a.rrn=$3
+             for update of a
+        `, card.ID, rec.TerminalID, rec.RRN).Scan(&authID, &authAmount, &authCurrency, &status, &txType, &mcc, &captured, &refunded)
+        if err != nil && !errors.Is(err, sql.ErrNoRows) { return "", "", err }
+    }
+
+    txStatus := "CAPTURED"
+    if rec.Refund { txStatus = "REFUNDED" }
+
+    // the capture or refund message may have posted the record online already
+    if authID.Valid && rec.STAN != 0 {
+        err := tx.QueryRowContext(ctx, `
+          update issuer.transactions set clearing_reference=$4
+           where tx_id = (select tx_id from issuer.transactions
+                           where auth_id=$1 and status=$2 and stan=$3 and clearing_reference is null
+                           order by created_at limit 1 for update)
+          returning tx_id
+        `, authID, txStatus, rec.STAN, rec.Reference).Scan(&txID)
+        if err == nil {
+            result = models.ClearingResultMatched
+            return record()
+        }
+        if !errors.Is(err, sql.ErrNoRows) { return "", "", err }
+    }
+
+    if rec.Refund {
+        switch {
+        case !authID.Valid:
+            reason = "no matching authorization"
+        case strings.ToUpper(authCurrency) != currency:
+            reason = fmt.Sprintf("currency %s does not match authorization currency %s", currency, authCurrency)
+        case rec.Amount > captured-refunded:
+            reason = fmt.Sprintf("refund of %d exceeds refundable %d", rec.Amount, captured-refunded)
+        }
+        if reason != "" { return record() }
+
+        if err := tx.QueryRowContext(ctx, `
+          insert into issuer.transactions(tx_id, account_id, card_id, auth_id, amount, currency, status, stan, clearing_reference, posted_at)
+          values (gen_random_uuid(), $1,$2,$3,$4,$5,'REFUNDED', nullif($6, 0), $7, now())
+          returning tx_id
+        `, card.AccountID, card.ID, authID, -rec.Amount, currency, rec.STAN, rec.Reference).Scan(&txID); err != nil { return "", "", err }
+        refund := &models.Journal{Kind: models.JournalRefund, AccountID: card.AccountID, AuthID: authID.String, TxID: txID.String, Currency: currency,
+            Postings: models.Transfer(models.Settlement(currency), models.CustomerAvailable(card.AccountID, currency), rec.Amount)}
+        if err := r.postJournal(ctx, tx, refund); err != nil { return "", "", err }
+        result = models.ClearingResultPosted
+        return record()
+    }
+
+    // take what the hold covers, force-post the rest
+    var fromHold int64
+    remaining := authAmount - captured
+    switch {
+    case !authID.Valid:
+        reason = "no matching authorization"
+    case status != "AUTHORIZED":
+        reason = fmt.Sprintf("authorization is %s", status)
+    case strings.ToUpper(authCurrency) != currency:
+        reason = fmt.Sprintf("currency %s does not match authorization currency %s", currency, authCurrency)
+    case rec.Amount > remaining:
+        fromHold = remaining
+        reason = fmt.Sprintf("amount exceeds the authorization by %d", rec.Amount-remaining)
+    default:
+        fromHold = rec.Amount
+    }
+
+    if err := tx.QueryRowContext(ctx, `
+      insert into issuer.transactions(tx_id, account_id, card_id, auth_id, amount, currency, status, stan, clearing_reference, posted_at)
+      values (gen_random_uuid(), $1,$2,$3,$4,$5,'CAPTURED', nullif($6, 0), $7, now())
+      returning tx_id
+    `, card.AccountID, card.ID, authID, rec.Amount, currency, rec.STAN, rec.Reference).Scan(&txID); err != nil { return "", "", err }
+    presentment := &models.Journal{Kind: models.JournalCapture, AccountID: card.AccountID, AuthID: authID.String, TxID: txID.String, Currency: currency}
+    if fromHold < rec.Amount { presentment.Kind = models.JournalForcePost }
+    presentment.Postings = append(models.Transfer(models.CustomerHold(card.AccountID, currency), models.Settlement(currency), fromHold),
+        models.Transfer(models.CustomerAvailable(card.AccountID, currency), models.Settlement(currency), rec.Amount-fromHold)...)
+    if err := r.postJournal(ctx, tx, presentment); err != nil { return "", "", err }
+    quote := models.QuoteFees(fees, models.FeeRequest{Type: models.TransactionType(txType), MCC: mcc, Amount: rec.Amount,
+        Currency: currency, AccountCurrency: accountCurrency})
+    if _, err := r.chargeFees(ctx, tx, card.AccountID, card.ID, authID.String, rec.STAN, quote, businessDate); err != nil { return "", "", err }
+    if authID.Valid && status == "AUTHORIZED" && fromHold == remaining {
+        if _, err := tx.ExecContext(ctx, `update issuer.auths set status='CAPTURED' where auth_id=$1`, authID); err != nil { return "", "", err }
+    }
+
+    result = models.ClearingResultPosted
+    if reason != "" { result = models.ClearingResultForcePosted }
+    return record()
+}
+
+// CreateDispute disputes a posted purchase of the account and credits the
+// disputed amount provisionally, in one transaction. dispute.Amount of 0
+// disputes the whole transaction. A transaction is disputed once; a second
+// dispute returns ErrConflict.
+func (r *Repository) CreateDispute(ctx context.Context, dispute *models.Dispute) error {
+    if r.db == nil { return fmt.Errorf("not supported in memory repo") }
+    tx, err := r.db.BeginTx(ctx, nil)
+    if err != nil { return err }
+    defer tx.Rollback()
+    if _, err := tx.ExecContext(ctx, "set local statement_timeout = '3s'"); err != nil { return err }
+
+    var cardID, status string
+    var authID, terminalID, rrn sql.NullString
+    var amount int64
+    err = tx.QueryRowContext(ctx, `
+      select t.card_id, t.auth_id, t.amount, t.currency, t.status, a.terminal_id, a.rrn
+        from issuer.transactions t
+        left join issuer.auths a on a.auth_id = t.auth_id
+       where t.tx_id::text=$1 and t.account_id::text=$2
+         for update of t
+    `, dispute.TransactionID, dispute.AccountID).Scan(&cardID, &authID, &amount, &dispute.Currency, &status, &terminalID, &rrn)
+    if errors.Is(err, sql.ErrNoRows) { return ErrNotFound }
+    if err != nil { return err }
+    if status != "CAPTURED" {
+        return fmt.Errorf("transaction is %s: %w", status, models.ErrTransactionNotDisputable)
+    }
+    if dispute.Amount == 0 { dispute.Amount = amount }
+    if dispute.Amount < 0 || dispute.Amount > amount {
+        return fmt.Errorf("dispute of %d for a transaction of %d: %w", dispute.Amount, amount, models.ErrTransactionNotDisputable)
+    }
+    dispute.AuthID = authID.String
+    dispute.TerminalID = terminalID.String
+    dispute.RRN = rrn.String
+    dispute.Status = models.DisputeStatusOpened
+
+    if err := tx.QueryRowContext(ctx, `
+      insert into issuer.transactions(tx_id, account_id, card_id, auth_id, amount, currency, status, posted_at)
+      values (gen_random_uuid(), $1,$2,$3,$4,$5,'PROVISIONAL_CREDIT', now())
+      returning tx_id
+    `, dispute.AccountID, cardID, authID, -dispute.Amount, dispute.Currency).Scan(&dispute.ProvisionalCreditID); err != nil { return err }
+    credit := &models.Journal{Kind: models.JournalProvisionalCredit, AccountID: dispute.AccountID, AuthID: authID.String, TxID: dispute.ProvisionalCreditID, Currency: dispute.Currency,
+        Postings: models.Transfer(models.Settlement(dispute.Currency), models.CustomerAvailable(dispute.AccountID, dispute.Currency), dispute.Amount)}
+    if err := r.postJournal(ctx, tx, credit); err != nil { return err }
+
+    err = tx.QueryRowContext(ctx, `
+      insert into issuer.disputes(dispute_id, account_id, tx_id, auth_id, amount, currency, reason_code, description, status, provisional_credit_id)
+      values ($1,$2,$3,$4,$5,$6,$7,nullif($8,''),$9,$10)
+      returning created_at, updated_at
+    `, dispute.ID, dispute.AccountID, dispute.TransactionID, authID, dispute.Amount, dispute.Currency,
+        dispute.ReasonCode, dispute.Description, string(dispute.Status), dispute.ProvisionalCreditID).Scan(&dispute.CreatedAt, &dispute.UpdatedAt)
+    if isUniqueViolation(err) { return ErrConflict }
+    if err != nil { return err }
+    return tx.Commit()
+}
+
+// GetDispute returns the dispute with its status history if it belongs to the account.
+func (r *Repository) GetDispute(ctx context.Context, accountID, disputeID string) (*models.Dispute, error) {
+    if r.db == nil { return nil, fmt.Errorf("not supported in memory repo") }
+    disputes, err := r.listDisputes(ctx, `d.account_id::text=$1 and d.dispute_id::text=$2`, accountID, disputeID)
+    if err != nil { return nil, err }
+    if len(disputes) == 0 { return nil, ErrNotFound }
+    dispute := disputes[0]
+
+    rows, err := r.db.QueryContext(ctx, `
+      select change_id, dispute_id, from_status, to_status, coalesce(reason, ''), actor, changed_at
+        from issuer.dispute_status_changes where dispute_id=$1 order by changed_at asc
+    `, dispute.ID)
+    if err != nil { return nil, err }
+    defer rows.Close()
+    for rows.Next() {
+        var ch models.DisputeStatusChange; var from, to string
+        if err := rows.Scan(&ch.ID, &ch.DisputeID, &from, &to, &ch.Reason, &ch.Actor, &ch.ChangedAt); err != nil { return nil, err }
+        ch.FromStatus = models.DisputeStatus(from)
+        ch.ToStatus = models.DisputeStatus(to)
+        dispute.History = append(dispute.History, &ch)
+    }
+    return dispute, rows.Err()
+}
+
+// ListDisputes returns the disputes of the account, oldest first, without their history.
+func (r *Repository) ListDisputes(ctx context.Context, accountID string) ([]*models.Dispute, error) {
+    if r.db == nil { return nil, fmt.Errorf("not supported in memory repo") }
+    return r.listDisputes(ctx, `d.account_id::text=$1`, accountID)
+}
+
+func (r *Repository) listDisputes(ctx context.Context, where string, args ...any) ([]*models.Dispute, error) {
+    rows, err := r.db.QueryContext(ctx, `
+      select d.dispute_id, d.account_id, d.tx_id, coalesce(d.auth_id::text, ''), d.amount, d.currency,
+             d.reason_code, coalesce(d.description, ''), d.status, d.provisional_credit_id,
+             coalesce(a.terminal_id, ''), coalesce(a.rrn, ''), d.created_at, d.updated_at
+        from issuer.disputes d
+        left join issuer.auths a on a.auth_id = d.auth_id
+       where `+where+`
+       order by d.created_at asc
+    `, args...)
+    if err != nil { return nil, err }
+    defer rows.Close()
+    var out []*models.Dispute
+    for rows.Next() {
+        var d models.Dispute; var status string
+        if err := rows.Scan(&d.ID, &d.AccountID, &d.TransactionID, &d.AuthID, &d.Amount, &d.Currency,
+            &d.ReasonCode, &d.Description, &status, &d.ProvisionalCreditID,
+            &d.TerminalID, &d.RRN, &d.CreatedAt, &d.UpdatedAt); err != nil { return nil, err }
+        d.Status = models.DisputeStatus(status)
+        out = append(out, &d)
+    }
+    return out, rows.Err()
+}
+
+// UpdateDisputeStatus moves a dispute to a new status and records the change
+// in the audit trail. Losing the dispute reverses the provisional credit in
+// the same transaction, even when that overdraws the account. Returns
+// models.ErrInvalidDisputeStatusTransition when the move is not allowed.
+func (r *Repository) UpdateDisputeStatus(ctx context.Context, accountID, disputeID string, change models.ChangeDisputeStatus) (*models.DisputeStatusChange, error) {
+    if r.db == nil { return nil, fmt.Errorf("not supported in memory repo") }
+    tx, err := r.db.BeginTx(ctx, nil)
+    if err != nil { return nil, err }
+    defer tx.Rollback()
+    if _, err := tx.ExecContext(ctx, "set local statement_timeout = '3s'"); err != nil { return nil, err }
+
+    var cardID, currency, status string
+    var authID sql.NullString
+    var amount int64
+    err = tx.QueryRowContext(ctx, `
+      select t.card_id, d.auth_id, d.amount, d.currency, d.status
+        from issuer.disputes d
+        join issuer.transactions t on t.tx_id = d.provisional_credit_id
+       where d.dispute_id::text=$1 and d.account_id::text=$2
+         for update of d
+    `, disputeID, accountID).Scan(&cardID, &authID, &amount, &currency, &status)
+    if errors.Is(err, sql.ErrNoRows) { return nil, ErrNotFound }
+    if err != nil { return nil, err }
+    from := models.DisputeStatus(status)
+    if !from.CanTransitionTo(change.Status) {
+        return nil, fmt.Errorf("%s -> %s: %w", from, change.Status, models.ErrInvalidDisputeStatusTransition)
+    }
+
+    if change.Status == models.DisputeStatusLost {
+        var txID string
+        if err := tx.QueryRowContext(ctx, `
+          insert into issuer.transactions(tx_id, account_id, card_id, auth_id, amount, currency, status, posted_at)
+          values (gen_random_uuid(), $1,$2,$3,$4,$5,'PROVISIONAL_CREDIT_REVERSAL', now())
+          returning tx_id
+        `, accountID, cardID, authID, amount, currency).Scan(&txID); err != nil { return nil, err }
+        reversal := &models.Journal{Kind: models.JournalProvisionalCreditReversal, AccountID: accountID, AuthID: authID.String, TxID: txID, Currency: currency,
+            Postings: models.Transfer(models.CustomerAvailable(accountID, currency), models.Settlement(currency), amount)}
+        if err := r.postJournal(ctx, tx, reversal); err != nil { return nil, err }
+    }
+
+    if _, err := tx.ExecContext(ctx, `update issuer.disputes set status=$2 where dispute_id=$1`, disputeID, string(change.Status)); err != nil { return nil, err }
+    audit := &models.DisputeStatusChange{
+        ID:         uuid.New().String(),
+        DisputeID:  disputeID,
+        FromStatus: from,
+        ToStatus:   change.Status,
+        Reason:     change.Reason,
+        Actor:      change.Actor,
+    }
+    if err := tx.QueryRowContext(ctx, `
+      insert into issuer.dispute_status_changes(change_id, dispute_id, from_status, to_status, reason, actor)
+      values ($1,$2,$3,$4,nullif($5,''),$6)
+      returning changed_at
+    `, audit.ID, disputeID, string(from), string(change.Status), change.Reason, change.Actor).Scan(&audit.ChangedAt); err != nil {
+        return nil, err
+    }
+    if err := tx.Commit(); err != nil { return nil, err }
+    return audit, nil
+}
+
+// GetBusinessDate returns the business date, starting it at initial when
+// there is none yet.
+func (r *Repository) GetBusinessDate(ctx context.Context, initial time.Time) (time.Time, error) {
+    var d time.Time
+    // the outer select does not see the row the insert adds, so exactly one of them returns it
+    err := r.db.QueryRowContext(ctx, `
+        with inserted as (
+            insert into issuer.business_date (business_date) values ($1)
+            on conflict (id) do nothing
+            returning business_date)
+        select business_date from inserted
+        union all
+        select business_date from issuer.business_date
+    `, initial.Format("2006-01-02")).Scan(&d)
+    return d, err
+}
+
+// AdvanceBusinessDate moves the business date to the next day and returns
+// it; without one yet it starts at the day after initial.
+func (r *Repository) AdvanceBusinessDate(ctx context.Context, initial time.Time) (time.Time, error) {
+    var d time.Time
+    err := r.db.QueryRowContext(ctx, `
+        insert into issuer.business_date (business_date) values ($1::date + 1)
+        on conflict (id) do update set business_date = issuer.business_date.business_date + 1, updated_at = now()
+        returning business_date
+    `, initial.Format("2006-01-02")).Scan(&d)
+    return d, err
+}
+
+// RollBusinessDate moves the business date to today when it is behind and
+// returns it. It never moves the date back, so every instance may roll it.
+func (r *Repository) RollBusinessDate(ctx context.Context, today time.Time) (time.Time, error) {
+    var d time.Time
+    err := r.db.QueryRowContext(ctx, `
+        insert into issuer.business_date (business_date) values ($1)
+        on conflict (id) do update set business_date = excluded.business_date, updated_at = now()
+            where issuer.business_date.business_date < excluded.business_date
+        returning business_date
+    `, today.Format("2006-01-02")).Scan(&d)
+    if errors.Is(err, sql.ErrNoRows) { return r.GetBusinessDate(ctx, today) }
+    return d, err
+}
+
+// CreatePayment posts a payment of a credit account on the business date.
+// The payment is funded from outside the ledger's customer accounts and
+// makes the amount available again.
+func (r *Repository) CreatePayment(ctx context.Context, accountID string, amount int64, currency string, businessDate time.Time) (*models.Payment, error) {
+    if r.db == nil { return nil, fmt.Errorf("not supported in memory repo") }
+    tx, err := r.db.BeginTx(ctx, nil)
+    if err != nil { return nil, err }
+    defer tx.Rollback()
+    if _, err := tx.ExecContext(ctx, "set local statement_timeout = '3s'"); err != nil { return nil, err }
+
+    var product, accountCurrency string
+    err = tx.QueryRowContext(ctx, `select product, currency from issuer.accounts where account_id::text=$1 for update`, accountID).Scan(&product, &accountCurrency)
+    if errors.Is(err, sql.ErrNoRows) { return nil, ErrNotFound }
+    if err != nil { return nil, err }
+    if product != models.ProductCredit { return nil, models.ErrNotCreditAccount }
+    currency = strings.ToUpper(currency)
+    if currency != accountCurrency { return nil, fmt.Errorf("currency %s does not match account currency %s: %w", currency, accountCurrency, models.ErrInvalidAmount) }
+
+    payment := &models.Payment{AccountID: accountID, Amount: amount, Currency: currency, BusinessDate: businessDate}
+    if err := tx.QueryRowContext(ctx, `
+      insert into issuer.transactions(tx_id, account_id, amount, currency, status, business_date, posted_at)
+      values (gen_random_uuid(), $1,$2,$3,'PAYMENT',$4, now())
+      returning tx_id
+    `, accountID, -amount, currency, businessDate.Format("2006-01-02")).Scan(&payment.TransactionID); err != nil { return nil, err }
+    journal := &models.Journal{Kind: models.JournalPayment, AccountID: accountID, TxID: payment.TransactionID, Currency: currency,
+        Postings: models.Transfer(models.Funding(currency), models.CustomerAvailable(accountID, currency), amount)}
+    if err := r.postJournal(ctx, tx, journal); err != nil { return nil, err }
+    if err := tx.Commit(); err != nil { return nil, err }
+    return payment, nil
+}
+
+// ListCreditAccountsToClose returns the credit accounts whose end of day has
+// not run through the given business date yet.
+func (r *Repository) ListCreditAccountsToClose(ctx context.Context, through time.Time) ([]string, error) {
+    if r.db == nil { return nil, fmt.Errorf("not supported in memory repo") }
+    rows, err := r.db.QueryContext(ctx, `
+      select account_id from issuer.accounts
+       where product='credit' and coalesce(cycle_date + 1, opened_on) <= $1::date
+       order by account_id
+    `, through.Format("2006-01-02"))
+    if err != nil { return nil, err }
+    defer rows.Close()
+    var out []string
+    for rows.Next() {
+        var id string
+        if err := rows.Scan(&id); err != nil { return nil, err }
+        out = append(out, id)
+    }
+    return out, rows.Err()
+}
+
+// CloseCreditDay runs the end of day of a credit account for the business
+// date after the last one it ran for, unless that is after through. In one
+// transaction it accrues a day of interest on what the account owes, charges
+// the late fee of a statement due that day that did not get its minimum
+// payment, and on the statement day charges the cycle's interest (waived in
+// the grace period) and closes the statement, returned when it does. closed
+// is false when there was no day left to close.
+func (r *Repository) CloseCreditDay(ctx context.Context, accountID string, through time.Time, terms CreditConfig) (day time.Time, statement *models.Statement, closed bool, err error) {
+    if r.db == nil { return day, nil, false, fmt.Errorf("not supported in memory repo") }
+    tx, err := r.db.BeginTx(ctx, nil)
+    if err != nil { return day, nil, false, err }
+    defer tx.Rollback()
+    if _, err := tx.ExecContext(ctx, "set local statement_timeout = '5s'"); err != nil { return day, nil, false, err }
+
+    account := models.Account{ID: accountID}
+    err = tx.QueryRowContext(ctx, `
+      select product, currency, available_balance, hold_balance, coalesce(statement_day, 0), purchase_apr_bps, opened_on,
+             coalesce(cycle_date + 1, opened_on)
+        from issuer.accounts where account_id=$1 for update
+    `, accountID).Scan(&account.Product, &account.Currency, &account.AvailableBalance, &account.HoldBalance,
+        &account.StatementDay, &account.PurchaseAPRBps, &account.OpenedOn, &day)
+    if errors.Is(err, sql.ErrNoRows) { return day, nil, false, ErrNotFound }
+    if err != nil { return day, nil, false, err }
+    if account.Product != models.ProductCredit { return day, nil, false, models.ErrNotCreditAccount }
+    // dates come back from the DB at UTC midnight
+    if day.After(time.Date(through.Year(), through.Month(), through.Day(), 0, 0, 0, 0, time.UTC)) { return day, nil, false, nil }
+    date := day.Format("2006-01-02")
+    currency := account.Currency
+
+    // charge posts interest or a fee against the available balance
+    charge := func(status string, kind models.JournalKind, to models.LedgerAccount, amount int64) error {
+        var txID string
+        if err := tx.QueryRowContext(ctx, `
+          insert into issuer.transactions(tx_id, account_id, amount, currency, status, business_date, posted_at)
+          values (gen_random_uuid(), $1,$2,$3,$4,$5, now())
+          returning tx_id
+        `, accountID, amount, currency, status, date).Scan(&txID); err != nil { return err }
+        journal := &models.Journal{Kind: kind, AccountID: accountID, TxID: txID, Currency: currency,
+            Postings: models.Transfer(models.CustomerAvailable(accountID, currency), to, amount)}
+        if err := r.postJournal(ctx, tx, journal); err != nil { return err }
+        account.AvailableBalance -= amount
+        return nil
+    }
+
+    // interest accrues on what is owed at the end of the day
+    if owed := account.Owed(); owed > 0 && account.PurchaseAPRBps > 0 {
+        if _, err := tx.ExecContext(ctx, `
+          insert into issuer.interest_accruals(account_id, business_date, balance, apr_bps, amount_micros)
+          values ($1,$2,$3,$4,$5)
+        `, accountID, date, owed, account.PurchaseAPRBps, owed*int64(account.PurchaseAPRBps)*100/365); err != nil { return day, nil, false, err }
+    }
+
+    var dueID string
+    var dueMinimum int64
+    var duePeriodEnd time.Time
+    err = tx.QueryRowContext(ctx, `
+      select statement_id, minimum_payment, period_end from issuer.statements
+       where account_id=$1 and due_date=$2 and not late_fee_charged and minimum_payment > 0
+         for update
+    `, accountID, date).Scan(&dueID, &dueMinimum, &duePeriodEnd)
+    if err != nil && !errors.Is(err, sql.ErrNoRows) { return day, nil, false, err }
+    if err == nil && terms.LateFee > 0 {
+        paid, err := paidBetween(ctx, tx, accountID, duePeriodEnd, day)
+        if err != nil { return day, nil, false, err }
+        if paid < dueMinimum {
+            if err := charge("LATE_FEE", models.JournalLateFee, models.Fees(currency), terms.LateFee); err != nil { return day, nil, false, err }
+            if _, err := tx.ExecContext(ctx, `update issuer.statements set late_fee_charged=true where statement_id=$1`, dueID); err != nil { return day, nil, false, err }
+        }
+    }
+
+    if account.StatementDay == day.Day() && day.After(account.OpenedOn) {
+        statement = &models.Statement{ID: uuid.New().String(), AccountID: accountID, PeriodStart: account.OpenedOn, PeriodEnd: day}
+        // the first cycle is in the grace period
+        grace := true
+        var prevEnd, prevDue time.Time
+        var prevClosing int64
+        err = tx.QueryRowContext(ctx, `
+          select period_end, due_date, closing_balance from issuer.statements
+           where account_id=$1 order by period_end desc limit 1
+        `, accountID).Scan(&prevEnd, &prevDue, &prevClosing)
+        if err != nil && !errors.Is(err, sql.ErrNoRows) { return day, nil, false, err }
+        if err == nil {
+            paid, err := paidBetween(ctx, tx, accountID, prevEnd, prevDue)
+            if err != nil { return day, nil, false, err }
+            statement.PeriodStart = prevEnd.AddDate(0, 0, 1)
+            statement.OpeningBalance = prevClosing
+            grace = prevClosing <= 0 || paid >= prevClosing
+        }
+        from := statement.PeriodStart.Format("2006-01-02")
+
+        if !grace {
+            var micros int64
+            if err := tx.QueryRowContext(ctx, `
+              select coalesce(sum(amount_micros), 0) from issuer.interest_accruals
+               where account_id=$1 and business_date between $2 and $3
+            `, accountID, from, date).Scan(&micros); err != nil { return day, nil, false, err }
+            statement.Interest = (micros + 500_000) / 1_000_000
+            if statement.Interest > 0 {
+                if err := charge("INTEREST", models.JournalInterest, models.Interest(currency), statement.Interest); err != nil { return day, nil, false, err }
+            }
+        }
+        if err := tx.QueryRowContext(ctx, `
+          select coalesce(sum(amount), 0) from issuer.transactions
+           where account_id=$1 and status in ('LATE_FEE','FEE') and business_date between $2 and $3
+        `, accountID, from, date).Scan(&statement.Fees); err != nil { return day, nil, false, err }
+
+        statement.ClosingBalance = -(account.AvailableBalance + account.HoldBalance)
+        statement.MinimumPayment = terms.MinimumPayment(statement.ClosingBalance, statement.Interest, statement.Fees)
+        statement.DueDate = day.AddDate(0, 0, terms.GracePeriodDays)
+        if err := tx.QueryRowContext(ctx, `
+          insert into issuer.statements(statement_id, account_id, period_start, period_end, opening_balance, closing_balance,
+                                        interest, fees, minimum_payment, due_date)
+          values ($1,$2,$3,$4,$5,$6,$7,$8,$9,$10)
+          returning created_at
+        `, statement.ID, accountID, from, date, statement.OpeningBalance, statement.ClosingBalance,
+            statement.Interest, statement.Fees, statement.MinimumPayment, statement.DueDate.Format("2006-01-02")).Scan(&statement.CreatedAt); err != nil {
+            return day, nil, false, err
+        }
+    }
+
+    if _, err := tx.ExecContext(ctx, `update issuer.accounts set cycle_date=$2 where account_id=$1`, accountID, date); err != nil { return day, nil, false, err }
+    if err := tx.Commit(); err != nil { return day, nil, false, err }
+    return day, statement, true, nil
+}
+
+// ChargeFee charges the fees of a quote that is not tied to an
+// authorization, such as a card replacement, to the account.
+func (r *Repository) ChargeFee(ctx context.Context, accountID, cardID string, quote models.FeeQuote, businessDate time.Time) ([]*models.Transaction, error) {
+    if r.db == nil {
+        r.mu.Lock(); defer r.mu.Unlock()
+        var account *models.Account
+        for _, a := range r.Accounts {
+            if a.ID == accountID { account = a }
+        }
+        if account == nil { return nil, ErrNotFound }
+        var charged []*models.Transaction
+        for _, fee := range quote.Fees {
+            t := &models.Transaction{ID: uuid.New().String(), AccountID: accountID, CardID: cardID, Amount: fee.Amount,
+                Currency: account.Currency, Status: models.TransactionStatusFee, Description: fee.Rule}
+            account.AvailableBalance -= fee.Amount
+            r.Transactions = append(r.Transactions, t)
+            charged = append(charged, t)
+        }
+        return charged, nil
+    }
+    tx, err := r.db.BeginTx(ctx, nil)
+    if err != nil { return nil, err }
+    defer tx.Rollback()
+    if _, err := tx.ExecContext(ctx, "set local statement_timeout = '3s'"); err != nil { return nil, err }
+
+    var currency string
+    err = tx.QueryRowContext(ctx, `select currency from issuer.accounts where account_id=$1 for update`, accountID).Scan(&currency)
+    if errors.Is(err, sql.ErrNoRows) { return nil, ErrNotFound }
+    if err != nil { return nil, err }
+    quote.Currency = strings.ToUpper(currency)
+    charged, err := r.chargeFees(ctx, tx, accountID, cardID, "", 0, quote, businessDate)
+    if err != nil { return nil, err }
+    if err := tx.Commit(); err != nil { return nil, err }
+    return charged, nil
+}
+
+// chargeFees posts each fee of the quote as a FEE transaction of its own,
+// linked to the card and authorization it was charged on and to the STAN of
+// the capture or presentment (0 without one), and takes it from the available
+// balance. Fees are charged even when the balance does not
+// cover them.
+func (r *Repository) chargeFees(ctx context.Context, tx *sql.Tx, accountID, cardID, authID string, stan int, quote models.FeeQuote, businessDate time.Time) ([]*models.Transaction, error) {
+    currency := strings.ToUpper(quote.Currency)
+    var charged []*models.Transaction
+    for _, fee := range quote.Fees {
+        t := &models.Transaction{AccountID: accountID, CardID: cardID, AuthID: authID, Amount: fee.Amount, Currency: currency,
+            Status: models.TransactionStatusFee, Description: fee.Rule}
+        if err := tx.QueryRowContext(ctx, `
+          insert into issuer.transactions(tx_id, account_id, card_id, auth_id, amount, currency, status, description, stan, business_date, posted_at)
+          values (gen_random_uuid(), $1,$2,$3,$4,$5,'FEE',$6,nullif($7, 0),$8, now())
+          returning tx_id
+        `, accountID, nullString(cardID), nullString(authID), fee.Amount, currency, fee.Rule, stan, businessDate.Format("2006-01-02")).Scan(&t.ID); err != nil { return nil, err }
+        journal := &models.Journal{Kind: models.JournalFee, AccountID: accountID, AuthID: authID, TxID: t.ID, Currency: currency,
+            Postings: models.Transfer(models.CustomerAvailable(accountID, currency), models.Fees(currency), fee.Amount)}
+        if err := r.postJournal(ctx, tx, journal); err != nil { return nil, err }
+        charged = append(charged, t)
+    }
+    return charged, nil
+}
+
+// paidBetween sums the payments of the account booked after one business
+// date, up to and including another.
+func paidBetween(ctx context.Context, tx *sql.Tx, accountID string, after, through time.Time) (int64, error) {
+    var paid int64
+    err := tx.QueryRowContext(ctx, `
+      select coalesce(-sum(amount), 0) from issuer.transactions
+       where account_id=$1 and status='PAYMENT' and business_date > $2 and business_date <= $3
+    `, accountID, after.Format("2006-01-02"), through.Format("2006-01-02")).Scan(&paid)
+    return paid, err
+}
+
+// ListStatements returns the statements of the account, newest first, with
+// what was paid towards each by its due date.
+func (r *Repository) ListStatements(ctx context.Context, accountID string) ([]*models.Statement, error) {
+    if r.db == nil { return nil, fmt.Errorf("not supported in memory repo") }
+    rows, err := r.db.QueryContext(ctx, `
+      select s.statement_id, s.account_id, s.period_start, s.period_end, s.opening_balance, s.closing_balance,
+             s.interest, s.fees, s.minimum_payment, s.due_date, s.late_fee_charged, s.created_at,
+             coalesce((select -sum(t.amount) from issuer.transactions t
+                        where t.account_id=s.account_id and t.status='PAYMENT'
+                          and t.business_date > s.period_end and t.business_date <= s.due_date), 0)
+        from issuer.statements s
+       where s.account_id::text=$1
+       order by s.period_end desc
+    `, accountID)
+    if err != nil { return nil, err }
+    defer rows.Close()
+    var out []*models.Statement
+    for rows.Next() {
+        var s models.Statement
+        if err := rows.Scan(&s.ID, &s.AccountID, &s.PeriodStart, &s.PeriodEnd, &s.OpeningBalance, &s.ClosingBalance,
+            &s.Interest, &s.Fees, &s.MinimumPayment, &s.DueDate, &s.LateFeeCharged, &s.CreatedAt, &s.Paid); err != nil { return nil, err }
+        out = append(out, &s)
+    }
+    return out, rows.Err()
+}
+
+// postJournal appends a balanced journal entry to the ledger in tx and
+// applies what it posts to customer ledger accounts to the balance columns of
+// issuer.accounts, which are a projection of the ledger. A journal without
+// postings (nothing moved) is not recorded.
+func (r *Repository) postJournal(ctx context.Context, tx *sql.Tx, j *models.Journal) error {
+    if len(j.Postings) == 0 { return nil }
+    if err := j.Validate(); err != nil { return err }
+    if j.ID == "" { j.ID = uuid.New().String() }
+
+    if err := tx.QueryRowContext(ctx, `
+      insert into issuer.journal_entries(entry_id, kind, account_id, auth_id, tx_id, currency)
+      values ($1,$2,$3,nullif($4,'')::uuid,nullif($5,'')::uuid,$6)
+      returning created_at
+    `, j.ID, string(j.Kind), nullString(j.AccountID), j.AuthID, j.TxID, j.Currency).Scan(&j.CreatedAt); err != nil { return err }
+
+    type delta struct{ available, hold int64 }
+    projection := map[string]*delta{}
+    for _, p := range j.Postings {
+        if _, err := tx.ExecContext(ctx, `
+          insert into issuer.ledger_accounts(code, kind, account_id, currency) values ($1,$2,$3,$4)
+          on conflict (code) do nothing
+        `, p.Account.Code, string(p.Account.Kind), nullString(p.Account.AccountID), p.Account.Currency); err != nil { return err }
+        if _, err := tx.ExecContext(ctx, `
+          insert into issuer.postings(entry_id, ledger_account, amount) values ($1,$2,$3)
+        `, j.ID, p.Account.Code, p.Amount); err != nil { return err }
+
+        switch p.Account.Kind {
+        case models.LedgerAccountCustomerAvailable, models.LedgerAccountCustomerHold:
+            d := projection[p.Account.AccountID]
+            if d == nil { d = &delta{}; projection[p.Account.AccountID] = d }
+            if p.Account.Kind == models.LedgerAccountCustomerHold { d.hold += p.Amount } else { d.available += p.Amount }
+        }
+    }
+    for accountID, d := range projection {
+        if d.available == 0 && d.hold == 0 { continue }
+        if _, err := tx.ExecContext(ctx, `
+          update issuer.accounts
+             set available_balance = available_balance + $2, hold_balance = hold_balance + $3, updated_at=now()
+           where account_id=$1
+        `, accountID, d.available, d.hold); err != nil { return err }
+    }
+    return nil
+}
+
+// CheckLedger verifies the ledger: every journal entry must balance and the
+// balance columns of every account must equal the sum of the postings to its
+// customer ledger accounts. Discrepancies are reported, not repaired.
+func (r *Repository) CheckLedger(ctx context.Context) (*models.LedgerCheck, error) {
+    if r.db == nil { return nil, fmt.Errorf("not supported in memory repo") }
+    // one snapshot for all queries, so postings committed meanwhile cannot
+    // show up as discrepancies
+    tx, err := r.db.BeginTx(ctx, &sql.TxOptions{Isolation: sql.LevelRepeatableRead, ReadOnly: true})
+    if err != nil { return nil, err }
+    defer tx.Rollback()
+
+    check := &models.LedgerCheck{CheckedAt: time.Now().UTC()}
+    if err := tx.QueryRowContext(ctx, `
+      select (select count(*) from issuer.accounts), (select count(*) from issuer.journal_entries)
+    `).Scan(&check.Accounts, &check.Journals); err != nil { return nil, err }
+
+    rows, err := tx.QueryContext(ctx, `
+      select e.entry_id from issuer.journal_entries e
+        left join issuer.postings p on p.entry_id = e.entry_id
+       group by e.entry_id
+      having coalesce(sum(p.amount), 0) <> 0 or count(p.posting_id) < 2
+       order by e.entry_id
+    `)
+    if err != nil { return nil, err }
+    for rows.Next() {
+        var entryID string
+        if err := rows.Scan(&entryID); err != nil { rows.Close(); return nil, err }
+        check.Unbalanced = append(check.Unbalanced, entryID)
+    }
+    rows.Close()
+    if err := rows.Err(); err != nil { return nil, err }
+
+    rows, err = tx.QueryContext(ctx, `
+      select account_id, currency, available_balance, ledger_available, hold_balance, ledger_hold from (
+        select a.account_id, a.currency, a.available_balance, a.hold_balance,
+               coalesce(sum(p.amount) filter (where l.kind='CUSTOMER_AVAILABLE'), 0) as ledger_available,
+               coalesce(sum(p.amount) filter (where l.kind='CUSTOMER_HOLD'), 0)      as ledger_hold
+          from issuer.accounts a
+          left join issuer.ledger_accounts l on l.account_id = a.account_id
+          left join issuer.postings p on p.ledger_account = l.code
+         group by a.account_id
+      ) b
+       where available_balance <> ledger_available or hold_balance <> ledger_hold
+       order by account_id
+    `)
+    if err != nil { return nil, err }
+    defer rows.Close()
+    for rows.Next() {
+        var d models.LedgerDiscrepancy
+        if err := rows.Scan(&d.AccountID, &d.Currency, &d.AvailableBalance, &d.LedgerAvailable, &d.HoldBalance, &d.LedgerHold); err != nil { return nil, err }
+        check.Discrepancies = append(check.Discrepancies, d)
+    }
+    return check, rows.Err()
+}
+
+// nullString stores the empty string as NULL.
+func nullString(s string) sql.NullString {
+    return sql.NullString{String: s, Valid: s != ""}
+}
+
+// nullTime stores the zero time as NULL.
+func nullTime(t time.Time) sql.NullTime {
+    return sql.NullTime{Time: t, Valid: !t.IsZero()}
+}
+
 // Ping returns DB readiness
 func (r *Repository) Ping(ctx context.Context) error {
     if r.db == nil { return nil }
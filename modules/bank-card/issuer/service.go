@@ -1,9 +1,13 @@
 package issuer
 
 import (
+    "crypto/subtle"
+    "database/sql"
     "errors"
     "fmt"
     "math/rand"
+    "strings"
+    "sync"
     "time"
     "context"
 
@@ -11,28 +15,156 @@ import (
     "github.com/google/uuid"
     "github.com/alovak/cardflow-playground/internal/expiry"
     "github.com/alovak/cardflow-playground/internal/cardgen"
+    "github.com/alovak/cardflow-playground/internal/security"
 )
 
 type Service struct {
     repo *Repository
     cfg  *Config
+    // expiryLoc is the location card expiry is evaluated in (Config.ExpiryTZ);
+    // nil falls back to the expiry package default.
+    expiryLoc *time.Location
+    // cvv derives CVV2 values with each CVK version; they are never stored,
+    // only recomputed for verification with the card's version.
+    cvv byKeyVersion[security.CVVProvider]
+    // pvv derives the PVVs PINs are verified with, by PVK version; PINs are never stored.
+    pvv byKeyVersion[security.PVVProvider]
+    // zpk decrypts the PIN blocks (DE52) of authorizations.
+    zpk []byte
+    // now tells the time dynamic CVVs are derived for and card expiry is
+    // checked against.
+    now func() time.Time
+
+    // businessDate is the processing day transactions are booked to with the
+    // memory backend; PostgreSQL keeps it in issuer.business_date.
+    bizMu        sync.Mutex
+    businessDate time.Time
 }
 
 func NewService(repo *Repository, cfg *Config) *Service {
+    var loc *time.Location
+    if cfg != nil && cfg.ExpiryTZ != "" {
+        // invalid names are reported by App.Start; fall back to the default here
+        if l, err := time.LoadLocation(cfg.ExpiryTZ); err == nil {
+            loc = l
+        }
+    }
+    today := time.Now()
+    if loc != nil {
+        today = today.In(loc)
+    }
     return &Service{
-        repo: repo,
-        cfg:  cfg,
+        repo:      repo,
+        cfg:       cfg,
+        expiryLoc: loc,
+        // demo provider by default; App swaps in the configured one (see newCVVProvider)
+        cvv:          singleKeyVersion[security.CVVProvider](security.NewDemoProviderStrict(security.DemoKey())),
+        pvv:          singleKeyVersion[security.PVVProvider](security.NewSoftwarePVVProvider(security.DemoPVK())),
+        zpk:          security.DemoZPK(),
+        now:          time.Now,
+        businessDate: time.Date(today.Year(), today.Month(), today.Day(), 0, 0, 0, 0, today.Location()),
     }
 }
 
+// BusinessDate returns the current processing day. It starts at today and
+// moves with RollBusinessDate and Cutover.
+func (i *Service) BusinessDate() (time.Time, error) {
+    if i.repo.db == nil {
+        i.bizMu.Lock()
+        defer i.bizMu.Unlock()
+        return i.businessDate, nil
+    }
+    d, err := i.repo.GetBusinessDate(context.Background(), i.today())
+    if err != nil { return time.Time{}, fmt.Errorf("getting business date: %w", err) }
+    return i.date(d), nil
+}
+
+// Cutover handles a cutover message of the network (0800, DE70=201) and
+// returns the new business date. With Config.Cutover "network" it closes the
+// current business day; with the scheduled rollover it only catches up with
+// the calendar, so a day is never closed twice.
+func (i *Service) Cutover() (time.Time, error) {
+    if i.cfg == nil || i.cfg.Cutover != CutoverNetwork {
+        return i.RollBusinessDate()
+    }
+    if i.repo.db == nil {
+        i.bizMu.Lock()
+        defer i.bizMu.Unlock()
+        i.businessDate = i.businessDate.AddDate(0, 0, 1)
+        return i.businessDate, nil
+    }
+    d, err := i.repo.AdvanceBusinessDate(context.Background(), i.today())
+    if err != nil { return time.Time{}, fmt.Errorf("advancing business date: %w", err) }
+    return i.date(d), nil
+}
+
+// RollBusinessDate closes the business days before today, in ExpiryTZ, and
+// returns the business date. It never moves the date back.
+func (i *Service) RollBusinessDate() (time.Time, error) {
+    today := i.today()
+    if i.repo.db == nil {
+        i.bizMu.Lock()
+        defer i.bizMu.Unlock()
+        if i.businessDate.Before(today) { i.businessDate = today }
+        return i.businessDate, nil
+    }
+    d, err := i.repo.RollBusinessDate(context.Background(), today)
+    if err != nil { return time.Time{}, fmt.Errorf("rolling business date: %w", err) }
+    return i.date(d), nil
+}
+
+// today returns the calendar date in ExpiryTZ.
+func (i *Service) today() time.Time {
+    now := i.now()
+    if i.expiryLoc != nil { now = now.In(i.expiryLoc) }
+    return i.date(now)
+}
+
+// date returns midnight of the day of t in ExpiryTZ; dates read from the
+// database are midnight UTC.
+func (i *Service) date(t time.Time) time.Time {
+    loc := time.Local
+    if i.expiryLoc != nil { loc = i.expiryLoc }
+    return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, loc)
+}
+
+// CreateAccount opens a debit account funded with the balance, or a credit
+// account with a limit that closes a statement every month on the day of
+// the month it was opened (at most the 28th).
 func (i *Service) CreateAccount(req models.CreateAccount) (*models.Account, error) {
+	openedOn, err := i.BusinessDate()
+	if err != nil {
+		return nil, err
+	}
 	account := &models.Account{
 		ID:               uuid.New().String(),
 		AvailableBalance: req.Balance,
 		Currency:         req.Currency,
+		Product:          req.Product,
+		OpenedOn:         openedOn,
+	}
+
+	switch req.Product {
+	case "", models.ProductDebit:
+		if req.CreditLimit != 0 {
+			return nil, fmt.Errorf("debit account with a credit limit: %w", models.ErrInvalidAccount)
+		}
+		account.Product = models.ProductDebit
+	case models.ProductCredit:
+		if req.Balance != 0 || req.CreditLimit <= 0 {
+			return nil, fmt.Errorf("credit account needs a limit and no balance: %w", models.ErrInvalidAccount)
+		}
+		account.CreditLimit = req.CreditLimit
+		account.PurchaseAPRBps = i.creditTerms().PurchaseAPRBps
+		account.StatementDay = openedOn.Day()
+		if account.StatementDay > 28 {
+			account.StatementDay = 28
+		}
+	default:
+		return nil, fmt.Errorf("product %q: %w", req.Product, models.ErrInvalidAccount)
 	}
 
-	err := i.repo.CreateAccount(account)
+	err = i.repo.CreateAccount(account)
 	if err != nil {
 		return nil, fmt.Errorf("creating account: %w", err)
 	}
@@ -51,11 +183,14 @@ func (i *Service) GetAccount(accountID string) (*models.Account, error) {
 
 func (i *Service) IssueCard(accountID string) (*models.Card, error) {
     now := time.Now()
-    // Determine years by configured product; callers can extend in future to pass per-card product.
+    // Determine years by product: the account's, or the configured default for unknown accounts.
     product := ""
     if i.cfg != nil {
         product = i.cfg.CardProduct
     }
+    if account, err := i.repo.GetAccount(accountID); err == nil && account.Product != "" {
+        product = account.Product
+    }
     years := expiry.YearsForProduct(product, 0)
     // Store YYMM in DB; present MMYY to clients
     expYYMM := expiry.YYMM(now, years)
@@ -76,19 +211,25 @@ func (i *Service) IssueCard(accountID string) (*models.Card, error) {
     }
     // Create card with uniqueness retry to avoid race on insert
     for attempt := 0; attempt < 5; attempt++ {
+        // CVV2 is derived from PAN+expiry and returned once; the repository never stores it
+        cvv, err := i.computeCVV(pan, expYYMM, i.cvv.current)
+        if err != nil {
+            return nil, fmt.Errorf("computing cvv: %w", err)
+        }
         card := &models.Card{
             ID:                    uuid.New().String(),
             AccountID:             accountID,
             Number:                pan,
             ExpirationDate:        expYYMM, // DB expects YYMM
-            // CVV should be a random 3-digit value
-            CardVerificationValue: generateRandomNumber(3),
+            CardVerificationValue: cvv,
+            CVKVersion:            i.cvv.current,
         }
         err = i.repo.CreateCard(card)
         if err == nil {
-            // For API response return MMYY
-            card.ExpirationDate = expMMYY
-            return card, nil
+            // For API response return MMYY; copy so the stored card keeps YYMM
+            issued := *card
+            issued.ExpirationDate = expMMYY
+            return &issued, nil
         }
         if errors.Is(err, ErrConflict) {
             // regenerate and try again
@@ -114,7 +255,21 @@ func (i *Service) ListTransactions(accountID string) ([]*models.Transaction, err
 	return transactions, nil
 }
 
-func (i *Service) AuthorizeRequest(req models.AuthorizationRequest) (models.AuthorizationResponse, error) {
+// AuthorizeRequest authorizes a 0100 by its processing code. Purchases and
+// cash withdrawals hold the amount; refunds are only a pre-check, approved
+// without recording anything, as the credit is the 0200 refund of the
+// original purchase; balance inquiries return the account balances. Every transaction type has its own policy (Config.Transactions)
+// with limits, the response code for exceeding them and whether a PIN is
+// required. A PIN block is verified whenever there is one; wrong PINs count
+// towards blocking the PIN. Cards with dCVV enabled take a dynamic CVV,
+// which only one approved authorization may use. Transactions in another
+// currency than the account's are declined with 57.
+func (i *Service) AuthorizeRequest(req models.AuthorizationRequest) (resp models.AuthorizationResponse, err error) {
+    txType, ok := models.TransactionTypeForProcessingCode(req.ProcessingCode, req.Merchant.MCC)
+    if !ok {
+        return models.AuthorizationResponse{ApprovalCode: models.ApprovalCodeInvalidTransaction}, nil
+    }
+
     card, err := i.repo.FindCardForAuthorization(req.Card)
     if err != nil {
         if errors.Is(err, ErrNotFound) {
@@ -126,15 +281,127 @@ func (i *Service) AuthorizeRequest(req models.AuthorizationRequest) (models.Auth
         return models.AuthorizationResponse{}, fmt.Errorf("finding card: %w", err)
     }
 
+    if card.Status != models.CardStatusActive {
+        return models.AuthorizationResponse{
+            ApprovalCode: declineCodeForCardStatus(card.Status),
+        }, nil
+    }
+
+    if code, ok := i.checkExpiry(card, req.Card.ExpirationDate); !ok {
+        return models.AuthorizationResponse{ApprovalCode: code}, nil
+    }
+
+    // the repository may only know the last 4 digits; the presented PAN matched the card.
+    var dcvvWindow time.Time
+    switch {
+    case req.PINBlock != "" && req.Card.CardVerificationValue == "":
+        // card-present transactions verified by PIN carry no CVV2
+    case card.DCVVEnabled:
+        window, ok, err := i.verifyDCVV(req.Card.Number, card.ExpirationDate, card.CVKVersion, req.Card.CardVerificationValue)
+        if err != nil {
+            return models.AuthorizationResponse{}, fmt.Errorf("verifying dcvv: %w", err)
+        }
+        if !ok {
+            return models.AuthorizationResponse{ApprovalCode: models.ApprovalCodeCVVMismatch}, nil
+        }
+        dcvvWindow = window
+    default:
+        cvvOK, err := i.verifyCVV(req.Card.Number, card.ExpirationDate, card.CVKVersion, req.Card.CardVerificationValue)
+        if err != nil {
+            return models.AuthorizationResponse{}, fmt.Errorf("verifying cvv: %w", err)
+        }
+        if !cvvOK {
+            return models.AuthorizationResponse{ApprovalCode: models.ApprovalCodeCVVMismatch}, nil
+        }
+    }
+
+    policy, ok := i.transactionPolicy(txType)
+    if !ok {
+        return models.AuthorizationResponse{ApprovalCode: models.ApprovalCodeNotPermitted}, nil
+    }
+    if policy.RequirePIN && req.PINBlock == "" {
+        return models.AuthorizationResponse{ApprovalCode: models.ApprovalCodeIncorrectPIN}, nil
+    }
+    if req.PINBlock != "" {
+        code, err := i.verifyPINBlock(card.ID, req.Card.Number, req.PINBlock)
+        if err != nil {
+            return models.AuthorizationResponse{}, fmt.Errorf("verifying pin: %w", err)
+        }
+        if code != "" {
+            return models.AuthorizationResponse{ApprovalCode: code}, nil
+        }
+    }
+    if policy.MaxAmount > 0 && req.Amount > policy.MaxAmount {
+        return models.AuthorizationResponse{ApprovalCode: policy.LimitCode}, nil
+    }
+
+    // there are no exchange rates, so amounts in another currency than the
+    // account's can be neither held nor charged fees on
+    account, err := i.repo.GetAccount(card.AccountID)
+    if err != nil {
+        return models.AuthorizationResponse{}, fmt.Errorf("finding account: %w", err)
+    }
+    if txType != models.TransactionTypeBalanceInquiry && !strings.EqualFold(req.Currency, account.Currency) {
+        return models.AuthorizationResponse{ApprovalCode: models.ApprovalCodeNotPermitted}, nil
+    }
+
+    // claim the dynamic CVV before the hold so concurrent replays cannot both
+    // be approved; a declined authorization gives it back
+    if !dcvvWindow.IsZero() {
+        claimed, err := i.repo.ClaimDCVV(card.ID, dcvvWindow, req.RRN)
+        if errors.Is(err, models.ErrDCVVReplayed) {
+            return models.AuthorizationResponse{ApprovalCode: models.ApprovalCodeCVVMismatch}, nil
+        }
+        if err != nil {
+            return models.AuthorizationResponse{}, fmt.Errorf("claiming dcvv: %w", err)
+        }
+        if claimed {
+            defer func() {
+                if resp.ApprovalCode == models.ApprovalCodeApproved {
+                    return
+                }
+                if releaseErr := i.repo.ReleaseDCVV(card.ID, dcvvWindow); releaseErr != nil && err == nil {
+                    resp, err = models.AuthorizationResponse{}, fmt.Errorf("releasing dcvv: %w", releaseErr)
+                }
+            }()
+        }
+    }
+
+    switch txType {
+    case models.TransactionTypeBalanceInquiry:
+        return models.AuthorizationResponse{
+            AuthorizationCode: generateAuthorizationCode(),
+            ApprovalCode:      models.ApprovalCodeApproved,
+            Balances: &models.Balances{
+                Currency:  account.Currency,
+                Available: account.OpenToBuy(),
+                Ledger:    account.AvailableBalance + account.HoldBalance,
+            },
+        }, nil
+    case models.TransactionTypeRefund:
+        // a 0100 refund is only a pre-check that the card takes the credit:
+        // nothing is recorded, the credit is the 0200 refund (or the clearing
+        // refund record) against the original purchase
+        return models.AuthorizationResponse{
+            AuthorizationCode: generateAuthorizationCode(),
+            ApprovalCode:      models.ApprovalCodeApproved,
+        }, nil
+    }
+
     // DB-backed path: perform atomic hold via repository when available
     if i.repo.db != nil {
         authCode := generateAuthorizationCode()
         appr := models.ApprovalCodeApproved
-        retAppr, retAuth, dup, err := i.repo.CreateAuthAndHold(card.AccountID, card.ID, req.Amount, req.Currency, appr, authCode, req.Merchant.Name, req.Merchant.MCC, req.STAN)
+        holdExpiresAt := time.Now().Add(i.holdTTL(req.Merchant.MCC))
+        // the day of the daily limit is the calendar day in ExpiryTZ, not the database's
+        retAppr, retAuth, dup, err := i.repo.CreateAuthAndHold(card.AccountID, card.ID, req, txType, policy.DailyAmount, i.today(), appr, authCode, holdExpiresAt)
         if err != nil {
             if errors.Is(err, models.ErrInsufficientFunds) {
                 return models.AuthorizationResponse{ApprovalCode: models.ApprovalCodeInsufficientFunds}, nil
             }
+            if errors.Is(err, models.ErrLimitExceeded) {
+                return models.AuthorizationResponse{ApprovalCode: policy.LimitCode}, nil
+            }
             return models.AuthorizationResponse{}, fmt.Errorf("auth hold: %w", err)
         }
         // Use returned codes when idempotency hit
@@ -145,10 +412,6 @@ func (i *Service) AuthorizeRequest(req models.AuthorizationRequest) (models.Auth
     }
 
     // In-memory path (tests): create transaction and hold on account model
-    account, err := i.repo.GetAccount(card.AccountID)
-    if err != nil {
-        return models.AuthorizationResponse{}, fmt.Errorf("finding account: %w", err)
-    }
     transaction := &models.Transaction{
         ID:        uuid.New().String(),
         AccountID: card.AccountID,
@@ -176,29 +439,73 @@ func (i *Service) AuthorizeRequest(req models.AuthorizationRequest) (models.Auth
 	}, nil
 }
 
-// CaptureByStan finds auth by PAN+expiry and STAN, then captures amount.
-func (i *Service) CaptureByStan(pan, expiry string, stan int, amount int64, currency string) error {
+// CaptureAuthorization finds the original authorization by card, terminal
+// and RRN (or DE90), then captures amount. Partial captures leave the rest of
+// the hold in place until it is captured, reversed or expires. stan is the
+// one of the capture message; the presentment in the clearing file quotes it.
+// Fees are charged on the captured amount.
+func (i *Service) CaptureAuthorization(original models.OriginalTransaction, stan int, amount int64, currency string) error {
     if i.repo.db == nil { return fmt.Errorf("not supported in memory repo") }
-    // find card by PAN+expiry (DB uses pan_hash only, CVV ignored)
-    card, err := i.repo.FindCardForAuthorization(models.Card{Number: pan, ExpirationDate: expiry})
+    authID, _, err := i.findOriginalAuth(original)
     if err != nil { return err }
-    authID, _, _, status, err := i.repo.FindAuthByCardStan(context.Background(), card.ID, stan)
+    businessDate, err := i.BusinessDate()
     if err != nil { return err }
-    if status != "AUTHORIZED" { return fmt.Errorf("bad auth status: %s", status) }
-    return i.repo.CaptureAuth(context.Background(), authID, amount, currency)
+    return i.repo.CaptureAuth(context.Background(), authID, amount, currency, stan, i.feeRules(), businessDate)
 }
 
-// ReverseByStan reverses an authorized hold by PAN+expiry and STAN.
-func (i *Service) ReverseByStan(pan, expiry string, stan int) error {
+// RefundAuthorization credits back amount of what was captured on the
+// original authorization.
+func (i *Service) RefundAuthorization(original models.OriginalTransaction, stan int, amount int64, currency string) error {
     if i.repo.db == nil { return fmt.Errorf("not supported in memory repo") }
-    card, err := i.repo.FindCardForAuthorization(models.Card{Number: pan, ExpirationDate: expiry})
+    authID, _, err := i.findOriginalAuth(original)
     if err != nil { return err }
-    authID, _, _, status, err := i.repo.FindAuthByCardStan(context.Background(), card.ID, stan)
+    return i.repo.RefundAuth(context.Background(), authID, amount, currency, stan)
+}
+
+// findOriginalAuth finds the card by PAN+expiry (DB uses pan_hash only, CVV
+// ignored) and its authorization by terminal and RRN or DE90. It returns the
+// auth id and status.
+func (i *Service) findOriginalAuth(original models.OriginalTransaction) (string, string, error) {
+    card, err := i.repo.FindCardForAuthorization(models.Card{Number: original.Card.Number, ExpirationDate: original.Card.ExpirationDate})
+    if errors.Is(err, ErrNotFound) { return "", "", models.ErrAuthorizationNotFound }
+    if err != nil { return "", "", err }
+    authID, _, _, status, err := i.repo.FindOriginalAuth(context.Background(), card.ID, original)
+    if errors.Is(err, sql.ErrNoRows) { return "", "", models.ErrAuthorizationNotFound }
+    return authID, status, err
+}
+
+// ReverseAuthorization reverses the hold of the original authorization, or,
+// when the original data elements refer to a 0200, the capture or refund of
+// it sent with their STAN. Reversals are repeated until acknowledged, so
+// reversing an already reversed one succeeds, and so does an EXCEPTION
+// authorization, which holds nothing; an unknown authorization returns
+// models.ErrAuthorizationNotFound, a captured or refunded one, or a capture
+// or refund that never arrived, models.ErrNothingToReverse.
+func (i *Service) ReverseAuthorization(original models.OriginalTransaction) error {
+    if i.repo.db == nil { return fmt.Errorf("not supported in memory repo") }
+    authID, _, err := i.findOriginalAuth(original)
     if err != nil { return err }
-    if status != "AUTHORIZED" { return fmt.Errorf("bad auth status: %s", status) }
+    if original.MTI == "0200" { return i.repo.ReverseFinancial(context.Background(), authID, original.STAN) }
     return i.repo.ReverseAuth(context.Background(), authID)
 }
 
+// AdviseAuthorization records an authorization the acquirer approved offline.
+// The decision was already made, so card status, expiry and CVV are not checked;
+// the (card, terminal, RRN) triple makes repeated advices a no-op.
+func (i *Service) AdviseAuthorization(req models.AuthorizationRequest, authorizationCode string) error {
+    if i.repo.db == nil { return fmt.Errorf("not supported in memory repo") }
+    if req.RRN == "" { return fmt.Errorf("advice without RRN") }
+    card, err := i.repo.FindCardForAuthorization(req.Card)
+    if errors.Is(err, ErrNotFound) { return models.ErrAuthorizationNotFound }
+    if err != nil { return err }
+    // the acquirer approved it as whatever it was; unknown codes are purchases
+    txType, ok := models.TransactionTypeForProcessingCode(req.ProcessingCode, req.Merchant.MCC)
+    if !ok { txType = models.TransactionTypePurchase }
+    holdExpiresAt := time.Now().Add(i.holdTTL(req.Merchant.MCC))
+    _, err = i.repo.CreateAdvisedAuth(context.Background(), card.AccountID, card.ID, req, txType, authorizationCode, holdExpiresAt)
+    return err
+}
+
 // SetCardholderName sets user-provided cardholder name on a card (in-memory repo only for now).
 func (i *Service) SetCardholderName(accountID, cardID, name string) (*models.Card, error) {
     updated, err := i.repo.UpdateCardholderName(accountID, cardID, name)
@@ -208,6 +515,117 @@ func (i *Service) SetCardholderName(accountID, cardID, name string) (*models.Car
     return updated, nil
 }
 
+// GetCardStatus returns the card with its current status and status history.
+func (i *Service) GetCardStatus(accountID, cardID string) (*models.Card, []*models.CardStatusChange, error) {
+    card, err := i.repo.GetCard(accountID, cardID)
+    if err != nil {
+        return nil, nil, fmt.Errorf("finding card: %w", err)
+    }
+    history, err := i.repo.ListCardStatusChanges(accountID, cardID)
+    if err != nil {
+        return nil, nil, fmt.Errorf("listing card status changes: %w", err)
+    }
+    return card, history, nil
+}
+
+// ChangeCardStatus moves a card through its lifecycle (e.g. ISSUED -> ACTIVE, ACTIVE -> FROZEN).
+// Disallowed transitions return models.ErrInvalidCardStatusTransition.
+func (i *Service) ChangeCardStatus(accountID, cardID string, change models.ChangeCardStatus) (*models.Card, *models.CardStatusChange, error) {
+    if !change.Status.Valid() {
+        return nil, nil, fmt.Errorf("unknown card status %q: %w", change.Status, models.ErrInvalidCardStatusTransition)
+    }
+    card, audit, err := i.repo.UpdateCardStatus(accountID, cardID, change)
+    if err != nil {
+        return nil, nil, fmt.Errorf("updating card status: %w", err)
+    }
+    return card, audit, nil
+}
+
+// checkExpiry validates the expiry presented in the request (YYMM, DE14 format)
+// against the card on file and the current date in the configured expiry timezone.
+// It returns the decline code and false when the card must not be authorized.
+func (i *Service) checkExpiry(card *models.Card, presented string) (string, bool) {
+    if presented != card.ExpirationDate {
+        return models.ApprovalCodeInvalidExpiry, false
+    }
+    expired, err := expiry.IsExpired(card.ExpirationDate, i.now(), i.expiryLoc)
+    if err != nil {
+        // malformed expiry on file; treat the card as unusable
+        return models.ApprovalCodeInvalidCard, false
+    }
+    if expired {
+        return models.ApprovalCodeExpiredCard, false
+    }
+    return "", true
+}
+
+// transactionPolicy returns the policy of a transaction type and false when
+// the type is not allowed.
+func (i *Service) transactionPolicy(txType models.TransactionType) (TransactionPolicy, bool) {
+    policies := DefaultConfig().Transactions
+    if i.cfg != nil && i.cfg.Transactions != nil {
+        policies = i.cfg.Transactions
+    }
+    policy, ok := policies[txType]
+    return policy, ok
+}
+
+// holdTTL returns how long a hold placed for a merchant with the given MCC lasts.
+func (i *Service) holdTTL(mcc string) time.Duration {
+    if i.cfg == nil {
+        return defaultHoldTTL
+    }
+    return i.cfg.HoldTTLFor(mcc)
+}
+
+// computeCVV derives the CVV2 for a full PAN and YYMM expiry using the configured provider
+// with the CVK of the version.
+func (i *Service) computeCVV(pan, expiryYYMM string, cvkVersion int) (string, error) {
+    pan = cardgen.NormalizePAN(pan)
+    if len(pan) < 2 {
+        return "", fmt.Errorf("pan is too short")
+    }
+    provider, err := i.cvv.get(cvkVersion)
+    if err != nil {
+        return "", fmt.Errorf("finding cvk: %w", err)
+    }
+    return provider.ComputeCVV2(pan[:len(pan)-1], expiryYYMM, i.cvvServiceCode(), 3)
+}
+
+// cvvServiceCode returns the service code CVVs are derived with.
+func (i *Service) cvvServiceCode() string {
+    if i.cfg != nil && i.cfg.CVVServiceCode != "" {
+        return i.cfg.CVVServiceCode
+    }
+    return "000"
+}
+
+// verifyCVV recomputes the CVV2 for the card with the CVK version it was issued under and
+// compares it with the presented value in constant time. A missing CVV never matches.
+func (i *Service) verifyCVV(pan, expiryYYMM string, cvkVersion int, presented string) (bool, error) {
+    if presented == "" {
+        return false, nil
+    }
+    expected, err := i.computeCVV(pan, expiryYYMM, cvkVersion)
+    if err != nil {
+        return false, err
+    }
+    return subtle.ConstantTimeCompare([]byte(expected), []byte(presented)) == 1, nil
+}
+
+// declineCodeForCardStatus maps a non-active card status to the response code sent in 0110.
+func declineCodeForCardStatus(status models.CardStatus) string {
+    switch status {
+    case models.CardStatusLost:
+        return models.ApprovalCodeLostCard
+    case models.CardStatusStolen:
+        return models.ApprovalCodeStolenCard
+    default:
+        // ISSUED (not yet activated), FROZEN and CLOSED cards are restricted
+        return models.ApprovalCodeRestrictedCard
+    }
+}
+
 // generateFakeCardNumber generates a fake card number starting with 9
 // and a random 15-digit number. This is not a valid card number.
 // Deprecated: generateFakeCardNumber retained for compatibility; PAN now generated via cardgen.
@@ -0,0 +1,679 @@
+package issuer_test
+
+import (
+	"encoding/hex"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alovak/cardflow-playground/internal/expiry"
+	"github.com/alovak/cardflow-playground/internal/keys"
+	"github.com/alovak/cardflow-playground/internal/security"
+	"github.com/alovak/cardflow-playground/internal/tr31"
+	"github.com/alovak/cardflow-playground/issuer"
+	"github.com/alovak/cardflow-playground/issuer/models"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAuthorizeRequest_CardStatus(t *testing.T) {
+	svc := issuer.NewService(issuer.NewRepository(), issuer.DefaultConfig())
+
+	account, err := svc.CreateAccount(models.CreateAccount{Balance: 100_00, Currency: "USD"})
+	require.NoError(t, err)
+
+	card, err := svc.IssueCard(account.ID)
+	require.NoError(t, err)
+
+	// the API returns MMYY; authorization requests carry YYMM
+	presented := *card
+	presented.ExpirationDate, err = expiry.ParseCardFace(card.ExpirationDate)
+	require.NoError(t, err)
+
+	authorize := func() string {
+		res, err := svc.AuthorizeRequest(models.AuthorizationRequest{
+			Amount:   10_00,
+			Currency: "USD",
+			Card:     presented,
+		})
+		require.NoError(t, err)
+		return res.ApprovalCode
+	}
+
+	changeStatus := func(status models.CardStatus) {
+		_, _, err := svc.ChangeCardStatus(account.ID, card.ID, models.ChangeCardStatus{Status: status, Actor: "test"})
+		require.NoError(t, err)
+	}
+
+	// issued cards are not activated yet
+	require.Equal(t, models.ApprovalCodeRestrictedCard, authorize())
+
+	changeStatus(models.CardStatusActive)
+	require.Equal(t, models.ApprovalCodeApproved, authorize())
+
+	changeStatus(models.CardStatusFrozen)
+	require.Equal(t, models.ApprovalCodeRestrictedCard, authorize())
+
+	changeStatus(models.CardStatusStolen)
+	require.Equal(t, models.ApprovalCodeStolenCard, authorize())
+
+	changeStatus(models.CardStatusClosed)
+	require.Equal(t, models.ApprovalCodeRestrictedCard, authorize())
+}
+
+func TestAuthorizeRequest_CardVerification(t *testing.T) {
+	repo := issuer.NewRepository()
+	cfg := issuer.DefaultConfig()
+	cfg.ExpiryTZ = "Australia/Sydney"
+	svc := issuer.NewService(repo, cfg)
+
+	account, err := svc.CreateAccount(models.CreateAccount{Balance: 100_00, Currency: "USD"})
+	require.NoError(t, err)
+
+	now := time.Now()
+	lastMonth := now.AddDate(0, -1, 0)
+	cards := map[string]*models.Card{
+		"valid":   {ID: "valid", AccountID: account.ID, Number: "4212340000000006", ExpirationDate: expiry.YYMM(now, 3)},
+		"expired": {ID: "expired", AccountID: account.ID, Number: "4212340000000014", ExpirationDate: expiry.YYMM(lastMonth, 0)},
+	}
+	cvv := security.NewDemoProviderStrict(security.DemoKey())
+	for _, c := range cards {
+		require.NoError(t, repo.CreateCard(c))
+		c.CardVerificationValue, err = cvv.ComputeCVV2(c.Number[:len(c.Number)-1], c.ExpirationDate, "000", 3)
+		require.NoError(t, err)
+		_, _, err := svc.ChangeCardStatus(account.ID, c.ID, models.ChangeCardStatus{Status: models.CardStatusActive, Actor: "test"})
+		require.NoError(t, err)
+	}
+
+	authorize := func(card models.Card) string {
+		res, err := svc.AuthorizeRequest(models.AuthorizationRequest{Amount: 1_00, Currency: "USD", Card: card})
+		require.NoError(t, err)
+		return res.ApprovalCode
+	}
+
+	require.Equal(t, models.ApprovalCodeApproved, authorize(*cards["valid"]))
+	require.Equal(t, models.ApprovalCodeExpiredCard, authorize(*cards["expired"]))
+
+	wrongExpiry := *cards["valid"]
+	wrongExpiry.ExpirationDate = expiry.YYMM(now, 4)
+	require.Equal(t, models.ApprovalCodeInvalidExpiry, authorize(wrongExpiry))
+
+	unknown := *cards["valid"]
+	unknown.Number = "4212340000000022"
+	require.Equal(t, models.ApprovalCodeInvalidCard, authorize(unknown))
+
+	wrongCVV := *cards["valid"]
+	wrongCVV.CardVerificationValue = "xyz"
+	require.Equal(t, models.ApprovalCodeCVVMismatch, authorize(wrongCVV))
+}
+
+func TestConfig_HoldTTLFor(t *testing.T) {
+	cfg := issuer.DefaultConfig()
+
+	require.Equal(t, cfg.HoldTTL, cfg.HoldTTLFor("5411"))
+	require.Equal(t, 31*24*time.Hour, cfg.HoldTTLFor("7011"))
+	require.Equal(t, 31*24*time.Hour, cfg.HoldTTLFor("7512"))
+
+	// zero config falls back to the default TTL
+	require.Equal(t, 7*24*time.Hour, (&issuer.Config{}).HoldTTLFor("5411"))
+}
+
+func TestCreditAccount_OpenToBuy(t *testing.T) {
+	svc := issuer.NewService(issuer.NewRepository(), issuer.DefaultConfig())
+
+	for _, req := range []models.CreateAccount{
+		{Product: "credit", Currency: "USD"},
+		{Product: "credit", Currency: "USD", CreditLimit: 100_00, Balance: 10_00},
+		{Product: "debit", Currency: "USD", CreditLimit: 100_00},
+		{Product: "prepaid", Currency: "USD"},
+	} {
+		_, err := svc.CreateAccount(req)
+		require.ErrorIs(t, err, models.ErrInvalidAccount, "%+v", req)
+	}
+
+	account, err := svc.CreateAccount(models.CreateAccount{Product: "credit", Currency: "USD", CreditLimit: 100_00})
+	require.NoError(t, err)
+	require.Equal(t, int64(100_00), account.OpenToBuy())
+	require.Equal(t, issuer.DefaultConfig().Credit.PurchaseAPRBps, account.PurchaseAPRBps)
+	require.True(t, account.StatementDay >= 1 && account.StatementDay <= 28)
+
+	card, err := svc.IssueCard(account.ID)
+	require.NoError(t, err)
+	// credit cards follow the credit product's validity
+	require.Equal(t, expiry.MMYY(time.Now(), expiry.YearsForProduct("credit", 0)), card.ExpirationDate)
+	_, _, err = svc.ChangeCardStatus(account.ID, card.ID, models.ChangeCardStatus{Status: models.CardStatusActive, Actor: "test"})
+	require.NoError(t, err)
+
+	presented := *card
+	presented.ExpirationDate, err = expiry.ParseCardFace(card.ExpirationDate)
+	require.NoError(t, err)
+
+	authorize := func(amount int64) string {
+		res, err := svc.AuthorizeRequest(models.AuthorizationRequest{Amount: amount, Currency: "USD", Card: presented})
+		require.NoError(t, err)
+		return res.ApprovalCode
+	}
+
+	require.Equal(t, models.ApprovalCodeApproved, authorize(60_00))
+	require.Equal(t, models.ApprovalCodeInsufficientFunds, authorize(50_00))
+	require.Equal(t, models.ApprovalCodeApproved, authorize(40_00))
+	require.Equal(t, int64(0), account.OpenToBuy())
+	require.Equal(t, int64(-100_00), account.AvailableBalance)
+}
+
+func TestCreditConfig_MinimumPayment(t *testing.T) {
+	terms := issuer.DefaultConfig().Credit
+
+	tests := []struct {
+		balance, interest, fees, want int64
+	}{
+		{balance: -10_00, want: 0},
+		{balance: 0, want: 0},
+		// never more than the balance
+		{balance: 10_00, want: 10_00},
+		// at least the floor
+		{balance: 300_00, want: 25_00},
+		// 1% of the balance plus interest and fees
+		{balance: 5000_00, interest: 80_00, fees: 29_00, want: 159_00},
+	}
+	for _, tt := range tests {
+		require.Equal(t, tt.want, terms.MinimumPayment(tt.balance, tt.interest, tt.fees), "%+v", tt)
+	}
+}
+
+func TestQuoteFees(t *testing.T) {
+	svc := issuer.NewService(issuer.NewRepository(), issuer.DefaultConfig())
+
+	account, err := svc.CreateAccount(models.CreateAccount{Balance: 100_00, Currency: "USD"})
+	require.NoError(t, err)
+
+	tests := []struct {
+		name  string
+		req   models.FeeRequest
+		total int64
+		rules []string
+	}{
+		{name: "domestic purchase", req: models.FeeRequest{MCC: "5411", Amount: 100_00, Currency: "USD"}},
+		{name: "currency defaults to the account's", req: models.FeeRequest{MCC: "5411", Amount: 100_00}},
+		{name: "ATM withdrawal", req: models.FeeRequest{MCC: "6011", Amount: 100_00, Currency: "USD"},
+			total: 2_50, rules: []string{"ATM withdrawal"}},
+		// 5% of 50.00 is below the minimum
+		{name: "cash advance", req: models.FeeRequest{MCC: "6010", Amount: 50_00, Currency: "USD"},
+			total: 10_00, rules: []string{"cash advance"}},
+		{name: "card replacement", req: models.FeeRequest{Type: models.TransactionTypeCardReplacement},
+			total: 5_00, rules: []string{"card replacement"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			quote, err := svc.QuoteFees(account.ID, tt.req)
+			require.NoError(t, err)
+			require.Equal(t, tt.total, quote.Total)
+			var rules []string
+			for _, fee := range quote.Fees {
+				rules = append(rules, fee.Rule)
+			}
+			require.Equal(t, tt.rules, rules)
+		})
+	}
+
+	_, err = svc.QuoteFees(account.ID, models.FeeRequest{Type: "wire", Amount: 100_00})
+	require.ErrorIs(t, err, models.ErrInvalidFeeRequest)
+	_, err = svc.QuoteFees(account.ID, models.FeeRequest{Amount: -1})
+	require.ErrorIs(t, err, models.ErrInvalidFeeRequest)
+	// foreign transactions are declined, there are no exchange rates to quote them with
+	_, err = svc.QuoteFees(account.ID, models.FeeRequest{MCC: "5411", Amount: 100_00, Currency: "EUR"})
+	require.ErrorIs(t, err, models.ErrInvalidFeeRequest)
+	_, err = svc.QuoteFees("unknown", models.FeeRequest{Amount: 100_00})
+	require.ErrorIs(t, err, issuer.ErrNotFound)
+}
+
+func TestReplaceCard(t *testing.T) {
+	svc := issuer.NewService(issuer.NewRepository(), issuer.DefaultConfig())
+
+	account, err := svc.CreateAccount(models.CreateAccount{Balance: 100_00, Currency: "USD"})
+	require.NoError(t, err)
+	card, err := svc.IssueCard(account.ID)
+	require.NoError(t, err)
+
+	replacement, fees, err := svc.ReplaceCard(account.ID, card.ID)
+	require.NoError(t, err)
+	require.NotEqual(t, card.ID, replacement.ID)
+	require.Len(t, fees, 1)
+	require.Equal(t, int64(5_00), fees[0].Amount)
+	require.Equal(t, models.TransactionStatusFee, fees[0].Status)
+
+	old, _, err := svc.GetCardStatus(account.ID, card.ID)
+	require.NoError(t, err)
+	require.Equal(t, models.CardStatusClosed, old.Status)
+
+	account, err = svc.GetAccount(account.ID)
+	require.NoError(t, err)
+	require.Equal(t, int64(95_00), account.AvailableBalance)
+
+	transactions, err := svc.ListTransactions(account.ID)
+	require.NoError(t, err)
+	require.Len(t, transactions, 1)
+	require.Equal(t, "card replacement", transactions[0].Description)
+}
+
+func TestAuthorizeRequest_ProcessingCodes(t *testing.T) {
+	cfg := issuer.DefaultConfig()
+	svc := issuer.NewService(issuer.NewRepository(), cfg)
+
+	account, err := svc.CreateAccount(models.CreateAccount{Balance: 1000_00, Currency: "USD"})
+	require.NoError(t, err)
+	card, err := svc.IssueCard(account.ID)
+	require.NoError(t, err)
+	_, _, err = svc.ChangeCardStatus(account.ID, card.ID, models.ChangeCardStatus{Status: models.CardStatusActive, Actor: "test"})
+	require.NoError(t, err)
+
+	presented := *card
+	presented.ExpirationDate, err = expiry.ParseCardFace(card.ExpirationDate)
+	require.NoError(t, err)
+
+	_, err = svc.SetPIN(account.ID, card.ID, models.SetPIN{CardNumber: card.Number, PIN: "1234"})
+	require.NoError(t, err)
+	block, err := security.EncryptPINBlock(security.PINBlockFormat0, "1234", card.Number, security.DemoZPK())
+	require.NoError(t, err)
+	pinBlock := hex.EncodeToString(block)
+
+	authorize := func(processingCode string, amount int64, pinBlock string) models.AuthorizationResponse {
+		res, err := svc.AuthorizeRequest(models.AuthorizationRequest{
+			Amount:         amount,
+			Currency:       "USD",
+			Card:           presented,
+			Merchant:       models.Merchant{Name: "Demo ATM", MCC: "6011"},
+			ProcessingCode: processingCode,
+			PINBlock:       pinBlock,
+		})
+		require.NoError(t, err)
+		return res
+	}
+	available := func() int64 {
+		account, err := svc.GetAccount(account.ID)
+		require.NoError(t, err)
+		return account.AvailableBalance
+	}
+
+	require.Equal(t, models.ApprovalCodeApproved, authorize("000000", 10_00, "").ApprovalCode)
+	require.Equal(t, int64(990_00), available())
+
+	// cash needs a PIN and has its own limit
+	require.Equal(t, models.ApprovalCodeIncorrectPIN, authorize("010000", 100_00, "").ApprovalCode)
+	require.Equal(t, models.ApprovalCodeExceedsLimit, authorize("010000", 600_00, pinBlock).ApprovalCode)
+	require.Equal(t, models.ApprovalCodeApproved, authorize("010000", 100_00, pinBlock).ApprovalCode)
+	require.Equal(t, int64(890_00), available())
+
+	// refunds hold nothing
+	require.Equal(t, models.ApprovalCodeApproved, authorize("200000", 20_00, "").ApprovalCode)
+	require.Equal(t, models.ApprovalCodeInvalidAmount, authorize("200000", 6000_00, "").ApprovalCode)
+	require.Equal(t, int64(890_00), available())
+
+	// balance inquiries hold nothing either
+	res := authorize("310000", 0, "")
+	require.Equal(t, models.ApprovalCodeApproved, res.ApprovalCode)
+	require.Equal(t, &models.Balances{Currency: "USD", Available: 890_00, Ledger: 1000_00}, res.Balances)
+	require.Equal(t, int64(890_00), available())
+
+	require.Equal(t, models.ApprovalCodeInvalidTransaction, authorize("990000", 10_00, "").ApprovalCode)
+
+	// without exchange rates, amounts in another currency cannot be held
+	res, err = svc.AuthorizeRequest(models.AuthorizationRequest{Amount: 10_00, Currency: "EUR", Card: presented, ProcessingCode: "000000"})
+	require.NoError(t, err)
+	require.Equal(t, models.ApprovalCodeNotPermitted, res.ApprovalCode)
+	require.Equal(t, int64(890_00), available())
+
+	// types without a policy are not permitted
+	delete(cfg.Transactions, models.TransactionTypeATMWithdrawal)
+	require.Equal(t, models.ApprovalCodeNotPermitted, authorize("010000", 100_00, pinBlock).ApprovalCode)
+}
+
+func TestPIN(t *testing.T) {
+	svc := issuer.NewService(issuer.NewRepository(), issuer.DefaultConfig())
+
+	account, err := svc.CreateAccount(models.CreateAccount{Balance: 1000_00, Currency: "USD"})
+	require.NoError(t, err)
+	card, err := svc.IssueCard(account.ID)
+	require.NoError(t, err)
+	_, _, err = svc.ChangeCardStatus(account.ID, card.ID, models.ChangeCardStatus{Status: models.CardStatusActive, Actor: "test"})
+	require.NoError(t, err)
+
+	presented := *card
+	presented.ExpirationDate, err = expiry.ParseCardFace(card.ExpirationDate)
+	require.NoError(t, err)
+	// a card-present withdrawal: PIN, no CVV2
+	presented.CardVerificationValue = ""
+
+	withdraw := func(format int, pin string) string {
+		block, err := security.EncryptPINBlock(format, pin, card.Number, security.DemoZPK())
+		require.NoError(t, err)
+		res, err := svc.AuthorizeRequest(models.AuthorizationRequest{
+			Amount:         10_00,
+			Currency:       "USD",
+			Card:           presented,
+			Merchant:       models.Merchant{Name: "Demo ATM", MCC: "6011"},
+			ProcessingCode: "010000",
+			PINBlock:       hex.EncodeToString(block),
+		})
+		require.NoError(t, err)
+		return res.ApprovalCode
+	}
+
+	// no PIN set yet
+	require.Equal(t, models.ApprovalCodeIncorrectPIN, withdraw(security.PINBlockFormat0, "1234"))
+
+	_, err = svc.SetPIN(account.ID, card.ID, models.SetPIN{CardNumber: card.Number, PIN: "12"})
+	require.ErrorIs(t, err, security.ErrInvalidPIN)
+	_, err = svc.SetPIN(account.ID, card.ID, models.SetPIN{CardNumber: "4111111111111111", PIN: "1234"})
+	require.ErrorIs(t, err, models.ErrCardNumberMismatch)
+
+	status, err := svc.SetPIN(account.ID, card.ID, models.SetPIN{CardNumber: card.Number, PIN: "1234"})
+	require.NoError(t, err)
+	require.Equal(t, &models.PINStatus{CardID: card.ID, Set: true, TriesLeft: 3}, status)
+
+	require.Equal(t, models.ApprovalCodeApproved, withdraw(security.PINBlockFormat0, "1234"))
+	require.Equal(t, models.ApprovalCodeApproved, withdraw(security.PINBlockFormat4, "1234"))
+
+	// a correct PIN clears the wrong attempts before it
+	require.Equal(t, models.ApprovalCodeIncorrectPIN, withdraw(security.PINBlockFormat0, "0000"))
+	require.Equal(t, models.ApprovalCodeApproved, withdraw(security.PINBlockFormat0, "1234"))
+
+	// the third wrong PIN in a row blocks it, even for the right PIN
+	_, err = svc.ChangePIN(account.ID, card.ID, models.ChangePIN{CardNumber: card.Number, OldPIN: "1111", NewPIN: "4321"})
+	require.ErrorIs(t, err, models.ErrIncorrectPIN)
+	require.Equal(t, models.ApprovalCodeIncorrectPIN, withdraw(security.PINBlockFormat4, "0000"))
+	require.Equal(t, models.ApprovalCodePINTriesExceeded, withdraw(security.PINBlockFormat0, "0000"))
+	require.Equal(t, models.ApprovalCodePINTriesExceeded, withdraw(security.PINBlockFormat0, "1234"))
+
+	status, err = svc.GetPINStatus(account.ID, card.ID)
+	require.NoError(t, err)
+	require.Equal(t, &models.PINStatus{CardID: card.ID, Set: true, Blocked: true}, status)
+
+	// knowing the PAN is not enough to set it again; a reset by issuer
+	// operations unblocks it, changing it needs the old one
+	_, err = svc.SetPIN(account.ID, card.ID, models.SetPIN{CardNumber: card.Number, PIN: "1234"})
+	require.ErrorIs(t, err, models.ErrPINAlreadySet)
+	status, reset, err := svc.ResetPIN(account.ID, card.ID, models.ResetPIN{CardNumber: card.Number, PIN: "1234", Reason: "blocked", Actor: "ops"})
+	require.NoError(t, err)
+	require.Equal(t, &models.PINStatus{CardID: card.ID, Set: true, TriesLeft: 3}, status)
+	require.Equal(t, "ops", reset.Actor)
+	_, err = svc.ChangePIN(account.ID, card.ID, models.ChangePIN{CardNumber: card.Number, OldPIN: "1234", NewPIN: "4321"})
+	require.NoError(t, err)
+	require.Equal(t, models.ApprovalCodeIncorrectPIN, withdraw(security.PINBlockFormat0, "1234"))
+	require.Equal(t, models.ApprovalCodeApproved, withdraw(security.PINBlockFormat0, "4321"))
+
+	// a block that does not decrypt is declined without counting
+	res, err := svc.AuthorizeRequest(models.AuthorizationRequest{
+		Amount: 10_00, Currency: "USD", Card: presented,
+		Merchant:       models.Merchant{Name: "Demo ATM", MCC: "6011"},
+		ProcessingCode: "010000", PINBlock: "not hex",
+	})
+	require.NoError(t, err)
+	require.Equal(t, models.ApprovalCodeIncorrectPIN, res.ApprovalCode)
+	status, err = svc.GetPINStatus(account.ID, card.ID)
+	require.NoError(t, err)
+	require.Equal(t, 3, status.TriesLeft)
+}
+
+func TestDCVV(t *testing.T) {
+	cfg := issuer.DefaultConfig()
+	cfg.DCVV = issuer.DCVVConfig{Step: time.Hour, Tolerance: 1}
+	svc := issuer.NewService(issuer.NewRepository(), cfg)
+
+	account, err := svc.CreateAccount(models.CreateAccount{Balance: 100_00, Currency: "USD"})
+	require.NoError(t, err)
+	card, err := svc.IssueCard(account.ID)
+	require.NoError(t, err)
+	_, _, err = svc.ChangeCardStatus(account.ID, card.ID, models.ChangeCardStatus{Status: models.CardStatusActive, Actor: "test"})
+	require.NoError(t, err)
+
+	presented := *card
+	presented.ExpirationDate, err = expiry.ParseCardFace(card.ExpirationDate)
+	require.NoError(t, err)
+
+	authorize := func(cvv, rrn string, amount int64) string {
+		card := presented
+		card.CardVerificationValue = cvv
+		res, err := svc.AuthorizeRequest(models.AuthorizationRequest{Amount: amount, Currency: "USD", Card: card, RRN: rrn})
+		require.NoError(t, err)
+		return res.ApprovalCode
+	}
+	// the codes of the windows around the current one, as the app would show them
+	provider := security.NewDemoProviderStrict(security.DemoKey())
+	dcvvAt := func(windows int) string {
+		cvv, _, err := provider.ComputeDCVVAt(card.Number[:len(card.Number)-1], presented.ExpirationDate, "000",
+			time.Now().Add(time.Duration(windows)*time.Hour), time.Hour, 3)
+		require.NoError(t, err)
+		return cvv
+	}
+	// 3-digit codes of neighbouring windows may collide, which changes the
+	// window a code matches
+	seen := map[string]bool{card.CardVerificationValue: true}
+	for windows := -2; windows <= 1; windows++ {
+		if seen[dcvvAt(windows)] {
+			t.Skip("codes of neighbouring windows collide")
+		}
+		seen[dcvvAt(windows)] = true
+	}
+
+	_, err = svc.GetDCVV(account.ID, card.ID, card.Number)
+	require.ErrorIs(t, err, models.ErrDCVVNotEnabled)
+
+	status, err := svc.SetDCVV(account.ID, card.ID, models.SetDCVV{Enabled: true})
+	require.NoError(t, err)
+	require.Equal(t, &models.DCVVStatus{CardID: card.ID, Enabled: true}, status)
+
+	_, err = svc.GetDCVV(account.ID, card.ID, "4111111111111111")
+	require.ErrorIs(t, err, models.ErrCardNumberMismatch)
+
+	dcvv, err := svc.GetDCVV(account.ID, card.ID, card.Number)
+	require.NoError(t, err)
+	require.Equal(t, dcvvAt(0), dcvv.CVV)
+	require.True(t, dcvv.TTL > 0 && dcvv.TTL <= 3600, "ttl %d", dcvv.TTL)
+	require.WithinDuration(t, time.Now().Add(time.Duration(dcvv.TTL)*time.Second), dcvv.ExpiresAt, 2*time.Second)
+
+	// the printed CVV2 is no longer accepted
+	require.Equal(t, models.ApprovalCodeCVVMismatch, authorize(card.CardVerificationValue, "000000000001", 1_00))
+
+	// one approved authorization per code
+	require.Equal(t, models.ApprovalCodeApproved, authorize(dcvv.CVV, "000000000002", 1_00))
+	require.Equal(t, models.ApprovalCodeCVVMismatch, authorize(dcvv.CVV, "000000000003", 1_00))
+
+	// a declined authorization does not use the code up
+	require.Equal(t, models.ApprovalCodeInsufficientFunds, authorize(dcvvAt(1), "000000000004", 1000_00))
+	require.Equal(t, models.ApprovalCodeApproved, authorize(dcvvAt(1), "000000000005", 1_00))
+
+	// clock skew: one window back is accepted, two are not
+	require.Equal(t, models.ApprovalCodeApproved, authorize(dcvvAt(-1), "000000000006", 1_00))
+	require.Equal(t, models.ApprovalCodeCVVMismatch, authorize(dcvvAt(-2), "000000000007", 1_00))
+
+	_, err = svc.SetDCVV(account.ID, "unknown", models.SetDCVV{Enabled: true})
+	require.ErrorIs(t, err, issuer.ErrNotFound)
+}
+
+func TestCutover(t *testing.T) {
+	// the scheduled rollover keeps the business date on today
+	svc := issuer.NewService(issuer.NewRepository(), issuer.DefaultConfig())
+	today, err := svc.BusinessDate()
+	require.NoError(t, err)
+	businessDate, err := svc.Cutover()
+	require.NoError(t, err)
+	require.Equal(t, today, businessDate)
+
+	// a network cutover closes the day
+	cfg := issuer.DefaultConfig()
+	cfg.Cutover = issuer.CutoverNetwork
+	svc = issuer.NewService(issuer.NewRepository(), cfg)
+	businessDate, err = svc.Cutover()
+	require.NoError(t, err)
+	require.Equal(t, today.AddDate(0, 0, 1), businessDate)
+
+	// and the rollover never moves it back
+	businessDate, err = svc.RollBusinessDate()
+	require.NoError(t, err)
+	require.Equal(t, today.AddDate(0, 0, 1), businessDate)
+}
+
+func TestOpenKeyStore(t *testing.T) {
+	t.Setenv("KEYS_STORE", "")
+	t.Setenv("PAN_HASH_KEY", "")
+
+	// without a store the demo keys are used
+	cfg := issuer.DefaultConfig()
+	store, err := issuer.OpenKeyStore(cfg)
+	require.NoError(t, err)
+	pepper, err := issuer.PANHashKey(store, cfg)
+	require.NoError(t, err)
+	require.Equal(t, []byte("dev-secret-pepper"), pepper)
+	zpk, err := store.Active(keys.PurposeZPK)
+	require.NoError(t, err)
+	require.Equal(t, security.DemoZPK(), zpk.Material())
+
+	cfg.Keys.StorePath = filepath.Join(t.TempDir(), "keys.json")
+	t.Setenv(keys.MasterKeyEnv, "")
+	_, err = issuer.OpenKeyStore(cfg)
+	require.ErrorContains(t, err, keys.MasterKeyEnv)
+
+	t.Setenv(keys.MasterKeyEnv, strings.Repeat("42", 32))
+	store, err = issuer.OpenKeyStore(cfg)
+	require.NoError(t, err)
+	_, err = issuer.PANHashKey(store, cfg)
+	require.ErrorIs(t, err, keys.ErrNotFound)
+
+	_, err = store.ImportComponents(keys.PurposePANPepper, keys.AlgorithmHMAC, []byte("pepper-1"), []byte("xor-part"))
+	require.NoError(t, err)
+	_, err = store.Import(keys.PurposePANPepper, keys.AlgorithmHMAC, []byte("pepper-2"))
+	require.NoError(t, err)
+
+	// the active version unless one is pinned
+	store, err = issuer.OpenKeyStore(cfg)
+	require.NoError(t, err)
+	pepper, err = issuer.PANHashKey(store, cfg)
+	require.NoError(t, err)
+	require.Equal(t, []byte("pepper-2"), pepper)
+	cfg.Keys.Versions = map[keys.Purpose]int{keys.PurposePANPepper: 1}
+	pepper, err = issuer.PANHashKey(store, cfg)
+	require.NoError(t, err)
+	v1, err := keys.CombineComponents([]byte("pepper-1"), []byte("xor-part"))
+	require.NoError(t, err)
+	require.Equal(t, v1, pepper)
+}
+
+func TestOpenKeyStore_KeyBlocks(t *testing.T) {
+	t.Setenv("KEYS_STORE", "")
+	t.Setenv("ZMK_DEMO", "89E88CF7931444F334BD7547FC3F380C")
+	t.Setenv("ZPK_TR31", "")
+
+	// the partner wraps the CVK under the ZMK both sides share
+	partner := keys.NewStore()
+	zmk, err := partner.Import(keys.PurposeZMK, keys.AlgorithmTDES, mustHex(t, "89E88CF7931444F334BD7547FC3F380C"))
+	require.NoError(t, err)
+	cvk, err := partner.Import(keys.PurposeCVK, keys.AlgorithmTDES, mustHex(t, "0123456789ABCDEFFEDCBA9876543210"))
+	require.NoError(t, err)
+	block, err := tr31.Export(zmk, cvk, tr31.ExportNone)
+	require.NoError(t, err)
+
+	// the block replaces the demo CVK
+	t.Setenv("CVK_TR31", block)
+	cfg := issuer.DefaultConfig()
+	store, err := issuer.OpenKeyStore(cfg)
+	require.NoError(t, err)
+	active, err := store.Active(keys.PurposeCVK)
+	require.NoError(t, err)
+	require.Equal(t, "08D7B4", active.KCV)
+
+	// a file store imports it once
+	cfg.Keys.StorePath = filepath.Join(t.TempDir(), "keys.json")
+	t.Setenv(keys.MasterKeyEnv, strings.Repeat("42", 32))
+	_, err = issuer.OpenKeyStore(cfg)
+	require.ErrorIs(t, err, keys.ErrNotFound)
+
+	store, err = keys.Open(cfg.Keys.StorePath, mustHex(t, strings.Repeat("42", 32)))
+	require.NoError(t, err)
+	_, err = store.Import(keys.PurposeZMK, keys.AlgorithmTDES, zmk.Material())
+	require.NoError(t, err)
+	for i := 0; i < 2; i++ {
+		store, err = issuer.OpenKeyStore(cfg)
+		require.NoError(t, err)
+	}
+	require.Len(t, store.List(), 2)
+
+	// a block must hold a key of its purpose
+	cfg.Keys.Blocks = map[keys.Purpose]string{keys.PurposeZPK: block}
+	_, err = issuer.OpenKeyStore(cfg)
+	require.ErrorContains(t, err, "ZPK key block holds a CVK")
+}
+
+func TestKeyRotation(t *testing.T) {
+	t.Setenv("KEYS_STORE", "")
+	t.Setenv("ZPK_TR31", "")
+	t.Setenv("CVK_TR31", "")
+
+	cfg := issuer.DefaultConfig()
+	store, err := issuer.OpenKeyStore(cfg)
+	require.NoError(t, err)
+	repo := issuer.NewRepository()
+	svc := issuer.NewService(repo, cfg)
+	closeCVV, err := svc.UseKeyStore(store)
+	require.NoError(t, err)
+	defer closeCVV()
+
+	account, err := svc.CreateAccount(models.CreateAccount{Balance: 1000_00, Currency: "USD"})
+	require.NoError(t, err)
+	card, err := svc.IssueCard(account.ID)
+	require.NoError(t, err)
+	require.Equal(t, 1, card.CVKVersion)
+	_, _, err = svc.ChangeCardStatus(account.ID, card.ID, models.ChangeCardStatus{Status: models.CardStatusActive, Actor: "test"})
+	require.NoError(t, err)
+	_, err = svc.SetPIN(account.ID, card.ID, models.SetPIN{CardNumber: card.Number, PIN: "1234"})
+	require.NoError(t, err)
+
+	// new versions of the CVK and the PVK become the active ones
+	_, err = store.Import(keys.PurposeCVK, keys.AlgorithmHMAC, []byte("cvk-version-2"))
+	require.NoError(t, err)
+	_, err = store.Import(keys.PurposePVK, keys.AlgorithmTDES, mustHex(t, "0123456789ABCDEFFEDCBA9876543210"))
+	require.NoError(t, err)
+	rotated := issuer.NewService(repo, cfg)
+	closeRotated, err := rotated.UseKeyStore(store)
+	require.NoError(t, err)
+	defer closeRotated()
+
+	// the card issued before is still verified with the versions it was issued under
+	presented := *card
+	presented.ExpirationDate, err = expiry.ParseCardFace(card.ExpirationDate)
+	require.NoError(t, err)
+	res, err := rotated.AuthorizeRequest(models.AuthorizationRequest{
+		Amount:   10_00,
+		Currency: "USD",
+		Card:     presented,
+		Merchant: models.Merchant{Name: "Demo Shop", MCC: "5411"},
+	})
+	require.NoError(t, err)
+	require.Equal(t, models.ApprovalCodeApproved, res.ApprovalCode)
+
+	block, err := security.EncryptPINBlock(security.PINBlockFormat0, "1234", card.Number, security.DemoZPK())
+	require.NoError(t, err)
+	presented.CardVerificationValue = ""
+	res, err = rotated.AuthorizeRequest(models.AuthorizationRequest{
+		Amount:         10_00,
+		Currency:       "USD",
+		Card:           presented,
+		Merchant:       models.Merchant{Name: "Demo ATM", MCC: "6011"},
+		ProcessingCode: "010000",
+		PINBlock:       hex.EncodeToString(block),
+	})
+	require.NoError(t, err)
+	require.Equal(t, models.ApprovalCodeApproved, res.ApprovalCode)
+
+	// new cards get the new version
+	card, err = rotated.IssueCard(account.ID)
+	require.NoError(t, err)
+	require.Equal(t, 2, card.CVKVersion)
+}
+
+func mustHex(t *testing.T, s string) []byte {
+	t.Helper()
+	b, err := hex.DecodeString(s)
+	require.NoError(t, err)
+	return b
+}
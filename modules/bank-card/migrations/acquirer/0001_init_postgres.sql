@@ -0,0 +1,66 @@
+create schema if not exists acquirer;
+
+create or replace function acquirer_set_updated_at() returns trigger as $$
+begin new.updated_at = now(); return new; end $$ language plpgsql;
+
+create table if not exists acquirer.merchants (
+  merchant_id  uuid primary key,
+  name         text    not null,
+  mcc          text    not null,
+  postal_code  text,
+  website      text,
+  created_at   timestamptz not null default now()
+);
+
+create table if not exists acquirer.payments (
+  payment_id         uuid primary key,
+  merchant_id        uuid not null references acquirer.merchants(merchant_id) on delete restrict,
+  amount             bigint  not null check (amount > 0),
+  currency           char(3) not null,
+  card_first6        char(6) not null,
+  card_last4         char(4) not null,
+  card_expiry        text    not null,
+  status             text    not null,
+  authorization_code text,
+  stan               text,
+  captured_amount    bigint  not null default 0 check (captured_amount >= 0),
+  refunded_amount    bigint  not null default 0 check (refunded_amount >= 0),
+  created_at         timestamptz not null,
+  updated_at         timestamptz not null default now(),
+  constraint chk_currency_upper check (currency = upper(currency)),
+  constraint chk_captured check (captured_amount <= amount),
+  constraint chk_refunded check (refunded_amount <= captured_amount),
+  constraint chk_status check (status in ('pending','error','authorized','declined','reversal_pending','reversed',
+                                          'partially_captured','captured','voided','refunded'))
+);
+create trigger trg_payments_updated before update on acquirer.payments
+for each row execute function acquirer_set_updated_at();
+create index if not exists idx_payments_merchant on acquirer.payments(merchant_id, created_at desc);
+
+-- PAN and expiry of payments, kept for the follow-up messages the issuer
+-- matches by card (captures, refunds, reversals, advices); the CVV is never stored
+create table if not exists acquirer.payment_cards (
+  payment_id  uuid primary key references acquirer.payments(payment_id) on delete cascade,
+  pan         text not null,
+  expiry      text not null
+);
+
+create table if not exists acquirer.refunds (
+  refund_id   uuid primary key,
+  payment_id  uuid not null references acquirer.payments(payment_id) on delete restrict,
+  amount      bigint  not null check (amount > 0),
+  currency    char(3) not null,
+  created_at  timestamptz not null default now()
+);
+create index if not exists idx_refunds_payment on acquirer.refunds(payment_id);
+
+-- every change to a payment, with the status and amounts it left the payment in
+create table if not exists acquirer.payment_events (
+  event_id         uuid primary key,
+  payment_id       uuid not null references acquirer.payments(payment_id) on delete restrict,
+  status           text   not null,
+  captured_amount  bigint not null,
+  refunded_amount  bigint not null,
+  created_at       timestamptz not null default now()
+);
+create index if not exists idx_payment_events_payment on acquirer.payment_events(payment_id, created_at);
@@ -0,0 +1,12 @@
+-- Idempotency-Key headers of payment requests, per merchant; the payment is
+-- the response of the first request (null while it is in flight)
+create table if not exists acquirer.idempotency_keys (
+  merchant_id     uuid not null references acquirer.merchants(merchant_id) on delete cascade,
+  idempotency_key text not null,
+  fingerprint     text not null,
+  payment         jsonb,
+  created_at      timestamptz not null default now(),
+  expires_at      timestamptz not null,
+  primary key (merchant_id, idempotency_key)
+);
+create index if not exists idx_idempotency_keys_expiry on acquirer.idempotency_keys(expires_at);
@@ -0,0 +1,24 @@
+-- card acceptor ID (DE42) of merchants; merchants created before get one generated
+alter table acquirer.merchants add column if not exists mid text;
+update acquirer.merchants set mid = lpad((floor(random() * 1e15))::bigint::text, 15, '0') where mid is null;
+alter table acquirer.merchants alter column mid set not null;
+create unique index if not exists uq_merchants_mid on acquirer.merchants(mid);
+
+-- terminals of merchants; every terminal numbers its messages with its own STAN sequence
+create table if not exists acquirer.terminals (
+  terminal_id  uuid primary key,
+  merchant_id  uuid not null references acquirer.merchants(merchant_id) on delete cascade,
+  tid          text not null unique check (length(tid) between 1 and 8),
+  created_at   timestamptz not null default now()
+);
+create index if not exists idx_terminals_merchant on acquirer.terminals(merchant_id, created_at);
+
+insert into acquirer.terminals(terminal_id, merchant_id, tid)
+select gen_random_uuid(), m.merchant_id, lpad((floor(random() * 1e8))::bigint::text, 8, '0')
+  from acquirer.merchants m
+ where not exists (select 1 from acquirer.terminals t where t.merchant_id = m.merchant_id);
+
+-- terminal of the payment, with the TID and MID the messages were sent with
+alter table acquirer.payments add column if not exists terminal_id uuid references acquirer.terminals(terminal_id) on delete restrict;
+alter table acquirer.payments add column if not exists tid text;
+alter table acquirer.payments add column if not exists mid text;
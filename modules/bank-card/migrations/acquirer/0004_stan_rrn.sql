@@ -0,0 +1,14 @@
+-- last STAN used by every terminal per transmission date (UTC); STANs start
+-- again at 000001 every day and survive restarts
+create table if not exists acquirer.stan_sequences (
+  tid               text not null,
+  transmission_date date not null,
+  last_stan         int  not null check (last_stan between 1 and 999999),
+  primary key (tid, transmission_date)
+);
+
+-- MTI and retrieval reference number (DE37) of the message that authorized
+-- the payment
+alter table acquirer.payments add column if not exists mti text;
+alter table acquirer.payments add column if not exists rrn text;
+create index if not exists idx_payments_rrn on acquirer.payments(tid, rrn);
@@ -0,0 +1,50 @@
+-- end-of-day settlement batches, one per merchant and clearing file
+create table if not exists acquirer.batches (
+  batch_id            uuid primary key,
+  merchant_id         uuid not null references acquirer.merchants(merchant_id) on delete restrict,
+  mid                 text not null,
+  business_date       date not null,
+  file_id             text not null,
+  presentments        int    not null check (presentments >= 0),
+  presentment_amount  bigint not null check (presentment_amount >= 0),
+  refunds             int    not null check (refunds >= 0),
+  refund_amount       bigint not null check (refund_amount >= 0),
+  closed_at           timestamptz not null default now()
+);
+create index if not exists idx_batches_merchant on acquirer.batches(merchant_id, closed_at);
+
+-- captures the issuer approved, presented in the next batch of the merchant;
+-- captures made before this table existed were settled online only and are
+-- not presented
+create table if not exists acquirer.captures (
+  capture_id  uuid primary key,
+  payment_id  uuid not null references acquirer.payments(payment_id) on delete restrict,
+  amount      bigint  not null check (amount > 0),
+  currency    char(3) not null,
+  stan        text,
+  batch_id    uuid references acquirer.batches(batch_id),
+  created_at  timestamptz not null default now()
+);
+create index if not exists idx_captures_payment on acquirer.captures(payment_id);
+create index if not exists idx_captures_uncleared on acquirer.captures(created_at) where batch_id is null;
+
+-- refunds are presented the same way
+alter table acquirer.refunds add column if not exists stan text;
+alter table acquirer.refunds add column if not exists batch_id uuid references acquirer.batches(batch_id);
+create index if not exists idx_refunds_uncleared on acquirer.refunds(created_at) where batch_id is null;
+
+-- refunds made before were settled online only; they go into one batch per
+-- merchant that is never written to a clearing file
+insert into acquirer.batches(batch_id, merchant_id, mid, business_date, file_id,
+                             presentments, presentment_amount, refunds, refund_amount)
+select gen_random_uuid(), m.merchant_id, m.mid, current_date, 'settled-online', 0, 0, count(*), sum(r.amount)
+  from acquirer.refunds r
+  join acquirer.payments p on p.payment_id = r.payment_id
+  join acquirer.merchants m on m.merchant_id = p.merchant_id
+ where r.batch_id is null
+ group by m.merchant_id, m.mid;
+update acquirer.refunds r
+   set batch_id = b.batch_id
+  from acquirer.payments p, acquirer.batches b
+ where r.batch_id is null and p.payment_id = r.payment_id
+   and b.merchant_id = p.merchant_id and b.file_id = 'settled-online';
@@ -0,0 +1,19 @@
+-- chargebacks the issuers raised against payments, one per dispute
+create table if not exists acquirer.chargebacks (
+  chargeback_id  uuid primary key,
+  payment_id     uuid not null references acquirer.payments(payment_id) on delete restrict,
+  merchant_id    uuid not null references acquirer.merchants(merchant_id) on delete restrict,
+  dispute_id     text not null unique,
+  amount         bigint  not null check (amount > 0),
+  currency       char(3) not null,
+  reason_code    text    not null,
+  status         text    not null,
+  evidence       text,
+  reason         text,
+  created_at     timestamptz not null default now(),
+  updated_at     timestamptz not null default now(),
+  constraint chk_status check (status in ('chargeback','representment','pre_arbitration','won','lost'))
+);
+create trigger trg_chargebacks_updated before update on acquirer.chargebacks
+for each row execute function acquirer_set_updated_at();
+create index if not exists idx_chargebacks_payment on acquirer.chargebacks(payment_id, created_at);
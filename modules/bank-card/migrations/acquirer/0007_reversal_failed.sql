@@ -0,0 +1,5 @@
+-- reversal_failed: the issuer rejected the reversal (or its advice) for good
+-- and it was parked for manual handling
+alter table acquirer.payments drop constraint if exists chk_status;
+alter table acquirer.payments add constraint chk_status check (status in ('pending','error','authorized','declined',
+  'reversal_pending','reversed','reversal_failed','partially_captured','captured','voided','refunded'));
@@ -0,0 +1,7 @@
+-- PANs of payments are sealed with the acquirer's DEK (see internal/keys)
+-- into pan_token; the acquirer seals the clear PANs stored before at start
+-- and empties pan
+alter table acquirer.payment_cards add column if not exists pan_token text;
+alter table acquirer.payment_cards alter column pan drop not null;
+alter table acquirer.payment_cards drop constraint if exists chk_pan;
+alter table acquirer.payment_cards add constraint chk_pan check (pan is not null or pan_token is not null);
@@ -0,0 +1,12 @@
+-- audit trail for card lifecycle transitions (issuer.cards.status)
+create table if not exists issuer.card_status_changes (
+  change_id   uuid primary key,
+  card_id     uuid not null references issuer.cards(card_id) on delete restrict,
+  from_status text not null,
+  to_status   text not null,
+  reason      text,
+  actor       text not null,
+  changed_at  timestamptz not null default now(),
+  constraint chk_status_change_to check (to_status in ('ISSUED','ACTIVE','FROZEN','LOST','STOLEN','CLOSED'))
+);
+create index if not exists idx_card_status_changes_card on issuer.card_status_changes(card_id, changed_at);
@@ -0,0 +1,9 @@
+-- terminal (DE41) and card acceptor (DE42) of the authorization; acquirers keep
+-- a STAN sequence per terminal, so duplicates are detected per terminal
+alter table issuer.auths add column if not exists terminal_id      text not null default '';
+alter table issuer.auths add column if not exists card_acceptor_id text;
+
+drop index if exists issuer.uq_auth_card_stan;
+create unique index if not exists uq_auth_card_terminal_stan
+  on issuer.auths(card_id, terminal_id, stan)
+  where stan is not null;
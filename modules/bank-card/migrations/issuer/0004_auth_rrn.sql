@@ -0,0 +1,14 @@
+-- retrieval reference number (DE37) and transmission date and time (DE7) of
+-- the authorization. Acquirers restart STANs per terminal and day, so the RRN
+-- is the idempotency key; follow-ups without an RRN are matched by the
+-- original data elements (DE90)
+alter table issuer.auths add column if not exists rrn            text;
+alter table issuer.auths add column if not exists transmitted_at timestamptz;
+
+drop index if exists issuer.uq_auth_card_terminal_stan;
+create unique index if not exists uq_auth_card_terminal_rrn
+  on issuer.auths(card_id, terminal_id, rrn)
+  where rrn is not null;
+create index if not exists idx_auths_original
+  on issuer.auths(card_id, terminal_id, stan, transmitted_at)
+  where stan is not null;
@@ -0,0 +1,32 @@
+-- STAN of the capture or refund message that posted a transaction online,
+-- and the clearing record that presented it
+alter table issuer.transactions add column if not exists stan               int;
+alter table issuer.transactions add column if not exists clearing_reference text;
+create unique index if not exists uq_tx_clearing_reference
+  on issuer.transactions(clearing_reference)
+  where clearing_reference is not null;
+create index if not exists idx_tx_auth on issuer.transactions(auth_id, status, stan)
+  where auth_id is not null;
+
+-- every record of the acquirers' clearing files, applied once by reference
+create table if not exists issuer.clearing_records (
+  reference   text primary key,
+  file_id     text    not null,
+  batch_id    text    not null,
+  code        char(2) not null,
+  card_id     uuid references issuer.cards(card_id),
+  auth_id     uuid references issuer.auths(auth_id),
+  tx_id       uuid references issuer.transactions(tx_id),
+  amount      bigint  not null check (amount > 0),
+  currency    char(3) not null,
+  result      text    not null,
+  reason      text,
+  created_at  timestamptz not null default now(),
+  constraint chk_code   check (code in ('05','06')),
+  constraint chk_result check (result in ('POSTED','MATCHED','FORCE_POSTED','REJECTED'))
+);
+create index if not exists idx_clearing_records_file on issuer.clearing_records(file_id);
+
+-- presentments are posted even without funds, so force-posted ones may
+-- overdraw the account; authorizations still require the available balance
+alter table issuer.accounts drop constraint if exists accounts_available_balance_check;
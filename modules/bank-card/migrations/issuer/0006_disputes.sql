@@ -0,0 +1,33 @@
+-- cardholder disputes of posted transactions; opening one credits the
+-- account provisionally, losing it reverses the credit
+create table if not exists issuer.disputes (
+  dispute_id            uuid primary key,
+  account_id            uuid not null references issuer.accounts(account_id) on delete restrict,
+  tx_id                 uuid not null references issuer.transactions(tx_id) on delete restrict,
+  auth_id               uuid references issuer.auths(auth_id),
+  amount                bigint  not null check (amount > 0),
+  currency              char(3) not null,
+  reason_code           text    not null,
+  description           text,
+  status                text    not null,
+  provisional_credit_id uuid not null references issuer.transactions(tx_id),
+  created_at            timestamptz not null default now(),
+  updated_at            timestamptz not null default now(),
+  constraint uq_disputes_tx unique (tx_id),
+  constraint chk_status check (status in ('OPENED','CHARGEBACK','REPRESENTMENT','PRE_ARBITRATION','WON','LOST'))
+);
+create trigger trg_disputes_updated before update on issuer.disputes
+for each row execute function issuer_set_updated_at();
+create index if not exists idx_disputes_account on issuer.disputes(account_id, created_at);
+
+-- audit trail for dispute transitions (issuer.disputes.status)
+create table if not exists issuer.dispute_status_changes (
+  change_id   uuid primary key,
+  dispute_id  uuid not null references issuer.disputes(dispute_id) on delete restrict,
+  from_status text not null,
+  to_status   text not null,
+  reason      text,
+  actor       text not null,
+  changed_at  timestamptz not null default now()
+);
+create index if not exists idx_dispute_status_changes_dispute on issuer.dispute_status_changes(dispute_id, changed_at);
@@ -0,0 +1,86 @@
+-- append-only double-entry ledger; the balance columns of issuer.accounts
+-- are a projection of the postings to the customer ledger accounts
+create table if not exists issuer.ledger_accounts (
+  code        text primary key,
+  kind        text    not null,
+  account_id  uuid references issuer.accounts(account_id) on delete restrict,
+  currency    char(3) not null,
+  created_at  timestamptz not null default now(),
+  constraint chk_kind     check (kind in ('CUSTOMER_AVAILABLE','CUSTOMER_HOLD','SETTLEMENT','FEES','FUNDING')),
+  constraint chk_customer check ((kind like 'CUSTOMER_%') = (account_id is not null))
+);
+create index if not exists idx_ledger_accounts_account on issuer.ledger_accounts(account_id)
+  where account_id is not null;
+
+create table if not exists issuer.journal_entries (
+  entry_id    uuid primary key,
+  kind        text    not null,
+  account_id  uuid references issuer.accounts(account_id) on delete restrict,
+  auth_id     uuid references issuer.auths(auth_id),
+  tx_id       uuid references issuer.transactions(tx_id),
+  currency    char(3) not null,
+  created_at  timestamptz not null default now()
+);
+create index if not exists idx_journal_entries_account on issuer.journal_entries(account_id, created_at);
+create index if not exists idx_journal_entries_auth on issuer.journal_entries(auth_id)
+  where auth_id is not null;
+
+create table if not exists issuer.postings (
+  posting_id     bigserial primary key,
+  entry_id       uuid   not null references issuer.journal_entries(entry_id) on delete restrict,
+  ledger_account text   not null references issuer.ledger_accounts(code) on delete restrict,
+  amount         bigint not null check (amount <> 0),
+  created_at     timestamptz not null default now()
+);
+create index if not exists idx_postings_entry   on issuer.postings(entry_id);
+create index if not exists idx_postings_account on issuer.postings(ledger_account);
+
+-- the postings of an entry must sum to zero when the transaction commits
+create or replace function issuer_check_entry_balanced() returns trigger as $$
+begin
+  if (select sum(amount) from issuer.postings where entry_id = new.entry_id) <> 0 then
+    raise exception 'journal entry % is not balanced', new.entry_id;
+  end if;
+  return null;
+end $$ language plpgsql;
+create constraint trigger trg_postings_balanced after insert on issuer.postings
+deferrable initially deferred
+for each row execute function issuer_check_entry_balanced();
+
+-- mistakes are corrected with new entries, never by changing posted ones
+create or replace function issuer_ledger_append_only() returns trigger as $$
+begin raise exception '% is append-only', tg_table_name; end $$ language plpgsql;
+create trigger trg_journal_entries_append_only before update or delete on issuer.journal_entries
+for each row execute function issuer_ledger_append_only();
+create trigger trg_journal_entries_no_truncate before truncate on issuer.journal_entries
+for each statement execute function issuer_ledger_append_only();
+create trigger trg_postings_append_only before update or delete on issuer.postings
+for each row execute function issuer_ledger_append_only();
+create trigger trg_postings_no_truncate before truncate on issuer.postings
+for each statement execute function issuer_ledger_append_only();
+
+-- open the ledger with the balances of the existing accounts
+insert into issuer.ledger_accounts(code, kind, account_id, currency)
+select 'customer:' || account_id || ':available', 'CUSTOMER_AVAILABLE', account_id, currency from issuer.accounts
+union all
+select 'customer:' || account_id || ':hold', 'CUSTOMER_HOLD', account_id, currency from issuer.accounts
+union all
+select distinct 'funding:' || currency, 'FUNDING', null::uuid, currency from issuer.accounts
+on conflict (code) do nothing;
+
+with opening as (
+  insert into issuer.journal_entries(entry_id, kind, account_id, currency)
+  select gen_random_uuid(), 'OPENING', account_id, currency from issuer.accounts
+   where available_balance <> 0 or hold_balance <> 0
+  returning entry_id, account_id
+)
+insert into issuer.postings(entry_id, ledger_account, amount)
+select o.entry_id, p.code, p.amount
+  from opening o
+  join issuer.accounts a on a.account_id = o.account_id
+ cross join lateral (values
+   ('customer:' || a.account_id || ':available', a.available_balance),
+   ('customer:' || a.account_id || ':hold',      a.hold_balance),
+   ('funding:'  || a.currency,                   -(a.available_balance + a.hold_balance))
+ ) as p(code, amount)
+ where p.amount <> 0;
@@ -0,0 +1,54 @@
+-- credit accounts spend against a limit instead of a prefunded balance; the
+-- available balance goes negative as they draw on it
+alter table issuer.accounts add column if not exists product          text     not null default 'debit';
+alter table issuer.accounts add column if not exists credit_limit     bigint   not null default 0;
+alter table issuer.accounts add column if not exists statement_day    smallint;
+alter table issuer.accounts add column if not exists purchase_apr_bps int      not null default 0;
+alter table issuer.accounts add column if not exists opened_on        date     not null default current_date;
+-- last business date the end of day ran for (interest, late fees, statements)
+alter table issuer.accounts add column if not exists cycle_date       date;
+alter table issuer.accounts add constraint chk_product check (product in ('debit','credit'));
+alter table issuer.accounts add constraint chk_credit_limit check (credit_limit >= 0 and (product = 'credit' or credit_limit = 0));
+alter table issuer.accounts add constraint chk_statement_day check (statement_day between 1 and 28);
+create index if not exists idx_accounts_credit_cycle on issuer.accounts(cycle_date) where product = 'credit';
+
+-- payments, interest and late fees belong to an account, not a card, and are
+-- booked to a business date
+alter table issuer.transactions alter column card_id drop not null;
+alter table issuer.transactions add column if not exists business_date date;
+create index if not exists idx_tx_business_date on issuer.transactions(account_id, status, business_date)
+  where business_date is not null;
+
+alter table issuer.ledger_accounts drop constraint if exists chk_kind;
+alter table issuer.ledger_accounts add constraint chk_kind
+  check (kind in ('CUSTOMER_AVAILABLE','CUSTOMER_HOLD','SETTLEMENT','FEES','FUNDING','INTEREST'));
+
+-- interest accrued on the owed balance at the end of each business date, in
+-- millionths of the minor unit; charged when the statement closes
+create table if not exists issuer.interest_accruals (
+  account_id     uuid   not null references issuer.accounts(account_id) on delete restrict,
+  business_date  date   not null,
+  balance        bigint not null,
+  apr_bps        int    not null,
+  amount_micros  bigint not null,
+  created_at     timestamptz not null default now(),
+  primary key (account_id, business_date)
+);
+
+create table if not exists issuer.statements (
+  statement_id     uuid primary key,
+  account_id       uuid not null references issuer.accounts(account_id) on delete restrict,
+  period_start     date   not null,
+  period_end       date   not null,
+  opening_balance  bigint not null,
+  closing_balance  bigint not null,
+  interest         bigint not null default 0,
+  fees             bigint not null default 0,
+  minimum_payment  bigint not null default 0,
+  due_date         date   not null,
+  late_fee_charged boolean not null default false,
+  created_at       timestamptz not null default now(),
+  constraint uq_statements_period unique (account_id, period_end)
+);
+create index if not exists idx_statements_due on issuer.statements(due_date)
+  where late_fee_charged = false and minimum_payment > 0;
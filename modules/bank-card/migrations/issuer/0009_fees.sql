@@ -0,0 +1,4 @@
+-- fees post as their own transactions, linked to the authorization they were
+-- charged on; the description names the fee rule
+alter table issuer.transactions add column if not exists description text;
+create index if not exists idx_tx_fees on issuer.transactions(auth_id) where status = 'FEE';
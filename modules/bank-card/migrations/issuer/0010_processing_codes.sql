@@ -0,0 +1,9 @@
+-- the processing code (DE3) of an authorization tells its transaction type;
+-- limits and fees are per type
+alter table issuer.auths add column if not exists transaction_type text not null default 'purchase';
+alter table issuer.auths add column if not exists processing_code  char(6);
+alter table issuer.auths add constraint chk_transaction_type
+  check (transaction_type in ('purchase','atm_withdrawal','cash_advance','refund','balance_inquiry'));
+-- daily limits sum a card's authorizations of a type since midnight
+create index if not exists idx_auths_card_type_day on issuer.auths(card_id, transaction_type, created_at)
+  where status in ('AUTHORIZED','CAPTURED');
@@ -0,0 +1,12 @@
+-- PINs are never stored; the issuer keeps their Visa PVV and counts wrong
+-- attempts, blocking the PIN until it is set again
+create table if not exists issuer.card_pins (
+  card_id          uuid primary key references issuer.cards(card_id) on delete restrict,
+  pvki             smallint not null,
+  pvv              char(4)  not null,
+  failed_attempts  int      not null default 0,
+  blocked          boolean  not null default false,
+  updated_at       timestamptz not null default now(),
+  constraint chk_pvki check (pvki between 0 and 9),
+  constraint chk_failed_attempts check (failed_attempts >= 0)
+);
@@ -0,0 +1,11 @@
+-- cards with dCVV enabled accept dynamic CVVs instead of the printed CVV2
+alter table issuer.cards add column if not exists dcvv_enabled boolean not null default false;
+-- the time windows whose dynamic CVV an approved authorization used; another
+-- authorization with the code of the same window is a replay
+create table if not exists issuer.dcvv_uses (
+  card_id       uuid        not null references issuer.cards(card_id) on delete restrict,
+  window_start  timestamptz not null,
+  rrn           text,
+  used_at       timestamptz not null default now(),
+  primary key (card_id, window_start)
+);
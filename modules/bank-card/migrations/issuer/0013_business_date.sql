@@ -0,0 +1,7 @@
+-- the processing day transactions are booked to, shared by every issuer
+-- instance; a single row, moved by the scheduled rollover or a network cutover
+create table if not exists issuer.business_date (
+  id            boolean     primary key default true check (id),
+  business_date date        not null,
+  updated_at    timestamptz not null default now()
+);
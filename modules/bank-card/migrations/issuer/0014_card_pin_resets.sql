@@ -0,0 +1,10 @@
+-- PINs are set once by the cardholder and changed with the old PIN; only
+-- issuer operations reset a forgotten or blocked one, each reset recorded here
+create table if not exists issuer.card_pin_resets (
+  reset_id  uuid primary key,
+  card_id   uuid not null references issuer.cards(card_id) on delete restrict,
+  reason    text,
+  actor     text not null,
+  reset_at  timestamptz not null default now()
+);
+create index if not exists idx_card_pin_resets_card on issuer.card_pin_resets(card_id, reset_at);
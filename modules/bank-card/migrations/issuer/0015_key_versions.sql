@@ -0,0 +1,7 @@
+-- the key store versions of the PAN pepper a card's PAN hash was made with,
+-- of the CVK its CVVs are derived with and of the PVK of its PIN's PVV, so a
+-- new version of a key does not break what the earlier one protected. Rows
+-- from before have none and use the configured version.
+alter table issuer.cards add column if not exists pan_hash_version int;
+alter table issuer.cards add column if not exists cvk_version int;
+alter table issuer.card_pins add column if not exists pvk_version int;